@@ -0,0 +1,397 @@
+// Package dnsproxytest implements local DNS servers for the tests of the code
+// that uses dnsproxy, so that they don't depend on the public resolvers.
+package dnsproxytest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NetworkEnv is the environment variable that enables the tests calling
+// RequireNetwork
+const NetworkEnv = "DNSPROXY_TEST_NETWORK"
+
+// RequireNetwork skips the test unless the NetworkEnv environment variable is
+// set.  The tests that query the public resolvers call it, so that the tests
+// pass without the network access.
+func RequireNetwork(t testing.TB) {
+	if os.Getenv(NetworkEnv) == "" {
+		t.Skipf("the test uses the network, set %s=1 to run it", NetworkEnv)
+	}
+}
+
+// Handler creates the response to req.  If it returns nil, no response is
+// sent.
+type Handler func(req *dns.Msg) *dns.Msg
+
+// Server is a local DNS server started by one of the New functions
+type Server struct {
+	Addr        string            // host:port the server listens on
+	URL         string            // upstream address of the server, e.g. tls://127.0.0.1:853
+	Certificate *x509.Certificate // self-signed certificate of DoT and DoH servers
+
+	accepted int32 // the number of accepted TCP connections
+
+	closers   []func() error
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Accepted returns the number of TCP connections the server has accepted
+func (s *Server) Accepted() int {
+	return int(atomic.LoadInt32(&s.accepted))
+}
+
+// Close stops the server and closes its listeners
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		for _, c := range s.closers {
+			err := c()
+			if err != nil && s.closeErr == nil {
+				s.closeErr = err
+			}
+		}
+	})
+	return s.closeErr
+}
+
+// NewPlainServer starts a plain DNS server on a random port of 127.0.0.1 that
+// serves both UDP and TCP.  If h is nil, every query is answered with an empty
+// response.
+func NewPlainServer(h Handler) (*Server, error) {
+	s := &Server{}
+	l, err := s.listen(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	handler := dnsHandler(h)
+	tcpSrv := &dns.Server{Listener: l, Handler: handler}
+	udpSrv := &dns.Server{PacketConn: pc, Handler: handler}
+	startDNSServer(tcpSrv)
+	startDNSServer(udpSrv)
+
+	s.Addr = l.Addr().String()
+	s.URL = s.Addr
+	s.closers = []func() error{tcpSrv.Shutdown, udpSrv.Shutdown}
+	return s, nil
+}
+
+// NewTLSServer starts a DNS-over-TLS server on a random port of 127.0.0.1.
+// Only TLS 1.3 is supported and the certificate is self-signed, so the
+// clients either skip its verification or trust Server.Certificate.  If h is
+// nil, every query is answered with an empty response.
+func NewTLSServer(h Handler) (*Server, error) {
+	return newTLSServer(h, nil)
+}
+
+// NewMutualTLSServer starts a DNS-over-TLS server like NewTLSServer that
+// requires the clients to present a certificate signed by clientCA, e.g. the
+// self-signed one of NewClientCertificate
+func NewMutualTLSServer(h Handler, clientCA *x509.Certificate) (*Server, error) {
+	return newTLSServer(h, clientCA)
+}
+
+// newTLSServer starts a DNS-over-TLS server, it requires the client
+// certificates signed by clientCA if it's not nil
+func newTLSServer(h Handler, clientCA *x509.Certificate) (*Server, error) {
+	s := &Server{}
+	conf, err := s.newTLSConfig(clientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := s.listen(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := handlerOrDefault(h)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, handler)
+		}
+	}()
+
+	s.Addr = l.Addr().String()
+	s.URL = "tls://" + s.Addr
+	s.closers = []func() error{l.Close}
+	return s, nil
+}
+
+// NewHTTPSServer starts a DNS-over-HTTPS server on a random port of
+// 127.0.0.1.  It serves the GET and POST requests to /dns-query, the
+// certificate is the same as the one of NewTLSServer.  If h is nil, every
+// query is answered with an empty response.
+func NewHTTPSServer(h Handler) (*Server, error) {
+	return newHTTPSServer(h, nil)
+}
+
+// NewMutualHTTPSServer starts a DNS-over-HTTPS server like NewHTTPSServer
+// that requires the clients to present a certificate signed by clientCA
+func NewMutualHTTPSServer(h Handler, clientCA *x509.Certificate) (*Server, error) {
+	return newHTTPSServer(h, clientCA)
+}
+
+// newHTTPSServer starts a DNS-over-HTTPS server, it requires the client
+// certificates signed by clientCA if it's not nil
+func newHTTPSServer(h Handler, clientCA *x509.Certificate) (*Server, error) {
+	s := &Server{}
+	conf, err := s.newTLSConfig(clientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := s.listen(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", dohHandler(handlerOrDefault(h)))
+	srv := &http.Server{Handler: mux, TLSConfig: conf}
+	go func() { _ = srv.ServeTLS(l, "", "") }()
+
+	s.Addr = l.Addr().String()
+	s.URL = "https://" + s.Addr + "/dns-query"
+	s.closers = []func() error{srv.Close}
+	return s, nil
+}
+
+// NewHTTPServer starts a DNS-over-HTTPS server without TLS on a random port of
+// 127.0.0.1, the upstreams need upstream.Options.AllowPlaintextDoH to use it.
+// The queries are served at /dns-query.
+func NewHTTPServer(h Handler) (*Server, error) {
+	s := &Server{}
+	l, err := s.listen(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", dohHandler(handlerOrDefault(h)))
+	srv := &http.Server{Handler: mux}
+	go func() { _ = srv.Serve(l) }()
+
+	s.Addr = l.Addr().String()
+	s.URL = "http://" + s.Addr + "/dns-query"
+	s.closers = []func() error{srv.Close}
+	return s, nil
+}
+
+// listen listens on a random TCP port of 127.0.0.1 and counts the accepted
+// connections, conf enables TLS if it's not nil
+func (s *Server) listen(conf *tls.Config) (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	var cl net.Listener = &countingListener{Listener: l, accepted: &s.accepted}
+	if conf != nil {
+		cl = tls.NewListener(cl, conf)
+	}
+	return cl, nil
+}
+
+// newTLSConfig creates the TLS 1.3-only server configuration with a new
+// self-signed certificate and sets it to s.Certificate.  The client
+// certificates signed by clientCA are required if it's not nil.
+func (s *Server) newTLSConfig(clientCA *x509.Certificate) (*tls.Config, error) {
+	cert, err := newCertificate(x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Certificate, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}
+	if clientCA != nil {
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+		conf.ClientCAs = x509.NewCertPool()
+		conf.ClientCAs.AddCert(clientCA)
+	}
+	return conf, nil
+}
+
+// NewClientCertificate generates a self-signed client certificate valid for a
+// day for the servers of NewMutualTLSServer and NewMutualHTTPSServer
+func NewClientCertificate() (tls.Certificate, error) {
+	return newCertificate(x509.ExtKeyUsageClientAuth)
+}
+
+// newCertificate generates a self-signed certificate for 127.0.0.1, ::1 and
+// localhost valid for a day
+func newCertificate(usage x509.ExtKeyUsage) (tls.Certificate, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"AdGuard Tests"}},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:              []string{"localhost"},
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{derBytes}, PrivateKey: privateKey}, nil
+}
+
+// countingListener counts the accepted connections
+type countingListener struct {
+	net.Listener
+	accepted *int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(l.accepted, 1)
+	}
+	return conn, err
+}
+
+// handlerOrDefault returns h or the handler that responds with an empty
+// response if h is nil
+func handlerOrDefault(h Handler) Handler {
+	if h != nil {
+		return h
+	}
+	return func(req *dns.Msg) *dns.Msg {
+		return new(dns.Msg).SetReply(req)
+	}
+}
+
+// dnsHandler adapts h to dns.Handler
+func dnsHandler(h Handler) dns.Handler {
+	h = handlerOrDefault(h)
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := h(req)
+		if res != nil {
+			_ = w.WriteMsg(res)
+		}
+	})
+}
+
+// startDNSServer starts srv and waits until it's ready to serve
+func startDNSServer(srv *dns.Server) {
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+}
+
+// serveConn answers the queries sent over the DNS-over-TLS connection until
+// it's closed
+func serveConn(conn net.Conn, h Handler) {
+	defer conn.Close()
+
+	c := dns.Conn{Conn: conn}
+	for {
+		req, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+
+		res := h(req)
+		if res == nil {
+			continue
+		}
+		err = c.WriteMsg(res)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dohHandler serves the DNS-over-HTTPS requests, the wire format only
+func dohHandler(h Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			buf, err = ioutil.ReadAll(r.Body)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req := new(dns.Msg)
+		err = req.Unpack(buf)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res := h(req)
+		if res == nil {
+			http.Error(w, "no response", http.StatusInternalServerError)
+			return
+		}
+
+		buf, err = res.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(buf)
+	})
+}
@@ -0,0 +1,188 @@
+package dnsproxytest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testHandler answers every query with an A record
+func testHandler(req *dns.Msg) *dns.Msg {
+	res := new(dns.Msg).SetReply(req)
+	res.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	}}
+	return res
+}
+
+// checkResponse checks that res is the response of testHandler to req
+func checkResponse(t *testing.T, req, res *dns.Msg) {
+	if res == nil {
+		t.Fatalf("no response")
+	}
+	assert.Equal(t, req.Id, res.Id)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "192.0.2.1", res.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestPlainServer(t *testing.T) {
+	srv, err := NewPlainServer(testHandler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+	assert.Equal(t, srv.Addr, srv.URL)
+
+	for _, network := range []string{"udp", "tcp"} {
+		c := &dns.Client{Net: network, Timeout: time.Second}
+		req := new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+		res, _, err := c.Exchange(req, srv.Addr)
+		if err != nil {
+			t.Fatalf("cannot exchange over %s: %s", network, err)
+		}
+		checkResponse(t, req, res)
+	}
+	assert.Equal(t, 1, srv.Accepted())
+
+	assert.Nil(t, srv.Close())
+	assert.Nil(t, srv.Close())
+}
+
+func TestTLSServer(t *testing.T) {
+	srv, err := NewTLSServer(testHandler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+	assert.Equal(t, "tls://"+srv.Addr, srv.URL)
+
+	// The certificate is valid for the address
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate)
+	c := &dns.Client{Net: "tcp-tls", Timeout: time.Second, TLSConfig: &tls.Config{RootCAs: roots}}
+
+	conn, err := c.Dial(srv.Addr)
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer conn.Close()
+
+	// Several queries are answered over the same connection
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+		res, _, err := c.ExchangeWithConn(req, conn)
+		if err != nil {
+			t.Fatalf("cannot exchange: %s", err)
+		}
+		checkResponse(t, req, res)
+	}
+	assert.Equal(t, 1, srv.Accepted())
+}
+
+func TestMutualTLSServer(t *testing.T) {
+	cert, err := NewClientCertificate()
+	if err != nil {
+		t.Fatalf("cannot generate the client certificate: %s", err)
+	}
+	ca, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("cannot parse the client certificate: %s", err)
+	}
+
+	srv, err := NewMutualTLSServer(testHandler, ca)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
+	// The handshake of TLS 1.3 finishes before the server verifies the
+	// client, so the exchange fails without the certificate
+	req := new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+	c := &dns.Client{Net: "tcp-tls", Timeout: time.Second, TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	_, _, err = c.Exchange(req, srv.Addr)
+	assert.NotNil(t, err)
+
+	c.TLSConfig.Certificates = []tls.Certificate{cert}
+	res, _, err := c.Exchange(req, srv.Addr)
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	checkResponse(t, req, res)
+}
+
+func TestHTTPServer(t *testing.T) {
+	srv, err := NewHTTPServer(nil)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+	assert.Equal(t, "http://"+srv.Addr+"/dns-query", srv.URL)
+	assert.Nil(t, srv.Certificate)
+
+	req := new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+	buf, err := req.Pack()
+	assert.Nil(t, err)
+
+	client := &http.Client{Timeout: time.Second}
+	resp, err := client.Post(srv.URL, "application/dns-message", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("cannot send the request: %s", err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	res := new(dns.Msg)
+	assert.Nil(t, res.Unpack(body))
+	assert.Equal(t, req.Id, res.Id)
+}
+
+func TestHTTPSServer(t *testing.T) {
+	srv, err := NewHTTPSServer(nil)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+	assert.Equal(t, "https://"+srv.Addr+"/dns-query", srv.URL)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate)
+	client := &http.Client{
+		Timeout:   time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+
+	req := new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+	buf, err := req.Pack()
+	assert.Nil(t, err)
+
+	resp, err := client.Post(srv.URL, "application/dns-message", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("cannot send the request: %s", err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	// The default handler responds with an empty response
+	res := new(dns.Msg)
+	err = res.Unpack(body)
+	if err != nil {
+		t.Fatalf("cannot unpack the response: %s", err)
+	}
+	assert.Equal(t, req.Id, res.Id)
+	assert.Empty(t, res.Answer)
+}
@@ -4,6 +4,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 
@@ -13,12 +14,25 @@ import (
 	"github.com/miekg/dns"
 )
 
+// fastestAddrTTL is the maximum TTL of the records in the responses with the
+// fastest IP address, so that the clients come back soon and get another
+// address if the network conditions change
+const fastestAddrTTL = 10
+
+// maxPingAddrs is the maximum number of IP addresses that are probed for a
+// single query.  The rest of them are probed by the next queries for the host.
+const maxPingAddrs = 8
+
 // FastestAddr - object data
 type FastestAddr struct {
 	cache     glcache.Cache // cache of the fastest IP addresses
 	cacheLock sync.Mutex    // for atomic find-and-store cache operation
 	allowTCP  bool          // connect via TCP
 	tcpPorts  []uint        // TCP ports we're using to check connection speed
+
+	// PingWaitTimeout is how long ExchangeFastest waits for the probes of
+	// the IP addresses after the upstreams have responded
+	PingWaitTimeout time.Duration
 }
 
 // NewFastestAddr initializes a new instance of the FastestAddr
@@ -31,6 +45,8 @@ func NewFastestAddr() *FastestAddr {
 		cache:    glcache.New(conf),
 		allowTCP: true,
 		tcpPorts: []uint{80, 443},
+
+		PingWaitTimeout: defaultPingWaitTimeout,
 	}
 }
 
@@ -49,10 +65,19 @@ func NewFastestAddr() *FastestAddr {
 // . Receive TCP connection status.  The first connected address - the fastest IP address.
 // . Choose the fastest address between this and the one previously found in cache
 // . Return DNS packet containing the chosen IP address (remove all other IP addresses from the packet)
+// . Cap the TTL of the remaining A/AAAA records
 func (f *FastestAddr) ExchangeFastest(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	reply, u, _, err := f.ExchangeFastestWithInfo(req, upstreams)
+	return reply, u, err
+}
+
+// ExchangeFastestWithInfo is like ExchangeFastest, but it also returns the
+// information about the exchange with the upstream the response came from,
+// see upstream.ExchangeWithInfo
+func (f *FastestAddr) ExchangeFastestWithInfo(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, *upstream.ExchangeInfo, error) {
 	replies, err := upstream.ExchangeAll(upstreams, req)
 	if err != nil || len(replies) == 0 {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	host := strings.ToLower(req.Question[0].Name)
@@ -61,7 +86,7 @@ func (f *FastestAddr) ExchangeFastest(req *dns.Msg, upstreams []upstream.Upstrea
 
 	if !found {
 		log.Debug("%s: no fastest IP found, using the first response", host)
-		return replies[0].Resp, replies[0].Upstream, nil
+		return replies[0].Resp, replies[0].Upstream, replies[0].Info, nil
 	}
 
 	return f.prepareReply(pingRes, replies)
@@ -74,9 +99,10 @@ func (f *FastestAddr) ExchangeFastest(req *dns.Msg, upstreams []upstream.Upstrea
 // 2. Find the one that contains the fastest IP
 // 3. Remove all other IP addresses from that response
 // 4. Return it
-func (f *FastestAddr) prepareReply(pingRes *pingResult, replies []upstream.ExchangeAllResult) (*dns.Msg, upstream.Upstream, error) {
+func (f *FastestAddr) prepareReply(pingRes *pingResult, replies []upstream.ExchangeAllResult) (*dns.Msg, upstream.Upstream, *upstream.ExchangeInfo, error) {
 	var m *dns.Msg
 	var u upstream.Upstream
+	var info *upstream.ExchangeInfo
 
 	for _, r := range replies {
 		for _, rr := range r.Resp.Answer {
@@ -85,6 +111,7 @@ func (f *FastestAddr) prepareReply(pingRes *pingResult, replies []upstream.Excha
 				// Found it!
 				m = r.Resp
 				u = r.Upstream
+				info = r.Info
 				break
 			}
 		}
@@ -93,7 +120,7 @@ func (f *FastestAddr) prepareReply(pingRes *pingResult, replies []upstream.Excha
 	if m == nil {
 		// Something definitely went wrong
 		log.Error("Found no replies with IP %s, most likely this is a bug", pingRes.ip)
-		return replies[0].Resp, replies[0].Upstream, nil
+		return replies[0].Resp, replies[0].Upstream, replies[0].Info, nil
 	}
 
 	// Now modify that message and keep only those A/AAAA records
@@ -103,11 +130,13 @@ func (f *FastestAddr) prepareReply(pingRes *pingResult, replies []upstream.Excha
 		switch addr := rr.(type) {
 		case *dns.A:
 			if pingRes.ip.Equal(addr.A.To4()) {
+				capTTL(rr)
 				ans = append(ans, rr)
 			}
 
 		case *dns.AAAA:
 			if pingRes.ip.Equal(addr.AAAA) {
+				capTTL(rr)
 				ans = append(ans, rr)
 			}
 
@@ -119,7 +148,14 @@ func (f *FastestAddr) prepareReply(pingRes *pingResult, replies []upstream.Excha
 	// Set new answer
 	m.Answer = ans
 
-	return m, u, nil
+	return m, u, info, nil
+}
+
+// capTTL lowers the TTL of the record to fastestAddrTTL
+func capTTL(rr dns.RR) {
+	if rr.Header().Ttl > fastestAddrTTL {
+		rr.Header().Ttl = fastestAddrTTL
+	}
 }
 
 // getIPAddresses -- extracts all IP addresses from the list of upstream.ExchangeAllResult
@@ -4,6 +4,7 @@ import (
 	"net"
 	"testing"
 
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -39,11 +40,16 @@ func TestFastestAddrOneDeadIP(t *testing.T) {
 	assert.NotNil(t, resp)
 	ip := resp.Answer[0].(*dns.A).A.String()
 	assert.Equal(t, "127.0.0.1", ip)
+
+	// TTL of the fastest address is capped
+	assert.Equal(t, uint32(fastestAddrTTL), resp.Answer[0].Header().Ttl)
 }
 
 // . Upstream server returns "8.8.8.8" (alive, slow), "127.0.0.1" (alive, fast)
 // . The algorithm returns "127.0.0.1"
 func TestFastestAddrOneFaster(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	// Listener that we're using for TCP checks
 	listener, err := net.Listen("tcp", ":0")
 	assert.Nil(t, err)
@@ -8,12 +8,12 @@ import (
 	"github.com/AdguardTeam/golibs/log"
 )
 
-// Time we're waiting for ping operations to finish to
+// Default time we're waiting for ping operations to finish to
 // If we don't receive any result for this period of time,
 // we ignore all scheduled ping checks and return what we have
-const pingWaitTimeout = 1 * time.Second
+const defaultPingWaitTimeout = 1 * time.Second
 
-// TCP connection timeout. Note that it's higher that pingWaitTimeout
+// TCP connection timeout. Note that it's higher that PingWaitTimeout
 // If the connection really takes more than "pingWaitTimeout" to succeed,
 // it will be ignored at first. However, we will record it to the cache
 // and consider the IP address next time it's checked.
@@ -46,9 +46,15 @@ func (f *FastestAddr) pingAll(host string, ips []net.IP) (bool, *pingResult) {
 	scheduled := 0
 
 	// find the fastest cached IP address (if any)
+	pinged := 0
 	for _, ip := range ips {
 		cached := f.cacheFind(ip)
 		if cached == nil {
+			if pinged == maxPingAddrs {
+				continue
+			}
+			pinged++
+
 			// start async ping checks
 			for _, port := range f.tcpPorts {
 				// async ping the specified IP
@@ -78,6 +84,8 @@ func (f *FastestAddr) pingAll(host string, ips []net.IP) (bool, *pingResult) {
 
 	// wait for the first successful ping result
 	// or until ping timeout is finished
+	timer := time.NewTimer(f.PingWaitTimeout)
+	defer timer.Stop()
 	for i := 0; i < scheduled; i++ {
 		select {
 		case res := <-ch:
@@ -94,7 +102,7 @@ func (f *FastestAddr) pingAll(host string, ips []net.IP) (bool, *pingResult) {
 
 				return true, res
 			}
-		case <-time.After(pingWaitTimeout):
+		case <-timer.C:
 			if fCached != nil {
 				log.Debug("pingAll: %s: ping checks timed out, returning cached response: %s", host, fCached.ip)
 			} else {
@@ -87,6 +87,36 @@ func TestPingFastest(t *testing.T) {
 	assert.Equal(t, 0, ce.status)
 }
 
+func TestPingMaxAddrs(t *testing.T) {
+	f := NewFastestAddr()
+	f.tcpPorts = []uint{getFreePort()}
+
+	var ips []net.IP
+	for i := 1; i <= maxPingAddrs+2; i++ {
+		ips = append(ips, net.IPv4(127, 0, 0, byte(i)))
+	}
+
+	found, _ := f.pingAll("test", ips)
+	assert.False(t, found)
+
+	// Only the first maxPingAddrs addresses are probed
+	for i, ip := range ips {
+		assert.Equal(t, i < maxPingAddrs, f.cacheFind(ip) != nil, ip.String())
+	}
+}
+
+func TestPingWaitTimeout(t *testing.T) {
+	f := NewFastestAddr()
+	f.tcpPorts = []uint{getFreePort()}
+	f.PingWaitTimeout = 0
+
+	// The probes are not waited for, the results are cached for the next time
+	start := time.Now()
+	found, _ := f.pingAll("test", []net.IP{net.ParseIP("127.0.0.1")})
+	assert.False(t, found)
+	assert.True(t, time.Since(start) < defaultPingWaitTimeout)
+}
+
 func getFreePort() uint {
 	l, _ := net.Listen("tcp", ":0")
 	port := uint(l.Addr().(*net.TCPAddr).Port)
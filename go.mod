@@ -6,7 +6,6 @@ require (
 	github.com/AdguardTeam/golibs v0.4.4
 	github.com/ameshkov/dnscrypt/v2 v2.0.1
 	github.com/ameshkov/dnsstamps v1.0.3
-	github.com/beefsack/go-rate v0.0.0-20200827232406-6cde80facd47
 	github.com/go-test/deep v1.0.5
 	github.com/golang/protobuf v1.4.3 // indirect
 	github.com/jessevdk/go-flags v1.4.0
@@ -15,12 +14,11 @@ require (
 	github.com/lucas-clemente/quic-go v0.19.3
 	github.com/miekg/dns v1.1.35
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
-	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/stretchr/testify v1.6.1
-	golang.org/x/crypto v0.0.0-20201208171446-5f87f3452ae9 // indirect
+	golang.org/x/crypto v0.0.0-20201208171446-5f87f3452ae9
 	golang.org/x/net v0.0.0-20201209123823-ac852fbbde11
 	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a // indirect
-	golang.org/x/sys v0.0.0-20201214095126-aec9a390925b // indirect
+	golang.org/x/sys v0.0.0-20201214095126-aec9a390925b
 	golang.org/x/text v0.3.4 // indirect
 	google.golang.org/protobuf v1.25.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
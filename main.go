@@ -7,6 +7,8 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/ameshkov/dnscrypt/v2"
 	goFlags "github.com/jessevdk/go-flags"
+	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
 )
 
@@ -74,9 +77,21 @@ type Options struct {
 	// Bootstrap DNS
 	BootstrapDNS []string `short:"b" long:"bootstrap" description:"Bootstrap DNS for DoH and DoT, can be specified multiple times (default: 8.8.8.8:53)"`
 
+	// Client certificate for the upstreams that require mutual TLS
+	UpstreamTLSCertPath string `long:"upstream-tls-crt" description:"Path to a file with the client certificate chain for the DoT, DoH and DoQ upstreams that require mutual TLS"`
+
+	// Private key of the client certificate
+	UpstreamTLSKeyPath string `long:"upstream-tls-key" description:"Path to a file with the private key of the client certificate"`
+
 	// Fallback DNS resolver
 	Fallbacks []string `short:"f" long:"fallback" description:"Fallback resolvers to use when regular ones are unavailable, can be specified multiple times"`
 
+	// Upstreams for the PTR requests for the locally-served addresses
+	PrivateRDNSUpstreams []string `long:"private-rdns-upstream" description:"An upstream for the PTR requests for the private addresses, can be specified multiple times"`
+
+	// If true, the PTR requests for the private addresses are only sent to the private upstreams
+	UsePrivateRDNS bool `long:"use-private-rdns" description:"If specified, the PTR requests for the private addresses are only sent to the private upstreams, or answered with NXDOMAIN if there are none" optional:"yes" optional-value:"true"`
+
 	// If true, parallel queries to all configured upstream servers
 	AllServers bool `long:"all-servers" description:"If specified, parallel queries to all configured upstream servers are enabled" optional:"yes" optional-value:"true"`
 
@@ -84,6 +99,18 @@ type Options struct {
 	//  detected by ICMP response time or TCP connection time
 	FastestAddress bool `long:"fastest-addr" description:"Respond to A or AAAA requests only with the fastest IP address" optional:"yes" optional-value:"true"`
 
+	// How often the upstreams are probed, the dead ones aren't used
+	ProbeInterval uint32 `long:"probe-interval" description:"Probe the upstreams every so many seconds and don't use the ones that are down. 0 disables probing" default:"0"`
+
+	// Name the upstreams are probed with
+	ProbeName string `long:"probe-name" description:"Name the upstreams are probed with as an A query (default: the NS query for the root zone)"`
+
+	// Number of the failed probes in a row the upstream is excluded after
+	ProbeDownAfter int `long:"probe-down-after" description:"Number of the failed probes in a row the upstream is excluded after" default:"3"`
+
+	// Number of the successful probes in a row the upstream is used again after
+	ProbeUpAfter int `long:"probe-up-after" description:"Number of the successful probes in a row the excluded upstream is used again after" default:"2"`
+
 	// Cache settings
 	// --
 
@@ -99,15 +126,67 @@ type Options struct {
 	// DNS cache maximum TTL value - overrides record value
 	CacheMaxTTL uint32 `long:"cache-max-ttl" description:"Maximum TTL value for DNS entries, in seconds."`
 
+	// Don't use the cache for the queries with the CD bit set
+	CacheBypassCD bool `long:"cache-bypass-cd" description:"If specified, the queries with the CD bit set are neither answered from cache nor cached" optional:"yes" optional-value:"true"`
+
+	// File the cache is saved to on exit and loaded from on start
+	CacheFile string `long:"cache-file" description:"Save the cache to the file on exit and load it on start"`
+
 	// Anti-DNS amplification measures
 	// --
 
 	// Ratelimit value
 	Ratelimit int `short:"r" long:"ratelimit" description:"Ratelimit (requests per second)" default:"0"`
 
+	// Global ratelimit value
+	RatelimitGlobal int `long:"ratelimit-global" description:"Ratelimit for all clients together (requests per second)" default:"0"`
+
+	// If true, ratelimited UDP requests are answered with TC=1
+	RatelimitTruncate bool `long:"ratelimit-truncate" description:"If specified, ratelimited UDP requests are answered with truncated responses to make the clients retry over TCP" optional:"yes" optional-value:"true"`
+
 	// If true, refuse ANY requests
 	RefuseAny bool `long:"refuse-any" description:"If specified, refuse ANY requests" optional:"yes" optional-value:"true"`
 
+	// How to answer ANY requests
+	AnyPolicy string `long:"any-policy" description:"How to answer ANY requests: forward, minimal (a single HINFO record, RFC 8482) or notimp"`
+
+	// Query types answered with NOTIMP
+	BlockedQtypes []string `long:"block-qtype" description:"Refuse the requests of the query type (name or number), can be specified multiple times"`
+
+	// TTL of the HINFO response to ANY requests
+	RestrictedTTL uint32 `long:"any-ttl" description:"TTL of the HINFO response to ANY requests, in seconds" default:"3600"`
+
+	// IP addresses and CIDRs of the clients --any-policy and --block-qtype don't apply to
+	QtypeExemptClients []string `long:"qtype-exempt-client" description:"Client IP address or CIDR --any-policy and --block-qtype don't apply to, can be specified multiple times"`
+
+	// Access settings
+	// --
+
+	// IP addresses and CIDRs of the clients allowed to use the proxy
+	AllowedClients []string `long:"allowed-client" description:"Client IP address or CIDR allowed to use the proxy, can be specified multiple times. If not specified, all clients are allowed"`
+
+	// IP addresses and CIDRs of the clients not allowed to use the proxy
+	DisallowedClients []string `long:"disallowed-client" description:"Client IP address or CIDR not allowed to use the proxy, can be specified multiple times"`
+
+	// IP addresses and CIDRs of the reverse proxies the DoH client addresses
+	// are taken from the headers of
+	TrustedProxies []string `long:"trusted-proxy" description:"IP address or CIDR of a reverse proxy the DNS-over-HTTPS client addresses are taken from the X-Forwarded-For and X-Real-IP headers of, can be specified multiple times"`
+
+	// If true, queries from disallowed clients are dropped instead of being refused
+	DropDisallowed bool `long:"drop-disallowed" description:"If specified, queries from disallowed clients are dropped instead of being refused" optional:"yes" optional-value:"true"`
+
+	// Hosts settings
+	// --
+
+	// Files with the static records
+	HostsFiles []string `long:"hosts-file" description:"Answer the queries for the hosts from the file in the hosts file format, can be specified multiple times"`
+
+	// TTL of the responses from the hosts files
+	HostsTTL uint32 `long:"hosts-ttl" description:"TTL of the responses from the hosts files, in seconds (default: 10)"`
+
+	// Special-use zones sent to the upstreams instead of being answered locally
+	ForwardSpecialZones []string `long:"forward-special-zone" description:"Send the queries for the special-use zone, e.g. home.arpa or onion, to the upstreams instead of answering them locally, can be specified multiple times"`
+
 	// ECS settings
 	// --
 
@@ -117,20 +196,71 @@ type Options struct {
 	// Use Custom EDNS Client Address
 	EDNSAddr string `long:"edns-addr" description:"Send EDNS Client Address"`
 
+	// How to handle the EDNS Client Subnet option of the clients
+	EDNSMode string `long:"edns-mode" description:"EDNS Client Subnet option handling: strip, forward or generate (generate if --edns is set)"`
+
+	// NSID settings
+	// --
+
+	// How to handle the NSID option of the clients
+	NSIDMode string `long:"nsid-mode" description:"NSID option handling: off, local (answer with --nsid) or forward (pass to the upstreams) (default: forward)"`
+
+	// Server identifier for the NSID option
+	NSID string `long:"nsid" description:"Server identifier sent in the NSID option with --nsid-mode=local (default: hostname)"`
+
 	// Other settings and options
 	// --
 
 	// If true, all AAAA requests will be replied with NoError RCode and empty answer
 	IPv6Disabled bool `long:"ipv6-disabled" description:"If specified, all AAAA requests will be replied with NoError RCode and empty answer" optional:"yes" optional-value:"true"`
 
+	// Domains --ipv6-disabled doesn't apply to
+	IPv6EnabledDomains []string `long:"ipv6-enabled-domain" description:"Domain, with its subdomains, --ipv6-disabled doesn't apply to, can be specified multiple times"`
+
+	// How to order the A and AAAA records of the responses
+	AnswerOrder string `long:"answer-order" description:"Order of the A and AAAA records in the responses: preserve, shuffle or prefer-private" default:"preserve"`
+
+	// Response codes that make the proxy try the next upstream
+	FailoverRcodes []string `long:"failover-rcode" description:"Response code (name or number), e.g. SERVFAIL or REFUSED, that makes the proxy try the next upstream, can be specified multiple times"`
+
+	// If true, the CNAME targets the upstream hasn't resolved are resolved by the proxy
+	ChaseCNAME bool `long:"chase-cname" description:"If specified, the CNAME targets of the A and AAAA responses the upstream hasn't resolved are resolved by the proxy" optional:"yes" optional-value:"true"`
+
+	// If true, the CNAME chains are removed from the A and AAAA responses
+	FlattenCNAME bool `long:"flatten-cname" description:"If specified, the CNAME chains are removed from the A and AAAA responses and the addresses get the queried name, unless the DO bit is set" optional:"yes" optional-value:"true"`
+
+	// NAT64 prefix for the DNS64 synthesis
+	DNS64Prefix string `long:"dns64-prefix" description:"Enable DNS64 with the specified NAT64 /96 prefix (64:ff9b::/96 if no value is given)" optional:"yes" optional-value:"64:ff9b::/96"`
+
 	// Transform responses that contain at least one of the given IP addresses into NXDOMAIN
-	BogusNXDomain []string `long:"bogus-nxdomain" description:"Transform responses that contain at least one of the given IP addresses into NXDOMAIN. Can be specified multiple times."`
+	BogusNXDomain []string `long:"bogus-nxdomain" description:"Transform responses where all addresses are the given IP addresses or CIDR networks into NXDOMAIN, remove them from other responses. Can be specified multiple times."`
+
+	// Query log settings
+	// --
+
+	// File the answered queries are logged to as JSON lines
+	QueryLogFile string `long:"querylog" description:"Log the answered queries to the file as JSON lines"`
+
+	// Size of the query log file it's rotated at
+	QueryLogMaxSize int64 `long:"querylog-max-size" description:"Rotate the query log file when it grows over the size, in megabytes. 0 disables rotation" default:"0"`
+
+	// Number of the rotated query log files to keep
+	QueryLogMaxBackups int `long:"querylog-max-backups" description:"Number of the rotated query log files to keep" default:"3"`
+
+	// If true, the client IP addresses in the query log are anonymized
+	QueryLogAnonymizeIP bool `long:"querylog-anonymize-ip" description:"If specified, the last byte of IPv4 and the last 80 bits of IPv6 client addresses are zeroed in the query log" optional:"yes" optional-value:"true"`
 
 	// UDP buffer size value
 	UDPBufferSize int `long:"udp-buf-size" description:"Set the size of the UDP buffer in bytes. A value <= 0 will use the system default." default:"0"`
 
+	// If true, several UDP sockets are bound to every listen address with SO_REUSEPORT
+	UDPReusePort bool `long:"udp-reuseport" description:"If specified, bind several UDP sockets to every listen address with SO_REUSEPORT (Linux only)" optional:"yes" optional-value:"true"`
+
+	// Number of the UDP sockets per address if UDPReusePort is set
+	UDPReusePortSockets int `long:"udp-reuseport-sockets" description:"Number of the UDP sockets per address with --udp-reuseport. A value <= 0 will use the number of CPUs." default:"0"`
+
 	// The maximum number of go routines
-	MaxGoRoutines int `long:"max-go-routines" description:"Set the maximum number of go routines. A value <= 0 will not not set a maximum." default:"0"`
+	MaxGoRoutines int `long:"max-go-routines" description:"Set the maximum number of go routines handling the queries. When they are all busy, the UDP queries are dropped and the TCP connections are not read until one is free. A value <= 0 will not set a maximum." default:"300"`
 
 	// Print DNSProxy version (just for the help)
 	Version bool `long:"version" description:"Prints the program version"`
@@ -178,14 +308,9 @@ func run(options Options) {
 
 	// Prepare the proxy server
 	config := createProxyConfig(options)
+	queryLog := initQueryLog(&config, options)
 	dnsProxy := proxy.Proxy{Config: config}
 
-	// Add extra handler if needed
-	if options.IPv6Disabled {
-		ipv6Configuration := ipv6Configuration{ipv6Disabled: options.IPv6Disabled}
-		dnsProxy.RequestHandler = ipv6Configuration.handleDNSRequest
-	}
-
 	// Start the proxy
 	err := dnsProxy.Start()
 	if err != nil {
@@ -198,6 +323,12 @@ func run(options Options) {
 
 	// Stopping the proxy
 	err = dnsProxy.Stop()
+	if queryLog != nil {
+		closeErr := queryLog.Close()
+		if closeErr != nil {
+			log.Error("cannot close the query log: %s", closeErr)
+		}
+	}
 	if err != nil {
 		log.Fatalf("cannot stop the DNS proxy due to %s", err)
 	}
@@ -208,19 +339,43 @@ func createProxyConfig(options Options) proxy.Config {
 	// Create the config
 	config := proxy.Config{
 		Ratelimit:              options.Ratelimit,
+		RatelimitGlobal:        options.RatelimitGlobal,
+		RatelimitTruncate:      options.RatelimitTruncate,
 		CacheEnabled:           options.Cache,
 		CacheSizeBytes:         options.CacheSizeBytes,
 		CacheMinTTL:            options.CacheMinTTL,
 		CacheMaxTTL:            options.CacheMaxTTL,
+		CacheBypassCD:          options.CacheBypassCD,
+		CacheFile:              options.CacheFile,
 		RefuseAny:              options.RefuseAny,
+		AllowedClients:         options.AllowedClients,
+		DisallowedClients:      options.DisallowedClients,
+		TrustedProxies:         options.TrustedProxies,
+		DropDisallowed:         options.DropDisallowed,
+		HostsFiles:             options.HostsFiles,
+		HostsTTL:               options.HostsTTL,
+		ForwardSpecialZones:    options.ForwardSpecialZones,
 		EnableEDNSClientSubnet: options.EnableEDNSSubnet,
 		UDPBufferSize:          options.UDPBufferSize,
+		UDPReusePort:           options.UDPReusePort,
+		UDPReusePortSockets:    options.UDPReusePortSockets,
 		MaxGoroutines:          options.MaxGoRoutines,
+		DNS64Prefix:            options.DNS64Prefix,
+		RestrictedTTL:          options.RestrictedTTL,
+		QtypeExemptClients:     options.QtypeExemptClients,
+		FilterAAAA:             options.IPv6Disabled,
+		FilterAAAAExempt:       options.IPv6EnabledDomains,
+		ChaseCNAME:             options.ChaseCNAME,
+		FlattenCNAME:           options.FlattenCNAME,
 	}
 
 	initUpstreams(&config, options)
+	initProbe(&config, options)
 	initEDNS(&config, options)
 	initBogusNXDomain(&config, options)
+	initQtypes(&config, options)
+	initFailoverRcodes(&config, options)
+	initAnswerOrder(&config, options)
 	initTLSConfig(&config, options)
 	initDNSCryptConfig(&config, options)
 	initListenAddrs(&config, options)
@@ -230,12 +385,15 @@ func createProxyConfig(options Options) proxy.Config {
 
 // initUpstreams inits upstream-related config
 func initUpstreams(config *proxy.Config, options Options) {
+	clientCert := loadUpstreamClientCert(options)
+
 	// Init upstreams
 	upstreamConfig, err := proxy.ParseUpstreamsConfig(options.Upstreams,
 		upstream.Options{
 			InsecureSkipVerify: options.Insecure,
 			Bootstrap:          options.BootstrapDNS,
 			Timeout:            defaultTimeout,
+			ClientCert:         clientCert,
 		})
 	if err != nil {
 		log.Fatalf("error while parsing upstreams configuration: %s", err)
@@ -253,7 +411,7 @@ func initUpstreams(config *proxy.Config, options Options) {
 	if options.Fallbacks != nil {
 		fallbacks := []upstream.Upstream{}
 		for i, f := range options.Fallbacks {
-			fallback, err := upstream.AddressToUpstream(f, upstream.Options{Timeout: defaultTimeout})
+			fallback, err := upstream.AddressToUpstreamLine(f, upstream.Options{Timeout: defaultTimeout})
 			if err != nil {
 				log.Fatalf("cannot parse the fallback %s (%s): %s", f, options.BootstrapDNS, err)
 			}
@@ -262,6 +420,42 @@ func initUpstreams(config *proxy.Config, options Options) {
 		}
 		config.Fallbacks = fallbacks
 	}
+
+	config.UsePrivateRDNS = options.UsePrivateRDNS
+	if len(options.PrivateRDNSUpstreams) > 0 {
+		privateConfig, err := proxy.ParseUpstreamsConfig(options.PrivateRDNSUpstreams,
+			upstream.Options{
+				InsecureSkipVerify: options.Insecure,
+				Bootstrap:          options.BootstrapDNS,
+				Timeout:            defaultTimeout,
+				ClientCert:         clientCert,
+			})
+		if err != nil {
+			log.Fatalf("error while parsing private rDNS upstreams configuration: %s", err)
+		}
+		config.PrivateRDNSUpstreamConfig = &privateConfig
+
+		if !options.UsePrivateRDNS {
+			log.Printf("--private-rdns-upstream is ignored since --use-private-rdns is not set")
+		}
+	}
+}
+
+// loadUpstreamClientCert loads the client certificate for the upstreams, it
+// returns nil if it's not set
+func loadUpstreamClientCert(options Options) *tls.Certificate {
+	if options.UpstreamTLSCertPath == "" && options.UpstreamTLSKeyPath == "" {
+		return nil
+	}
+	if options.UpstreamTLSCertPath == "" || options.UpstreamTLSKeyPath == "" {
+		log.Fatalf("both --upstream-tls-crt and --upstream-tls-key must be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(options.UpstreamTLSCertPath, options.UpstreamTLSKeyPath)
+	if err != nil {
+		log.Fatalf("cannot load the upstream client certificate: %s", err)
+	}
+	return &cert
 }
 
 // initEDNS - init EDNS-related config
@@ -277,13 +471,120 @@ func initEDNS(config *proxy.Config, options Options) {
 			log.Printf("--edns-addr=%s need --edns to work", options.EDNSAddr)
 		}
 	}
+
+	switch options.EDNSMode {
+	case "":
+		// ECSStrip by default, or ECSGenerate if --edns is set
+	case "strip":
+		config.ECSMode = proxy.ECSStrip
+	case "forward":
+		config.ECSMode = proxy.ECSForward
+	case "generate":
+		config.ECSMode = proxy.ECSGenerate
+	default:
+		log.Fatalf("invalid --edns-mode value: %s", options.EDNSMode)
+	}
+
+	if options.EnableEDNSSubnet && options.EDNSMode != "" && options.EDNSMode != "generate" {
+		log.Printf("--edns-mode=%s is ignored since --edns is set", options.EDNSMode)
+	}
+
+	switch options.NSIDMode {
+	case "", "forward":
+		config.NSIDMode = proxy.NSIDForward
+	case "off":
+		config.NSIDMode = proxy.NSIDOff
+	case "local":
+		config.NSIDMode = proxy.NSIDLocal
+	default:
+		log.Fatalf("invalid --nsid-mode value: %s", options.NSIDMode)
+	}
+	config.NSID = options.NSID
+}
+
+// initQtypes - inits the ANY policy and the blocked query types
+func initQtypes(config *proxy.Config, options Options) {
+	switch options.AnyPolicy {
+	case "", "forward":
+		config.AnyPolicy = proxy.AnyForward
+	case "minimal":
+		config.AnyPolicy = proxy.AnyMinimal
+	case "notimp":
+		config.AnyPolicy = proxy.AnyNotImpl
+	default:
+		log.Fatalf("invalid --any-policy value: %s", options.AnyPolicy)
+	}
+
+	for _, s := range options.BlockedQtypes {
+		qtype, ok := dns.StringToType[strings.ToUpper(s)]
+		if !ok {
+			n, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				log.Fatalf("invalid --block-qtype value: %s", s)
+			}
+			qtype = uint16(n)
+		}
+		config.BlockedQtypes = append(config.BlockedQtypes, qtype)
+	}
+}
+
+// initFailoverRcodes inits the response codes that make the proxy try the
+// next upstream
+func initFailoverRcodes(config *proxy.Config, options Options) {
+	for _, s := range options.FailoverRcodes {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(s)]
+		if !ok {
+			n, err := strconv.ParseUint(s, 10, 12)
+			if err != nil {
+				log.Fatalf("invalid --failover-rcode value: %s", s)
+			}
+			rcode = int(n)
+		}
+		config.FailoverRcodes = append(config.FailoverRcodes, rcode)
+	}
+}
+
+// initProbe inits the upstream probing
+func initProbe(config *proxy.Config, options Options) {
+	config.ProbeInterval = time.Duration(options.ProbeInterval) * time.Second
+	config.ProbeDownAfter = options.ProbeDownAfter
+	config.ProbeUpAfter = options.ProbeUpAfter
+	if options.ProbeName != "" {
+		config.ProbeRequest = &dns.Msg{}
+		config.ProbeRequest.SetQuestion(dns.Fqdn(options.ProbeName), dns.TypeA)
+	}
+}
+
+// initAnswerOrder inits the order of the address records in the responses
+func initAnswerOrder(config *proxy.Config, options Options) {
+	switch options.AnswerOrder {
+	case "", "preserve":
+		config.AnswerOrder = upstream.AnswerOrderPreserve
+	case "shuffle":
+		config.AnswerOrder = upstream.AnswerOrderShuffle
+	case "prefer-private":
+		config.AnswerOrder = upstream.AnswerOrderPreferPrivate
+	default:
+		log.Fatalf("invalid --answer-order value: %s", options.AnswerOrder)
+	}
 }
 
 // initBogusNXDomain - inits BogusNXDomain structure
 func initBogusNXDomain(config *proxy.Config, options Options) {
 	if len(options.BogusNXDomain) > 0 {
 		bogusIP := []net.IP{}
+		bogusNets := []*net.IPNet{}
 		for _, s := range options.BogusNXDomain {
+			if strings.Contains(s, "/") {
+				_, n, err := net.ParseCIDR(s)
+				if err != nil {
+					log.Error("Invalid CIDR: %s", s)
+				} else {
+					bogusNets = append(bogusNets, n)
+				}
+				continue
+			}
+
 			ip := net.ParseIP(s)
 			if ip == nil {
 				log.Error("Invalid IP: %s", s)
@@ -292,9 +593,26 @@ func initBogusNXDomain(config *proxy.Config, options Options) {
 			}
 		}
 		config.BogusNXDomain = bogusIP
+		config.BogusNXDomainNets = bogusNets
 	}
 }
 
+// initQueryLog opens the query log file if it's specified, it's closed once
+// the proxy is stopped
+func initQueryLog(config *proxy.Config, options Options) *proxy.QueryLogFile {
+	if options.QueryLogFile == "" {
+		return nil
+	}
+
+	l, err := proxy.NewQueryLogFile(options.QueryLogFile, options.QueryLogMaxSize*1024*1024, options.QueryLogMaxBackups)
+	if err != nil {
+		log.Fatalf("cannot create the query log: %s", err)
+	}
+	config.QueryLogHandler = l.Write
+	config.QueryLogAnonymizeIP = options.QueryLogAnonymizeIP
+	return l
+}
+
 // initTLSConfig - inits TLS config
 func initTLSConfig(config *proxy.Config, options Options) {
 	if options.TLSCertPath != "" && options.TLSKeyPath != "" {
@@ -330,6 +648,16 @@ func initDNSCryptConfig(config *proxy.Config, options Options) {
 
 	config.DNSCryptResolverCert = cert
 	config.DNSCryptProviderName = rc.ProviderName
+
+	// Print the stamps so that clients could be pointed at the server
+	for _, port := range options.DNSCryptListenPorts {
+		for _, a := range options.ListenAddrs {
+			stamp, err := proxy.DNSCryptStamp(*rc, &net.UDPAddr{IP: net.ParseIP(a), Port: port})
+			if err == nil {
+				log.Info("DNSCrypt stamp for %s: %s", net.JoinHostPort(a, strconv.Itoa(port)), stamp)
+			}
+		}
+	}
 }
 
 // initListenAddrs - inits listen addrs
@@ -392,20 +720,6 @@ func initListenAddrs(config *proxy.Config, options Options) {
 	}
 }
 
-// IPv6 configuration
-type ipv6Configuration struct {
-	ipv6Disabled bool // If true, all AAAA requests will be replied with NoError RCode and empty answer
-}
-
-// handleDNSRequest checks IPv6 configuration for current session before resolve
-func (c *ipv6Configuration) handleDNSRequest(p *proxy.Proxy, ctx *proxy.DNSContext) error {
-	if proxy.CheckDisabledAAAARequest(ctx, c.ipv6Disabled) {
-		return nil
-	}
-
-	return p.Resolve(ctx)
-}
-
 // NewTLSConfig returns a TLS config that includes a certificate
 // Use for server TLS config or when using a client certificate
 // If caPath is empty, system CAs will be used
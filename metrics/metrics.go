@@ -0,0 +1,250 @@
+// Package metrics implements proxy.Metrics that keeps the counters in memory
+// and exports them with expvar or in the Prometheus text format, so that the
+// proxy doesn't depend on a metrics library.
+package metrics
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RTTBuckets are the upper bounds of the upstream RTT histogram buckets, they
+// must not be changed
+var RTTBuckets = []time.Duration{ // nolint:gochecknoglobals
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// Counters is a proxy.Metrics that counts the events in memory.  All counters
+// are updated with atomic operations, the maps are only locked when a new
+// upstream or protocol appears.  The zero value is ready to use.
+type Counters struct {
+	cacheHits   uint64 // accessed atomically
+	cacheMisses uint64 // accessed atomically
+	inFlight    int64  // accessed atomically
+	rateLimited uint64 // accessed atomically
+	dropped     uint64 // accessed atomically
+
+	upstreams sync.Map // *upstreamCounters by address
+	conns     sync.Map // *int64 active connections by protocol
+	rejected  sync.Map // *uint64 rejected connections by protocol
+	queries   sync.Map // *uint64 queries by protocol
+	failovers sync.Map // *uint64 rcode failovers by response code name
+}
+
+// upstreamCounters are the counters of an upstream, accessed atomically
+type upstreamCounters struct {
+	queries  uint64
+	errors   uint64
+	timeouts uint64
+	rttSum   int64    // nanoseconds
+	rtt      []uint64 // histogram, the last bucket is for the values above RTTBuckets
+}
+
+// Snapshot contains the values of the counters
+type Snapshot struct {
+	Upstreams   map[string]UpstreamStats // by address
+	CacheHits   uint64                   // responses served from cache
+	CacheMisses uint64                   // cache lookups that found nothing
+	Connections map[string]int64         // active client connections by protocol
+	Rejected    map[string]uint64        // client connections closed without being handled by protocol
+	Queries     map[string]uint64        // handled queries by protocol
+	InFlight    int64                    // queries being handled
+	RateLimited uint64                   // queries dropped by the rate limiter
+	Dropped     uint64                   // queries dropped since too many of them were being handled
+	Failovers   map[string]uint64        // upstream responses discarded for the next upstream by response code, e.g. "SERVFAIL"
+}
+
+// UpstreamStats contains the counters of an upstream
+type UpstreamStats struct {
+	Queries  uint64        // exchanges with the upstream
+	Errors   uint64        // failed exchanges, including the timeouts
+	Timeouts uint64        // exchanges failed due to a timeout
+	RTTSum   time.Duration // total time of the exchanges
+	RTT      []uint64      // number of the exchanges by RTTBuckets, the last one is for the slower ones
+}
+
+// CacheHitRatio returns the share of the cache lookups that found the
+// response, or 0 if there were no lookups
+func (s Snapshot) CacheHitRatio() float64 {
+	total := s.CacheHits + s.CacheMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.CacheHits) / float64(total)
+}
+
+// UpstreamExchanged implements the proxy.Metrics interface for *Counters
+func (c *Counters) UpstreamExchanged(addr string, rtt time.Duration, err error, timeout bool) {
+	u := c.upstream(addr)
+	atomic.AddUint64(&u.queries, 1)
+	if err != nil {
+		atomic.AddUint64(&u.errors, 1)
+	}
+	if timeout {
+		atomic.AddUint64(&u.timeouts, 1)
+	}
+
+	atomic.AddInt64(&u.rttSum, int64(rtt))
+	i := 0
+	for i < len(RTTBuckets) && rtt > RTTBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&u.rtt[i], 1)
+}
+
+// UpstreamRcodeFailover implements the proxy.FailoverMetrics interface for
+// *Counters
+func (c *Counters) UpstreamRcodeFailover(_ string, rcode int) {
+	name, ok := dns.RcodeToString[rcode]
+	if !ok {
+		name = strconv.Itoa(rcode)
+	}
+	atomic.AddUint64(loadUint64(&c.failovers, name), 1)
+}
+
+// CacheLookup implements the proxy.Metrics interface for *Counters
+func (c *Counters) CacheLookup(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.cacheHits, 1)
+	} else {
+		atomic.AddUint64(&c.cacheMisses, 1)
+	}
+}
+
+// ConnectionOpened implements the proxy.Metrics interface for *Counters
+func (c *Counters) ConnectionOpened(proto string) {
+	atomic.AddInt64(loadInt64(&c.conns, proto), 1)
+}
+
+// ConnectionClosed implements the proxy.Metrics interface for *Counters
+func (c *Counters) ConnectionClosed(proto string) {
+	atomic.AddInt64(loadInt64(&c.conns, proto), -1)
+}
+
+// ConnectionRejected implements the proxy.ConnectionMetrics interface for
+// *Counters
+func (c *Counters) ConnectionRejected(proto string) {
+	atomic.AddUint64(loadUint64(&c.rejected, proto), 1)
+}
+
+// QueryStarted implements the proxy.Metrics interface for *Counters
+func (c *Counters) QueryStarted(proto string) {
+	atomic.AddInt64(&c.inFlight, 1)
+	atomic.AddUint64(loadUint64(&c.queries, proto), 1)
+}
+
+// QueryFinished implements the proxy.Metrics interface for *Counters
+func (c *Counters) QueryFinished(string) {
+	atomic.AddInt64(&c.inFlight, -1)
+}
+
+// QueryRateLimited implements the proxy.Metrics interface for *Counters
+func (c *Counters) QueryRateLimited(string) {
+	atomic.AddUint64(&c.rateLimited, 1)
+}
+
+// QueryDropped implements the proxy.DropMetrics interface for *Counters
+func (c *Counters) QueryDropped(string) {
+	atomic.AddUint64(&c.dropped, 1)
+}
+
+// Snapshot returns the current values of the counters
+func (c *Counters) Snapshot() Snapshot {
+	s := Snapshot{
+		Upstreams:   map[string]UpstreamStats{},
+		CacheHits:   atomic.LoadUint64(&c.cacheHits),
+		CacheMisses: atomic.LoadUint64(&c.cacheMisses),
+		Connections: map[string]int64{},
+		Rejected:    map[string]uint64{},
+		Queries:     map[string]uint64{},
+		InFlight:    atomic.LoadInt64(&c.inFlight),
+		RateLimited: atomic.LoadUint64(&c.rateLimited),
+		Dropped:     atomic.LoadUint64(&c.dropped),
+		Failovers:   map[string]uint64{},
+	}
+
+	c.upstreams.Range(func(k, v interface{}) bool {
+		u := v.(*upstreamCounters)
+		stats := UpstreamStats{
+			Queries:  atomic.LoadUint64(&u.queries),
+			Errors:   atomic.LoadUint64(&u.errors),
+			Timeouts: atomic.LoadUint64(&u.timeouts),
+			RTTSum:   time.Duration(atomic.LoadInt64(&u.rttSum)),
+			RTT:      make([]uint64, len(u.rtt)),
+		}
+		for i := range u.rtt {
+			stats.RTT[i] = atomic.LoadUint64(&u.rtt[i])
+		}
+		s.Upstreams[k.(string)] = stats
+		return true
+	})
+	c.conns.Range(func(k, v interface{}) bool {
+		s.Connections[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	c.rejected.Range(func(k, v interface{}) bool {
+		s.Rejected[k.(string)] = atomic.LoadUint64(v.(*uint64))
+		return true
+	})
+	c.queries.Range(func(k, v interface{}) bool {
+		s.Queries[k.(string)] = atomic.LoadUint64(v.(*uint64))
+		return true
+	})
+	c.failovers.Range(func(k, v interface{}) bool {
+		s.Failovers[k.(string)] = atomic.LoadUint64(v.(*uint64))
+		return true
+	})
+	return s
+}
+
+// Publish exports the snapshot of the counters with expvar under the name.
+// Like expvar.Publish, it panics if the name is already used.
+func (c *Counters) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return c.Snapshot()
+	}))
+}
+
+// upstream returns the counters of the upstream, creating them if needed
+func (c *Counters) upstream(addr string) *upstreamCounters {
+	if u, ok := c.upstreams.Load(addr); ok {
+		return u.(*upstreamCounters)
+	}
+
+	u, _ := c.upstreams.LoadOrStore(addr, &upstreamCounters{rtt: make([]uint64, len(RTTBuckets)+1)})
+	return u.(*upstreamCounters)
+}
+
+// loadInt64 returns the counter for the key, creating it if needed
+func loadInt64(m *sync.Map, key string) *int64 {
+	if v, ok := m.Load(key); ok {
+		return v.(*int64)
+	}
+
+	v, _ := m.LoadOrStore(key, new(int64))
+	return v.(*int64)
+}
+
+// loadUint64 returns the counter for the key, creating it if needed
+func loadUint64(m *sync.Map, key string) *uint64 {
+	if v, ok := m.Load(key); ok {
+		return v.(*uint64)
+	}
+
+	v, _ := m.LoadOrStore(key, new(uint64))
+	return v.(*uint64)
+}
@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounters(t *testing.T) {
+	u := upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		switch m.Question[0].Name {
+		case "fail.example.":
+			return nil, errors.New("test failure")
+		case "timeout.example.":
+			return nil, &net.DNSError{Err: "test timeout", IsTimeout: true}
+		}
+
+		resp := new(dns.Msg).SetReply(m)
+		a, _ := dns.NewRR(m.Question[0].Name + " 60 IN A 192.0.2.1")
+		resp.Answer = []dns.RR{a}
+		return resp, nil
+	})
+
+	counters := &Counters{}
+	var _ proxy.Metrics = counters
+	var _ proxy.ConnectionMetrics = counters
+	var _ proxy.FailoverMetrics = counters
+	var _ proxy.DropMetrics = counters
+
+	p := &proxy.Proxy{Config: proxy.Config{
+		UDPListenAddr:   []*net.UDPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		TCPListenAddr:   []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		UpstreamConfig:  &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+		CacheEnabled:    true,
+		Ratelimit:       6,
+		RatelimitWindow: time.Minute,
+		Metrics:         counters,
+	}}
+	err := p.Start()
+	if err != nil {
+		t.Fatalf("cannot start the proxy: %s", err)
+	}
+	defer func() { _ = p.Stop() }()
+
+	udpClient := &dns.Client{Net: "udp", Timeout: time.Second}
+	udpAddr := p.Addr(proxy.ProtoUDP).String()
+	exchangeUDP := func(name string) *dns.Msg {
+		req := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		resp, _, err := udpClient.Exchange(req, udpAddr)
+		if err != nil {
+			t.Fatalf("cannot exchange %s over UDP: %s", name, err)
+		}
+		return resp
+	}
+
+	// The queries over a single TCP connection
+	conn, err := dns.Dial("tcp", p.Addr(proxy.ProtoTCP).String())
+	if err != nil {
+		t.Fatalf("cannot connect over TCP: %s", err)
+	}
+	exchangeTCP := func(name string) *dns.Msg {
+		req := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		err := conn.WriteMsg(req)
+		if err != nil {
+			t.Fatalf("cannot write %s over TCP: %s", name, err)
+		}
+		resp, err := conn.ReadMsg()
+		if err != nil {
+			t.Fatalf("cannot read %s over TCP: %s", name, err)
+		}
+		return resp
+	}
+
+	assert.Equal(t, dns.RcodeSuccess, exchangeUDP("example.org.").Rcode)        // cache miss, upstream
+	assert.Equal(t, dns.RcodeSuccess, exchangeUDP("example.org.").Rcode)        // cache hit
+	assert.Equal(t, dns.RcodeServerFailure, exchangeTCP("fail.example.").Rcode) // cache miss, upstream error
+	assert.Equal(t, dns.RcodeServerFailure, exchangeTCP("timeout.example.").Rcode)
+	assert.Equal(t, dns.RcodeSuccess, exchangeTCP("example.org.").Rcode) // cache hit
+	assert.Equal(t, dns.RcodeSuccess, exchangeTCP("example.net.").Rcode) // cache miss, upstream
+	assert.Equal(t, dns.RcodeRefused, exchangeTCP("example.com.").Rcode) // ratelimited
+
+	s := counters.Snapshot()
+	if assert.Contains(t, s.Upstreams, "static") {
+		us := s.Upstreams["static"]
+		assert.Equal(t, uint64(4), us.Queries)
+		assert.Equal(t, uint64(2), us.Errors)
+		assert.Equal(t, uint64(1), us.Timeouts)
+
+		var total uint64
+		for _, n := range us.RTT {
+			total += n
+		}
+		assert.Equal(t, us.Queries, total)
+	}
+	assert.Equal(t, uint64(2), s.CacheHits)
+	assert.Equal(t, uint64(4), s.CacheMisses)
+	assert.Equal(t, 1.0/3, s.CacheHitRatio())
+	assert.Equal(t, map[string]uint64{proxy.ProtoUDP: 2, proxy.ProtoTCP: 5}, s.Queries)
+	assert.Equal(t, int64(0), s.InFlight)
+	assert.Equal(t, uint64(1), s.RateLimited)
+	assert.Equal(t, int64(1), s.Connections[proxy.ProtoTCP])
+
+	buf := &bytes.Buffer{}
+	err = counters.WritePrometheus(buf)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), `dnsproxy_upstream_queries_total{upstream="static"} 4`)
+	assert.Contains(t, buf.String(), `dnsproxy_upstream_rtt_seconds_bucket{upstream="static",le="+Inf"} 4`)
+	assert.Contains(t, buf.String(), "dnsproxy_cache_hits_total 2\n")
+	assert.Contains(t, buf.String(), `dnsproxy_connections{proto="tcp"} 1`)
+
+	// The connection is closed by the client
+	_ = conn.Close()
+	for i := 0; i < 100 && counters.Snapshot().Connections[proxy.ProtoTCP] != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(0), counters.Snapshot().Connections[proxy.ProtoTCP])
+	assert.False(t, strings.Contains(buf.String(), "NaN"))
+}
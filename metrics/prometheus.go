@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// prometheusContentType is the content type of the Prometheus text format
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// labelEscaper escapes the label values in the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`) // nolint:gochecknoglobals
+
+// WritePrometheus writes the counters in the Prometheus text format
+func (c *Counters) WritePrometheus(w io.Writer) error {
+	s := c.Snapshot()
+	b := bufio.NewWriter(w)
+
+	addrs := sortedKeys(len(s.Upstreams), func(f func(string)) {
+		for k := range s.Upstreams {
+			f(k)
+		}
+	})
+
+	writeHeader(b, "dnsproxy_upstream_queries_total", "counter", "Exchanges with the upstream.")
+	for _, addr := range addrs {
+		fmt.Fprintf(b, "dnsproxy_upstream_queries_total{upstream=\"%s\"} %d\n", labelEscaper.Replace(addr), s.Upstreams[addr].Queries)
+	}
+	writeHeader(b, "dnsproxy_upstream_errors_total", "counter", "Failed exchanges with the upstream, including the timeouts.")
+	for _, addr := range addrs {
+		fmt.Fprintf(b, "dnsproxy_upstream_errors_total{upstream=\"%s\"} %d\n", labelEscaper.Replace(addr), s.Upstreams[addr].Errors)
+	}
+	writeHeader(b, "dnsproxy_upstream_timeouts_total", "counter", "Exchanges with the upstream failed due to a timeout.")
+	for _, addr := range addrs {
+		fmt.Fprintf(b, "dnsproxy_upstream_timeouts_total{upstream=\"%s\"} %d\n", labelEscaper.Replace(addr), s.Upstreams[addr].Timeouts)
+	}
+
+	writeHeader(b, "dnsproxy_upstream_rtt_seconds", "histogram", "Round-trip time of the exchanges with the upstream.")
+	for _, addr := range addrs {
+		u := s.Upstreams[addr]
+		label := labelEscaper.Replace(addr)
+		var cumulative uint64
+		for i, le := range RTTBuckets {
+			cumulative += u.RTT[i]
+			fmt.Fprintf(b, "dnsproxy_upstream_rtt_seconds_bucket{upstream=\"%s\",le=\"%g\"} %d\n", label, le.Seconds(), cumulative)
+		}
+		fmt.Fprintf(b, "dnsproxy_upstream_rtt_seconds_bucket{upstream=\"%s\",le=\"+Inf\"} %d\n", label, u.Queries)
+		fmt.Fprintf(b, "dnsproxy_upstream_rtt_seconds_sum{upstream=\"%s\"} %g\n", label, u.RTTSum.Seconds())
+		fmt.Fprintf(b, "dnsproxy_upstream_rtt_seconds_count{upstream=\"%s\"} %d\n", label, u.Queries)
+	}
+
+	rcodes := sortedKeys(len(s.Failovers), func(f func(string)) {
+		for k := range s.Failovers {
+			f(k)
+		}
+	})
+	writeHeader(b, "dnsproxy_upstream_rcode_failovers_total", "counter", "Upstream responses discarded to try the next upstream due to the response code.")
+	for _, rcode := range rcodes {
+		fmt.Fprintf(b, "dnsproxy_upstream_rcode_failovers_total{rcode=\"%s\"} %d\n", labelEscaper.Replace(rcode), s.Failovers[rcode])
+	}
+
+	writeHeader(b, "dnsproxy_cache_hits_total", "counter", "Responses served from cache.")
+	fmt.Fprintf(b, "dnsproxy_cache_hits_total %d\n", s.CacheHits)
+	writeHeader(b, "dnsproxy_cache_misses_total", "counter", "Cache lookups that found nothing.")
+	fmt.Fprintf(b, "dnsproxy_cache_misses_total %d\n", s.CacheMisses)
+
+	protos := sortedKeys(len(s.Connections), func(f func(string)) {
+		for k := range s.Connections {
+			f(k)
+		}
+	})
+	writeHeader(b, "dnsproxy_connections", "gauge", "Active client connections.")
+	for _, proto := range protos {
+		fmt.Fprintf(b, "dnsproxy_connections{proto=\"%s\"} %d\n", labelEscaper.Replace(proto), s.Connections[proto])
+	}
+
+	protos = sortedKeys(len(s.Rejected), func(f func(string)) {
+		for k := range s.Rejected {
+			f(k)
+		}
+	})
+	writeHeader(b, "dnsproxy_connections_rejected_total", "counter", "Client connections closed without being handled since there were too many.")
+	for _, proto := range protos {
+		fmt.Fprintf(b, "dnsproxy_connections_rejected_total{proto=\"%s\"} %d\n", labelEscaper.Replace(proto), s.Rejected[proto])
+	}
+
+	protos = sortedKeys(len(s.Queries), func(f func(string)) {
+		for k := range s.Queries {
+			f(k)
+		}
+	})
+	writeHeader(b, "dnsproxy_queries_total", "counter", "Handled client queries.")
+	for _, proto := range protos {
+		fmt.Fprintf(b, "dnsproxy_queries_total{proto=\"%s\"} %d\n", labelEscaper.Replace(proto), s.Queries[proto])
+	}
+
+	writeHeader(b, "dnsproxy_queries_in_flight", "gauge", "Client queries being handled.")
+	fmt.Fprintf(b, "dnsproxy_queries_in_flight %d\n", s.InFlight)
+	writeHeader(b, "dnsproxy_ratelimited_total", "counter", "Client queries dropped by the rate limiter.")
+	fmt.Fprintf(b, "dnsproxy_ratelimited_total %d\n", s.RateLimited)
+	writeHeader(b, "dnsproxy_dropped_total", "counter", "Client queries dropped since too many of them were being handled.")
+	fmt.Fprintf(b, "dnsproxy_dropped_total %d\n", s.Dropped)
+
+	return b.Flush()
+}
+
+// ServeHTTP serves the counters in the Prometheus text format, so that
+// Counters can be mounted as the /metrics handler
+func (c *Counters) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", prometheusContentType)
+	err := c.WritePrometheus(w)
+	if err != nil {
+		log.Debug("metrics: writing the response: %s", err)
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of the metric
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sortedKeys returns the sorted keys that keys passes to its argument
+func sortedKeys(n int, keys func(f func(string))) []string {
+	sorted := make([]string, 0, n)
+	keys(func(k string) { sorted = append(sorted, k) })
+	sort.Strings(sorted)
+	return sorted
+}
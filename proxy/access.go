@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ipRange is an inclusive range of IP addresses, both ends are in the 16-byte form
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// ipRanges is a sorted list of non-overlapping IP ranges.  It's looked up with
+// a binary search since it's checked for every query.
+type ipRanges []ipRange
+
+// newIPRanges creates the list of ranges from IP addresses and CIDRs
+func newIPRanges(list []string) (ipRanges, error) {
+	var ranges ipRanges
+	for _, s := range list {
+		r, err := parseIPRange(s)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+
+	// Merge the overlapping ranges so that at most one range may contain the IP
+	merged := ranges[:0]
+	for _, r := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && bytes.Compare(r.start, merged[last].end) <= 0 {
+			if bytes.Compare(r.end, merged[last].end) > 0 {
+				merged[last].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged, nil
+}
+
+// parseIPRange parses an IP address or a CIDR
+func parseIPRange(s string) (ipRange, error) {
+	s = strings.TrimSpace(s)
+
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return ipRange{}, fmt.Errorf("invalid IP address: %s", s)
+		}
+		ip = ip.To16()
+		return ipRange{start: ip, end: ip}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return ipRange{}, err
+	}
+
+	end := make(net.IP, len(ipNet.IP))
+	for i := range ipNet.IP {
+		end[i] = ipNet.IP[i] | ^ipNet.Mask[i]
+	}
+
+	return ipRange{start: ipNet.IP.To16(), end: end.To16()}, nil
+}
+
+// contains checks if the IP address is in one of the ranges
+func (r ipRanges) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+
+	// Find the first range that ends at or after ip
+	i := sort.Search(len(r), func(i int) bool {
+		return bytes.Compare(r[i].end, ip) >= 0
+	})
+
+	return i < len(r) && bytes.Compare(r[i].start, ip) <= 0
+}
+
+// accessList decides which clients may query the proxy
+type accessList struct {
+	allowed    ipRanges // if not empty, only these clients are allowed
+	disallowed ipRanges // these clients are never allowed
+}
+
+// newAccessList creates the access list from the allowed and disallowed IP
+// addresses and CIDRs.  It returns nil if both lists are empty.
+func newAccessList(allowed, disallowed []string) (*accessList, error) {
+	if len(allowed) == 0 && len(disallowed) == 0 {
+		return nil, nil
+	}
+
+	a := &accessList{}
+
+	var err error
+	a.allowed, err = newIPRanges(allowed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed clients: %w", err)
+	}
+
+	a.disallowed, err = newIPRanges(disallowed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid disallowed clients: %w", err)
+	}
+
+	return a, nil
+}
+
+// isAllowed checks if the client may query the proxy
+func (a *accessList) isAllowed(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+
+	if ip == nil {
+		// Can't tell who the client is
+		return len(a.allowed) == 0
+	}
+
+	if a.disallowed.contains(ip) {
+		return false
+	}
+
+	return len(a.allowed) == 0 || a.allowed.contains(ip)
+}
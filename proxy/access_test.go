@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPRanges(t *testing.T) {
+	r, err := newIPRanges([]string{"10.0.0.0/8", "10.1.0.0/16", "192.168.1.1", "2001:db8::/32", " 172.16.0.0/12 "})
+	assert.Nil(t, err)
+
+	// 10.1.0.0/16 is merged into 10.0.0.0/8
+	assert.Len(t, r, 4)
+
+	for _, ip := range []string{"10.0.0.0", "10.255.255.255", "10.1.2.3", "192.168.1.1", "172.31.0.1", "2001:db8::1"} {
+		assert.True(t, r.contains(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"9.255.255.255", "11.0.0.0", "192.168.1.2", "172.32.0.0", "2001:db9::1", "::1"} {
+		assert.False(t, r.contains(net.ParseIP(ip)), ip)
+	}
+
+	_, err = newIPRanges([]string{"10.0.0.0/33"})
+	assert.NotNil(t, err)
+	_, err = newIPRanges([]string{"example.org"})
+	assert.NotNil(t, err)
+}
+
+func TestAccessList(t *testing.T) {
+	a, err := newAccessList(nil, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, a)
+
+	a, err = newAccessList([]string{"192.168.0.0/16"}, []string{"192.168.1.0/24"})
+	assert.Nil(t, err)
+
+	assert.True(t, a.isAllowed(&net.UDPAddr{IP: net.ParseIP("192.168.0.1")}))
+	assert.False(t, a.isAllowed(&net.UDPAddr{IP: net.ParseIP("192.168.1.1")}))
+	assert.False(t, a.isAllowed(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}))
+
+	// Only the disallowed list is set
+	a, err = newAccessList(nil, []string{"10.0.0.1"})
+	assert.Nil(t, err)
+
+	assert.True(t, a.isAllowed(&net.TCPAddr{IP: net.ParseIP("10.0.0.2")}))
+	assert.False(t, a.isAllowed(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}))
+}
+
+func TestAccessProxy(t *testing.T) {
+	testCases := []struct {
+		name       string
+		allowed    []string
+		disallowed []string
+		drop       bool
+		rcode      int // -1 if the request must be dropped
+	}{
+		{name: "allowed", allowed: []string{"127.0.0.0/8"}, rcode: dns.RcodeSuccess},
+		{name: "not_allowed", allowed: []string{"10.0.0.0/8"}, rcode: dns.RcodeRefused},
+		{name: "disallowed", allowed: []string{"127.0.0.0/8"}, disallowed: []string{listenIP}, rcode: dns.RcodeRefused},
+		{name: "dropped", disallowed: []string{"127.0.0.0/8"}, drop: true, rcode: -1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dnsProxy := createTestProxy(t, nil)
+			dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{upstream.NullUpstream()}
+			dnsProxy.AllowedClients = tc.allowed
+			dnsProxy.DisallowedClients = tc.disallowed
+			dnsProxy.DropDisallowed = tc.drop
+
+			var denied int32
+			dnsProxy.AccessHandler = func(d *DNSContext, allowed bool) {
+				if !allowed {
+					atomic.AddInt32(&denied, 1)
+				}
+			}
+
+			err := dnsProxy.Start()
+			if err != nil {
+				t.Fatalf("cannot start the DNS proxy: %s", err)
+			}
+			defer func() { _ = dnsProxy.Stop() }()
+
+			for _, proto := range []string{ProtoUDP, ProtoTCP} {
+				client := &dns.Client{Net: proto, Timeout: 200 * time.Millisecond}
+				r, _, err := client.Exchange(createTestMessage(), dnsProxy.Addr(proto).String())
+				if tc.rcode == -1 {
+					assert.NotNil(t, err, proto)
+					continue
+				}
+
+				if err != nil {
+					t.Fatalf("%s request failed: %s", proto, err)
+				}
+				assert.Equal(t, tc.rcode, r.Rcode, proto)
+			}
+
+			if tc.rcode == dns.RcodeSuccess {
+				assert.Equal(t, int32(0), atomic.LoadInt32(&denied))
+			} else {
+				assert.Equal(t, int32(2), atomic.LoadInt32(&denied))
+			}
+		})
+	}
+
+	// Invalid lists are reported on start
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.AllowedClients = []string{"127.0.0.1/64"}
+	assert.NotNil(t, dnsProxy.Start())
+}
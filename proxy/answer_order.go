@@ -0,0 +1,15 @@
+package proxy
+
+import "github.com/AdguardTeam/dnsproxy/upstream"
+
+// orderAnswers orders the address records of the response according to
+// AnswerOrder
+func (p *Proxy) orderAnswers(d *DNSContext) {
+	if p.AnswerOrder == upstream.AnswerOrderPreserve || d.Res == nil || len(d.Res.Answer) < 2 {
+		return
+	}
+
+	// The response is modified, don't touch the one the caller may keep
+	d.Res = d.Res.Copy()
+	upstream.OrderAnswers(d.Res, p.AnswerOrder)
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnswerOrder(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.AnswerOrder = upstream.AnswerOrderPreferPrivate
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = []dns.RR{
+			newRR("host. 60 IN A 192.0.2.1"),
+			newRR("host. 60 IN A 192.168.1.1"),
+		}
+		return resp, nil
+	})}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() { _ = dnsProxy.Stop() }()
+
+	// The second response is from the cache
+	for i := 0; i < 2; i++ {
+		d := &DNSContext{Proto: ProtoUDP, Req: createHostTestMessage("host"), Addr: &net.UDPAddr{IP: net.IP{192, 0, 2, 10}}}
+		err = dnsProxy.Resolve(d)
+		assert.Nil(t, err)
+		if assert.Len(t, d.Res.Answer, 2) {
+			assert.Equal(t, "192.168.1.1", d.Res.Answer[0].(*dns.A).A.String())
+			assert.Equal(t, "192.0.2.1", d.Res.Answer[1].(*dns.A).A.String())
+		}
+	}
+}
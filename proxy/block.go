@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// defaultBlockTTL is used when BlockAction.TTL is not set
+const defaultBlockTTL = 10
+
+// BlockActionType defines how the proxy answers the blocked queries
+type BlockActionType int
+
+const (
+	// BlockNXDomain answers the blocked queries with NXDOMAIN
+	BlockNXDomain BlockActionType = iota
+	// BlockNoData answers the blocked queries with the empty NOERROR response
+	BlockNoData
+	// BlockSinkhole answers the blocked A and AAAA queries with
+	// BlockAction.IPs, the other blocked queries get the empty NOERROR
+	// response
+	BlockSinkhole
+	// BlockRefused answers the blocked queries with REFUSED
+	BlockRefused
+)
+
+// BlockAction is how the proxy answers the queries matching a block rule
+type BlockAction struct {
+	Type   BlockActionType
+	IPs    []net.IP // addresses of BlockSinkhole, the A queries get the IPv4 ones and the AAAA queries the IPv6 ones
+	Qtypes []uint16 // query types the rule applies to, all if empty
+	TTL    uint32   // TTL of the addresses and the SOA, 10 seconds if not set
+}
+
+// BlockRule is the block rule added with Proxy.AddBlockRule
+type BlockRule struct {
+	Pattern string      // normalized pattern, e.g. "*.example.org."
+	Action  BlockAction // how the matching queries are answered
+	Hits    uint64      // number of the queries blocked by the rule
+}
+
+// blockRule is the block rule with its hit counter
+type blockRule struct {
+	hits    uint64 // accessed atomically, the first field for the alignment
+	pattern string
+	action  BlockAction
+}
+
+// blockList keeps the block rules by the names of their patterns, so that the
+// lookup takes one map access per label of the name whatever the number of
+// the rules
+type blockList struct {
+	suffix   map[string]*blockRule // rules for the domains and their subdomains
+	wildcard map[string]*blockRule // rules for the subdomains only
+}
+
+// newBlockList creates the empty block list
+func newBlockList() *blockList {
+	return &blockList{
+		suffix:   map[string]*blockRule{},
+		wildcard: map[string]*blockRule{},
+	}
+}
+
+// parseBlockPattern returns the lowercase FQDN of the pattern and whether it
+// only matches the subdomains.  "example.org" matches the domain and its
+// subdomains, "*.example.org" only the subdomains.
+func parseBlockPattern(pattern string) (name string, wildcard bool, err error) {
+	name = strings.ToLower(strings.TrimSpace(pattern))
+	if strings.HasPrefix(name, "*.") {
+		name = name[2:]
+		wildcard = true
+	}
+	if name == "" || strings.Contains(name, "*") {
+		return "", false, fmt.Errorf("invalid block pattern %q", pattern)
+	}
+
+	name = dns.Fqdn(name)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", false, fmt.Errorf("invalid block pattern %q", pattern)
+	}
+	return name, wildcard, nil
+}
+
+// rules returns the map of the rules with the pattern type
+func (l *blockList) rules(wildcard bool) map[string]*blockRule {
+	if wildcard {
+		return l.wildcard
+	}
+	return l.suffix
+}
+
+// match returns the most specific rule that applies to the query, or nil if
+// there is none
+func (l *blockList) match(name string, qtype uint16) *blockRule {
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		suffix := name[off:]
+		if r := l.suffix[suffix]; r != nil && r.appliesTo(qtype) {
+			return r
+		}
+		if r := l.wildcard[suffix]; off > 0 && r != nil && r.appliesTo(qtype) {
+			return r
+		}
+	}
+	// The root zone pattern matches everything
+	if r := l.suffix["."]; r != nil && r.appliesTo(qtype) {
+		return r
+	}
+	return nil
+}
+
+// appliesTo checks if the rule applies to the query type
+func (r *blockRule) appliesTo(qtype uint16) bool {
+	if len(r.action.Qtypes) == 0 {
+		return true
+	}
+	for _, t := range r.action.Qtypes {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBlockAction checks the action and returns its copy with the IPv4
+// addresses in the 4-byte form
+func validateBlockAction(a BlockAction) (BlockAction, error) {
+	switch a.Type {
+	case BlockNXDomain, BlockNoData, BlockRefused:
+		// Nothing to check
+	case BlockSinkhole:
+		if len(a.IPs) == 0 {
+			return a, errors.New("no sinkhole addresses specified")
+		}
+	default:
+		return a, fmt.Errorf("unknown block action type %d", a.Type)
+	}
+
+	ips := make([]net.IP, 0, len(a.IPs))
+	for _, ip := range a.IPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		} else if ip.To16() == nil {
+			return a, fmt.Errorf("invalid sinkhole address %v", ip)
+		}
+		ips = append(ips, ip)
+	}
+	a.IPs = ips
+	a.Qtypes = append([]uint16(nil), a.Qtypes...)
+	return a, nil
+}
+
+// AddBlockRule adds the rule that blocks the queries for the domains matching
+// the pattern, the rule with the same pattern is replaced.  "example.org"
+// matches the domain and its subdomains, "*.example.org" only the subdomains.
+// The names are case-insensitive.  The most specific rule that applies to the
+// query type is used.  The blocked queries are answered before the hosts
+// records and the cache are looked up, so the upstream responses for them are
+// never cached.  It's safe to call it while the proxy is running.
+func (p *Proxy) AddBlockRule(pattern string, action BlockAction) error {
+	name, wildcard, err := parseBlockPattern(pattern)
+	if err != nil {
+		return err
+	}
+	action, err = validateBlockAction(action)
+	if err != nil {
+		return err
+	}
+
+	r := &blockRule{pattern: name, action: action}
+	if wildcard {
+		r.pattern = "*." + name
+	}
+
+	p.blockLock.Lock()
+	defer p.blockLock.Unlock()
+
+	if p.blocked == nil {
+		p.blocked = newBlockList()
+	}
+	p.blocked.rules(wildcard)[name] = r
+	return nil
+}
+
+// RemoveBlockRule removes the rule added with AddBlockRule, it returns false
+// if there is no rule with the pattern.  It's safe to call it while the proxy
+// is running.
+func (p *Proxy) RemoveBlockRule(pattern string) bool {
+	name, wildcard, err := parseBlockPattern(pattern)
+	if err != nil {
+		return false
+	}
+
+	p.blockLock.Lock()
+	defer p.blockLock.Unlock()
+
+	if p.blocked == nil {
+		return false
+	}
+	rules := p.blocked.rules(wildcard)
+	if _, ok := rules[name]; !ok {
+		return false
+	}
+	delete(rules, name)
+	return true
+}
+
+// BlockRules returns the block rules with the numbers of the queries they've
+// blocked, sorted by the pattern
+func (p *Proxy) BlockRules() []BlockRule {
+	p.blockLock.RLock()
+	defer p.blockLock.RUnlock()
+
+	if p.blocked == nil {
+		return nil
+	}
+
+	rules := make([]BlockRule, 0, len(p.blocked.suffix)+len(p.blocked.wildcard))
+	for _, m := range []map[string]*blockRule{p.blocked.suffix, p.blocked.wildcard} {
+		for _, r := range m {
+			rules = append(rules, BlockRule{
+				Pattern: r.pattern,
+				Action:  r.action,
+				Hits:    atomic.LoadUint64(&r.hits),
+			})
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Pattern < rules[j].Pattern })
+	return rules
+}
+
+// replyBlocked answers the request if it matches one of the block rules
+func (p *Proxy) replyBlocked(d *DNSContext) bool {
+	q := d.Req.Question[0]
+
+	p.blockLock.RLock()
+	var r *blockRule
+	if p.blocked != nil {
+		r = p.blocked.match(q.Name, q.Qtype)
+	}
+	p.blockLock.RUnlock()
+
+	if r == nil {
+		return false
+	}
+
+	atomic.AddUint64(&r.hits, 1)
+	d.Res = genBlocked(d.Req, r.action)
+	log.Debug("Blocked %s by rule %s", q.Name, r.pattern)
+	return true
+}
+
+// genBlocked creates the response to the blocked request
+func genBlocked(req *dns.Msg, a BlockAction) *dns.Msg {
+	ttl := a.TTL
+	if ttl == 0 {
+		ttl = defaultBlockTTL
+	}
+
+	var resp *dns.Msg
+	switch a.Type {
+	case BlockNXDomain:
+		resp = GenEmptyMessage(req, dns.RcodeNameError, retryNoError)
+	case BlockRefused:
+		resp = new(dns.Msg).SetRcode(req, dns.RcodeRefused)
+		resp.RecursionAvailable = true
+		return resp
+	default:
+		resp = genEmptyNoError(req)
+		if a.Type == BlockSinkhole {
+			resp.Answer = sinkholeAnswer(req.Question[0], a.IPs, ttl)
+		}
+		if len(resp.Answer) > 0 {
+			resp.Ns = nil
+		}
+	}
+
+	for _, rr := range resp.Ns {
+		rr.Header().Ttl = ttl
+	}
+	return resp
+}
+
+// sinkholeAnswer returns the records with the addresses of the query type
+func sinkholeAnswer(q dns.Question, ips []net.IP, ttl uint32) []dns.RR {
+	var answer []dns.RR
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+			answer = append(answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return answer
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newBlockTestProxy creates the proxy with the cache and the upstream that
+// answers every A request with 192.0.2.1
+func newBlockTestProxy(t *testing.T) *Proxy {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{
+		upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+			resp := new(dns.Msg).SetReply(m)
+			if m.Question[0].Qtype == dns.TypeA {
+				resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 192.0.2.1")}
+			}
+			return resp, nil
+		}),
+	}
+	err := dnsProxy.Init()
+	if err != nil {
+		t.Fatalf("cannot initialize the DNS proxy: %s", err)
+	}
+	return dnsProxy
+}
+
+// resolveBlock resolves the request with the proxy
+func resolveBlock(t *testing.T, dnsProxy *Proxy, name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	d := &DNSContext{Req: req}
+	err := dnsProxy.Resolve(d)
+	if err != nil {
+		t.Fatalf("cannot resolve %s: %s", name, err)
+	}
+	return d.Res
+}
+
+func TestBlockRules(t *testing.T) {
+	dnsProxy := newBlockTestProxy(t)
+	sinkhole := BlockAction{Type: BlockSinkhole, IPs: []net.IP{net.ParseIP("0.0.0.0"), net.ParseIP("::")}, TTL: 30}
+	assert.Nil(t, dnsProxy.AddBlockRule("ads.example.org", BlockAction{Type: BlockNXDomain}))
+	assert.Nil(t, dnsProxy.AddBlockRule("*.Tracker.example.org", BlockAction{Type: BlockNoData}))
+	assert.Nil(t, dnsProxy.AddBlockRule("sinkhole.example.org.", sinkhole))
+	assert.Nil(t, dnsProxy.AddBlockRule("refused.example.org", BlockAction{Type: BlockRefused}))
+	assert.Nil(t, dnsProxy.AddBlockRule("allowed.ads.example.org", BlockAction{Type: BlockNoData, Qtypes: []uint16{dns.TypeTXT}}))
+
+	testCases := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string // the address of the only answer, "" if there is none
+		ttl    uint32 // TTL of the answer or the SOA, 0 if it's not blocked
+	}{
+		{"ads.example.org.", dns.TypeA, dns.RcodeNameError, "", defaultBlockTTL},
+		{"www.ADS.example.org.", dns.TypeAAAA, dns.RcodeNameError, "", defaultBlockTTL},
+		{"tracker.example.org.", dns.TypeA, dns.RcodeSuccess, "192.0.2.1", 0},
+		{"a.b.tracker.example.org.", dns.TypeA, dns.RcodeSuccess, "", defaultBlockTTL},
+		{"sinkhole.example.org.", dns.TypeA, dns.RcodeSuccess, "0.0.0.0", 30},
+		{"www.sinkhole.example.org.", dns.TypeAAAA, dns.RcodeSuccess, "::", 30},
+		{"sinkhole.example.org.", dns.TypeMX, dns.RcodeSuccess, "", 30},
+		{"refused.example.org.", dns.TypeA, dns.RcodeRefused, "", defaultBlockTTL},
+		{"allowed.ads.example.org.", dns.TypeTXT, dns.RcodeSuccess, "", defaultBlockTTL},
+		// The more specific rule only applies to TXT, so the less specific
+		// one is used
+		{"allowed.ads.example.org.", dns.TypeA, dns.RcodeNameError, "", defaultBlockTTL},
+		{"example.org.", dns.TypeA, dns.RcodeSuccess, "192.0.2.1", 0},
+		{"notads.example.org.", dns.TypeA, dns.RcodeSuccess, "192.0.2.1", 0},
+	}
+
+	for _, tc := range testCases {
+		res := resolveBlock(t, dnsProxy, tc.name, tc.qtype)
+		assert.Equal(t, tc.rcode, res.Rcode, tc.name)
+		if tc.answer == "" {
+			assert.Empty(t, res.Answer, tc.name)
+		} else if assert.Len(t, res.Answer, 1, tc.name) {
+			ip := proxyutil.GetIPFromDNSRecord(res.Answer[0])
+			assert.Equal(t, tc.answer, ip.String(), tc.name)
+			if tc.ttl != 0 {
+				assert.Equal(t, tc.ttl, res.Answer[0].Header().Ttl, tc.name)
+			}
+		}
+
+		// The negative responses have the SOA for caching
+		if tc.ttl != 0 && tc.answer == "" && tc.rcode != dns.RcodeRefused && assert.Len(t, res.Ns, 1, tc.name) {
+			assert.Equal(t, tc.ttl, res.Ns[0].Header().Ttl, tc.name)
+		}
+	}
+
+	rules := dnsProxy.BlockRules()
+	hits := map[string]uint64{}
+	for _, r := range rules {
+		hits[r.Pattern] = r.Hits
+	}
+	assert.Equal(t, map[string]uint64{
+		"*.tracker.example.org.":   1,
+		"ads.example.org.":         3,
+		"allowed.ads.example.org.": 1,
+		"refused.example.org.":     1,
+		"sinkhole.example.org.":    3,
+	}, hits)
+	assert.Equal(t, "*.tracker.example.org.", rules[0].Pattern)
+}
+
+func TestBlockRulesRuntime(t *testing.T) {
+	dnsProxy := newBlockTestProxy(t)
+
+	// The blocked names aren't cached from the upstream
+	assert.Nil(t, dnsProxy.AddBlockRule("example.org", BlockAction{Type: BlockNXDomain}))
+	res := resolveBlock(t, dnsProxy, "example.org.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	_, ok := dnsProxy.CacheGet("example.org.", dns.TypeA)
+	assert.False(t, ok)
+
+	// The rule with the same pattern is replaced
+	assert.Nil(t, dnsProxy.AddBlockRule("EXAMPLE.org.", BlockAction{Type: BlockRefused}))
+	res = resolveBlock(t, dnsProxy, "example.org.", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, res.Rcode)
+	assert.Len(t, dnsProxy.BlockRules(), 1)
+
+	// The removed rules don't apply, the wildcard and the suffix rules are
+	// different
+	assert.Nil(t, dnsProxy.AddBlockRule("*.example.org", BlockAction{Type: BlockNXDomain}))
+	assert.True(t, dnsProxy.RemoveBlockRule("example.org"))
+	assert.False(t, dnsProxy.RemoveBlockRule("example.org"))
+	res = resolveBlock(t, dnsProxy, "example.org.", dns.TypeA)
+	assert.Len(t, res.Answer, 1)
+	res = resolveBlock(t, dnsProxy, "www.example.org.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	assert.True(t, dnsProxy.RemoveBlockRule("*.example.org"))
+	res = resolveBlock(t, dnsProxy, "www.example.org.", dns.TypeA)
+	assert.Len(t, res.Answer, 1)
+	assert.Empty(t, dnsProxy.BlockRules())
+
+	// The invalid rules are rejected
+	for _, pattern := range []string{"", "*", "ads*.example.org", "*.*.example.org", "exa mple..org"} {
+		assert.NotNil(t, dnsProxy.AddBlockRule(pattern, BlockAction{}), pattern)
+	}
+	assert.NotNil(t, dnsProxy.AddBlockRule("example.org", BlockAction{Type: BlockSinkhole}))
+	assert.NotNil(t, dnsProxy.AddBlockRule("example.org", BlockAction{Type: BlockActionType(100)}))
+	assert.NotNil(t, dnsProxy.AddBlockRule("example.org", BlockAction{Type: BlockSinkhole, IPs: []net.IP{{1, 2, 3}}}))
+}
+
+func BenchmarkBlockRules(b *testing.B) {
+	l := newBlockList()
+	for i := 0; i < 50000; i++ {
+		l.suffix[fmt.Sprintf("host%d.example.org.", i)] = &blockRule{}
+		l.wildcard[fmt.Sprintf("zone%d.example.net.", i)] = &blockRule{}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if l.match("www.a.b.c.unblocked.example.com.", dns.TypeA) != nil {
+			b.Fatalf("unexpected match")
+		}
+		if l.match("www.zone49999.example.net.", dns.TypeA) == nil {
+			b.Fatalf("no match")
+		}
+	}
+}
@@ -1,28 +1,66 @@
 package proxy
 
 import (
+	"net"
+
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
 
-// isBogusNXDomain - checks if the specified DNS message
-// contains AT LEAST ONE ip address from the Proxy.BogusNXDomain list
-func (p *Proxy) isBogusNXDomain(reply *dns.Msg) bool {
+// isBogusIP checks if the IP address is in the Proxy.BogusNXDomain list or in
+// one of the Proxy.BogusNXDomainNets networks
+func (p *Proxy) isBogusIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	if proxyutil.ContainsIP(p.BogusNXDomain, ip) {
+		return true
+	}
+
+	for _, n := range p.BogusNXDomainNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterBogusNXDomain replaces the response with NXDOMAIN if all of its A and
+// AAAA records contain the bogus IP addresses.  If only some of them do, these
+// records are removed from the answer.
+func (p *Proxy) filterBogusNXDomain(reply *dns.Msg) *dns.Msg {
 	if reply == nil ||
-		len(p.BogusNXDomain) == 0 ||
+		(len(p.BogusNXDomain) == 0 && len(p.BogusNXDomainNets) == 0) ||
 		len(reply.Answer) == 0 ||
 		(reply.Question[0].Qtype != dns.TypeA &&
 			reply.Question[0].Qtype != dns.TypeAAAA) {
-		return false
+		return reply
 	}
 
+	addrs := 0
+	answer := make([]dns.RR, 0, len(reply.Answer))
 	for _, rr := range reply.Answer {
 		ip := proxyutil.GetIPFromDNSRecord(rr)
-		if proxyutil.ContainsIP(p.BogusNXDomain, ip) {
-			return true
+		if ip != nil {
+			addrs++
+		}
+		if !p.isBogusIP(ip) {
+			answer = append(answer, rr)
 		}
 	}
 
-	// No IPs are bogus if we got here
-	return false
+	bogus := len(reply.Answer) - len(answer)
+	switch {
+	case bogus == 0:
+		return reply
+	case bogus == addrs:
+		log.Tracef("Received IP from the bogus-nxdomain list, replacing response")
+		return p.genNXDomain(reply)
+	default:
+		log.Tracef("Removing %d bogus-nxdomain records from the response", bogus)
+		reply.Answer = answer
+		return reply
+	}
 }
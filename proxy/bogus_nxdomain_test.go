@@ -4,6 +4,7 @@ import (
 	"net"
 	"testing"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -74,3 +75,83 @@ func TestBogusNXDomainTypeA(t *testing.T) {
 
 	_ = dnsProxy.Stop()
 }
+
+func TestBogusNXDomainNets(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.BogusNXDomain = []net.IP{net.ParseIP("2001:db8::1")}
+	_, ipNet, _ := net.ParseCIDR("192.0.2.0/24")
+	dnsProxy.BogusNXDomainNets = []*net.IPNet{ipNet}
+
+	var answer []dns.RR
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = answer
+		return resp, nil
+	})}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() { _ = dnsProxy.Stop() }()
+
+	testCases := []struct {
+		name   string
+		qtype  uint16
+		answer []dns.RR
+		rcode  int
+		left   int
+	}{{
+		name:   "ipv4_range_all",
+		qtype:  dns.TypeA,
+		answer: []dns.RR{newRR("host. 10 IN A 192.0.2.1"), newRR("host. 10 IN A 192.0.2.200")},
+		rcode:  dns.RcodeNameError,
+		left:   0,
+	}, {
+		name:   "ipv4_range_partial",
+		qtype:  dns.TypeA,
+		answer: []dns.RR{newRR("host. 10 IN A 192.0.2.1"), newRR("host. 10 IN A 192.0.3.1")},
+		rcode:  dns.RcodeSuccess,
+		left:   1,
+	}, {
+		name:   "ipv4_outside",
+		qtype:  dns.TypeA,
+		answer: []dns.RR{newRR("host. 10 IN A 192.0.3.1")},
+		rcode:  dns.RcodeSuccess,
+		left:   1,
+	}, {
+		name:   "ipv6_single",
+		qtype:  dns.TypeAAAA,
+		answer: []dns.RR{newRR("host. 10 IN CNAME alias."), newRR("alias. 10 IN AAAA 2001:db8::1")},
+		rcode:  dns.RcodeNameError,
+		left:   0,
+	}, {
+		name:   "ipv6_partial",
+		qtype:  dns.TypeAAAA,
+		answer: []dns.RR{newRR("host. 10 IN AAAA 2001:db8::1"), newRR("host. 10 IN AAAA 2001:db8::2")},
+		rcode:  dns.RcodeSuccess,
+		left:   1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			answer = tc.answer
+
+			d := DNSContext{Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+			d.Req = new(dns.Msg).SetQuestion("host.", tc.qtype)
+			err := dnsProxy.Resolve(&d)
+			if err != nil {
+				t.Fatalf("cannot resolve: %s", err)
+			}
+
+			assert.Equal(t, tc.rcode, d.Res.Rcode)
+			addrs := 0
+			for _, rr := range d.Res.Answer {
+				if rr.Header().Rrtype == tc.qtype {
+					addrs++
+					assert.False(t, dnsProxy.isBogusIP(proxyutil.GetIPFromDNSRecord(rr)))
+				}
+			}
+			assert.Equal(t, tc.left, addrs)
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"math"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	glcache "github.com/AdguardTeam/golibs/cache"
@@ -14,12 +15,339 @@ import (
 
 const (
 	defaultCacheSize = 64 * 1024 // in bytes
+
+	// staleTTL is the TTL of the expired responses served when the upstreams
+	// fail, as RFC 8767 recommends
+	staleTTL = 30
 )
 
 type cache struct {
+	hits      uint64 // number of requests answered from cache, accessed atomically
+	misses    uint64 // number of requests not found in cache, accessed atomically
+	evictions uint64 // number of items removed to free space, accessed atomically
+
 	items        glcache.Cache // cache
 	cacheSize    int           // cache size (in bytes)
+	staleIfError uint32        // how long the expired responses are kept to be served if the upstreams fail (in seconds)
 	sync.RWMutex               // lock
+
+	// index is the question of every stored response by key, since the
+	// storage can't be iterated.  It's only changed together with the
+	// storage while indexLock is held, so it has exactly the keys of the
+	// stored responses and is bounded by the cache size.
+	index     map[string]cacheIndexEntry
+	indexLock sync.Mutex // protects index and pinned and serializes the changes of the storage
+
+	// pinned are the responses stored with Proxy.CachePin by key in the
+	// packResponse format, they're kept apart from the storage since they
+	// must neither expire nor be evicted
+	pinned map[string][]byte
+}
+
+// cacheIndexEntry is the question of a stored response
+type cacheIndexEntry struct {
+	name  string // lowercase name
+	qtype uint16
+}
+
+// initItems lazily initializes the cache storage
+func (c *cache) initItems() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.items != nil {
+		return
+	}
+
+	conf := glcache.Config{
+		MaxSize:   uint(c.maxSize()),
+		EnableLRU: true,
+		// The storage calls it from Set, which is called with indexLock
+		// held
+		OnDelete: func(key, _ []byte) {
+			atomic.AddUint64(&c.evictions, 1)
+			delete(c.index, string(key))
+		},
+	}
+	c.items = glcache.New(conf)
+}
+
+// setItem stores the packed response and adds it to the index.  It returns
+// false if the response is too large to be stored.
+func (c *cache) setItem(key []byte, m *dns.Msg) bool {
+	return c.setData(key, packResponse(m), m.Question[0])
+}
+
+// setData stores the data in the packResponse format for the question, see
+// setItem
+func (c *cache) setData(key, data []byte, q dns.Question) bool {
+	c.initItems()
+
+	if len(key)+len(data) > c.maxSize() {
+		// The storage would refuse it anyway
+		log.Tracef("Refusing to cache a response of %d bytes", len(data))
+		return false
+	}
+
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if c.index == nil {
+		c.index = map[string]cacheIndexEntry{}
+	}
+	c.index[string(key)] = cacheIndexEntry{name: strings.ToLower(q.Name), qtype: q.Qtype}
+	_ = c.items.Set(key, data)
+	return true
+}
+
+// maxSize returns the cache size in bytes
+func (c *cache) maxSize() int {
+	if c.cacheSize > 0 {
+		return c.cacheSize
+	}
+	return defaultCacheSize
+}
+
+// delItem removes the response from the storage and the index
+func (c *cache) delItem(key []byte) {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	c.delItemLocked(key)
+}
+
+// delItemLocked is delItem for the callers that hold indexLock
+func (c *cache) delItemLocked(key []byte) {
+	c.items.Del(key)
+	delete(c.index, string(key))
+}
+
+// clear removes all responses
+func (c *cache) clear() {
+	c.Lock()
+	items := c.items
+	c.Unlock()
+
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if items != nil {
+		items.Clear()
+	}
+	c.index = nil
+	c.pinned = nil
+}
+
+// purge removes the responses for the domain, and its subdomains if
+// subdomains is true, and returns the number of the removed responses
+func (c *cache) purge(domain string, subdomains bool) int {
+	domain = strings.ToLower(dns.Fqdn(domain))
+
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	matches := func(name string) bool {
+		return name == domain || (subdomains && (domain == "." || strings.HasSuffix(name, "."+domain)))
+	}
+
+	n := 0
+	for key, e := range c.index {
+		if matches(e.name) {
+			// Deleting the map entries while ranging over it is fine
+			c.delItemLocked([]byte(key))
+			n++
+		}
+	}
+	for key := range c.pinned {
+		if matches(keyName(key)) {
+			delete(c.pinned, key)
+			n++
+		}
+	}
+	return n
+}
+
+// pin stores the response so that it never expires and isn't evicted, see
+// Proxy.CachePin
+func (c *cache) pin(m *dns.Msg) {
+	data := packResponse(m)
+
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if c.pinned == nil {
+		c.pinned = map[string][]byte{}
+	}
+	c.pinned[string(key(m))] = data
+}
+
+// unpin removes the pinned response for the question with and without the DO
+// bit, it returns false if there is none
+func (c *cache) unpin(name string, qtype uint16) bool {
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	plain := string(key(req))
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	do := string(key(req))
+
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	_, ok := c.pinned[plain]
+	_, okDO := c.pinned[do]
+	delete(c.pinned, plain)
+	delete(c.pinned, do)
+	return ok || okDO
+}
+
+// pinnedData returns the pinned response stored with the key in the
+// packResponse format, or nil if there is none
+func (c *cache) pinnedData(key []byte) []byte {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	return c.pinned[string(key)]
+}
+
+// getPinned returns the pinned response for the request with its lowest TTL
+func (c *cache) getPinned(request *dns.Msg) (*dns.Msg, bool) {
+	if request == nil || len(request.Question) != 1 {
+		return nil, false
+	}
+
+	data := c.pinnedData(key(request))
+	if data == nil {
+		return nil, false
+	}
+
+	res := unpackResponseTTL(data, request, pinnedTTL(data))
+	return res, res != nil
+}
+
+// pinnedTTL returns the lowest TTL of the pinned response, packResponse has
+// stored it as the difference between the expiration and insertion times
+func pinnedTTL(data []byte) uint32 {
+	return binary.BigEndian.Uint32(data[:4]) - binary.BigEndian.Uint32(data[4:8])
+}
+
+// keyName returns the name of the question the key was created for
+func keyName(key string) string {
+	return key[5:]
+}
+
+// entries returns the information about the stored responses that haven't
+// expired yet
+func (c *cache) entries() []CacheEntry {
+	c.Lock()
+	items := c.items
+	c.Unlock()
+	if items == nil {
+		return nil
+	}
+
+	c.indexLock.Lock()
+	index := make(map[string]cacheIndexEntry, len(c.index))
+	for key, e := range c.index {
+		index[key] = e
+	}
+	var entries []CacheEntry
+	for key, data := range c.pinned {
+		entries = append(entries, CacheEntry{
+			Name:   keyName(key),
+			Qtype:  binary.BigEndian.Uint16([]byte(key[1:3])),
+			TTL:    pinnedTTL(data),
+			Size:   len(data) - 8,
+			Pinned: true,
+		})
+	}
+	c.indexLock.Unlock()
+
+	now := time.Now().Unix()
+	for key, e := range index {
+		data := items.Get([]byte(key))
+		if data == nil {
+			continue
+		}
+
+		expire := int64(binary.BigEndian.Uint32(data[:4]))
+		if expire <= now {
+			continue
+		}
+
+		entries = append(entries, CacheEntry{
+			Name:  e.name,
+			Qtype: e.qtype,
+			TTL:   uint32(expire - now),
+			Size:  len(data) - 8,
+		})
+	}
+	return entries
+}
+
+// entry returns the stored response with the times it was cached and
+// expires, or false if there is none or it has expired
+func (c *cache) entry(key []byte) (*CacheEntry, bool) {
+	if data := c.pinnedData(key); data != nil {
+		e, ok := unpackEntry(data)
+		if ok {
+			e.TTL = pinnedTTL(data)
+			e.Pinned = true
+		}
+		return e, ok
+	}
+
+	c.Lock()
+	items := c.items
+	c.Unlock()
+	if items == nil {
+		return nil, false
+	}
+
+	data := items.Get(key)
+	if data == nil {
+		return nil, false
+	}
+
+	now := time.Now().Unix()
+	expire := int64(binary.BigEndian.Uint32(data[:4]))
+	if expire <= now {
+		return nil, false
+	}
+
+	e, ok := unpackEntry(data)
+	if ok {
+		e.TTL = uint32(expire - now)
+		e.Expires = time.Unix(expire, 0)
+	}
+	return e, ok
+}
+
+// unpackEntry returns the entry with the response stored in the packResponse
+// format, the TTL and the expiration time aren't set
+func unpackEntry(data []byte) (*CacheEntry, bool) {
+	// The response is unpacked from the stored data, so it's a copy
+	m := &dns.Msg{}
+	err := m.Unpack(data[8:])
+	if err != nil || len(m.Question) != 1 {
+		return nil, false
+	}
+
+	return &CacheEntry{
+		Name:     strings.ToLower(m.Question[0].Name),
+		Qtype:    m.Question[0].Qtype,
+		Size:     len(data) - 8,
+		Msg:      m,
+		Inserted: time.Unix(int64(binary.BigEndian.Uint32(data[4:8])), 0),
+	}, true
+}
+
+// countLookup counts the cache hit or miss
+func (c *cache) countLookup(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
 }
 
 func (c *cache) Get(request *dns.Msg) (*dns.Msg, bool) {
@@ -31,22 +359,65 @@ func (c *cache) Get(request *dns.Msg) (*dns.Msg, bool) {
 	c.Lock()
 	if c.items == nil {
 		c.Unlock()
+		c.countLookup(false)
 		return nil, false
 	}
 	c.Unlock()
 	data := c.items.Get(key)
 	if data == nil {
+		c.countLookup(false)
 		return nil, false
 	}
 
 	res := unpackResponse(data, request)
 	if res == nil {
-		c.items.Del(key)
+		if !c.isStale(data) {
+			c.delItem(key)
+		}
+		c.countLookup(false)
 		return nil, false
 	}
+	c.countLookup(true)
 	return res, true
 }
 
+// isStale checks if the stored response has expired, but may still be served
+// if the upstreams fail
+func (c *cache) isStale(data []byte) bool {
+	now := time.Now().Unix()
+	expire := int64(binary.BigEndian.Uint32(data[:4]))
+	return expire <= now && expire+int64(c.staleIfError) > now
+}
+
+// getStale returns the expired response for the request with staleTTL if it
+// has been expired for less than staleIfError, see Config.CacheStaleIfError.
+// The lookup isn't counted, it has already missed.
+func (c *cache) getStale(request *dns.Msg) (*dns.Msg, bool) {
+	if request == nil || len(request.Question) != 1 {
+		return nil, false
+	}
+
+	return c.getStaleItem(key(request), request)
+}
+
+// getStaleItem returns the expired response stored with the key, see getStale
+func (c *cache) getStaleItem(key []byte, request *dns.Msg) (*dns.Msg, bool) {
+	c.Lock()
+	items := c.items
+	c.Unlock()
+	if items == nil {
+		return nil, false
+	}
+
+	data := items.Get(key)
+	if data == nil || !c.isStale(data) {
+		return nil, false
+	}
+
+	res := unpackResponseTTL(data, request, staleTTL)
+	return res, res != nil
+}
+
 func (c *cache) Set(m *dns.Msg) {
 	if m == nil {
 		return // no-op
@@ -56,24 +427,7 @@ func (c *cache) Set(m *dns.Msg) {
 		return
 	}
 
-	key := key(m)
-
-	c.Lock()
-	// lazy initialization for cache
-	if c.items == nil {
-		conf := glcache.Config{
-			MaxSize:   defaultCacheSize,
-			EnableLRU: true,
-		}
-		if c.cacheSize > 0 {
-			conf.MaxSize = uint(c.cacheSize)
-		}
-		c.items = glcache.New(conf)
-	}
-	c.Unlock()
-
-	data := packResponse(m)
-	_ = c.items.Set(key, data)
+	c.setItem(key(m), m)
 }
 
 // check if message is cacheable
@@ -210,16 +564,19 @@ func key(m *dns.Msg) []byte {
 
 /*
 expire [4]byte
+inserted [4]byte
 dns_message []byte
 */
 func packResponse(m *dns.Msg) []byte {
 	pm, _ := m.Pack()
 	actualTTL := findLowestTTL(m)
-	expire := uint32(time.Now().Unix()) + actualTTL
+	now := uint32(time.Now().Unix())
+	expire := now + actualTTL
 	var d []byte
-	d = make([]byte, 4+len(pm))
+	d = make([]byte, 8+len(pm))
 	binary.BigEndian.PutUint32(d, expire)
-	copy(d[4:], pm)
+	binary.BigEndian.PutUint32(d[4:], now)
+	copy(d[8:], pm)
 	return d
 }
 
@@ -230,10 +587,15 @@ func unpackResponse(data []byte, request *dns.Msg) *dns.Msg {
 	if int64(expire) <= now {
 		return nil
 	}
-	ttl := expire - uint32(now)
 
+	return unpackResponseTTL(data, request, expire-uint32(now))
+}
+
+// unpackResponseTTL unpacks the stored response for the request with the TTL
+// of all records set to ttl, it returns nil if the response can't be unpacked
+func unpackResponseTTL(data []byte, request *dns.Msg, ttl uint32) *dns.Msg {
 	m := dns.Msg{}
-	err := m.Unpack(data[4:])
+	err := m.Unpack(data[8:])
 	if err != nil {
 		return nil
 	}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// The cache file format, all numbers are big-endian: the magic "DPXC", the
+// uint16 version, the records and the uint32 CRC-32 (IEEE) of everything before
+// it.  The record is uint8 cache (0 for the general cache, 1 for the subnet
+// one), uint16 key length, uint32 data length, the key and the data in the
+// packResponse format, it starts with the absolute expiry time.
+const (
+	cacheFileMagic   = "DPXC"
+	cacheFileVersion = 1
+
+	cacheFileHeaderSize = len(cacheFileMagic) + 2
+	cacheRecordHeadSize = 1 + 2 + 4
+)
+
+// cacheRecord is a cache entry read from the cache file
+type cacheRecord struct {
+	subnet bool // the entry of the subnet cache
+	key    []byte
+	data   []byte
+}
+
+// errCacheDisabled is returned by SaveCache and LoadCache if the cache is
+// disabled
+var errCacheDisabled = errors.New("cache is disabled")
+
+// SaveCache writes the responses of the general and subnet caches that haven't
+// expired yet to w in a compact binary format along with their absolute expiry
+// times.  No more than the cache size is written for each of the caches.
+func (p *Proxy) SaveCache(w io.Writer) error {
+	if p.cache == nil {
+		return errCacheDisabled
+	}
+
+	sum := crc32.NewIEEE()
+	bw := bufio.NewWriter(w)
+	out := io.MultiWriter(bw, sum)
+
+	header := make([]byte, cacheFileHeaderSize)
+	copy(header, cacheFileMagic)
+	binary.BigEndian.PutUint16(header[len(cacheFileMagic):], cacheFileVersion)
+	_, err := out.Write(header)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, c := range p.caches() {
+		subnet := c != p.cache
+		for _, r := range c.records(subnet) {
+			head := make([]byte, cacheRecordHeadSize)
+			if r.subnet {
+				head[0] = 1
+			}
+			binary.BigEndian.PutUint16(head[1:], uint16(len(r.key)))
+			binary.BigEndian.PutUint32(head[3:], uint32(len(r.data)))
+			for _, b := range [][]byte{head, r.key, r.data} {
+				_, err = out.Write(b)
+				if err != nil {
+					return err
+				}
+			}
+			n++
+		}
+	}
+
+	_ = binary.Write(bw, binary.BigEndian, sum.Sum32())
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Saved %d responses from cache", n)
+	return nil
+}
+
+// LoadCache reads the responses written by SaveCache from r and stores them
+// in the general and subnet caches, the ones that have expired are skipped.
+// Nothing is stored if the data is corrupted, is of another format version or
+// is larger than SaveCache could have written with the current cache size.
+func (p *Proxy) LoadCache(r io.Reader) error {
+	if p.cache == nil {
+		return errCacheDisabled
+	}
+
+	limit := cacheFileHeaderSize + 4
+	for _, c := range p.caches() {
+		// The record headers are smaller than the smallest entry
+		limit += 2 * c.maxSize()
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return err
+	}
+	records, err := parseCacheFile(buf, limit)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	n := 0
+	for _, rec := range records {
+		c := p.cache
+		if rec.subnet {
+			if p.cacheSubnet == nil {
+				continue
+			}
+			c = (*cache)(p.cacheSubnet)
+		}
+
+		if int64(binary.BigEndian.Uint32(rec.data[:4])) <= now {
+			continue
+		}
+		m := &dns.Msg{}
+		if m.Unpack(rec.data[8:]) != nil || len(m.Question) != 1 {
+			continue
+		}
+		if c.setData(rec.key, rec.data, m.Question[0]) {
+			n++
+		}
+	}
+
+	log.Debug("Loaded %d responses into cache", n)
+	return nil
+}
+
+// parseCacheFile checks the header and the checksum of the cache file and
+// returns its records
+func parseCacheFile(buf []byte, limit int) ([]cacheRecord, error) {
+	if len(buf) > limit {
+		return nil, fmt.Errorf("cache file is larger than %d bytes", limit)
+	}
+	if len(buf) < cacheFileHeaderSize+4 || string(buf[:len(cacheFileMagic)]) != cacheFileMagic {
+		return nil, errors.New("not a cache file")
+	}
+	v := binary.BigEndian.Uint16(buf[len(cacheFileMagic):])
+	if v != cacheFileVersion {
+		return nil, fmt.Errorf("unsupported cache file version %d", v)
+	}
+
+	end := len(buf) - 4
+	if crc32.ChecksumIEEE(buf[:end]) != binary.BigEndian.Uint32(buf[end:]) {
+		return nil, errors.New("cache file checksum mismatch")
+	}
+
+	var records []cacheRecord
+	b := buf[cacheFileHeaderSize:end]
+	for len(b) > 0 {
+		if len(b) < cacheRecordHeadSize {
+			return nil, errors.New("truncated cache record")
+		}
+		keyLen := int(binary.BigEndian.Uint16(b[1:]))
+		dataLen := int(binary.BigEndian.Uint32(b[3:]))
+		rec := cacheRecord{subnet: b[0] == 1}
+		b = b[cacheRecordHeadSize:]
+		if keyLen+dataLen > len(b) || dataLen < 8 {
+			return nil, errors.New("truncated cache record")
+		}
+
+		rec.key = b[:keyLen]
+		rec.data = b[keyLen : keyLen+dataLen]
+		records = append(records, rec)
+		b = b[keyLen+dataLen:]
+	}
+	return records, nil
+}
+
+// records returns the entries of the cache that haven't expired yet, the
+// total size of their keys and data doesn't exceed the cache size
+func (c *cache) records(subnet bool) []cacheRecord {
+	c.Lock()
+	items := c.items
+	c.Unlock()
+	if items == nil {
+		return nil
+	}
+
+	c.indexLock.Lock()
+	keys := make([]string, 0, len(c.index))
+	for key := range c.index {
+		keys = append(keys, key)
+	}
+	c.indexLock.Unlock()
+
+	now := time.Now().Unix()
+	size := 0
+	var records []cacheRecord
+	for _, key := range keys {
+		data := items.Get([]byte(key))
+		if data == nil || int64(binary.BigEndian.Uint32(data[:4])) <= now {
+			continue
+		}
+
+		size += len(key) + len(data)
+		if size > c.maxSize() {
+			break
+		}
+		records = append(records, cacheRecord{subnet: subnet, key: []byte(key), data: data})
+	}
+	return records
+}
+
+// saveCacheFile writes the cache to Config.CacheFile, the file is replaced
+// atomically
+func (p *Proxy) saveCacheFile() error {
+	var buf bytes.Buffer
+	err := p.SaveCache(&buf)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p.CacheFile), filepath.Base(p.CacheFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p.CacheFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	log.Printf("Saved cache to %s", p.CacheFile)
+	return nil
+}
+
+// loadCacheFile loads the cache from Config.CacheFile.  The errors are only
+// logged, the proxy starts with the empty cache then.
+func (p *Proxy) loadCacheFile() {
+	f, err := os.Open(p.CacheFile)
+	if os.IsNotExist(err) {
+		log.Debug("Cache file %s doesn't exist yet", p.CacheFile)
+		return
+	}
+	if err != nil {
+		log.Error("ignoring the cache file: %s", err)
+		return
+	}
+	defer f.Close()
+
+	err = p.LoadCache(f)
+	if err != nil {
+		log.Error("ignoring the cache file %s: %s", p.CacheFile, err)
+		return
+	}
+	log.Printf("Loaded cache from %s", p.CacheFile)
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newPersistResponse returns the response for the name with the TTL
+func newPersistResponse(name string, ttl int) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.Response = true
+	resp.SetQuestion(name, dns.TypeA)
+	resp.Answer = []dns.RR{newRR(fmt.Sprintf("%s %d IN A 192.0.2.1", name, ttl))}
+	return resp
+}
+
+// updateChecksum replaces the checksum at the end of the cache file
+func updateChecksum(buf []byte) {
+	end := len(buf) - 4
+	binary.BigEndian.PutUint32(buf[end:], crc32.ChecksumIEEE(buf[:end]))
+}
+
+func TestCacheSaveLoad(t *testing.T) {
+	src := &Proxy{}
+	var buf bytes.Buffer
+	assert.Equal(t, errCacheDisabled, src.SaveCache(&buf))
+	assert.Equal(t, errCacheDisabled, src.LoadCache(&buf))
+
+	src.cache = &cache{}
+	src.cacheSubnet = &cacheSubnet{}
+	now := time.Now()
+	assert.Nil(t, src.CacheSet(newPersistResponse("first.example.org.", 60)))
+	assert.Nil(t, src.CacheSet(newPersistResponse("second.example.org.", 90)))
+	ip := net.IP{192, 0, 2, 0}
+	src.cacheSubnet.SetWithSubnet(newPersistResponse("subnet.example.org.", 60), ip, 24)
+	assert.Nil(t, src.SaveCache(&buf))
+	saved := buf.Bytes()
+
+	dst := &Proxy{}
+	dst.cache = &cache{}
+	dst.cacheSubnet = &cacheSubnet{}
+	assert.Nil(t, dst.LoadCache(bytes.NewReader(saved)))
+	assert.Len(t, dst.CacheEntries(), 3)
+
+	// The absolute times are kept
+	e, ok := dst.CacheGet("first.example.org.", dns.TypeA)
+	if !ok {
+		t.Fatalf("no loaded response in cache")
+	}
+	assert.WithinDuration(t, now, e.Inserted, time.Second)
+	assert.WithinDuration(t, now.Add(60*time.Second), e.Expires, time.Second)
+	_, ok = dst.CacheGet("second.example.org.", dns.TypeA)
+	assert.True(t, ok)
+
+	req := &dns.Msg{}
+	req.SetQuestion("subnet.example.org.", dns.TypeA)
+	res, ok := dst.cacheSubnet.GetWithSubnet(req, ip, 24)
+	if assert.True(t, ok) {
+		assert.Equal(t, net.IP{192, 0, 2, 1}, res.Answer[0].(*dns.A).A.To4())
+	}
+
+	// The subnet entries are dropped if there is no subnet cache
+	dst = &Proxy{}
+	dst.cache = &cache{}
+	assert.Nil(t, dst.LoadCache(bytes.NewReader(saved)))
+	assert.Len(t, dst.CacheEntries(), 2)
+
+	// Corrupted, version-mismatched and truncated data is ignored as a whole
+	corrupted := append([]byte{}, saved...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	version := append([]byte{}, saved...)
+	version[len(cacheFileMagic)+1]++
+	updateChecksum(version)
+	truncated := append([]byte{}, saved[:len(saved)-10]...)
+	updateChecksum(truncated)
+	for _, data := range [][]byte{nil, []byte("garbage"), corrupted, version, truncated} {
+		dst = &Proxy{}
+		dst.cache = &cache{}
+		assert.NotNil(t, dst.LoadCache(bytes.NewReader(data)))
+		assert.Len(t, dst.CacheEntries(), 0)
+	}
+}
+
+func TestCacheLoadExpired(t *testing.T) {
+	src := &Proxy{}
+	src.cache = &cache{}
+	assert.Nil(t, src.CacheSet(newPersistResponse("expired.example.org.", 60)))
+	var buf bytes.Buffer
+	assert.Nil(t, src.SaveCache(&buf))
+
+	// The entry expires before it's loaded
+	saved := buf.Bytes()
+	rec := saved[cacheFileHeaderSize:]
+	data := rec[cacheRecordHeadSize+int(binary.BigEndian.Uint16(rec[1:])):]
+	binary.BigEndian.PutUint32(data, uint32(time.Now().Unix()-1))
+	updateChecksum(saved)
+
+	dst := &Proxy{}
+	dst.cache = &cache{}
+	assert.Nil(t, dst.LoadCache(bytes.NewReader(saved)))
+	assert.Len(t, dst.CacheEntries(), 0)
+
+	// The expired entries aren't saved
+	src.cache.clear()
+	src.cache.setData(key(newPersistResponse("expired.example.org.", 60)), data, dns.Question{
+		Name:  "expired.example.org.",
+		Qtype: dns.TypeA,
+	})
+	buf.Reset()
+	assert.Nil(t, src.SaveCache(&buf))
+	assert.Equal(t, cacheFileHeaderSize+4, buf.Len())
+}
+
+func TestCacheSaveSizeLimit(t *testing.T) {
+	src := &Proxy{}
+	src.cache = &cache{cacheSize: 4096}
+	for i := 0; i < 200; i++ {
+		src.cache.Set(newPersistResponse(fmt.Sprintf("host%d.example.org.", i), 60))
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, src.SaveCache(&buf))
+	assert.True(t, buf.Len() <= cacheFileHeaderSize+4+2*4096, "%d", buf.Len())
+
+	// The data that wouldn't fit into the cache isn't read
+	dst := &Proxy{}
+	dst.cache = &cache{cacheSize: 1024}
+	assert.NotNil(t, dst.LoadCache(&buf))
+	assert.Len(t, dst.CacheEntries(), 0)
+}
+
+func TestCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsproxy-cache")
+	if err != nil {
+		t.Fatalf("cannot create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.bin")
+
+	// The missing file is fine
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheFile = path
+	assert.Nil(t, dnsProxy.Start())
+	assert.Nil(t, dnsProxy.CacheSet(newPersistResponse("saved.example.org.", 60)))
+	assert.Nil(t, dnsProxy.Stop())
+
+	dnsProxy = createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheFile = path
+	assert.Nil(t, dnsProxy.Start())
+	_, ok := dnsProxy.CacheGet("saved.example.org.", dns.TypeA)
+	assert.True(t, ok)
+	assert.Nil(t, dnsProxy.Stop())
+
+	// The corrupted file doesn't fail the start
+	assert.Nil(t, ioutil.WriteFile(path, []byte("garbage"), 0644))
+	dnsProxy = createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheFile = path
+	assert.Nil(t, dnsProxy.Start())
+	assert.Len(t, dnsProxy.CacheEntries(), 0)
+	assert.Nil(t, dnsProxy.Stop())
+}
@@ -5,7 +5,6 @@ import (
 	"net"
 	"strings"
 
-	glcache "github.com/AdguardTeam/golibs/cache"
 	"github.com/miekg/dns"
 )
 
@@ -44,7 +43,7 @@ func keyWithSubnet(m *dns.Msg, ip net.IP, mask uint8) []byte {
 	k++
 
 	// put qtype
-	binary.BigEndian.PutUint16(b[:], q.Qtype)
+	binary.BigEndian.PutUint16(b[k:], q.Qtype)
 	k += 2
 
 	// put qclass
@@ -78,6 +77,7 @@ func (c *cacheSubnet) GetWithSubnet(request *dns.Msg, ip net.IP, mask uint8) (*d
 	c.Lock()
 	if c.items == nil {
 		c.Unlock()
+		(*cache)(c).countLookup(false)
 		return nil, false
 	}
 	c.Unlock()
@@ -90,6 +90,7 @@ func (c *cacheSubnet) GetWithSubnet(request *dns.Msg, ip net.IP, mask uint8) (*d
 			break
 		}
 		if mask == 0 {
+			(*cache)(c).countLookup(false)
 			return nil, false
 		}
 		mask--
@@ -97,12 +98,33 @@ func (c *cacheSubnet) GetWithSubnet(request *dns.Msg, ip net.IP, mask uint8) (*d
 
 	res := unpackResponse(data, request)
 	if res == nil {
-		c.items.Del(key)
+		if !(*cache)(c).isStale(data) {
+			(*cache)(c).delItem(key)
+		}
+		(*cache)(c).countLookup(false)
 		return nil, false
 	}
+	(*cache)(c).countLookup(true)
 	return res, true
 }
 
+// getStaleWithSubnet returns the expired response for the request and the
+// client subnet, see cache.getStale.  The longest prefix is matched the same
+// way GetWithSubnet does.
+func (c *cacheSubnet) getStaleWithSubnet(request *dns.Msg, ip net.IP, mask uint8) (*dns.Msg, bool) {
+	if request == nil || len(request.Question) != 1 {
+		return nil, false
+	}
+
+	for {
+		res, ok := (*cache)(c).getStaleItem(keyWithSubnet(request, ip, mask), request)
+		if ok || mask == 0 {
+			return res, ok
+		}
+		mask--
+	}
+}
+
 // SetWithSubnet - store DNS response
 // ip: IP subnet this response is valid for
 // mask: subnet mask
@@ -110,22 +132,5 @@ func (c *cacheSubnet) SetWithSubnet(m *dns.Msg, ip net.IP, mask uint8) {
 	if m == nil || !isCacheable(m) {
 		return
 	}
-	key := keyWithSubnet(m, ip, mask)
-
-	c.Lock()
-	// lazy initialization for cache
-	if c.items == nil {
-		conf := glcache.Config{
-			MaxSize:   defaultCacheSize,
-			EnableLRU: true,
-		}
-		if c.cacheSize > 0 {
-			conf.MaxSize = uint(c.cacheSize)
-		}
-		c.items = glcache.New(conf)
-	}
-	c.Unlock()
-
-	data := packResponse(m)
-	_ = c.items.Set(key, data)
+	(*cache)(c).setItem(keyWithSubnet(m, ip, mask), m)
 }
@@ -1,10 +1,13 @@
 package proxy
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -539,3 +542,503 @@ func TestSubnet(t *testing.T) {
 	a = resp.Answer[0].(*dns.A)
 	assert.True(t, a.A.String() == "3.3.3.3")
 }
+
+func TestCacheStats(t *testing.T) {
+	p := &Proxy{cache: &cache{cacheSize: 256}}
+
+	req := dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	_, ok := p.cache.Get(&req)
+	assert.False(t, ok)
+
+	for i := 0; i < 10; i++ {
+		resp := &dns.Msg{}
+		resp.Response = true
+		resp.SetQuestion(fmt.Sprintf("host%d.example.org.", i), dns.TypeA)
+		resp.Answer = []dns.RR{newRR(fmt.Sprintf("host%d.example.org. 60 IN A 1.1.1.1", i))}
+		p.cache.Set(resp)
+	}
+
+	// The latest response is still cached
+	req.SetQuestion("host9.example.org.", dns.TypeA)
+	_, ok = p.cache.Get(&req)
+	assert.True(t, ok)
+
+	s := p.CacheStats()
+	assert.Equal(t, uint64(1), s.Hits)
+	assert.Equal(t, uint64(1), s.Misses)
+	assert.NotZero(t, s.Evictions)
+}
+
+func TestSubnetDO(t *testing.T) {
+	c := &cacheSubnet{}
+
+	resp := &dns.Msg{}
+	resp.Response = true
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Answer = []dns.RR{newRR("example.com. 60 IN A 1.1.1.1")}
+	c.SetWithSubnet(resp, net.IP{1, 2, 3, 4}, 24)
+
+	req := dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	r, _ := c.GetWithSubnet(&req, net.IP{1, 2, 3, 4}, 24)
+	assert.NotNil(t, r)
+
+	// The response to the query without DO must not be served for DO queries
+	req.SetEdns0(4096, true)
+	r, _ = c.GetWithSubnet(&req, net.IP{1, 2, 3, 4}, 24)
+	assert.Nil(t, r)
+}
+
+func TestCacheControl(t *testing.T) {
+	p := &Proxy{cache: &cache{}, cacheSubnet: &cacheSubnet{}}
+
+	newResp := func(name string, qtype uint16, rr string) *dns.Msg {
+		resp := &dns.Msg{}
+		resp.Response = true
+		resp.SetQuestion(name, qtype)
+		resp.Answer = []dns.RR{newRR(rr)}
+		return resp
+	}
+	p.cache.Set(newResp("WWW.Example.org.", dns.TypeA, "WWW.Example.org. 60 IN A 1.1.1.1"))
+	p.cache.Set(newResp("example.org.", dns.TypeAAAA, "example.org. 60 IN AAAA 2001:db8::1"))
+	p.cache.Set(newResp("example.com.", dns.TypeA, "example.com. 60 IN A 1.1.1.2"))
+	p.cacheSubnet.SetWithSubnet(newResp("sub.example.org.", dns.TypeA, "sub.example.org. 60 IN A 1.1.1.3"), net.IP{1, 2, 3, 0}, 24)
+
+	entries := p.CacheEntries()
+	assert.Len(t, entries, 4)
+	for _, e := range entries {
+		assert.NotZero(t, e.Size)
+		assert.True(t, e.TTL > 0 && e.TTL <= 60)
+		if e.Name == "www.example.org." {
+			assert.Equal(t, dns.TypeA, e.Qtype)
+		}
+	}
+
+	// Only the name itself is purged by name
+	assert.Equal(t, 1, p.PurgeCacheName("EXAMPLE.org"))
+	entries = p.CacheEntries()
+	assert.Len(t, entries, 3)
+	for _, e := range entries {
+		assert.NotEqual(t, "example.org.", e.Name)
+	}
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeAAAA)
+	_, ok := p.cache.Get(req)
+	assert.False(t, ok)
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	_, ok = p.cache.Get(req)
+	assert.True(t, ok)
+
+	// Purging is case-insensitive and covers the subdomains
+	assert.Equal(t, 2, p.PurgeCache("EXAMPLE.org"))
+	entries = p.CacheEntries()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "example.com.", entries[0].Name)
+	}
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	_, ok = p.cache.Get(req)
+	assert.False(t, ok)
+
+	p.ClearCache()
+	assert.Empty(t, p.CacheEntries())
+	req.SetQuestion("example.com.", dns.TypeA)
+	_, ok = p.cache.Get(req)
+	assert.False(t, ok)
+
+	// The evicted responses are removed from the index too
+	p.cache = &cache{cacheSize: 256}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("host%d.example.org.", i)
+		p.cache.Set(newResp(name, dns.TypeA, name+" 60 IN A 1.1.1.1"))
+	}
+	assert.Len(t, p.cache.index, len(p.CacheEntries()))
+	assert.True(t, len(p.cache.index) < 10)
+
+	// The queries with the CD bit set bypass the cache
+	p.CacheBypassCD = true
+	d := &DNSContext{Req: &dns.Msg{}}
+	d.Req.SetQuestion("host9.example.org.", dns.TypeA)
+	assert.True(t, p.replyFromCache(d))
+	d.Req.CheckingDisabled = true
+	assert.False(t, p.replyFromCache(d))
+}
+
+func TestCacheIndexRace(t *testing.T) {
+	c := &cache{cacheSize: 1024}
+
+	// The responses are stored, evicted and purged concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				name := fmt.Sprintf("host%d.example%d.org.", j%20, j%2)
+				resp := &dns.Msg{}
+				resp.Response = true
+				resp.SetQuestion(name, dns.TypeA)
+				resp.Answer = []dns.RR{newRR(name + " 60 IN A 1.1.1.1")}
+				c.Set(resp)
+				if j%100 == i {
+					c.purge(fmt.Sprintf("example%d.org.", i%2), true)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The index has exactly the keys of the stored responses
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+	assert.Equal(t, c.items.Stats().Count, len(c.index))
+	for key := range c.index {
+		assert.NotNil(t, c.items.Get([]byte(key)))
+	}
+}
+
+func TestSetMinMaxTTL(t *testing.T) {
+	p := &Proxy{Config: Config{CacheMinTTL: 60, CacheMaxTTL: 600}}
+	exp := time.Now().Add(30 * time.Second).UTC().Format("20060102150405")
+
+	r := new(dns.Msg)
+	r.Answer = []dns.RR{
+		newRR("signed. 10 IN A 192.0.2.1"),
+		newRR("signed. 10 IN RRSIG A 8 1 60 " + exp + " 20200101000000 1 example. AAAA"),
+		newRR("unsigned. 10 IN A 192.0.2.2"),
+		newRR("long. 3600 IN A 192.0.2.3"),
+		newRR("long. 3600 IN RRSIG A 8 1 3600 " + exp + " 20200101000000 1 example. AAAA"),
+	}
+	r.SetEdns0(4096, true)
+	p.setMinMaxTTL(r)
+
+	// The signed RRset isn't kept longer than its signature is valid
+	for i, ttl := range []uint32{30, 30, 60, 600, 600} {
+		assert.InDelta(t, ttl, r.Answer[i].Header().Ttl, 2, r.Answer[i].String())
+	}
+	assert.Equal(t, uint32(0x8000), r.Extra[0].Header().Ttl)
+}
+
+func TestSetNegativeTTL(t *testing.T) {
+	newNegative := func(rcode int, soa string) *dns.Msg {
+		r := new(dns.Msg)
+		r.Rcode = rcode
+		r.Ns = []dns.RR{newRR(soa)}
+		return r
+	}
+	soa := func(r *dns.Msg) *dns.SOA { return r.Ns[0].(*dns.SOA) }
+
+	p := &Proxy{Config: Config{CacheMinTTL: 60, CacheMaxTTL: 600}}
+
+	// The negative TTL is the lowest of the SOA TTL and MINIMUM
+	r := newNegative(dns.RcodeNameError, "example. 3600 IN SOA ns. host. 1 7200 3600 1209600 5")
+	p.setMinMaxTTL(r)
+	assert.Equal(t, uint32(60), soa(r).Hdr.Ttl)
+	assert.Equal(t, uint32(60), soa(r).Minttl)
+
+	r = newNegative(dns.RcodeSuccess, "example. 3600 IN SOA ns. host. 1 7200 3600 1209600 900")
+	p.setMinMaxTTL(r)
+	assert.Equal(t, uint32(600), soa(r).Hdr.Ttl)
+	assert.Equal(t, uint32(600), soa(r).Minttl)
+
+	r = newNegative(dns.RcodeNameError, "example. 300 IN SOA ns. host. 1 7200 3600 1209600 900")
+	p.setMinMaxTTL(r)
+	assert.Equal(t, uint32(300), soa(r).Hdr.Ttl)
+	assert.Equal(t, uint32(300), soa(r).Minttl)
+
+	// MINIMUM of the signed SOA isn't changed
+	r = newNegative(dns.RcodeNameError, "example. 3600 IN SOA ns. host. 1 7200 3600 1209600 5")
+	r.Ns = append(r.Ns, newRR("example. 3600 IN RRSIG SOA 8 1 3600 20300101000000 20200101000000 1 example. AAAA"))
+	p.setMinMaxTTL(r)
+	assert.Equal(t, uint32(600), soa(r).Hdr.Ttl)
+	assert.Equal(t, uint32(5), soa(r).Minttl)
+
+	// The TTLs are kept if there are no overrides
+	p = &Proxy{}
+	r = newNegative(dns.RcodeNameError, "example. 3600 IN SOA ns. host. 1 7200 3600 1209600 5")
+	p.setMinMaxTTL(r)
+	assert.Equal(t, uint32(3600), soa(r).Hdr.Ttl)
+	assert.Equal(t, uint32(5), soa(r).Minttl)
+}
+
+func TestNegativeTTLOverride(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheMinTTL = 60
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg).SetRcode(m, dns.RcodeNameError)
+		resp.Ns = []dns.RR{newRR("example. 3600 IN SOA ns. host. 1 7200 3600 1209600 5")}
+		return resp, nil
+	})}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() { _ = dnsProxy.Stop() }()
+
+	// The response sent to the client and the cached one are changed
+	for i := 0; i < 2; i++ {
+		d := &DNSContext{Proto: ProtoUDP, Req: createHostTestMessage("host"), Addr: &net.UDPAddr{IP: net.IP{192, 0, 2, 1}}}
+		err = dnsProxy.Resolve(d)
+		assert.Nil(t, err)
+		if assert.Len(t, d.Res.Ns, 1) {
+			soa := d.Res.Ns[0].(*dns.SOA)
+			assert.InDelta(t, 60, soa.Hdr.Ttl, 1)
+			assert.Equal(t, uint32(60), soa.Minttl)
+		}
+	}
+}
+
+func TestCacheGetSet(t *testing.T) {
+	p := &Proxy{}
+	resp := &dns.Msg{}
+	resp.Response = true
+	resp.SetQuestion("Pinned.example.org.", dns.TypeA)
+	resp.Answer = []dns.RR{newRR("Pinned.example.org. 3600 IN A 192.0.2.1")}
+	assert.NotNil(t, p.CacheSet(resp))
+	_, ok := p.CacheGet("pinned.example.org", dns.TypeA)
+	assert.False(t, ok)
+
+	p.cache = &cache{}
+	now := time.Now()
+	assert.Nil(t, p.CacheSet(resp))
+
+	e, ok := p.CacheGet("pinned.example.org", dns.TypeA)
+	if !ok {
+		t.Fatalf("no pinned response in cache")
+	}
+	assert.Equal(t, "pinned.example.org.", e.Name)
+	assert.Equal(t, dns.TypeA, e.Qtype)
+	assert.InDelta(t, 3600, e.TTL, 1)
+	assert.WithinDuration(t, now, e.Inserted, time.Second)
+	assert.WithinDuration(t, now.Add(time.Hour), e.Expires, time.Second)
+	assert.Equal(t, uint32(3600), e.Msg.Answer[0].Header().Ttl)
+
+	// The entry is a copy
+	e.Msg.Answer[0].(*dns.A).A = net.IP{192, 0, 2, 2}
+	e, _ = p.CacheGet("pinned.example.org.", dns.TypeA)
+	assert.Equal(t, net.IP{192, 0, 2, 1}, e.Msg.Answer[0].(*dns.A).A.To4())
+
+	// The pinned response is served to the clients
+	d := &DNSContext{Req: &dns.Msg{}}
+	d.Req.SetQuestion("pinned.example.org.", dns.TypeA)
+	assert.True(t, p.replyFromCache(d))
+	assert.Equal(t, net.IP{192, 0, 2, 1}, d.Res.Answer[0].(*dns.A).A.To4())
+	_, ok = p.CacheGet("pinned.example.org.", dns.TypeAAAA)
+	assert.False(t, ok)
+
+	// The response cached for the DO queries is returned if there is no other
+	resp.SetQuestion("signed.example.org.", dns.TypeA)
+	resp.Answer = []dns.RR{newRR("signed.example.org. 60 IN A 192.0.2.3")}
+	resp.SetEdns0(4096, true)
+	assert.Nil(t, p.CacheSet(resp))
+	e, ok = p.CacheGet("signed.example.org.", dns.TypeA)
+	if assert.True(t, ok) {
+		assert.NotNil(t, e.Msg.IsEdns0())
+	}
+
+	// The responses that can't be cached are refused
+	resp = &dns.Msg{}
+	resp.SetQuestion("empty.example.org.", dns.TypeA)
+	assert.NotNil(t, p.CacheSet(resp))
+	assert.NotNil(t, p.CacheSet(nil))
+}
+
+func TestCachePin(t *testing.T) {
+	resp := &dns.Msg{}
+	resp.Response = true
+	resp.SetQuestion("Pinned.example.org.", dns.TypeA)
+	resp.Answer = []dns.RR{newRR("Pinned.example.org. 60 IN A 192.0.2.1")}
+
+	p := &Proxy{}
+	assert.NotNil(t, p.CachePin(resp))
+	assert.False(t, p.CacheUnpin("pinned.example.org.", dns.TypeA))
+
+	// The cache only has room for a few responses
+	p.cache = &cache{cacheSize: 512}
+	p.cacheSubnet = &cacheSubnet{}
+	assert.Nil(t, p.CachePin(resp))
+
+	// The pinned response doesn't expire
+	for key, data := range p.cache.pinned {
+		past := uint32(time.Now().Add(-time.Hour).Unix())
+		binary.BigEndian.PutUint32(data, past+60)
+		binary.BigEndian.PutUint32(data[4:], past)
+		p.cache.pinned[key] = data
+	}
+
+	// Nor is it evicted
+	for i := 0; i < 20; i++ {
+		m := &dns.Msg{}
+		m.SetQuestion(fmt.Sprintf("host%d.example.org.", i), dns.TypeA)
+		m.Answer = []dns.RR{newRR(fmt.Sprintf("host%d.example.org. 60 IN A 192.0.2.2", i))}
+		assert.Nil(t, p.CacheSet(m))
+	}
+	assert.NotZero(t, p.CacheStats().Evictions)
+
+	e, ok := p.CacheGet("pinned.example.org", dns.TypeA)
+	if !ok {
+		t.Fatalf("no pinned response in cache")
+	}
+	assert.True(t, e.Pinned)
+	assert.Equal(t, uint32(60), e.TTL)
+	assert.True(t, e.Expires.IsZero())
+
+	// It's served to the clients with and without ECS
+	for _, mask := range []uint8{0, 24} {
+		d := &DNSContext{Req: &dns.Msg{}, ecsReqIP: net.IP{192, 0, 2, 0}, ecsReqMask: mask}
+		d.Req.SetQuestion("pinned.example.org.", dns.TypeA)
+		assert.True(t, p.replyFromCache(d))
+		if assert.Len(t, d.Res.Answer, 1) {
+			assert.Equal(t, uint32(60), d.Res.Answer[0].Header().Ttl)
+		}
+	}
+
+	var pinned []CacheEntry
+	for _, e := range p.CacheEntries() {
+		if e.Pinned {
+			pinned = append(pinned, e)
+		}
+	}
+	assert.Equal(t, []CacheEntry{{Name: "pinned.example.org.", Qtype: dns.TypeA, TTL: 60, Size: e.Size, Pinned: true}}, pinned)
+
+	assert.True(t, p.CacheUnpin("PINNED.example.org", dns.TypeA))
+	assert.False(t, p.CacheUnpin("pinned.example.org", dns.TypeA))
+	_, ok = p.CacheGet("pinned.example.org", dns.TypeA)
+	assert.False(t, ok)
+
+	// PurgeCacheName removes it too
+	assert.Nil(t, p.CachePin(resp))
+	assert.Equal(t, 1, p.PurgeCacheName("pinned.example.org"))
+	_, ok = p.CacheGet("pinned.example.org", dns.TypeA)
+	assert.False(t, ok)
+}
+
+func TestNoCache(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	var queries int32
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		n := atomic.AddInt32(&queries, 1)
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = []dns.RR{newRR(fmt.Sprintf("host. 60 IN A 192.0.2.%d", n))}
+		return resp, nil
+	})}
+	// The handlers set the option for the requests
+	var noCache int32
+	dnsProxy.BeforeRequestHandler = func(_ *Proxy, d *DNSContext) (bool, error) {
+		d.NoCache = atomic.LoadInt32(&noCache) == 1
+		return true, nil
+	}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() { _ = dnsProxy.Stop() }()
+
+	addr := dnsProxy.Addr(ProtoUDP).String()
+	exchange := func(bypass bool) string {
+		if bypass {
+			atomic.StoreInt32(&noCache, 1)
+		} else {
+			atomic.StoreInt32(&noCache, 0)
+		}
+		resp, err := dns.Exchange(createHostTestMessage("host"), addr)
+		if err != nil {
+			t.Fatalf("cannot exchange: %s", err)
+		}
+		return resp.Answer[0].(*dns.A).A.String()
+	}
+
+	assert.Equal(t, "192.0.2.1", exchange(false))
+	assert.Equal(t, "192.0.2.1", exchange(false))
+
+	// The live response isn't cached
+	assert.Equal(t, "192.0.2.2", exchange(true))
+	assert.Equal(t, "192.0.2.3", exchange(true))
+	e, ok := dnsProxy.CacheGet("host.", dns.TypeA)
+	if assert.True(t, ok) {
+		assert.Equal(t, "192.0.2.1", e.Msg.Answer[0].(*dns.A).A.String())
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&queries))
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.CacheStaleIfError = 3600
+	// The upstream answers with a new address every time unless it's failing
+	var queries, rcode int32
+	var upstreamErr atomic.Value
+	upstreamErr.Store(false)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		n := atomic.AddInt32(&queries, 1)
+		if upstreamErr.Load().(bool) {
+			return nil, errors.New("upstream is down")
+		}
+		resp := new(dns.Msg).SetRcode(m, int(atomic.LoadInt32(&rcode)))
+		if resp.Rcode == dns.RcodeSuccess {
+			resp.Answer = []dns.RR{newRR(fmt.Sprintf("host. 60 IN A 192.0.2.%d", n))}
+		}
+		return resp, nil
+	})}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() { _ = dnsProxy.Stop() }()
+
+	resolve := func() *DNSContext {
+		d := &DNSContext{Req: createHostTestMessage("host"), Addr: &net.TCPAddr{}}
+		_ = dnsProxy.Resolve(d)
+		return d
+	}
+	// expire makes the cached response expired for the seconds
+	expire := func(ago int64) {
+		k := key(createHostTestMessage("host"))
+		data := dnsProxy.cache.items.Get(k)
+		binary.BigEndian.PutUint32(data, uint32(time.Now().Unix()-ago))
+		_ = dnsProxy.cache.items.Set(k, data)
+	}
+
+	d := resolve()
+	assert.Equal(t, "192.0.2.1", d.Res.Answer[0].(*dns.A).A.String())
+
+	// The expired response is served if the upstream fails
+	expire(10)
+	upstreamErr.Store(true)
+	d = resolve()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+	if assert.Len(t, d.Res.Answer, 1) {
+		assert.Equal(t, "192.0.2.1", d.Res.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, uint32(staleTTL), d.Res.Answer[0].Header().Ttl)
+	}
+	assert.True(t, d.cached)
+
+	// Or answers with SERVFAIL, the stale response isn't cached again
+	upstreamErr.Store(false)
+	atomic.StoreInt32(&rcode, dns.RcodeServerFailure)
+	d = resolve()
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	if assert.Len(t, d.Res.Answer, 1) {
+		assert.Equal(t, "192.0.2.1", d.Res.Answer[0].(*dns.A).A.String())
+	}
+	_, ok := dnsProxy.cache.Get(createHostTestMessage("host"))
+	assert.False(t, ok)
+
+	// The fresh response is used if the upstream succeeds
+	atomic.StoreInt32(&rcode, dns.RcodeSuccess)
+	d = resolve()
+	assert.Equal(t, "192.0.2.4", d.Res.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(60), d.Res.Answer[0].Header().Ttl)
+	assert.False(t, d.cached)
+	d = resolve()
+	assert.Equal(t, "192.0.2.4", d.Res.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, int32(4), atomic.LoadInt32(&queries))
+
+	// Not after the stale period
+	expire(3600)
+	upstreamErr.Store(true)
+	d = resolve()
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+}
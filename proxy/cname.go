@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// chaseCNAME resolves the CNAME the response to the A or AAAA query ends with
+// if the upstream hasn't resolved it, and adds the records of the targets to
+// the response, see upstream.ChaseCNAME.  The TTL of the answer records is set
+// to the lowest one in the chain.  If a follow-up query fails, the partially
+// resolved chain is returned.
+func (p *Proxy) chaseCNAME(d *DNSContext, reply *dns.Msg, gen *upstreamsGen) *dns.Msg {
+	q := d.Req.Question[0]
+	if !p.ChaseCNAME || reply == nil || reply.Rcode != dns.RcodeSuccess ||
+		(q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		return reply
+	}
+
+	if upstream.UnresolvedCNAME(reply.Answer, q.Name, q.Qtype) == "" {
+		return reply
+	}
+
+	reply = upstream.ChaseCNAME(reply, q.Name, q.Qtype, func(target string) (*dns.Msg, error) {
+		return p.resolveCNAMETarget(d, target, gen)
+	})
+	setChainTTL(reply.Answer)
+	return reply
+}
+
+// resolveCNAMETarget sends the query for the target with the type of the
+// original query to the upstreams for the target, or the fallbacks if they
+// fail.  The cache is used if it's enabled for the original one.  The
+// unsuccessful responses are returned as errors so that the partial chain
+// keeps the response code of the original one.
+func (p *Proxy) resolveCNAMETarget(d *DNSContext, target string, gen *upstreamsGen) (*dns.Msg, error) {
+	req := d.Req.Copy()
+	req.Id = dns.Id()
+	req.Question[0].Name = target
+
+	td := &DNSContext{
+		Req:                  req,
+		CustomUpstreamConfig: d.CustomUpstreamConfig,
+		ExchangeOptions:      d.ExchangeOptions,
+		ecsReqIP:             d.ecsReqIP,
+		ecsReqMask:           d.ecsReqMask,
+	}
+	if p.replyFromCache(td) {
+		return td.Res, nil
+	}
+
+	// The query goes the same way as the original one
+	res, _, err := p.exchange(req, p.selectUpstreams(d, target, gen))
+	if err != nil && gen.fallbacks != nil {
+		res, _, _, err = p.exchangeFallbacks(req, gen, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("resolved with %s", dns.RcodeToString[res.Rcode])
+	}
+
+	// The partial chain would be served to the clients as is
+	if upstream.UnresolvedCNAME(res.Answer, target, req.Question[0].Qtype) == "" {
+		p.setMinMaxTTL(res)
+		p.setInCache(td, res)
+	}
+	return res, nil
+}
+
+// setChainTTL sets the TTL of all the records to the lowest one
+func setChainTTL(rrs []dns.RR) {
+	if len(rrs) == 0 {
+		return
+	}
+
+	ttl := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	for _, rr := range rrs {
+		rr.Header().Ttl = ttl
+	}
+}
+
+// flattenCNAME removes the CNAME chain from the response to the A or AAAA
+// query if FlattenCNAME is set, the records at its end get the queried name
+// and the lowest TTL of the chain.  The responses to the queries with the DO
+// bit are left alone since the signatures would be invalid, so are the
+// NXDOMAIN and NODATA ones.  It's applied to the outgoing responses only.
+func (p *Proxy) flattenCNAME(d *DNSContext) {
+	if !p.FlattenCNAME || d.Res == nil || d.Res.Rcode != dns.RcodeSuccess || len(d.Req.Question) == 0 {
+		return
+	}
+
+	q := d.Req.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return
+	}
+	if opt := d.Req.IsEdns0(); opt != nil && opt.Do() {
+		return
+	}
+
+	answer := flattenChain(d.Res.Answer, q.Name, q.Qtype)
+	if answer == nil {
+		return
+	}
+
+	log.Tracef("Flattened the CNAME chain of %s", q.Name)
+	// The response is modified, don't touch the one the caller may keep
+	d.Res = d.Res.Copy()
+	d.Res.Answer = answer
+}
+
+// flattenChain follows the CNAME chain from name in the answer and returns the
+// answer without it, with the records of the name at its end renamed to name.
+// It returns nil if there is no chain, or it doesn't end with the records of
+// qtype, or it's a loop.  The records that aren't in the chain are kept.
+func flattenChain(answer []dns.RR, name string, qtype uint16) []dns.RR {
+	cnames := map[string]*dns.CNAME{}
+	resolved := map[string]bool{}
+	for _, rr := range answer {
+		h := rr.Header()
+		owner := strings.ToLower(h.Name)
+		switch h.Rrtype {
+		case qtype:
+			resolved[owner] = true
+		case dns.TypeCNAME:
+			if _, ok := cnames[owner]; !ok {
+				cnames[owner] = rr.(*dns.CNAME)
+			}
+		}
+	}
+
+	chain := map[string]bool{}
+	ttl := ^uint32(0)
+	cur := strings.ToLower(name)
+	for !resolved[cur] {
+		cname, ok := cnames[cur]
+		if !ok || chain[cur] {
+			return nil
+		}
+		chain[cur] = true
+		if cname.Hdr.Ttl < ttl {
+			ttl = cname.Hdr.Ttl
+		}
+		cur = strings.ToLower(cname.Target)
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+
+	var flat, renamed []dns.RR
+	for _, rr := range answer {
+		h := rr.Header()
+		owner := strings.ToLower(h.Name)
+		switch {
+		case chain[owner], owner == cur && h.Rrtype == dns.TypeRRSIG:
+			// The CNAMEs and the signatures that would be invalid
+		case owner == cur:
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+			renamed = append(renamed, rr)
+			flat = append(flat, rr)
+		default:
+			flat = append(flat, rr)
+		}
+	}
+
+	for _, rr := range renamed {
+		rr.Header().Ttl = ttl
+	}
+	return flat
+}
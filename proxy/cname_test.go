@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChaseCNAME(t *testing.T) {
+	zone := map[string][]string{
+		"a.example.":       {"a.example. 300 IN CNAME b.example."},
+		"b.example.":       {"b.example. 100 IN CNAME c.example."},
+		"c.example.":       {"c.example. 200 IN A 192.0.2.1"},
+		"d.example.":       {"d.example. 300 IN CNAME c.example."},
+		"loop1.example.":   {"loop1.example. 300 IN CNAME loop2.example."},
+		"loop2.example.":   {"loop2.example. 300 IN CNAME loop1.example."},
+		"cross.example.":   {"cross.example. 300 IN CNAME other.example."},
+		"other.example.":   {"other.example. 300 IN CNAME c.example.", "cross.example. 300 IN CNAME b.example."},
+		"missing.example.": {"missing.example. 300 IN CNAME nx.example."},
+	}
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("chain%d.example.", i)
+		zone[name] = []string{fmt.Sprintf("%s 300 IN CNAME chain%d.example.", name, i+1)}
+	}
+
+	var queries int32
+	u := upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&queries, 1)
+		resp := new(dns.Msg).SetReply(m)
+		rrs, ok := zone[strings.ToLower(m.Question[0].Name)]
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+			return resp, nil
+		}
+		for _, rr := range rrs {
+			resp.Answer = append(resp.Answer, newRR(rr))
+		}
+		return resp, nil
+	})
+
+	p := createTestProxy(t, nil)
+	p.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	p.CacheEnabled = true
+	p.ChaseCNAME = true
+	err := p.Init()
+	if err != nil {
+		t.Fatalf("cannot init the proxy: %s", err)
+	}
+
+	resolve := func(name string) *dns.Msg {
+		d := &DNSContext{Req: new(dns.Msg).SetQuestion(name, dns.TypeA)}
+		err := p.Resolve(d)
+		if err != nil {
+			t.Fatalf("cannot resolve %s: %s", name, err)
+		}
+		return d.Res
+	}
+
+	// The chain is resolved with the lowest TTL
+	res := resolve("a.example.")
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	if assert.Len(t, res.Answer, 3) {
+		assert.Equal(t, "c.example.", res.Answer[2].Header().Name)
+		assert.Equal(t, dns.TypeA, res.Answer[2].Header().Rrtype)
+		for _, rr := range res.Answer {
+			assert.Equal(t, uint32(100), rr.Header().Ttl)
+		}
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&queries))
+
+	// The resolved target is cached
+	res = resolve("d.example.")
+	assert.Len(t, res.Answer, 2)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&queries))
+
+	// Loops are detected
+	atomic.StoreInt32(&queries, 0)
+	res = resolve("loop1.example.")
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Len(t, res.Answer, 2)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+
+	// The chain is limited
+	atomic.StoreInt32(&queries, 0)
+	res = resolve("chain0.example.")
+	assert.Len(t, res.Answer, upstream.MaxCNAMEChain+1)
+	assert.Equal(t, int32(upstream.MaxCNAMEChain+1), atomic.LoadInt32(&queries))
+
+	// The CNAME for the name that already has one is dropped
+	res = resolve("cross.example.")
+	if assert.Len(t, res.Answer, 3) {
+		assert.Equal(t, "other.example.", res.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "c.example.", res.Answer[1].(*dns.CNAME).Target)
+	}
+
+	// The partial chain is returned if the target can't be resolved
+	res = resolve("missing.example.")
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Len(t, res.Answer, 1)
+}
+
+// exchangeCounter counts the exchanges reported to Metrics
+type exchangeCounter struct {
+	noopMetrics
+	exchanged int32
+}
+
+func (m *exchangeCounter) UpstreamExchanged(string, time.Duration, error, bool) {
+	atomic.AddInt32(&m.exchanged, 1)
+}
+
+func TestChaseCNAMEFallback(t *testing.T) {
+	// The upstream fails to resolve the target, the fallback resolves it
+	u := upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		if strings.EqualFold(m.Question[0].Name, "b.example.") {
+			return nil, errors.New("upstream is down")
+		}
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = []dns.RR{newRR("a.example. 300 IN CNAME b.example.")}
+		return resp, nil
+	})
+	fallback := upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = []dns.RR{newRR("b.example. 300 IN A 192.0.2.1")}
+		return resp, nil
+	})
+
+	m := &exchangeCounter{}
+	p := createTestProxy(t, nil)
+	p.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	p.Fallbacks = []upstream.Upstream{fallback}
+	p.ChaseCNAME = true
+	p.Metrics = m
+	err := p.Init()
+	if err != nil {
+		t.Fatalf("cannot init the proxy: %s", err)
+	}
+
+	d := &DNSContext{Req: new(dns.Msg).SetQuestion("a.example.", dns.TypeA)}
+	err = p.Resolve(d)
+	if err != nil {
+		t.Fatalf("cannot resolve: %s", err)
+	}
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	if assert.Len(t, d.Res.Answer, 2) {
+		assert.Equal(t, dns.TypeA, d.Res.Answer[1].Header().Rrtype)
+	}
+
+	// The follow-up exchanges are reported as well
+	assert.Equal(t, int32(3), atomic.LoadInt32(&m.exchanged))
+}
+
+func TestFlattenCNAME(t *testing.T) {
+	answers := map[string][]string{
+		"multi.example. A": {
+			"multi.example. 300 IN CNAME hop1.example.",
+			"hop1.example. 60 IN CNAME hop2.example.",
+			"hop2.example. 200 IN A 192.0.2.1",
+			"hop2.example. 200 IN A 192.0.2.2",
+		},
+		"multi.example. AAAA": {
+			"multi.example. 300 IN CNAME hop1.example.",
+			"hop1.example. 300 IN CNAME hop2.example.",
+			"hop2.example. 30 IN AAAA 2001:db8::1",
+		},
+		"mixed.example. A": {
+			"mixed.example. 300 IN CNAME end.example.",
+			"end.example. 300 IN AAAA 2001:db8::1",
+			"end.example. 300 IN A 192.0.2.1",
+			"unrelated.example. 300 IN A 192.0.2.9",
+		},
+		"nodata.example. A": {
+			"nodata.example. 300 IN CNAME hop1.example.",
+			"hop1.example. 300 IN CNAME empty.example.",
+		},
+		"nx.example. A": {
+			"nx.example. 300 IN CNAME nonexistent.example.",
+		},
+		"loop.example. A": {
+			"loop.example. 300 IN CNAME loop2.example.",
+			"loop2.example. 300 IN CNAME loop.example.",
+		},
+		"plain.example. A": {
+			"plain.example. 300 IN A 192.0.2.1",
+		},
+	}
+	u := upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		q := m.Question[0]
+		resp := new(dns.Msg).SetReply(m)
+		for _, rr := range answers[strings.ToLower(q.Name)+" "+dns.TypeToString[q.Qtype]] {
+			resp.Answer = append(resp.Answer, newRR(rr))
+		}
+		if strings.HasPrefix(q.Name, "nx.") {
+			resp.Rcode = dns.RcodeNameError
+		}
+		return resp, nil
+	})
+
+	p := createTestProxy(t, nil)
+	p.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	p.CacheEnabled = true
+	p.FlattenCNAME = true
+	err := p.Init()
+	if err != nil {
+		t.Fatalf("cannot init the proxy: %s", err)
+	}
+
+	resolve := func(name string, qtype uint16, do bool) *dns.Msg {
+		d := &DNSContext{Req: new(dns.Msg).SetQuestion(name, qtype)}
+		if do {
+			d.Req.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		err := p.Resolve(d)
+		if err != nil {
+			t.Fatalf("cannot resolve %s: %s", name, err)
+		}
+		return d.Res
+	}
+
+	// The multi-hop chain is removed, the addresses get the queried name and
+	// the lowest TTL of the chain
+	for i := 0; i < 2; i++ {
+		res := resolve("Multi.Example.", dns.TypeA, false)
+		if assert.Len(t, res.Answer, 2) {
+			for _, rr := range res.Answer {
+				assert.Equal(t, "Multi.Example.", rr.Header().Name)
+				assert.Equal(t, dns.TypeA, rr.Header().Rrtype)
+				assert.Equal(t, uint32(60), rr.Header().Ttl)
+			}
+		}
+	}
+	res := resolve("multi.example.", dns.TypeAAAA, false)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "multi.example.", res.Answer[0].Header().Name)
+		assert.Equal(t, dns.TypeAAAA, res.Answer[0].Header().Rrtype)
+		assert.Equal(t, uint32(30), res.Answer[0].Header().Ttl)
+	}
+
+	// All the records of the target are renamed, the unrelated ones are kept
+	res = resolve("mixed.example.", dns.TypeA, false)
+	if assert.Len(t, res.Answer, 3) {
+		assert.Equal(t, "mixed.example.", res.Answer[0].Header().Name)
+		assert.Equal(t, dns.TypeAAAA, res.Answer[0].Header().Rrtype)
+		assert.Equal(t, "mixed.example.", res.Answer[1].Header().Name)
+		assert.Equal(t, dns.TypeA, res.Answer[1].Header().Rrtype)
+		assert.Equal(t, "unrelated.example.", res.Answer[2].Header().Name)
+	}
+
+	// NODATA, NXDOMAIN and loops are left alone
+	res = resolve("nodata.example.", dns.TypeA, false)
+	assert.Len(t, res.Answer, 2)
+	res = resolve("nx.example.", dns.TypeA, false)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	assert.Len(t, res.Answer, 1)
+	res = resolve("loop.example.", dns.TypeA, false)
+	assert.Len(t, res.Answer, 2)
+	res = resolve("plain.example.", dns.TypeA, false)
+	assert.Len(t, res.Answer, 1)
+
+	// The chain is kept if the client may validate it
+	res = resolve("multi.example.", dns.TypeA, true)
+	assert.Len(t, res.Answer, 4)
+
+	// The cache keeps the chain
+	p.FlattenCNAME = false
+	res = resolve("multi.example.", dns.TypeA, false)
+	if assert.Len(t, res.Answer, 4) {
+		assert.Equal(t, dns.TypeCNAME, res.Answer[0].Header().Rrtype)
+	}
+}
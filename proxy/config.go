@@ -3,11 +3,14 @@ package proxy
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
 )
 
 // UpstreamModeType - upstream mode
@@ -22,17 +25,74 @@ const (
 	UModeFastestAddr
 )
 
+// ECSMode defines how the proxy handles the EDNS Client Subnet option of the
+// requests
+type ECSMode int
+
+const (
+	// ECSStrip removes the ECS option of the client before forwarding the
+	// request, so the upstreams never learn the client subnet
+	ECSStrip ECSMode = iota
+	// ECSForward passes the ECS option of the client to the upstreams as is
+	ECSForward
+	// ECSGenerate passes the ECS option of the client as is, and adds one
+	// with the /24 (IPv4) or /112 (IPv6) subnet of the client's public IP
+	// address if the client didn't send it
+	ECSGenerate
+)
+
+// NSIDMode defines how the proxy handles the NSID option (RFC 5001) of the
+// requests
+type NSIDMode int
+
+const (
+	// NSIDForward passes the NSID option of the client to the upstreams, so
+	// the response has the identifier of the upstream server.  The responses
+	// served from the cache have no identifier since the OPT record isn't
+	// cached.
+	NSIDForward NSIDMode = iota
+	// NSIDOff removes the NSID option from the requests and the responses
+	NSIDOff
+	// NSIDLocal answers the requests with the NSID option with Config.NSID,
+	// the option isn't sent to the upstreams
+	NSIDLocal
+)
+
+// AnyPolicy defines how the proxy answers the ANY queries
+type AnyPolicy int
+
+const (
+	// AnyForward forwards the ANY queries to the upstreams
+	AnyForward AnyPolicy = iota
+	// AnyMinimal answers the ANY queries with a single HINFO record (RFC 8482)
+	AnyMinimal
+	// AnyNotImpl answers the ANY queries with NOTIMP
+	AnyNotImpl
+)
+
 // BeforeRequestHandler is an optional custom handler called before DNS requests
 // If it returns false, the request won't be processed at all
+// If it sets d.Res, the response is sent to the client without querying the upstreams
+// If it returns an error or panics, the client gets SERVFAIL
 type BeforeRequestHandler func(p *Proxy, d *DNSContext) (bool, error)
 
 // RequestHandler is an optional custom handler for DNS requests
 // It is called instead of the default method (Proxy.Resolve())
+// If it panics, the client gets SERVFAIL
 // See handler_test.go for examples
 type RequestHandler func(p *Proxy, d *DNSContext) error
 
+// AccessHandler is an optional callback that is called with the access
+// decision for every query when AllowedClients or DisallowedClients are set
+// d -- current DNS query context, d.Addr is the client address
+// allowed -- false if the query is refused or dropped
+type AccessHandler func(d *DNSContext, allowed bool)
+
 // ResponseHandler is a callback method that is called when DNS query has been processed
-// d -- current DNS query context (contains response if it was successful)
+// It's called once for every query, including the ones answered from the cache
+// or by BeforeRequestHandler, before the response is written to the client
+// d -- current DNS query context (contains response if it was successful, d.Upstream is the upstream
+// that resolved it, time.Since(d.StartTime) is the elapsed time)
 // err -- error (if any)
 type ResponseHandler func(d *DNSContext, err error)
 
@@ -54,25 +114,142 @@ type Config struct {
 
 	TLSConfig            *tls.Config    // necessary for TLS, HTTPS, QUIC
 	DNSCryptProviderName string         // DNSCrypt provider name
-	DNSCryptResolverCert *dnscrypt.Cert // DNSCrypt resolver certificate
+	DNSCryptResolverCert *dnscrypt.Cert // DNSCrypt resolver certificate, see Proxy.RotateDNSCryptCert for replacing it
+
+	// ResponsePadding is the block size the responses sent over TLS, HTTPS and QUIC are padded to with the EDNS
+	// padding option (RFC 7830) if the query is padded.  0 means the default block size (468) RFC 8467 recommends,
+	// negative value disables the padding
+	ResponsePadding int
 
 	// Rate-limiting and anti-DNS amplification measures
 	// --
 
-	Ratelimit          int      // max number of requests per second from a given IP (0 to disable)
-	RatelimitWhitelist []string // a list of whitelisted client IP addresses
-	RefuseAny          bool     // if true, refuse ANY requests
+	Ratelimit          int           // max number of requests per RatelimitWindow from a given IP (0 to disable)
+	RatelimitGlobal    int           // max number of requests per RatelimitWindow from all clients (0 to disable)
+	RatelimitWindow    time.Duration // the period the ratelimits apply to (1 second if 0)
+	RatelimitWhitelist []string      // a list of whitelisted client IP addresses and CIDRs
+	RatelimitTruncate  bool          // if true, ratelimited UDP requests are answered with TC=1 instead of being dropped
+	RefuseAny          bool          // if true, refuse ANY requests, same as AnyPolicy set to AnyNotImpl
+
+	AnyPolicy          AnyPolicy // how to answer the ANY queries, the upstreams are not queried unless it's AnyForward
+	BlockedQtypes      []uint16  // query types answered with NOTIMP without querying the upstreams
+	RestrictedTTL      uint32    // TTL of the HINFO response to the ANY queries (3600 if 0)
+	QtypeExemptClients []string  // IP addresses and CIDRs of the clients AnyPolicy and BlockedQtypes don't apply to
+
+	// Access settings
+	// --
+
+	AllowedClients    []string // IP addresses and CIDRs of the clients allowed to use the proxy (if empty, all are allowed)
+	DisallowedClients []string // IP addresses and CIDRs of the clients not allowed to use the proxy, takes precedence over AllowedClients
+	DropDisallowed    bool     // if true, queries from disallowed clients are dropped instead of being refused
+	TrustedProxies    []string // IP addresses and CIDRs of the reverse proxies the DoH client addresses are taken from the X-Forwarded-For and X-Real-IP headers of (the headers are ignored if empty)
+
+	// Hosts settings
+	// --
+
+	HostsFiles []string // files in the hosts file format the static records are loaded from
+	HostsTTL   uint32   // TTL of the responses from the static records, 10 seconds if not set
+
+	// ForwardSpecialZones are the special-use zones, e.g. SpecialZoneHomeArpa,
+	// the requests for which are sent to the upstreams.  The other special-use
+	// zones are answered by the proxy itself: localhost and the loopback reverse
+	// zones resolve to the loopback addresses, ipv4only.arpa to its well-known
+	// addresses, mapped with the NAT64 prefix for AAAA, onion and home.arpa are
+	// NXDOMAIN.  The names that have the upstreams reserved in UpstreamConfig
+	// are sent to them anyway.
+	ForwardSpecialZones []string
 
 	// Upstream DNS servers and their settings
 	// --
 
-	UpstreamConfig *UpstreamConfig     // Upstream DNS servers configuration
-	Fallbacks      []upstream.Upstream // list of fallback resolvers (which will be used if regular upstream failed to answer)
+	UpstreamConfig *UpstreamConfig     // Upstream DNS servers configuration, use UpdateUpstreamConfig to change it while the proxy is running
+	Fallbacks      []upstream.Upstream // list of fallback resolvers (which will be used if regular upstream failed to answer), use UpdateFallbacks to change it while the proxy is running
 	UpstreamMode   UpstreamModeType    // How to request the upstream servers
 
-	// BogusNXDomain - transforms responses that contain at least one of the given IP addresses into NXDOMAIN
+	// PrivateRDNSUpstreamConfig is the upstream configuration for the PTR
+	// requests for the locally-served addresses (RFC 6303), e.g. the LAN
+	// router's resolver.  It's only used if UsePrivateRDNS is set.
+	PrivateRDNSUpstreamConfig *UpstreamConfig
+	// UsePrivateRDNS - if true, the PTR requests for the locally-served
+	// addresses are only sent to PrivateRDNSUpstreamConfig, neither to the
+	// other upstreams nor to the fallbacks.  They're answered with NXDOMAIN
+	// if there are no private upstreams for them.
+	UsePrivateRDNS bool
+
+	// UpstreamSelector chooses the upstreams for the requests, it takes
+	// precedence over UpstreamMode except for the A and AAAA requests in
+	// UModeFastestAddr.  If not set, it's NewParallelSelector in UModeParallel
+	// and NewRTTSelector otherwise.
+	UpstreamSelector UpstreamSelector
+
+	// ProbeInterval is how often the default and domain-specific upstreams
+	// are probed with ProbeRequest, see UpstreamStatuses.  The ones that fail
+	// the probe on Start, or ProbeDownAfter probes in a row later, aren't used
+	// until they succeed ProbeUpAfter probes in a row, unless all the
+	// upstreams for the request are down.  0 disables probing.
+	ProbeInterval time.Duration
+	// ProbeRequest is the query the upstreams are probed with, the NS records
+	// of the root zone if not set
+	ProbeRequest *dns.Msg
+	// ProbeDownAfter is the number of the failed probes in a row the upstream
+	// is excluded after, 3 if not set
+	ProbeDownAfter int
+	// ProbeUpAfter is the number of the successful probes in a row the
+	// excluded upstream is used again after, 2 if not set
+	ProbeUpAfter int
+
+	// Metrics receives the events of the proxy to count them, e.g. the
+	// upstream exchanges, the cache lookups and the client connections.
+	// Nothing is counted if it's not set.  The optional events are passed
+	// if it implements ConnectionMetrics, FailoverMetrics or DropMetrics.
+	Metrics Metrics
+
+	// FastestPingTimeout is how long to wait for the probes of the IP addresses
+	// in UModeFastestAddr, 1 second if not set.  Keep it below the upstream timeout.
+	FastestPingTimeout time.Duration
+
+	// DNS64Prefix is the NAT64 prefix used to synthesize AAAA records for the
+	// IPv4-only hosts (RFC 6147), DefaultDNS64Prefix for the Well-Known Prefix.
+	// Only /96 prefixes are supported.  If empty, DNS64 is disabled unless the
+	// prefix is set with SetNAT64Prefix.
+	DNS64Prefix string
+
+	// FilterAAAA - if true, the AAAA queries are answered with the empty
+	// NOERROR response without querying the upstreams, A and other queries are
+	// resolved normally
+	FilterAAAA bool
+	// FilterAAAAExempt is the list of the domains, with their subdomains, the
+	// AAAA queries are resolved normally for
+	FilterAAAAExempt []string
+
+	// AnswerOrder defines how the A and AAAA records of the responses are
+	// ordered, see upstream.OrderAnswers.  The cached responses are ordered
+	// anew every time.
+	AnswerOrder upstream.AnswerOrder
+
+	// FailoverRcodes are the response codes, e.g. dns.RcodeServerFailure and
+	// dns.RcodeRefused, that are treated as failures, so that the next
+	// upstream is tried.  If all the upstreams respond with the same code,
+	// the response is used.  NOERROR and NXDOMAIN can't be there.
+	FailoverRcodes []int
+
+	// ChaseCNAME - if true, when the response to an A or AAAA query ends with
+	// the CNAME the upstream hasn't resolved, the proxy resolves the target
+	// itself, up to 8 hops, and adds the records to the response
+	ChaseCNAME bool
+
+	// FlattenCNAME - if true, the CNAME chains are removed from the responses
+	// to the A and AAAA queries, and the address records get the queried name
+	// and the lowest TTL of the chain, e.g. for the clients that can't handle
+	// the chains.  It isn't applied if the client has set the DO bit.
+	FlattenCNAME bool
+
+	// BogusNXDomain - transforms responses where all A and AAAA records contain the given IP addresses into NXDOMAIN.
+	// If only some of the records are bogus, they are removed from the response.
 	// Similar to dnsmasq's "bogus-nxdomain"
 	BogusNXDomain []net.IP
+	// BogusNXDomainNets is the same as BogusNXDomain, but for the IP networks
+	BogusNXDomainNets []*net.IPNet
 
 	// Enable EDNS Client Subnet option
 	// DNS requests to the upstream server will contain an OPT record with Client Subnet option.
@@ -93,29 +270,67 @@ type Config struct {
 	// And so there will be no EDNS record in response either.
 	// We store these responses in general cache (without subnet)
 	//  so they will never be used for clients with public IP addresses.
+	//
+	// It's the same as ECSMode set to ECSGenerate.
 	EnableEDNSClientSubnet bool
 	EDNSAddr               net.IP // ECS IP used in request
 
+	// ECSMode defines how the ECS option of the requests is handled, ECSStrip
+	// by default.  The ECS option of the response is made consistent with the
+	// one the client has sent.  In ECSForward and ECSGenerate modes the
+	// responses are cached per subnet.
+	ECSMode ECSMode
+
+	// NSIDMode defines how the NSID option of the requests is handled,
+	// NSIDForward by default.  The responses only have the option if the client has sent it.
+	NSIDMode NSIDMode
+	// NSID is the server identifier sent in NSIDLocal mode, the hostname if
+	// it's empty
+	NSID string
+
 	// Cache settings
 	// --
 
 	CacheEnabled   bool   // cache status
 	CacheSizeBytes int    // Cache size (in bytes). Default: 64k
-	CacheMinTTL    uint32 // Minimum TTL for DNS entries (in seconds).
-	CacheMaxTTL    uint32 // Maximum TTL for DNS entries (in seconds).
+	CacheMinTTL    uint32 // Minimum TTL of the records in the upstream responses (in seconds), 0 to keep it as is.
+	CacheMaxTTL    uint32 // Maximum TTL of the records in the upstream responses (in seconds), 0 to keep it as is.
+	CacheBypassCD  bool   // If true, the queries with the CD bit set are neither answered from cache nor cached.
+
+	// CacheStaleIfError is how long the expired responses are kept in cache (in seconds).  They're only served, with
+	// the TTL of 30 seconds, if the upstreams fail to answer or answer with SERVFAIL, the upstreams are always queried
+	// first once the response expires.  0 disables it.
+	CacheStaleIfError uint32
+
+	// CacheFile is the file the cache is saved to on Stop and loaded from on Start, see Proxy.SaveCache.  The cache
+	// starts empty if the file is missing or can't be loaded.  Empty disables it.
+	CacheFile string
 
 	// Handlers (for the case when dnsproxy is used as a library)
 	// --
 
 	BeforeRequestHandler BeforeRequestHandler // callback that is called before each request
 	RequestHandler       RequestHandler       // callback that can handle incoming DNS requests
+	AccessHandler        AccessHandler        // callback that is called with the access decision for each request
 	ResponseHandler      ResponseHandler      // response callback
 
+	// Query log settings
+	// --
+
+	QueryLogHandler     QueryLogHandler // receives the answered queries, nothing is logged if it's not set
+	QueryLogBufferSize  int             // max number of the entries waiting for QueryLogHandler, the oldest ones are dropped (1000 if 0)
+	QueryLogAnonymizeIP bool            // if true, the last byte of IPv4 and the last 80 bits of IPv6 client addresses are zeroed
+
 	// Other settings
 	// --
 
 	// MaxGoroutines is the maximum number of goroutines processing DNS
-	// requests.  Important for mobile users.
+	// requests.  Important for mobile users.  When all of them are busy,
+	// the UDP requests are dropped, the new QUIC connections wait for a free
+	// one and the next query of a TCP or TLS connection isn't read until
+	// there is one, so that a flood doesn't exhaust the memory.  The idle TCP
+	// and TLS connections don't take them, see MaxTCPConnections.  0 means no
+	// limit.
 	//
 	// TODO(a.garipov): Renamme this to something like
 	// “MaxDNSRequestGoroutines” in a later major version, as it doesn't
@@ -125,6 +340,47 @@ type Config struct {
 	// The size of the read buffer on the underlying socket. Larger read buffers can handle
 	// larger bursts of requests before packets get dropped.
 	UDPBufferSize int
+
+	// UDPReusePort - if true, several UDP sockets are bound to every UDP
+	// listen address with SO_REUSEPORT, each with its own read loop, so that
+	// the kernel spreads the queries across them.  Linux only, a single
+	// socket is used on other platforms.
+	UDPReusePort bool
+
+	// UDPReusePortSockets is the number of the UDP sockets per address if
+	// UDPReusePort is set, GOMAXPROCS if 0
+	UDPReusePortSockets int
+
+	// MaxTCPConnections is the maximum number of simultaneous TCP and TLS
+	// client connections per listener.  Connections over the limit are closed
+	// right away.  0 means no limit.
+	MaxTCPConnections int
+
+	// TCPAcceptBacklog is the number of the TCP and TLS client connections
+	// over MaxTCPConnections per listener that wait up to TCPIdleTimeout for
+	// a free slot instead of being closed right away
+	TCPAcceptBacklog int
+
+	// MaxQueriesPerConnection is the maximum number of DNS queries handled
+	// on a single TCP or TLS connection.  The connection is closed once it's
+	// reached.  0 means no limit.
+	MaxQueriesPerConnection int
+
+	// MaxPipelinedQueries is the maximum number of the queries on a single
+	// TCP or TLS connection handled at the same time (RFC 7766).  The next
+	// query isn't read until one of them is answered.  0 or 1 means that the
+	// queries are handled one by one.
+	MaxPipelinedQueries int
+
+	// TCPIdleTimeout is how long a TCP or TLS client connection is kept
+	// open waiting for the next query, 10 seconds if 0
+	TCPIdleTimeout time.Duration
+
+	// GracefulShutdownTimeout is how long Stop waits for the DNS requests
+	// being processed to finish.  The listeners stop accepting new requests
+	// and the open connections stop reading them in the meantime.  0 means
+	// that Stop doesn't wait.
+	GracefulShutdownTimeout time.Duration
 }
 
 // validateConfig verifies that the supplied configuration is valid and returns an error if it's not
@@ -149,20 +405,45 @@ func (p *Proxy) validateConfig() error {
 		return errors.New("no default upstreams specified")
 	}
 
+	for _, rc := range p.FailoverRcodes {
+		if rc == dns.RcodeSuccess || rc == dns.RcodeNameError {
+			return fmt.Errorf("%s can't be a failover response code", dns.RcodeToString[rc])
+		}
+	}
+
 	if p.CacheMinTTL > 0 || p.CacheMaxTTL > 0 {
 		log.Info("Cache TTL override is enabled. Min=%d, Max=%d", p.CacheMinTTL, p.CacheMaxTTL)
 	}
 
 	if p.Ratelimit > 0 {
-		log.Info("Ratelimit is enabled and set to %d rps", p.Ratelimit)
+		log.Info("Ratelimit is enabled and set to %d requests per client", p.Ratelimit)
 	}
 
-	if p.RefuseAny {
+	if p.RatelimitGlobal > 0 {
+		log.Info("Global ratelimit is enabled and set to %d requests", p.RatelimitGlobal)
+	}
+
+	switch p.anyPolicy() {
+	case AnyMinimal:
+		log.Info("The server is configured to answer ANY requests with HINFO")
+	case AnyNotImpl:
 		log.Info("The server is configured to refuse ANY requests")
 	}
 
-	if len(p.BogusNXDomain) > 0 {
-		log.Info("%d bogus-nxdomain IP specified", len(p.BogusNXDomain))
+	if p.FilterAAAA {
+		log.Info("AAAA requests are replied with NoError, except for %d domains", len(p.FilterAAAAExempt))
+	}
+
+	if len(p.BlockedQtypes) > 0 {
+		log.Info("The server is configured to refuse %d query types", len(p.BlockedQtypes))
+	}
+
+	if len(p.AllowedClients) > 0 || len(p.DisallowedClients) > 0 {
+		log.Info("Access is restricted: %d allowed and %d disallowed clients", len(p.AllowedClients), len(p.DisallowedClients))
+	}
+
+	if len(p.BogusNXDomain) > 0 || len(p.BogusNXDomainNets) > 0 {
+		log.Info("%d bogus-nxdomain IP and %d networks specified", len(p.BogusNXDomain), len(p.BogusNXDomainNets))
 	}
 
 	return nil
@@ -1,28 +1,71 @@
 package proxy
 
 import (
+	"encoding/hex"
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
 
+// DefaultDNS64Prefix is the Well-Known Prefix for the IPv4-embedded IPv6
+// addresses (RFC 6052)
+const DefaultDNS64Prefix = "64:ff9b::/96"
+
+// wellKnownNAT64Prefix is DefaultDNS64Prefix without the prefix length
+var wellKnownNAT64Prefix = net.ParseIP("64:ff9b::")[:12]
+
+// parseDNS64Prefix parses the NAT64 prefix, only /96 prefixes are supported
+func parseDNS64Prefix(s string) ([]byte, error) {
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS64 prefix %s: %w", s, err)
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if ip.To4() != nil || bits != net.IPv6len*8 || ones != 96 {
+		return nil, fmt.Errorf("invalid DNS64 prefix %s: must be an IPv6 /96 prefix", s)
+	}
+
+	return ipnet.IP[:12], nil
+}
+
 // isEmptyAAAAResponse checks AAAA answer to be empty
-// returns true if NAT64 prefix already calculated and there are no answers for AAAA question
+// returns true if NAT64 prefix already calculated and there are no usable AAAA records for AAAA question
+// the responses with NXDOMAIN are not considered empty
 func (p *Proxy) isEmptyAAAAResponse(resp, req *dns.Msg) bool {
-	return p.isNAT64PrefixAvailable() &&
-		(resp == nil || len(resp.Answer) == 0) &&
-		req.Question[0].Qtype == dns.TypeAAAA
+	if !p.isNAT64PrefixAvailable() || req.Question[0].Qtype != dns.TypeAAAA {
+		return false
+	}
+	if resp == nil {
+		return true
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return false
+	}
+
+	for _, rr := range resp.Answer {
+		// IPv4-mapped addresses can't be used by the IPv6-only clients (RFC 6147, section 5.1.4)
+		if a, ok := rr.(*dns.AAAA); ok && a.AAAA.To4() == nil {
+			return false
+		}
+	}
+	return true
 }
 
 // isNAT64PrefixAvailable returns true if NAT64 prefix was calculated
 func (p *Proxy) isNAT64PrefixAvailable() bool {
+	return len(p.getNAT64Prefix()) == 12
+}
+
+// getNAT64Prefix returns the NAT64 prefix or nil if it's not set
+func (p *Proxy) getNAT64Prefix() []byte {
 	p.nat64Lock.Lock()
-	prefixSize := len(p.nat64Prefix)
-	p.nat64Lock.Unlock()
-	return prefixSize == 12
+	defer p.nat64Lock.Unlock()
+	return p.nat64Prefix
 }
 
 // SetNAT64Prefix sets NAT64 prefix
@@ -61,7 +104,8 @@ func createModifiedARequest(d *dns.Msg) (*dns.Msg, error) {
 // newAResp is new A response. oldAAAAResp is old *dns.Msg with AAAA request and empty answer
 func (p *Proxy) createDNS64MappedResponse(newAResp, oldAAAAResp *dns.Msg) (*dns.Msg, error) {
 	// do nothing if prefix is not valid
-	if !p.isNAT64PrefixAvailable() {
+	prefix := p.getNAT64Prefix()
+	if len(prefix) != 12 {
 		return nil, fmt.Errorf("can not create DNS64 mapped response: NAT64 prefix was not calculated")
 	}
 
@@ -73,23 +117,33 @@ func (p *Proxy) createDNS64MappedResponse(newAResp, oldAAAAResp *dns.Msg) (*dns.
 	oldAAAAResp.Answer = []dns.RR{}
 	// add NAT 64 prefix for each ipv4 answer
 	for _, ans := range newAResp.Answer {
+		if cname, ok := ans.(*dns.CNAME); ok {
+			// keep the CNAME chain
+			oldAAAAResp.Answer = append(oldAAAAResp.Answer, cname)
+			continue
+		}
+
 		i, ok := ans.(*dns.A)
 		if !ok {
 			continue
 		}
 
+		ip4 := i.A.To4()
+		if ip4 == nil || !isDNS64Mappable(ip4, prefix) {
+			log.Tracef("DNS64: skipping unusable IPv4 address %s", i.A)
+			continue
+		}
+
 		// new ip address
 		mappedAddress := make(net.IP, net.IPv6len)
 
 		// add NAT 64 prefix and append ipv4 record
-		copy(mappedAddress, p.nat64Prefix)
-		for index, b := range i.A {
-			mappedAddress[12+index] = b
-		}
+		copy(mappedAddress, prefix)
+		copy(mappedAddress[12:], ip4)
 
 		// create new response and fill it
 		rr := new(dns.AAAA)
-		rr.Hdr = dns.RR_Header{Name: newAResp.Question[0].Name, Rrtype: dns.TypeAAAA, Ttl: ans.Header().Ttl, Class: dns.ClassINET}
+		rr.Hdr = dns.RR_Header{Name: ans.Header().Name, Rrtype: dns.TypeAAAA, Ttl: ans.Header().Ttl, Class: dns.ClassINET}
 		rr.AAAA = mappedAddress
 		oldAAAAResp.Answer = append(oldAAAAResp.Answer, rr)
 	}
@@ -130,3 +184,105 @@ func (p *Proxy) checkDNS64(oldAAAAReq, oldAAAAResp *dns.Msg, upstreams []upstrea
 	}
 	return mappedAAAAResponse, u, nil
 }
+
+// isDNS64Mappable returns false for the IPv4 addresses that mustn't be
+// synthesized into AAAA records: loopback, link-local and so on.  The private
+// addresses can't be used with the Well-Known Prefix (RFC 6052, section 3.1).
+func isDNS64Mappable(ip net.IP, prefix []byte) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() || ip.Equal(net.IPv4bcast) || ip[0] == 0 {
+		return false
+	}
+
+	if net.IP(prefix).Equal(wellKnownNAT64Prefix) && isPrivateIPv4(ip) {
+		return false
+	}
+	return true
+}
+
+// isPrivateIPv4 checks if the IPv4 address is in one of the RFC 1918 ranges
+func isPrivateIPv4(ip net.IP) bool {
+	return ip[0] == 10 ||
+		(ip[0] == 172 && ip[1]&0xf0 == 16) ||
+		(ip[0] == 192 && ip[1] == 168)
+}
+
+// dns64PTRRequest returns the PTR request for the IPv4 address embedded into
+// the IPv6 address with the NAT64 prefix.  It returns nil if req is not a PTR
+// request for an address with the NAT64 prefix.
+func (p *Proxy) dns64PTRRequest(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if q.Qtype != dns.TypePTR {
+		return nil
+	}
+
+	prefix := p.getNAT64Prefix()
+	if len(prefix) != 12 {
+		return nil
+	}
+
+	ip := ip6ArpaToIP(q.Name)
+	if ip == nil || !net.IP(ip[:12]).Equal(prefix) {
+		return nil
+	}
+
+	arpa, err := dns.ReverseAddr(net.IP(ip[12:]).String())
+	if err != nil {
+		return nil
+	}
+
+	ptrReq := req.Copy()
+	ptrReq.Question[0].Name = arpa
+	return ptrReq
+}
+
+// exchangeDNS64PTR resolves the PTR request for the address with the NAT64
+// prefix using the PTR request for the embedded IPv4 address
+func (p *Proxy) exchangeDNS64PTR(req, ptrReq *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	log.Tracef("DNS64: resolving %s instead of %s", ptrReq.Question[0].Name, req.Question[0].Name)
+
+	resp, u, err := p.exchange(ptrReq, upstreams)
+	if err != nil {
+		return nil, u, err
+	}
+
+	arpa := ptrReq.Question[0].Name
+	resp = resp.Copy()
+	resp.Question = []dns.Question{req.Question[0]}
+	for _, rr := range resp.Answer {
+		if strings.EqualFold(rr.Header().Name, arpa) {
+			rr.Header().Name = req.Question[0].Name
+		}
+	}
+	return resp, u, nil
+}
+
+// ip6ArpaToIP converts the ip6.arpa name to the IPv6 address, or returns nil
+// if it's not a full reverse name of an IPv6 address
+func ip6ArpaToIP(name string) net.IP {
+	const suffix = ".ip6.arpa."
+
+	name = strings.ToLower(dns.Fqdn(name))
+	if !strings.HasSuffix(name, suffix) {
+		return nil
+	}
+
+	nibbles := strings.Split(strings.TrimSuffix(name, suffix), ".")
+	if len(nibbles) != net.IPv6len*2 {
+		return nil
+	}
+
+	var b strings.Builder
+	for i := len(nibbles) - 1; i >= 0; i-- {
+		if len(nibbles[i]) != 1 {
+			return nil
+		}
+		b.WriteString(nibbles[i])
+	}
+
+	ip, err := hex.DecodeString(b.String())
+	if err != nil {
+		return nil
+	}
+	return ip
+}
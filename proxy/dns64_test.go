@@ -5,7 +5,9 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 const ipv4OnlyHost = "and.ru"
@@ -151,3 +153,92 @@ func createTestDNSContext(host string) *DNSContext {
 	d.Req = createAAAATestMessage(host)
 	return &d
 }
+
+func TestDNS64Synthesis(t *testing.T) {
+	records := map[string][]string{
+		"ipv4only.example. A":           {"ipv4only.example. 120 IN A 203.0.113.1", "ipv4only.example. 120 IN A 127.0.0.1"},
+		"dual.example. A":               {"dual.example. 60 IN A 203.0.113.2"},
+		"dual.example. AAAA":            {"dual.example. 60 IN AAAA 2001:db8::2"},
+		"mapped.example. A":             {"mapped.example. 60 IN A 203.0.113.3"},
+		"mapped.example. AAAA":          {"mapped.example. 60 IN AAAA ::ffff:203.0.113.3"},
+		"private.example. A":            {"private.example. 60 IN A 192.168.1.1"},
+		"alias.example. A":              {"alias.example. 60 IN CNAME ipv4only.example.", "ipv4only.example. 120 IN A 203.0.113.1"},
+		"1.113.0.203.in-addr.arpa. PTR": {"1.113.0.203.in-addr.arpa. 60 IN PTR ipv4only.example."},
+	}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.DNS64Prefix = DefaultDNS64Prefix
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		q := m.Question[0]
+		resp := new(dns.Msg).SetReply(m)
+		for _, s := range records[q.Name+" "+dns.TypeToString[q.Qtype]] {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				return nil, err
+			}
+			resp.Answer = append(resp.Answer, rr)
+		}
+		return resp, nil
+	})}
+	assert.Nil(t, dnsProxy.Init())
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		d := &DNSContext{Req: req}
+		err := dnsProxy.Resolve(d)
+		if err != nil {
+			t.Fatalf("cannot resolve %s: %s", name, err)
+		}
+		return d.Res
+	}
+
+	// The loopback address is not synthesized, the TTL is copied
+	res := resolve("ipv4only.example.", dns.TypeAAAA)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "64:ff9b::cb00:7101", res.Answer[0].(*dns.AAAA).AAAA.String())
+		assert.Equal(t, uint32(120), res.Answer[0].Header().Ttl)
+	}
+
+	// Genuine AAAA records are kept
+	res = resolve("dual.example.", dns.TypeAAAA)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "2001:db8::2", res.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+
+	// IPv4-mapped AAAA records are replaced
+	res = resolve("mapped.example.", dns.TypeAAAA)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "64:ff9b::cb00:7103", res.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+
+	// Private addresses can't be used with the Well-Known Prefix, and the
+	// names without A records get an empty response
+	for _, name := range []string{"private.example.", "none.example."} {
+		res = resolve(name, dns.TypeAAAA)
+		assert.Equal(t, dns.RcodeSuccess, res.Rcode, name)
+		assert.Empty(t, res.Answer, name)
+	}
+
+	// CNAMEs are kept
+	res = resolve("alias.example.", dns.TypeAAAA)
+	if assert.Len(t, res.Answer, 2) {
+		assert.Equal(t, "ipv4only.example.", res.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "ipv4only.example.", res.Answer[1].Header().Name)
+	}
+
+	// Reverse lookups of the synthesized addresses
+	arpa, _ := dns.ReverseAddr("64:ff9b::cb00:7101")
+	res = resolve(arpa, dns.TypePTR)
+	assert.Equal(t, arpa, res.Question[0].Name)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, arpa, res.Answer[0].Header().Name)
+		assert.Equal(t, "ipv4only.example.", res.Answer[0].(*dns.PTR).Ptr)
+	}
+
+	// Invalid prefixes
+	for _, p := range []string{"64:ff9b::/64", "10.0.0.0/8", "invalid"} {
+		_, err := parseDNS64Prefix(p)
+		assert.NotNil(t, err, p)
+	}
+}
@@ -21,11 +21,21 @@ type DNSContext struct {
 	StartTime time.Time         // processing start time
 	Upstream  upstream.Upstream // upstream that resolved DNS request
 
+	// UpstreamInfo is the information about the exchange with Upstream, see
+	// upstream.ExchangeWithInfo.  It's nil if it's unknown, e.g. the response
+	// was synthesized with DNS64 or the custom UpstreamSelector doesn't
+	// implement InfoSelector.
+	UpstreamInfo *upstream.ExchangeInfo
+
 	// CustomUpstreamConfig -- custom upstream servers configuration
 	// to use for this request only.
 	// If set, Resolve() uses it instead of default servers
 	CustomUpstreamConfig *UpstreamConfig
 
+	// ExchangeOptions can be set by the handlers to change how Resolve
+	// handles the request
+	ExchangeOptions
+
 	// Conn is the underlying client connection.  It is nil if Proto is
 	// ProtoDNSCrypt, ProtoHTTPS, or ProtoQUIC.
 	Conn net.Conn
@@ -49,8 +59,22 @@ type DNSContext struct {
 	// ProtoQUIC only.
 	QUICSession quic.Session
 
-	ecsReqIP   net.IP // ECS IP used in request
-	ecsReqMask uint8  // ECS mask used in request
+	ecsReqIP   net.IP            // ECS IP used in request
+	ecsReqMask uint8             // ECS mask used in request
+	ecsClient  *dns.EDNS0_SUBNET // ECS option sent by the client, nil if there was none
+	ecsNoOPT   bool              // true if the client's request had no OPT record
+
+	nsidRequested bool // true if the client's request had the NSID option
+
+	responseHandled bool // true if ResponseHandler has been called for the request
+	cached          bool // true if the response was served from cache
+}
+
+// ExchangeOptions are the per-request options of Resolve
+type ExchangeOptions struct {
+	// NoCache - if true, the response is neither served from cache nor
+	// cached, e.g. to compare the cached response with the live one
+	NoCache bool
 }
 
 // scrub - prepares the d.Res to be written (truncates if necessary)
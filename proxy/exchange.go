@@ -1,88 +1,89 @@
 package proxy
 
 import (
-	"sort"
-	"time"
-
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
 
 // exchange -- sends DNS query to the upstream DNS server and returns the response
 func (p *Proxy) exchange(req *dns.Msg, upstreams []upstream.Upstream) (reply *dns.Msg, u upstream.Upstream, err error) {
+	reply, u, _, err = p.exchangeWithInfo(req, upstreams)
+	return reply, u, err
+}
+
+// exchangeWithInfo is like exchange, but it also returns the information about
+// the exchange with the upstream, it's nil if the selector doesn't implement
+// InfoSelector or the response is the one all upstreams have failed over with
+func (p *Proxy) exchangeWithInfo(req *dns.Msg, upstreams []upstream.Upstream) (reply *dns.Msg, u upstream.Upstream, info *upstream.ExchangeInfo, err error) {
+	gen := p.acquireUpstreams()
+	upstreams = gen.wrap(p, upstreams)
+	gen.release()
+
+	failover, upstreams := p.startFailover(upstreams)
+
 	qtype := req.Question[0].Qtype
 	if p.UpstreamMode == UModeFastestAddr && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
-		reply, u, err = p.fastestAddr.ExchangeFastest(req, upstreams)
-		return
+		reply, u, info, err = p.fastestAddr.ExchangeFastestWithInfo(req, upstreams)
+	} else if s, ok := p.getUpstreamSelector().(InfoSelector); ok {
+		reply, u, info, err = s.ExchangeWithInfo(req, upstreams)
+	} else {
+		reply, u, err = p.getUpstreamSelector().Exchange(req, upstreams)
 	}
 
-	if p.UpstreamMode == UModeParallel {
-		reply, u, err = upstream.ExchangeParallel(upstreams, req)
-		return
+	if err != nil && failover != nil {
+		if e, ok := failover.agreed(len(upstreams)); ok {
+			log.Tracef("All upstreams responded to %s with %s", req.Question[0].Name, dns.RcodeToString[e.reply.Rcode])
+			reply, u, info, err = e.reply, e.upstream, nil, nil
+		}
 	}
 
-	// UModeLoadBalance goes below
-
-	if len(upstreams) == 1 {
-		u = upstreams[0]
-		reply, _, err = exchangeWithUpstream(u, req)
-		return
+	u = unwrapUpstream(u)
+	if err == nil && u != nil {
+		p.countSelection(u)
 	}
+	return reply, u, info, err
+}
 
-	// sort upstreams by rtt from fast to slow
-	sortedUpstreams := p.getSortedUpstreams(upstreams)
-
-	errs := []error{}
-	for _, dnsUpstream := range sortedUpstreams {
-		reply, elapsed, err := exchangeWithUpstream(dnsUpstream, req)
-		if err == nil {
-			p.updateRtt(dnsUpstream.Address(), elapsed)
-			return reply, dnsUpstream, err
-		}
-		errs = append(errs, err)
-		p.updateRtt(dnsUpstream.Address(), int(defaultTimeout/time.Millisecond))
+// getUpstreamSelector returns the configured UpstreamSelector or the default
+// one for the UpstreamMode
+func (p *Proxy) getUpstreamSelector() UpstreamSelector {
+	if p.UpstreamSelector != nil {
+		return p.UpstreamSelector
 	}
-	return nil, nil, errorx.DecorateMany("all upstreams failed to exchange request", errs...)
-}
 
-func (p *Proxy) getSortedUpstreams(u []upstream.Upstream) []upstream.Upstream {
-	// clone upstreams list to avoid race conditions
-	p.rttLock.Lock()
-	clone := make([]upstream.Upstream, len(u))
-	copy(clone, u)
+	p.selectionLock.Lock()
+	defer p.selectionLock.Unlock()
 
-	sort.Slice(clone, func(i, j int) bool {
-		if p.upstreamRttStats[clone[i].Address()] < p.upstreamRttStats[clone[j].Address()] {
-			return true
+	if p.selector == nil {
+		if p.UpstreamMode == UModeParallel {
+			p.selector = NewParallelSelector()
+		} else {
+			p.selector = NewRTTSelector()
 		}
-		return false
-	})
-	p.rttLock.Unlock()
-
-	return clone
+	}
+	return p.selector
 }
 
-// exchangeWithUpstream returns result of Exchange with elapsed time
-func exchangeWithUpstream(u upstream.Upstream, req *dns.Msg) (*dns.Msg, int, error) {
-	startTime := time.Now()
-	reply, err := u.Exchange(req)
-	elapsed := int(time.Since(startTime) / time.Millisecond)
-	if err != nil {
-		log.Tracef("upstream %s failed to exchange %s in %d milliseconds. Cause: %s", u.Address(), req.Question[0].String(), elapsed, err)
-	} else {
-		log.Tracef("upstream %s successfully finished exchange of %s. Elapsed %d ms.", u.Address(), req.Question[0].String(), elapsed)
+// countSelection counts the response of the upstream
+func (p *Proxy) countSelection(u upstream.Upstream) {
+	p.selectionLock.Lock()
+	if p.selections == nil {
+		p.selections = map[string]uint64{}
 	}
-	return reply, elapsed, err
+	p.selections[u.Address()]++
+	p.selectionLock.Unlock()
 }
 
-// updateRtt updates rtt in upstreamRttStats for given address
-func (p *Proxy) updateRtt(address string, rtt int) {
-	p.rttLock.Lock()
-	if p.upstreamRttStats == nil {
-		p.upstreamRttStats = map[string]int{}
+// UpstreamSelections returns the number of responses used from every upstream
+// by the upstream address
+func (p *Proxy) UpstreamSelections() map[string]uint64 {
+	p.selectionLock.Lock()
+	defer p.selectionLock.Unlock()
+
+	counts := make(map[string]uint64, len(p.selections))
+	for addr, n := range p.selections {
+		counts[addr] = n
 	}
-	p.upstreamRttStats[address] = (p.upstreamRttStats[address] + rtt) / 2
-	p.rttLock.Unlock()
+	return counts
 }
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// rcodeError is returned instead of the response with one of
+// Config.FailoverRcodes, so that the selector tries the next upstream
+type rcodeError struct {
+	upstream upstream.Upstream // the upstream that responded
+	reply    *dns.Msg
+}
+
+func (e *rcodeError) Error() string {
+	return fmt.Sprintf("upstream %s responded with %s", e.upstream.Address(), dns.RcodeToString[e.reply.Rcode])
+}
+
+// rcodeFailover keeps the responses turned into errors during a single
+// exchange, the response is used if all the upstreams agree on the code
+type rcodeFailover struct {
+	p    *Proxy
+	errs []*rcodeError
+	mu   sync.Mutex // protects errs
+}
+
+// startFailover wraps the upstreams for a single exchange, so that the
+// responses with Config.FailoverRcodes are turned into errors whatever request
+// UpstreamSelector passes to them.  It returns nil and the upstreams as is if
+// Config.FailoverRcodes is empty.
+func (p *Proxy) startFailover(upstreams []upstream.Upstream) (*rcodeFailover, []upstream.Upstream) {
+	if len(p.FailoverRcodes) == 0 {
+		return nil, upstreams
+	}
+
+	f := &rcodeFailover{p: p}
+	wrapped := make([]upstream.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		// The wrappers report to Metrics as well, so they replace the ones
+		// of the generation
+		wrapped[i] = &wrappedUpstream{Upstream: unwrapUpstream(u), p: p, failover: f}
+	}
+	return f, wrapped
+}
+
+// check turns the response of the upstream into an error if its code is one
+// of Config.FailoverRcodes
+func (f *rcodeFailover) check(u upstream.Upstream, reply *dns.Msg) (*dns.Msg, error) {
+	if !f.p.isFailover(reply.Rcode) {
+		return reply, nil
+	}
+
+	f.p.upstreamRcodeFailover(u.Address(), reply.Rcode)
+	e := &rcodeError{upstream: u, reply: reply}
+
+	f.mu.Lock()
+	f.errs = append(f.errs, e)
+	f.mu.Unlock()
+
+	return nil, e
+}
+
+// isFailover checks if the response code must be treated as a failure
+func (p *Proxy) isFailover(rcode int) bool {
+	for _, rc := range p.FailoverRcodes {
+		if rc == rcode {
+			return true
+		}
+	}
+	return false
+}
+
+// agreed returns the response if each of n upstreams has responded with the
+// same failover code
+func (f *rcodeFailover) agreed(n int) (*rcodeError, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if n == 0 || len(f.errs) != n {
+		return nil, false
+	}
+	for _, e := range f.errs[1:] {
+		if e.reply.Rcode != f.errs[0].reply.Rcode {
+			return nil, false
+		}
+	}
+	return f.errs[0], true
+}
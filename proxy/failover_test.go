@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// failoverMetrics counts the rcode failovers
+type failoverMetrics struct {
+	noopMetrics
+
+	failovers map[int]int
+	mu        sync.Mutex
+}
+
+func (m *failoverMetrics) UpstreamRcodeFailover(_ string, rcode int) {
+	m.mu.Lock()
+	m.failovers[rcode]++
+	m.mu.Unlock()
+}
+
+// copyingSelector passes the copies of the requests to UpstreamSelector
+type copyingSelector struct {
+	UpstreamSelector
+}
+
+func (s *copyingSelector) Exchange(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	return s.UpstreamSelector.Exchange(req.Copy(), upstreams)
+}
+
+func TestFailoverRcodes(t *testing.T) {
+	// The upstreams respond with the code set for the query name
+	newUpstream := func(rcodes map[string]int) upstream.Upstream {
+		return upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+			resp := new(dns.Msg).SetReply(m)
+			resp.Rcode = rcodes[m.Question[0].Name]
+			if resp.Rcode == dns.RcodeSuccess {
+				resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 192.0.2.1")}
+			}
+			return resp, nil
+		})
+	}
+	u1 := newUpstream(map[string]int{
+		"servfail.example.": dns.RcodeServerFailure,
+		"agreed.example.":   dns.RcodeRefused,
+		"differ.example.":   dns.RcodeRefused,
+		"nx.example.":       dns.RcodeNameError,
+	})
+	u2 := newUpstream(map[string]int{
+		"agreed.example.": dns.RcodeRefused,
+		"differ.example.": dns.RcodeServerFailure,
+	})
+
+	m := &failoverMetrics{failovers: map[int]int{}}
+	p := createTestProxy(t, nil)
+	p.UpstreamConfig.Upstreams = []upstream.Upstream{u1, u2}
+	// u1 is always tried first
+	p.UpstreamSelector = NewWeightedSelector(map[string]int{u1.Address(): 1000})
+	p.FailoverRcodes = []int{dns.RcodeServerFailure, dns.RcodeRefused}
+	p.Metrics = m
+	err := p.Init()
+	if err != nil {
+		t.Fatalf("cannot init the proxy: %s", err)
+	}
+
+	resolve := func(name string) *dns.Msg {
+		d := &DNSContext{Req: new(dns.Msg).SetQuestion(name, dns.TypeA)}
+		_ = p.Resolve(d)
+		return d.Res
+	}
+
+	// The next upstream is tried
+	res := resolve("servfail.example.")
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Len(t, res.Answer, 1)
+
+	// The code is used if all upstreams agree
+	assert.Equal(t, dns.RcodeRefused, resolve("agreed.example.").Rcode)
+
+	// Otherwise it's a server failure
+	assert.Equal(t, dns.RcodeServerFailure, resolve("differ.example.").Rcode)
+
+	// NXDOMAIN is never a failure
+	assert.Equal(t, dns.RcodeNameError, resolve("nx.example.").Rcode)
+
+	m.mu.Lock()
+	assert.Equal(t, map[int]int{dns.RcodeServerFailure: 2, dns.RcodeRefused: 3}, m.failovers)
+	m.mu.Unlock()
+
+	// The upstreams are wrapped once for all the queries
+	gen := p.acquireUpstreams()
+	first := gen.wrap(p, p.UpstreamConfig.Upstreams)
+	second := gen.wrap(p, p.UpstreamConfig.Upstreams)
+	gen.release()
+	assert.True(t, first[0] == second[0] && first[1] == second[1])
+	assert.Equal(t, u1, unwrapUpstream(first[0]))
+
+	// The selector may pass a copy of the request to the upstreams
+	p.UpstreamSelector = &copyingSelector{UpstreamSelector: p.UpstreamSelector}
+	res = resolve("servfail.example.")
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Len(t, res.Answer, 1)
+
+	// NXDOMAIN can't be configured
+	p = createTestProxy(t, nil)
+	p.FailoverRcodes = []int{dns.RcodeNameError}
+	assert.NotNil(t, p.Start())
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// newDomainSet creates the set of the lowercase FQDNs from the list
+func newDomainSet(domains []string) map[string]bool {
+	set := map[string]bool{}
+	for _, d := range domains {
+		d = strings.TrimSpace(d)
+		if d != "" {
+			set[strings.ToLower(dns.Fqdn(d))] = true
+		}
+	}
+	return set
+}
+
+// matchDomain checks if the name or one of its parent domains is in the set
+func matchDomain(set map[string]bool, name string) bool {
+	if len(set) == 0 {
+		return false
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if set[name[off:]] {
+			return true
+		}
+	}
+	return false
+}
+
+// replyFilteredAAAA answers the AAAA query with the empty NOERROR response if
+// FilterAAAA is set and the domain isn't exempt, the query isn't sent to the
+// upstreams.  It's checked before the cache, so turning FilterAAAA off takes
+// effect at once.
+func (p *Proxy) replyFilteredAAAA(d *DNSContext) bool {
+	if !p.FilterAAAA || len(d.Req.Question) == 0 {
+		return false
+	}
+
+	q := d.Req.Question[0]
+	if q.Qtype != dns.TypeAAAA || matchDomain(p.filterAAAAExempt, q.Name) {
+		return false
+	}
+
+	log.Debug("IPv6 is disabled. Reply with NoError to %s AAAA request", q.Name)
+	d.Res = genEmptyNoError(d.Req)
+	return true
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterAAAA(t *testing.T) {
+	var queries int32
+	u := upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&queries, 1)
+		name := m.Question[0].Name
+		resp := new(dns.Msg).SetReply(m)
+		switch m.Question[0].Qtype {
+		case dns.TypeA:
+			resp.Answer = []dns.RR{newRR(name + " 60 IN A 192.0.2.1")}
+		case dns.TypeAAAA:
+			resp.Answer = []dns.RR{
+				newRR(name + " 60 IN CNAME host.example.net."),
+				newRR("host.example.net. 60 IN AAAA 2001:db8::1"),
+			}
+			resp.Ns = []dns.RR{newRR("example.net. 60 IN SOA ns.example.net. hostmaster.example.net. 1 3600 600 86400 60")}
+		case dns.TypeTXT:
+			resp.Answer = []dns.RR{newRR(name + ` 60 IN TXT "v=test"`)}
+		}
+		return resp, nil
+	})
+
+	p := createTestProxy(t, nil)
+	p.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	p.CacheEnabled = true
+	p.FilterAAAA = true
+	p.FilterAAAAExempt = []string{"My.Domain.example"}
+	err := p.Init()
+	if err != nil {
+		t.Fatalf("cannot init the proxy: %s", err)
+	}
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		d := &DNSContext{Req: new(dns.Msg).SetQuestion(name, qtype)}
+		err := p.Resolve(d)
+		if err != nil {
+			t.Fatalf("cannot resolve %s: %s", name, err)
+		}
+		return d.Res
+	}
+
+	// The AAAA queries are answered locally
+	res := resolve("example.org.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Empty(t, res.Answer)
+	if assert.Len(t, res.Ns, 1) {
+		assert.Equal(t, dns.TypeSOA, res.Ns[0].Header().Rrtype)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&queries))
+
+	// Other types are not affected
+	assert.Len(t, resolve("example.org.", dns.TypeA).Answer, 1)
+	assert.Len(t, resolve("example.org.", dns.TypeTXT).Answer, 1)
+
+	// Neither are the exempt domains
+	assert.Len(t, resolve("sub.my.domain.example.", dns.TypeAAAA).Answer, 2)
+	assert.Len(t, resolve("my.domain.example.", dns.TypeAAAA).Answer, 2)
+	assert.Empty(t, resolve("notmy.domain.example.", dns.TypeAAAA).Answer)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&queries))
+
+	// Turning the filter off takes effect at once
+	p.FilterAAAA = false
+	res = resolve("example.org.", dns.TypeAAAA)
+	assert.Len(t, res.Answer, 2)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&queries))
+}
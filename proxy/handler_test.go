@@ -1,11 +1,16 @@
 package proxy
 
 import (
+	"fmt"
+	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestFilteringHandler(t *testing.T) {
@@ -71,3 +76,109 @@ func TestFilteringHandler(t *testing.T) {
 		t.Fatalf("cannot stop the DNS proxy: %s", err)
 	}
 }
+
+func TestHandlerHooks(t *testing.T) {
+	var upstreamQueries int32
+	staticUpstream := upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&upstreamQueries, 1)
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IP{192, 0, 2, 1},
+		}}
+		return resp, nil
+	})
+
+	var mu sync.Mutex
+	handled := map[string]int{}
+
+	serverConfig, _ := createServerTLSConfig(t)
+	plainProxy := createTestProxy(t, nil)
+	tlsProxy := createTestProxy(t, serverConfig)
+	for _, p := range []*Proxy{plainProxy, tlsProxy} {
+		p.UpstreamConfig.Upstreams = []upstream.Upstream{staticUpstream}
+		p.BeforeRequestHandler = func(p *Proxy, d *DNSContext) (bool, error) {
+			switch d.Req.Question[0].Name {
+			case "blocked.example.":
+				// Short-circuit with a synthesized response
+				resp := new(dns.Msg).SetReply(d.Req)
+				resp.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: "blocked.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4zero,
+				}}
+				d.Res = resp
+			case "panic.example.":
+				panic("bad rule")
+			}
+			return true, nil
+		}
+		p.ResponseHandler = func(d *DNSContext, err error) {
+			mu.Lock()
+			handled[d.Req.Question[0].Name]++
+			mu.Unlock()
+
+			if d.Req.Question[0].Name == "respanic.example." {
+				panic("bad response rule")
+			}
+		}
+
+		err := p.Start()
+		if err != nil {
+			t.Fatalf("cannot start the DNS proxy: %s", err)
+		}
+		defer func(p *Proxy) { _ = p.Stop() }(p)
+	}
+
+	clients := []string{
+		plainProxy.Addr(ProtoUDP).String(),
+		"tcp://" + plainProxy.Addr(ProtoTCP).String(),
+		"tls://" + tlsProxy.Addr(ProtoTLS).String(),
+		fmt.Sprintf("https://%s/dns-query", tlsProxy.Addr(ProtoHTTPS)),
+	}
+	for _, addr := range clients {
+		u, err := upstream.AddressToUpstream(addr, upstream.Options{Timeout: defaultTimeout, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("cannot create the client for %s: %s", addr, err)
+		}
+
+		exchange := func(name string) *dns.Msg {
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			resp, err := u.Exchange(req)
+			if err != nil {
+				t.Fatalf("%s: cannot exchange %s: %s", addr, name, err)
+			}
+			return resp
+		}
+
+		queries := atomic.LoadInt32(&upstreamQueries)
+		resp := exchange("blocked.example.")
+		if assert.Len(t, resp.Answer, 1, addr) {
+			assert.True(t, resp.Answer[0].(*dns.A).A.Equal(net.IPv4zero), addr)
+		}
+		assert.Equal(t, queries, atomic.LoadInt32(&upstreamQueries), addr)
+
+		resp = exchange("pass.example.")
+		if assert.Len(t, resp.Answer, 1, addr) {
+			assert.True(t, resp.Answer[0].(*dns.A).A.Equal(net.IP{192, 0, 2, 1}), addr)
+		}
+		assert.Equal(t, queries+1, atomic.LoadInt32(&upstreamQueries), addr)
+
+		// The panics in the handlers don't crash the proxy
+		resp = exchange("panic.example.")
+		assert.Equal(t, dns.RcodeServerFailure, resp.Rcode, addr)
+		resp = exchange("respanic.example.")
+		assert.Len(t, resp.Answer, 1, addr)
+	}
+
+	// ResponseHandler is called once for every query
+	mu.Lock()
+	defer mu.Unlock()
+	n := len(clients)
+	assert.Equal(t, map[string]int{
+		"blocked.example.":  n,
+		"pass.example.":     n,
+		"panic.example.":    n,
+		"respanic.example.": n,
+	}, handled)
+}
@@ -4,23 +4,11 @@ import (
 	"net"
 	"strings"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
 
 const retryNoError = 60 // Retry time for NoError SOA
 
-// CheckDisabledAAAARequest checks if AAAA requests should be disabled or not and sets NoError empty response to given DNSContext if needed
-func CheckDisabledAAAARequest(ctx *DNSContext, ipv6Disabled bool) bool {
-	if ipv6Disabled && ctx.Req.Question[0].Qtype == dns.TypeAAAA {
-		log.Debug("IPv6 is disabled. Reply with NoError to %s AAAA request", ctx.Req.Question[0].Name)
-		ctx.Res = genEmptyNoError(ctx.Req)
-		return true
-	}
-
-	return false
-}
-
 // GenEmptyMessage generates empty message with given response code and retry time
 func GenEmptyMessage(request *dns.Msg, rCode int, retry uint32) *dns.Msg {
 	resp := dns.Msg{}
@@ -78,6 +66,18 @@ func getIPString(addr net.Addr) string {
 	return ""
 }
 
+// getIP is a helper function that extracts IP address from net.Addr, it
+// returns nil if the address is neither UDP nor TCP
+func getIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
 // Parse ECS option from DNS response
 // Return IP, mask, scope
 func parseECS(m *dns.Msg) (net.IP, uint8, uint8) {
@@ -140,6 +140,27 @@ func setECS(m *dns.Msg, ip net.IP, scope uint8) (net.IP, uint8) {
 	return e.Address, e.SourceNetmask
 }
 
+// removeECS removes the ECS option from the message and returns it, or nil if
+// there was none
+func removeECS(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	var ecs *dns.EDNS0_SUBNET
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			ecs = e
+			continue
+		}
+		options = append(options, o)
+	}
+	opt.Option = options
+	return ecs
+}
+
 // Return TRUE if IP is within public Internet IP range
 // nolint (gocyclo)
 func isPublicIP(ip net.IP) bool {
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// defaultHostsTTL is used when Config.HostsTTL is not set
+const defaultHostsTTL = 10
+
+// loadHosts reads the records in the hosts file format to t: an IP address
+// followed by the host names on every line, "#" starts a comment.  Lines with
+// invalid IP addresses are skipped.
+func loadHosts(t *proxyutil.HostsTable, r io.Reader) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		// Remove the IPv6 zone, it's meaningless in DNS responses
+		addr := fields[0]
+		if i := strings.IndexByte(addr, '%'); i >= 0 {
+			addr = addr[:i]
+		}
+
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			log.Debug("hosts: skipping the line with an invalid IP: %s", line)
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			t.Add(name, []net.IP{ip})
+		}
+	}
+	return s.Err()
+}
+
+// AddHostsRecord adds the addresses of the host.  The proxy answers the A and
+// AAAA queries for the host and the PTR queries for the addresses itself.
+// It's safe to call it while the proxy is running.
+func (p *Proxy) AddHostsRecord(name string, ips []net.IP) {
+	p.hostsLock.Lock()
+	defer p.hostsLock.Unlock()
+
+	if p.hosts == nil {
+		p.hosts = proxyutil.NewHostsTable()
+	}
+	p.hosts.Add(name, ips)
+}
+
+// LoadHostsFiles replaces all hosts records, including the ones added with
+// AddHostsRecord, with the records from the files in the hosts file format.
+// If one of the files can't be read, the records are not changed.  It's safe
+// to call it while the proxy is running.
+func (p *Proxy) LoadHostsFiles(paths ...string) error {
+	t := proxyutil.NewHostsTable()
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		err = loadHosts(t, f)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+
+	p.hostsLock.Lock()
+	p.hosts = t
+	p.hostsLock.Unlock()
+
+	log.Debug("Loaded %d hosts from %v", t.Len(), paths)
+	return nil
+}
+
+// replyFromHosts tries to answer the request from the hosts records.  The
+// hosts that have no addresses of the requested family get an empty response.
+func (p *Proxy) replyFromHosts(d *DNSContext) bool {
+	q := d.Req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return false
+	}
+
+	ttl := p.HostsTTL
+	if ttl == 0 {
+		ttl = defaultHostsTTL
+	}
+
+	p.hostsLock.RLock()
+	var answer []dns.RR
+	ok := false
+	if p.hosts != nil {
+		answer, ok = p.hosts.Lookup(q.Name, q.Qtype, ttl)
+	}
+	p.hostsLock.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	resp := new(dns.Msg).SetReply(d.Req)
+	resp.RecursionAvailable = true
+	resp.Answer = answer
+	d.Res = resp
+	log.Debug("Serving response from hosts")
+	return true
+}
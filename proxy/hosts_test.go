@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostsTableLoad(t *testing.T) {
+	tbl := proxyutil.NewHostsTable()
+	err := loadHosts(tbl, strings.NewReader(`# comment
+127.0.0.1	localhost
+::1		localhost ip6-localhost # comment
+192.168.1.1 Router.LAN router
+fe80::1%lo0 link.lan
+invalid     broken.lan
+192.168.1.2
+`))
+	assert.Nil(t, err)
+
+	assert.Equal(t, 5, tbl.Len())
+	rrs, _ := tbl.Lookup("localhost.", dns.TypeA, 0)
+	assert.Len(t, rrs, 1)
+	rrs, _ = tbl.Lookup("localhost.", dns.TypeAAAA, 0)
+	assert.Len(t, rrs, 1)
+	rrs, _ = tbl.Lookup("link.lan.", dns.TypeAAAA, 0)
+	assert.Len(t, rrs, 1)
+	_, ok := tbl.Lookup("broken.lan.", dns.TypeA, 0)
+	assert.False(t, ok)
+	rrs, _ = tbl.Lookup("1.1.168.192.in-addr.arpa.", dns.TypePTR, 0)
+	if assert.Len(t, rrs, 2) {
+		assert.Equal(t, "router.lan.", rrs[0].(*dns.PTR).Ptr)
+		assert.Equal(t, "router.", rrs[1].(*dns.PTR).Ptr)
+	}
+}
+
+func TestProxyHosts(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{upstream.NullUpstream()}
+	dnsProxy.HostsTTL = 30
+	dnsProxy.AddHostsRecord("Host.LAN", []net.IP{net.ParseIP("192.168.1.10"), net.ParseIP("fd00::10")})
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		d := &DNSContext{Req: req}
+		err := dnsProxy.Resolve(d)
+		if err != nil {
+			t.Fatalf("cannot resolve %s: %s", name, err)
+		}
+		return d.Res
+	}
+
+	// Both IPv4 and IPv6, case-insensitive
+	res := resolve("host.lan.", dns.TypeA)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "192.168.1.10", res.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, uint32(30), res.Answer[0].Header().Ttl)
+	}
+	res = resolve("HOST.lan.", dns.TypeAAAA)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "fd00::10", res.Answer[0].(*dns.AAAA).AAAA.String())
+		assert.Equal(t, "HOST.lan.", res.Answer[0].Header().Name)
+	}
+
+	// Reverse lookups
+	res = resolve("10.1.168.192.in-addr.arpa.", dns.TypePTR)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "host.lan.", res.Answer[0].(*dns.PTR).Ptr)
+	}
+	arpa, _ := dns.ReverseAddr("fd00::10")
+	res = resolve(arpa, dns.TypePTR)
+	assert.Len(t, res.Answer, 1)
+
+	// Other names and types go to the upstream
+	for _, q := range []dns.Question{
+		{Name: "www.host.lan.", Qtype: dns.TypeA},
+		{Name: "host.lan.", Qtype: dns.TypeMX},
+		{Name: "11.1.168.192.in-addr.arpa.", Qtype: dns.TypePTR},
+	} {
+		res = resolve(q.Name, q.Qtype)
+		assert.Empty(t, res.Answer, q.Name)
+	}
+
+	// Reloading replaces all records
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatalf("cannot create the hosts file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString("10.0.0.1 other.lan\n")
+	_ = f.Close()
+
+	assert.Nil(t, dnsProxy.LoadHostsFiles(f.Name()))
+	assert.Empty(t, resolve("host.lan.", dns.TypeA).Answer)
+	assert.Len(t, resolve("other.lan.", dns.TypeA).Answer, 1)
+
+	// The records are kept if a file can't be read
+	assert.NotNil(t, dnsProxy.LoadHostsFiles(f.Name(), f.Name()+".missing"))
+	assert.Len(t, resolve("other.lan.", dns.TypeA).Answer, 1)
+}
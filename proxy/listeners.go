@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+)
+
+// listenerDrainTimeout is how long RemoveListener waits for the requests
+// being handled by the listener
+const listenerDrainTimeout = defaultTimeout
+
+// listenerTracker tracks the requests being handled by a UDP, TCP or TLS
+// listener, so that it can be removed without dropping them
+type listenerTracker struct {
+	done     chan struct{}  // closed when the listener loop exits
+	closing  int32          // 1 if the listener is being removed, accessed atomically
+	handlers sync.WaitGroup // the UDP packets or the TCP connections being handled
+
+	conns     map[net.Conn]bool // the TCP connections being handled
+	connsLock sync.Mutex        // protects conns
+}
+
+// isClosing returns true if the listener is being removed
+func (t *listenerTracker) isClosing() bool {
+	return atomic.LoadInt32(&t.closing) == 1
+}
+
+// addConn starts tracking the TCP connection
+func (t *listenerTracker) addConn(conn net.Conn) {
+	t.connsLock.Lock()
+	t.conns[conn] = true
+	t.connsLock.Unlock()
+}
+
+// removeConn stops tracking the TCP connection
+func (t *listenerTracker) removeConn(conn net.Conn) {
+	t.connsLock.Lock()
+	delete(t.conns, conn)
+	t.connsLock.Unlock()
+}
+
+// eachConn calls f for every TCP connection being handled
+func (t *listenerTracker) eachConn(f func(conn net.Conn)) {
+	t.connsLock.Lock()
+	defer t.connsLock.Unlock()
+
+	for conn := range t.conns {
+		f(conn)
+	}
+}
+
+// drain waits until the listener loop exits and the requests being handled
+// are answered, but no longer than until the deadline.  The TCP connections
+// stop reading the new queries.  It returns false if the deadline passes.
+func (t *listenerTracker) drain(deadline time.Time) bool {
+	drained := make(chan struct{})
+	go func() {
+		<-t.done
+		t.eachConn(func(conn net.Conn) { _ = conn.SetReadDeadline(time.Now()) })
+		t.handlers.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// serveUDP starts the loop of the UDP listener
+func (p *Proxy) serveUDP(l *net.UDPConn) {
+	t := p.newListenerTracker(l)
+	go p.udpPacketLoop(l, t, p.requestGoroutinesSema)
+}
+
+// serveTCP starts the loop of the TCP or TLS listener
+func (p *Proxy) serveTCP(l net.Listener, proto string) {
+	t := p.newListenerTracker(l)
+	go p.tcpPacketLoop(l, proto, t, p.requestGoroutinesSema)
+}
+
+// newListenerTracker creates a new *listenerTracker for the listener.  p must
+// be locked.
+func (p *Proxy) newListenerTracker(l io.Closer) *listenerTracker {
+	t := &listenerTracker{
+		done:  make(chan struct{}),
+		conns: map[net.Conn]bool{},
+	}
+	if p.trackers == nil {
+		p.trackers = map[io.Closer]*listenerTracker{}
+	}
+	p.trackers[l] = t
+	return t
+}
+
+// AddListener starts listening to the address, proto must be "udp", "tcp" or
+// "tls".  It returns the address the listener is bound to, e.g. with the port
+// chosen by the system if addr has port 0.  The proxy must be started, the
+// other listeners aren't affected even if it fails.  The listener isn't added
+// to the configuration, so it isn't restored if the proxy is restarted.
+func (p *Proxy) AddListener(proto, addr string) (net.Addr, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.started {
+		return nil, errors.New("the DNS proxy server is not started")
+	}
+
+	switch proto {
+	case ProtoUDP:
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, errorx.Decorate(err, "invalid listen address %s", addr)
+		}
+		conns, err := p.udpCreateAll(udpAddr)
+		if err != nil {
+			return nil, err
+		}
+		p.udpListen = append(p.udpListen, conns...)
+		for _, l := range conns {
+			p.serveUDP(l)
+		}
+		return conns[0].LocalAddr(), nil
+
+	case ProtoTCP, ProtoTLS:
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, errorx.Decorate(err, "invalid listen address %s", addr)
+		}
+
+		var l net.Listener
+		if proto == ProtoTCP {
+			l, err = p.tcpCreate(tcpAddr)
+		} else if p.TLSConfig == nil {
+			err = errors.New("cannot listen to TLS without TLSConfig")
+		} else {
+			l, err = p.tlsCreate(tcpAddr)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if proto == ProtoTCP {
+			p.tcpListen = append(p.tcpListen, l)
+		} else {
+			p.tlsListen = append(p.tlsListen, l)
+		}
+		p.serveTCP(l, proto)
+		return l.Addr(), nil
+
+	default:
+		return nil, fmt.Errorf("adding %s listeners is not supported", proto)
+	}
+}
+
+// RemoveListener stops listening to the address, proto must be "udp", "tcp" or
+// "tls".  The listener stops accepting the new requests right away, but it's
+// only closed once the requests it's handling are answered, or in 10 seconds.
+// The TCP connections are closed as soon as their current queries are
+// answered.  The other listeners aren't affected.
+func (p *Proxy) RemoveListener(proto, addr string) error {
+	var listenAddr string
+	switch proto {
+	case ProtoUDP:
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return errorx.Decorate(err, "invalid listen address %s", addr)
+		}
+		listenAddr = udpAddr.String()
+	case ProtoTCP, ProtoTLS:
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return errorx.Decorate(err, "invalid listen address %s", addr)
+		}
+		listenAddr = tcpAddr.String()
+	default:
+		return fmt.Errorf("removing %s listeners is not supported", proto)
+	}
+
+	removed := p.takeListeners(proto, listenAddr)
+	if len(removed) == 0 {
+		return fmt.Errorf("not listening to %s://%s", proto, listenAddr)
+	}
+
+	log.Info("Removing the listener %s://%s", proto, listenAddr)
+
+	// The listeners stop accepting the requests first, so that the requests
+	// being handled can be waited for
+	for l, t := range removed {
+		atomic.StoreInt32(&t.closing, 1)
+		if udpListen, ok := l.(*net.UDPConn); ok {
+			_ = udpListen.SetReadDeadline(time.Now())
+		} else {
+			_ = l.Close()
+		}
+	}
+
+	deadline := time.Now().Add(listenerDrainTimeout)
+	var errs []error
+	for l, t := range removed {
+		if !t.drain(deadline) {
+			log.Info("Timed out waiting for the requests to the listener %s://%s", proto, listenAddr)
+			t.eachConn(func(conn net.Conn) { _ = conn.Close() })
+		}
+
+		if _, ok := l.(*net.UDPConn); ok {
+			err := l.Close()
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) != 0 {
+		return errorx.DecorateMany(fmt.Sprintf("couldn't close the listener %s://%s", proto, listenAddr), errs...)
+	}
+	log.Info("Removed the listener %s://%s", proto, listenAddr)
+	return nil
+}
+
+// takeListeners removes the listeners bound to the address from the proxy,
+// so that Stop doesn't close them, and returns them with their trackers
+func (p *Proxy) takeListeners(proto, addr string) map[io.Closer]*listenerTracker {
+	p.Lock()
+	defer p.Unlock()
+
+	removed := map[io.Closer]*listenerTracker{}
+	take := func(l io.Closer, lAddr net.Addr) bool {
+		t, ok := p.trackers[l]
+		if !ok || lAddr.String() != addr {
+			return false
+		}
+		delete(p.trackers, l)
+		removed[l] = t
+		return true
+	}
+
+	switch proto {
+	case ProtoUDP:
+		var kept []*net.UDPConn
+		for _, l := range p.udpListen {
+			if !take(l, l.LocalAddr()) {
+				kept = append(kept, l)
+			}
+		}
+		p.udpListen = kept
+	case ProtoTCP:
+		p.tcpListen = takeNetListeners(p.tcpListen, take)
+	case ProtoTLS:
+		p.tlsListen = takeNetListeners(p.tlsListen, take)
+	}
+
+	return removed
+}
+
+// takeNetListeners returns the listeners take has returned false for
+func takeNetListeners(listeners []net.Listener, take func(l io.Closer, addr net.Addr) bool) []net.Listener {
+	var kept []net.Listener
+	for _, l := range listeners {
+		if !take(l, l.Addr()) {
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddRemoveListener(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		d.Res = new(dns.Msg).SetReply(d.Req)
+		return nil
+	}
+
+	// The proxy must be started
+	_, err := dnsProxy.AddListener(ProtoUDP, listenIP+":0")
+	assert.NotNil(t, err)
+
+	err = dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	for _, proto := range []string{ProtoUDP, ProtoTCP} {
+		client := &dns.Client{Net: proto, Timeout: 200 * time.Millisecond}
+		exchange := func(addr net.Addr) error {
+			_, _, err := client.Exchange(createTestMessage(), addr.String())
+			return err
+		}
+		first := dnsProxy.Addr(proto)
+
+		added, err := dnsProxy.AddListener(proto, listenIP+":0")
+		if err != nil {
+			t.Fatalf("cannot add the %s listener: %s", proto, err)
+		}
+		assert.Len(t, dnsProxy.Addrs(proto), 2)
+		assert.Nil(t, exchange(added))
+
+		// The address is busy, the other listeners keep working
+		_, err = dnsProxy.AddListener(proto, first.String())
+		assert.NotNil(t, err)
+		assert.Len(t, dnsProxy.Addrs(proto), 2)
+		assert.Nil(t, exchange(first))
+
+		err = dnsProxy.RemoveListener(proto, added.String())
+		assert.Nil(t, err)
+		assert.Equal(t, []net.Addr{first}, dnsProxy.Addrs(proto))
+		assert.NotNil(t, exchange(added))
+		assert.Nil(t, exchange(first))
+
+		// It's removed already
+		err = dnsProxy.RemoveListener(proto, added.String())
+		assert.NotNil(t, err)
+	}
+
+	_, err = dnsProxy.AddListener(ProtoHTTPS, listenIP+":0")
+	assert.NotNil(t, err)
+}
+
+func TestRemoveListenerDrain(t *testing.T) {
+	const delay = 300 * time.Millisecond
+
+	dnsProxy := createTestProxy(t, nil)
+	var received int32
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		atomic.AddInt32(&received, 1)
+		time.Sleep(delay)
+		d.Res = new(dns.Msg).SetReply(d.Req)
+		return nil
+	}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	for _, proto := range []string{ProtoUDP, ProtoTCP} {
+		atomic.StoreInt32(&received, 0)
+		added, err := dnsProxy.AddListener(proto, listenIP+":0")
+		if err != nil {
+			t.Fatalf("cannot add the %s listener: %s", proto, err)
+		}
+
+		conn, err := dns.Dial(proto, added.String())
+		if err != nil {
+			t.Fatalf("cannot connect to the proxy: %s", err)
+		}
+		req := createTestMessage()
+		err = conn.WriteMsg(req)
+		assert.Nil(t, err)
+		assert.True(t, waitFor(delay, func() bool { return atomic.LoadInt32(&received) == 1 }))
+
+		// The query being handled is answered before the listener is
+		// closed
+		start := time.Now()
+		err = dnsProxy.RemoveListener(proto, added.String())
+		assert.Nil(t, err)
+		assert.True(t, time.Since(start) < 2*delay)
+
+		_ = conn.SetReadDeadline(time.Now().Add(delay))
+		res, err := conn.ReadMsg()
+		if assert.Nil(t, err) {
+			assert.Equal(t, req.Id, res.Id)
+		}
+		_ = conn.Close()
+	}
+
+	// Stop closes the other listeners only
+	err = dnsProxy.Stop()
+	assert.Nil(t, err)
+}
@@ -6,10 +6,13 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 )
 
 func TestLookupIPAddr(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	// Create a simple proxy
 	p := Proxy{}
 	upstreams := make([]upstream.Upstream, 0)
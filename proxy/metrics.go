@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// Metrics receives the events of the proxy to count them.  The methods are
+// called concurrently on the hot paths, so they must be fast and must not
+// block.  See the metrics package for an implementation.
+type Metrics interface {
+	// UpstreamExchanged is called after every exchange with an upstream.
+	// timeout is true if err is caused by a timeout.
+	UpstreamExchanged(addr string, rtt time.Duration, err error, timeout bool)
+
+	// CacheLookup is called after every cache lookup
+	CacheLookup(hit bool)
+
+	// ConnectionOpened is called when a client connection of the protocol is
+	// accepted.  The stream protocols only: "tcp", "tls", "https" and "quic".
+	ConnectionOpened(proto string)
+	// ConnectionClosed is called when the connection is closed
+	ConnectionClosed(proto string)
+
+	// QueryStarted is called when the proxy starts handling a query
+	QueryStarted(proto string)
+	// QueryFinished is called when the query is handled
+	QueryFinished(proto string)
+
+	// QueryRateLimited is called when a query is dropped by the rate limiter
+	QueryRateLimited(proto string)
+}
+
+// noopMetrics is the Metrics that ignores all events
+type noopMetrics struct{}
+
+func (noopMetrics) UpstreamExchanged(string, time.Duration, error, bool) {}
+func (noopMetrics) CacheLookup(bool)                                     {}
+func (noopMetrics) ConnectionOpened(string)                              {}
+func (noopMetrics) ConnectionClosed(string)                              {}
+func (noopMetrics) QueryStarted(string)                                  {}
+func (noopMetrics) QueryFinished(string)                                 {}
+func (noopMetrics) QueryRateLimited(string)                              {}
+
+// ConnectionMetrics is the optional interface of Metrics that receives the
+// rejected client connections
+type ConnectionMetrics interface {
+	// ConnectionRejected is called when a client connection is closed
+	// without being handled since there are too many of them, see
+	// Config.MaxTCPConnections
+	ConnectionRejected(proto string)
+}
+
+// connectionRejected reports the rejected connection if Metrics implements
+// ConnectionMetrics
+func (p *Proxy) connectionRejected(proto string) {
+	if m, ok := p.Metrics.(ConnectionMetrics); ok {
+		m.ConnectionRejected(proto)
+	}
+}
+
+// FailoverMetrics is the optional interface of Metrics that receives the
+// failovers caused by Config.FailoverRcodes
+type FailoverMetrics interface {
+	// UpstreamRcodeFailover is called when the response of the upstream is
+	// discarded and the next upstream is tried since its code is one of
+	// Config.FailoverRcodes
+	UpstreamRcodeFailover(addr string, rcode int)
+}
+
+// upstreamRcodeFailover reports the failover if Metrics implements
+// FailoverMetrics
+func (p *Proxy) upstreamRcodeFailover(addr string, rcode int) {
+	if m, ok := p.Metrics.(FailoverMetrics); ok {
+		m.UpstreamRcodeFailover(addr, rcode)
+	}
+}
+
+// DropMetrics is the optional interface of Metrics that receives the queries
+// dropped since the proxy is overloaded
+type DropMetrics interface {
+	// QueryDropped is called when a query is dropped without being handled
+	// since there are too many of them, see Config.MaxGoroutines
+	QueryDropped(proto string)
+}
+
+// queryDropped reports the dropped query if Metrics implements DropMetrics
+func (p *Proxy) queryDropped(proto string) {
+	if m, ok := p.Metrics.(DropMetrics); ok {
+		m.QueryDropped(proto)
+	}
+}
+
+// getMetrics returns the configured Metrics or the no-op one
+func (p *Proxy) getMetrics() Metrics {
+	if p.Metrics != nil {
+		return p.Metrics
+	}
+	return noopMetrics{}
+}
+
+// isTimeout checks if the error or one of the errors it wraps is a timeout
+func isTimeout(err error) bool {
+	for err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return true
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return true
+		}
+
+		switch e := err.(type) {
+		case *errorx.Error:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"os"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// initNSID sets the identifier the proxy puts into the NSID option in
+// NSIDLocal mode, the hostname if Config.NSID isn't set
+func (p *Proxy) initNSID() {
+	if p.NSIDMode != NSIDLocal {
+		return
+	}
+
+	p.nsid = p.NSID
+	if p.nsid == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Error("Failed to get the hostname for NSID: %s", err)
+			return
+		}
+		p.nsid = hostname
+	}
+	log.Printf("NSID is enabled: %s", p.nsid)
+}
+
+// processNSID remembers if the client has asked for the NSID option and
+// removes it from the request unless it's forwarded to the upstreams
+func (p *Proxy) processNSID(d *DNSContext) {
+	if p.NSIDMode == NSIDForward {
+		d.nsidRequested = findNSID(d.Req) != nil
+		return
+	}
+
+	d.nsidRequested = removeNSID(d.Req) != nil
+}
+
+// setNSID makes the NSID option of the response consistent with the request
+// the client has sent: the response only has the option if the request had
+// one, and it's the proxy's identifier in NSIDLocal mode.  d.Res is replaced
+// with its copy if it's changed since it may be shared.
+func (p *Proxy) setNSID(d *DNSContext) {
+	nsid := findNSID(d.Res)
+	switch {
+	case !d.nsidRequested || p.NSIDMode == NSIDOff:
+		if nsid != nil {
+			d.Res = d.Res.Copy()
+			removeNSID(d.Res)
+		}
+	case p.NSIDMode == NSIDLocal:
+		res := d.Res.Copy()
+		removeNSID(res)
+		opt := res.IsEdns0()
+		if opt == nil {
+			reqOpt := d.Req.IsEdns0()
+			res.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+			opt = res.IsEdns0()
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{
+			Code: dns.EDNS0NSID,
+			Nsid: hex.EncodeToString([]byte(p.nsid)),
+		})
+
+		// The identifier is optional, so the response isn't truncated
+		// because of it
+		if res.Len() > proxyutil.DNSSize(d.Proto, d.Req) {
+			log.Tracef("No room for NSID in the response to %s", d.Addr)
+			return
+		}
+		d.Res = res
+	}
+}
+
+// findNSID returns the NSID option of the message, or nil if there is none
+func findNSID(m *dns.Msg) *dns.EDNS0_NSID {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if nsid, ok := o.(*dns.EDNS0_NSID); ok {
+			return nsid
+		}
+	}
+	return nil
+}
+
+// removeNSID removes the NSID option from the message and returns it, or nil
+// if there was none
+func removeNSID(m *dns.Msg) *dns.EDNS0_NSID {
+	nsid := findNSID(m)
+	if nsid != nil {
+		opt := m.IsEdns0()
+		opt.Option = proxyutil.RemoveOption(opt.Option, dns.EDNS0NSID)
+	}
+	return nsid
+}
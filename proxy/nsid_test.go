@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startNSIDProxy starts the proxy with the upstream that answers with its own
+// NSID even if it isn't asked for, the requests with the NSID option are
+// counted in asked
+func startNSIDProxy(t *testing.T, mode NSIDMode, cache bool, asked *int32) *Proxy {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.NSIDMode = mode
+	dnsProxy.NSID = "proxy-1"
+	dnsProxy.CacheEnabled = cache
+	dnsProxy.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{
+		upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+			resp := new(dns.Msg).SetReply(m)
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 192.0.2.1")}
+			if opt := m.IsEdns0(); opt != nil {
+				if findNSID(m) != nil {
+					atomic.AddInt32(asked, 1)
+				}
+				resp.SetEdns0(opt.UDPSize(), false)
+				resOpt := resp.IsEdns0()
+				resOpt.Option = append(resOpt.Option, &dns.EDNS0_NSID{
+					Code: dns.EDNS0NSID,
+					Nsid: hex.EncodeToString([]byte("upstream-1")),
+				})
+			}
+			return resp, nil
+		}),
+	}}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	return dnsProxy
+}
+
+// exchangeNSID sends the request over UDP and returns the raw response and
+// the identifier from its NSID option, if there is one
+func exchangeNSID(t *testing.T, addr net.Addr, edns, nsid bool) ([]byte, *string) {
+	req := new(dns.Msg).SetQuestion("nsid.example.org.", dns.TypeA)
+	if edns {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+	}
+	if nsid {
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	}
+	buf, err := req.Pack()
+	assert.Nil(t, err)
+
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(buf)
+	assert.Nil(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf = make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("cannot read the response: %s", err)
+	}
+	buf = buf[:n]
+
+	res := new(dns.Msg)
+	assert.Nil(t, res.Unpack(buf))
+	assert.Equal(t, req.Id, res.Id)
+	assert.Len(t, res.Answer, 1)
+	if !edns {
+		assert.Nil(t, res.IsEdns0())
+	}
+
+	option := findNSID(res)
+	if option == nil {
+		return buf, nil
+	}
+	id, err := hex.DecodeString(option.Nsid)
+	assert.Nil(t, err)
+	s := string(id)
+	return buf, &s
+}
+
+func TestNSID(t *testing.T) {
+	// Off: the option is never sent to the upstream or to the client
+	var asked int32
+	dnsProxy := startNSIDProxy(t, NSIDOff, false, &asked)
+	addr := dnsProxy.Addr(ProtoUDP)
+	buf, id := exchangeNSID(t, addr, true, true)
+	assert.Nil(t, id)
+	assert.False(t, bytes.Contains(buf, []byte("upstream-1")))
+	_, id = exchangeNSID(t, addr, true, false)
+	assert.Nil(t, id)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&asked))
+	_ = dnsProxy.Stop()
+
+	// Local: the proxy answers with its own identifier if it's asked for
+	dnsProxy = startNSIDProxy(t, NSIDLocal, false, &asked)
+	addr = dnsProxy.Addr(ProtoUDP)
+	buf, id = exchangeNSID(t, addr, true, true)
+	if assert.NotNil(t, id) {
+		assert.Equal(t, "proxy-1", *id)
+	}
+	assert.True(t, bytes.Contains(buf, []byte("proxy-1")))
+
+	buf, id = exchangeNSID(t, addr, true, false)
+	assert.Nil(t, id)
+	assert.False(t, bytes.Contains(buf, []byte("proxy-1")))
+	_, id = exchangeNSID(t, addr, false, false)
+	assert.Nil(t, id)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&asked))
+	_ = dnsProxy.Stop()
+
+	// Forward, the default: the client gets the upstream's identifier if it's
+	// asked for
+	assert.Equal(t, NSIDForward, Config{}.NSIDMode)
+	dnsProxy = startNSIDProxy(t, NSIDForward, false, &asked)
+	addr = dnsProxy.Addr(ProtoUDP)
+	_, id = exchangeNSID(t, addr, true, true)
+	if assert.NotNil(t, id) {
+		assert.Equal(t, "upstream-1", *id)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&asked))
+
+	buf, id = exchangeNSID(t, addr, true, false)
+	assert.Nil(t, id)
+	assert.False(t, bytes.Contains(buf, []byte("upstream-1")))
+	_ = dnsProxy.Stop()
+
+	// The cached responses have no identifier
+	dnsProxy = startNSIDProxy(t, NSIDForward, true, &asked)
+	addr = dnsProxy.Addr(ProtoUDP)
+	_, id = exchangeNSID(t, addr, true, true)
+	assert.NotNil(t, id)
+	_, id = exchangeNSID(t, addr, true, true)
+	assert.Nil(t, id)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&asked))
+	_ = dnsProxy.Stop()
+}
+
+func TestNSIDHostname(t *testing.T) {
+	dnsProxy := &Proxy{Config: Config{NSIDMode: NSIDLocal}}
+	dnsProxy.initNSID()
+	assert.NotEqual(t, "", dnsProxy.nsid)
+
+	dnsProxy = &Proxy{Config: Config{NSIDMode: NSIDLocal, NSID: "proxy-1"}}
+	dnsProxy.initNSID()
+	assert.Equal(t, "proxy-1", dnsProxy.nsid)
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+)
+
+// defaultResponsePadding is the default Config.ResponsePadding, RFC 8467
+// recommends it
+const defaultResponsePadding = 468
+
+// padResponse replaces d.Res with its copy padded to Config.ResponsePadding if
+// the query is sent over an encrypted transport and has the padding option.
+// RFC 7830 only allows padding the responses to the padded queries, and the
+// padding makes no sense without encryption.
+func (p *Proxy) padResponse(d *DNSContext) {
+	blockSize := p.ResponsePadding
+	switch {
+	case blockSize == 0:
+		blockSize = defaultResponsePadding
+	case blockSize < 0:
+		return
+	}
+
+	switch d.Proto {
+	case ProtoTLS, ProtoHTTPS, ProtoQUIC:
+		// Go on
+	default:
+		return
+	}
+
+	if d.Req == nil || !proxyutil.IsPadded(d.Req) {
+		return
+	}
+
+	// The response may be shared, e.g. the one set by BeforeRequestHandler
+	res := d.Res.Copy()
+	proxyutil.PadMsg(res, blockSize)
+	d.Res = res
+}
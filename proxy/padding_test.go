@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponsePadding(t *testing.T) {
+	serverConfig, _ := createServerTLSConfig(t)
+	dnsProxy := createTestProxy(t, serverConfig)
+	dnsProxy.TCPListenAddr = []*net.TCPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
+	dnsProxy.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{
+		upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+			resp := new(dns.Msg).SetReply(m)
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 192.0.2.1")}
+			return resp, nil
+		}),
+	}}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	newReq := func(padded bool) *dns.Msg {
+		req := new(dns.Msg).SetQuestion("padding.example.org.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		if padded {
+			proxyutil.PadMsg(req, 128)
+		}
+		return req
+	}
+
+	// exchange sends the request over the connection and returns the packed
+	// response
+	exchange := func(conn net.Conn, req *dns.Msg) []byte {
+		buf, err := req.Pack()
+		assert.Nil(t, err)
+		err = proxyutil.WritePrefixed(buf, conn)
+		if err != nil {
+			t.Fatalf("cannot write the request: %s", err)
+		}
+		buf, err = proxyutil.ReadPrefixed(conn)
+		if err != nil {
+			t.Fatalf("cannot read the response: %s", err)
+		}
+		return buf
+	}
+
+	// The responses to the padded queries over TLS are padded
+	tlsConn, err := tls.Dial("tcp", dnsProxy.Addr(ProtoTLS).String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+	defer tlsConn.Close()
+	assert.Len(t, exchange(tlsConn, newReq(true)), defaultResponsePadding)
+
+	buf := exchange(tlsConn, newReq(false))
+	assert.True(t, len(buf) < defaultResponsePadding)
+	res := new(dns.Msg)
+	assert.Nil(t, res.Unpack(buf))
+	assert.False(t, proxyutil.IsPadded(res))
+
+	// The same over HTTPS
+	client := &http.Client{
+		Timeout:   defaultTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	buf, err = newReq(true).Pack()
+	assert.Nil(t, err)
+	resp, err := client.Post("https://"+dnsProxy.Addr(ProtoHTTPS).String()+"/dns-query", "application/dns-message", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("cannot send the DoH request: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Len(t, body, defaultResponsePadding)
+
+	// The responses over the unencrypted TCP aren't padded
+	tcpConn, err := net.Dial("tcp", dnsProxy.Addr(ProtoTCP).String())
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+	defer tcpConn.Close()
+	buf = exchange(tcpConn, newReq(true))
+	assert.Nil(t, res.Unpack(buf))
+	assert.False(t, proxyutil.IsPadded(res))
+
+	// The block size is configurable
+	p := &Proxy{}
+	p.ResponsePadding = 128
+	req := newReq(true)
+	d := &DNSContext{Proto: ProtoQUIC, Req: req, Res: new(dns.Msg).SetReply(req)}
+	p.padResponse(d)
+	buf, err = d.Res.Pack()
+	assert.Nil(t, err)
+	assert.Len(t, buf, 128)
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	// defaultProbeDownAfter is the default Config.ProbeDownAfter
+	defaultProbeDownAfter = 3
+	// defaultProbeUpAfter is the default Config.ProbeUpAfter
+	defaultProbeUpAfter = 2
+)
+
+// UpstreamStatus is the state of the upstream probed by the proxy, see
+// Config.ProbeInterval
+type UpstreamStatus struct {
+	Address   string        // upstream address
+	Up        bool          // false if the upstream is excluded
+	RTT       time.Duration // round-trip time of the last successful probe
+	Err       error         // error of the last probe, nil if it has succeeded
+	LastProbe time.Time     // when the upstream was probed last
+	Failures  int           // number of the failed probes in a row
+	Successes int           // number of the successful probes in a row
+}
+
+// upstreamProber probes the default and domain-specific upstreams and keeps
+// track of the ones that are down
+type upstreamProber struct {
+	p         *Proxy
+	downAfter int
+	upAfter   int
+
+	status map[upstream.Upstream]*UpstreamStatus
+	mu     sync.Mutex // protects status
+
+	stop chan struct{} // closed to stop probing
+	done chan struct{} // closed when run exits
+}
+
+// newUpstreamProber probes the upstreams once and starts probing them every
+// Config.ProbeInterval.  The upstreams that fail the first probe are excluded
+// right away.
+func newUpstreamProber(p *Proxy) *upstreamProber {
+	pr := &upstreamProber{
+		p:         p,
+		downAfter: p.ProbeDownAfter,
+		upAfter:   p.ProbeUpAfter,
+		status:    map[upstream.Upstream]*UpstreamStatus{},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if pr.downAfter <= 0 {
+		pr.downAfter = defaultProbeDownAfter
+	}
+	if pr.upAfter <= 0 {
+		pr.upAfter = defaultProbeUpAfter
+	}
+
+	pr.probe(true)
+	go pr.run()
+	return pr
+}
+
+// close stops probing and waits for the probe in progress
+func (pr *upstreamProber) close() {
+	close(pr.stop)
+	<-pr.done
+}
+
+// run probes the upstreams every Config.ProbeInterval until close is called
+func (pr *upstreamProber) run() {
+	defer close(pr.done)
+
+	t := time.NewTicker(pr.p.ProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			pr.probe(false)
+		case <-pr.stop:
+			return
+		}
+	}
+}
+
+// probe sends the probe to all the default and domain-specific upstreams and
+// updates their status.  If first is true, the failed upstreams are excluded
+// at once.
+func (pr *upstreamProber) probe(first bool) {
+	gen := pr.p.acquireUpstreams()
+	all := gen.all()
+	for _, u := range gen.fallbacks {
+		delete(all, u)
+	}
+	gen.release()
+
+	upstreams := make([]upstream.Upstream, 0, len(all))
+	for u := range all {
+		upstreams = append(upstreams, u)
+	}
+
+	// The probes that don't finish until the interval is over fail
+	timeout := pr.p.ProbeInterval
+	if first || timeout > defaultTimeout {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	results := upstream.ProbeUpstreams(ctx, upstreams, pr.p.ProbeRequest)
+	cancel()
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	status := make(map[upstream.Upstream]*UpstreamStatus, len(results))
+	for _, r := range results {
+		s, ok := pr.status[r.Upstream]
+		if !ok {
+			s = &UpstreamStatus{Address: r.Upstream.Address(), Up: true}
+		}
+		pr.update(s, r, first)
+		status[r.Upstream] = s
+	}
+	// The upstreams that are replaced are forgotten
+	pr.status = status
+}
+
+// update applies the result of the probe to the status
+func (pr *upstreamProber) update(s *UpstreamStatus, r upstream.ProbeResult, first bool) {
+	s.LastProbe = time.Now()
+	s.Err = r.Err
+	if r.Err != nil {
+		s.Failures++
+		s.Successes = 0
+		if s.Up && (first || s.Failures >= pr.downAfter) {
+			log.Info("Upstream %s is down: %s", s.Address, r.Err)
+			s.Up = false
+		}
+		return
+	}
+
+	s.RTT = r.RTT
+	s.Successes++
+	s.Failures = 0
+	if !s.Up && s.Successes >= pr.upAfter {
+		log.Info("Upstream %s is up again", s.Address)
+		s.Up = true
+	}
+}
+
+// filter returns the upstreams that aren't down, or all of them if all are
+func (pr *upstreamProber) filter(upstreams []upstream.Upstream) []upstream.Upstream {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	var up []upstream.Upstream
+	for _, u := range upstreams {
+		if s, ok := pr.status[u]; !ok || s.Up {
+			up = append(up, u)
+		}
+	}
+	if len(up) == 0 {
+		return upstreams
+	}
+	return up
+}
+
+// statuses returns the copies of the statuses sorted by the address
+func (pr *upstreamProber) statuses() []UpstreamStatus {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	statuses := make([]UpstreamStatus, 0, len(pr.status))
+	for _, s := range pr.status {
+		statuses = append(statuses, *s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Address < statuses[j].Address })
+	return statuses
+}
+
+// UpstreamStatuses returns the status of the default and domain-specific
+// upstreams sorted by the address, or nil if Config.ProbeInterval isn't set.
+// The statuses aren't updated after Stop.
+func (p *Proxy) UpstreamStatuses() []UpstreamStatus {
+	p.RLock()
+	pr := p.prober
+	p.RUnlock()
+
+	if pr == nil {
+		return nil
+	}
+	return pr.statuses()
+}
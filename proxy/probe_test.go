@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// probeUpstream is a test upstream that can be turned off, it counts the
+// queries other than the probes
+type probeUpstream struct {
+	addr    string
+	dead    int32 // 1 if Exchange fails, accessed atomically
+	queries int32 // number of the queries other than the probes, accessed atomically
+}
+
+func (u *probeUpstream) Address() string { return u.addr }
+
+func (u *probeUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if atomic.LoadInt32(&u.dead) == 1 {
+		return nil, errors.New("dead")
+	}
+	if m.Question[0].Qtype != dns.TypeNS {
+		atomic.AddInt32(&u.queries, 1)
+	}
+	return new(dns.Msg).SetReply(m), nil
+}
+
+// waitStatus waits until the upstream with the address is up or down
+func waitStatus(t *testing.T, p *Proxy, addr string, up bool) UpstreamStatus {
+	for i := 0; i < 100; i++ {
+		for _, s := range p.UpstreamStatuses() {
+			if s.Address == addr && s.Up == up {
+				return s
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s isn't up=%t: %+v", addr, up, p.UpstreamStatuses())
+	return UpstreamStatus{}
+}
+
+func TestUpstreamProbing(t *testing.T) {
+	alive := &probeUpstream{addr: "alive"}
+	dead := &probeUpstream{addr: "dead", dead: 1}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{dead, alive}}
+	dnsProxy.UpstreamMode = UModeParallel
+	dnsProxy.ProbeInterval = 20 * time.Millisecond
+	dnsProxy.ProbeDownAfter = 2
+	dnsProxy.ProbeUpAfter = 2
+	assert.Nil(t, dnsProxy.Start())
+	defer dnsProxy.Stop()
+
+	// The upstream that fails on start is excluded at once
+	statuses := dnsProxy.UpstreamStatuses()
+	if assert.Len(t, statuses, 2) {
+		assert.Equal(t, "alive", statuses[0].Address)
+		assert.True(t, statuses[0].Up)
+		assert.Nil(t, statuses[0].Err)
+		assert.Equal(t, "dead", statuses[1].Address)
+		assert.False(t, statuses[1].Up)
+		assert.NotNil(t, statuses[1].Err)
+	}
+	resolve := func() {
+		d := &DNSContext{Proto: ProtoUDP, Req: createTestMessage(), Addr: &net.UDPAddr{}}
+		assert.Nil(t, dnsProxy.Resolve(d))
+	}
+	resolve()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&alive.queries))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dead.queries))
+
+	// It's used again once it recovers
+	atomic.StoreInt32(&dead.dead, 0)
+	s := waitStatus(t, dnsProxy, "dead", true)
+	assert.True(t, s.Successes >= 2)
+	resolve()
+	// The parallel exchange returns as soon as one of the upstreams answers
+	for i := 0; i < 100 && atomic.LoadInt32(&dead.queries) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dead.queries))
+
+	// All the upstreams are used if all are down
+	atomic.StoreInt32(&alive.dead, 1)
+	atomic.StoreInt32(&dead.dead, 1)
+	s = waitStatus(t, dnsProxy, "alive", false)
+	assert.True(t, s.Failures >= 2)
+	waitStatus(t, dnsProxy, "dead", false)
+	assert.Len(t, dnsProxy.prober.filter([]upstream.Upstream{dead, alive}), 2)
+}
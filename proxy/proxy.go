@@ -4,20 +4,20 @@ package proxy
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/fastip"
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/joomcode/errorx"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/miekg/dns"
-	gocache "github.com/patrickmn/go-cache"
 	"golang.org/x/net/http2"
 )
 
@@ -53,21 +53,29 @@ type Proxy struct {
 	// Listeners
 	// --
 
-	udpListen         []*net.UDPConn   // UDP listen connections
-	tcpListen         []net.Listener   // TCP listeners
-	tlsListen         []net.Listener   // TLS listeners
-	quicListen        []quic.Listener  // QUIC listeners
-	httpsListen       []net.Listener   // HTTPS listeners
-	httpsServer       []*http.Server   // HTTPS server instance
-	dnsCryptUDPListen []*net.UDPConn   // UDP listen connections for DNSCrypt
-	dnsCryptTCPListen []net.Listener   // TCP listeners for DNSCrypt
-	dnsCryptServer    *dnscrypt.Server // DNSCrypt server instance
+	udpListen         []*net.UDPConn  // UDP listen connections
+	tcpListen         []net.Listener  // TCP listeners
+	tlsListen         []net.Listener  // TLS listeners
+	quicListen        []quic.Listener // QUIC listeners
+	httpsListen       []net.Listener  // HTTPS listeners
+	httpsServer       []*http.Server  // HTTPS server instance
+	dnsCryptUDPListen []*net.UDPConn  // UDP listen connections for DNSCrypt
+	dnsCryptTCPListen []net.Listener  // TCP listeners for DNSCrypt
+	dnsCryptServer    *dnsCryptServer // DNSCrypt server instance
+
+	trackers map[io.Closer]*listenerTracker // the requests being handled by the UDP, TCP and TLS listeners
 
 	// Upstream
 	// --
 
-	upstreamRttStats map[string]int // Map of upstream addresses and their rtt. Used to sort upstreams "from fast to slow"
-	rttLock          sync.Mutex     // Synchronizes access to the upstreamRttStats map
+	upstreams     *upstreamsGen // current upstream configuration, replaced by UpdateUpstreamConfig
+	upstreamsLock sync.RWMutex  // protects upstreams, UpstreamConfig and Fallbacks after Init
+
+	prober *upstreamProber // probes the upstreams (nil if Config.ProbeInterval isn't set)
+
+	selector      UpstreamSelector  // default selector for the UpstreamMode, used if UpstreamSelector isn't set
+	selections    map[string]uint64 // number of responses used from every upstream by address
+	selectionLock sync.Mutex        // protects selector and selections
 
 	// DNS64 (in case dnsproxy works in a NAT64/DNS64 network)
 	// --
@@ -78,8 +86,36 @@ type Proxy struct {
 	// Ratelimit
 	// --
 
-	ratelimitBuckets *gocache.Cache // where the ratelimiters are stored, per IP
-	ratelimitLock    sync.Mutex     // Synchronizes access to ratelimitBuckets
+	ratelimit     atomic.Value // *ratelimiter, request counters (unset until the first request if Init wasn't called)
+	ratelimitLock sync.Mutex   // Synchronizes the lazy initialization of ratelimit
+
+	// Access
+	// --
+
+	access         *accessList        // clients access list (nil if all clients are allowed)
+	trustedProxies ipRanges           // the DoH client addresses are taken from the headers of their requests
+	qtypes         *qtypeRestrictions // restricted query types (nil if nothing is restricted)
+
+	filterAAAAExempt map[string]bool // domains FilterAAAA doesn't apply to
+
+	// Hosts
+	// --
+
+	hosts     *proxyutil.HostsTable // static records (nil if there are none)
+	hostsLock sync.RWMutex          // protects hosts
+
+	specialZones map[string]bool // special-use zones answered locally
+
+	// Blocking
+	// --
+
+	blocked   *blockList   // block rules (nil if none were added)
+	blockLock sync.RWMutex // protects blocked
+
+	// NSID
+	// --
+
+	nsid string // server identifier for the NSID option in NSIDLocal mode
 
 	// DNS cache
 	// --
@@ -95,7 +131,7 @@ type Proxy struct {
 	// Other
 	// --
 
-	bytesPool    *sync.Pool // bytes pool to avoid unnecessary allocations when reading DNS packets
+	bytesPool    *sync.Pool // pool of *[]byte to avoid unnecessary allocations when reading and packing DNS packets
 	udpOOBSize   int        // size for received OOB data
 	sync.RWMutex            // protects parallel access to proxy structures
 
@@ -109,6 +145,11 @@ type Proxy struct {
 	// See also: https://github.com/AdguardTeam/AdGuardHome/issues/2242.
 	requestGoroutinesSema semaphore
 
+	requests sync.WaitGroup // the DNS requests being processed, counted once they're read
+	stopping int32          // 1 once Stop has stopped accepting the requests, accessed atomically
+
+	queryLog *queryLog // passes the entries to QueryLogHandler (nil if it's not set)
+
 	Config // proxy configuration
 }
 
@@ -118,16 +159,67 @@ func (p *Proxy) Init() (err error) {
 		log.Printf("DNS cache is enabled")
 
 		p.cache = &cache{
-			cacheSize: p.CacheSizeBytes,
+			cacheSize:    p.CacheSizeBytes,
+			staleIfError: p.CacheStaleIfError,
 		}
 
-		if p.Config.EnableEDNSClientSubnet {
+		if p.ecsMode() != ECSStrip {
 			p.cacheSubnet = &cacheSubnet{
-				cacheSize: p.CacheSizeBytes,
+				cacheSize:    p.CacheSizeBytes,
+				staleIfError: p.CacheStaleIfError,
 			}
 		}
 	}
 
+	r, err := newRatelimiter(&p.Config)
+	if err != nil {
+		return fmt.Errorf("invalid ratelimit whitelist: %w", err)
+	}
+	p.ratelimit.Store(r)
+
+	p.access, err = newAccessList(p.AllowedClients, p.DisallowedClients)
+	if err != nil {
+		return err
+	}
+
+	p.trustedProxies, err = newIPRanges(p.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+
+	p.qtypes, err = newQtypeRestrictions(&p.Config)
+	if err != nil {
+		return err
+	}
+
+	p.filterAAAAExempt = newDomainSet(p.FilterAAAAExempt)
+
+	p.specialZones, err = newSpecialZones(p.ForwardSpecialZones)
+	if err != nil {
+		return err
+	}
+
+	p.upstreamsLock.Lock()
+	p.upstreams = p.newUpstreamsGen(p.UpstreamConfig, p.Fallbacks)
+	p.upstreamsLock.Unlock()
+
+	if p.DNS64Prefix != "" {
+		p.nat64Prefix, err = parseDNS64Prefix(p.DNS64Prefix)
+		if err != nil {
+			return err
+		}
+		log.Printf("DNS64 is enabled, NAT64 prefix: %s", p.DNS64Prefix)
+	}
+
+	p.initNSID()
+
+	if len(p.HostsFiles) > 0 {
+		err = p.LoadHostsFiles(p.HostsFiles...)
+		if err != nil {
+			return fmt.Errorf("cannot load hosts: %w", err)
+		}
+	}
+
 	if p.TLSConfig != nil && len(p.TLSConfig.NextProtos) == 0 {
 		p.TLSConfig.NextProtos = []string{
 			"http/1.1",
@@ -150,14 +242,13 @@ func (p *Proxy) Init() (err error) {
 
 	if p.DNSCryptResolverCert != nil && p.DNSCryptProviderName != "" {
 		log.Info("Initializing DNSCrypt: %s", p.DNSCryptProviderName)
-		p.dnsCryptServer = &dnscrypt.Server{
-			ProviderName: p.DNSCryptProviderName,
-			ResolverCert: p.DNSCryptResolverCert,
-			Handler: &dnsCryptHandler{
-				proxy: p,
+		p.dnsCryptServer, err = newDNSCryptServer(p.DNSCryptProviderName, p.DNSCryptResolverCert, &dnsCryptHandler{
+			proxy: p,
 
-				requestGoroutinesSema: p.requestGoroutinesSema,
-			},
+			requestGoroutinesSema: p.requestGoroutinesSema,
+		}, &p.requests)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -165,13 +256,17 @@ func (p *Proxy) Init() (err error) {
 	p.bytesPool = &sync.Pool{
 		New: func() interface{} {
 			// 2 bytes may be used to store packet length (see TCP/TLS)
-			return make([]byte, 2+dns.MaxMsgSize)
+			b := make([]byte, 2+dns.MaxMsgSize)
+			return &b
 		},
 	}
 
 	if p.UpstreamMode == UModeFastestAddr {
 		log.Printf("Fastest IP is enabled")
 		p.fastestAddr = fastip.NewFastestAddr()
+		if p.FastestPingTimeout > 0 {
+			p.fastestAddr.PingWaitTimeout = p.FastestPingTimeout
+		}
 	}
 
 	return nil
@@ -193,19 +288,45 @@ func (p *Proxy) Start() (err error) {
 		return err
 	}
 
+	if p.CacheFile != "" && p.cache != nil {
+		p.loadCacheFile()
+	}
+
+	// The dead upstreams are excluded before the first query
+	p.prober = nil
+	if p.ProbeInterval > 0 {
+		p.prober = newUpstreamProber(p)
+	}
+
 	err = p.startListeners()
 	if err != nil {
+		if p.prober != nil {
+			p.prober.close()
+		}
 		return err
 	}
 
+	if p.QueryLogHandler != nil {
+		p.queryLog = newQueryLog(p.QueryLogHandler, p.QueryLogBufferSize)
+	}
+
+	atomic.StoreInt32(&p.stopping, 0)
 	p.started = true
 	return nil
 }
 
-// Stop stops the proxy server including all its listeners
+// Stop stops the proxy server including all its listeners.  If
+// GracefulShutdownTimeout is set, it waits for the requests being processed
+// first.  The query log entries are passed to QueryLogHandler before it
+// returns, unless the handler takes longer than 5 seconds.
 func (p *Proxy) Stop() error {
 	log.Info("Stopping the DNS proxy server")
 
+	if p.GracefulShutdownTimeout > 0 {
+		p.stopAccepting()
+		p.waitRequests(p.GracefulShutdownTimeout)
+	}
+
 	p.Lock()
 	defer p.Unlock()
 	if !p.started {
@@ -271,6 +392,22 @@ func (p *Proxy) Stop() error {
 		}
 	}
 	p.dnsCryptTCPListen = nil
+	p.trackers = nil
+
+	if p.CacheFile != "" && p.cache != nil {
+		err := p.saveCacheFile()
+		if err != nil {
+			errs = append(errs, errorx.Decorate(err, "couldn't save cache"))
+		}
+	}
+
+	if p.queryLog != nil {
+		p.queryLog.close()
+	}
+
+	if p.prober != nil {
+		p.prober.close()
+	}
 
 	p.started = false
 	log.Println("Stopped the DNS proxy server")
@@ -280,6 +417,63 @@ func (p *Proxy) Stop() error {
 	return nil
 }
 
+// stopAccepting makes all the listeners stop accepting new requests and the
+// TCP, TLS and HTTPS connections stop reading them.  The sockets are left open
+// so that the requests being processed can still be answered.
+func (p *Proxy) stopAccepting() {
+	p.RLock()
+	defer p.RUnlock()
+
+	// The QUIC listeners have no deadlines, their loops check the flag
+	atomic.StoreInt32(&p.stopping, 1)
+
+	now := time.Now()
+	for _, l := range p.udpListen {
+		_ = l.SetReadDeadline(now)
+	}
+	for _, l := range p.dnsCryptUDPListen {
+		_ = l.SetReadDeadline(now)
+	}
+	for _, listeners := range [][]net.Listener{p.tcpListen, p.tlsListen, p.httpsListen, p.dnsCryptTCPListen} {
+		for _, l := range listeners {
+			if dl, ok := l.(interface{ SetDeadline(t time.Time) error }); ok {
+				_ = dl.SetDeadline(now)
+			}
+		}
+	}
+
+	for _, t := range p.trackers {
+		t.eachConn(func(conn net.Conn) { _ = conn.SetReadDeadline(now) })
+	}
+	for _, srv := range p.httpsServer {
+		srv.SetKeepAlivesEnabled(false)
+	}
+}
+
+// isStopping returns true if Stop has stopped accepting the requests
+func (p *Proxy) isStopping() bool {
+	return atomic.LoadInt32(&p.stopping) == 1
+}
+
+// waitRequests waits until all the requests being processed are finished, but
+// not longer than timeout
+func (p *Proxy) waitRequests(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		p.requests.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Info("Timed out waiting for the DNS requests to finish")
+	}
+}
+
 // Addrs returns all listen addresses for the specified proto or nil if the proxy does not listen to it.
 // proto must be "tcp", "tls", "https", "quic", or "udp"
 func (p *Proxy) Addrs(proto string) []net.Addr {
@@ -306,7 +500,12 @@ func (p *Proxy) Addrs(proto string) []net.Addr {
 
 	case ProtoUDP:
 		for _, l := range p.udpListen {
-			addrs = append(addrs, l.LocalAddr())
+			// The sockets bound with SO_REUSEPORT go one after another
+			addr := l.LocalAddr()
+			if n := len(addrs); n > 0 && addrs[n-1].String() == addr.String() {
+				continue
+			}
+			addrs = append(addrs, addr)
 		}
 
 	case ProtoQUIC:
@@ -378,50 +577,92 @@ func (p *Proxy) Addr(proto string) net.Addr {
 
 // Resolve is the default resolving method used by the DNS proxy to query upstreams
 func (p *Proxy) Resolve(d *DNSContext) error {
-	if p.Config.EnableEDNSClientSubnet {
-		p.processECS(d)
-	}
+	p.processECS(d)
 
+	if p.replyBlocked(d) || p.replyFilteredAAAA(d) {
+		return nil
+	}
+	if p.replyFromHosts(d) {
+		p.flattenCNAME(d)
+		p.orderAnswers(d)
+		return nil
+	}
+	if p.replyFromSpecialZone(d) {
+		return nil
+	}
 	if p.replyFromCache(d) {
+		p.restoreECS(d)
+		p.flattenCNAME(d)
+		p.orderAnswers(d)
 		return nil
 	}
 
+	// The upstreams replaced meanwhile are not closed until it's released
+	gen := p.acquireUpstreams()
+	defer gen.release()
+
 	host := d.Req.Question[0].Name
 	var upstreams []upstream.Upstream
 
-	// Get custom upstreams first -- note that they might be empty
-	if d.CustomUpstreamConfig != nil {
-		upstreams = d.CustomUpstreamConfig.getUpstreamsForDomain(host)
-	}
-
-	// If nothing found in the custom upstreams, start using the default ones
-	if upstreams == nil {
-		upstreams = p.UpstreamConfig.getUpstreamsForDomain(host)
+	// The locally-served addresses are never sent to the other upstreams
+	private := p.isPrivateRDNSRequest(d.Req)
+	if private {
+		upstreams = p.privateRDNSUpstreams(host)
+		if len(upstreams) == 0 {
+			log.Tracef("No private resolvers for %s, answering with NXDOMAIN", host)
+			d.Res = p.genNXDomain(d.Req)
+			return nil
+		}
+	} else {
+		upstreams = p.selectUpstreams(d, host, gen)
 	}
 
 	// execute the DNS request
 	startTime := time.Now()
-	reply, u, err := p.exchange(d.Req, upstreams)
+	var reply *dns.Msg
+	var u upstream.Upstream
+	var info *upstream.ExchangeInfo
+	var err error
+	if ptrReq := p.dns64PTRRequest(d.Req); ptrReq != nil {
+		reply, u, err = p.exchangeDNS64PTR(d.Req, ptrReq, upstreams)
+	} else {
+		reply, u, info, err = p.exchangeWithInfo(d.Req, upstreams)
+	}
 	if p.isEmptyAAAAResponse(reply, d.Req) {
 		log.Tracef("Received empty AAAA response, checking DNS64")
-		reply, u, err = p.checkDNS64(d.Req, reply, upstreams)
-	} else if p.isBogusNXDomain(reply) {
-		log.Tracef("Received IP from the bogus-nxdomain list, replacing response")
-		reply = p.genNXDomain(reply)
+		dns64Reply, dns64U, dns64Err := p.checkDNS64(d.Req, reply, upstreams)
+		// Keep the empty response if there is nothing to synthesize from
+		if dns64Err == nil || reply == nil {
+			reply, u, info, err = dns64Reply, dns64U, nil, dns64Err
+		}
+	} else {
+		reply = p.filterBogusNXDomain(reply)
 	}
 
 	rtt := int(time.Since(startTime) / time.Millisecond)
 	log.Tracef("RTT: %d ms", rtt)
 
-	if err != nil && p.Fallbacks != nil {
-		log.Tracef("Using the fallback upstream due to %s", err)
-		reply, u, err = upstream.ExchangeParallel(p.Fallbacks, d.Req)
+	if err != nil && gen.fallbacks != nil && !private {
+		reply, u, info, err = p.exchangeFallbacks(d.Req, gen, err)
+	}
+
+	// The expired response is better than none, it's not cached again
+	stale := false
+	if reply == nil || reply.Rcode == dns.RcodeServerFailure {
+		var staleReply *dns.Msg
+		if staleReply, stale = p.staleFromCache(d); stale {
+			log.Debug("Serving stale response for %s due to %v", host, err)
+			reply, u, info, err = staleReply, nil, nil, nil
+			d.cached = true
+		}
 	}
 
 	// set Upstream that resolved DNS request to DNSContext
-	if reply != nil {
+	if reply != nil && !stale {
 		d.Upstream = u
+		d.UpstreamInfo = info
 
+		reply = p.chaseCNAME(d, reply, gen)
 		p.setMinMaxTTL(reply)
 
 		// Saving cached response
@@ -433,24 +674,78 @@ func (p *Proxy) Resolve(d *DNSContext) error {
 	} else {
 		d.Res = reply
 	}
+	p.restoreECS(d)
+	p.flattenCNAME(d)
+	p.orderAnswers(d)
 
 	// truncate and compress the response
 	d.scrub()
 
-	if p.ResponseHandler != nil {
-		p.ResponseHandler(d, err)
-	}
+	p.callResponseHandler(d, err)
 
 	return err
 }
 
+// selectUpstreams returns the upstreams for the host: the custom ones of the
+// request if it has them, or the ones of gen otherwise, except the ones the
+// prober has found to be down
+func (p *Proxy) selectUpstreams(d *DNSContext, host string, gen *upstreamsGen) []upstream.Upstream {
+	// Get custom upstreams first -- note that they might be empty
+	var upstreams []upstream.Upstream
+	if d.CustomUpstreamConfig != nil {
+		upstreams = d.CustomUpstreamConfig.getUpstreamsForDomain(host)
+	}
+
+	// If nothing found in the custom upstreams, start using the default ones
+	if upstreams == nil {
+		upstreams = gen.config.getUpstreamsForDomain(host)
+	}
+
+	if p.prober != nil {
+		upstreams = p.prober.filter(upstreams)
+	}
+	return upstreams
+}
+
+// exchangeFallbacks sends the request to the fallbacks of gen since the
+// upstreams have failed with err
+func (p *Proxy) exchangeFallbacks(req *dns.Msg, gen *upstreamsGen, err error) (*dns.Msg, upstream.Upstream, *upstream.ExchangeInfo, error) {
+	log.Tracef("Using the fallback upstream due to %s", err)
+	reply, u, info, err := upstream.ExchangeParallelWithInfo(gen.wrap(p, gen.fallbacks), req)
+	return reply, unwrapUpstream(u), info, err
+}
+
+// ecsMode returns the ECS mode taking EnableEDNSClientSubnet into account
+func (p *Proxy) ecsMode() ECSMode {
+	if p.Config.EnableEDNSClientSubnet {
+		return ECSGenerate
+	}
+	return p.Config.ECSMode
+}
+
 // Set EDNS Client-Subnet data in DNS request
 func (p *Proxy) processECS(d *DNSContext) {
 	d.ecsReqIP = nil
 	d.ecsReqMask = uint8(0)
-
-	ip, mask, _ := parseECS(d.Req)
-	if mask == 0 {
+	d.ecsClient = nil
+	d.ecsNoOPT = d.Req.IsEdns0() == nil
+
+	mode := p.ecsMode()
+	d.ecsClient = removeECS(d.Req)
+
+	var ip net.IP
+	var mask uint8
+	switch {
+	case d.ecsClient != nil && mode == ECSStrip:
+		log.Debug("Removing ECS data: %s/%d", d.ecsClient.Address, d.ecsClient.SourceNetmask)
+	case d.ecsClient != nil:
+		// SOURCE PREFIX-LENGTH 0 means the client doesn't want its subnet
+		// to be revealed, so it's passed through as well
+		opt := d.Req.IsEdns0()
+		opt.Option = append(opt.Option, d.ecsClient)
+		ip, mask, _ = parseECS(d.Req)
+		log.Debug("Passing through ECS data: %s/%d", ip, mask)
+	case mode == ECSGenerate:
 		// Set EDNS Client-Subnet data
 		var clientIP net.IP
 		if p.Config.EDNSAddr != nil {
@@ -468,10 +763,39 @@ func (p *Proxy) processECS(d *DNSContext) {
 			ip, mask = setECS(d.Req, clientIP, 0)
 			log.Debug("Set ECS data: %s/%d", ip, mask)
 		}
-	} else {
-		log.Debug("Passing through ECS data: %s/%d", ip, mask)
 	}
 
 	d.ecsReqIP = ip
 	d.ecsReqMask = mask
 }
+
+// restoreECS makes the ECS option of the response consistent with the request
+// the client has sent: the response only has the ECS option if the request had
+// one, and the OPT record is removed from both the request and the response
+// if it was added by processECS
+func (p *Proxy) restoreECS(d *DNSContext) {
+	if d.ecsNoOPT {
+		proxyutil.RemoveOPT(d.Req)
+		if d.Res != nil {
+			proxyutil.RemoveOPT(d.Res)
+		}
+		return
+	}
+
+	if d.Res == nil || d.Res.IsEdns0() == nil {
+		return
+	}
+
+	switch {
+	case d.ecsClient == nil:
+		removeECS(d.Res)
+	case p.ecsMode() == ECSStrip:
+		// The subnet wasn't sent anywhere, so the response is valid for
+		// all clients (RFC 7871, section 7.2.1)
+		removeECS(d.Res)
+		e := *d.ecsClient
+		e.SourceScope = 0
+		opt := d.Res.IsEdns0()
+		opt.Option = append(opt.Option, &e)
+	}
+}
@@ -1,21 +1,203 @@
 package proxy
 
 import (
+	"errors"
+	"sync/atomic"
+	"time"
+
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
 
+// CacheStats contains the cache counters
+type CacheStats struct {
+	Hits      uint64 // requests answered from cache
+	Misses    uint64 // requests not found in cache
+	Evictions uint64 // responses removed from cache to free space for the new ones
+}
+
+// CacheStats returns the counters of the general and subnet caches together
+func (p *Proxy) CacheStats() CacheStats {
+	s := CacheStats{}
+	for _, c := range p.caches() {
+		s.Hits += atomic.LoadUint64(&c.hits)
+		s.Misses += atomic.LoadUint64(&c.misses)
+		s.Evictions += atomic.LoadUint64(&c.evictions)
+	}
+	return s
+}
+
+// CacheEntry describes a response stored in the cache
+type CacheEntry struct {
+	Name  string // lowercase question name
+	Qtype uint16 // question type
+	TTL   uint32 // remaining TTL in seconds, the lowest TTL of the response if it's pinned
+	Size  int    // size of the packed response in bytes
+
+	// Pinned is true if the response is pinned with CachePin
+	Pinned bool
+
+	// The fields below are only set by CacheGet
+
+	Msg      *dns.Msg  // a copy of the stored response with the original TTLs
+	Inserted time.Time // when the response was cached
+	Expires  time.Time // when the response expires, zero if it's pinned
+}
+
+// caches returns the general and subnet caches that are enabled
+func (p *Proxy) caches() []*cache {
+	var caches []*cache
+	if p.cache != nil {
+		caches = append(caches, p.cache)
+	}
+	if p.cacheSubnet != nil {
+		caches = append(caches, (*cache)(p.cacheSubnet))
+	}
+	return caches
+}
+
+// ClearCache removes all responses from the general and subnet caches
+func (p *Proxy) ClearCache() {
+	for _, c := range p.caches() {
+		c.clear()
+	}
+	log.Debug("Cache is cleared")
+}
+
+// PurgeCache removes the responses for the domain and its subdomains from the
+// general and subnet caches.  The domain is case-insensitive, "." purges
+// everything.  It returns the number of the removed responses.
+func (p *Proxy) PurgeCache(domain string) int {
+	n := 0
+	for _, c := range p.caches() {
+		n += c.purge(domain, true)
+	}
+	log.Debug("Purged %d responses for %s from cache", n, domain)
+	return n
+}
+
+// PurgeCacheName removes the responses of all types for exactly the name from
+// the general and subnet caches, unlike PurgeCache the subdomains are kept.
+// The name is case-insensitive.  It returns the number of the removed
+// responses.
+func (p *Proxy) PurgeCacheName(name string) int {
+	n := 0
+	for _, c := range p.caches() {
+		n += c.purge(name, false)
+	}
+	log.Debug("Purged %d responses for exactly %s from cache", n, name)
+	return n
+}
+
+// CacheEntries returns the responses stored in the general and subnet caches
+// that haven't expired yet.  The subnet cache may have several entries for the
+// same question.
+func (p *Proxy) CacheEntries() []CacheEntry {
+	var entries []CacheEntry
+	for _, c := range p.caches() {
+		entries = append(entries, c.entries()...)
+	}
+	return entries
+}
+
+// CacheGet returns the response for the question stored in the general cache
+// along with the times it was cached and expires.  The response cached for the
+// queries without the DO bit is preferred.  The returned entry is a copy, the
+// caller may modify it.
+func (p *Proxy) CacheGet(name string, qtype uint16) (*CacheEntry, bool) {
+	if p.cache == nil {
+		return nil, false
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	if e, ok := p.cache.entry(key(req)); ok {
+		return e, true
+	}
+
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	return p.cache.entry(key(req))
+}
+
+// CacheSet stores the response in the general cache, e.g. to pre-seed the
+// records.  It's served until its lowest TTL expires and replaces the one
+// stored for the same question.  The TTL overrides don't apply to it.  Use
+// CachePin for the responses that must not expire.
+func (p *Proxy) CacheSet(m *dns.Msg) error {
+	if p.cache == nil {
+		return errors.New("cache is disabled")
+	}
+
+	if m == nil || !isCacheable(m) {
+		return errors.New("response can't be cached")
+	}
+
+	if !p.cache.setItem(key(m), m) {
+		return errors.New("response is too large for the cache")
+	}
+
+	log.Debug("Response for %s is set in cache", m.Question[0].Name)
+	return nil
+}
+
+// CachePin stores the response in the general cache so that it never expires
+// and isn't evicted to free space.  It's served with its lowest TTL to all the
+// clients, including the ones with ECS, until it's removed with CacheUnpin,
+// PurgeCache or ClearCache, and takes precedence over the response cached for
+// the same question.  The pinned responses aren't saved by SaveCache.
+func (p *Proxy) CachePin(m *dns.Msg) error {
+	if p.cache == nil {
+		return errors.New("cache is disabled")
+	}
+
+	if m == nil || !isCacheable(m) {
+		return errors.New("response can't be cached")
+	}
+
+	p.cache.pin(m)
+	log.Debug("Response for %s is pinned in cache", m.Question[0].Name)
+	return nil
+}
+
+// CacheUnpin removes the response pinned with CachePin for the question, the
+// name is case-insensitive.  It returns false if there is none.
+func (p *Proxy) CacheUnpin(name string, qtype uint16) bool {
+	if p.cache == nil {
+		return false
+	}
+	return p.cache.unpin(name, qtype)
+}
+
+// cacheBypassed returns true if the cache must not be used for the query:
+// the cache is disabled, the query is with custom upstreams or with
+// DNSContext.NoCache set, or the client asked for a fresh response with the CD
+// bit and Config.CacheBypassCD is set
+func (p *Proxy) cacheBypassed(d *DNSContext) bool {
+	return p.cache == nil ||
+		d.CustomUpstreamConfig != nil ||
+		d.NoCache ||
+		(p.CacheBypassCD && d.Req.CheckingDisabled)
+}
+
 // Get response from general or subnet cache
 // Return TRUE if response is found in cache
-func (p *Proxy) replyFromCache(d *DNSContext) bool {
-	if p.cache == nil || d.CustomUpstreamConfig != nil {
-		// Do not use cache if:
-		// it is disabled
-		// the query is with custom upstreams
+func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
+	if p.cacheBypassed(d) {
 		return false
 	}
+	defer func() {
+		d.cached = hit
+		p.getMetrics().CacheLookup(hit)
+	}()
 
-	if !p.Config.EnableEDNSClientSubnet {
+	if val, ok := p.cache.getPinned(d.Req); ok {
+		p.cache.countLookup(true)
+		d.Res = val
+		log.Debug("Serving pinned response")
+		return true
+	}
+
+	if p.cacheSubnet == nil {
 		val, ok := p.cache.Get(d.Req)
 		if ok && val != nil {
 			d.Res = val
@@ -44,16 +226,26 @@ func (p *Proxy) replyFromCache(d *DNSContext) bool {
 	return false
 }
 
+// staleFromCache returns the expired response from the general or subnet
+// cache, see Config.CacheStaleIfError
+func (p *Proxy) staleFromCache(d *DNSContext) (*dns.Msg, bool) {
+	if p.CacheStaleIfError == 0 || p.cacheBypassed(d) {
+		return nil, false
+	}
+
+	if d.ecsReqMask != 0 && p.cacheSubnet != nil {
+		return p.cacheSubnet.getStaleWithSubnet(d.Req, d.ecsReqIP, d.ecsReqMask)
+	}
+	return p.cache.getStale(d.Req)
+}
+
 // Store response in general or subnet cache
 func (p *Proxy) setInCache(d *DNSContext, resp *dns.Msg) {
-	if p.cache == nil || d.CustomUpstreamConfig != nil {
-		// Do not use cache if:
-		// it is disabled
-		// the query is with custom upstreams
+	if p.cacheBypassed(d) {
 		return
 	}
 
-	if !p.Config.EnableEDNSClientSubnet {
+	if p.cacheSubnet == nil {
 		p.cache.Set(resp)
 		return
 	}
@@ -11,9 +11,11 @@ import (
 	"math/big"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/miekg/dns"
@@ -22,11 +24,44 @@ import (
 
 const (
 	listenIP          = "127.0.0.1"
-	upstreamAddr      = "8.8.8.8:53"
 	tlsServerName     = "testdns.adguard.com"
 	testMessagesCount = 10
 )
 
+var (
+	testUpstreamOnce sync.Once
+	testUpstreamAddr string // address of the local upstream server
+	testUpstreamErr  error
+)
+
+// localUpstreamAddr returns the address of the local DNS server that answers
+// the A queries with 8.8.8.8 and the other ones with the empty responses, the
+// server is started once for all the tests
+func localUpstreamAddr(t *testing.T) string {
+	testUpstreamOnce.Do(func() {
+		var srv *dnsproxytest.Server
+		srv, testUpstreamErr = dnsproxytest.NewPlainServer(func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg).SetReply(req)
+			resp.RecursionAvailable = true
+			q := req.Question[0]
+			if q.Qtype == dns.TypeA {
+				resp.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(8, 8, 8, 8),
+				}}
+			}
+			return resp
+		})
+		if testUpstreamErr == nil {
+			testUpstreamAddr = srv.Addr
+		}
+	})
+	if testUpstreamErr != nil {
+		t.Fatalf("cannot start the upstream server: %s", testUpstreamErr)
+	}
+	return testUpstreamAddr
+}
+
 // TestProxyRace sends multiple parallel DNS requests to the
 // fully configured dnsproxy to check for race conditions
 func TestProxyRace(t *testing.T) {
@@ -59,7 +94,7 @@ func TestProxyRace(t *testing.T) {
 }
 
 func TestUpstreamsSort(t *testing.T) {
-	testProxy := createTestProxy(t, nil)
+	selector := NewRTTSelector().(*rttSelector)
 	upstreams := []upstream.Upstream{}
 
 	// there are 4 upstreams in configuration
@@ -77,9 +112,9 @@ func TestUpstreamsSort(t *testing.T) {
 	upstreamRttStats["1.1.1.1:53"] = 10
 	upstreamRttStats["2.3.4.5:53"] = 20
 	upstreamRttStats["1.2.3.4:53"] = 30
-	testProxy.upstreamRttStats = upstreamRttStats
+	selector.rtt = upstreamRttStats
 
-	sortedUpstreams := testProxy.getSortedUpstreams(upstreams)
+	sortedUpstreams := selector.sorted(upstreams)
 
 	// upstream without rtt stats means `zero rtt`; this upstream should be the first one after sorting
 	if sortedUpstreams[0].Address() != "8.8.8.8:53" {
@@ -101,6 +136,8 @@ func TestUpstreamsSort(t *testing.T) {
 }
 
 func TestExchangeWithReservedDomains(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	dnsProxy := createTestProxy(t, nil)
 
 	// upstreams specification. Domains adguard.com and google.ru reserved with fake upstreams, maps.google.ru excluded from dnsmasq.
@@ -190,6 +227,8 @@ func TestExchangeWithReservedDomains(t *testing.T) {
 // TestOneByOneUpstreamsExchange tries to resolve DNS request
 // with one valid and two invalid upstreams
 func TestOneByOneUpstreamsExchange(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	timeOut := 1 * time.Second
 	dnsProxy := createTestProxy(t, nil)
 
@@ -258,6 +297,8 @@ func TestOneByOneUpstreamsExchange(t *testing.T) {
 }
 
 func TestFallback(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	timeout := 1 * time.Second
 	// Prepare the proxy server
 	dnsProxy := createTestProxy(t, nil)
@@ -317,6 +358,8 @@ func TestFallback(t *testing.T) {
 }
 
 func TestFallbackFromInvalidBootstrap(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	timeout := 1 * time.Second
 	// Prepare the proxy server
 	dnsProxy := createTestProxy(t, nil)
@@ -411,6 +454,68 @@ func TestRefuseAny(t *testing.T) {
 	}
 }
 
+func TestQtypeRestrictions(t *testing.T) {
+	newProxy := func(exempt []string) *Proxy {
+		dnsProxy := createTestProxy(t, nil)
+		dnsProxy.AnyPolicy = AnyMinimal
+		dnsProxy.BlockedQtypes = []uint16{dns.TypeAXFR, dns.TypeNULL}
+		dnsProxy.RestrictedTTL = 600
+		dnsProxy.QtypeExemptClients = exempt
+		dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+			return new(dns.Msg).SetReply(m), nil
+		})}
+
+		err := dnsProxy.Start()
+		if err != nil {
+			t.Fatalf("cannot start the DNS proxy: %s", err)
+		}
+		return dnsProxy
+	}
+
+	exchange := func(p *Proxy, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("google.com.", qtype)
+		client := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond}
+		r, _, err := client.Exchange(req, p.Addr(ProtoUDP).String())
+		if err != nil {
+			t.Fatalf("cannot exchange: %s", err)
+		}
+		return r
+	}
+
+	dnsProxy := newProxy(nil)
+
+	r := exchange(dnsProxy, dns.TypeANY)
+	assert.True(t, r.Response)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Equal(t, "google.com.", r.Question[0].Name)
+	if assert.Len(t, r.Answer, 1) {
+		hinfo := r.Answer[0].(*dns.HINFO)
+		assert.Equal(t, "RFC8482", hinfo.Cpu)
+		assert.Equal(t, uint32(600), hinfo.Hdr.Ttl)
+	}
+
+	r = exchange(dnsProxy, dns.TypeNULL)
+	assert.Equal(t, dns.RcodeNotImplemented, r.Rcode)
+	r = exchange(dnsProxy, dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Empty(t, r.Answer)
+
+	assert.Equal(t, map[string]uint64{"ANY": 1, "NULL": 1}, dnsProxy.RestrictedQueries())
+	_ = dnsProxy.Stop()
+
+	// The restrictions don't apply to the exempt clients
+	dnsProxy = newProxy([]string{"127.0.0.0/8"})
+	r = exchange(dnsProxy, dns.TypeANY)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Empty(t, r.Answer)
+	r = exchange(dnsProxy, dns.TypeNULL)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+
+	assert.Empty(t, dnsProxy.RestrictedQueries())
+	_ = dnsProxy.Stop()
+}
+
 func TestInvalidDNSRequest(t *testing.T) {
 	// Prepare the proxy server
 	dnsProxy := createTestProxy(t, nil)
@@ -664,6 +769,140 @@ func TestECSProxyCacheMinMaxTTL(t *testing.T) {
 	_ = dnsProxy.Stop()
 }
 
+func TestECSMode(t *testing.T) {
+	u := &testUpstream{}
+	u.aResp = new(dns.A)
+	u.aResp.Hdr = dns.RR_Header{Name: "host.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}
+	u.aResp.A = net.IP{4, 3, 2, 1}
+
+	newProxy := func(mode ECSMode) *Proxy {
+		dnsProxy := createTestProxy(t, nil)
+		dnsProxy.ECSMode = mode
+		dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+		return dnsProxy
+	}
+
+	resolve := func(p *Proxy, ecs *dns.EDNS0_SUBNET) *dns.Msg {
+		d := &DNSContext{Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+		d.Req = createHostTestMessage("host")
+		if ecs != nil {
+			d.Req.SetEdns0(4096, false)
+			opt := d.Req.IsEdns0()
+			opt.Option = append(opt.Option, ecs)
+		}
+
+		u.ecsReqIP, u.ecsReqMask = nil, 0
+		err := p.Resolve(d)
+		if err != nil {
+			t.Fatalf("cannot resolve: %s", err)
+		}
+		return d.Res
+	}
+
+	clientECS := func(ip net.IP, mask uint8) *dns.EDNS0_SUBNET {
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: mask, Address: ip}
+	}
+
+	// Strip: the upstream never sees the subnet, the client gets its option
+	// back with the zero scope
+	p := newProxy(ECSStrip)
+	u.ecsIP = net.IP{5, 6, 7, 0}
+	res := resolve(p, clientECS(net.IP{5, 6, 7, 0}, 24))
+	assert.Nil(t, u.ecsReqIP)
+	ip, mask, scope := parseECS(res)
+	assert.True(t, ip.Equal(net.IP{5, 6, 7, 0}))
+	assert.Equal(t, uint8(24), mask)
+	assert.Equal(t, uint8(0), scope)
+
+	// No OPT in the request, no OPT in the response
+	res = resolve(p, nil)
+	assert.Nil(t, u.ecsReqIP)
+	assert.Nil(t, res.IsEdns0())
+	u.ecsIP = nil
+
+	// Forward: the client's option is passed as is, nothing is generated
+	p = newProxy(ECSForward)
+	resolve(p, clientECS(net.IP{5, 6, 7, 0}, 24))
+	assert.True(t, u.ecsReqIP.Equal(net.IP{5, 6, 7, 0}))
+	assert.Equal(t, uint8(24), u.ecsReqMask)
+	resolve(p, nil)
+	assert.Nil(t, u.ecsReqIP)
+
+	// Generate: the subnet of the client is added, but the client that asks
+	// not to reveal its subnet is respected
+	p = newProxy(ECSGenerate)
+	res = resolve(p, nil)
+	assert.True(t, u.ecsReqIP.Equal(net.IP{1, 2, 3, 0}))
+	assert.Equal(t, uint8(24), u.ecsReqMask)
+	assert.Nil(t, res.IsEdns0())
+
+	resolve(p, clientECS(net.IP{0, 0, 0, 0}, 0))
+	assert.True(t, u.ecsReqIP.Equal(net.IP{0, 0, 0, 0}))
+	assert.Equal(t, uint8(0), u.ecsReqMask)
+}
+
+func TestGracefulStop(t *testing.T) {
+	serverConfig, _ := createServerTLSConfig(t)
+	dnsProxy := createTestProxy(t, serverConfig)
+	dnsProxy.UDPListenAddr = []*net.UDPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
+	dnsProxy.TCPListenAddr = []*net.TCPAddr{{Port: 0, IP: net.ParseIP(listenIP)}}
+	dnsProxy.GracefulShutdownTimeout = 2 * time.Second
+
+	// Answer slowly so that the request is still being processed on Stop
+	var handled int32
+	arrived := make(chan struct{}, 1)
+	dnsProxy.RequestHandler = func(p *Proxy, d *DNSContext) error {
+		atomic.AddInt32(&handled, 1)
+		arrived <- struct{}{}
+		time.Sleep(500 * time.Millisecond)
+		d.Res = new(dns.Msg).SetReply(d.Req)
+		return nil
+	}
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	// The connection opened before Stop
+	idleConn, err := dns.Dial("tcp", dnsProxy.Addr(ProtoTCP).String())
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+	defer idleConn.Close()
+
+	addr := dnsProxy.Addr(ProtoUDP)
+	client := &dns.Client{Net: "udp", Timeout: time.Second}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := client.Exchange(createTestMessage(), addr.String())
+		errCh <- err
+	}()
+	<-arrived
+
+	stopErr := make(chan error, 1)
+	go func() { stopErr <- dnsProxy.Stop() }()
+	time.Sleep(100 * time.Millisecond)
+
+	// No listener accepts the new requests while the proxy is stopping
+	tcpClient := &dns.Client{Net: "tcp", Timeout: 200 * time.Millisecond}
+	_, _, err = tcpClient.Exchange(createTestMessage(), dnsProxy.Addr(ProtoTCP).String())
+	assert.NotNil(t, err)
+	tlsClient := &dns.Client{Net: "tcp-tls", Timeout: 200 * time.Millisecond, TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	_, _, err = tlsClient.Exchange(createTestMessage(), dnsProxy.Addr(ProtoTLS).String())
+	assert.NotNil(t, err)
+	_ = idleConn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	_ = idleConn.WriteMsg(createTestMessage())
+	_, err = idleConn.ReadMsg()
+	assert.NotNil(t, err)
+
+	// The request that was being processed is answered
+	assert.Nil(t, <-errCh)
+	assert.Nil(t, <-stopErr)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&handled))
+}
+
 func createTestDNSCryptProxy(t *testing.T) (*Proxy, dnscrypt.ResolverConfig) {
 	p := createTestProxy(t, nil)
 	p.UDPListenAddr = nil
@@ -722,7 +961,7 @@ func createTestProxy(t *testing.T, tlsConfig *tls.Config) *Proxy {
 		}
 	}
 	upstreams := make([]upstream.Upstream, 0)
-	dnsUpstream, err := upstream.AddressToUpstream(upstreamAddr, upstream.Options{Timeout: defaultTimeout})
+	dnsUpstream, err := upstream.AddressToUpstream(localUpstreamAddr(t), upstream.Options{Timeout: defaultTimeout})
 	if err != nil {
 		t.Fatalf("cannot prepare the upstream: %s", err)
 	}
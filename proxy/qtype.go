@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// defaultRestrictedTTL is used when Config.RestrictedTTL is not set, the same
+// TTL is recommended by RFC 8482
+const defaultRestrictedTTL = 3600
+
+// qtypeRestrictions answers the queries of the restricted types without
+// querying the upstreams
+type qtypeRestrictions struct {
+	blocked map[uint16]bool // types answered with NOTIMP
+	exempt  ipRanges        // clients the restrictions don't apply to
+
+	counts     map[uint16]uint64 // number of the restricted queries by type
+	countsLock sync.Mutex        // protects counts
+}
+
+// newQtypeRestrictions creates the restrictions from the config.  It returns
+// nil if nothing is restricted.
+func newQtypeRestrictions(c *Config) (*qtypeRestrictions, error) {
+	if c.anyPolicy() == AnyForward && len(c.BlockedQtypes) == 0 {
+		return nil, nil
+	}
+
+	exempt, err := newIPRanges(c.QtypeExemptClients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid qtype exempt clients: %w", err)
+	}
+
+	r := &qtypeRestrictions{
+		blocked: map[uint16]bool{},
+		exempt:  exempt,
+		counts:  map[uint16]uint64{},
+	}
+	for _, t := range c.BlockedQtypes {
+		r.blocked[t] = true
+	}
+	return r, nil
+}
+
+// count counts the restricted query
+func (r *qtypeRestrictions) count(qtype uint16) {
+	r.countsLock.Lock()
+	r.counts[qtype]++
+	r.countsLock.Unlock()
+}
+
+// anyPolicy returns the AnyPolicy taking RefuseAny into account
+func (c *Config) anyPolicy() AnyPolicy {
+	if c.RefuseAny && c.AnyPolicy == AnyForward {
+		return AnyNotImpl
+	}
+	return c.AnyPolicy
+}
+
+// restrictQtype answers the query if its type is restricted for the client.
+// It returns true if d.Res is set.
+func (p *Proxy) restrictQtype(d *DNSContext) bool {
+	r := p.qtypes
+	if r == nil || len(d.Req.Question) == 0 {
+		return false
+	}
+
+	qtype := d.Req.Question[0].Qtype
+	policy := p.anyPolicy()
+	if (qtype != dns.TypeANY || policy == AnyForward) && !r.blocked[qtype] {
+		return false
+	}
+
+	if ip := getIP(d.Addr); ip != nil && r.exempt.contains(ip) {
+		return false
+	}
+
+	r.count(qtype)
+	if qtype == dns.TypeANY && policy == AnyMinimal {
+		log.Tracef("Answering type=ANY request with HINFO")
+		d.Res = p.genMinimalAny(d.Req)
+	} else {
+		log.Tracef("Refusing type=%s request", dns.Type(qtype))
+		d.Res = p.genNotImpl(d.Req)
+	}
+	return true
+}
+
+// genMinimalAny creates the response to the ANY query with a single HINFO
+// record as described in RFC 8482
+func (p *Proxy) genMinimalAny(req *dns.Msg) *dns.Msg {
+	ttl := p.RestrictedTTL
+	if ttl == 0 {
+		ttl = defaultRestrictedTTL
+	}
+
+	resp := new(dns.Msg).SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Answer = []dns.RR{&dns.HINFO{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: ttl},
+		Cpu: "RFC8482",
+	}}
+	return resp
+}
+
+// RestrictedQueries returns the number of queries answered by the proxy
+// itself because of AnyPolicy or BlockedQtypes by the query type
+func (p *Proxy) RestrictedQueries() map[string]uint64 {
+	r := p.qtypes
+	if r == nil {
+		return map[string]uint64{}
+	}
+
+	r.countsLock.Lock()
+	defer r.countsLock.Unlock()
+
+	counts := make(map[string]uint64, len(r.counts))
+	for qtype, n := range r.counts {
+		counts[dns.Type(qtype).String()] = n
+	}
+	return counts
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// defaultQueryLogBufferSize is used when Config.QueryLogBufferSize is not set
+const defaultQueryLogBufferSize = 1000
+
+// queryLogCloseTimeout is how long Proxy.Stop waits for QueryLogHandler to
+// receive the buffered entries, the ones left after it are dropped
+const queryLogCloseTimeout = 5 * time.Second
+
+// QueryLogEntry describes a query the proxy has answered
+type QueryLogEntry struct {
+	Time     time.Time     // when the query was received
+	ClientIP net.IP        // client IP address, anonymized if Config.QueryLogAnonymizeIP is set
+	Proto    string        // protocol of the query: ProtoUDP, ProtoTCP, ProtoTLS, etc.
+	QName    string        // question name
+	QType    uint16        // question type
+	Rcode    int           // response code
+	Answer   []string      // answer records as type and data, e.g. "A 1.2.3.4"
+	Upstream string        // address of the upstream that resolved the query, empty if none did
+	Cached   bool          // true if the response was served from cache
+	Elapsed  time.Duration // time spent on the query
+}
+
+// QueryLogHandler receives the query log entries.  It's called from a single
+// goroutine, so a slow handler doesn't delay the responses, but the entries
+// that don't fit Config.QueryLogBufferSize meanwhile are dropped.
+type QueryLogHandler func(e QueryLogEntry)
+
+// QueryLogChannel returns the QueryLogHandler that sends the entries to the
+// channel, it never blocks.  If the channel is full, the entry is dropped and
+// dropped, if it's not nil, is incremented atomically.
+func QueryLogChannel(ch chan<- QueryLogEntry, dropped *uint64) QueryLogHandler {
+	return func(e QueryLogEntry) {
+		select {
+		case ch <- e:
+		default:
+			if dropped != nil {
+				atomic.AddUint64(dropped, 1)
+			}
+		}
+	}
+}
+
+// queryLog passes the entries to the handler asynchronously.  The entries
+// wait in a ring buffer, the oldest one is dropped if it's full.
+type queryLog struct {
+	dropped uint64 // number of the dropped entries, accessed atomically
+
+	handler QueryLogHandler
+	entries []QueryLogEntry // ring buffer
+	first   int             // index of the oldest entry
+	n       int             // number of the entries in the buffer
+	closed  bool            // true if no entries are accepted anymore
+	mu      sync.Mutex      // protects entries, first, n and closed
+
+	notify chan struct{} // signals that there are new entries or the log is closed
+	done   chan struct{} // closed when all entries are passed to the handler after close
+}
+
+// newQueryLog creates the query log and starts passing the entries to the
+// handler
+func newQueryLog(handler QueryLogHandler, size int) *queryLog {
+	if size <= 0 {
+		size = defaultQueryLogBufferSize
+	}
+
+	q := &queryLog{
+		handler: handler,
+		entries: make([]QueryLogEntry, size),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// add puts the entry into the buffer, it never blocks
+func (q *queryLog) add(e QueryLogEntry) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+
+	if q.n == len(q.entries) {
+		q.first = (q.first + 1) % len(q.entries)
+		q.n--
+		atomic.AddUint64(&q.dropped, 1)
+	}
+	q.entries[(q.first+q.n)%len(q.entries)] = e
+	q.n++
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+// close stops accepting the entries and waits until the buffered ones are
+// passed to the handler, but no longer than queryLogCloseTimeout
+func (q *queryLog) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	q.signal()
+
+	timer := time.NewTimer(queryLogCloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-q.done:
+		return
+	case <-timer.C:
+		// Go on, run exits once the handler returns
+	}
+
+	q.mu.Lock()
+	n := q.n
+	q.n = 0
+	for i := range q.entries {
+		q.entries[i] = QueryLogEntry{}
+	}
+	q.mu.Unlock()
+
+	atomic.AddUint64(&q.dropped, uint64(n))
+	log.Error("querylog: the handler is too slow, dropped %d entries", n)
+}
+
+// signal wakes run up if it's waiting
+func (q *queryLog) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run passes the entries to the handler until the log is closed
+func (q *queryLog) run() {
+	defer close(q.done)
+
+	for {
+		q.mu.Lock()
+		for q.n > 0 {
+			e := q.entries[q.first]
+			q.entries[q.first] = QueryLogEntry{}
+			q.first = (q.first + 1) % len(q.entries)
+			q.n--
+			q.mu.Unlock()
+
+			q.callHandler(e)
+
+			q.mu.Lock()
+		}
+		closed := q.closed
+		q.mu.Unlock()
+
+		if closed {
+			return
+		}
+		<-q.notify
+	}
+}
+
+// callHandler calls the handler, a panic in it is logged
+func (q *queryLog) callHandler(e QueryLogEntry) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Error("Panic in the QueryLogHandler: %v\n%s", v, debug.Stack())
+		}
+	}()
+
+	q.handler(e)
+}
+
+// QueryLogDropped returns the number of the query log entries dropped because
+// QueryLogHandler couldn't keep up
+func (p *Proxy) QueryLogDropped() uint64 {
+	p.RLock()
+	q := p.queryLog
+	p.RUnlock()
+
+	if q == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// logQuery adds the answered query to the query log if it's enabled
+func (p *Proxy) logQuery(d *DNSContext) {
+	q := p.queryLog
+	if q == nil {
+		return
+	}
+
+	e := QueryLogEntry{
+		Time:     d.StartTime,
+		ClientIP: getIP(d.Addr),
+		Proto:    d.Proto,
+		Rcode:    d.Res.Rcode,
+		Answer:   answerSummary(d.Res.Answer),
+		Cached:   d.cached,
+		Elapsed:  time.Since(d.StartTime),
+	}
+	if len(d.Req.Question) > 0 {
+		e.QName = d.Req.Question[0].Name
+		e.QType = d.Req.Question[0].Qtype
+	}
+	if d.Upstream != nil {
+		e.Upstream = d.Upstream.Address()
+	}
+	if p.QueryLogAnonymizeIP {
+		e.ClientIP = anonymizeIP(e.ClientIP)
+	}
+
+	q.add(e)
+}
+
+// answerSummary returns the type and data of the records
+func answerSummary(rrs []dns.RR) []string {
+	var summary []string
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		data := strings.TrimPrefix(rr.String(), hdr.String())
+		summary = append(summary, dns.Type(hdr.Rrtype).String()+" "+data)
+	}
+	return summary
+}
+
+// anonymizeIP zeroes the last byte of the IPv4 address and the last 80 bits
+// of the IPv6 address
+func anonymizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32))
+	}
+	if ip != nil {
+		return ip.Mask(net.CIDRMask(48, 128))
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// QueryLogFile writes the query log entries to a file as JSON lines.  When
+// the file grows over the size limit, it's renamed to "<path>.1", the older
+// files are renamed to "<path>.2", "<path>.3" and so on, and the ones over
+// the backups limit are removed.
+type QueryLogFile struct {
+	path       string
+	maxSize    int64 // max size of the file in bytes, 0 for no rotation
+	maxBackups int   // number of the rotated files to keep
+
+	file *os.File
+	size int64      // current size of file
+	mu   sync.Mutex // protects file and size
+}
+
+// queryLogJSON is the JSON line QueryLogFile writes
+type queryLogJSON struct {
+	Time      string   `json:"time"`
+	ClientIP  string   `json:"client_ip"`
+	Proto     string   `json:"proto"`
+	QName     string   `json:"qname"`
+	QType     string   `json:"qtype"`
+	Rcode     string   `json:"rcode"`
+	Answer    []string `json:"answer,omitempty"`
+	Upstream  string   `json:"upstream,omitempty"`
+	Cached    bool     `json:"cached"`
+	ElapsedMs float64  `json:"elapsed_ms"`
+}
+
+// NewQueryLogFile opens the file the query log entries are appended to.
+// maxSize is the size in bytes the file is rotated at, 0 disables rotation.
+// maxBackups is the number of the rotated files to keep.
+func NewQueryLogFile(path string, maxSize int64, maxBackups int) (*QueryLogFile, error) {
+	l := &QueryLogFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write writes the entry to the file, it's a QueryLogHandler
+func (l *QueryLogFile) Write(e QueryLogEntry) {
+	line, err := json.Marshal(queryLogJSON{
+		Time:      e.Time.Format(time.RFC3339Nano),
+		ClientIP:  e.ClientIP.String(),
+		Proto:     e.Proto,
+		QName:     e.QName,
+		QType:     dns.Type(e.QType).String(),
+		Rcode:     rcodeString(e.Rcode),
+		Answer:    e.Answer,
+		Upstream:  e.Upstream,
+		Cached:    e.Cached,
+		ElapsedMs: float64(e.Elapsed) / float64(time.Millisecond),
+	})
+	if err != nil {
+		log.Error("querylog: couldn't encode the entry: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return
+	}
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			log.Error("querylog: couldn't rotate %s: %s", l.path, err)
+		}
+		if l.file == nil {
+			return
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Error("querylog: couldn't write to %s: %s", l.path, err)
+	}
+}
+
+// Close closes the file, the entries written after it are ignored
+func (l *QueryLogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// open opens the file for appending
+func (l *QueryLogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening query log: %w", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("opening query log: %w", err)
+	}
+
+	l.file = f
+	l.size = fi.Size()
+	return nil
+}
+
+// rotate renames the current file and the backups and opens a new file.  If
+// renaming fails, the current file is reopened.
+func (l *QueryLogFile) rotate() error {
+	err := l.file.Close()
+	l.file = nil
+	if err == nil {
+		err = l.shiftBackups()
+	}
+
+	openErr := l.open()
+	if err != nil {
+		return err
+	}
+	return openErr
+}
+
+// shiftBackups renames the file to the first backup and every backup to the
+// next one, the last backup is overwritten
+func (l *QueryLogFile) shiftBackups() error {
+	var err error
+	if l.maxBackups > 0 {
+		for i := l.maxBackups - 1; i > 0; i-- {
+			err = os.Rename(l.backupPath(i), l.backupPath(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = os.Rename(l.path, l.backupPath(1))
+	} else {
+		err = os.Remove(l.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// backupPath returns the path of the i-th rotated file
+func (l *QueryLogFile) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+// rcodeString returns the name of the response code
+func rcodeString(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
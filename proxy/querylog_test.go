@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryLog(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.CacheEnabled = true
+	dnsProxy.QueryLogAnonymizeIP = true
+	entries := make(chan QueryLogEntry, 10)
+	dnsProxy.QueryLogHandler = QueryLogChannel(entries, nil)
+
+	u := upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = []dns.RR{newRR("host. 60 IN A 192.0.2.1")}
+		return resp, nil
+	})
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+
+	addr := dnsProxy.Addr(ProtoUDP).String()
+	for i := 0; i < 2; i++ {
+		_, err = dns.Exchange(createHostTestMessage("host"), addr)
+		if err != nil {
+			t.Fatalf("couldn't exchange with the proxy: %s", err)
+		}
+	}
+
+	// Stop delivers the remaining entries
+	err = dnsProxy.Stop()
+	assert.Nil(t, err)
+	close(entries)
+
+	var got []QueryLogEntry
+	for e := range entries {
+		got = append(got, e)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(got))
+	}
+
+	for i, e := range got {
+		assert.Equal(t, ProtoUDP, e.Proto)
+		assert.Equal(t, "host.", e.QName)
+		assert.Equal(t, dns.TypeA, e.QType)
+		assert.Equal(t, dns.RcodeSuccess, e.Rcode)
+		assert.Equal(t, []string{"A 192.0.2.1"}, e.Answer)
+		assert.Equal(t, "127.0.0.0", e.ClientIP.String())
+		assert.Equal(t, i == 1, e.Cached)
+	}
+	assert.Equal(t, u.Address(), got[0].Upstream)
+	assert.Equal(t, "", got[1].Upstream)
+	assert.Equal(t, uint64(0), dnsProxy.QueryLogDropped())
+}
+
+func TestQueryLogDropOldest(t *testing.T) {
+	// The first entry is taken by the handler, it blocks until it's
+	// released, so the next ones wait in the buffer
+	taken := make(chan struct{})
+	release := make(chan struct{})
+	var got []string
+	q := newQueryLog(func(e QueryLogEntry) {
+		if e.QName == "0." {
+			close(taken)
+			<-release
+		}
+		got = append(got, e.QName)
+	}, 2)
+
+	q.add(QueryLogEntry{QName: "0."})
+	<-taken
+	for _, name := range []string{"1.", "2.", "3."} {
+		q.add(QueryLogEntry{QName: name})
+	}
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&q.dropped))
+
+	close(release)
+	q.close()
+	assert.Equal(t, []string{"0.", "2.", "3."}, got)
+}
+
+func TestQueryLogChannel(t *testing.T) {
+	// The full channel doesn't block the handler
+	ch := make(chan QueryLogEntry, 1)
+	var dropped uint64
+	handler := QueryLogChannel(ch, &dropped)
+	handler(QueryLogEntry{QName: "0."})
+	handler(QueryLogEntry{QName: "1."})
+	assert.Equal(t, uint64(1), dropped)
+	assert.Equal(t, "0.", (<-ch).QName)
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	assert.Equal(t, "192.0.2.0", anonymizeIP(net.ParseIP("192.0.2.55")).String())
+	assert.Equal(t, "2001:db8:1::", anonymizeIP(net.ParseIP("2001:db8:1:2:3:4:5:6")).String())
+	assert.Nil(t, anonymizeIP(nil))
+}
+
+func TestQueryLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatalf("cannot create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "querylog.json")
+	l, err := NewQueryLogFile(path, 500, 2)
+	if err != nil {
+		t.Fatalf("cannot open the query log: %s", err)
+	}
+
+	e := QueryLogEntry{
+		Time:     time.Now(),
+		ClientIP: net.IP{192, 0, 2, 1},
+		Proto:    ProtoTCP,
+		QName:    "example.org.",
+		QType:    dns.TypeAAAA,
+		Rcode:    dns.RcodeNameError,
+		Elapsed:  1500 * time.Microsecond,
+	}
+	for i := 0; i < 10; i++ {
+		l.Write(e)
+	}
+	assert.Nil(t, l.Close())
+
+	// Every line is about 200 bytes, so there are 2 lines per file and
+	// only 2 backups are kept
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		var f *os.File
+		f, err = os.Open(p)
+		if err != nil {
+			t.Fatalf("cannot open %s: %s", p, err)
+		}
+
+		s := bufio.NewScanner(f)
+		lines := 0
+		for s.Scan() {
+			lines++
+			line := queryLogJSON{}
+			assert.Nil(t, json.Unmarshal(s.Bytes(), &line))
+			assert.Equal(t, "192.0.2.1", line.ClientIP)
+			assert.Equal(t, "AAAA", line.QType)
+			assert.Equal(t, "NXDOMAIN", line.Rcode)
+			assert.Equal(t, 1.5, line.ElapsedMs)
+		}
+		_ = f.Close()
+		assert.Equal(t, 2, lines, p)
+	}
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,60 +1,208 @@
 package proxy
 
 import (
+	"hash/fnv"
 	"net"
-	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
-	rate "github.com/beefsack/go-rate"
-	gocache "github.com/patrickmn/go-cache"
 )
 
-func (p *Proxy) limiterForIP(ip string) interface{} {
+// defaultRatelimitWindow is used when Config.RatelimitWindow is not set
+const defaultRatelimitWindow = time.Second
+
+// ratelimitShards is the number of independently locked parts of the per-IP
+// counters, so that the requests from different clients rarely wait for each other
+const ratelimitShards = 32
+
+// RatelimitStats contains the number of requests that were ratelimited
+type RatelimitStats struct {
+	Global uint64 // over the global limit
+	Client uint64 // over the per-client limit
+}
+
+// windowCounter counts the requests in a fixed window that starts with the
+// first request after the previous window has ended
+type windowCounter struct {
+	start int64 // window start, unix nanoseconds, accessed atomically
+	count int64 // number of the requests in the window, accessed atomically
+}
+
+// inc counts the request and returns the number of requests in the window
+func (c *windowCounter) inc(now int64, window time.Duration) int64 {
+	start := atomic.LoadInt64(&c.start)
+	if now-start >= int64(window) && atomic.CompareAndSwapInt64(&c.start, start, now) {
+		// A few requests of the previous window may be counted in the new one,
+		// that's fine for a ratelimit
+		atomic.StoreInt64(&c.count, 0)
+	}
+
+	return atomic.AddInt64(&c.count, 1)
+}
+
+// ratelimitShard contains the per-IP counters of some of the clients
+type ratelimitShard struct {
+	mu     sync.Mutex
+	start  time.Time      // window start
+	counts map[string]int // number of requests per IP in the window
+}
+
+// inc counts the request from ip and returns the number of its requests in the window
+func (s *ratelimitShard) inc(ip string, now time.Time, window time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forget all the clients at once when the window ends, so that the map
+	// doesn't grow with the clients that are gone
+	if s.counts == nil || now.Sub(s.start) >= window {
+		s.start = now
+		s.counts = map[string]int{}
+	}
+
+	s.counts[ip]++
+	return s.counts[ip]
+}
+
+// ratelimiter limits the number of requests per window from each client and
+// from all of them together
+type ratelimiter struct {
+	limit       int           // per-client limit, 0 to disable
+	globalLimit int           // global limit, 0 to disable
+	window      time.Duration // limits apply to this period of time
+	whitelist   ipRanges      // these clients are never ratelimited
+
+	global windowCounter
+	shards [ratelimitShards]ratelimitShard
+
+	limitedGlobal uint64 // accessed atomically
+	limitedClient uint64 // accessed atomically
+}
+
+// newRatelimiter creates a new ratelimiter from the proxy configuration
+func newRatelimiter(conf *Config) (*ratelimiter, error) {
+	whitelist, err := newIPRanges(conf.RatelimitWhitelist)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ratelimiter{
+		limit:       conf.Ratelimit,
+		globalLimit: conf.RatelimitGlobal,
+		window:      conf.RatelimitWindow,
+		whitelist:   whitelist,
+	}
+	if r.window <= 0 {
+		r.window = defaultRatelimitWindow
+	}
+
+	return r, nil
+}
+
+// isLimited counts the request and checks if it's over one of the limits
+func (r *ratelimiter) isLimited(ip net.IP) bool {
+	if r.whitelist.contains(ip) {
+		return false
+	}
+
+	now := time.Now()
+
+	if r.globalLimit > 0 && r.global.inc(now.UnixNano(), r.window) > int64(r.globalLimit) {
+		atomic.AddUint64(&r.limitedGlobal, 1)
+		return true
+	}
+
+	if r.limit <= 0 {
+		return false
+	}
+
+	key := string(ip.To16())
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	shard := &r.shards[h.Sum32()%ratelimitShards]
+
+	if shard.inc(key, now, r.window) > r.limit {
+		atomic.AddUint64(&r.limitedClient, 1)
+		return true
+	}
+
+	return false
+}
+
+// getRatelimiter returns the ratelimiter.  Init creates it before the
+// listeners start, and it's only created lazily if Init wasn't called.
+func (p *Proxy) getRatelimiter() *ratelimiter {
+	if r, ok := p.ratelimit.Load().(*ratelimiter); ok {
+		return r
+	}
+
 	p.ratelimitLock.Lock()
 	defer p.ratelimitLock.Unlock()
-	if p.ratelimitBuckets == nil {
-		p.ratelimitBuckets = gocache.New(time.Hour, time.Hour)
+
+	if r, ok := p.ratelimit.Load().(*ratelimiter); ok {
+		return r
 	}
 
-	// check if ratelimiter for that IP already exists, if not, create
-	value, found := p.ratelimitBuckets.Get(ip)
-	if !found {
-		value = rate.New(p.Ratelimit, time.Second)
-		p.ratelimitBuckets.Set(ip, value, time.Hour)
+	r, err := newRatelimiter(&p.Config)
+	if err != nil {
+		// Init reports it, so this only happens if it wasn't called
+		log.Error("ignoring the ratelimit whitelist: %s", err)
+		conf := p.Config
+		conf.RatelimitWhitelist = nil
+		r, _ = newRatelimiter(&conf)
 	}
+	p.ratelimit.Store(r)
 
-	return value
+	return r
 }
 
 // isRatelimited checks if the specified IP is ratelimited
 func (p *Proxy) isRatelimited(addr net.Addr) bool {
-	if p.Ratelimit <= 0 { // 0 -- disabled
+	if p.Ratelimit <= 0 && p.RatelimitGlobal <= 0 { // 0 -- disabled
 		return false
 	}
 
-	ip := getIPString(addr)
-	if ip == "" {
-		log.Printf("failed to split %v into host/port", addr)
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	if ip == nil {
+		log.Printf("failed to get the IP address of %v", addr)
 		return false
 	}
 
-	if len(p.RatelimitWhitelist) > 0 {
-		i := sort.SearchStrings(p.RatelimitWhitelist, ip)
+	return p.getRatelimiter().isLimited(ip)
+}
 
-		if i < len(p.RatelimitWhitelist) && p.RatelimitWhitelist[i] == ip {
-			// found, don't ratelimit
-			return false
-		}
+// respondRatelimited replies to the ratelimited request.  UDP requests are
+// dropped, or answered with TC=1 to make the client retry over TCP if
+// RatelimitTruncate is set.  Requests over the other protocols are refused.
+func (p *Proxy) respondRatelimited(d *DNSContext) {
+	switch {
+	case d.Proto != ProtoUDP:
+		d.Res = p.genRefused(d.Req)
+	case p.RatelimitTruncate:
+		d.Res = p.genTruncated(d.Req)
+	default:
+		return // do nothing, don't reply
 	}
 
-	value := p.limiterForIP(ip)
-	rl, ok := value.(*rate.RateLimiter)
-	if !ok {
-		log.Println("SHOULD NOT HAPPEN: non-bool entry found in safebrowsing lookup cache")
-		return false
+	p.respond(d)
+}
+
+// RatelimitStats returns the number of ratelimited requests
+func (p *Proxy) RatelimitStats() RatelimitStats {
+	if p.Ratelimit <= 0 && p.RatelimitGlobal <= 0 {
+		return RatelimitStats{}
 	}
 
-	allow, _ := rl.Try()
-	return !allow
+	r := p.getRatelimiter()
+	return RatelimitStats{
+		Global: atomic.LoadUint64(&r.limitedGlobal),
+		Client: atomic.LoadUint64(&r.limitedClient),
+	}
 }
@@ -2,10 +2,13 @@ package proxy
 
 import (
 	"net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestRatelimitingProxy(t *testing.T) {
@@ -87,3 +90,105 @@ func TestWhitelist(t *testing.T) {
 		t.Fatal("Second request must have been allowed due to whitelist")
 	}
 }
+
+func TestRatelimitingGlobal(t *testing.T) {
+	p := Proxy{}
+	p.RatelimitGlobal = 2
+	p.RatelimitWhitelist = []string{"192.168.0.0/16"}
+
+	for i := 0; i < 2; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, byte(i+1)), Port: 1232}
+		if p.isRatelimited(addr) {
+			t.Fatalf("request #%d must have been allowed", i)
+		}
+	}
+
+	// The limit applies to all clients together
+	if !p.isRatelimited(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 1232}) {
+		t.Fatal("third request must have been ratelimited")
+	}
+
+	// Unless the client is in the whitelisted subnet
+	if p.isRatelimited(&net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 1232}) {
+		t.Fatal("request must have been allowed due to whitelist")
+	}
+
+	assert.Equal(t, RatelimitStats{Global: 1}, p.RatelimitStats())
+}
+
+func TestRatelimitingConcurrentInit(t *testing.T) {
+	// Init isn't called, so the first requests create the ratelimiter
+	p := Proxy{}
+	p.RatelimitGlobal = 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = p.isRatelimited(&net.UDPAddr{IP: net.IPv4(127, 0, 0, byte(i+1)), Port: 1232})
+		}(i)
+	}
+	wg.Wait()
+
+	// All the requests are counted by the same ratelimiter
+	assert.Equal(t, RatelimitStats{Global: 10}, p.RatelimitStats())
+}
+
+func TestRatelimitingWindow(t *testing.T) {
+	p := Proxy{}
+	p.Ratelimit = 1
+	p.RatelimitWindow = 100 * time.Millisecond
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1232}
+	assert.False(t, p.isRatelimited(addr))
+	assert.True(t, p.isRatelimited(addr))
+
+	// Other clients have their own limits
+	assert.False(t, p.isRatelimited(&net.UDPAddr{IP: net.ParseIP("::1"), Port: 1232}))
+
+	time.Sleep(p.RatelimitWindow)
+	assert.False(t, p.isRatelimited(addr))
+
+	assert.Equal(t, RatelimitStats{Client: 1}, p.RatelimitStats())
+}
+
+func TestRatelimitingTruncate(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{upstream.NullUpstream()}
+	dnsProxy.Ratelimit = 1
+	dnsProxy.RatelimitWindow = time.Hour
+	dnsProxy.RatelimitTruncate = true
+
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() { _ = dnsProxy.Stop() }()
+
+	udpClient := &dns.Client{Net: "udp", Timeout: 500 * time.Millisecond}
+	tcpClient := &dns.Client{Net: "tcp", Timeout: 500 * time.Millisecond}
+
+	r, _, err := udpClient.Exchange(createTestMessage(), dnsProxy.Addr(ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("error in the first request: %s", err)
+	}
+	assert.False(t, r.Truncated)
+
+	// Ratelimited UDP request is truncated to make the client retry over TCP
+	r, _, err = udpClient.Exchange(createTestMessage(), dnsProxy.Addr(ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("error in the second request: %s", err)
+	}
+	assert.True(t, r.Truncated)
+	assert.Empty(t, r.Answer)
+
+	// Ratelimited TCP request is refused
+	r, _, err = tcpClient.Exchange(createTestMessage(), dnsProxy.Addr(ProtoTCP).String())
+	if err != nil {
+		t.Fatalf("error in the TCP request: %s", err)
+	}
+	assert.Equal(t, dns.RcodeRefused, r.Rcode)
+
+	assert.Equal(t, RatelimitStats{Client: 2}, dnsProxy.RatelimitStats())
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// locallyServedNets are the networks the reverse zones of which are served
+// locally (RFC 6303), plus the shared address space (RFC 6598) and the whole
+// unique local range (RFC 4193)
+var locallyServedNets = parseCIDRs(
+	// IPv4
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"255.255.255.255/32",
+	// IPv6
+	"::/128",
+	"::1/128",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+// parseCIDRs parses the networks, it panics if one of them is invalid
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// isPrivateRDNSRequest returns true if UsePrivateRDNS is set and it's a PTR
+// request for a locally-served address or network
+func (p *Proxy) isPrivateRDNSRequest(req *dns.Msg) bool {
+	q := req.Question[0]
+	if !p.UsePrivateRDNS || q.Qtype != dns.TypePTR {
+		return false
+	}
+
+	n := reverseNet(q.Name)
+	return n != nil && isLocallyServed(n)
+}
+
+// privateRDNSUpstreams returns the upstreams for the PTR request for a
+// locally-served address, it's empty if there are no private resolvers
+func (p *Proxy) privateRDNSUpstreams(host string) []upstream.Upstream {
+	if p.PrivateRDNSUpstreamConfig == nil {
+		return nil
+	}
+	return p.PrivateRDNSUpstreamConfig.getUpstreamsForDomain(host)
+}
+
+// isLocallyServed checks if the network is within one of the locally-served
+// networks
+func isLocallyServed(n *net.IPNet) bool {
+	ones, _ := n.Mask.Size()
+	for _, local := range locallyServedNets {
+		localOnes, _ := local.Mask.Size()
+		if ones >= localOnes && local.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseNet returns the network the in-addr.arpa or ip6.arpa name denotes,
+// e.g. 192.168.0.0/16 for 168.192.in-addr.arpa, and the single address network
+// for the full reverse name.  It returns nil if the name is malformed.
+func reverseNet(name string) *net.IPNet {
+	const (
+		v4Suffix = ".in-addr.arpa"
+		v6Suffix = ".ip6.arpa"
+	)
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	switch {
+	case strings.HasSuffix(name, v4Suffix):
+		return reverseIPv4Net(strings.TrimSuffix(name, v4Suffix))
+	case strings.HasSuffix(name, v6Suffix):
+		return reverseIPv6Net(strings.TrimSuffix(name, v6Suffix))
+	}
+	return nil
+}
+
+// reverseIPv4Net parses the reversed octets of the in-addr.arpa name
+func reverseIPv4Net(labels string) *net.IPNet {
+	octets := strings.Split(labels, ".")
+	if len(octets) > net.IPv4len {
+		return nil
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	for i, o := range octets {
+		// The octets with the leading zeros are ambiguous
+		if o == "" || (len(o) > 1 && o[0] == '0') {
+			return nil
+		}
+
+		v, err := strconv.ParseUint(o, 10, 8)
+		if err != nil {
+			return nil
+		}
+		ip[len(octets)-1-i] = byte(v)
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(octets)*8, net.IPv4len*8)}
+}
+
+// reverseIPv6Net parses the reversed nibbles of the ip6.arpa name
+func reverseIPv6Net(labels string) *net.IPNet {
+	nibbles := strings.Split(labels, ".")
+	if len(nibbles) > net.IPv6len*2 {
+		return nil
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	for i, n := range nibbles {
+		if len(n) != 1 {
+			return nil
+		}
+
+		v, err := strconv.ParseUint(n, 16, 4)
+		if err != nil {
+			return nil
+		}
+
+		pos := len(nibbles) - 1 - i
+		if pos%2 == 0 {
+			v <<= 4
+		}
+		ip[pos/2] |= byte(v)
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(nibbles)*4, net.IPv6len*8)}
+}
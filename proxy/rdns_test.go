@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseNet(t *testing.T) {
+	testCases := []struct {
+		name    string
+		want    string
+		private bool
+	}{
+		{"1.0.168.192.in-addr.arpa.", "192.168.0.1/32", true},
+		{"168.192.IN-ADDR.ARPA.", "192.168.0.0/16", true},
+		{"192.in-addr.arpa", "192.0.0.0/8", false},
+		{"31.172.in-addr.arpa.", "172.31.0.0/16", true},
+		{"32.172.in-addr.arpa.", "172.32.0.0/16", false},
+		{"8.8.8.8.in-addr.arpa.", "8.8.8.8/32", false},
+		{"1.0.0.127.in-addr.arpa.", "127.0.0.1/32", true},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", "::1/128", true},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.f.ip6.arpa.", "f000::1/128", false},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.F.ip6.arpa.", "fd00::1/128", true},
+		{"d.f.ip6.arpa.", "fd00::/8", true},
+		{"c.f.ip6.arpa.", "fc00::/8", true},
+		{"f.ip6.arpa.", "f000::/4", false},
+		{"8.e.f.ip6.arpa.", "fe80::/12", true},
+		{"8.b.d.0.1.0.0.2.ip6.arpa.", "2001:db8::/32", true},
+
+		// Malformed names
+		{"in-addr.arpa.", "", false},
+		{"ip6.arpa.", "", false},
+		{"256.168.192.in-addr.arpa.", "", false},
+		{"01.168.192.in-addr.arpa.", "", false},
+		{"-1.168.192.in-addr.arpa.", "", false},
+		{"1..168.192.in-addr.arpa.", "", false},
+		{"1.1.0.168.192.in-addr.arpa.", "", false},
+		{"host.168.192.in-addr.arpa.", "", false},
+		{"10.d.f.ip6.arpa.", "", false},
+		{"g.f.ip6.arpa.", "", false},
+		{"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", "", false},
+		{"example.org.", "", false},
+	}
+
+	for _, tc := range testCases {
+		n := reverseNet(tc.name)
+		if tc.want == "" {
+			assert.Nil(t, n, tc.name)
+			continue
+		}
+
+		if assert.NotNil(t, n, tc.name) {
+			assert.Equal(t, tc.want, n.String(), tc.name)
+			assert.Equal(t, tc.private, isLocallyServed(n), tc.name)
+		}
+	}
+}
+
+// newNamedUpstream creates a static upstream that answers the PTR requests
+// with the name
+func newNamedUpstream(name string) upstream.Upstream {
+	return upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN PTR " + name)}
+		return resp, nil
+	})
+}
+
+func TestPrivateRDNS(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{newNamedUpstream("public.")}
+	dnsProxy.Fallbacks = []upstream.Upstream{newNamedUpstream("fallback.")}
+	dnsProxy.PrivateRDNSUpstreamConfig = &UpstreamConfig{
+		Upstreams: []upstream.Upstream{newNamedUpstream("private.")},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"168.192.in-addr.arpa.": {newNamedUpstream("router.")},
+		},
+	}
+	dnsProxy.UsePrivateRDNS = true
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() { _ = dnsProxy.Stop() }()
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		d := &DNSContext{
+			Proto: ProtoUDP,
+			Req:   new(dns.Msg).SetQuestion(name, qtype),
+			Addr:  &net.UDPAddr{IP: net.IP{192, 0, 2, 1}},
+		}
+		err := dnsProxy.Resolve(d)
+		assert.Nil(t, err)
+		return d.Res
+	}
+	ptr := func(resp *dns.Msg) string {
+		if len(resp.Answer) != 1 {
+			return ""
+		}
+		return resp.Answer[0].(*dns.PTR).Ptr
+	}
+
+	assert.Equal(t, "router.", ptr(resolve("1.0.168.192.in-addr.arpa.", dns.TypePTR)))
+	assert.Equal(t, "private.", ptr(resolve("1.0.0.10.in-addr.arpa.", dns.TypePTR)))
+	assert.Equal(t, "private.", ptr(resolve("d.f.ip6.arpa.", dns.TypePTR)))
+	assert.Equal(t, "public.", ptr(resolve("8.8.8.8.in-addr.arpa.", dns.TypePTR)))
+	assert.Equal(t, "public.", ptr(resolve("01.0.0.10.in-addr.arpa.", dns.TypePTR)))
+
+	// Only the PTR requests are routed to the private upstreams
+	assert.Equal(t, "public.", ptr(resolve("1.0.0.10.in-addr.arpa.", dns.TypeTXT)))
+
+	// The private requests are answered with NXDOMAIN without the private
+	// upstreams
+	dnsProxy.PrivateRDNSUpstreamConfig = nil
+	resp := resolve("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Equal(t, "public.", ptr(resolve("8.8.8.8.in-addr.arpa.", dns.TypePTR)))
+
+	// The private requests follow the usual routing if UsePrivateRDNS isn't
+	// set
+	dnsProxy.UsePrivateRDNS = false
+	assert.Equal(t, "public.", ptr(resolve("1.0.0.10.in-addr.arpa.", dns.TypePTR)))
+}
+
+func TestPrivateRDNSNoFallback(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{newNamedUpstream("public.")}
+	dnsProxy.Fallbacks = []upstream.Upstream{newNamedUpstream("fallback.")}
+	dnsProxy.PrivateRDNSUpstreamConfig = &UpstreamConfig{
+		Upstreams: []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+			return nil, net.UnknownNetworkError("failing")
+		})},
+	}
+	dnsProxy.UsePrivateRDNS = true
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() { _ = dnsProxy.Stop() }()
+
+	// The private requests aren't sent to the fallbacks
+	d := &DNSContext{
+		Proto: ProtoUDP,
+		Req:   new(dns.Msg).SetQuestion("1.0.0.10.in-addr.arpa.", dns.TypePTR),
+		Addr:  &net.UDPAddr{IP: net.IP{192, 0, 2, 1}},
+	}
+	err = dnsProxy.Resolve(d)
+	assert.NotNil(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// rttExploreEvery is how often the RTT-based selector sends the request to one
+// of the slower upstreams first, so that a recovered upstream can win back
+// the traffic
+const rttExploreEvery = 20
+
+// UpstreamSelector decides which of the upstreams the request is sent to
+type UpstreamSelector interface {
+	// Exchange sends the request to one or more of the upstreams and returns
+	// the response and the upstream that sent it
+	Exchange(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error)
+}
+
+// InfoSelector is the optional interface of the UpstreamSelector that also
+// returns the information about the exchange with the upstream, so that it
+// reaches DNSContext.UpstreamInfo.  The built-in selectors implement it.
+type InfoSelector interface {
+	// ExchangeWithInfo is like Exchange, but it also returns the information
+	// about the exchange with the upstream that sent the response, see
+	// upstream.ExchangeWithInfo
+	ExchangeWithInfo(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, *upstream.ExchangeInfo, error)
+}
+
+// type check
+var (
+	_ InfoSelector = parallelSelector{}
+	_ InfoSelector = (*rttSelector)(nil)
+	_ InfoSelector = (*weightedSelector)(nil)
+)
+
+// parallelSelector sends the request to all upstreams at once
+type parallelSelector struct{}
+
+// NewParallelSelector returns an UpstreamSelector that sends the request to
+// all upstreams at once and uses the first successful response
+func NewParallelSelector() UpstreamSelector {
+	return parallelSelector{}
+}
+
+func (parallelSelector) Exchange(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	return upstream.ExchangeParallel(upstreams, req)
+}
+
+// ExchangeWithInfo implements InfoSelector for parallelSelector
+func (parallelSelector) ExchangeWithInfo(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, *upstream.ExchangeInfo, error) {
+	return upstream.ExchangeParallelWithInfo(upstreams, req)
+}
+
+// rttSelector tries the upstreams from fast to slow
+type rttSelector struct {
+	rtt      map[string]int // moving average of the upstreams rtt in milliseconds by address
+	rttLock  sync.Mutex     // protects rtt
+	requests uint64         // number of the requests, accessed atomically
+}
+
+// NewRTTSelector returns an UpstreamSelector that tries the upstreams one by
+// one, from the one with the lowest average rtt to the one with the highest.
+// Every 20th request is sent to one of the slower upstreams first.
+func NewRTTSelector() UpstreamSelector {
+	return &rttSelector{rtt: map[string]int{}}
+}
+
+func (s *rttSelector) Exchange(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	reply, u, _, err := s.ExchangeWithInfo(req, upstreams)
+	return reply, u, err
+}
+
+// ExchangeWithInfo implements InfoSelector for *rttSelector
+func (s *rttSelector) ExchangeWithInfo(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, *upstream.ExchangeInfo, error) {
+	sorted := s.sorted(upstreams)
+
+	n := atomic.AddUint64(&s.requests, 1)
+	if len(sorted) > 1 && n%rttExploreEvery == 0 {
+		// Take turns moving the slower upstreams to the front
+		i := 1 + int(n/rttExploreEvery)%(len(sorted)-1)
+		slow := sorted[i]
+		copy(sorted[1:i+1], sorted[:i])
+		sorted[0] = slow
+	}
+
+	return exchangeOrdered(req, sorted, s.update)
+}
+
+// sorted returns a copy of the upstreams sorted by rtt from fast to slow.  The
+// upstreams that weren't used yet go first.  A single upstream is returned as
+// is.
+func (s *rttSelector) sorted(upstreams []upstream.Upstream) []upstream.Upstream {
+	if len(upstreams) < 2 {
+		return upstreams
+	}
+
+	clone := make([]upstream.Upstream, len(upstreams))
+	copy(clone, upstreams)
+
+	s.rttLock.Lock()
+	defer s.rttLock.Unlock()
+
+	sort.SliceStable(clone, func(i, j int) bool {
+		return s.rtt[clone[i].Address()] < s.rtt[clone[j].Address()]
+	})
+
+	return clone
+}
+
+// update updates the moving average of the upstream rtt, failures count as
+// the default timeout
+func (s *rttSelector) update(u upstream.Upstream, elapsed int, err error) {
+	if err != nil {
+		elapsed = int(defaultTimeout / time.Millisecond)
+	}
+
+	s.rttLock.Lock()
+	s.rtt[u.Address()] = (s.rtt[u.Address()] + elapsed) / 2
+	s.rttLock.Unlock()
+}
+
+// weightedSelector chooses the upstream using the smooth weighted round-robin
+type weightedSelector struct {
+	weights map[string]int // upstream weights by address
+	current map[string]int // current weights by address
+	lock    sync.Mutex     // protects current
+}
+
+// NewWeightedSelector returns an UpstreamSelector that distributes the
+// requests between the upstreams proportionally to their weights.  weights
+// maps the upstream addresses to their weights, the weight of the upstreams
+// that are not there is 1.  If the chosen upstream fails, the rest of them are
+// tried in the configured order.
+func NewWeightedSelector(weights map[string]int) UpstreamSelector {
+	s := &weightedSelector{weights: map[string]int{}, current: map[string]int{}}
+	for addr, w := range weights {
+		s.weights[addr] = w
+	}
+	return s
+}
+
+func (s *weightedSelector) Exchange(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	reply, u, _, err := s.ExchangeWithInfo(req, upstreams)
+	return reply, u, err
+}
+
+// ExchangeWithInfo implements InfoSelector for *weightedSelector
+func (s *weightedSelector) ExchangeWithInfo(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, *upstream.ExchangeInfo, error) {
+	if len(upstreams) == 0 {
+		return exchangeOrdered(req, upstreams, nil)
+	}
+
+	i := s.next(upstreams)
+	ordered := make([]upstream.Upstream, 0, len(upstreams))
+	ordered = append(ordered, upstreams[i])
+	ordered = append(ordered, upstreams[:i]...)
+	ordered = append(ordered, upstreams[i+1:]...)
+
+	return exchangeOrdered(req, ordered, nil)
+}
+
+// next returns the index of the upstream to use
+func (s *weightedSelector) next(upstreams []upstream.Upstream) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	total := 0
+	best := 0
+	for i, u := range upstreams {
+		w := s.weights[u.Address()]
+		if w <= 0 {
+			w = 1
+		}
+		total += w
+
+		addr := u.Address()
+		s.current[addr] += w
+		if s.current[addr] > s.current[upstreams[best].Address()] {
+			best = i
+		}
+	}
+
+	s.current[upstreams[best].Address()] -= total
+	return best
+}
+
+// exchangeOrdered tries the upstreams one by one until one of them responds.
+// update is called with the result of every exchange if it's not nil.
+func exchangeOrdered(req *dns.Msg, upstreams []upstream.Upstream, update func(u upstream.Upstream, elapsed int, err error)) (*dns.Msg, upstream.Upstream, *upstream.ExchangeInfo, error) {
+	errs := []error{}
+	for _, u := range upstreams {
+		reply, info, elapsed, err := exchangeWithUpstream(u, req)
+		if update != nil {
+			update(u, elapsed, err)
+		}
+		if err == nil {
+			return reply, u, info, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, nil, nil, errorx.DecorateMany("all upstreams failed to exchange request", errs...)
+}
+
+// exchangeWithUpstream returns result of ExchangeWithInfo with elapsed time
+func exchangeWithUpstream(u upstream.Upstream, req *dns.Msg) (*dns.Msg, *upstream.ExchangeInfo, int, error) {
+	startTime := time.Now()
+	reply, info, err := upstream.ExchangeWithInfo(u, req)
+	elapsed := int(time.Since(startTime) / time.Millisecond)
+	if log.GetLevel() < log.DEBUG {
+		return reply, info, elapsed, err
+	}
+
+	if err != nil {
+		log.Tracef("upstream %s failed to exchange %s in %d milliseconds. Cause: %s", u.Address(), req.Question[0].String(), elapsed, err)
+	} else {
+		log.Tracef("upstream %s successfully finished exchange of %s. Elapsed %d ms.", u.Address(), req.Question[0].String(), elapsed)
+	}
+	return reply, info, elapsed, err
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// addrUpstream is a test upstream with the specified address
+type addrUpstream struct {
+	addr string
+	fail bool // if true, Exchange returns an error
+}
+
+func (u *addrUpstream) Address() string { return u.addr }
+
+func (u *addrUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if u.fail {
+		return nil, errors.New("failed")
+	}
+	return new(dns.Msg).SetReply(m), nil
+}
+
+// countSelected sends n requests with the selector and counts the upstreams
+// that responded
+func countSelected(t *testing.T, s UpstreamSelector, upstreams []upstream.Upstream, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		_, u, err := s.Exchange(createTestMessage(), upstreams)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+		counts[u.Address()]++
+	}
+	return counts
+}
+
+func TestWeightedSelector(t *testing.T) {
+	upstreams := []upstream.Upstream{&addrUpstream{addr: "a"}, &addrUpstream{addr: "b"}, &addrUpstream{addr: "c"}}
+	s := NewWeightedSelector(map[string]int{"a": 5, "b": 2})
+
+	counts := countSelected(t, s, upstreams, 80)
+	assert.Equal(t, map[string]int{"a": 50, "b": 20, "c": 10}, counts)
+
+	// The rest of upstreams are tried if the chosen one fails
+	upstreams[0].(*addrUpstream).fail = true
+	counts = countSelected(t, s, upstreams, 80)
+	assert.Equal(t, 0, counts["a"])
+	assert.Equal(t, 80, counts["b"]+counts["c"])
+}
+
+func TestRTTSelector(t *testing.T) {
+	fast := &addrUpstream{addr: "fast"}
+	slow1 := &addrUpstream{addr: "slow1"}
+	slow2 := &addrUpstream{addr: "slow2"}
+	upstreams := []upstream.Upstream{slow1, fast, slow2}
+
+	s := NewRTTSelector().(*rttSelector)
+	s.rtt = map[string]int{"fast": 1, "slow1": 100, "slow2": 200}
+
+	// Most of the requests go to the fastest upstream, but the slow ones
+	// still get some of them
+	counts := countSelected(t, s, upstreams, 10*rttExploreEvery)
+	assert.Equal(t, 5, counts["slow1"])
+	assert.Equal(t, 5, counts["slow2"])
+	assert.Equal(t, 10*rttExploreEvery-10, counts["fast"])
+
+	// The failed upstreams get slower
+	fast.fail = true
+	_, u, err := s.Exchange(createTestMessage(), upstreams)
+	assert.Nil(t, err)
+	assert.NotEqual(t, fast, u)
+	assert.True(t, s.rtt["fast"] > 100)
+}
+
+func TestUpstreamSelections(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{&addrUpstream{addr: "a"}, &addrUpstream{addr: "b"}}
+	dnsProxy.UpstreamSelector = NewWeightedSelector(map[string]int{"a": 3})
+
+	for i := 0; i < 8; i++ {
+		d := &DNSContext{Req: createTestMessage()}
+		err := dnsProxy.Resolve(d)
+		if err != nil {
+			t.Fatalf("cannot resolve: %s", err)
+		}
+	}
+
+	assert.Equal(t, map[string]uint64{"a": 6, "b": 2}, dnsProxy.UpstreamSelections())
+}
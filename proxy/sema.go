@@ -5,9 +5,11 @@ import (
 )
 
 // semaphore is the semaphore interface.  acquire will block until the
-// resource can be acquired.  release never blocks.
+// resource can be acquired.  tryAcquire acquires the resource only if it's
+// available right away.  release never blocks.
 type semaphore interface {
 	acquire()
+	tryAcquire() (ok bool)
 	release()
 }
 
@@ -17,6 +19,9 @@ type noopSemaphore struct{}
 // acquire implements the semaphore interface for noopSemaphore.
 func (noopSemaphore) acquire() {}
 
+// tryAcquire implements the semaphore interface for noopSemaphore.
+func (noopSemaphore) tryAcquire() (ok bool) { return true }
+
 // release implements the semaphore interface for noopSemaphore.
 func (noopSemaphore) release() {}
 
@@ -36,6 +41,16 @@ func (c *chanSemaphore) acquire() {
 	c.c <- sig{}
 }
 
+// tryAcquire implements the semaphore interface for *chanSemaphore.
+func (c *chanSemaphore) tryAcquire() (ok bool) {
+	select {
+	case c.c <- sig{}:
+		return true
+	default:
+		return false
+	}
+}
+
 // release implements the semaphore interface for *chanSemaphore.
 func (c *chanSemaphore) release() {
 	select {
@@ -3,9 +3,11 @@ package proxy
 import (
 	"fmt"
 	"net"
+	"runtime/debug"
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
@@ -44,15 +46,15 @@ func (p *Proxy) startListeners() error {
 	}
 
 	for _, l := range p.udpListen {
-		go p.udpPacketLoop(l, p.requestGoroutinesSema)
+		p.serveUDP(l)
 	}
 
 	for _, l := range p.tcpListen {
-		go p.tcpPacketLoop(l, ProtoTCP, p.requestGoroutinesSema)
+		p.serveTCP(l, ProtoTCP)
 	}
 
 	for _, l := range p.tlsListen {
-		go p.tcpPacketLoop(l, ProtoTLS, p.requestGoroutinesSema)
+		p.serveTCP(l, ProtoTLS)
 	}
 
 	for i := range p.httpsServer {
@@ -76,6 +78,10 @@ func (p *Proxy) startListeners() error {
 
 // handleDNSRequest processes the incoming packet bytes and returns with an optional response packet.
 func (p *Proxy) handleDNSRequest(d *DNSContext) error {
+	metrics := p.getMetrics()
+	metrics.QueryStarted(d.Proto)
+	defer metrics.QueryFinished(d.Proto)
+
 	d.StartTime = time.Now()
 	p.logDNSMessage(d.Req)
 
@@ -84,11 +90,18 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) error {
 		return nil
 	}
 
+	p.processNSID(d)
+
+	if p.access != nil && !p.checkAccess(d) {
+		return nil
+	}
+
 	if p.BeforeRequestHandler != nil {
-		ok, err := p.BeforeRequestHandler(p, d)
+		ok, err := p.callBeforeRequestHandler(d)
 		if err != nil {
 			log.Error("Error in the BeforeRequestHandler: %s", err)
 			d.Res = p.genServerFailure(d.Req)
+			p.callResponseHandler(d, err)
 			p.respond(d)
 			return nil
 		}
@@ -98,9 +111,11 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) error {
 	}
 
 	// ratelimit based on IP only, protects CPU cycles and outbound connections
-	if d.Proto == ProtoUDP && p.isRatelimited(d.Addr) {
+	if p.isRatelimited(d.Addr) {
 		log.Tracef("Ratelimiting %v based on IP only", d.Addr)
-		return nil // do nothing, don't reply, we got ratelimited
+		metrics.QueryRateLimited(d.Proto)
+		p.respondRatelimited(d)
+		return nil
 	}
 
 	if len(d.Req.Question) != 1 {
@@ -108,42 +123,118 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) error {
 		d.Res = p.genServerFailure(d.Req)
 	}
 
-	// refuse ANY requests (anti-DDOS measure)
-	if p.RefuseAny && len(d.Req.Question) > 0 && d.Req.Question[0].Qtype == dns.TypeANY {
-		log.Tracef("Refusing type=ANY request")
-		d.Res = p.genNotImpl(d.Req)
+	// refuse or minimize ANY and other restricted requests (anti-DDOS measure)
+	if d.Res == nil {
+		p.restrictQtype(d)
 	}
 
 	var err error
 
 	if d.Res == nil {
-		if len(p.UpstreamConfig.Upstreams) == 0 {
+		p.upstreamsLock.RLock()
+		noUpstreams := len(p.UpstreamConfig.Upstreams) == 0
+		p.upstreamsLock.RUnlock()
+		if noUpstreams {
 			panic("SHOULD NOT HAPPEN: no default upstreams specified")
 		}
 
 		// execute the DNS request
 		// if there is a custom middleware configured, use it
-		if p.RequestHandler != nil {
-			err = p.RequestHandler(p, d)
-		} else {
-			err = p.Resolve(d)
-		}
-
+		err = p.callRequestHandler(d)
 		if err != nil {
 			err = errorx.Decorate(err, "talking to dnsUpstream failed")
 		}
 	}
 
+	// The responses that didn't come from Resolve, e.g. the ones set by
+	// BeforeRequestHandler or served from the cache, are passed to
+	// ResponseHandler here
+	p.callResponseHandler(d, err)
+
 	p.logDNSMessage(d.Res)
 	p.respond(d)
 	return err
 }
 
+// callBeforeRequestHandler calls BeforeRequestHandler, a panic in it is
+// returned as an error
+func (p *Proxy) callBeforeRequestHandler(d *DNSContext) (ok bool, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Error("Panic in the BeforeRequestHandler: %v\n%s", v, debug.Stack())
+			ok, err = false, fmt.Errorf("panic in the BeforeRequestHandler: %v", v)
+		}
+	}()
+
+	return p.BeforeRequestHandler(p, d)
+}
+
+// callRequestHandler calls RequestHandler, or Resolve if it's not set.  If
+// the handler panics, the client gets SERVFAIL.
+func (p *Proxy) callRequestHandler(d *DNSContext) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Error("Panic in the RequestHandler: %v\n%s", v, debug.Stack())
+			d.Res = p.genServerFailure(d.Req)
+			err = fmt.Errorf("panic in the RequestHandler: %v", v)
+		}
+	}()
+
+	if p.RequestHandler != nil {
+		return p.RequestHandler(p, d)
+	}
+	return p.Resolve(d)
+}
+
+// callResponseHandler calls ResponseHandler unless it has already been
+// called for the request, a panic in it is logged
+func (p *Proxy) callResponseHandler(d *DNSContext, err error) {
+	if p.ResponseHandler == nil || d.responseHandled {
+		return
+	}
+	d.responseHandled = true
+
+	defer func() {
+		if v := recover(); v != nil {
+			log.Error("Panic in the ResponseHandler: %v\n%s", v, debug.Stack())
+		}
+	}()
+
+	p.ResponseHandler(d, err)
+}
+
+// checkAccess checks if the client is allowed to use the proxy.  Queries from
+// disallowed clients are refused, or dropped if DropDisallowed is set.
+func (p *Proxy) checkAccess(d *DNSContext) bool {
+	allowed := p.access.isAllowed(d.Addr)
+	if p.AccessHandler != nil {
+		p.AccessHandler(d, allowed)
+	}
+	if allowed {
+		return true
+	}
+
+	if p.DropDisallowed {
+		log.Tracef("Dropping the request from disallowed client %s", d.Addr)
+		return false
+	}
+
+	log.Tracef("Refusing the request from disallowed client %s", d.Addr)
+	d.Res = p.genRefused(d.Req)
+	p.respond(d)
+	return false
+}
+
 // respond writes the specified response to the client (or does nothing if d.Res is empty)
 func (p *Proxy) respond(d *DNSContext) {
 	if d.Res == nil {
 		return
 	}
+	p.setNSID(d)
+	p.logQuery(d)
+
+	// The padding goes last, after the response is changed
+	p.padResponse(d)
 
 	// d.Conn can be nil in the case of a DOH request
 	if d.Conn != nil {
@@ -189,17 +280,117 @@ func isNonCriticalError(err error) (ok bool) {
 		strings.HasSuffix(err.Error(), "use of closed network connection")
 }
 
-// Set TTL value of all records according to our settings
+// Set TTL value of all records according to our settings.  The response is
+// cached for its lowest TTL, so the authority and additional sections are
+// changed too.  The TTL of a signed RRset isn't raised above the time its
+// RRSIG is valid for.  The negative caching TTL of NXDOMAIN and NODATA
+// responses (RFC 2308) is changed in the SOA record, see setNegativeTTL.
 func (p *Proxy) setMinMaxTTL(r *dns.Msg) {
-	for _, rr := range r.Answer {
-		originalTTL := rr.Header().Ttl
-		newTTL := respectTTLOverrides(originalTTL, p.CacheMinTTL, p.CacheMaxTTL)
+	if p.CacheMinTTL == 0 && p.CacheMaxTTL == 0 {
+		return
+	}
 
-		if originalTTL != newTTL {
-			log.Debug("Override TTL from %d to %d", originalTTL, newTTL)
-			rr.Header().Ttl = newTTL
+	now := time.Now()
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		validity := sigValidities(section, now)
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				// OPT record uses the TTL field for extended RCODE and flags
+				continue
+			}
+
+			originalTTL := h.Ttl
+			newTTL := respectTTLOverrides(originalTTL, p.CacheMinTTL, p.CacheMaxTTL)
+			if v, ok := validity[proxyutil.RRsetKeyOf(rr)]; ok && newTTL > originalTTL {
+				newTTL = maxTTL(originalTTL, minTTL(newTTL, v))
+			}
+
+			if originalTTL != newTTL {
+				log.Debug("Override TTL from %d to %d", originalTTL, newTTL)
+				h.Ttl = newTTL
+			}
 		}
 	}
+
+	if isNegative(r) {
+		p.setNegativeTTL(r)
+	}
+}
+
+// setNegativeTTL sets the negative caching TTL of the response, which is the
+// lowest of the SOA TTL and MINIMUM, to fall within the range of the TTL
+// overrides.  Both the TTL and MINIMUM of the SOA record are set to it unless
+// the SOA is signed, changing MINIMUM would break the signature then.
+func (p *Proxy) setNegativeTTL(r *dns.Msg) {
+	signed := false
+	var soa *dns.SOA
+	for _, rr := range r.Ns {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			soa = rr
+		case *dns.RRSIG:
+			signed = signed || rr.TypeCovered == dns.TypeSOA
+		}
+	}
+	if soa == nil || signed {
+		return
+	}
+
+	ttl := respectTTLOverrides(minTTL(soa.Hdr.Ttl, soa.Minttl), p.CacheMinTTL, p.CacheMaxTTL)
+	if soa.Hdr.Ttl != ttl || soa.Minttl != ttl {
+		log.Debug("Override negative TTL from %d/%d to %d", soa.Hdr.Ttl, soa.Minttl, ttl)
+		soa.Hdr.Ttl = ttl
+		soa.Minttl = ttl
+	}
+}
+
+// isNegative checks if the response is NXDOMAIN or NODATA
+func isNegative(r *dns.Msg) bool {
+	return r.Rcode == dns.RcodeNameError || (r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0)
+}
+
+// sigValidities returns the number of seconds the RRSIGs of the section's
+// RRsets remain valid for, the lowest one if there are several
+func sigValidities(section []dns.RR, now time.Time) map[proxyutil.RRsetKey]uint32 {
+	var validity map[proxyutil.RRsetKey]uint32
+	for _, rr := range section {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+
+		// The expiration time uses the serial number arithmetic (RFC 4034)
+		var v uint32
+		if left := int32(sig.Expiration - uint32(now.Unix())); left > 0 {
+			v = uint32(left)
+		}
+
+		if validity == nil {
+			validity = map[proxyutil.RRsetKey]uint32{}
+		}
+		key := proxyutil.RRsetKeyOf(sig)
+		if old, ok := validity[key]; !ok || v < old {
+			validity[key] = v
+		}
+	}
+	return validity
+}
+
+// minTTL returns the lower of the TTLs
+func minTTL(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// maxTTL returns the higher of the TTLs
+func maxTTL(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
 }
 
 func (p *Proxy) genServerFailure(request *dns.Msg) *dns.Msg {
@@ -217,6 +408,21 @@ func (p *Proxy) genNotImpl(request *dns.Msg) *dns.Msg {
 	return &resp
 }
 
+func (p *Proxy) genRefused(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetRcode(request, dns.RcodeRefused)
+	resp.RecursionAvailable = true
+	return &resp
+}
+
+func (p *Proxy) genTruncated(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetReply(request)
+	resp.Truncated = true
+	resp.RecursionAvailable = true
+	return &resp
+}
+
 func (p *Proxy) genNXDomain(req *dns.Msg) *dns.Msg {
 	resp := dns.Msg{}
 	resp.SetRcode(req, dns.RcodeNameError)
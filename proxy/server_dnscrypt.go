@@ -1,12 +1,22 @@
 package proxy
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnscrypt/v2/xsecretbox"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
 )
 
 func (p *Proxy) createDNSCryptListeners() error {
@@ -33,6 +43,454 @@ func (p *Proxy) createDNSCryptListeners() error {
 	return nil
 }
 
+// DNSCryptStamp returns the sdns:// stamp that DNSCrypt clients can use to
+// connect to the DNSCrypt server with the configuration rc listening on addr.
+// addr must be the address clients connect to, not the unspecified one.
+func DNSCryptStamp(rc dnscrypt.ResolverConfig, addr net.Addr) (string, error) {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		return "", fmt.Errorf("unsupported address type %T", addr)
+	}
+
+	if ip == nil || ip.IsUnspecified() {
+		return "", fmt.Errorf("DNSCrypt stamp requires a specific IP address: %s", addr)
+	}
+
+	stamp, err := rc.CreateStamp(net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		return "", errorx.Decorate(err, "couldn't create DNSCrypt stamp for %s", addr)
+	}
+
+	return stamp.String(), nil
+}
+
+// dnsCryptMinPacketSize is the size of the DNS header plus the shortest
+// question, the shorter packets are ignored
+const dnsCryptMinPacketSize = 12 + 5
+
+// dnsCryptServer serves DNSCrypt clients with one or more resolver
+// certificates.  dnscrypt.Server holds a single certificate, while rotating the
+// short-term key requires the queries encrypted for the previous certificates
+// to be accepted until they expire.
+type dnsCryptServer struct {
+	providerName string
+	handler      dnscrypt.Handler
+	requests     *sync.WaitGroup // the queries being handled, see Proxy.requests
+
+	mu    sync.RWMutex    // protects certs
+	certs []*dnsCryptCert // the last one is the current certificate
+}
+
+// dnsCryptCert is the resolver certificate with its TXT record data
+type dnsCryptCert struct {
+	cert *dnscrypt.Cert
+	txt  string
+}
+
+// newDNSCryptCert serializes the certificate
+func newDNSCryptCert(cert *dnscrypt.Cert) (*dnsCryptCert, error) {
+	b, err := cert.Serialize()
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't serialize DNSCrypt certificate")
+	}
+	return &dnsCryptCert{cert: cert, txt: packTxtString(b)}, nil
+}
+
+// newDNSCryptServer creates a new *dnsCryptServer with the certificate, the
+// queries are added to requests once they're read
+func newDNSCryptServer(providerName string, cert *dnscrypt.Cert, handler dnscrypt.Handler, requests *sync.WaitGroup) (*dnsCryptServer, error) {
+	c, err := newDNSCryptCert(cert)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsCryptServer{
+		providerName: dns.Fqdn(providerName),
+		handler:      handler,
+		requests:     requests,
+		certs:        []*dnsCryptCert{c},
+	}, nil
+}
+
+// validCerts returns the current certificate and the previous ones that are
+// still valid, the newest first
+func (s *dnsCryptServer) validCerts() []*dnsCryptCert {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	last := len(s.certs) - 1
+	certs := []*dnsCryptCert{s.certs[last]}
+	for i := last - 1; i >= 0; i-- {
+		if s.certs[i].cert.VerifyDate() {
+			certs = append(certs, s.certs[i])
+		}
+	}
+	return certs
+}
+
+// setCert makes cert the current certificate, the previous ones that are
+// still valid are kept
+func (s *dnsCryptServer) setCert(cert *dnscrypt.Cert) error {
+	c, err := newDNSCryptCert(cert)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.certs[len(s.certs)-1].cert
+	if cert.Serial <= current.Serial {
+		// The clients prefer the certificate with the highest serial
+		return fmt.Errorf("the serial of the new DNSCrypt certificate must be greater than %d", current.Serial)
+	}
+
+	certs := make([]*dnsCryptCert, 0, len(s.certs)+1)
+	for _, old := range s.certs {
+		if old.cert.VerifyDate() {
+			certs = append(certs, old)
+		}
+	}
+	s.certs = append(certs, c)
+	return nil
+}
+
+// decrypt decrypts the query with the certificate it's encrypted for.  The
+// certificates created with dnscrypt.ResolverConfig.CreateCert share the
+// client magic, so every certificate with the query's magic is tried.
+func (s *dnsCryptServer) decrypt(b []byte) (*dns.Msg, *dnscrypt.EncryptedQuery, *dnscrypt.Cert, error) {
+	err := dnscrypt.ErrInvalidClientMagic
+	for _, c := range s.validCerts() {
+		if !bytes.Equal(b[:len(c.cert.ClientMagic)], c.cert.ClientMagic[:]) {
+			continue
+		}
+
+		q := &dnscrypt.EncryptedQuery{
+			EsVersion:   c.cert.EsVersion,
+			ClientMagic: c.cert.ClientMagic,
+		}
+		var packet []byte
+		packet, err = q.Decrypt(b, c.cert.ResolverSk)
+		if err != nil {
+			continue
+		}
+
+		m := &dns.Msg{}
+		err = m.Unpack(packet)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return m, q, c.cert, nil
+	}
+	return nil, nil, nil, err
+}
+
+// encrypt encrypts the response to the query with the certificate's key
+func encryptDNSCrypt(m *dns.Msg, q *dnscrypt.EncryptedQuery, cert *dnscrypt.Cert) ([]byte, error) {
+	packet, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var sharedKey [32]byte
+	switch q.EsVersion {
+	case dnscrypt.XChacha20Poly1305:
+		sharedKey, err = xsecretbox.SharedKey(cert.ResolverSk, q.ClientPk)
+		if err != nil {
+			return nil, err
+		}
+	case dnscrypt.XSalsa20Poly1305:
+		box.Precompute(&sharedKey, &q.ClientPk, &cert.ResolverSk)
+	default:
+		return nil, dnscrypt.ErrEsVersion
+	}
+
+	r := &dnscrypt.EncryptedResponse{
+		EsVersion: q.EsVersion,
+		Nonce:     q.Nonce,
+	}
+	return r.Encrypt(packet, sharedKey)
+}
+
+// handleHandshake answers the TXT query for the certificates with all the
+// valid ones, the clients choose the one with the highest serial
+func (s *dnsCryptServer) handleHandshake(b []byte) ([]byte, error) {
+	m := &dns.Msg{}
+	err := m.Unpack(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.Question) != 1 || m.Response {
+		return nil, dnscrypt.ErrInvalidQuery
+	}
+	q := m.Question[0]
+	if q.Qtype != dns.TypeTXT || !strings.EqualFold(q.Name, s.providerName) {
+		return nil, dnscrypt.ErrInvalidQuery
+	}
+
+	reply := &dns.Msg{}
+	reply.SetReply(m)
+	for _, c := range s.validCerts() {
+		reply.Answer = append(reply.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeTXT,
+				Ttl:    60,
+				Class:  dns.ClassINET,
+			},
+			Txt: []string{c.txt},
+		})
+	}
+	return reply.Pack()
+}
+
+// serveDNS passes the decrypted query to the handler
+func (s *dnsCryptServer) serveDNS(rw dnscrypt.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) != 1 || r.Response {
+		log.Tracef("Invalid DNSCrypt query: %v", r)
+		return
+	}
+
+	err := s.handler.ServeDNS(rw, r)
+	if err != nil {
+		log.Tracef("error handling DNSCrypt request: %s", err)
+		_ = rw.WriteMsg(new(dns.Msg).SetRcode(r, dns.RcodeServerFailure))
+	}
+}
+
+// ServeUDP reads the DNSCrypt queries from l until it's closed
+func (s *dnsCryptServer) ServeUDP(l *net.UDPConn) error {
+	err := proxyutil.UDPSetOptions(l)
+	if err != nil {
+		return err
+	}
+	oobSize := proxyutil.UDPGetOOBSize()
+	b := make([]byte, dns.MaxMsgSize)
+
+	log.Info("Entering DNSCrypt UDP listening loop udp://%s", l.LocalAddr())
+	for {
+		n, localIP, addr, err := proxyutil.UDPRead(l, b, oobSize)
+		if n >= dnsCryptMinPacketSize {
+			s.handleUDPPacket(b[:n], l, localIP, addr)
+		}
+		if err != nil {
+			if proxyutil.IsConnClosed(err) {
+				log.Info("udpListen.ReadFrom() returned because we're reading from a closed connection, exiting loop")
+			} else {
+				log.Info("got error when reading from UDP listen: %s", err)
+			}
+			return nil
+		}
+	}
+}
+
+// handleUDPPacket handles the query or the certificate request, the packet
+// isn't referred to once it returns
+func (s *dnsCryptServer) handleUDPPacket(b []byte, l *net.UDPConn, localIP net.IP, addr *net.UDPAddr) {
+	m, q, cert, err := s.decrypt(b)
+	if err == nil {
+		rw := &dnsCryptUDPResponseWriter{
+			conn:       l,
+			remoteAddr: addr,
+			localIP:    localIP,
+			req:        m,
+			query:      q,
+			cert:       cert,
+		}
+		s.requests.Add(1)
+		go func() {
+			defer s.requests.Done()
+			s.serveDNS(rw, m)
+		}()
+		return
+	}
+
+	// Most likely it's the request for the certificates
+	reply, hsErr := s.handleHandshake(b)
+	if hsErr != nil {
+		log.Tracef("Failed to process DNSCrypt UDP packet len=%d: %s", len(b), hsErr)
+		return
+	}
+	_, _ = proxyutil.UDPWrite(reply, l, addr, localIP)
+}
+
+// ServeTCP accepts the DNSCrypt connections from l until it's closed
+func (s *dnsCryptServer) ServeTCP(l net.Listener) error {
+	log.Info("Entering DNSCrypt TCP listening loop tcp://%s", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if proxyutil.IsConnClosed(err) {
+				log.Info("tcpListen.Accept() returned because we're reading from a closed connection, exiting loop")
+			} else {
+				log.Info("got error when accepting DNSCrypt connection: %s", err)
+			}
+			return nil
+		}
+
+		go func() {
+			err := s.handleTCPConnection(conn)
+			if err != nil && err != io.EOF {
+				log.Tracef("error handling DNSCrypt TCP connection: %s", err)
+			}
+			_ = conn.Close()
+		}()
+	}
+}
+
+// handleTCPConnection handles the queries and the certificate requests from
+// the connection until it's closed
+func (s *dnsCryptServer) handleTCPConnection(conn net.Conn) error {
+	for {
+		b, err := proxyutil.ReadPrefixed(conn)
+		if err != nil {
+			return err
+		}
+		if len(b) < dnsCryptMinPacketSize {
+			return dnscrypt.ErrTooShort
+		}
+
+		m, q, cert, err := s.decrypt(b)
+		if err == nil {
+			rw := &dnsCryptTCPResponseWriter{
+				conn:  conn,
+				req:   m,
+				query: q,
+				cert:  cert,
+			}
+			s.requests.Add(1)
+			s.serveDNS(rw, m)
+			s.requests.Done()
+			continue
+		}
+
+		reply, hsErr := s.handleHandshake(b)
+		if hsErr != nil {
+			return hsErr
+		}
+		err = proxyutil.WritePrefixed(reply, conn)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dnsCryptUDPResponseWriter encrypts the responses to the UDP queries
+type dnsCryptUDPResponseWriter struct {
+	conn       *net.UDPConn
+	remoteAddr *net.UDPAddr
+	localIP    net.IP // the destination address of the query
+	req        *dns.Msg
+	query      *dnscrypt.EncryptedQuery
+	cert       *dnscrypt.Cert // the certificate the query is encrypted for
+}
+
+// type check
+var _ dnscrypt.ResponseWriter = &dnsCryptUDPResponseWriter{}
+
+// LocalAddr implements dnscrypt.ResponseWriter for *dnsCryptUDPResponseWriter
+func (w *dnsCryptUDPResponseWriter) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
+// RemoteAddr implements dnscrypt.ResponseWriter for *dnsCryptUDPResponseWriter
+func (w *dnsCryptUDPResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+// WriteMsg implements dnscrypt.ResponseWriter for *dnsCryptUDPResponseWriter
+func (w *dnsCryptUDPResponseWriter) WriteMsg(m *dns.Msg) error {
+	m.Truncate(proxyutil.DNSSize("udp", w.req))
+	b, err := encryptDNSCrypt(m, w.query, w.cert)
+	if err != nil {
+		return err
+	}
+	_, err = proxyutil.UDPWrite(b, w.conn, w.remoteAddr, w.localIP)
+	return err
+}
+
+// dnsCryptTCPResponseWriter encrypts the responses to the TCP queries
+type dnsCryptTCPResponseWriter struct {
+	conn  net.Conn
+	req   *dns.Msg
+	query *dnscrypt.EncryptedQuery
+	cert  *dnscrypt.Cert // the certificate the query is encrypted for
+}
+
+// type check
+var _ dnscrypt.ResponseWriter = &dnsCryptTCPResponseWriter{}
+
+// LocalAddr implements dnscrypt.ResponseWriter for *dnsCryptTCPResponseWriter
+func (w *dnsCryptTCPResponseWriter) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
+// RemoteAddr implements dnscrypt.ResponseWriter for *dnsCryptTCPResponseWriter
+func (w *dnsCryptTCPResponseWriter) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+// WriteMsg implements dnscrypt.ResponseWriter for *dnsCryptTCPResponseWriter
+func (w *dnsCryptTCPResponseWriter) WriteMsg(m *dns.Msg) error {
+	m.Truncate(proxyutil.DNSSize("tcp", w.req))
+	b, err := encryptDNSCrypt(m, w.query, w.cert)
+	if err != nil {
+		return err
+	}
+	return proxyutil.WritePrefixed(b, w.conn)
+}
+
+// packTxtString escapes the binary data for the TXT record the way
+// dns.TXT.Txt expects it
+func packTxtString(b []byte) string {
+	var out strings.Builder
+	out.Grow(3 * len(b))
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			out.WriteByte('\\')
+			out.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&out, "\\%03d", c)
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
+
+// RotateDNSCryptCert installs the new DNSCrypt resolver certificate without
+// restarting the proxy.  The certificate requests are answered with the new
+// certificate and the previous ones until they expire, the clients use the
+// one with the highest serial, so the serial of cert must be greater than the
+// current one's.  The queries encrypted for the previous certificates are
+// accepted until the certificates expire.
+func (p *Proxy) RotateDNSCryptCert(cert *dnscrypt.Cert) error {
+	if cert == nil {
+		return errors.New("no DNSCrypt certificate specified")
+	}
+
+	p.RLock()
+	s := p.dnsCryptServer
+	p.RUnlock()
+	if s == nil {
+		return errors.New("DNSCrypt is not configured")
+	}
+
+	err := s.setCert(cert)
+	if err != nil {
+		return err
+	}
+	log.Info("Installed DNSCrypt certificate %d", cert.Serial)
+	return nil
+}
+
 // dnsCryptHandler - dnscrypt.Handler implementation
 type dnsCryptHandler struct {
 	proxy *Proxy
@@ -3,10 +3,14 @@ package proxy
 import (
 	"fmt"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,9 +26,15 @@ func TestDNSCryptProxy(t *testing.T) {
 	}()
 
 	// Generate a DNS stamp
-	addr := fmt.Sprintf("%s:%d", listenIP, dnsProxy.Addr(ProtoDNSCrypt).(*net.UDPAddr).Port)
-	stamp, err := rc.CreateStamp(addr)
+	stampStr, err := DNSCryptStamp(rc, dnsProxy.Addr(ProtoDNSCrypt))
 	assert.Nil(t, err)
+	stamp, err := dnsstamps.NewServerStampFromString(stampStr)
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("%s:%d", listenIP, dnsProxy.Addr(ProtoDNSCrypt).(*net.UDPAddr).Port), stamp.ServerAddrStr)
+
+	// Unspecified addresses can't be used by clients
+	_, err = DNSCryptStamp(rc, &net.UDPAddr{IP: net.IPv4zero, Port: 443})
+	assert.NotNil(t, err)
 
 	// Test DNSCrypt proxy on both UDP and TCP
 	checkDNSCryptProxy(t, "udp", stamp)
@@ -48,3 +58,105 @@ func checkDNSCryptProxy(t *testing.T, proto string, stamp dnsstamps.ServerStamp)
 	assert.Nil(t, err)
 	assertResponse(t, reply)
 }
+
+// createRotatedCert creates the certificate with the new short-term key and
+// the serial
+func createRotatedCert(t *testing.T, rc dnscrypt.ResolverConfig, serial uint32) *dnscrypt.Cert {
+	rc.ResolverSk = ""
+	rc.ResolverPk = ""
+	cert, err := rc.CreateCert()
+	if err != nil {
+		t.Fatalf("cannot create DNSCrypt certificate: %s", err)
+	}
+
+	privateKey, err := dnscrypt.HexDecodeKey(rc.PrivateKey)
+	if err != nil {
+		t.Fatalf("cannot decode DNSCrypt provider key: %s", err)
+	}
+	cert.Serial = serial
+	cert.Sign(privateKey)
+	return cert
+}
+
+func TestDNSCryptCertRotation(t *testing.T) {
+	dnsProxy, rc := createTestDNSCryptProxy(t)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{
+		upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+			resp := new(dns.Msg).SetReply(m)
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + " 60 IN A 8.8.8.8")}
+			return resp, nil
+		}),
+	}
+	assert.NotNil(t, dnsProxy.RotateDNSCryptCert(createRotatedCert(t, rc, dnsProxy.DNSCryptResolverCert.Serial+1)))
+
+	err := dnsProxy.Start()
+	assert.Nil(t, err)
+	defer func() {
+		assert.Nil(t, dnsProxy.Stop())
+	}()
+
+	stampStr, err := DNSCryptStamp(rc, dnsProxy.Addr(ProtoDNSCrypt))
+	assert.Nil(t, err)
+	stamp, err := dnsstamps.NewServerStampFromString(stampStr)
+	assert.Nil(t, err)
+
+	clients := map[string]*dnscrypt.Client{}
+	oldInfo := map[string]*dnscrypt.ResolverInfo{}
+	for _, proto := range []string{"udp", "tcp"} {
+		clients[proto] = &dnscrypt.Client{Timeout: defaultTimeout, Net: proto}
+		oldInfo[proto], err = clients[proto].DialStamp(stamp)
+		if err != nil {
+			t.Fatalf("cannot fetch DNSCrypt certificate over %s: %s", proto, err)
+		}
+	}
+
+	// The serial must grow so that the clients switch to the new certificate
+	oldSerial := dnsProxy.DNSCryptResolverCert.Serial
+	assert.NotNil(t, dnsProxy.RotateDNSCryptCert(createRotatedCert(t, rc, oldSerial)))
+	assert.NotNil(t, dnsProxy.RotateDNSCryptCert(nil))
+	newCert := createRotatedCert(t, rc, oldSerial+1)
+	assert.Nil(t, dnsProxy.RotateDNSCryptCert(newCert))
+
+	for proto, c := range clients {
+		// The queries encrypted for the previous certificate are still
+		// accepted
+		reply, err := c.Exchange(createTestMessage(), oldInfo[proto])
+		if err != nil {
+			t.Fatalf("cannot exchange with the old certificate over %s: %s", proto, err)
+		}
+		assertResponse(t, reply)
+
+		ri, err := c.DialStamp(stamp)
+		if err != nil {
+			t.Fatalf("cannot fetch DNSCrypt certificate over %s: %s", proto, err)
+		}
+		assert.Equal(t, newCert.Serial, ri.ResolverCert.Serial)
+		assert.Equal(t, newCert.ResolverPk, ri.ResolverCert.ResolverPk)
+		reply, err = c.Exchange(createTestMessage(), ri)
+		if err != nil {
+			t.Fatalf("cannot exchange with the new certificate over %s: %s", proto, err)
+		}
+		assertResponse(t, reply)
+	}
+}
+
+func TestDNSCryptServerExpiredCerts(t *testing.T) {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	assert.Nil(t, err)
+	expired := createRotatedCert(t, rc, 1)
+	s, err := newDNSCryptServer(rc.ProviderName, expired, nil, &sync.WaitGroup{})
+	assert.Nil(t, err)
+
+	// The current certificate is served even once it's expired
+	now := uint32(time.Now().Unix())
+	expired.NotBefore, expired.NotAfter = now-7200, now-3600
+	assert.Len(t, s.validCerts(), 1)
+
+	assert.Nil(t, s.setCert(createRotatedCert(t, rc, 2)))
+	assert.Nil(t, s.setCert(createRotatedCert(t, rc, 3)))
+	certs := s.validCerts()
+	if assert.Len(t, certs, 2) {
+		assert.Equal(t, uint32(3), certs[0].cert.Serial)
+		assert.Equal(t, uint32(2), certs[1].cert.Serial)
+	}
+}
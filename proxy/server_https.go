@@ -3,6 +3,7 @@ package proxy
 import (
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -28,6 +29,7 @@ func (p *Proxy) createHTTPSListeners() error {
 			Handler:           p,
 			ReadHeaderTimeout: defaultTimeout,
 			WriteTimeout:      defaultTimeout,
+			ConnState:         p.countHTTPSConn,
 		}
 		p.httpsServer = append(p.httpsServer, srv)
 	}
@@ -35,6 +37,16 @@ func (p *Proxy) createHTTPSListeners() error {
 	return nil
 }
 
+// countHTTPSConn reports the opened and closed HTTPS connections to Metrics
+func (p *Proxy) countHTTPSConn(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		p.getMetrics().ConnectionOpened(ProtoHTTPS)
+	case http.StateHijacked, http.StateClosed:
+		p.getMetrics().ConnectionClosed(ProtoHTTPS)
+	}
+}
+
 // serveHttps starts the HTTPS server
 func (p *Proxy) listenHTTPS(srv *http.Server, l net.Listener) {
 	log.Info("Listening to DNS-over-HTTPS on %s", l.Addr())
@@ -52,6 +64,8 @@ func (p *Proxy) listenHTTPS(srv *http.Server, l net.Listener) {
 // http.StatusBadRequest - if there is no DNS request data
 // http.StatusUnsupportedMediaType - if request content type is not application/dns-message
 // http.StatusMethodNotAllowed - if request method is not GET or POST
+// http.StatusRequestEntityTooLarge - if the DNS request is larger than dns.MaxMsgSize
+// The proxy can be mounted on an existing http.ServeMux since it's an http.Handler
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("Incoming HTTPS request on %s", r.URL)
 
@@ -75,7 +89,8 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		buf, err = ioutil.ReadAll(r.Body)
+		// Read one byte more than allowed to detect messages that are too large
+		buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
 		if err != nil {
 			log.Tracef("Cannot read the request body: %s", err)
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -88,6 +103,12 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(buf) > dns.MaxMsgSize {
+		log.Tracef("DNS request is too large: %d bytes", len(buf))
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
 	msg := new(dns.Msg)
 	if err = msg.Unpack(buf); err != nil {
 		log.Tracef("msg.Unpack: %s", err)
@@ -95,6 +116,9 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	p.requests.Add(1)
+	defer p.requests.Done()
+
 	addr, _ := p.remoteAddr(r)
 
 	d := &DNSContext{
@@ -111,8 +135,15 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Get a client IP address from HTTP headers that proxy servers may set
-func getIPFromHTTPRequest(r *http.Request) net.IP {
+// Get a client IP address from HTTP headers that proxy servers may set.  The
+// headers are only used if the request comes from one of the trusted proxies,
+// the X-Forwarded-For addresses are checked from the right-most one, so that
+// the address is the one the last trusted proxy has got the request from.
+func getIPFromHTTPRequest(r *http.Request, peer net.IP, trusted ipRanges) net.IP {
+	if !trusted.contains(peer) {
+		return nil
+	}
+
 	names := []string{
 		"CF-Connecting-IP", "True-Client-IP", // set by CloudFlare servers
 		"X-Real-IP",
@@ -125,11 +156,18 @@ func getIPFromHTTPRequest(r *http.Request) net.IP {
 		}
 	}
 
-	s := r.Header.Get("X-Forwarded-For")
-	s = splitNext(&s, ',') // get left-most IP address
-	ip := net.ParseIP(s)
-	if ip != nil {
-		return ip
+	var forwarded []net.IP
+	for s := r.Header.Get("X-Forwarded-For"); s != ""; {
+		ip := net.ParseIP(splitNext(&s, ','))
+		if ip == nil {
+			return nil
+		}
+		forwarded = append(forwarded, ip)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if i == 0 || !trusted.contains(forwarded[i]) {
+			return forwarded[i]
+		}
 	}
 
 	return nil
@@ -148,10 +186,29 @@ func (p *Proxy) respondHTTPS(d *DNSContext) error {
 
 	w.Header().Set("Server", "AdGuard DNS")
 	w.Header().Set("Content-Type", "application/dns-message")
+	if ttl, ok := responseMaxAge(resp); ok {
+		// The response must not be cached longer than its records (RFC 8484, 5.1)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
 	_, err = w.Write(bytes)
 	return err
 }
 
+// responseMaxAge returns the HTTP freshness lifetime of the DNS response,
+// which is the lowest TTL of its records.  ok is false if the response has no
+// records, or it's a failure that must not be cached.
+func responseMaxAge(resp *dns.Msg) (ttl uint32, ok bool) {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+
+	if len(resp.Answer) == 0 && len(resp.Ns) == 0 {
+		return 0, false
+	}
+
+	return findLowestTTL(resp), true
+}
+
 func (p *Proxy) remoteAddr(r *http.Request) (net.Addr, error) {
 	host, port, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
@@ -163,14 +220,14 @@ func (p *Proxy) remoteAddr(r *http.Request) (net.Addr, error) {
 		return nil, err
 	}
 
-	ip := getIPFromHTTPRequest(r)
-	if ip != nil {
-		log.Tracef("Using IP address from HTTP request: %s", ip)
-	} else {
-		ip = net.ParseIP(host)
-		if ip == nil {
-			return nil, fmt.Errorf("invalid IP: %s", host)
-		}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP: %s", host)
+	}
+
+	if forwarded := getIPFromHTTPRequest(r, ip, p.trustedProxies); forwarded != nil {
+		log.Tracef("Using IP address from HTTP request: %s", forwarded)
+		ip = forwarded
 	}
 
 	return &net.TCPAddr{IP: ip, Port: portValue}, nil
@@ -5,11 +5,14 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -18,6 +21,7 @@ func TestHttpsProxy(t *testing.T) {
 	// Prepare the proxy server
 	serverConfig, caPem := createServerTLSConfig(t)
 	dnsProxy := createTestProxy(t, serverConfig)
+	dnsProxy.TrustedProxies = []string{"127.0.0.1"}
 
 	// Start listening
 	err := dnsProxy.Start()
@@ -78,3 +82,91 @@ func TestHttpsProxy(t *testing.T) {
 
 	assertResponse(t, reply)
 }
+
+func TestHttpsHandler(t *testing.T) {
+	dnsProxy := &Proxy{}
+	dnsProxy.UpstreamConfig = &UpstreamConfig{
+		Upstreams: []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+			res := new(dns.Msg).SetReply(m)
+			for _, ttl := range []uint32{60, 30} {
+				res.Answer = append(res.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+					A:   net.IPv4(8, 8, 8, 8),
+				})
+			}
+			return res, nil
+		})},
+	}
+	assert.Nil(t, dnsProxy.Init())
+
+	// The proxy can be mounted on any mux
+	mux := http.NewServeMux()
+	mux.Handle("/dns-query", dnsProxy)
+
+	buf, err := createTestMessage().Pack()
+	assert.Nil(t, err)
+
+	// GET request
+	req := httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 127.0.0.1")
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/dns-message", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "max-age=30", rw.Header().Get("Cache-Control"))
+
+	reply := &dns.Msg{}
+	assert.Nil(t, reply.Unpack(rw.Body.Bytes()))
+	assert.Len(t, reply.Answer, 2)
+
+	// Wrong content type
+	req = httptest.NewRequest("POST", "/dns-query", bytes.NewReader(buf))
+	req.Header.Set("Content-Type", "text/plain")
+	rw = httptest.NewRecorder()
+	mux.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rw.Code)
+
+	// The message is too large
+	req = httptest.NewRequest("POST", "/dns-query", bytes.NewReader(make([]byte, dns.MaxMsgSize+1)))
+	req.Header.Set("Content-Type", "application/dns-message")
+	rw = httptest.NewRecorder()
+	mux.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+}
+
+func TestHttpsRemoteAddr(t *testing.T) {
+	dnsProxy := &Proxy{}
+	var err error
+	dnsProxy.trustedProxies, err = newIPRanges([]string{"10.0.0.1", "192.168.0.0/16"})
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		name    string
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Real-IP": "1.2.3.4"}, "192.0.2.1"},
+		{"trusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "1.2.3.4"},
+		{"real_ip", "10.0.0.1:1234", map[string]string{"X-Real-IP": "1.2.3.4"}, "1.2.3.4"},
+		{"no_headers", "10.0.0.1:1234", nil, "10.0.0.1"},
+		// The left-most addresses are set by the client, only the ones added
+		// by the trusted proxies are used
+		{"chain", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "5.6.7.8, 1.2.3.4, 192.168.1.1"}, "1.2.3.4"},
+		{"all_trusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "192.168.1.2, 192.168.1.1"}, "192.168.1.2"},
+		{"invalid", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, bad"}, "10.0.0.1"},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/dns-query", nil)
+		req.RemoteAddr = tc.peer
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		addr, err := dnsProxy.remoteAddr(req)
+		if assert.Nil(t, err, tc.name) {
+			assert.Equal(t, tc.want, addr.(*net.TCPAddr).IP.String(), tc.name)
+		}
+	}
+}
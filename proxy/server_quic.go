@@ -52,6 +52,8 @@ func (p *Proxy) quicPacketLoop(l quic.Listener, requestGoroutinesSema semaphore)
 				log.Info("got error when reading from QUIC listen: %s", err)
 			}
 			break
+		} else if p.isStopping() {
+			_ = session.CloseWithError(0, "")
 		} else {
 			requestGoroutinesSema.acquire()
 			go func() {
@@ -67,6 +69,10 @@ func (p *Proxy) quicPacketLoop(l quic.Listener, requestGoroutinesSema semaphore)
 //
 // See also the comment on Proxy.requestGoroutinesSema.
 func (p *Proxy) handleQUICSession(session quic.Session, requestGoroutinesSema semaphore) {
+	metrics := p.getMetrics()
+	metrics.ConnectionOpened(ProtoQUIC)
+	defer metrics.ConnectionClosed(ProtoQUIC)
+
 	for {
 		// The stub to resolver DNS traffic follows a simple pattern in which
 		// the client sends a query, and the server provides a response.  This
@@ -85,6 +91,12 @@ func (p *Proxy) handleQUICSession(session quic.Session, requestGoroutinesSema se
 			return
 		}
 
+		// The new queries aren't read once the proxy is stopping
+		if p.isStopping() {
+			_ = stream.Close()
+			continue
+		}
+
 		requestGoroutinesSema.acquire()
 		go func() {
 			p.handleQUICStream(stream, session)
@@ -97,13 +109,9 @@ func (p *Proxy) handleQUICSession(session quic.Session, requestGoroutinesSema se
 // handleQUICStream reads DNS queries from the stream, processes them,
 // and writes back the responses
 func (p *Proxy) handleQUICStream(stream quic.Stream, session quic.Session) {
-	var buf []byte
-	buf = p.bytesPool.Get().([]byte)
-
-	// Linter says that the argument needs to be pointer-like
-	// But it's already pointer-like
-	// nolint
-	defer p.bytesPool.Put(buf)
+	bufPtr := p.bytesPool.Get().(*[]byte)
+	defer p.bytesPool.Put(bufPtr)
+	buf := *bufPtr
 
 	// One query -- one stream
 	// The client MUST send the DNS query over the selected stream, and MUST
@@ -131,6 +139,9 @@ func (p *Proxy) handleQUICStream(stream quic.Stream, session quic.Session) {
 		return
 	}
 
+	p.requests.Add(1)
+	defer p.requests.Done()
+
 	msg := dns.Msg{}
 	err = msg.Unpack(buf)
 	if err != nil {
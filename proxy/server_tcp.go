@@ -3,6 +3,8 @@ package proxy
 import (
 	"crypto/tls"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
@@ -13,37 +15,140 @@ import (
 
 func (p *Proxy) createTCPListeners() error {
 	for _, a := range p.TCPListenAddr {
-		log.Printf("Creating a TCP server socket")
-		tcpListen, err := net.ListenTCP("tcp", a)
+		tcpListen, err := p.tcpCreate(a)
 		if err != nil {
-			return errorx.Decorate(err, "couldn't listen to TCP socket")
+			return err
 		}
 		p.tcpListen = append(p.tcpListen, tcpListen)
-		log.Printf("Listening to tcp://%s", tcpListen.Addr())
 	}
 	return nil
 }
 
+// tcpCreate creates a TCP listener
+func (p *Proxy) tcpCreate(a *net.TCPAddr) (net.Listener, error) {
+	log.Printf("Creating a TCP server socket")
+	tcpListen, err := net.ListenTCP("tcp", a)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't listen to TCP socket")
+	}
+	log.Printf("Listening to tcp://%s", tcpListen.Addr())
+	return tcpListen, nil
+}
+
 func (p *Proxy) createTLSListeners() error {
 	for _, a := range p.TLSListenAddr {
-		log.Printf("Creating a TLS server socket")
-		tcpListen, err := net.ListenTCP("tcp", a)
+		l, err := p.tlsCreate(a)
 		if err != nil {
-			return errorx.Decorate(err, "could not start TLS listener")
+			return err
 		}
-		l := tls.NewListener(tcpListen, p.TLSConfig)
 		p.tlsListen = append(p.tlsListen, l)
-		log.Printf("Listening to tls://%s", l.Addr())
 	}
 	return nil
 }
 
+// tlsCreate creates a TLS listener
+func (p *Proxy) tlsCreate(a *net.TCPAddr) (net.Listener, error) {
+	log.Printf("Creating a TLS server socket")
+	tcpListen, err := net.ListenTCP("tcp", a)
+	if err != nil {
+		return nil, errorx.Decorate(err, "could not start TLS listener")
+	}
+	l := &tlsListener{Listener: tls.NewListener(tcpListen, p.TLSConfig), tcp: tcpListen}
+	log.Printf("Listening to tls://%s", l.Addr())
+	return l, nil
+}
+
+// tlsListener is the TLS listener that keeps its TCP listener, so that it can
+// stop accepting the connections
+type tlsListener struct {
+	net.Listener
+	tcp *net.TCPListener
+}
+
+// SetDeadline sets the deadline of the TCP listener
+func (l *tlsListener) SetDeadline(t time.Time) error { return l.tcp.SetDeadline(t) }
+
+// tcpConnLimiter limits the number of the connections a TCP or TLS listener
+// handles at the same time
+type tcpConnLimiter struct {
+	slots   chan struct{} // a token for every handled connection, nil if not limited
+	waiting int32         // number of the connections waiting for a slot, accessed atomically
+	backlog int32         // maximum number of the waiting connections
+	timeout time.Duration // how long a connection waits for a slot
+}
+
+// newTCPConnLimiter creates a new *tcpConnLimiter for the proxy settings
+func (p *Proxy) newTCPConnLimiter() *tcpConnLimiter {
+	l := &tcpConnLimiter{backlog: int32(p.TCPAcceptBacklog), timeout: p.tcpIdleTimeout()}
+	if p.MaxTCPConnections > 0 {
+		l.slots = make(chan struct{}, p.MaxTCPConnections)
+	}
+	return l
+}
+
+// acquire takes a free slot, it returns false if there is none
+func (l *tcpConnLimiter) acquire() bool {
+	if l.slots == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueue reserves a place in the backlog, it returns false if it's full
+func (l *tcpConnLimiter) enqueue() bool {
+	if atomic.AddInt32(&l.waiting, 1) > l.backlog {
+		atomic.AddInt32(&l.waiting, -1)
+		return false
+	}
+	return true
+}
+
+// wait waits for a free slot for the connection in the backlog, it returns
+// false if there was none in time
+func (l *tcpConnLimiter) wait() bool {
+	defer atomic.AddInt32(&l.waiting, -1)
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// release frees the slot
+func (l *tcpConnLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// tcpIdleTimeout returns TCPIdleTimeout or the default one
+func (p *Proxy) tcpIdleTimeout() time.Duration {
+	if p.TCPIdleTimeout > 0 {
+		return p.TCPIdleTimeout
+	}
+	return defaultTimeout
+}
+
 // tcpPacketLoop listens for incoming TCP packets.  proto must be either "tcp"
-// or "tls".
+// or "tls".  The connections being handled are tracked by t.
 //
 // See also the comment on Proxy.requestGoroutinesSema.
-func (p *Proxy) tcpPacketLoop(l net.Listener, proto string, requestGoroutinesSema semaphore) {
+func (p *Proxy) tcpPacketLoop(l net.Listener, proto string, t *listenerTracker, requestGoroutinesSema semaphore) {
 	log.Printf("Entering the %s listener loop on %s", proto, l.Addr())
+	defer close(t.done)
+
+	limiter := p.newTCPConnLimiter()
 	for {
 		clientConn, err := l.Accept()
 
@@ -55,40 +160,91 @@ func (p *Proxy) tcpPacketLoop(l net.Listener, proto string, requestGoroutinesSem
 			}
 			break
 		} else {
-			requestGoroutinesSema.acquire()
+			// The connections over the limit wait in the backlog, if any,
+			// so that the accept loop isn't blocked
+			queued := false
+			if !limiter.acquire() {
+				if !limiter.enqueue() {
+					log.Tracef("Too many %s connections, closing %s", proto, clientConn.RemoteAddr())
+					p.connectionRejected(proto)
+					_ = clientConn.Close()
+					continue
+				}
+				queued = true
+			}
+
+			// The connection doesn't take requestGoroutinesSema, its
+			// queries do, so that the idle connections can't exhaust it
+			t.handlers.Add(1)
 			go func() {
-				p.handleTCPConnection(clientConn, proto)
-				requestGoroutinesSema.release()
+				defer t.handlers.Done()
+
+				if queued && !limiter.wait() {
+					log.Tracef("No free slot for the %s connection %s, closing it", proto, clientConn.RemoteAddr())
+					p.connectionRejected(proto)
+					_ = clientConn.Close()
+					return
+				}
+
+				p.handleTCPConnection(clientConn, proto, t, requestGoroutinesSema)
+
+				// Free the slot before closing so that the client could
+				// re-connect right away
+				limiter.release()
+				_ = clientConn.Close()
 			}()
 		}
 	}
 }
 
 // handleTCPConnection starts a loop that handles an incoming TCP connection
-// proto is either "tcp" or "tls"
-func (p *Proxy) handleTCPConnection(conn net.Conn, proto string) {
+// proto is either "tcp" or "tls".  The caller closes the connection.  The loop
+// stops reading the queries once the listener is being removed.  Every query
+// takes requestGoroutinesSema while it's handled, see
+// Proxy.requestGoroutinesSema.
+func (p *Proxy) handleTCPConnection(conn net.Conn, proto string, t *listenerTracker, requestGoroutinesSema semaphore) {
 	log.Tracef("Start handling the new %s connection %s", proto, conn.RemoteAddr())
-	defer conn.Close()
 
-	for {
+	t.addConn(conn)
+	defer t.removeConn(conn)
+
+	metrics := p.getMetrics()
+	metrics.ConnectionOpened(proto)
+	defer metrics.ConnectionClosed(proto)
+
+	// The pipelined queries are handled concurrently, the next query isn't
+	// read until there is a free slot
+	var pipeline chan struct{}
+	if p.MaxPipelinedQueries > 1 {
+		pipeline = make(chan struct{}, p.MaxPipelinedQueries)
+	}
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	idleTimeout := p.tcpIdleTimeout()
+	for queries := 0; p.MaxQueriesPerConnection <= 0 || queries < p.MaxQueriesPerConnection; queries++ {
 		p.RLock()
 		if !p.started {
+			p.RUnlock()
 			return
 		}
 		p.RUnlock()
 
-		conn.SetDeadline(time.Now().Add(defaultTimeout)) //nolint
-		packet, err := proxyutil.ReadPrefixed(conn)
-		if err != nil {
-			return
+		if pipeline != nil {
+			pipeline <- struct{}{}
 		}
 
-		msg := &dns.Msg{}
-		err = msg.Unpack(packet)
-		if err != nil {
-			log.Info("error handling TCP packet: %s", err)
+		// The listener might be removed after the deadline is set, it
+		// interrupts the read then
+		conn.SetReadDeadline(time.Now().Add(idleTimeout)) //nolint
+		if t.isClosing() || p.isStopping() {
 			return
 		}
+		msg, ok := p.readTCPMsg(conn)
+		if !ok {
+			return
+		}
+		p.requests.Add(1)
 
 		d := &DNSContext{
 			Proto: proto,
@@ -97,11 +253,58 @@ func (p *Proxy) handleTCPConnection(conn net.Conn, proto string) {
 			Conn:  conn,
 		}
 
-		err = p.handleDNSRequest(d)
-		if err != nil {
-			log.Tracef("error handling DNS (%s) request: %s", d.Proto, err)
+		// The next query isn't read until MaxGoroutines have a free slot
+		requestGoroutinesSema.acquire()
+		if pipeline == nil {
+			p.handleTCPRequest(d)
+			requestGoroutinesSema.release()
+			continue
 		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				requestGoroutinesSema.release()
+				<-pipeline
+				wg.Done()
+			}()
+
+			p.handleTCPRequest(d)
+		}()
+	}
+
+	log.Tracef("Too many queries on the %s connection %s, closing it", proto, conn.RemoteAddr())
+}
+
+// handleTCPRequest handles the query received over the TCP (or TLS)
+// connection, the query has been added to Proxy.requests once it's read
+func (p *Proxy) handleTCPRequest(d *DNSContext) {
+	defer p.requests.Done()
+
+	err := p.handleDNSRequest(d)
+	if err != nil {
+		log.Tracef("error handling DNS (%s) request: %s", d.Proto, err)
+	}
+}
+
+// readTCPMsg reads the next query from the TCP (or TLS) connection, ok is false
+// if the connection must be closed
+func (p *Proxy) readTCPMsg(conn net.Conn) (msg *dns.Msg, ok bool) {
+	bufPtr := p.bytesPool.Get().(*[]byte)
+	defer p.bytesPool.Put(bufPtr)
+	buf := *bufPtr
+
+	packet, err := proxyutil.ReadPrefixedBuffer(conn, buf)
+	if err != nil {
+		return nil, false
 	}
+
+	msg, err = proxyutil.UnpackMsg(packet)
+	if err != nil {
+		log.Info("error handling TCP packet: %s", err)
+		return nil, false
+	}
+	return msg, true
 }
 
 // Writes a response to the TCP (or TLS) client
@@ -109,13 +312,19 @@ func (p *Proxy) respondTCP(d *DNSContext) error {
 	resp := d.Res
 	conn := d.Conn
 
-	bytes, err := resp.Pack()
+	bufPtr := p.bytesPool.Get().(*[]byte)
+	defer p.bytesPool.Put(bufPtr)
+	buf := *bufPtr
+
+	bytes, err := proxyutil.PackPrefixed(resp, buf)
 	if err != nil {
 		return errorx.Decorate(err, "couldn't convert message into wire format: %s", resp.String())
 	}
 
-	err = proxyutil.WritePrefixed(bytes, conn)
-
+	// The pipelined responses are written concurrently, but every Write is
+	// atomic
+	conn.SetWriteDeadline(time.Now().Add(defaultTimeout)) //nolint
+	_, err = conn.Write(bytes)
 	if proxyutil.IsConnClosed(err) {
 		return err
 	}
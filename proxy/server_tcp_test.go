@@ -3,9 +3,16 @@ package proxy
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/metrics"
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestTcpProxy(t *testing.T) {
@@ -64,3 +71,257 @@ func TestTlsProxy(t *testing.T) {
 		t.Fatalf("cannot stop the DNS proxy: %s", err)
 	}
 }
+
+func TestTlsProxyLimits(t *testing.T) {
+	// Prepare the proxy server
+	serverConfig, _ := createServerTLSConfig(t)
+	dnsProxy := createTestProxy(t, serverConfig)
+	dnsProxy.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{upstream.NullUpstream()}}
+	dnsProxy.MaxTCPConnections = 1
+	dnsProxy.MaxQueriesPerConnection = 2
+
+	// Start listening
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	// Use the DoT upstream from this module as the client.  It re-connects
+	// when the proxy closes the connection after two queries.
+	addr := dnsProxy.Addr(ProtoTLS)
+	u, err := upstream.AddressToUpstream("tls://"+addr.String(), upstream.Options{
+		Timeout:            defaultTimeout,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create the DoT upstream: %s", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		req := createTestMessage()
+		res, err := u.Exchange(req)
+		if err != nil {
+			t.Fatalf("error in request #%d: %s", i, err)
+		}
+		assert.Equal(t, req.Id, res.Id)
+	}
+
+	// The connection kept by the upstream takes the only slot, so a new one
+	// is closed right away
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+// waitFor checks the condition every 10ms until it's true or the timeout
+// passes
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestTcpProxyIdleTimeout(t *testing.T) {
+	const idleTimeout = time.Second
+	const count = 20
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{upstream.NullUpstream()}}
+	dnsProxy.TCPIdleTimeout = idleTimeout
+	counters := &metrics.Counters{}
+	dnsProxy.Metrics = counters
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	// Open many connections and leave them idle
+	addr := dnsProxy.Addr(ProtoTCP).String()
+	conns := make([]net.Conn, count)
+	for i := range conns {
+		conns[i], err = net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("cannot connect to the proxy: %s", err)
+		}
+		defer conns[i].Close()
+	}
+	assert.True(t, waitFor(idleTimeout/2, func() bool {
+		return counters.Snapshot().Connections[ProtoTCP] == count
+	}))
+
+	// All of them are closed by the proxy after the idle timeout
+	for _, conn := range conns {
+		_ = conn.SetReadDeadline(time.Now().Add(3 * idleTimeout))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	}
+	assert.True(t, waitFor(idleTimeout, func() bool {
+		return counters.Snapshot().Connections[ProtoTCP] == 0
+	}))
+}
+
+func TestTcpProxyAcceptBacklog(t *testing.T) {
+	const idleTimeout = 300 * time.Millisecond
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{upstream.NullUpstream()}}
+	dnsProxy.TCPIdleTimeout = idleTimeout
+	dnsProxy.MaxTCPConnections = 2
+	dnsProxy.TCPAcceptBacklog = 1
+	counters := &metrics.Counters{}
+	dnsProxy.Metrics = counters
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	addr := dnsProxy.Addr(ProtoTCP).String()
+	dial := func() *dns.Conn {
+		conn, err := dns.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("cannot connect to the proxy: %s", err)
+		}
+		return conn
+	}
+
+	// The first two connections take the slots
+	first := dial()
+	defer first.Close()
+	second := dial()
+	defer second.Close()
+	assert.True(t, waitFor(idleTimeout/2, func() bool {
+		return counters.Snapshot().Connections[ProtoTCP] == 2
+	}))
+
+	// The third one waits in the backlog, and the fourth one is closed right
+	// away
+	queued := dial()
+	defer queued.Close()
+	rejected := dial()
+	defer rejected.Close()
+	_ = rejected.SetReadDeadline(time.Now().Add(idleTimeout / 2))
+	_, err = rejected.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, uint64(1), counters.Snapshot().Rejected[ProtoTCP])
+
+	// The queued connection is handled once the first one is closed
+	req := createTestMessage()
+	err = queued.WriteMsg(req)
+	assert.Nil(t, err)
+	_ = first.Close()
+
+	_ = queued.SetReadDeadline(time.Now().Add(idleTimeout / 2))
+	res, err := queued.ReadMsg()
+	if assert.Nil(t, err) {
+		assert.Equal(t, req.Id, res.Id)
+	}
+}
+
+// pipelineTestDelay is how long the upstream of pipelineQueries takes to
+// answer
+const pipelineTestDelay = 200 * time.Millisecond
+
+// pipelineQueries sends count queries over one connection at once and returns
+// the time it takes to get the responses
+func pipelineQueries(t *testing.T, count, maxGoroutines int) time.Duration {
+	const delay = pipelineTestDelay
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		time.Sleep(delay)
+		return new(dns.Msg).SetReply(m), nil
+	})}}
+	dnsProxy.MaxPipelinedQueries = count
+	dnsProxy.MaxGoroutines = maxGoroutines
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	conn, err := dns.Dial("tcp", dnsProxy.Addr(ProtoTCP).String())
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	ids := map[uint16]bool{}
+	for i := 0; i < count; i++ {
+		req := createHostTestMessage(fmt.Sprintf("host%d", i))
+		ids[req.Id] = true
+		err = conn.WriteMsg(req)
+		assert.Nil(t, err)
+	}
+
+	for i := 0; i < count; i++ {
+		res, err := conn.ReadMsg()
+		if err != nil {
+			t.Fatalf("cannot read the response: %s", err)
+		}
+		assert.True(t, ids[res.Id])
+		delete(ids, res.Id)
+	}
+	return time.Since(start)
+}
+
+func TestTcpProxyPipelining(t *testing.T) {
+	// The queries sent at once are handled concurrently
+	elapsed := pipelineQueries(t, 4, 0)
+	assert.True(t, elapsed < 2*pipelineTestDelay, elapsed.String())
+
+	// The pipelined queries take MaxGoroutines, so no more than two queries
+	// are handled at once
+	elapsed = pipelineQueries(t, 4, 2)
+	assert.True(t, elapsed >= 2*pipelineTestDelay, elapsed.String())
+}
+
+func TestTcpIdleConnectionsMaxGoroutines(t *testing.T) {
+	const maxGoroutines = 5
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		return new(dns.Msg).SetReply(m), nil
+	})}}
+	dnsProxy.MaxGoroutines = maxGoroutines
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	// The idle connections don't take MaxGoroutines
+	for i := 0; i < maxGoroutines; i++ {
+		conn, dialErr := net.Dial("tcp", dnsProxy.Addr(ProtoTCP).String())
+		if dialErr != nil {
+			t.Fatalf("cannot connect to the proxy: %s", dialErr)
+		}
+		defer conn.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, network := range []string{"udp", "tcp"} {
+		client := &dns.Client{Net: network, Timeout: time.Second}
+		addr := dnsProxy.Addr(ProtoUDP).String()
+		if network == "tcp" {
+			addr = dnsProxy.Addr(ProtoTCP).String()
+		}
+		res, _, err := client.Exchange(createTestMessage(), addr)
+		if assert.Nil(t, err, network) {
+			assert.Equal(t, dns.RcodeSuccess, res.Rcode, network)
+		}
+	}
+}
@@ -3,30 +3,73 @@ package proxy
 import (
 	"fmt"
 	"net"
+	"runtime"
 
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
-	"github.com/miekg/dns"
 )
 
 func (p *Proxy) createUDPListeners() error {
 	for _, a := range p.UDPListenAddr {
-		udpListen, err := p.udpCreate(a)
+		conns, err := p.udpCreateAll(a)
 		if err != nil {
 			return err
 		}
-		p.udpListen = append(p.udpListen, udpListen)
+		p.udpListen = append(p.udpListen, conns...)
 	}
 
 	return nil
 }
 
+// udpCreateAll creates the UDP listening sockets for the address, several of
+// them if UDPReusePort is set.  If one can't be created, the others are closed.
+func (p *Proxy) udpCreateAll(udpAddr *net.UDPAddr) ([]*net.UDPConn, error) {
+	udpListen, err := p.udpCreate(udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conns := []*net.UDPConn{udpListen}
+
+	// The other sockets are bound to the same port if it's random
+	addr := udpListen.LocalAddr().(*net.UDPAddr)
+	for i := 1; i < p.udpSocketsPerAddr(); i++ {
+		udpListen, err = p.udpCreate(addr)
+		if err != nil {
+			for _, c := range conns {
+				_ = c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, udpListen)
+	}
+
+	return conns, nil
+}
+
+// udpSocketsPerAddr returns the number of the UDP sockets to bind to every
+// listen address
+func (p *Proxy) udpSocketsPerAddr() int {
+	if !p.UDPReusePort || !proxyutil.ReusePortSupported {
+		return 1
+	}
+	if p.UDPReusePortSockets > 0 {
+		return p.UDPReusePortSockets
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
 // udpCreate - create a UDP listening socket
 func (p *Proxy) udpCreate(udpAddr *net.UDPAddr) (*net.UDPConn, error) {
 	log.Info("Creating the UDP server socket")
-	udpListen, err := net.ListenUDP("udp", udpAddr)
+	var udpListen *net.UDPConn
+	var err error
+	if p.UDPReusePort {
+		udpListen, err = proxyutil.UDPListenReusePort(udpAddr)
+	} else {
+		udpListen, err = net.ListenUDP("udp", udpAddr)
+	}
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't listen to UDP socket")
 	}
@@ -39,44 +82,61 @@ func (p *Proxy) udpCreate(udpAddr *net.UDPAddr) (*net.UDPConn, error) {
 		}
 	}
 
+	// The responses are still sent, but the system chooses their source
+	// address, which may be wrong if the socket is bound to the unspecified
+	// address on a multi-homed host
 	err = proxyutil.UDPSetOptions(udpListen)
 	if err != nil {
-		_ = udpListen.Close()
-		return nil, errorx.Decorate(err, "udpSetOptions failed")
+		log.Info("Can't receive the destination addresses of the UDP packets on %s: %s", udpListen.LocalAddr(), err)
 	}
 
 	log.Info("Listening to udp://%s", udpListen.LocalAddr())
 	return udpListen, nil
 }
 
-// udpPacketLoop listens for incoming UDP packets.
+// udpPacketLoop listens for incoming UDP packets.  The packets being handled
+// are tracked by t.
 //
 // See also the comment on Proxy.requestGoroutinesSema.
-func (p *Proxy) udpPacketLoop(conn *net.UDPConn, requestGoroutinesSema semaphore) {
+func (p *Proxy) udpPacketLoop(conn *net.UDPConn, t *listenerTracker, requestGoroutinesSema semaphore) {
 	log.Info("Entering the UDP listener loop on %s", conn.LocalAddr())
-	b := make([]byte, dns.MaxMsgSize)
+	defer close(t.done)
 	for {
 		p.RLock()
 		if !p.started {
+			p.RUnlock()
 			return
 		}
 		p.RUnlock()
 
-		n, localIP, remoteAddr, err := proxyutil.UDPRead(conn, b, p.udpOOBSize)
+		// Every packet is read into its own buffer since it's unpacked in
+		// the goroutine handling it, the buffer is returned to the pool once
+		// it's unpacked
+		bufPtr := p.bytesPool.Get().(*[]byte)
+		n, localIP, remoteAddr, err := proxyutil.UDPRead(conn, *bufPtr, p.udpOOBSize)
 		// documentation says to handle the packet even if err occurs, so do that first
-		if n > 0 {
-			// make a copy of all bytes because ReadFrom() will overwrite contents of b on next call
-			// we need the contents to survive the call because we're handling them in goroutine
-			packet := make([]byte, n)
-			copy(packet, b)
-			requestGoroutinesSema.acquire()
+		if n > 0 && requestGoroutinesSema.tryAcquire() {
+			t.handlers.Add(1)
+			p.requests.Add(1)
 			go func() {
-				p.udpHandlePacket(packet, localIP, remoteAddr, conn)
+				p.udpHandlePacket(bufPtr, n, localIP, remoteAddr, conn)
 				requestGoroutinesSema.release()
+				p.requests.Done()
+				t.handlers.Done()
 			}()
+		} else {
+			if n > 0 {
+				// The client retries, while waiting here would only make
+				// the socket buffer overflow
+				log.Tracef("Dropping the UDP packet from %s: too many requests are being processed", remoteAddr)
+				p.queryDropped(ProtoUDP)
+			}
+			p.bytesPool.Put(bufPtr)
 		}
 		if err != nil {
-			if proxyutil.IsConnClosed(err) {
+			if t.isClosing() {
+				log.Tracef("The UDP listener on %s is removed, exiting loop", conn.LocalAddr())
+			} else if proxyutil.IsConnClosed(err) {
 				log.Info("udpListen.ReadFrom() returned because we're reading from a closed connection, exiting loop")
 			} else {
 				log.Info("got error when reading from UDP listen: %s", err)
@@ -86,12 +146,14 @@ func (p *Proxy) udpPacketLoop(conn *net.UDPConn, requestGoroutinesSema semaphore
 	}
 }
 
-// udpHandlePacket processes the incoming UDP packet and sends a DNS response
-func (p *Proxy) udpHandlePacket(packet []byte, localIP net.IP, remoteAddr *net.UDPAddr, conn *net.UDPConn) {
+// udpHandlePacket unpacks the incoming UDP packet of n bytes read into the
+// pooled buffer and sends a DNS response.  The buffer is returned to the pool
+// once the packet is unpacked since the message doesn't refer to it.
+func (p *Proxy) udpHandlePacket(bufPtr *[]byte, n int, localIP net.IP, remoteAddr *net.UDPAddr, conn *net.UDPConn) {
 	log.Tracef("Start handling new UDP packet from %s", remoteAddr)
 
-	msg := &dns.Msg{}
-	err := msg.Unpack(packet)
+	msg, err := proxyutil.UnpackMsg((*bufPtr)[:n])
+	p.bytesPool.Put(bufPtr)
 	if err != nil {
 		log.Printf("error handling UDP packet: %s", err)
 		return
@@ -115,7 +177,10 @@ func (p *Proxy) udpHandlePacket(packet []byte, localIP net.IP, remoteAddr *net.U
 func (p *Proxy) respondUDP(d *DNSContext) error {
 	resp := d.Res
 
-	bytes, err := resp.Pack()
+	bufPtr := p.bytesPool.Get().(*[]byte)
+	defer p.bytesPool.Put(bufPtr)
+
+	bytes, err := resp.PackBuffer(*bufPtr)
 	if err != nil {
 		return errorx.Decorate(err, "couldn't convert message into wire format: %s", resp.String())
 	}
@@ -1,9 +1,16 @@
 package proxy
 
 import (
+	"net"
+	"runtime"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/metrics"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestUdpProxy(t *testing.T) {
@@ -31,3 +38,210 @@ func TestUdpProxy(t *testing.T) {
 		t.Fatalf("cannot stop the DNS proxy: %s", err)
 	}
 }
+
+func TestUdpReusePort(t *testing.T) {
+	if !proxyutil.ReusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UDPReusePort = true
+	dnsProxy.UDPReusePortSockets = 4
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() { _ = dnsProxy.Stop() }()
+
+	// All the sockets are bound to the same random port
+	assert.Equal(t, 4, len(dnsProxy.udpListen))
+	for _, l := range dnsProxy.udpListen {
+		assert.Equal(t, dnsProxy.Addr(ProtoUDP).String(), l.LocalAddr().String())
+	}
+	assert.Equal(t, 1, len(dnsProxy.Addrs(ProtoUDP)))
+}
+
+// BenchmarkUdpReusePort compares the throughput of a single UDP socket and
+// the SO_REUSEPORT sockets
+func BenchmarkUdpReusePort(b *testing.B) {
+	u := upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = []dns.RR{newRR("host. 60 IN A 192.0.2.1")}
+		return resp, nil
+	})
+
+	for _, reusePort := range []bool{false, true} {
+		name := "single"
+		if reusePort {
+			name = "reuseport"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			dnsProxy := &Proxy{Config: Config{
+				UDPListenAddr:  []*net.UDPAddr{{IP: net.ParseIP(listenIP), Port: 0}},
+				UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+				UDPReusePort:   reusePort,
+			}}
+			err := dnsProxy.Start()
+			if err != nil {
+				b.Fatalf("cannot start the DNS proxy: %s", err)
+			}
+			defer func() { _ = dnsProxy.Stop() }()
+			addr := dnsProxy.Addr(ProtoUDP).String()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := dns.Dial("udp", addr)
+				if err != nil {
+					b.Errorf("cannot connect to the proxy: %s", err)
+					return
+				}
+				defer conn.Close()
+
+				req := createHostTestMessage("host")
+				for pb.Next() {
+					err = conn.WriteMsg(req)
+					if err == nil {
+						_, err = conn.ReadMsg()
+					}
+					if err != nil {
+						b.Errorf("couldn't exchange with the proxy: %s", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkProxyUDP(b *testing.B) {
+	rr := newRR("host. 60 IN A 192.0.2.1")
+	u := upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = []dns.RR{dns.Copy(rr)}
+		return resp, nil
+	})
+	dnsProxy := &Proxy{Config: Config{
+		UDPListenAddr:  []*net.UDPAddr{{IP: net.ParseIP(listenIP), Port: 0}},
+		UpstreamConfig: &UpstreamConfig{Upstreams: []upstream.Upstream{u}},
+	}}
+	err := dnsProxy.Start()
+	if err != nil {
+		b.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() { _ = dnsProxy.Stop() }()
+
+	conn, err := dns.Dial("udp", dnsProxy.Addr(ProtoUDP).String())
+	if err != nil {
+		b.Fatalf("cannot connect to the proxy: %s", err)
+	}
+	defer conn.Close()
+	req := createHostTestMessage("host")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = conn.WriteMsg(req)
+		if err == nil {
+			_, err = conn.ReadMsg()
+		}
+		if err != nil {
+			b.Fatalf("couldn't exchange with the proxy: %s", err)
+		}
+	}
+}
+
+func TestUdpMaxGoroutines(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the load test is skipped in the short mode")
+	}
+
+	const maxGoroutines = 20
+	const qps = 10000
+
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.MaxGoroutines = maxGoroutines
+	dnsProxy.UpstreamConfig = &UpstreamConfig{Upstreams: []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		// The slow upstream keeps all the goroutines busy
+		time.Sleep(100 * time.Millisecond)
+		return new(dns.Msg).SetReply(m), nil
+	})}}
+	counters := &metrics.Counters{}
+	dnsProxy.Metrics = counters
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer dnsProxy.Stop()
+
+	conn, err := net.Dial("udp", dnsProxy.Addr(ProtoUDP).String())
+	if err != nil {
+		t.Fatalf("cannot connect to the proxy: %s", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			if _, readErr := conn.Read(buf); readErr != nil {
+				return
+			}
+		}
+	}()
+
+	// Watch the number of the queries being handled and the memory they take
+	// during the flood
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	var peakInFlight int64
+	var peakMem uint64
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		var m runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			if n := counters.Snapshot().InFlight; n > peakInFlight {
+				peakInFlight = n
+			}
+			runtime.ReadMemStats(&m)
+			if mem := m.HeapAlloc + m.StackInuse; mem > peakMem {
+				peakMem = mem
+			}
+		}
+	}()
+
+	// 10k queries per second for a second, sent in bursts every 10ms
+	packed, err := createTestMessage().Pack()
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		for j := 0; j < qps/100; j++ {
+			_, err = conn.Write(packed)
+			assert.Nil(t, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	<-watched
+
+	// The queries over the limit are dropped, so the ones being handled and
+	// their buffers don't pile up.  Without the limit there would be
+	// hundreds of them with their own goroutines and buffers.
+	assert.True(t, peakInFlight <= maxGoroutines, "%d queries at peak", peakInFlight)
+	beforeMem := before.HeapAlloc + before.StackInuse
+	assert.True(t, peakMem < beforeMem+8<<20, "%d bytes at peak, %d before", peakMem, beforeMem)
+	assert.True(t, counters.Snapshot().Dropped > 0)
+
+	// The queries are handled again once the flood is over
+	assert.True(t, waitFor(time.Second, func() bool {
+		return counters.Snapshot().InFlight == 0
+	}))
+	c := &dns.Client{Net: "udp", Timeout: time.Second}
+	_, _, err = c.Exchange(createTestMessage(), dnsProxy.Addr(ProtoUDP).String())
+	assert.Nil(t, err)
+}
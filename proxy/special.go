@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// The special-use zones (RFC 6761) the proxy answers itself
+const (
+	// SpecialZoneLocalhost resolves to the loopback addresses (RFC 6761)
+	SpecialZoneLocalhost = "localhost."
+	// SpecialZoneLoopbackV4 is the reverse zone of 127.0.0.0/8, its addresses
+	// resolve to localhost
+	SpecialZoneLoopbackV4 = "127.in-addr.arpa."
+	// SpecialZoneLoopbackV6 is the reverse zone of ::1, it resolves to
+	// localhost
+	SpecialZoneLoopbackV6 = "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa."
+	// SpecialZoneIPv4Only has the well-known IPv4 addresses used to discover
+	// the NAT64 prefix (RFC 8880)
+	SpecialZoneIPv4Only = "ipv4only.arpa."
+	// SpecialZoneOnion is the Tor hidden services zone, it's NXDOMAIN for the
+	// DNS (RFC 7686)
+	SpecialZoneOnion = "onion."
+	// SpecialZoneHomeArpa is the residential networks zone (RFC 8375), it's
+	// NXDOMAIN unless it's forwarded to the local router
+	SpecialZoneHomeArpa = "home.arpa."
+)
+
+const (
+	// specialTTL is the TTL of the records in the special-use zones
+	specialTTL = 3600
+	// specialNegativeTTL is the TTL of the SOA in the negative responses from
+	// the special-use zones, it's short since the zone may be forwarded later
+	specialNegativeTTL = 300
+)
+
+// specialZones are all the special-use zones, see Config.ForwardSpecialZones
+var specialZones = []string{
+	SpecialZoneLocalhost,
+	SpecialZoneLoopbackV4,
+	SpecialZoneLoopbackV6,
+	SpecialZoneIPv4Only,
+	SpecialZoneOnion,
+	SpecialZoneHomeArpa,
+}
+
+// ipv4OnlyAddrs are the addresses of ipv4only.arpa (RFC 8880)
+var ipv4OnlyAddrs = []net.IP{{192, 0, 0, 170}, {192, 0, 0, 171}}
+
+// newSpecialZones returns the set of the special-use zones answered locally,
+// all but the forwarded ones
+func newSpecialZones(forward []string) (map[string]bool, error) {
+	zones := map[string]bool{}
+	for _, z := range specialZones {
+		zones[z] = true
+	}
+
+	for z := range newDomainSet(forward) {
+		if !zones[z] {
+			return nil, fmt.Errorf("%s is not a special-use zone", z)
+		}
+		delete(zones, z)
+	}
+	return zones, nil
+}
+
+// findSpecialZone returns the special-use zone answered locally the name is
+// within, or "" if there is none
+func (p *Proxy) findSpecialZone(name string) string {
+	if len(p.specialZones) == 0 {
+		return ""
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if p.specialZones[name[off:]] {
+			return name[off:]
+		}
+	}
+	return ""
+}
+
+// replyFromSpecialZone answers the request for the special-use zone that isn't
+// forwarded and has no upstreams reserved for it.  The responses are
+// authoritative, the negative ones have the SOA of the zone.
+func (p *Proxy) replyFromSpecialZone(d *DNSContext) bool {
+	q := d.Req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return false
+	}
+	zone := p.findSpecialZone(q.Name)
+	if zone == "" || p.hasZoneUpstreams(d, q.Name, zone) {
+		return false
+	}
+
+	var nat64Prefix []byte
+	if p.isNAT64PrefixAvailable() {
+		nat64Prefix = p.getNAT64Prefix()
+	}
+
+	resp := new(dns.Msg).SetReply(d.Req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	resp.Rcode, resp.Answer = answerSpecialZone(zone, q, nat64Prefix)
+	if q.Qtype == dns.TypeSOA && strings.EqualFold(q.Name, zone) {
+		resp.Answer = []dns.RR{specialSOA(zone)}
+	}
+	if len(resp.Answer) == 0 {
+		resp.Ns = []dns.RR{specialSOA(zone)}
+	}
+
+	d.Res = resp
+	log.Debug("Serving response from special-use zone %s", zone)
+	return true
+}
+
+// hasZoneUpstreams checks if the upstreams are reserved for the name within
+// the special-use zone, e.g. with "[/home.arpa/]192.168.0.1", so that they
+// answer it instead of the proxy
+func (p *Proxy) hasZoneUpstreams(d *DNSContext, name, zone string) bool {
+	if d.CustomUpstreamConfig != nil && hasReservedUpstreams(d.CustomUpstreamConfig, name, zone) {
+		return true
+	}
+
+	gen := p.acquireUpstreams()
+	defer gen.release()
+	return gen.config != nil && hasReservedUpstreams(gen.config, name, zone)
+}
+
+// hasReservedUpstreams checks if the most specific domain of the name within
+// the zone that has the reserved upstreams in the config has any
+func hasReservedUpstreams(config *UpstreamConfig, name, zone string) bool {
+	if len(config.DomainReservedUpstreams) == 0 {
+		return false
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end && len(name)-off >= len(zone); off, end = dns.NextLabel(name, off) {
+		if ups, ok := config.DomainReservedUpstreams[name[off:]]; ok {
+			// The domain might be excluded with "[/domain/]#"
+			return ups != nil
+		}
+	}
+	return false
+}
+
+// answerSpecialZone returns the response code and the answer for the question
+// within the special-use zone.  If nat64Prefix is set, the AAAA records of
+// ipv4only.arpa are synthesized with it.
+func answerSpecialZone(zone string, q dns.Question, nat64Prefix []byte) (int, []dns.RR) {
+	apex := strings.EqualFold(q.Name, zone)
+	switch zone {
+	case SpecialZoneLocalhost:
+		// The subdomains of localhost are loopback as well
+		switch q.Qtype {
+		case dns.TypeA:
+			return dns.RcodeSuccess, []dns.RR{specialA(q.Name, net.IP{127, 0, 0, 1})}
+		case dns.TypeAAAA:
+			return dns.RcodeSuccess, []dns.RR{specialA(q.Name, net.IPv6loopback)}
+		}
+		return dns.RcodeSuccess, nil
+	case SpecialZoneLoopbackV4, SpecialZoneLoopbackV6:
+		n := reverseNet(q.Name)
+		if n == nil {
+			return dns.RcodeNameError, nil
+		}
+		ones, bits := n.Mask.Size()
+		if ones == bits && q.Qtype == dns.TypePTR {
+			return dns.RcodeSuccess, []dns.RR{&dns.PTR{
+				Hdr: specialHdr(q.Name, dns.TypePTR),
+				Ptr: SpecialZoneLocalhost,
+			}}
+		}
+		// The shorter names are the empty non-terminals
+		return dns.RcodeSuccess, nil
+	case SpecialZoneIPv4Only:
+		if !apex {
+			return dns.RcodeNameError, nil
+		}
+		// The clients discover the NAT64 prefix with the AAAA query (RFC 7050),
+		// so it's answered with the DNS64 prefix if there is one
+		var answer []dns.RR
+		for _, ip := range ipv4OnlyAddrs {
+			switch {
+			case q.Qtype == dns.TypeA:
+				answer = append(answer, specialA(q.Name, ip))
+			case q.Qtype == dns.TypeAAAA && nat64Prefix != nil:
+				mapped := make(net.IP, net.IPv6len)
+				copy(mapped, nat64Prefix)
+				copy(mapped[12:], ip)
+				answer = append(answer, specialA(q.Name, mapped))
+			}
+		}
+		return dns.RcodeSuccess, answer
+	}
+
+	// onion and home.arpa have no names but the zone itself
+	if apex {
+		return dns.RcodeSuccess, nil
+	}
+	return dns.RcodeNameError, nil
+}
+
+// specialHdr returns the header of the record in the special-use zone
+func specialHdr(name string, rrType uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrType,
+		Class:  dns.ClassINET,
+		Ttl:    specialTTL,
+	}
+}
+
+// specialA returns the A or the AAAA record depending on the IP address
+// version
+func specialA(name string, ip net.IP) dns.RR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dns.A{Hdr: specialHdr(name, dns.TypeA), A: ip4}
+	}
+	return &dns.AAAA{Hdr: specialHdr(name, dns.TypeAAAA), AAAA: ip}
+}
+
+// specialSOA returns the SOA of the special-use zone, its minimum TTL is
+// specialNegativeTTL so that the negative responses aren't cached for long
+func specialSOA(zone string) *dns.SOA {
+	soa := &dns.SOA{
+		Hdr:     specialHdr(zone, dns.TypeSOA),
+		Ns:      zone,
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  specialNegativeTTL,
+	}
+	soa.Hdr.Ttl = specialNegativeTTL
+	return soa
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// initSpecialProxy initializes the proxy with the upstream that answers every
+// request with the TXT record "upstream"
+func initSpecialProxy(t *testing.T, forward ...string) *Proxy {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.ForwardSpecialZones = forward
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{
+		upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+			resp := new(dns.Msg).SetReply(m)
+			resp.Answer = []dns.RR{newRR(m.Question[0].Name + ` 60 IN TXT "upstream"`)}
+			return resp, nil
+		}),
+	}
+	err := dnsProxy.Init()
+	if err != nil {
+		t.Fatalf("cannot initialize the DNS proxy: %s", err)
+	}
+	return dnsProxy
+}
+
+// resolveSpecial resolves the request with the proxy
+func resolveSpecial(t *testing.T, dnsProxy *Proxy, name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	d := &DNSContext{Req: req}
+	err := dnsProxy.Resolve(d)
+	if err != nil {
+		t.Fatalf("cannot resolve %s: %s", name, err)
+	}
+	return d.Res
+}
+
+// isForwarded checks if the response has come from the upstream
+func isForwarded(res *dns.Msg) bool {
+	return len(res.Answer) == 1 && res.Answer[0].Header().Rrtype == dns.TypeTXT
+}
+
+func TestSpecialZones(t *testing.T) {
+	dnsProxy := initSpecialProxy(t)
+	loopbackV6 := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa."
+
+	testCases := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer []string
+	}{
+		{"localhost.", dns.TypeA, dns.RcodeSuccess, []string{"127.0.0.1"}},
+		{"LocalHost.", dns.TypeAAAA, dns.RcodeSuccess, []string{"::1"}},
+		{"www.localhost.", dns.TypeA, dns.RcodeSuccess, []string{"127.0.0.1"}},
+		{"localhost.", dns.TypeMX, dns.RcodeSuccess, nil},
+		{"1.0.0.127.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, []string{"localhost."}},
+		{"5.4.3.127.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, []string{"localhost."}},
+		{"0.127.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, nil},
+		{"1.1.0.0.127.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, nil},
+		{loopbackV6, dns.TypePTR, dns.RcodeSuccess, []string{"localhost."}},
+		{"ipv4only.arpa.", dns.TypeA, dns.RcodeSuccess, []string{"192.0.0.170", "192.0.0.171"}},
+		{"ipv4only.arpa.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"www.ipv4only.arpa.", dns.TypeA, dns.RcodeNameError, nil},
+		{"example.onion.", dns.TypeA, dns.RcodeNameError, nil},
+		{"www.example.onion.", dns.TypeAAAA, dns.RcodeNameError, nil},
+		{"router.home.arpa.", dns.TypeA, dns.RcodeNameError, nil},
+		{"home.arpa.", dns.TypeA, dns.RcodeSuccess, nil},
+	}
+
+	for _, tc := range testCases {
+		res := resolveSpecial(t, dnsProxy, tc.name, tc.qtype)
+		assert.True(t, res.Authoritative, tc.name)
+		assert.Equal(t, tc.rcode, res.Rcode, tc.name)
+
+		var answer []string
+		for _, rr := range res.Answer {
+			assert.Equal(t, uint32(specialTTL), rr.Header().Ttl, tc.name)
+			switch rr := rr.(type) {
+			case *dns.A:
+				answer = append(answer, rr.A.String())
+			case *dns.AAAA:
+				answer = append(answer, rr.AAAA.String())
+			case *dns.PTR:
+				answer = append(answer, rr.Ptr)
+			}
+		}
+		assert.Equal(t, tc.answer, answer, tc.name)
+
+		// The negative responses have the SOA of the zone
+		if len(answer) == 0 && assert.Len(t, res.Ns, 1, tc.name) {
+			soa, ok := res.Ns[0].(*dns.SOA)
+			if assert.True(t, ok, tc.name) {
+				assert.Equal(t, uint32(specialNegativeTTL), soa.Hdr.Ttl)
+				assert.Equal(t, uint32(specialNegativeTTL), soa.Minttl)
+			}
+		}
+	}
+
+	// The zone apex has the SOA
+	res := resolveSpecial(t, dnsProxy, "onion.", dns.TypeSOA)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "onion.", res.Answer[0].(*dns.SOA).Hdr.Name)
+	}
+
+	// The other names and classes go to the upstream
+	for _, name := range []string{"localhost.example.org.", "arpa.", "1.0.0.10.in-addr.arpa.", "onion.example.org."} {
+		assert.True(t, isForwarded(resolveSpecial(t, dnsProxy, name, dns.TypeA)), name)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("localhost.", dns.TypeA)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	d := &DNSContext{Req: req}
+	assert.Nil(t, dnsProxy.Resolve(d))
+	assert.True(t, isForwarded(d.Res))
+}
+
+func TestSpecialZonesForward(t *testing.T) {
+	dnsProxy := initSpecialProxy(t, "home.arpa", "ONION.")
+	for _, name := range []string{"router.home.arpa.", "example.onion."} {
+		assert.True(t, isForwarded(resolveSpecial(t, dnsProxy, name, dns.TypeA)), name)
+	}
+	res := resolveSpecial(t, dnsProxy, "localhost.", dns.TypeA)
+	assert.False(t, isForwarded(res))
+
+	// All the zones can be forwarded
+	dnsProxy = initSpecialProxy(t, specialZones...)
+	for _, name := range []string{"localhost.", "1.0.0.127.in-addr.arpa.", "ipv4only.arpa.", "example.onion."} {
+		assert.True(t, isForwarded(resolveSpecial(t, dnsProxy, name, dns.TypeA)), name)
+	}
+
+	// Only the special-use zones can be listed
+	dnsProxy = createTestProxy(t, nil)
+	dnsProxy.ForwardSpecialZones = []string{"example.org"}
+	assert.NotNil(t, dnsProxy.Init())
+}
+
+func TestSpecialZonesReserved(t *testing.T) {
+	dnsProxy := initSpecialProxy(t)
+	reserved := upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = []dns.RR{newRR(m.Question[0].Name + ` 60 IN TXT "reserved"`)}
+		return resp, nil
+	})
+	dnsProxy.UpstreamConfig.DomainReservedUpstreams = map[string][]upstream.Upstream{
+		"home.arpa.":         {reserved},
+		"printer.home.arpa.": nil,
+		"example.onion.":     {reserved},
+		"arpa.":              {reserved},
+	}
+
+	// The upstreams reserved for the domains within the zone answer it,
+	// except for the excluded ones
+	for _, name := range []string{"home.arpa.", "router.home.arpa.", "www.example.onion."} {
+		assert.True(t, isForwarded(resolveSpecial(t, dnsProxy, name, dns.TypeA)), name)
+	}
+	for _, name := range []string{"printer.home.arpa.", "other.onion.", "ipv4only.arpa."} {
+		assert.False(t, isForwarded(resolveSpecial(t, dnsProxy, name, dns.TypeA)), name)
+	}
+
+	// The custom upstream config is checked as well
+	req := new(dns.Msg).SetQuestion("localhost.", dns.TypeA)
+	d := &DNSContext{Req: req, CustomUpstreamConfig: &UpstreamConfig{
+		Upstreams:               []upstream.Upstream{reserved},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{"localhost.": {reserved}},
+	}}
+	assert.Nil(t, dnsProxy.Resolve(d))
+	assert.True(t, isForwarded(d.Res))
+}
+
+func TestSpecialZonesDNS64(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.DNS64Prefix = "64:ff9b::/96"
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{upstream.NullUpstream()}
+	err := dnsProxy.Init()
+	if err != nil {
+		t.Fatalf("cannot initialize the DNS proxy: %s", err)
+	}
+
+	// The NAT64 prefix can be discovered with ipv4only.arpa
+	res := resolveSpecial(t, dnsProxy, "ipv4only.arpa.", dns.TypeAAAA)
+	var answer []string
+	for _, rr := range res.Answer {
+		answer = append(answer, rr.(*dns.AAAA).AAAA.String())
+	}
+	assert.Equal(t, []string{"64:ff9b::c000:aa", "64:ff9b::c000:ab"}, answer)
+}
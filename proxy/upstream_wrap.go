@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// wrappedUpstream reports the exchanges of the upstream to Metrics and turns
+// the responses with Config.FailoverRcodes into errors.  The wrappers that
+// only report to Metrics are created once for every generation of the
+// upstream configuration, the ones with the failover for every exchange, see
+// Proxy.startFailover.  It implements the optional interfaces of the upstream
+// package, so that the wrapping doesn't hide them.
+type wrappedUpstream struct {
+	upstream.Upstream
+	p        *Proxy
+	failover *rcodeFailover // nil if the responses aren't failed over
+}
+
+// type check
+var (
+	_ upstream.InfoExchanger = (*wrappedUpstream)(nil)
+	_ upstream.WireExchanger = (*wrappedUpstream)(nil)
+	_ upstream.Closer        = (*wrappedUpstream)(nil)
+)
+
+func (u *wrappedUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	reply, err := u.Upstream.Exchange(m)
+	return u.exchanged(reply, start, err)
+}
+
+// ExchangeWithInfo implements upstream.InfoExchanger for *wrappedUpstream
+func (u *wrappedUpstream) ExchangeWithInfo(m *dns.Msg) (*dns.Msg, *upstream.ExchangeInfo, error) {
+	start := time.Now()
+	reply, info, err := upstream.ExchangeWithInfo(u.Upstream, m)
+	reply, err = u.exchanged(reply, start, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply, info, nil
+}
+
+// ExchangeWire implements upstream.WireExchanger for *wrappedUpstream.  The
+// failovers only apply to the queries the proxy has sent as messages, so the
+// response is only reported to Metrics.
+func (u *wrappedUpstream) ExchangeWire(req []byte) ([]byte, error) {
+	start := time.Now()
+	reply, err := upstream.ExchangeWire(u.Upstream, req)
+	if u.p.Metrics != nil {
+		u.p.Metrics.UpstreamExchanged(u.Address(), time.Since(start), err, isTimeout(err))
+	}
+	return reply, err
+}
+
+// Close implements upstream.Closer for *wrappedUpstream, it does nothing if
+// the upstream doesn't implement it
+func (u *wrappedUpstream) Close() error {
+	if c, ok := u.Upstream.(upstream.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Shutdown implements upstream.Closer for *wrappedUpstream, it does nothing if
+// the upstream doesn't implement it
+func (u *wrappedUpstream) Shutdown(ctx context.Context) error {
+	if c, ok := u.Upstream.(upstream.Closer); ok {
+		return c.Shutdown(ctx)
+	}
+	return nil
+}
+
+// exchanged reports the exchange started at start to Metrics and checks the
+// response for the failover
+func (u *wrappedUpstream) exchanged(reply *dns.Msg, start time.Time, err error) (*dns.Msg, error) {
+	if u.p.Metrics != nil {
+		u.p.Metrics.UpstreamExchanged(u.Address(), time.Since(start), err, isTimeout(err))
+	}
+
+	if err == nil && reply != nil && u.failover != nil {
+		return u.failover.check(u.Upstream, reply)
+	}
+	return reply, err
+}
+
+// needsWrapping checks if the upstreams of the generation must be wrapped with
+// wrappedUpstream
+func (p *Proxy) needsWrapping() bool {
+	return p.Metrics != nil
+}
+
+// newUpstreamsGen creates the generation of the upstream configuration with
+// the wrappers of its upstreams
+func (p *Proxy) newUpstreamsGen(config *UpstreamConfig, fallbacks []upstream.Upstream) *upstreamsGen {
+	g := &upstreamsGen{config: config, fallbacks: fallbacks}
+	if config == nil || !p.needsWrapping() {
+		return g
+	}
+
+	all := g.all()
+	g.wrapped = make(map[upstream.Upstream]upstream.Upstream, len(all))
+	for u := range all {
+		g.wrapped[u] = &wrappedUpstream{Upstream: u, p: p}
+	}
+	return g
+}
+
+// wrap returns the wrappers of the upstreams, the upstreams that don't belong
+// to the generation, e.g. the ones of DNSContext.CustomUpstreamConfig, are
+// wrapped for this call only
+func (g *upstreamsGen) wrap(p *Proxy, upstreams []upstream.Upstream) []upstream.Upstream {
+	if !p.needsWrapping() {
+		return upstreams
+	}
+
+	wrapped := make([]upstream.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		w, ok := g.wrapped[u]
+		if !ok {
+			w = &wrappedUpstream{Upstream: u, p: p}
+		}
+		wrapped[i] = w
+	}
+	return wrapped
+}
+
+// unwrapUpstream returns the upstream upstreamsGen.wrap has wrapped
+func unwrapUpstream(u upstream.Upstream) upstream.Upstream {
+	if w, ok := u.(*wrappedUpstream); ok {
+		return w.Upstream
+	}
+	return u
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrappedUpstreamInterfaces(t *testing.T) {
+	srv, err := dnsproxytest.NewPlainServer(func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg).SetReply(req)
+		resp.Answer = []dns.RR{newRR(req.Question[0].Name + " 60 IN A 192.0.2.1")}
+		return resp
+	})
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+	u, err := upstream.AddressToUpstream(srv.URL, upstream.Options{Timeout: defaultTimeout})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	m := &failoverMetrics{failovers: map[int]int{}}
+	p := createTestProxy(t, nil)
+	p.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	p.Metrics = m
+	err = p.Init()
+	if err != nil {
+		t.Fatalf("cannot init the proxy: %s", err)
+	}
+
+	gen := p.acquireUpstreams()
+	w := gen.wrap(p, p.UpstreamConfig.Upstreams)[0]
+	gen.release()
+	assert.NotEqual(t, u, w)
+
+	// The information about the exchange isn't lost
+	_, info, err := upstream.ExchangeWithInfo(w, createTestMessage())
+	assert.Nil(t, err)
+	if assert.NotNil(t, info) {
+		assert.Equal(t, "udp", info.Protocol)
+		assert.Equal(t, srv.Addr, info.ServerAddr)
+	}
+
+	// The wire format is relayed as is
+	req, err := createTestMessage().Pack()
+	assert.Nil(t, err)
+	reply, err := upstream.ExchangeWire(w, req)
+	assert.Nil(t, err)
+	assert.Equal(t, req[:2], reply[:2])
+
+	// The upstream is closed through the wrapper
+	assert.Nil(t, w.(upstream.Closer).Close())
+	_, err = u.Exchange(createTestMessage())
+	assert.Equal(t, upstream.ErrClosed, err)
+}
+
+func TestResolveUpstreamInfo(t *testing.T) {
+	srv, err := dnsproxytest.NewPlainServer(func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg).SetReply(req)
+		resp.Answer = []dns.RR{newRR(req.Question[0].Name + " 60 IN A 127.0.0.1")}
+		return resp
+	})
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
+	for _, mode := range []UpstreamModeType{UModeLoadBalance, UModeParallel, UModeFastestAddr} {
+		u, err := upstream.AddressToUpstream(srv.URL, upstream.Options{Timeout: defaultTimeout})
+		if err != nil {
+			t.Fatalf("cannot create upstream: %s", err)
+		}
+
+		// The wrapping for the metrics doesn't hide the information
+		p := createTestProxy(t, nil)
+		p.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+		p.UpstreamMode = mode
+		p.CacheEnabled = true
+		p.Metrics = &failoverMetrics{failovers: map[int]int{}}
+		err = p.Init()
+		if err != nil {
+			t.Fatalf("cannot init the proxy: %s", err)
+		}
+
+		d := &DNSContext{Req: createTestMessage()}
+		err = p.Resolve(d)
+		assert.Nil(t, err)
+		assert.Equal(t, u, d.Upstream, mode)
+		if assert.NotNil(t, d.UpstreamInfo, mode) {
+			assert.Equal(t, "udp", d.UpstreamInfo.Protocol, mode)
+			assert.Equal(t, srv.Addr, d.UpstreamInfo.ServerAddr, mode)
+		}
+
+		// The cached responses have no upstream
+		d = &DNSContext{Req: createTestMessage()}
+		err = p.Resolve(d)
+		assert.Nil(t, err)
+		assert.Nil(t, d.UpstreamInfo, mode)
+	}
+}
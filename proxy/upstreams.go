@@ -6,6 +6,8 @@ import (
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/utils"
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 )
@@ -23,7 +25,9 @@ type UpstreamConfig struct {
 // To exclude more specific domains from reserved upstreams querying you should use the following syntax: [/domain1/../domainN/]#
 // So the following config: ["[/host.com/]1.2.3.4", "[/www.host.com/]2.3.4.5", "[/maps.host.com/]#", "3.4.5.6"]
 // will send queries for *.host.com to 1.2.3.4, except for *.www.host.com, which will go to 2.3.4.5 and *.maps.host.com,
-// which will go to default server 3.4.5.6 with all other domains
+// which will go to default server 3.4.5.6 with all other domains.
+// The upstream string may be followed by its own options, see
+// upstream.ParseUpstreamLine, e.g. "[/host.com/]tls://1.2.3.4 timeout=5s".
 func ParseUpstreamsConfig(upstreamConfig []string, options upstream.Options) (UpstreamConfig, error) {
 	var upstreams []upstream.Upstream
 	domainReservedUpstreams := map[string][]upstream.Upstream{}
@@ -49,13 +53,8 @@ func ParseUpstreamsConfig(upstreamConfig []string, options upstream.Options) (Up
 		} else {
 			dnsUpstream, ok := upstreamsIndex[u]
 			if !ok {
-				// create an upstream
-				dnsUpstream, err = upstream.AddressToUpstream(u,
-					upstream.Options{
-						Bootstrap:          options.Bootstrap,
-						Timeout:            options.Timeout,
-						InsecureSkipVerify: options.InsecureSkipVerify,
-					})
+				// create an upstream, the line may have its own options
+				dnsUpstream, err = upstream.AddressToUpstreamLine(u, options)
 				if err != nil {
 					err = fmt.Errorf("cannot prepare the upstream %s (%s): %s", l, options.Bootstrap, err)
 					return UpstreamConfig{}, err
@@ -105,10 +104,11 @@ func parseUpstreamLine(l string) (string, []string, error) {
 		// split domains list
 		for _, host := range strings.Split(domainsAndUpstream[0], "/") {
 			if host != "" {
-				if err := utils.IsValidHostname(host); err != nil {
+				h, err := normalizeDomain(host)
+				if err != nil {
 					return "", nil, err
 				}
-				hosts = append(hosts, strings.ToLower(host+"."))
+				hosts = append(hosts, h)
 			} else {
 				// empty domain specification means `unqualified names only`
 				hosts = append(hosts, UnqualifiedNames)
@@ -120,6 +120,54 @@ func parseUpstreamLine(l string) (string, []string, error) {
 	return u, hosts, nil
 }
 
+// normalizeDomain converts the domain to the form used as a key of
+// DomainReservedUpstreams: lowercase, punycode for IDN, with the trailing dot
+func normalizeDomain(host string) (string, error) {
+	host = strings.TrimSuffix(host, ".")
+	ascii, err := idna.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain name %s: %s", host, err)
+	}
+	if err = utils.IsValidHostname(ascii); err != nil {
+		return "", err
+	}
+	return strings.ToLower(ascii) + ".", nil
+}
+
+// AddDomainUpstream reserves the upstream for the specified domains and their
+// subdomains.  If u is nil, the domains are excluded from the less specific
+// reserved domains and the default upstreams are used for them, like with the
+// [/domain/]# syntax.  An empty domain means unqualified names.  It must not be
+// called while the proxy that uses the config is running.
+func (uc *UpstreamConfig) AddDomainUpstream(domains []string, u upstream.Upstream) error {
+	hosts := make([]string, 0, len(domains))
+	for _, d := range domains {
+		if d == "" {
+			hosts = append(hosts, UnqualifiedNames)
+			continue
+		}
+
+		h, err := normalizeDomain(d)
+		if err != nil {
+			return err
+		}
+		hosts = append(hosts, h)
+	}
+
+	if uc.DomainReservedUpstreams == nil {
+		uc.DomainReservedUpstreams = map[string][]upstream.Upstream{}
+	}
+	for _, h := range hosts {
+		if u == nil {
+			uc.DomainReservedUpstreams[h] = nil
+		} else {
+			uc.DomainReservedUpstreams[h] = append(uc.DomainReservedUpstreams[h], u)
+		}
+	}
+
+	return nil
+}
+
 // getUpstreamsForDomain looks for a domain in reserved domains map and returns a list of corresponding upstreams.
 // returns default upstreams list if domain isn't found. More specific domains take priority over less specific domains.
 // For example, map contains the following keys: host.com and www.host.com
@@ -131,15 +179,19 @@ func (uc *UpstreamConfig) getUpstreamsForDomain(host string) []upstream.Upstream
 		return uc.Upstreams
 	}
 
+	host = strings.ToLower(dns.Fqdn(host))
 	dotsCount := strings.Count(host, ".")
 	if dotsCount < 2 {
-		return uc.DomainReservedUpstreams[UnqualifiedNames]
+		if u := uc.DomainReservedUpstreams[UnqualifiedNames]; u != nil {
+			return u
+		}
+		return uc.Upstreams
 	}
 
 	for i := 1; i <= dotsCount; i++ {
 		h := strings.SplitAfterN(host, ".", i)
 		name := h[i-1]
-		if u, ok := uc.DomainReservedUpstreams[strings.ToLower(name)]; ok {
+		if u, ok := uc.DomainReservedUpstreams[name]; ok {
 			if u == nil {
 				// domain was excluded from reserved upstreams querying
 				return uc.Upstreams
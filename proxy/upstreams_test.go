@@ -28,6 +28,72 @@ func TestGetUpstreamsForDomain(t *testing.T) {
 	assertUpstreamsForDomain(t, config, 0, "maps.google.com.", []string{})
 }
 
+func TestGetUpstreamsForDomainOverlapping(t *testing.T) {
+	upstreams := []string{
+		"[/corp.example./]10.0.0.1",
+		"[/DEV.corp.example/]10.0.0.2",
+		"[/pub.dev.corp.example/]#",
+		"[/пример.рф/]10.0.0.3",
+		"9.9.9.9",
+	}
+	config, err := ParseUpstreamsConfig(upstreams, upstream.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatalf("Error while upstream config parsing: %s", err)
+	}
+
+	assertUpstreamsForDomain(t, config, 1, "corp.example.", []string{"10.0.0.1:53"})
+	assertUpstreamsForDomain(t, config, 1, "WWW.Corp.Example.", []string{"10.0.0.1:53"})
+	assertUpstreamsForDomain(t, config, 1, "www.corp.example", []string{"10.0.0.1:53"})
+	assertUpstreamsForDomain(t, config, 1, "host.dev.corp.example.", []string{"10.0.0.2:53"})
+	assertUpstreamsForDomain(t, config, 1, "www.pub.dev.corp.example.", []string{"9.9.9.9:53"})
+	assertUpstreamsForDomain(t, config, 1, "mycorp.example.", []string{"9.9.9.9:53"})
+	assertUpstreamsForDomain(t, config, 1, "www.xn--e1afmkfd.xn--p1ai.", []string{"10.0.0.3:53"})
+
+	// No upstreams are reserved for unqualified names
+	assertUpstreamsForDomain(t, config, 1, "localhost.", []string{"9.9.9.9:53"})
+
+	_, err = ParseUpstreamsConfig([]string{"[/bad..example/]1.1.1.1"}, upstream.Options{})
+	assert.NotNil(t, err)
+}
+
+func TestAddDomainUpstream(t *testing.T) {
+	internal, err := upstream.AddressToUpstream("10.0.0.1", upstream.Options{})
+	assert.Nil(t, err)
+	public, err := upstream.AddressToUpstream("9.9.9.9", upstream.Options{})
+	assert.Nil(t, err)
+
+	config := UpstreamConfig{Upstreams: []upstream.Upstream{public}}
+	assert.Nil(t, config.AddDomainUpstream([]string{"Corp.Example.", "bücher.example"}, internal))
+	assert.Nil(t, config.AddDomainUpstream([]string{"www.corp.example"}, nil))
+	assert.NotNil(t, config.AddDomainUpstream([]string{"bad..example"}, internal))
+
+	assertUpstreamsForDomain(t, config, 1, "host.corp.example.", []string{"10.0.0.1:53"})
+	assertUpstreamsForDomain(t, config, 1, "xn--bcher-kva.example.", []string{"10.0.0.1:53"})
+	assertUpstreamsForDomain(t, config, 1, "www.corp.example.", []string{"9.9.9.9:53"})
+	assertUpstreamsForDomain(t, config, 1, "example.", []string{"9.9.9.9:53"})
+}
+
+func TestParseUpstreamsConfigLineOptions(t *testing.T) {
+	upstreams := []string{
+		"[/example.org/]tls://1.1.1.1 timeout=5s",
+		"tls://1.1.1.1 timeout=5s",
+		"8.8.8.8",
+	}
+	config, err := ParseUpstreamsConfig(upstreams, upstream.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatalf("Error while upstream config parsing: %s", err)
+	}
+
+	assertUpstreamsForDomain(t, config, 1, "www.example.org.", []string{"tls://1.1.1.1:853"})
+	assertUpstreamsForDomain(t, config, 2, "example.com.", []string{"tls://1.1.1.1:853", "8.8.8.8:53"})
+
+	// The same line makes the same upstream
+	assert.True(t, config.DomainReservedUpstreams["example.org."][0] == config.Upstreams[0])
+
+	_, err = ParseUpstreamsConfig([]string{"tls://1.1.1.1 timeout=5"}, upstream.Options{})
+	assert.NotNil(t, err)
+}
+
 func TestGetUpstreamsForDomainWithoutDuplicates(t *testing.T) {
 	upstreams := []string{"[/example.com/]1.1.1.1", "[/example.org/]1.1.1.1"}
 	config, err := ParseUpstreamsConfig(upstreams,
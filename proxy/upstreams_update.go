@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// upstreamsDrainTimeout is how long the upstreams replaced at runtime are kept
+// open for the queries that use them
+const upstreamsDrainTimeout = defaultTimeout
+
+// upstreamsGen is a generation of the upstream configuration.  The queries
+// hold it while they're resolved, so that the upstreams that are replaced are
+// only closed when the queries are done with them.
+type upstreamsGen struct {
+	queries sync.WaitGroup // the queries using the generation
+
+	config    *UpstreamConfig
+	fallbacks []upstream.Upstream
+	wrapped   map[upstream.Upstream]upstream.Upstream // wrappers of the upstreams, nil if they aren't needed
+}
+
+// release must be called when the query is done with the generation
+func (g *upstreamsGen) release() {
+	g.queries.Done()
+}
+
+// all returns the default, domain-specific and fallback upstreams of the
+// generation
+func (g *upstreamsGen) all() map[upstream.Upstream]bool {
+	all := map[upstream.Upstream]bool{}
+	for _, u := range g.config.Upstreams {
+		all[u] = true
+	}
+	for _, ups := range g.config.DomainReservedUpstreams {
+		for _, u := range ups {
+			all[u] = true
+		}
+	}
+	for _, u := range g.fallbacks {
+		all[u] = true
+	}
+	return all
+}
+
+// acquireUpstreams returns the current upstream configuration, it must be
+// released when the query is resolved.  The generation is acquired under the
+// lock, so no query acquires it once it's replaced and closeReplacedUpstreams
+// starts waiting for its queries.
+func (p *Proxy) acquireUpstreams() *upstreamsGen {
+	p.upstreamsLock.RLock()
+	defer p.upstreamsLock.RUnlock()
+
+	g := p.upstreams
+	if g == nil {
+		// The proxy isn't initialized, nothing can be replaced
+		g = p.newUpstreamsGen(p.UpstreamConfig, p.Fallbacks)
+	}
+	g.queries.Add(1)
+	return g
+}
+
+// UpdateUpstreams replaces the default upstreams, see UpdateUpstreamConfig
+func (p *Proxy) UpdateUpstreams(upstreams []upstream.Upstream) error {
+	return p.updateUpstreams(func(config *UpstreamConfig, _ *[]upstream.Upstream) {
+		config.Upstreams = upstreams
+	})
+}
+
+// UpdateDomainUpstreams replaces the upstreams reserved for the domains, see
+// UpdateUpstreamConfig.  The keys are the same as in
+// UpstreamConfig.DomainReservedUpstreams.
+func (p *Proxy) UpdateDomainUpstreams(reserved map[string][]upstream.Upstream) error {
+	return p.updateUpstreams(func(config *UpstreamConfig, _ *[]upstream.Upstream) {
+		config.DomainReservedUpstreams = reserved
+	})
+}
+
+// UpdateFallbacks replaces the fallback upstreams, see UpdateUpstreamConfig
+func (p *Proxy) UpdateFallbacks(fallbacks []upstream.Upstream) error {
+	return p.updateUpstreams(func(_ *UpstreamConfig, f *[]upstream.Upstream) {
+		*f = fallbacks
+	})
+}
+
+// UpdateUpstreamConfig replaces the upstream configuration and the fallbacks
+// of the running proxy.  The queries being resolved finish with the old
+// upstreams, the new ones use the new upstreams.  The old upstreams that
+// implement upstream.Closer and aren't used anymore are closed in the
+// background once their queries are done, but no later than in 10 seconds.
+// It's safe to call it concurrently with the queries.
+func (p *Proxy) UpdateUpstreamConfig(config *UpstreamConfig, fallbacks []upstream.Upstream) error {
+	if config == nil {
+		return errors.New("no default upstreams specified")
+	}
+
+	return p.updateUpstreams(func(c *UpstreamConfig, f *[]upstream.Upstream) {
+		*c = *config
+		*f = fallbacks
+	})
+}
+
+// updateUpstreams creates the new generation of the upstream configuration
+// changed by update and closes the replaced upstreams once they're not used
+func (p *Proxy) updateUpstreams(update func(config *UpstreamConfig, fallbacks *[]upstream.Upstream)) error {
+	p.upstreamsLock.Lock()
+
+	config := &UpstreamConfig{}
+	if p.UpstreamConfig != nil {
+		*config = *p.UpstreamConfig
+	}
+	fallbacks := p.Fallbacks
+	update(config, &fallbacks)
+
+	if len(config.Upstreams) == 0 {
+		p.upstreamsLock.Unlock()
+		return errors.New("no default upstreams specified")
+	}
+
+	old := p.upstreams
+	p.UpstreamConfig = config
+	p.Fallbacks = fallbacks
+	if old != nil {
+		p.upstreams = p.newUpstreamsGen(config, fallbacks)
+	}
+	p.upstreamsLock.Unlock()
+
+	log.Info("Upstreams are updated: %d default, %d domain-specific, %d fallbacks",
+		len(config.Upstreams), len(config.DomainReservedUpstreams), len(fallbacks))
+
+	if old != nil {
+		go p.closeReplacedUpstreams(old)
+	}
+	return nil
+}
+
+// closeReplacedUpstreams waits until the queries that use the old generation
+// are resolved and closes its upstreams that the current one doesn't use
+func (p *Proxy) closeReplacedUpstreams(old *upstreamsGen) {
+	done := make(chan struct{})
+	go func() {
+		old.queries.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(upstreamsDrainTimeout)
+	select {
+	case <-done:
+		timer.Stop()
+	case <-timer.C:
+		log.Info("Timed out waiting for the queries to the replaced upstreams")
+	}
+
+	p.upstreamsLock.RLock()
+	used := p.upstreams.all()
+	p.upstreamsLock.RUnlock()
+
+	for u := range old.all() {
+		if used[u] {
+			continue
+		}
+
+		if c, ok := u.(upstream.Closer); ok {
+			err := c.Close()
+			if err != nil {
+				log.Debug("Closing the replaced upstream %s: %s", u.Address(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newSlowUpstream creates a static upstream that answers with the address
+// after a short delay, so that there are queries in progress when it's
+// replaced
+func newSlowUpstream(addr string) upstream.Upstream {
+	return upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		time.Sleep(time.Millisecond)
+		resp := new(dns.Msg).SetReply(m)
+		resp.Answer = []dns.RR{newRR("host. 60 IN A " + addr)}
+		return resp, nil
+	})
+}
+
+// slowSelector waits before sending the query to the upstreams it's given
+type slowSelector struct{}
+
+func (slowSelector) Exchange(req *dns.Msg, upstreams []upstream.Upstream) (*dns.Msg, upstream.Upstream, error) {
+	time.Sleep(time.Millisecond)
+	return NewParallelSelector().Exchange(req, upstreams)
+}
+
+func TestUpdateUpstreams(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	first := newSlowUpstream("192.0.2.0")
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{first}
+	// The queries keep the upstreams for a while before exchanging with
+	// them, so some of them are replaced meanwhile
+	dnsProxy.UpstreamSelector = slowSelector{}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() { _ = dnsProxy.Stop() }()
+
+	// Resolve the queries in parallel while the upstreams are replaced, the
+	// replaced ones are closed, so the queries fail if they're sent to them
+	const workers = 100
+	stop := make(chan struct{})
+	errs := make(chan error, workers)
+	wg := &sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					errs <- nil
+					return
+				default:
+				}
+
+				d := &DNSContext{
+					Proto: ProtoUDP,
+					Req:   createHostTestMessage("host"),
+					Addr:  &net.UDPAddr{IP: net.IP{192, 0, 2, 1}},
+				}
+				err := dnsProxy.Resolve(d)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var last upstream.Upstream
+	for i := 1; i <= 50; i++ {
+		last = newSlowUpstream(net.IP{192, 0, 2, byte(i)}.String())
+		err = dnsProxy.UpdateUpstreams([]upstream.Upstream{last})
+		assert.Nil(t, err)
+		time.Sleep(2 * time.Millisecond)
+	}
+	close(stop)
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("query failed: %s", err)
+		}
+	}
+
+	// The first upstream is closed once its queries are done, the current
+	// one is not
+	req := createHostTestMessage("host")
+	closed := false
+	for i := 0; i < 100 && !closed; i++ {
+		_, err = first.Exchange(req)
+		closed = err == upstream.ErrClosed
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, closed)
+
+	d := &DNSContext{Proto: ProtoUDP, Req: req, Addr: &net.UDPAddr{IP: net.IP{192, 0, 2, 1}}}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, last, d.Upstream)
+	assert.Equal(t, []upstream.Upstream{last}, dnsProxy.UpstreamConfig.Upstreams)
+
+	// There must be a default upstream
+	assert.NotNil(t, dnsProxy.UpdateUpstreams(nil))
+}
+
+func TestUpdateFallbacks(t *testing.T) {
+	dnsProxy := createTestProxy(t, nil)
+	dnsProxy.UpstreamConfig.Upstreams = []upstream.Upstream{upstream.NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		return nil, net.UnknownNetworkError("failing")
+	})}
+	err := dnsProxy.Start()
+	if err != nil {
+		t.Fatalf("cannot start the DNS proxy: %s", err)
+	}
+	defer func() { _ = dnsProxy.Stop() }()
+
+	fallback := newSlowUpstream("192.0.2.1")
+	err = dnsProxy.UpdateFallbacks([]upstream.Upstream{fallback})
+	assert.Nil(t, err)
+
+	d := &DNSContext{Proto: ProtoUDP, Req: createHostTestMessage("host"), Addr: &net.UDPAddr{IP: net.IP{192, 0, 2, 1}}}
+	err = dnsProxy.Resolve(d)
+	assert.Nil(t, err)
+	assert.Equal(t, fallback, d.Upstream)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -62,3 +63,105 @@ func WritePrefixed(b []byte, conn net.Conn) error {
 	_, err := (&net.Buffers{l, b}).WriteTo(conn)
 	return err
 }
+
+// ReadPrefixedBuffer is like ReadPrefixed, but reads the message into buf,
+// which must be large enough for any DNS message.  The returned slice refers
+// to buf.
+func ReadPrefixedBuffer(conn net.Conn, buf []byte) ([]byte, error) {
+	_, err := io.ReadFull(conn, buf[:2])
+	if err != nil {
+		return nil, err
+	}
+	packetLen := int(binary.BigEndian.Uint16(buf[:2]))
+	if packetLen > len(buf) {
+		return nil, ErrTooLarge
+	}
+
+	_, err = io.ReadFull(conn, buf[:packetLen])
+	if err != nil {
+		return nil, err
+	}
+	return buf[:packetLen], nil
+}
+
+// PackPrefixed packs the message into buf after the 2-byte length prefix and
+// returns them, so that they're written at once.  buf must be large enough for
+// any DNS message and the prefix.
+func PackPrefixed(m *dns.Msg, buf []byte) ([]byte, error) {
+	packed, err := m.PackBuffer(buf[2:])
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	return buf[:2+len(packed)], nil
+}
+
+// UnpackMsg unpacks the message from b so that it doesn't refer to b, and b can
+// be reused.  The data of some EDNS0 options refers to the packed message
+// after dns.Msg.Unpack, so it's copied.
+func UnpackMsg(b []byte) (*dns.Msg, error) {
+	m := &dns.Msg{}
+	err := m.Unpack(b)
+	if err != nil {
+		return nil, err
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		return m, nil
+	}
+	for _, o := range opt.Option {
+		switch o := o.(type) {
+		case *dns.EDNS0_PADDING:
+			o.Padding = append([]byte(nil), o.Padding...)
+		case *dns.EDNS0_DAU:
+			o.AlgCode = append([]uint8(nil), o.AlgCode...)
+		case *dns.EDNS0_DHU:
+			o.AlgCode = append([]uint8(nil), o.AlgCode...)
+		case *dns.EDNS0_N3U:
+			o.AlgCode = append([]uint8(nil), o.AlgCode...)
+		}
+	}
+	return m, nil
+}
+
+// RemoveOPT removes the OPT record from the additional section of the message
+func RemoveOPT(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
+// RemoveOption returns the list of the EDNS0 options without the ones with the
+// code, options itself isn't modified
+func RemoveOption(options []dns.EDNS0, code uint16) []dns.EDNS0 {
+	var res []dns.EDNS0
+	for _, o := range options {
+		if o.Option() != code {
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+// RRsetKey identifies the RRset of a record, see RRsetKeyOf
+type RRsetKey struct {
+	name   string
+	rrtype uint16
+	class  uint16
+}
+
+// RRsetKeyOf returns the key of the RRset the record belongs to, an RRSIG
+// belongs to the RRset it covers.  The names are compared case-insensitively.
+func RRsetKeyOf(rr dns.RR) RRsetKey {
+	h := rr.Header()
+	key := RRsetKey{name: strings.ToLower(h.Name), rrtype: h.Rrtype, class: h.Class}
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		key.rrtype = sig.TypeCovered
+	}
+	return key
+}
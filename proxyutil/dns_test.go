@@ -0,0 +1,96 @@
+package proxyutil
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnpackMsg(t *testing.T) {
+	m := new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_PADDING{Padding: []byte{1, 2, 3}},
+		&dns.EDNS0_DAU{Code: dns.EDNS0DAU, AlgCode: []uint8{dns.ED25519}},
+	)
+
+	buf := make([]byte, 2+dns.MaxMsgSize)
+	b, err := PackPrefixed(m, buf)
+	assert.Nil(t, err)
+
+	unpacked, err := UnpackMsg(b[2:])
+	assert.Nil(t, err)
+
+	// The buffer is reused, the message must not change
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	opt = unpacked.IsEdns0()
+	if assert.NotNil(t, opt) && assert.Len(t, opt.Option, 2) {
+		assert.Equal(t, []byte{1, 2, 3}, opt.Option[0].(*dns.EDNS0_PADDING).Padding)
+		assert.Equal(t, []uint8{dns.ED25519}, opt.Option[1].(*dns.EDNS0_DAU).AlgCode)
+	}
+	assert.Equal(t, "example.org.", unpacked.Question[0].Name)
+}
+
+func TestReadPrefixedBuffer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	m := new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+	go func() {
+		b, _ := PackPrefixed(m, make([]byte, 2+dns.MaxMsgSize))
+		_, _ = client.Write(b)
+	}()
+
+	b, err := ReadPrefixedBuffer(server, make([]byte, 2+dns.MaxMsgSize))
+	assert.Nil(t, err)
+	read, err := UnpackMsg(b)
+	assert.Nil(t, err)
+	assert.Equal(t, m.Id, read.Id)
+}
+
+func TestRemoveOPT(t *testing.T) {
+	m := new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	opt := m.IsEdns0()
+	opt.Option = []dns.EDNS0{
+		&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+		&dns.EDNS0_PADDING{},
+		&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+	}
+
+	// The list is copied, the option of the message isn't modified
+	options := RemoveOption(opt.Option, dns.EDNS0NSID)
+	if assert.Len(t, options, 1) {
+		assert.Equal(t, uint16(dns.EDNS0PADDING), options[0].Option())
+	}
+	assert.Len(t, opt.Option, 3)
+	assert.Empty(t, RemoveOption(options, dns.EDNS0PADDING))
+
+	m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET}})
+	RemoveOPT(m)
+	assert.Nil(t, m.IsEdns0())
+	assert.Len(t, m.Extra, 1)
+}
+
+func TestRRsetKeyOf(t *testing.T) {
+	a, err := dns.NewRR("Example.ORG. 60 IN A 192.0.2.1")
+	assert.Nil(t, err)
+	a2, err := dns.NewRR("example.org. 30 IN A 192.0.2.2")
+	assert.Nil(t, err)
+	aaaa, err := dns.NewRR("example.org. 60 IN AAAA 2001:db8::1")
+	assert.Nil(t, err)
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET},
+		TypeCovered: dns.TypeA,
+	}
+
+	assert.Equal(t, RRsetKeyOf(a), RRsetKeyOf(a2))
+	assert.Equal(t, RRsetKeyOf(a), RRsetKeyOf(sig))
+	assert.NotEqual(t, RRsetKeyOf(a), RRsetKeyOf(aaaa))
+}
@@ -0,0 +1,90 @@
+package proxyutil
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// HostsTable contains the addresses of the hosts and answers the A, AAAA and
+// the PTR queries synthesized from them.  The names are case-insensitive, the
+// trailing dot is optional.  It's not safe for concurrent modification.
+type HostsTable struct {
+	ips map[string][]net.IP // addresses by the lowercase FQDN
+	ptr map[string][]string // host names by the reverse name of the address
+}
+
+// NewHostsTable creates an empty table
+func NewHostsTable() *HostsTable {
+	return &HostsTable{
+		ips: map[string][]net.IP{},
+		ptr: map[string][]string{},
+	}
+}
+
+// Add adds the addresses of the host, the ones it already has are skipped
+func (t *HostsTable) Add(name string, ips []net.IP) {
+	name = HostsName(name)
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if ip == nil || ContainsIP(t.ips[name], ip) {
+			continue
+		}
+		t.ips[name] = append(t.ips[name], ip)
+
+		arpa, err := dns.ReverseAddr(ip.String())
+		if err == nil {
+			t.ptr[arpa] = append(t.ptr[arpa], name)
+		}
+	}
+}
+
+// Len returns the number of hosts
+func (t *HostsTable) Len() int { return len(t.ips) }
+
+// Lookup returns the records of the type for the name, owned by the name as
+// it's passed.  It returns false if the table has no records of the type or
+// the related one for the name.  The hosts that have no addresses of the
+// requested family get no records.
+func (t *HostsTable) Lookup(name string, qtype uint16, ttl uint32) ([]dns.RR, bool) {
+	key := HostsName(name)
+	hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+
+	var answer []dns.RR
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		ips, ok := t.ips[key]
+		if !ok {
+			return nil, false
+		}
+
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil && qtype == dns.TypeA {
+				answer = append(answer, &dns.A{Hdr: hdr, A: ip4})
+			} else if ip4 == nil && qtype == dns.TypeAAAA {
+				answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	case dns.TypePTR:
+		hosts, ok := t.ptr[key]
+		if !ok {
+			return nil, false
+		}
+
+		for _, h := range hosts {
+			answer = append(answer, &dns.PTR{Hdr: hdr, Ptr: h})
+		}
+	default:
+		return nil, false
+	}
+
+	return answer, true
+}
+
+// HostsName converts the name to the form the hosts are looked up by
+func HostsName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
@@ -0,0 +1,40 @@
+package proxyutil
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostsTable(t *testing.T) {
+	tbl := NewHostsTable()
+	tbl.Add("Host.LAN", []net.IP{net.ParseIP("192.168.1.10"), net.ParseIP("fd00::10")})
+	tbl.Add("host.lan.", []net.IP{net.IPv4(192, 168, 1, 10)})
+	assert.Equal(t, 1, tbl.Len())
+
+	// The IPv4-mapped duplicate isn't added, the owner is the name as it's
+	// passed
+	rrs, ok := tbl.Lookup("HOST.lan.", dns.TypeA, 30)
+	assert.True(t, ok)
+	if assert.Len(t, rrs, 1) {
+		assert.Equal(t, "192.168.1.10", rrs[0].(*dns.A).A.String())
+		assert.Equal(t, "HOST.lan.", rrs[0].Header().Name)
+		assert.Equal(t, uint32(30), rrs[0].Header().Ttl)
+	}
+
+	// The PTR records are synthesized from the addresses
+	arpa, _ := dns.ReverseAddr("fd00::10")
+	rrs, ok = tbl.Lookup(arpa, dns.TypePTR, 30)
+	assert.True(t, ok)
+	if assert.Len(t, rrs, 1) {
+		assert.Equal(t, "host.lan.", rrs[0].(*dns.PTR).Ptr)
+	}
+
+	// Other types and names aren't in the table
+	_, ok = tbl.Lookup("host.lan.", dns.TypeMX, 30)
+	assert.False(t, ok)
+	_, ok = tbl.Lookup("other.lan.", dns.TypeA, 30)
+	assert.False(t, ok)
+}
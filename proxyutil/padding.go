@@ -0,0 +1,48 @@
+package proxyutil
+
+import (
+	"github.com/miekg/dns"
+)
+
+// PadMsg adds the EDNS padding option (RFC 7830) to the message, so that the
+// size of the packed message is a multiple of blockSize.  The option goes
+// last, so that nothing is added after the size is calculated, and the padding
+// the message already has is replaced.  It must be called again if the message
+// is modified afterwards.  It adds the OPT record if the message has none and
+// returns true in that case.  It does nothing if blockSize is not positive.
+func PadMsg(m *dns.Msg, blockSize int) bool {
+	if blockSize <= 0 {
+		return false
+	}
+
+	added := false
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+		added = true
+	}
+
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(RemoveOption(opt.Option, dns.EDNS0PADDING), padding)
+
+	if l := m.Len(); l%blockSize != 0 {
+		padding.Padding = make([]byte, blockSize-l%blockSize)
+	}
+	return added
+}
+
+// IsPadded returns true if the message has the EDNS padding option
+func IsPadded(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package proxyutil
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPadMsg(t *testing.T) {
+	m := new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+	assert.False(t, IsPadded(m))
+
+	// The OPT record is added
+	assert.True(t, PadMsg(m, 128))
+	assert.True(t, IsPadded(m))
+	buf, err := m.Pack()
+	assert.Nil(t, err)
+	assert.Len(t, buf, 128)
+
+	// The padding is recomputed after the message is changed, it's the last
+	// option and there is only one
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   []byte{192, 0, 2, 1},
+	})
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	assert.False(t, PadMsg(m, 468))
+	buf, err = m.Pack()
+	assert.Nil(t, err)
+	assert.Len(t, buf, 468)
+	opt := m.IsEdns0().Option
+	if assert.Len(t, opt, 2) {
+		assert.Equal(t, uint16(dns.EDNS0PADDING), opt[1].Option())
+	}
+
+	// The previous padding is removed before the new one is calculated
+	assert.False(t, PadMsg(m, 4))
+	buf, err = m.Pack()
+	assert.Nil(t, err)
+	assert.Len(t, buf, 76)
+	assert.Len(t, m.IsEdns0().Option[1].(*dns.EDNS0_PADDING).Padding, 1)
+
+	// Nothing is done if the block size isn't positive
+	m = new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+	assert.False(t, PadMsg(m, 0))
+	assert.Nil(t, m.IsEdns0())
+}
@@ -0,0 +1,38 @@
+// +build linux
+
+package proxyutil
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReusePortSupported is true if UDPListenReusePort can bind several sockets
+// to the same address and the kernel spreads the packets across them
+const ReusePortSupported = true
+
+// UDPListenReusePort creates a UDP socket with SO_REUSEPORT set, so that
+// several sockets can be bound to the same address
+func UDPListenReusePort(addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var opErr error
+			err := c.Control(func(fd uintptr) {
+				opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return opErr
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
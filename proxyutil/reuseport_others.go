@@ -0,0 +1,15 @@
+// +build !linux
+
+package proxyutil
+
+import "net"
+
+// ReusePortSupported is true if UDPListenReusePort can bind several sockets
+// to the same address and the kernel spreads the packets across them
+const ReusePortSupported = false
+
+// UDPListenReusePort creates a regular UDP socket, SO_REUSEPORT is only used
+// on Linux
+func UDPListenReusePort(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return net.ListenUDP("udp", addr)
+}
@@ -1,15 +1,17 @@
+// +build !aix,!darwin,!dragonfly,!linux,!netbsd,!openbsd,!solaris,!freebsd
+
 package proxyutil
 
 import "net"
 
 // UDPGetOOBSize - get max. size of received OOB data
-// Does nothing on Windows
+// Does nothing on Windows and the other platforms without IP_PKTINFO
 func UDPGetOOBSize() int {
 	return 0
 }
 
 // UDPSetOptions - set options on a UDP socket to be able to receive the necessary OOB data
-// Does nothing on Windows
+// Does nothing on Windows and the other platforms without IP_PKTINFO
 func UDPSetOptions(c *net.UDPConn) error {
 	return nil
 }
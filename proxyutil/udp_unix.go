@@ -44,28 +44,60 @@ func UDPRead(c *net.UDPConn, buf []byte, udpOOBSize int) (int, net.IP, *net.UDPA
 		return -1, nil, nil, err
 	}
 
-	localIP := udpGetDstFromOOB(oob[:oobn])
+	localIP := udpGetDstFromOOB(oob[:oobn], remoteAddr.IP.To4() != nil)
 	return n, localIP, remoteAddr, nil
 }
 
-// UDPWrite - writes to the UDP socket and sets local IP to OOB data
+// UDPWrite - writes to the UDP socket and sets local IP to OOB data, so that
+// the response is sent from the address the request was received on.  If the
+// local IP is unknown or can't be used as the source address, the source
+// address is chosen by the system.
 func UDPWrite(bytes []byte, conn *net.UDPConn, remoteAddr *net.UDPAddr, localIP net.IP) (int, error) {
+	if localIP == nil {
+		n, _, err := conn.WriteMsgUDP(bytes, nil, remoteAddr)
+		return n, err
+	}
+
 	n, _, err := conn.WriteMsgUDP(bytes, udpMakeOOBWithSrc(localIP), remoteAddr)
+	if err != nil && !IsConnClosed(err) {
+		// E.g. the address has been removed from the interface meanwhile
+		n, _, err = conn.WriteMsgUDP(bytes, nil, remoteAddr)
+	}
 	return n, err
 }
 
-// udpGetDstFromOOB - get destination IP from OOB data
-func udpGetDstFromOOB(oob []byte) net.IP {
-	cm6 := &ipv6.ControlMessage{}
-	if cm6.Parse(oob) == nil && cm6.Dst != nil {
-		return cm6.Dst
+// udpGetDstFromOOB - get destination IP from OOB data.  The control message
+// of the client's address family is parsed first, so that the other one is
+// only parsed if it's not there.
+func udpGetDstFromOOB(oob []byte, ipv4First bool) net.IP {
+	if ipv4First {
+		if ip := udpGetDst4(oob); ip != nil {
+			return ip
+		}
+		return udpGetDst6(oob)
+	}
+
+	if ip := udpGetDst6(oob); ip != nil {
+		return ip
 	}
+	return udpGetDst4(oob)
+}
 
-	cm4 := &ipv4.ControlMessage{}
-	if cm4.Parse(oob) == nil && cm4.Dst != nil {
-		return cm4.Dst
+// udpGetDst4 returns the destination IP from the IPv4 control message
+func udpGetDst4(oob []byte) net.IP {
+	cm := &ipv4.ControlMessage{}
+	if cm.Parse(oob) == nil {
+		return cm.Dst
 	}
+	return nil
+}
 
+// udpGetDst6 returns the destination IP from the IPv6 control message
+func udpGetDst6(oob []byte) net.IP {
+	cm := &ipv6.ControlMessage{}
+	if cm.Parse(oob) == nil {
+		return cm.Dst
+	}
 	return nil
 }
 
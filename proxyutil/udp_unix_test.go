@@ -0,0 +1,90 @@
+// +build aix darwin dragonfly linux netbsd openbsd solaris freebsd
+
+package proxyutil
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// exchangeUDP sends the packet from a client connected to dst and returns the
+// local IP the server has received it on.  The reply is written with localIP
+// replaced by srcIP if it's not nil.  The connected client only accepts the
+// reply if it comes from dst.
+func exchangeUDP(t *testing.T, srv *net.UDPConn, dst string, srcIP net.IP) (net.IP, error) {
+	client, err := net.Dial("udp", dst)
+	if err != nil {
+		t.Fatalf("cannot dial %s: %s", dst, err)
+	}
+	defer client.Close()
+
+	_, err = client.Write([]byte("ping"))
+	assert.Nil(t, err)
+
+	buf := make([]byte, 512)
+	_ = srv.SetReadDeadline(time.Now().Add(time.Second))
+	n, localIP, remoteAddr, err := UDPRead(srv, buf, UDPGetOOBSize())
+	if err != nil {
+		t.Fatalf("cannot read from the server: %s", err)
+	}
+	assert.Equal(t, "ping", string(buf[:n]))
+
+	if srcIP == nil {
+		srcIP = localIP
+	}
+	n, err = UDPWrite([]byte("pong"), srv, remoteAddr, srcIP)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = client.Read(buf)
+	if err == nil {
+		assert.Equal(t, "pong", string(buf[:n]))
+	}
+	return localIP, err
+}
+
+func TestUDPSourceAddress(t *testing.T) {
+	// The whole 127.0.0.0/8 is local on Linux, so the socket bound to the
+	// unspecified address has several addresses to reply from
+	srv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer srv.Close()
+	assert.Nil(t, UDPSetOptions(srv))
+	_, port, _ := net.SplitHostPort(srv.LocalAddr().String())
+
+	localIP, err := exchangeUDP(t, srv, net.JoinHostPort("127.0.0.1", port), nil)
+	assert.Nil(t, err)
+	assert.True(t, localIP.Equal(net.IPv4(127, 0, 0, 1)), "%s", localIP)
+
+	second := net.IPv4(127, 0, 0, 2)
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: second})
+	if err == nil {
+		_ = l.Close()
+		localIP, err = exchangeUDP(t, srv, net.JoinHostPort(second.String(), port), nil)
+		assert.Nil(t, err)
+		assert.True(t, localIP.Equal(second), "%s", localIP)
+	}
+
+	// The system chooses the source address if the local one can't be used
+	_, err = exchangeUDP(t, srv, net.JoinHostPort("127.0.0.1", port), net.IPv4(192, 0, 2, 1))
+	assert.Nil(t, err)
+
+	// IPv6
+	srv6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		t.Skipf("IPv6 is not available: %s", err)
+	}
+	defer srv6.Close()
+	assert.Nil(t, UDPSetOptions(srv6))
+	_, port, _ = net.SplitHostPort(srv6.LocalAddr().String())
+
+	localIP, err = exchangeUDP(t, srv6, net.JoinHostPort("::1", port), nil)
+	assert.Nil(t, err)
+	assert.True(t, localIP.Equal(net.IPv6loopback), "%s", localIP)
+}
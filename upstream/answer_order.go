@@ -0,0 +1,128 @@
+package upstream
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// AnswerOrder defines how OrderAnswers orders the address records of the
+// response
+type AnswerOrder int
+
+const (
+	// AnswerOrderPreserve keeps the order the upstream has sent
+	AnswerOrderPreserve AnswerOrder = iota
+	// AnswerOrderShuffle randomizes the order of the addresses in every
+	// response, so that the clients that use the first one spread the load
+	AnswerOrderShuffle
+	// AnswerOrderPreferPrivate puts the private addresses (RFC 1918 and
+	// RFC 4193) first for the split-horizon setups
+	AnswerOrderPreferPrivate
+)
+
+// shuffleRand is used to shuffle the addresses, rand.Rand isn't safe for
+// concurrent use
+var shuffleRand = struct {
+	*rand.Rand
+	sync.Mutex
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// OrderAnswers orders the A and AAAA records in the answer section of the
+// response.  The records of every RRset are ordered separately, and the
+// RRSIGs that cover the RRset follow it.  The other records, e.g. the CNAME
+// chain, stay ahead of the address records in their original order.
+func OrderAnswers(m *dns.Msg, order AnswerOrder) {
+	if order == AnswerOrderPreserve || len(m.Answer) < 2 {
+		return
+	}
+
+	var others []dns.RR
+	var keys []proxyutil.RRsetKey
+	addrs := map[proxyutil.RRsetKey][]dns.RR{}
+	sigs := map[proxyutil.RRsetKey][]dns.RR{}
+	for _, rr := range m.Answer {
+		key := proxyutil.RRsetKeyOf(rr)
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			if _, ok := addrs[key]; !ok {
+				keys = append(keys, key)
+			}
+			addrs[key] = append(addrs[key], rr)
+			continue
+		case dns.TypeRRSIG:
+			covered := rr.(*dns.RRSIG).TypeCovered
+			if covered == dns.TypeA || covered == dns.TypeAAAA {
+				sigs[key] = append(sigs[key], rr)
+				continue
+			}
+		}
+		others = append(others, rr)
+	}
+
+	answer := make([]dns.RR, 0, len(m.Answer))
+	answer = append(answer, others...)
+	for _, key := range keys {
+		rrs := addrs[key]
+		orderRRset(rrs, order)
+		answer = append(answer, rrs...)
+		answer = append(answer, sigs[key]...)
+		delete(sigs, key)
+	}
+
+	// The signatures of the RRsets that aren't in the answer are kept too
+	for _, rr := range m.Answer {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			if _, ok = sigs[proxyutil.RRsetKeyOf(rr)]; ok {
+				answer = append(answer, rr)
+			}
+		}
+	}
+
+	m.Answer = answer
+}
+
+// orderRRset orders the address records of a single RRset in place
+func orderRRset(rrs []dns.RR, order AnswerOrder) {
+	if len(rrs) < 2 {
+		return
+	}
+
+	switch order {
+	case AnswerOrderShuffle:
+		shuffleRand.Lock()
+		shuffleRand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+		shuffleRand.Unlock()
+	case AnswerOrderPreferPrivate:
+		sort.SliceStable(rrs, func(i, j int) bool {
+			return isPrivateIP(rrIP(rrs[i])) && !isPrivateIP(rrIP(rrs[j]))
+		})
+	}
+}
+
+// rrIP returns the address of the A or AAAA record
+func rrIP(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+// isPrivateIP checks if the IPv4 address is in one of the RFC 1918 ranges or
+// the IPv6 address is a unique local one (RFC 4193)
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 ||
+			(ip4[0] == 172 && ip4[1]&0xf0 == 16) ||
+			(ip4[0] == 192 && ip4[1] == 168)
+	}
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
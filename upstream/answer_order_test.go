@@ -0,0 +1,87 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newOrderTestMsg creates the response with a CNAME chain, two signed RRsets
+// of addresses and a TXT record
+func newOrderTestMsg() *dns.Msg {
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{
+		newTestRR("www.example.org. 60 IN CNAME web.example.org."),
+		newTestRR("www.example.org. 60 IN RRSIG CNAME 8 3 60 20300101000000 20200101000000 1 example.org. AAAA"),
+		newTestRR("web.example.org. 60 IN A 192.0.2.1"),
+		newTestRR("web.example.org. 60 IN A 10.0.0.1"),
+		newTestRR("web.example.org. 60 IN A 192.0.2.2"),
+		newTestRR("web.example.org. 60 IN A 192.168.1.1"),
+		newTestRR("web.example.org. 60 IN RRSIG A 8 3 60 20300101000000 20200101000000 1 example.org. AAAA"),
+		newTestRR("web.example.org. 60 IN AAAA 2001:db8::1"),
+		newTestRR("web.example.org. 60 IN AAAA fd00::1"),
+		newTestRR("web.example.org. 60 IN RRSIG AAAA 8 3 60 20300101000000 20200101000000 1 example.org. AAAA"),
+		newTestRR("web.example.org. 60 IN TXT \"text\""),
+	}
+	return m
+}
+
+// answerStrings returns the short form of the answer records
+func answerStrings(m *dns.Msg) []string {
+	var s []string
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			s = append(s, "A "+rr.A.String())
+		case *dns.AAAA:
+			s = append(s, "AAAA "+rr.AAAA.String())
+		case *dns.RRSIG:
+			s = append(s, "RRSIG "+dns.Type(rr.TypeCovered).String())
+		default:
+			s = append(s, dns.Type(rr.Header().Rrtype).String())
+		}
+	}
+	return s
+}
+
+func TestOrderAnswers(t *testing.T) {
+	m := newOrderTestMsg()
+	OrderAnswers(m, AnswerOrderPreserve)
+	assert.Equal(t, answerStrings(newOrderTestMsg()), answerStrings(m))
+
+	m = newOrderTestMsg()
+	OrderAnswers(m, AnswerOrderPreferPrivate)
+	assert.Equal(t, []string{
+		"CNAME", "RRSIG CNAME", "TXT",
+		"A 10.0.0.1", "A 192.168.1.1", "A 192.0.2.1", "A 192.0.2.2", "RRSIG A",
+		"AAAA fd00::1", "AAAA 2001:db8::1", "RRSIG AAAA",
+	}, answerStrings(m))
+
+	// The addresses are shuffled, the rest of the records stay in place
+	orders := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		m = newOrderTestMsg()
+		OrderAnswers(m, AnswerOrderShuffle)
+		s := answerStrings(m)
+		if assert.Len(t, s, 11) {
+			assert.Equal(t, []string{"CNAME", "RRSIG CNAME", "TXT"}, s[:3])
+			assert.ElementsMatch(t, []string{"A 192.0.2.1", "A 10.0.0.1", "A 192.0.2.2", "A 192.168.1.1"}, s[3:7])
+			assert.Equal(t, "RRSIG A", s[7])
+			assert.ElementsMatch(t, []string{"AAAA 2001:db8::1", "AAAA fd00::1"}, s[8:10])
+			assert.Equal(t, "RRSIG AAAA", s[10])
+		}
+		orders[s[3]+s[4]+s[5]+s[6]] = true
+	}
+	assert.True(t, len(orders) > 1)
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	for _, ip := range []string{"10.1.2.3", "172.16.0.1", "172.31.255.255", "192.168.0.1", "fc00::1", "fd12::1"} {
+		assert.True(t, isPrivateIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"172.32.0.1", "192.0.2.1", "2001:db8::1", "fe80::1"} {
+		assert.False(t, isPrivateIP(net.ParseIP(ip)), ip)
+	}
+}
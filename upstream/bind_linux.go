@@ -0,0 +1,27 @@
+// +build linux
+
+package upstream
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDeviceSupported is true if the sockets can be bound to an interface
+const bindToDeviceSupported = true
+
+// bindToDevice returns the net.Dialer.Control function that binds the socket
+// to the network interface with SO_BINDTODEVICE
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			opErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, device)
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
@@ -0,0 +1,19 @@
+// +build !linux
+
+package upstream
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToDeviceSupported is true if the sockets can be bound to an interface
+const bindToDeviceSupported = false
+
+// bindToDevice returns the net.Dialer.Control function that fails since
+// SO_BINDTODEVICE is only supported on Linux
+func bindToDevice(_ string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, _ syscall.RawConn) error {
+		return errors.New("binding to a network interface is only supported on Linux")
+	}
+}
@@ -4,14 +4,17 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/dnsstamps"
 	"github.com/joomcode/errorx"
 	"golang.org/x/net/http2"
 )
@@ -29,11 +32,40 @@ var RootCAs *x509.CertPool
 // nolint
 var CipherSuites []uint16
 
+// defaultBootstrapFailureCooldown is the default Options.BootstrapFailureCooldown
+const defaultBootstrapFailureCooldown = time.Second
+
+// maxBootstrapFailureCooldown is the limit of the cooldown that doubles with
+// every bootstrap failure in a row
+const maxBootstrapFailureCooldown = 30 * time.Second
+
+// BootstrapFailedError is returned instead of repeating the bootstrap lookup
+// during the cooldown after it has failed
+type BootstrapFailedError struct {
+	Host  string    // host name the lookup has failed for
+	Retry time.Time // when the lookup is repeated
+	Err   error     // error of the failed lookup
+}
+
+func (e *BootstrapFailedError) Error() string {
+	return fmt.Sprintf("bootstrap recently failed to lookup %s, retrying in %s: %s",
+		e.Host, time.Until(e.Retry).Round(time.Millisecond), e.Err)
+}
+
+// Unwrap returns the error of the failed lookup
+func (e *BootstrapFailedError) Unwrap() error { return e.Err }
+
 type bootstrapper struct {
 	address        string      // in form of "tls://one.one.one.one:853"
 	resolvers      []*Resolver // list of Resolvers to use to resolve hostname, if necessary
 	dialContext    dialHandler // specifies the dial function for creating unencrypted TCP connections.
 	resolvedConfig *tls.Config
+	resolvedAddrs  []string               // addresses the host has been resolved to, nil if it's not resolved
+	sessionCache   tls.ClientSessionCache // shared by all the connections to resume TLS sessions, nil if disabled
+	lookupErr      error                  // the error of the last failed lookup, nil if it succeeded
+	lookupRetry    time.Time              // when the lookup may be repeated after lookupErr
+	lookupFailures int                    // the number of lookups failed in a row
+	lookupSeq      uint64                 // incremented with every recorded lookup result
 	sync.RWMutex
 
 	// stores options for AddressToUpstream func:
@@ -60,8 +92,9 @@ func newBootstrapperResolved(address string, options Options) (*bootstrapper, er
 	}
 
 	b := &bootstrapper{
-		address: address,
-		options: options,
+		address:      address,
+		options:      options,
+		sessionCache: newSessionCache(options),
 	}
 	b.dialContext = b.createDialContext(resolverAddresses)
 	b.resolvedConfig = b.createTLSConfig(host)
@@ -69,6 +102,81 @@ func newBootstrapperResolved(address string, options Options) (*bootstrapper, er
 	return b, nil
 }
 
+// validateBootstrap checks that every Options.Bootstrap entry is an address a
+// bootstrap resolver can be created from, so that the misconfiguration is
+// found when the upstream is created rather than on the first query.  Host
+// names are allowed since the system resolver resolves them, whether the
+// entry is eligible is checked by NewResolver once the bootstrap is needed
+func validateBootstrap(options Options) error {
+	for _, boot := range options.Bootstrap {
+		err := validateBootstrapAddr(boot)
+		if err != nil {
+			return fmt.Errorf("invalid bootstrap %q: %w", boot, err)
+		}
+	}
+	return nil
+}
+
+// validateBootstrapAddr checks that boot is either a DNS stamp or a plain DNS,
+// DNS-over-TCP, DoT or DoH address with an IP address or a host name
+func validateBootstrapAddr(boot string) error {
+	if boot == "" {
+		return errors.New("empty address")
+	}
+	if strings.HasPrefix(boot, "sdns://") {
+		_, err := dnsstamps.NewServerStampFromString(boot)
+		return err
+	}
+
+	hostPort := boot
+	if strings.Contains(boot, "://") {
+		u, err := url.Parse(boot)
+		if err != nil {
+			return err
+		}
+		switch u.Scheme {
+		case "dns", "tcp", "tls", "https":
+		default:
+			return fmt.Errorf("unsupported URL scheme: %s", u.Scheme)
+		}
+		hostPort = u.Host
+	}
+
+	host, _, err := parseHostAndPort(hostPort)
+	if err != nil {
+		return err
+	}
+	host = normalizeHostname(host)
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	if net.ParseIP(host) == nil && !isHostname(host) {
+		return fmt.Errorf("%q is neither an IP address nor a host name", host)
+	}
+	return nil
+}
+
+// isHostname checks that host consists of the labels of up to 63 letters,
+// digits, hyphens and underscores, the trailing dot is optional
+func isHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // newBootstrapper initializes a new bootstrapper instance
 // address -- original resolver address string (i.e. tls://one.one.one.one:853)
 // options -- Upstream customization options
@@ -90,17 +198,37 @@ func newBootstrapper(address string, options Options) (*bootstrapper, error) {
 	}
 
 	return &bootstrapper{
-		address:   address,
-		resolvers: resolvers,
-		options:   options,
+		address:      address,
+		resolvers:    resolvers,
+		options:      options,
+		sessionCache: newSessionCache(options),
 	}, nil
 }
 
+// newSessionCache creates the TLS session cache of the size from options
+func newSessionCache(options Options) tls.ClientSessionCache {
+	if options.sessionCache != nil {
+		return options.sessionCache
+	}
+	if options.TLSSessionCacheSize < 0 {
+		return nil
+	}
+
+	// The default size is used if it's 0
+	return tls.NewLRUClientSessionCache(options.TLSSessionCacheSize)
+}
+
 // dialHandler specifies the dial function for creating unencrypted TCP connections.
 type dialHandler func(ctx context.Context, network, addr string) (net.Conn, error)
 
 // will get usable IP address from Address field, and caches the result
 func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
+	return n.getContext(context.Background())
+}
+
+// getContext is like get, but the bootstrap lookup is also cancelled when ctx
+// is done.  It returns context.Canceled if ctx is cancelled during the lookup.
+func (n *bootstrapper) getContext(parent context.Context) (*tls.Config, dialHandler, error) {
 	n.RLock()
 	if n.dialContext != nil && n.resolvedConfig != nil { // fast path
 		tlsConfig, dialContext := n.resolvedConfig, n.dialContext
@@ -135,6 +263,17 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 		return n.resolvedConfig, n.dialContext, nil
 	}
 
+	// Fail fast if the lookup has failed recently, the bootstrap resolvers
+	// are most likely still down
+	if n.lookupErr != nil && time.Now().Before(n.lookupRetry) {
+		err = &BootstrapFailedError{Host: host, Retry: n.lookupRetry, Err: n.lookupErr}
+		n.RUnlock()
+		log.Tracef("Bootstrap of %s has failed recently: %s", n.address, err)
+		return nil, nil, err
+	}
+	// The failure of this lookup is discarded if another one finishes first
+	seq := n.lookupSeq
+
 	// Don't lock anymore (we can launch multiple lookup requests at a time)
 	// Otherwise, it might mess with the timeout specified for the Upstream
 	// See here: https://github.com/AdguardTeam/dnsproxy/issues/15
@@ -144,18 +283,61 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 	// if it's a hostname
 	//
 
-	var ctx context.Context
+	resolved, err := n.lookup(parent, host, port)
+	if err != nil {
+		if parent.Err() == context.Canceled {
+			return nil, nil, context.Canceled
+		}
+		n.lookupFailed(parent, seq, err)
+		return nil, nil, err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	n.setResolved(host, resolved)
+	return n.resolvedConfig, n.dialContext, nil
+}
+
+// refresh repeats the bootstrap lookup and replaces the resolved addresses if
+// they have changed, it returns true in this case.  The addresses are never
+// refreshed if the host is an IP address or Options.ServerIPAddrs are used.
+func (n *bootstrapper) refresh(ctx context.Context) (bool, error) {
+	host, port, err := getAddressHostPort(n.address)
+	if err != nil || net.ParseIP(host) != nil || len(n.resolvers) == 0 {
+		return false, nil
+	}
+
+	resolved, err := n.lookup(ctx, host, port)
+	if err != nil {
+		return false, err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if sameAddrs(n.resolvedAddrs, resolved) {
+		return false, nil
+	}
+
+	log.Debug("Addresses of %s have changed from %v to %v", n.address, n.resolvedAddrs, resolved)
+	n.setResolved(host, resolved)
+	return true, nil
+}
+
+// lookup resolves host with the bootstrap resolvers and returns its addresses
+// joined with port
+func (n *bootstrapper) lookup(parent context.Context, host, port string) ([]string, error) {
+	ctx := parent
 	if n.options.Timeout > 0 {
-		ctxWithTimeout, cancel := context.WithTimeout(context.TODO(), n.options.Timeout)
+		ctxWithTimeout, cancel := context.WithTimeout(parent, n.options.Timeout)
 		defer cancel() // important to avoid a resource leak
 		ctx = ctxWithTimeout
-	} else {
-		ctx = context.Background()
 	}
 
 	addrs, err := LookupParallel(ctx, n.resolvers, host)
 	if err != nil {
-		return nil, nil, errorx.Decorate(err, "failed to lookup %s", host)
+		return nil, errorx.Decorate(err, "failed to lookup %s", host)
 	}
 
 	resolved := []string{}
@@ -169,15 +351,79 @@ func (n *bootstrapper) get() (*tls.Config, dialHandler, error) {
 
 	if len(resolved) == 0 {
 		// couldn't find any suitable IP address
-		return nil, nil, fmt.Errorf("couldn't find any suitable IP address for host %s", host)
+		return nil, fmt.Errorf("couldn't find any suitable IP address for host %s", host)
+	}
+	return resolved, nil
+}
+
+// setResolved records the successful lookup of host, n must be locked
+func (n *bootstrapper) setResolved(host string, resolved []string) {
+	n.lookupSeq++
+	n.lookupErr = nil
+	n.lookupFailures = 0
+	n.resolvedAddrs = resolved
+	n.dialContext = n.createDialContext(resolved)
+	n.resolvedConfig = n.createTLSConfig(host)
+}
+
+// sameAddrs checks if a and b contain the same addresses in any order
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupFailed remembers the error so that the lookups fail fast during the
+// cooldown.  seq is lookupSeq from the start of the lookup, the failure is
+// discarded if another lookup has finished since then: either it succeeded,
+// or its failure has already started the cooldown.  The lookups cancelled by
+// the caller don't count.
+func (n *bootstrapper) lookupFailed(parent context.Context, seq uint64, err error) {
+	if parent.Err() == context.Canceled {
+		return
 	}
 
 	n.Lock()
 	defer n.Unlock()
 
-	n.dialContext = n.createDialContext(resolved)
-	n.resolvedConfig = n.createTLSConfig(host)
-	return n.resolvedConfig, n.dialContext, nil
+	cooldown := n.options.BootstrapFailureCooldown
+	if cooldown < 0 || seq != n.lookupSeq {
+		return
+	}
+
+	n.lookupSeq++
+	n.lookupFailures++
+	n.lookupErr = err
+	n.lookupRetry = time.Now().Add(failureCooldown(cooldown, n.lookupFailures))
+}
+
+// failureCooldown returns the cooldown after the number of failures in a row,
+// it starts with base (or the default one if it's 0) and doubles with every
+// failure up to maxBootstrapFailureCooldown
+func failureCooldown(base time.Duration, failures int) time.Duration {
+	if base == 0 {
+		base = defaultBootstrapFailureCooldown
+	}
+
+	cooldown := base
+	for i := 1; i < failures && cooldown < maxBootstrapFailureCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > maxBootstrapFailureCooldown {
+		return maxBootstrapFailureCooldown
+	}
+	return cooldown
 }
 
 // createTLSConfig creates a client TLS config
@@ -189,6 +435,11 @@ func (n *bootstrapper) createTLSConfig(host string) *tls.Config {
 		MinVersion:            tls.VersionTLS12,
 		InsecureSkipVerify:    n.options.InsecureSkipVerify,
 		VerifyPeerCertificate: n.options.VerifyServerCertificate,
+		ClientSessionCache:    n.sessionCache,
+	}
+
+	if n.options.ClientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*n.options.ClientCert}
 	}
 
 	tlsConfig.NextProtos = []string{
@@ -200,9 +451,7 @@ func (n *bootstrapper) createTLSConfig(host string) *tls.Config {
 
 // createDialContext returns dialContext function that tries to establish connection with all given addresses one by one
 func (n *bootstrapper) createDialContext(addresses []string) (dialContext dialHandler) {
-	dialer := &net.Dialer{
-		Timeout: n.options.Timeout,
-	}
+	dial := newDialHandler(n.options)
 
 	dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 		errs := []error{}
@@ -212,7 +461,7 @@ func (n *bootstrapper) createDialContext(addresses []string) (dialContext dialHa
 		for _, resolverAddress := range addresses {
 			log.Tracef("Dialing to %s", resolverAddress)
 			start := time.Now()
-			con, err := dialer.DialContext(ctx, network, resolverAddress)
+			con, err := dial(ctx, network, resolverAddress)
 			elapsed := time.Since(start) / time.Millisecond
 
 			if err == nil {
@@ -231,6 +480,34 @@ func (n *bootstrapper) createDialContext(addresses []string) (dialContext dialHa
 	return
 }
 
+// newDialHandler returns Options.DialContext if it's set, or the function that
+// dials with net.Dialer otherwise.  The connections go through Options.ProxyURL
+// if it's set.
+func newDialHandler(options Options) dialHandler {
+	var dial dialHandler
+	if options.DialContext != nil {
+		dial = options.DialContext
+	} else if bindsLocally(options) {
+		dial = newLocalDialHandler(options)
+	} else {
+		dialer := &net.Dialer{
+			Timeout: options.Timeout,
+		}
+		dial = dialer.DialContext
+	}
+
+	if options.ProxyURL == "" {
+		return dial
+	}
+
+	// The URL is validated when the upstream is created
+	proxyURL, err := parseProxyURL(options.ProxyURL)
+	if err != nil {
+		return func(_ context.Context, _, _ string) (net.Conn, error) { return nil, err }
+	}
+	return newProxyDialHandler(proxyURL, dial)
+}
+
 // getAddressHostPort splits resolver address into host and port
 // returns host, port
 func getAddressHostPort(address string) (string, string, error) {
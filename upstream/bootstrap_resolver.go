@@ -29,6 +29,11 @@ func NewResolver(resolverAddress string, options Options) (*Resolver, error) {
 	// set default net.Resolver as a resolver if resolverAddress is empty
 	if resolverAddress == "" {
 		r.resolver = &net.Resolver{}
+		if bindsLocally(options) {
+			// The system resolvers are queried from the local address too
+			r.resolver.PreferGo = true
+			r.resolver.Dial = newLocalDialHandler(options)
+		}
 		return r, nil
 	}
 
@@ -37,6 +42,9 @@ func NewResolver(resolverAddress string, options Options) (*Resolver, error) {
 	opts := Options{
 		Timeout:                 options.Timeout,
 		VerifyServerCertificate: options.VerifyServerCertificate,
+		LocalAddr:               options.LocalAddr,
+		BindToDevice:            options.BindToDevice,
+		ProxyURL:                options.ProxyURL,
 	}
 	r.upstream, err = AddressToUpstream(resolverAddress, opts)
 	if err != nil {
@@ -111,12 +119,19 @@ func isResolverValidBootstrap(upstream Upstream) bool {
 	return true
 }
 
+// contextExchanger is implemented by the upstreams that stop the exchange once
+// the context is done, so that the bootstrap lookups don't outlive it.  The
+// other upstreams only stop once their timeout expires.
+type contextExchanger interface {
+	exchangeContext(ctx context.Context, m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error)
+}
+
 type resultError struct {
 	resp *dns.Msg
 	err  error
 }
 
-func (r *Resolver) resolve(host string, qtype uint16, ch chan *resultError) {
+func (r *Resolver) resolve(ctx context.Context, host string, qtype uint16, ch chan *resultError) {
 	req := dns.Msg{}
 	req.Id = dns.Id()
 	req.RecursionDesired = true
@@ -127,7 +142,13 @@ func (r *Resolver) resolve(host string, qtype uint16, ch chan *resultError) {
 			Qclass: dns.ClassINET,
 		},
 	}
-	resp, err := r.upstream.Exchange(&req)
+	var resp *dns.Msg
+	var err error
+	if u, ok := r.upstream.(contextExchanger); ok {
+		resp, err = u.exchangeContext(ctx, &req, nil)
+	} else {
+		resp, err = r.upstream.Exchange(&req)
+	}
 	ch <- &resultError{resp, err}
 }
 
@@ -150,9 +171,11 @@ func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr,
 		host += "."
 	}
 
-	ch := make(chan *resultError)
-	go r.resolve(host, dns.TypeA, ch)
-	go r.resolve(host, dns.TypeAAAA, ch)
+	// Buffered so that the resolving goroutines don't block forever if the
+	// context is cancelled before they finish
+	ch := make(chan *resultError, 2)
+	go r.resolve(ctx, host, dns.TypeA, ch)
+	go r.resolve(ctx, host, dns.TypeAAAA, ch)
 
 	var ipAddrs []net.IPAddr
 	var errs []error
@@ -171,6 +194,8 @@ wait:
 			if n == 2 {
 				break wait
 			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
 
@@ -5,10 +5,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNewResolver(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	r, err := NewResolver("1.1.1.1:53", Options{Timeout: 3 * time.Second})
 	assert.Nil(t, err)
 
@@ -33,6 +37,8 @@ func TestNewResolver(t *testing.T) {
 }
 
 func TestNewResolverIsValid(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	withTimeoutOpt := Options{Timeout: 3 * time.Second}
 
 	r, err := NewResolver("1.1.1.1:53", withTimeoutOpt)
@@ -84,3 +90,53 @@ func TestNewResolverIsValid(t *testing.T) {
 	r, err = NewResolver("dns.adguard.com", Options{})
 	assert.NotNil(t, err)
 }
+
+func TestResolverLookupCancel(t *testing.T) {
+	// The stub server never answers until released
+	release := make(chan struct{})
+	srv, err := dnsproxytest.NewPlainServer(func(m *dns.Msg) *dns.Msg {
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+	defer close(release)
+
+	for _, address := range []string{srv.Addr, "tcp://" + srv.Addr} {
+		r, err := NewResolver(address, Options{Timeout: 10 * time.Second})
+		if err != nil {
+			t.Fatalf("cannot create the resolver: %s", err)
+		}
+		b := &bootstrapper{address: "tls://example.org:853", resolvers: []*Resolver{r}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error, 1)
+		go func() {
+			_, _, lookupErr := b.getContext(ctx)
+			errCh <- lookupErr
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		cancelled := time.Now()
+
+		// The lookup returns as soon as it's cancelled, although the
+		// resolver hasn't answered
+		select {
+		case err = <-errCh:
+			assert.Equal(t, context.Canceled, err, address)
+			assert.True(t, time.Since(cancelled) < 100*time.Millisecond, time.Since(cancelled).String())
+		case <-time.After(time.Second):
+			t.Fatalf("the bootstrap lookup to %s hasn't been cancelled", address)
+		}
+
+		// The exchanges of the lookup goroutines are interrupted as well,
+		// so the upstream shuts down without waiting for the server
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second)
+		err = r.upstream.(Closer).Shutdown(shutdownCtx)
+		shutdownCancel()
+		assert.Nil(t, err, address)
+	}
+}
@@ -2,8 +2,15 @@ package upstream
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 // See the details here: https://github.com/AdguardTeam/dnsproxy/issues/18
@@ -34,3 +41,112 @@ func TestDialContext(t *testing.T) {
 		}
 	}
 }
+
+func TestBootstrapFailureCooldown(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	// The bootstrap resolver doesn't answer until it's "up"
+	var up int32
+	srv, err := dnsproxytest.NewPlainServer(func(req *dns.Msg) *dns.Msg {
+		if atomic.LoadInt32(&up) == 0 {
+			return nil
+		}
+		resp := new(dns.Msg).SetReply(req)
+		if req.Question[0].Qtype == dns.TypeA {
+			resp.Answer = []dns.RR{newTestRR("%s 60 IN A 127.0.0.1", req.Question[0].Name)}
+		}
+		return resp
+	})
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
+	u, err := AddressToUpstream("tls://dns.example:853", Options{
+		Bootstrap: []string{srv.Addr},
+		Timeout:   timeout,
+	})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	start := time.Now()
+	_, err = u.Exchange(createTestMessage())
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) >= timeout)
+
+	// The next exchanges fail fast with the wrapped error
+	b := u.(*dnsOverTLS).boot
+	for i := 0; i < 5; i++ {
+		start = time.Now()
+		_, _, nextErr := b.get()
+		var failedErr *BootstrapFailedError
+		if assert.True(t, errors.As(nextErr, &failedErr)) {
+			assert.Equal(t, "dns.example", failedErr.Host)
+			assert.Contains(t, nextErr.Error(), "bootstrap recently failed")
+		}
+		assert.True(t, time.Since(start) < timeout/2)
+	}
+	b.RLock()
+	firstErr := b.lookupErr
+	assert.True(t, time.Until(b.lookupRetry) <= time.Second)
+	b.RUnlock()
+
+	// The cooldown doubles after the next failure
+	b.Lock()
+	b.lookupRetry = time.Now()
+	b.Unlock()
+	_, _, err = b.get()
+	assert.NotNil(t, err)
+	b.RLock()
+	assert.True(t, time.Until(b.lookupRetry) > 1500*time.Millisecond)
+	b.RUnlock()
+
+	// The failure of a lookup that started before a success is discarded
+	b.RLock()
+	seq := b.lookupSeq
+	b.RUnlock()
+	atomic.StoreInt32(&up, 1)
+	b.Lock()
+	b.lookupRetry = time.Now()
+	b.Unlock()
+
+	// The lookup is repeated after the cooldown, and its success resets the
+	// error
+	_, _, err = b.get()
+	assert.Nil(t, err)
+	b.lookupFailed(context.Background(), seq, firstErr)
+	b.RLock()
+	assert.Nil(t, b.lookupErr)
+	assert.Equal(t, 0, b.lookupFailures)
+	b.RUnlock()
+}
+
+func TestFailureCooldown(t *testing.T) {
+	assert.Equal(t, time.Second, failureCooldown(0, 1))
+	assert.Equal(t, 4*time.Second, failureCooldown(0, 3))
+	assert.Equal(t, 30*time.Second, failureCooldown(0, 100))
+	assert.Equal(t, 200*time.Millisecond, failureCooldown(100*time.Millisecond, 2))
+	assert.Equal(t, 30*time.Second, failureCooldown(time.Minute, 1))
+}
+
+func TestBootstrapValidation(t *testing.T) {
+	invalid := []string{"", "not a host!", "1.1.1.1:99999", "ftp://1.1.1.1", "sdns://invalid"}
+	for _, boot := range invalid {
+		// The entry is checked even if the upstream doesn't need the bootstrap
+		for _, address := range []string{"8.8.8.8", "tls://1.1.1.1", "tls://dns.adguard.com"} {
+			_, err := AddressToUpstream(address, Options{Bootstrap: []string{"8.8.8.8", boot}})
+			if assert.NotNil(t, err, "%s with bootstrap %q", address, boot) {
+				assert.Contains(t, err.Error(), fmt.Sprintf("invalid bootstrap %q", boot))
+			}
+		}
+	}
+
+	// The host names are left to the system resolver
+	valid := []string{"dns.google", "tls://dns.google:853", "[::1]:53", "https://1.1.1.1/dns-query"}
+	u, err := AddressToUpstream("8.8.8.8", Options{Bootstrap: valid})
+	if err != nil {
+		t.Fatalf("cannot create the upstream: %s", err)
+	}
+	assert.Equal(t, "8.8.8.8:53", u.Address())
+}
@@ -0,0 +1,48 @@
+package upstream
+
+import (
+	"net"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// bytesPool keeps the *[]byte buffers for packing and reading the messages,
+// they're large enough for any DNS message with the 2-byte length prefix
+var bytesPool = &sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 2+dns.MaxMsgSize)
+		return &b
+	},
+}
+
+// writePrefixedMsg packs the message with the length prefix and writes it to
+// the stream connection, it returns the size of the message without the prefix
+func writePrefixedMsg(conn net.Conn, m *dns.Msg) (int, error) {
+	bufPtr := bytesPool.Get().(*[]byte)
+	defer bytesPool.Put(bufPtr)
+	buf := *bufPtr
+
+	b, err := proxyutil.PackPrefixed(m, buf)
+	if err != nil {
+		return 0, err
+	}
+	_, err = conn.Write(b)
+	return len(b) - 2, err
+}
+
+// readPrefixedMsg reads the message with the length prefix from the stream
+// connection, it also returns the size of the message without the prefix
+func readPrefixedMsg(conn net.Conn) (*dns.Msg, int, error) {
+	bufPtr := bytesPool.Get().(*[]byte)
+	defer bytesPool.Put(bufPtr)
+	buf := *bufPtr
+
+	b, err := proxyutil.ReadPrefixedBuffer(conn, buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, err := proxyutil.UnpackMsg(b)
+	return m, len(b), err
+}
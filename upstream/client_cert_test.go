@@ -0,0 +1,98 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientCert(t *testing.T) {
+	cert, err := dnsproxytest.NewClientCertificate()
+	if err != nil {
+		t.Fatalf("cannot generate the client certificate: %s", err)
+	}
+	ca, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("cannot parse the client certificate: %s", err)
+	}
+	otherCert, err := dnsproxytest.NewClientCertificate()
+	if err != nil {
+		t.Fatalf("cannot generate the client certificate: %s", err)
+	}
+
+	dot, err := dnsproxytest.NewMutualTLSServer(nil, ca)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer dot.Close()
+	doh, err := dnsproxytest.NewMutualHTTPSServer(nil, ca)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer doh.Close()
+
+	exchange := func(address string, opts Options) error {
+		opts.Timeout = timeout
+		opts.InsecureSkipVerify = true
+		u, err := AddressToUpstream(address, opts)
+		if err != nil {
+			t.Fatalf("cannot create upstream %s: %s", address, err)
+		}
+		defer u.(Closer).Close()
+
+		_, err = u.Exchange(createTestMessage())
+		return err
+	}
+
+	for _, srv := range []*dnsproxytest.Server{dot, doh} {
+		// The handshake only succeeds with the certificate the server trusts
+		assert.Nil(t, exchange(srv.URL, Options{ClientCert: &cert}), srv.URL)
+		assert.NotNil(t, exchange(srv.URL, Options{}), srv.URL)
+		assert.NotNil(t, exchange(srv.URL, Options{ClientCert: &otherCert}), srv.URL)
+
+		// The pins are still checked
+		hash := sha256.Sum256(srv.Certificate.RawSubjectPublicKeyInfo)
+		pin := "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+		otherPin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+		assert.Nil(t, exchange(srv.URL+"?pin="+pin, Options{ClientCert: &cert}), srv.URL)
+		err = exchange(srv.URL+"?pin="+otherPin, Options{ClientCert: &cert})
+		if assert.NotNil(t, err, srv.URL) {
+			assert.Contains(t, err.Error(), errPinMismatch.Error())
+		}
+
+		// The host name is sent in SNI while the IP address is used to
+		// connect
+		_, port, _ := net.SplitHostPort(srv.Addr)
+		address := strings.Replace(srv.URL, srv.Addr, "localhost:"+port, 1)
+		u, err := AddressToUpstream(address, Options{
+			Timeout:            timeout,
+			InsecureSkipVerify: true,
+			ClientCert:         &cert,
+			ServerIPAddrs:      []net.IP{{127, 0, 0, 1}},
+		})
+		if err != nil {
+			t.Fatalf("cannot create upstream %s: %s", address, err)
+		}
+		_, err = u.Exchange(createTestMessage())
+		assert.Nil(t, err, address)
+		state := u.(interface{ TLSState() *TLSState }).TLSState()
+		if assert.NotNil(t, state) {
+			assert.Equal(t, "localhost", state.ServerName)
+		}
+		_ = u.(Closer).Close()
+	}
+}
+
+func TestClientCertSessions(t *testing.T) {
+	cert := &tls.Certificate{}
+	assert.True(t, canShareSessions(Options{ClientCert: cert}, Options{ClientCert: cert}))
+	assert.False(t, canShareSessions(Options{ClientCert: cert}, Options{}))
+	assert.False(t, canShareSessions(Options{ClientCert: cert}, Options{ClientCert: &tls.Certificate{}}))
+}
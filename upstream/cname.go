@@ -0,0 +1,138 @@
+package upstream
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// MaxCNAMEChain limits the number of the follow-up queries sent to resolve the
+// CNAME chain of a single response
+const MaxCNAMEChain = 8
+
+// followCNAME returns exchange itself if follow is false.  Otherwise, it
+// returns the exchange that re-queries the CNAME target while the response has
+// the CNAME chain without the records of the requested type at its end, see
+// Options.FollowCNAME.
+func followCNAME(follow bool, exchange exchangeWithTrace) exchangeWithTrace {
+	if !follow {
+		return exchange
+	}
+
+	return func(m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
+		reply, err := exchange(m, tr)
+		if err != nil || reply == nil || len(m.Question) != 1 {
+			return reply, err
+		}
+
+		q := m.Question[0]
+		if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+			return reply, nil
+		}
+
+		return ChaseCNAME(reply, q.Name, q.Qtype, func(target string) (*dns.Msg, error) {
+			req := m.Copy()
+			req.Id = dns.Id()
+			req.Question[0].Name = target
+			return exchange(req, tr)
+		}), nil
+	}
+}
+
+// ChaseCNAME resolves the CNAME chain the successful reply to the query for
+// name ends with if it has no records of qtype.  The targets are resolved with
+// resolve, at most MaxCNAMEChain of them, and the records the reply doesn't
+// have yet are added to its answer.  The response code and the authority
+// section become the ones of the last name in the chain (RFC 6604).  If
+// resolve fails, the partially resolved chain is returned.
+func ChaseCNAME(reply *dns.Msg, name string, qtype uint16, resolve func(target string) (*dns.Msg, error)) *dns.Msg {
+	target := UnresolvedCNAME(reply.Answer, name, qtype)
+	for hops := 0; target != "" && reply.Rcode == dns.RcodeSuccess; hops++ {
+		if hops == MaxCNAMEChain {
+			log.Debug("The CNAME chain of %s is too long, stopping at %s", name, target)
+			break
+		}
+
+		log.Tracef("Resolving the CNAME target %s of %s", target, name)
+		next, err := resolve(target)
+		if err != nil {
+			log.Debug("Failed to resolve the CNAME target %s of %s: %s", target, name, err)
+			break
+		}
+
+		reply.Answer = appendChain(reply.Answer, next.Answer)
+		reply.Ns = next.Ns
+		reply.Rcode = next.Rcode
+		reply.AuthenticatedData = reply.AuthenticatedData && next.AuthenticatedData
+
+		last := target
+		target = UnresolvedCNAME(reply.Answer, name, qtype)
+		if target == last {
+			// The target has no records of the type
+			break
+		}
+	}
+	return reply
+}
+
+// UnresolvedCNAME follows the CNAME chain from name in the answer and returns
+// the last target if it has no records of qtype.  It returns an empty string
+// if the chain is resolved, there is no CNAME for name, or the chain is a
+// loop.
+func UnresolvedCNAME(answer []dns.RR, name string, qtype uint16) string {
+	cnames := map[string]string{}
+	resolved := map[string]bool{}
+	for _, rr := range answer {
+		h := rr.Header()
+		owner := strings.ToLower(h.Name)
+		switch h.Rrtype {
+		case qtype:
+			resolved[owner] = true
+		case dns.TypeCNAME:
+			if _, ok := cnames[owner]; !ok {
+				cnames[owner] = strings.ToLower(rr.(*dns.CNAME).Target)
+			}
+		}
+	}
+
+	name = strings.ToLower(name)
+	visited := map[string]bool{}
+	for !resolved[name] {
+		visited[name] = true
+		target, ok := cnames[name]
+		if !ok {
+			if len(visited) == 1 {
+				return ""
+			}
+			return name
+		}
+		if visited[target] {
+			log.Debug("CNAME loop at %s", target)
+			return ""
+		}
+		name = target
+	}
+	return ""
+}
+
+// appendChain appends the records the answer doesn't have yet, the CNAME for
+// the name that already has one is dropped so that the chains don't cross
+func appendChain(answer, rrs []dns.RR) []dns.RR {
+outer:
+	for _, rr := range rrs {
+		for _, a := range answer {
+			if dns.IsDuplicate(a, rr) || isSameCNAMEOwner(a, rr) {
+				continue outer
+			}
+		}
+		answer = append(answer, rr)
+	}
+	return answer
+}
+
+// isSameCNAMEOwner returns true if both records are CNAMEs of the same name
+func isSameCNAMEOwner(a, b dns.RR) bool {
+	return a.Header().Rrtype == dns.TypeCNAME && b.Header().Rrtype == dns.TypeCNAME &&
+		strings.EqualFold(a.Header().Name, b.Header().Name)
+}
@@ -0,0 +1,74 @@
+package upstream
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFollowCNAME(t *testing.T) {
+	// The server only sends the CNAME, the loop and the A record are answered
+	// on the follow-up queries
+	var queries int32
+	srv, err := dnsproxytest.NewPlainServer(func(req *dns.Msg) *dns.Msg {
+		atomic.AddInt32(&queries, 1)
+		resp := new(dns.Msg).SetReply(req)
+		name := req.Question[0].Name
+		switch name {
+		case "www.example.org.":
+			resp.Answer = []dns.RR{newTestRR("www.example.org. 60 IN CNAME cdn.example.net.")}
+		case "cdn.example.net.":
+			// The records the first response has are repeated
+			resp.Answer = []dns.RR{
+				newTestRR("www.example.org. 60 IN CNAME cdn.example.net."),
+				newTestRR("cdn.example.net. 60 IN A 192.0.2.1"),
+			}
+		case "loop1.example.org.":
+			resp.Answer = []dns.RR{newTestRR("loop1.example.org. 60 IN CNAME loop2.example.org.")}
+		case "loop2.example.org.":
+			resp.Answer = []dns.RR{newTestRR("loop2.example.org. 60 IN CNAME loop1.example.org.")}
+		default:
+			resp.Rcode = dns.RcodeNameError
+		}
+		return resp
+	})
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
+	u, err := AddressToUpstream(srv.Addr, Options{Timeout: timeout, FollowCNAME: true})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	req := new(dns.Msg).SetQuestion("www.example.org.", dns.TypeA)
+	reply, err := u.Exchange(req)
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.Equal(t, req.Id, reply.Id)
+	assert.Equal(t, "www.example.org.", reply.Question[0].Name)
+	if assert.Len(t, reply.Answer, 2) {
+		assert.Equal(t, "cdn.example.net.", reply.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "192.0.2.1", reply.Answer[1].(*dns.A).A.String())
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+
+	// The loop is only followed once
+	atomic.StoreInt32(&queries, 0)
+	reply, err = u.Exchange(new(dns.Msg).SetQuestion("loop1.example.org.", dns.TypeA))
+	assert.Nil(t, err)
+	assert.Len(t, reply.Answer, 2)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+
+	// The CNAME isn't followed by default
+	u, err = AddressToUpstream(srv.Addr, Options{Timeout: timeout})
+	assert.Nil(t, err)
+	reply, err = u.Exchange(req)
+	assert.Nil(t, err)
+	assert.Len(t, reply.Answer, 1)
+}
@@ -0,0 +1,88 @@
+package upstream
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// clientCookieLen is the length of the client cookie in hex
+const clientCookieLen = 16
+
+// errCookie is returned when the response has the client cookie other than
+// the one sent in the request, which means it's most likely spoofed
+var errCookie = errors.New("response client cookie doesn't match the request")
+
+// dnsCookies keeps the DNS cookies (RFC 7873) of a plain DNS upstream
+type dnsCookies struct {
+	client string     // client cookie, hex
+	server string     // last server cookie, hex, empty until the server sends one
+	mu     sync.Mutex // protects server
+}
+
+// newDNSCookies creates a random client cookie
+func newDNSCookies() *dnsCookies {
+	b := make([]byte, clientCookieLen/2)
+	_, _ = rand.Read(b)
+	return &dnsCookies{client: hex.EncodeToString(b)}
+}
+
+// attach returns a copy of the request with the COOKIE option that contains
+// the client cookie and the last server cookie.  The cookie the request
+// already has, if any, is replaced.  It returns true if the OPT record was
+// added to the request.
+func (c *dnsCookies) attach(m *dns.Msg) (*dns.Msg, bool) {
+	c.mu.Lock()
+	cookie := c.client + c.server
+	c.mu.Unlock()
+
+	req := m.Copy()
+	added := false
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+		added = true
+	}
+
+	opt.Option = proxyutil.RemoveOption(opt.Option, dns.EDNS0COOKIE)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return req, added
+}
+
+// update remembers the server cookie from the response and removes the COOKIE
+// option from it.  If the OPT record was added by attach, it's removed.  It
+// returns errCookie if the response has someone else's client cookie.
+func (c *dnsCookies) update(reply *dns.Msg, removeOPT bool) error {
+	opt := reply.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		cookie, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+
+		if len(cookie.Cookie) < clientCookieLen || !strings.EqualFold(cookie.Cookie[:clientCookieLen], c.client) {
+			return errCookie
+		}
+
+		c.mu.Lock()
+		c.server = cookie.Cookie[clientCookieLen:]
+		c.mu.Unlock()
+	}
+
+	if removeOPT {
+		proxyutil.RemoveOPT(reply)
+	} else {
+		opt.Option = proxyutil.RemoveOption(opt.Option, dns.EDNS0COOKIE)
+	}
+	return nil
+}
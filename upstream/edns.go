@@ -0,0 +1,61 @@
+package upstream
+
+import (
+	"sort"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// withEDNSOptions returns a copy of the request with the options added to its
+// OPT record, or the request itself if there are no options.  The options the
+// request already has, e.g. ECS, are kept over the ones with the same code.
+// The options are ordered by the code and only the first one of every code is
+// kept.  It returns true if the OPT record was added to the request.
+func withEDNSOptions(m *dns.Msg, options []dns.EDNS0) (*dns.Msg, bool) {
+	if len(options) == 0 {
+		return m, false
+	}
+
+	req := m.Copy()
+	opt := req.IsEdns0()
+	addedOPT := opt == nil
+	if addedOPT {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+	}
+
+	merged := make([]dns.EDNS0, 0, len(opt.Option)+len(options))
+	seen := map[uint16]bool{}
+	for _, o := range append(opt.Option, options...) {
+		if !seen[o.Option()] {
+			seen[o.Option()] = true
+			merged = append(merged, o)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Option() < merged[j].Option() })
+
+	opt.Option = merged
+	return req, addedOPT
+}
+
+// removeAddedOPT removes the OPT record from the response if withEDNSOptions
+// has added it to the request, so that it doesn't reach the client that
+// hasn't sent one.  The record is kept in tr for ExchangeInfo.
+func removeAddedOPT(reply *dns.Msg, addedOPT bool, tr *exchangeTrace) {
+	if !addedOPT || reply == nil {
+		return
+	}
+
+	tr.removedOPT(reply.IsEdns0())
+	proxyutil.RemoveOPT(reply)
+}
+
+// NewExpireOption returns the EDNS EXPIRE option (RFC 7314) that requests the
+// expire value of the zone when it's added to Options.EDNSOptions.  The
+// option must be empty in the query, and dns.EDNS0_EXPIRE is always packed
+// with the value.  The servers only send the value in the responses to SOA,
+// AXFR and IXFR queries, see ExchangeInfo.Expire.
+func NewExpireOption() dns.EDNS0 {
+	return &dns.EDNS0_LOCAL{Code: dns.EDNS0EXPIRE}
+}
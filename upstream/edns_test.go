@@ -0,0 +1,104 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEDNSOptions(t *testing.T) {
+	// Prepare a stub server that saves the query and sends its NSID if it's
+	// requested
+	queries := make(chan *dns.Msg, 1)
+	srv, err := dnsproxytest.NewPlainServer(func(req *dns.Msg) *dns.Msg {
+		queries <- req
+
+		resp := new(dns.Msg).SetReply(req)
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		for _, o := range req.IsEdns0().Option {
+			if o.Option() == dns.EDNS0NSID {
+				nsid := &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "6e73312e6578616d706c65"}
+				resp.IsEdns0().Option = append(resp.IsEdns0().Option, nsid)
+			}
+		}
+		return resp
+	})
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
+	u, err := AddressToUpstream(srv.Addr, Options{
+		Timeout:          timeout,
+		EnableDNSCookies: true,
+		EDNSOptions: []dns.EDNS0{
+			&dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE},
+			&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+			&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 8, Address: net.IP{10, 0, 0, 0}},
+			&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "ff"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	// The ECS option of the query is kept
+	req := createTestMessage()
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IP{192, 0, 2, 0}}
+	req.IsEdns0().Option = []dns.EDNS0{ecs}
+
+	reply, err := u.Exchange(req)
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.Len(t, req.IsEdns0().Option, 1)
+
+	var codes []uint16
+	q := <-queries
+	for _, o := range q.IsEdns0().Option {
+		codes = append(codes, o.Option())
+		switch o := o.(type) {
+		case *dns.EDNS0_NSID:
+			assert.Equal(t, "", o.Nsid)
+		case *dns.EDNS0_SUBNET:
+			assert.Equal(t, uint8(24), o.SourceNetmask)
+		}
+	}
+	// The options are ordered by the code and the cookie is added after them
+	assert.Equal(t, []uint16{dns.EDNS0NSID, dns.EDNS0SUBNET, dns.EDNS0EXPIRE, dns.EDNS0COOKIE}, codes)
+
+	opt := reply.IsEdns0()
+	if assert.NotNil(t, opt) && assert.Len(t, opt.Option, 1) {
+		assert.Equal(t, "6e73312e6578616d706c65", opt.Option[0].(*dns.EDNS0_NSID).Nsid)
+	}
+
+	// The OPT record added to the query without one is removed from the
+	// response, but the NSID is still reported
+	reply, info, err := ExchangeWithInfo(u, createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	<-queries
+	assert.Nil(t, reply.IsEdns0())
+	assert.Equal(t, []byte("ns1.example"), info.NSID)
+}
+
+func TestWithEDNSOptions(t *testing.T) {
+	req := createTestMessage()
+	res, added := withEDNSOptions(req, nil)
+	assert.True(t, req == res)
+	assert.False(t, added)
+
+	// The OPT record is added to the copy
+	res, added = withEDNSOptions(req, []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID}})
+	assert.True(t, added)
+	assert.Nil(t, req.IsEdns0())
+	if assert.NotNil(t, res.IsEdns0()) {
+		assert.Equal(t, uint16(dns.DefaultMsgSize), res.IsEdns0().UDPSize())
+		assert.Len(t, res.IsEdns0().Option, 1)
+	}
+}
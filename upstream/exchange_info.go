@@ -0,0 +1,256 @@
+package upstream
+
+import (
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ExchangeInfo contains the information about the response received from an
+// upstream
+type ExchangeInfo struct {
+	Authenticated bool // the response has the AD bit set, i.e. the upstream validated it with DNSSEC
+	Authoritative bool // the response has the AA bit set, i.e. it came from an authoritative server
+
+	// NSID is the name server identifier (RFC 5001) the server has sent, nil
+	// if there is none.  It identifies the instance that answered, e.g. the
+	// anycast node.  The server only sends it if the query has the empty
+	// NSID option, see Options.EDNSOptions.
+	NSID []byte
+
+	// Expire is the expire value of the zone in seconds the server has sent
+	// with the EDNS EXPIRE option (RFC 7314), nil if there is none.  The
+	// server only sends it in the response to a SOA query that has the
+	// option, see NewExpireOption.
+	Expire *uint32
+
+	// RTT is the time from writing the query to the wire to reading the
+	// response, so it doesn't include the bootstrap, the connection
+	// establishment and the wait for a pooled connection.  If the query was
+	// retried, it's the RTT of the last attempt.  For DNSCrypt it's the
+	// duration of the whole encrypted exchange.
+	RTT time.Duration
+
+	// RequestSize and ResponseSize are the sizes of the query and the
+	// response DNS messages on the wire in bytes, with the compression, the
+	// padding and the EDNS options, but without the TCP length prefix and the
+	// TLS, HTTP or QUIC framing.  If the query was retried, they're the ones
+	// of the last attempt.  For DNSCrypt they're the sizes before the
+	// encryption, and for the DoH JSON API they're the sizes of the query
+	// string and the JSON response.  They're 0 if unknown.
+	RequestSize  int
+	ResponseSize int
+
+	ServerAddr  string // IP:port of the server the response was received from, empty if it's unknown
+	Protocol    string // one of "udp", "tcp", "tls", "https", "quic" and "dnscrypt", empty if it's unknown
+	Reconnected bool   // the query was resent over a new connection since the previous one had failed
+}
+
+// InfoExchanger is implemented by the upstreams that measure the exchanges on
+// the wire
+type InfoExchanger interface {
+	// ExchangeWithInfo is like Upstream.Exchange, but it also returns the
+	// information about the response and the exchange
+	ExchangeWithInfo(m *dns.Msg) (*dns.Msg, *ExchangeInfo, error)
+}
+
+// ExchangeWithInfo sends the query to the upstream and returns the response
+// along with the information about it.  If u doesn't implement InfoExchanger,
+// the RTT is the duration of the whole Exchange call and the server address
+// and the protocol are unknown.
+func ExchangeWithInfo(u Upstream, m *dns.Msg) (*dns.Msg, *ExchangeInfo, error) {
+	if ie, ok := u.(InfoExchanger); ok {
+		return ie.ExchangeWithInfo(m)
+	}
+
+	start := time.Now()
+	reply, err := u.Exchange(m)
+	if err != nil || reply == nil {
+		return reply, nil, err
+	}
+
+	info := newExchangeInfo(reply)
+	info.RTT = time.Since(start)
+	return reply, info, nil
+}
+
+// newExchangeInfo returns the information from the response itself
+func newExchangeInfo(reply *dns.Msg) *ExchangeInfo {
+	return &ExchangeInfo{
+		Authenticated: reply.AuthenticatedData,
+		Authoritative: reply.Authoritative,
+		NSID:          optNSID(reply.IsEdns0()),
+		Expire:        optExpire(reply.IsEdns0()),
+	}
+}
+
+// exchangeTrace collects the details of a single exchange on the wire.  Its
+// methods do nothing if it's nil, so Exchange passes nil to the internals
+// shared with ExchangeWithInfo.
+type exchangeTrace struct {
+	protocol    string
+	addr        string
+	wrote       time.Time // when the query of the current attempt was written
+	rtt         time.Duration
+	reqSize     int // size of the query of the current attempt
+	resSize     int // size of the response to the current attempt
+	reconnected bool
+	opt         *dns.OPT // OPT record removed from the response, see removeAddedOPT
+
+	mu sync.Mutex // the DoH transport calls the hooks from its own goroutines
+}
+
+// exchangeWithTrace is the exchange function of an upstream that records the
+// details to tr if it's not nil
+type exchangeWithTrace func(m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error)
+
+// traceExchange runs exchange with a new trace and returns the information
+// about the response
+func traceExchange(m *dns.Msg, exchange exchangeWithTrace) (*dns.Msg, *ExchangeInfo, error) {
+	tr := &exchangeTrace{}
+	reply, err := exchange(m, tr)
+	if err != nil || reply == nil {
+		return reply, nil, err
+	}
+	return reply, tr.info(reply), nil
+}
+
+// wroteQuery records that the query of size bytes is being written to addr
+// over protocol, which starts a new attempt
+func (tr *exchangeTrace) wroteQuery(protocol string, addr net.Addr, size int) {
+	if tr == nil {
+		return
+	}
+
+	addrStr := ""
+	if addr != nil {
+		addrStr = addr.String()
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.protocol = protocol
+	tr.addr = addrStr
+	tr.wrote = time.Now()
+	tr.rtt = 0
+	tr.reqSize = size
+	tr.resSize = 0
+}
+
+// readResponse records that the response of size bytes to the current attempt
+// has been read at t, the zero t means now
+func (tr *exchangeTrace) readResponse(t time.Time, size int) {
+	if tr == nil {
+		return
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if !tr.wrote.IsZero() && t.After(tr.wrote) {
+		tr.rtt = t.Sub(tr.wrote)
+	}
+	tr.resSize = size
+}
+
+// measured records the attempt the RTT of which has been measured elsewhere,
+// e.g. the whole DNSCrypt exchange
+func (tr *exchangeTrace) measured(protocol, addr string, rtt time.Duration, reqSize, resSize int) {
+	if tr == nil {
+		return
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.protocol = protocol
+	tr.addr = addr
+	tr.wrote = time.Time{}
+	tr.rtt = rtt
+	tr.reqSize = reqSize
+	tr.resSize = resSize
+}
+
+// removedOPT records the OPT record removed from the response
+func (tr *exchangeTrace) removedOPT(opt *dns.OPT) {
+	if tr == nil || opt == nil {
+		return
+	}
+
+	tr.mu.Lock()
+	tr.opt = opt
+	tr.mu.Unlock()
+}
+
+// reconnect records that the query is resent over a new connection
+func (tr *exchangeTrace) reconnect() {
+	if tr == nil {
+		return
+	}
+
+	tr.mu.Lock()
+	tr.reconnected = true
+	tr.mu.Unlock()
+}
+
+// info returns the information about the response with the recorded details
+func (tr *exchangeTrace) info(reply *dns.Msg) *ExchangeInfo {
+	info := newExchangeInfo(reply)
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	info.Protocol = tr.protocol
+	info.ServerAddr = tr.addr
+	info.Reconnected = tr.reconnected
+	info.RTT = tr.rtt
+	info.RequestSize = tr.reqSize
+	info.ResponseSize = tr.resSize
+	if tr.opt != nil {
+		info.NSID = optNSID(tr.opt)
+		info.Expire = optExpire(tr.opt)
+	}
+	return info
+}
+
+// optNSID returns the NSID from the OPT record of the response, or nil if
+// there is none
+func optNSID(opt *dns.OPT) []byte {
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if nsid, ok := o.(*dns.EDNS0_NSID); ok {
+			b, err := hex.DecodeString(nsid.Nsid)
+			if err != nil {
+				return nil
+			}
+			return b
+		}
+	}
+	return nil
+}
+
+// optExpire returns the value of the EXPIRE option from the OPT record of the
+// response, or nil if there is none
+func optExpire(opt *dns.OPT) *uint32 {
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_EXPIRE); ok {
+			expire := e.Expire
+			return &expire
+		}
+	}
+	return nil
+}
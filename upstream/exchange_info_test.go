@@ -0,0 +1,338 @@
+package upstream
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExchangeWithInfo(t *testing.T) {
+	authenticated := true
+	u := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		res := new(dns.Msg).SetReply(m)
+		res.AuthenticatedData = authenticated
+		res.Authoritative = !authenticated
+		res.Answer = []dns.RR{newTestRR("%s 60 IN A 8.8.8.8", m.Question[0].Name)}
+		return res, nil
+	})
+
+	res, info, err := ExchangeWithInfo(u, createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.Len(t, res.Answer, 1)
+	assert.True(t, info.Authenticated)
+	assert.False(t, info.Authoritative)
+
+	authenticated = false
+	_, info, err = ExchangeWithInfo(u, createTestMessage())
+	assert.Nil(t, err)
+	assert.False(t, info.Authenticated)
+	assert.True(t, info.Authoritative)
+
+	// No info if the exchange fails
+	failing := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) { return nil, nil })
+	res, info, err = ExchangeWithInfo(failing, createTestMessage())
+	assert.NotNil(t, err)
+	assert.Nil(t, res)
+	assert.Nil(t, info)
+}
+
+func TestExchangeInfoNSID(t *testing.T) {
+	// Prepare a stub server that sends its NSID if it's requested
+	srv, err := dnsproxytest.NewPlainServer(func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg).SetReply(req)
+		if opt := req.IsEdns0(); opt != nil && len(opt.Option) > 0 {
+			resp.SetEdns0(dns.DefaultMsgSize, false)
+			nsid := &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "6e73312e616d73"}
+			resp.IsEdns0().Option = []dns.EDNS0{nsid}
+		}
+		return resp
+	})
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
+	u, err := AddressToUpstream(srv.Addr, Options{
+		Timeout:     timeout,
+		EDNSOptions: []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID}},
+	})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	_, info, err := ExchangeWithInfo(u, createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.Equal(t, []byte("ns1.ams"), info.NSID)
+
+	// No NSID if it's not requested
+	u, err = AddressToUpstream(srv.Addr, Options{Timeout: timeout})
+	assert.Nil(t, err)
+	_, info, err = ExchangeWithInfo(u, createTestMessage())
+	assert.Nil(t, err)
+	assert.Nil(t, info.NSID)
+}
+
+func TestExchangeInfoExpire(t *testing.T) {
+	// Prepare a stub server that sends the expire value for SOA queries that
+	// have the EXPIRE option
+	srv, err := dnsproxytest.NewPlainServer(func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg).SetReply(req)
+		opt := req.IsEdns0()
+		if opt == nil || req.Question[0].Qtype != dns.TypeSOA {
+			return resp
+		}
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0EXPIRE {
+				resp.SetEdns0(dns.DefaultMsgSize, false)
+				resp.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Expire: 604800}}
+			}
+		}
+		return resp
+	})
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
+	// The option is empty in the query
+	req, _ := withEDNSOptions(new(dns.Msg).SetQuestion("example.org.", dns.TypeSOA), []dns.EDNS0{NewExpireOption()})
+	buf, err := req.Pack()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, dns.EDNS0EXPIRE, 0, 0}, buf[len(buf)-4:])
+
+	u, err := AddressToUpstream(srv.Addr, Options{Timeout: timeout, EDNSOptions: []dns.EDNS0{NewExpireOption()}})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	_, info, err := ExchangeWithInfo(u, new(dns.Msg).SetQuestion("example.org.", dns.TypeSOA))
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	if assert.NotNil(t, info.Expire) {
+		assert.Equal(t, uint32(604800), *info.Expire)
+	}
+
+	// No expire value for other queries
+	_, info, err = ExchangeWithInfo(u, createTestMessage())
+	assert.Nil(t, err)
+	assert.Nil(t, info.Expire)
+}
+
+func TestExchangeInfoRTT(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	handler := func(req *dns.Msg) *dns.Msg {
+		time.Sleep(delay)
+		return new(dns.Msg).SetReply(req)
+	}
+
+	plain, err := dnsproxytest.NewPlainServer(handler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer plain.Close()
+	dot, err := dnsproxytest.NewTLSServer(handler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer dot.Close()
+	doh, err := dnsproxytest.NewHTTPSServer(handler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer doh.Close()
+
+	testCases := []struct {
+		address  string
+		protocol string
+		srv      *dnsproxytest.Server
+	}{
+		{plain.URL, "udp", plain},
+		{"tcp://" + plain.Addr, "tcp", plain},
+		{dot.URL, "tls", dot},
+		{doh.URL, "https", doh},
+	}
+	for _, tc := range testCases {
+		u, err := AddressToUpstream(tc.address, Options{Timeout: timeout, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("cannot create upstream %s: %s", tc.address, err)
+		}
+
+		_, info, err := ExchangeWithInfo(u, createTestMessage())
+		if err != nil {
+			t.Fatalf("cannot exchange with %s: %s", tc.address, err)
+		}
+		assert.Equal(t, tc.protocol, info.Protocol, tc.address)
+		assert.Equal(t, tc.srv.Addr, info.ServerAddr, tc.address)
+		assert.True(t, info.RTT >= delay && info.RTT < timeout, "%s: %s", tc.address, info.RTT)
+		assert.False(t, info.Reconnected, tc.address)
+		_ = u.(Closer).Close()
+	}
+
+	// The results of the parallel exchange have the info too
+	u, err := AddressToUpstream(plain.URL, Options{Timeout: timeout})
+	assert.Nil(t, err)
+	results, err := ExchangeAll([]Upstream{u, NullUpstream()}, createTestMessage())
+	assert.Nil(t, err)
+	if assert.Len(t, results, 2) {
+		for _, r := range results {
+			assert.NotNil(t, r.Info)
+		}
+	}
+}
+
+func TestExchangeInfoReconnected(t *testing.T) {
+	// The server closes every connection after the response, so the pooled
+	// one fails
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			req, _, err := readPrefixedMsg(conn)
+			if err == nil {
+				_, _ = writePrefixedMsg(conn, new(dns.Msg).SetReply(req))
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	u, err := AddressToUpstream("tcp://"+l.Addr().String(), Options{Timeout: timeout})
+	assert.Nil(t, err)
+	defer u.(Closer).Close()
+
+	_, info, err := ExchangeWithInfo(u, createTestMessage())
+	assert.Nil(t, err)
+	assert.False(t, info.Reconnected)
+
+	_, info, err = ExchangeWithInfo(u, createTestMessage())
+	assert.Nil(t, err)
+	assert.True(t, info.Reconnected)
+	assert.Equal(t, "tcp", info.Protocol)
+}
+
+func TestExchangeInfoSize(t *testing.T) {
+	// The servers record the sizes of the messages they have received and
+	// sent, the latter are packed as is
+	var reqSize, resSize int32
+	handler := func(req *dns.Msg) *dns.Msg {
+		res := new(dns.Msg).SetReply(req)
+		res.Answer = []dns.RR{
+			newTestRR("%s 60 IN CNAME target.example.org.", req.Question[0].Name),
+			newTestRR("target.example.org. 60 IN A 192.0.2.1"),
+		}
+		buf, _ := req.Pack()
+		atomic.StoreInt32(&reqSize, int32(len(buf)))
+		buf, _ = res.Pack()
+		atomic.StoreInt32(&resSize, int32(len(buf)))
+		return res
+	}
+
+	plain, err := dnsproxytest.NewPlainServer(handler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer plain.Close()
+	tls, err := dnsproxytest.NewTLSServer(handler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer tls.Close()
+	doh, err := dnsproxytest.NewHTTPSServer(handler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer doh.Close()
+
+	req := createTestMessage()
+	buf, err := req.Pack()
+	assert.Nil(t, err)
+
+	for _, address := range []string{plain.Addr, "tcp://" + plain.Addr, tls.URL, doh.URL} {
+		u, err := AddressToUpstream(address, Options{Timeout: timeout, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("cannot create upstream %s: %s", address, err)
+		}
+
+		_, info, err := ExchangeWithInfo(u, req)
+		if err != nil {
+			t.Fatalf("cannot exchange with %s: %s", address, err)
+		}
+		// DoT adds the keepalive option
+		if address != tls.URL {
+			assert.Equal(t, len(buf), info.RequestSize, address)
+		}
+		assert.Equal(t, int(atomic.LoadInt32(&reqSize)), info.RequestSize, address)
+		assert.Equal(t, int(atomic.LoadInt32(&resSize)), info.ResponseSize, address)
+		_ = u.(Closer).Close()
+	}
+
+	// The padding is counted
+	u, err := AddressToUpstream(tls.URL, Options{Timeout: timeout, InsecureSkipVerify: true, Padding: 128})
+	assert.Nil(t, err)
+	defer u.(Closer).Close()
+	_, info, err := ExchangeWithInfo(u, req)
+	assert.Nil(t, err)
+	assert.Equal(t, 128, info.RequestSize)
+	assert.Equal(t, int(atomic.LoadInt32(&reqSize)), info.RequestSize)
+}
+
+func TestExchangeInfoSizeTruncated(t *testing.T) {
+	// The response is sent over TCP without the compression, its size must
+	// be the one on the wire rather than the one of the repacked message
+	var resSize int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg).SetReply(r)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			resp.Truncated = true
+		} else {
+			resp.Answer = []dns.RR{
+				newTestRR("%s 60 IN A 192.0.2.1", r.Question[0].Name),
+				newTestRR("%s 60 IN A 192.0.2.2", r.Question[0].Name),
+			}
+			buf, _ := resp.Pack()
+			atomic.StoreInt32(&resSize, int32(len(buf)))
+		}
+		_ = w.WriteMsg(resp)
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	tcpSrv := &dns.Server{Listener: l, Handler: handler}
+	go func() { _ = tcpSrv.ActivateAndServe() }()
+	defer tcpSrv.Shutdown()
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	assert.Nil(t, err)
+	udpSrv := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = udpSrv.ActivateAndServe() }()
+	defer udpSrv.Shutdown()
+
+	u, err := AddressToUpstream(l.Addr().String(), Options{Timeout: timeout})
+	assert.Nil(t, err)
+	reply, info, err := ExchangeWithInfo(u, createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.Len(t, reply.Answer, 2)
+	assert.Equal(t, "tcp", info.Protocol)
+	assert.Equal(t, int(atomic.LoadInt32(&resSize)), info.ResponseSize)
+
+	compressed := reply.Copy()
+	compressed.Compress = true
+	buf, err := compressed.Pack()
+	assert.Nil(t, err)
+	assert.True(t, len(buf) < info.ResponseSize)
+}
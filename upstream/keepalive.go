@@ -0,0 +1,59 @@
+package upstream
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// keepaliveUnit is the unit of the edns-tcp-keepalive timeout (RFC 7828)
+const keepaliveUnit = 100 * time.Millisecond
+
+// addKeepalive returns a copy of the request with the edns-tcp-keepalive option
+// without the timeout, as the clients must send it.  It returns true if the
+// OPT record was added to the request.
+func addKeepalive(m *dns.Msg) (*dns.Msg, bool) {
+	req := m.Copy()
+	added := false
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+		added = true
+	}
+
+	// dns.EDNS0_TCP_KEEPALIVE can't be packed and unpacked properly by the
+	// miekg/dns version we use, so the option is handled as a local one
+	opt.Option = proxyutil.RemoveOption(opt.Option, dns.EDNS0TCPKEEPALIVE)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE})
+	return req, added
+}
+
+// takeKeepalive removes the edns-tcp-keepalive option from the response and
+// returns the idle timeout the server has sent in it.  If the OPT record was
+// added by addKeepalive, it's removed.  It returns false if the response has
+// no timeout.
+func takeKeepalive(reply *dns.Msg, removeOPT bool) (time.Duration, bool) {
+	opt := reply.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+
+	var timeout time.Duration
+	ok := false
+	for _, o := range opt.Option {
+		if l, isLocal := o.(*dns.EDNS0_LOCAL); isLocal && l.Code == dns.EDNS0TCPKEEPALIVE && len(l.Data) == 2 {
+			timeout = time.Duration(binary.BigEndian.Uint16(l.Data)) * keepaliveUnit
+			ok = true
+		}
+	}
+
+	if removeOPT {
+		proxyutil.RemoveOPT(reply)
+	} else {
+		opt.Option = proxyutil.RemoveOption(opt.Option, dns.EDNS0TCPKEEPALIVE)
+	}
+	return timeout, ok
+}
@@ -0,0 +1,72 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// validateLocalAddr checks that Options.LocalAddr is assigned to one of the
+// interfaces and that the Options.BindToDevice interface exists, so that the
+// misconfiguration is found when the upstream is created
+func validateLocalAddr(options Options) error {
+	if options.BindToDevice != "" {
+		if !bindToDeviceSupported {
+			return errors.New("binding to a network interface is only supported on Linux")
+		}
+
+		_, err := net.InterfaceByName(options.BindToDevice)
+		if err != nil {
+			return fmt.Errorf("network interface %s not found: %w", options.BindToDevice, err)
+		}
+	}
+
+	ip := options.LocalAddr
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("couldn't get the interface addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("local address %s is not assigned to any network interface", ip)
+}
+
+// newDialer creates a *net.Dialer that connects from Options.LocalAddr over
+// Options.BindToDevice, if they're set.  network is the network of the
+// connections it's used for since the local address type depends on it.
+func newDialer(options Options, network string) *net.Dialer {
+	d := &net.Dialer{Timeout: options.Timeout}
+	if options.LocalAddr != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: options.LocalAddr}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: options.LocalAddr}
+		}
+	}
+	if options.BindToDevice != "" {
+		d.Control = bindToDevice(options.BindToDevice)
+	}
+	return d
+}
+
+// bindsLocally returns true if the connections must be created by newDialer,
+// Options.DialContext takes precedence
+func bindsLocally(options Options) bool {
+	return options.DialContext == nil && (options.LocalAddr != nil || options.BindToDevice != "")
+}
+
+// newLocalDialHandler returns the dialHandler that dials with newDialer
+func newLocalDialHandler(options Options) dialHandler {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return newDialer(options, network).DialContext(ctx, network, addr)
+	}
+}
@@ -0,0 +1,90 @@
+package upstream
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// nonLoopbackIPv4 returns an IPv4 address of the host other than the loopback
+// one, or nil if there is none
+func nonLoopbackIPv4(t *testing.T) net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatalf("cannot get the interface addresses: %s", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
+
+func TestLocalAddr(t *testing.T) {
+	localIP := nonLoopbackIPv4(t)
+	if localIP == nil {
+		t.Skip("no non-loopback IPv4 address")
+	}
+
+	// Remember the source addresses of the queries
+	var sources []string
+	var mu sync.Mutex
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		mu.Lock()
+		sources = append(sources, host)
+		mu.Unlock()
+
+		resp := new(dns.Msg).SetReply(r)
+		resp.Answer = []dns.RR{newTestRR("%s 60 IN A 192.0.2.1", r.Question[0].Name)}
+		_ = w.WriteMsg(resp)
+	})
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	tcpSrv := &dns.Server{Listener: tcpListener, Handler: handler}
+	go func() { _ = tcpSrv.ActivateAndServe() }()
+	defer tcpSrv.Shutdown()
+
+	udpConn, err := net.ListenPacket("udp", tcpListener.Addr().String())
+	assert.Nil(t, err)
+	udpSrv := &dns.Server{PacketConn: udpConn, Handler: handler}
+	go func() { _ = udpSrv.ActivateAndServe() }()
+	defer udpSrv.Shutdown()
+
+	addr := tcpListener.Addr().String()
+	for _, a := range []string{addr, "tcp://" + addr} {
+		u, err := AddressToUpstream(a, Options{Timeout: timeout, LocalAddr: localIP})
+		if err != nil {
+			t.Fatalf("cannot create upstream: %s", err)
+		}
+
+		req := createTestMessage()
+		reply, err := u.Exchange(req)
+		if err != nil {
+			t.Fatalf("%s: cannot exchange: %s", a, err)
+		}
+		assert.Equal(t, req.Id, reply.Id)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{localIP.String(), localIP.String()}, sources)
+}
+
+func TestLocalAddrInvalid(t *testing.T) {
+	// The address isn't assigned to any interface
+	_, err := AddressToUpstream("tls://1.1.1.1", Options{LocalAddr: net.ParseIP("192.0.2.1")})
+	assert.NotNil(t, err)
+
+	_, err = AddressToUpstream("8.8.8.8", Options{BindToDevice: "nonexistent0"})
+	assert.NotNil(t, err)
+
+	// The unspecified address is fine
+	_, err = AddressToUpstream("8.8.8.8", Options{LocalAddr: net.IPv4zero})
+	assert.Nil(t, err)
+}
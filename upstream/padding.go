@@ -0,0 +1,52 @@
+package upstream
+
+import (
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// padMsg returns a copy of the request with the EDNS padding option (RFC 7830)
+// that makes the size of the packed request a multiple of blockSize.  It
+// returns the request itself if blockSize is not positive.  It returns true
+// if the OPT record was added to the request.
+func padMsg(m *dns.Msg, blockSize int) (*dns.Msg, bool) {
+	if blockSize <= 0 {
+		return m, false
+	}
+
+	req := m.Copy()
+	added := proxyutil.PadMsg(req, blockSize)
+	return req, added
+}
+
+// unpadMsg removes the EDNS padding option from the response.  If the OPT
+// record was added by padMsg, it's removed.
+func unpadMsg(reply *dns.Msg, removeOPT bool) {
+	opt := reply.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	if removeOPT {
+		proxyutil.RemoveOPT(reply)
+	} else {
+		opt.Option = proxyutil.RemoveOption(opt.Option, dns.EDNS0PADDING)
+	}
+}
+
+// exchangePadded pads the request to blockSize, sends it with exchange and
+// removes the padding from the response
+func exchangePadded(m *dns.Msg, blockSize int, exchange func(m *dns.Msg) (*dns.Msg, error)) (*dns.Msg, error) {
+	if blockSize <= 0 {
+		return exchange(m)
+	}
+
+	req, addedOPT := padMsg(m, blockSize)
+	reply, err := exchange(req)
+	if err != nil {
+		return nil, err
+	}
+
+	unpadMsg(reply, addedOPT)
+	return reply, nil
+}
@@ -0,0 +1,110 @@
+package upstream
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPadMsg(t *testing.T) {
+	for _, blockSize := range []int{1, 128, 468} {
+		req := createHostTestMessage("padding.example.org")
+		req.SetEdns0(dns.DefaultMsgSize, true)
+
+		padded, addedOPT := padMsg(req, blockSize)
+		assert.False(t, addedOPT)
+		buf, err := padded.Pack()
+		if err != nil {
+			t.Fatalf("cannot pack: %s", err)
+		}
+		assert.Zero(t, len(buf)%blockSize, "block size %d", blockSize)
+		assert.True(t, padded.IsEdns0().Do())
+
+		// The original request isn't changed
+		assert.Empty(t, req.IsEdns0().Option)
+	}
+
+	req := createTestMessage()
+	padded, addedOPT := padMsg(req, 0)
+	assert.False(t, addedOPT)
+	assert.True(t, padded == req)
+}
+
+func TestDoTPadding(t *testing.T) {
+	var size, padded int32
+	srv := startTestDoTServer(t, func(req *dns.Msg) *dns.Msg {
+		buf, _ := req.Pack()
+		atomic.StoreInt32(&size, int32(len(buf)))
+
+		resp := new(dns.Msg).SetReply(req)
+		opt := req.IsEdns0()
+		if opt == nil {
+			return resp
+		}
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0PADDING {
+				atomic.AddInt32(&padded, 1)
+			}
+		}
+
+		// Pad the response as well
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		respOpt := resp.IsEdns0()
+		respOpt.Option = append(respOpt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 100)})
+		return resp
+	})
+	defer srv.Close()
+
+	testCases := []struct {
+		name string
+		opts Options
+	}{
+		{"pool", Options{Padding: 128}},
+		{"no_pool", Options{Padding: 128, DisablePool: true}},
+		{"pipelining", Options{Padding: 128, Pipelining: true}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&padded, 0)
+
+			opts := tc.opts
+			opts.Timeout = timeout
+			opts.InsecureSkipVerify = true
+			u, err := AddressToUpstream(srv.URL, opts)
+			if err != nil {
+				t.Fatalf("cannot create upstream: %s", err)
+			}
+			defer func() { _ = u.(Closer).Close() }()
+
+			req := createTestMessage()
+			reply, err := u.Exchange(req)
+			if err != nil {
+				t.Fatalf("DNS message failed: %s", err)
+			}
+			assert.Equal(t, req.Id, reply.Id)
+
+			assert.Equal(t, int32(1), atomic.LoadInt32(&padded))
+			assert.Equal(t, int32(128), atomic.LoadInt32(&size))
+
+			// The request had no OPT record, so the response mustn't have it
+			assert.Nil(t, reply.IsEdns0())
+			assert.Nil(t, req.IsEdns0())
+		})
+	}
+
+	// The padding is disabled by default
+	atomic.StoreInt32(&padded, 0)
+	u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	defer func() { _ = u.(Closer).Close() }()
+
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&padded))
+	assert.True(t, atomic.LoadInt32(&size) < 128)
+}
@@ -14,24 +14,33 @@ import (
 
 // exchangeResult is a structure that represents result of exchangeAsync
 type exchangeResult struct {
-	reply    *dns.Msg // Result of DNS request execution
-	upstream Upstream // Upstream that successfully resolved request
-	err      error    // Error
+	reply    *dns.Msg      // Result of DNS request execution
+	info     *ExchangeInfo // Information about the exchange, nil if it failed
+	upstream Upstream      // Upstream that successfully resolved request
+	err      error         // Error
 }
 
 // ExchangeParallel function is called to parallel exchange dns request by many upstreams
 // First answer without error will be returned
 // We will return nil and error if count of errors equals count of upstreams
 func ExchangeParallel(u []Upstream, req *dns.Msg) (*dns.Msg, Upstream, error) {
+	reply, resolved, _, err := ExchangeParallelWithInfo(u, req)
+	return reply, resolved, err
+}
+
+// ExchangeParallelWithInfo is like ExchangeParallel, but it also returns the
+// information about the exchange with the upstream that has responded first,
+// see ExchangeWithInfo
+func ExchangeParallelWithInfo(u []Upstream, req *dns.Msg) (*dns.Msg, Upstream, *ExchangeInfo, error) {
 	size := len(u)
 
 	if size == 0 {
-		return nil, nil, errors.New("no upstream specified")
+		return nil, nil, nil, errors.New("no upstream specified")
 	}
 
 	if size == 1 {
-		reply, err := exchange(u[0], req)
-		return reply, u[0], err
+		reply, info, err := exchange(u[0], req)
+		return reply, u[0], info, err
 	}
 
 	// Size of channel must accommodate results of exchangeAsync from all upstreams
@@ -49,21 +58,22 @@ func ExchangeParallel(u []Upstream, req *dns.Msg) (*dns.Msg, Upstream, error) {
 			if rep.err != nil {
 				errs = append(errs, rep.err)
 			} else if rep.reply != nil {
-				return rep.reply, rep.upstream, nil
+				return rep.reply, rep.upstream, rep.info, nil
 			}
 		}
 	}
 
 	if len(errs) == 0 {
-		return nil, nil, fmt.Errorf("none of upstream servers responded")
+		return nil, nil, nil, fmt.Errorf("none of upstream servers responded")
 	}
-	return nil, nil, errorx.DecorateMany("all upstreams failed to respond", errs...)
+	return nil, nil, nil, errorx.DecorateMany("all upstreams failed to respond", errs...)
 }
 
 // ExchangeAllResult - result of ExchangeAll()
 type ExchangeAllResult struct {
-	Resp     *dns.Msg // response
-	Upstream Upstream // upstream server
+	Resp     *dns.Msg      // response
+	Info     *ExchangeInfo // information about the exchange, see ExchangeWithInfo
+	Upstream Upstream      // upstream server
 }
 
 // ExchangeAll - receive responses from all upstream servers and return the results
@@ -73,9 +83,10 @@ func ExchangeAll(upstreams []Upstream, req *dns.Msg) ([]ExchangeAllResult, error
 	if len(upstreams) == 0 {
 		return replies, errors.New("no upstream specified")
 	} else if len(upstreams) == 1 {
-		reply, err := exchange(upstreams[0], req)
+		reply, info, err := exchange(upstreams[0], req)
 		res := ExchangeAllResult{
 			Resp:     reply,
+			Info:     info,
 			Upstream: upstreams[0],
 		}
 		replies = append(replies, res)
@@ -99,6 +110,7 @@ func ExchangeAll(upstreams []Upstream, req *dns.Msg) ([]ExchangeAllResult, error
 			} else if rep.reply != nil {
 				res := ExchangeAllResult{
 					Resp:     rep.reply,
+					Info:     rep.info,
 					Upstream: rep.upstream,
 				}
 				replies = append(replies, res)
@@ -113,26 +125,71 @@ func ExchangeAll(upstreams []Upstream, req *dns.Msg) ([]ExchangeAllResult, error
 	return replies, nil
 }
 
+// ExchangeBothError is returned by ExchangeBoth if any of the exchanges has
+// failed, the errors are nil for the ones that have succeeded
+type ExchangeBothError struct {
+	A    error // error of the A query
+	AAAA error // error of the AAAA query
+}
+
+// Error implements the error interface for *ExchangeBothError
+func (e *ExchangeBothError) Error() string {
+	switch {
+	case e.A == nil:
+		return fmt.Sprintf("AAAA query failed: %s", e.AAAA)
+	case e.AAAA == nil:
+		return fmt.Sprintf("A query failed: %s", e.A)
+	default:
+		return fmt.Sprintf("A query failed: %s; AAAA query failed: %s", e.A, e.AAAA)
+	}
+}
+
+// ExchangeBoth sends the A and AAAA queries for the name to the upstream
+// concurrently and returns both responses.  The upstreams that keep their
+// connections, e.g. DoT, DoH and DoQ ones, use the same pooled connection for
+// both if there is one.  If any of the exchanges fails, the error is
+// *ExchangeBothError and the response of the other one is still returned.
+func ExchangeBoth(u Upstream, name string) (a, aaaa *dns.Msg, err error) {
+	reqA := &dns.Msg{}
+	reqA.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	reqAAAA := &dns.Msg{}
+	reqAAAA.SetQuestion(dns.Fqdn(name), dns.TypeAAAA)
+
+	ch := make(chan *exchangeResult, 1)
+	go exchangeAsync(u, reqAAAA, ch)
+
+	var errA error
+	a, _, errA = exchange(u, reqA)
+	rep := <-ch
+	aaaa = rep.reply
+
+	if errA != nil || rep.err != nil {
+		return a, aaaa, &ExchangeBothError{A: errA, AAAA: rep.err}
+	}
+	return a, aaaa, nil
+}
+
 // exchangeAsync tries to resolve DNS request with one upstream and send result to resp channel
 func exchangeAsync(u Upstream, req *dns.Msg, resp chan *exchangeResult) {
-	reply, err := u.Exchange(req)
+	reply, info, err := ExchangeWithInfo(u, req)
 	resp <- &exchangeResult{
 		reply:    reply,
+		info:     info,
 		upstream: u,
 		err:      err,
 	}
 }
 
-func exchange(u Upstream, req *dns.Msg) (*dns.Msg, error) {
+func exchange(u Upstream, req *dns.Msg) (*dns.Msg, *ExchangeInfo, error) {
 	start := time.Now()
-	reply, err := u.Exchange(req)
+	reply, info, err := ExchangeWithInfo(u, req)
 	elapsed := time.Since(start) / time.Millisecond
 	if err == nil {
 		log.Tracef("upstream %s successfully finished exchange of %s. Elapsed %d ms.", u.Address(), req.Question[0].String(), elapsed)
 	} else {
 		log.Tracef("upstream %s failed to exchange %s in %d milliseconds. Cause: %s", u.Address(), req.Question[0].String(), elapsed, err)
 	}
-	return reply, err
+	return reply, info, err
 }
 
 // lookupResult is a structure that represents result of lookup
@@ -176,6 +233,8 @@ func LookupParallel(ctx context.Context, resolvers []*Resolver, host string) ([]
 			}
 
 			return result.address, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 
 		if n == size {
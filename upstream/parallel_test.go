@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -17,8 +19,16 @@ const (
 
 // TestExchangeParallel launches several parallel exchanges
 func TestExchangeParallel(t *testing.T) {
+	silent := newSilentServer(t)
+	defer silent.Close()
+	srv, err := dnsproxytest.NewPlainServer(testHandler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
 	upstreams := []Upstream{}
-	upstreamList := []string{"1.2.3.4:55", "8.8.8.1", "8.8.8.8:53"}
+	upstreamList := []string{silent.LocalAddr().String(), srv.URL}
 
 	for _, s := range upstreamList {
 		u, err := AddressToUpstream(s, Options{Timeout: timeout})
@@ -35,7 +45,7 @@ func TestExchangeParallel(t *testing.T) {
 		t.Fatalf("no response from test upstreams: %s", err)
 	}
 
-	if u.Address() != "8.8.8.8:53" {
+	if u.Address() != srv.URL {
 		t.Fatalf("shouldn't happen. This upstream can't resolve DNS request: %s", u.Address())
 	}
 
@@ -44,11 +54,31 @@ func TestExchangeParallel(t *testing.T) {
 	if elapsed > timeout {
 		t.Fatalf("exchange took more time than the configured timeout: %v", elapsed)
 	}
+
+	// The information is about the exchange with the upstream that responded
+	resp, u, info, err := ExchangeParallelWithInfo(upstreams, req)
+	if err != nil {
+		t.Fatalf("no response from test upstreams: %s", err)
+	}
+	assertResponse(t, resp)
+	assert.Equal(t, srv.URL, u.Address())
+	if assert.NotNil(t, info) {
+		assert.Equal(t, "udp", info.Protocol)
+		assert.Equal(t, srv.Addr, info.ServerAddr)
+	}
 }
 
 func TestLookupParallel(t *testing.T) {
+	silent := newSilentServer(t)
+	defer silent.Close()
+	srv, err := dnsproxytest.NewPlainServer(testHandler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
 	resolvers := []*Resolver{}
-	bootstraps := []string{"1.2.3.4:55", "8.8.8.1:555", "8.8.8.8:53"}
+	bootstraps := []string{silent.LocalAddr().String(), srv.Addr}
 
 	for _, boot := range bootstraps {
 		resolver, _ := NewResolver(boot, Options{Timeout: timeout})
@@ -158,3 +188,78 @@ func TestExchangeAll(t *testing.T) {
 	a = res[1].Resp.Answer[0].(*dns.A)
 	assert.True(t, a.A.To4().Equal(net.ParseIP("1.1.1.1").To4()))
 }
+
+func TestExchangeBoth(t *testing.T) {
+	// Both queries are sent before any of them is answered
+	var wg sync.WaitGroup
+	wg.Add(2)
+	u := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		wg.Done()
+		wg.Wait()
+
+		resp := new(dns.Msg).SetReply(m)
+		q := m.Question[0]
+		switch q.Qtype {
+		case dns.TypeA:
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, 1),
+			}}
+		case dns.TypeAAAA:
+			if q.Name == "v4only.example.org." {
+				return nil, fmt.Errorf("no IPv6")
+			}
+			resp.Answer = []dns.RR{&dns.AAAA{
+				Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+				AAAA: net.ParseIP("2001:db8::1"),
+			}}
+		}
+		return resp, nil
+	})
+
+	a, aaaa, err := ExchangeBoth(u, "example.org")
+	assert.Nil(t, err)
+	if assert.NotNil(t, a) && assert.NotNil(t, aaaa) {
+		assert.Equal(t, dns.TypeA, a.Question[0].Qtype)
+		assert.Equal(t, "example.org.", a.Question[0].Name)
+		assert.IsType(t, &dns.A{}, a.Answer[0])
+		assert.IsType(t, &dns.AAAA{}, aaaa.Answer[0])
+	}
+
+	// The error is reported for the failed query only
+	wg.Add(2)
+	a, aaaa, err = ExchangeBoth(u, "v4only.example.org")
+	assert.NotNil(t, a)
+	assert.Nil(t, aaaa)
+	bothErr, ok := err.(*ExchangeBothError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Nil(t, bothErr.A)
+		assert.NotNil(t, bothErr.AAAA)
+		assert.Contains(t, bothErr.Error(), "AAAA query failed")
+	}
+}
+
+func TestExchangeBothPooled(t *testing.T) {
+	srv, err := dnsproxytest.NewHTTPSServer(nil)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
+	u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	defer u.(Closer).Close()
+
+	// The connection is established first so that both queries use it
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	a, aaaa, err := ExchangeBoth(u, "example.org")
+	assert.Nil(t, err)
+	if assert.NotNil(t, a) && assert.NotNil(t, aaaa) {
+		assert.Equal(t, dns.TypeA, a.Question[0].Qtype)
+		assert.Equal(t, dns.TypeAAAA, aaaa.Question[0].Qtype)
+	}
+	assert.Equal(t, 1, srv.Accepted())
+}
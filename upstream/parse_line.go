@@ -0,0 +1,107 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseUpstreamLine parses the line of an upstreams list that has the upstream
+// address optionally followed by the space-separated key=value options, e.g.
+// "tls://1.1.1.1 bootstrap=8.8.8.8 timeout=5s".  It returns the options and
+// the address to pass to AddressToUpstream.  The supported options are:
+// * bootstrap -- Options.Bootstrap, comma-separated, can be repeated
+// * server-ip -- Options.ServerIPAddrs, comma-separated, can be repeated
+// * timeout -- Options.Timeout, e.g. 500ms or 5s
+// * insecure -- Options.InsecureSkipVerify, true or false
+func ParseUpstreamLine(line string) (*Options, string, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, "", errors.New("empty upstream line")
+	}
+
+	address := fields[0]
+	if strings.Contains(address, "=") && !strings.Contains(address, "://") {
+		return nil, "", fmt.Errorf("no upstream address in line %q", line)
+	}
+
+	opts := &Options{}
+	for _, f := range fields[1:] {
+		err := parseUpstreamOption(opts, f)
+		if err != nil {
+			return nil, "", fmt.Errorf("upstream %s: %w", address, err)
+		}
+	}
+
+	return opts, address, nil
+}
+
+// AddressToUpstreamLine creates the upstream from the line of an upstreams
+// list, see ParseUpstreamLine.  The options from the line override the ones of
+// opts: bootstrap, server-ip and timeout replace them and insecure=true turns
+// the certificate verification off.
+func AddressToUpstreamLine(line string, opts Options) (Upstream, error) {
+	lineOpts, address, err := ParseUpstreamLine(line)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lineOpts.Bootstrap) > 0 {
+		opts.Bootstrap = lineOpts.Bootstrap
+	}
+	if len(lineOpts.ServerIPAddrs) > 0 {
+		opts.ServerIPAddrs = lineOpts.ServerIPAddrs
+	}
+	if lineOpts.Timeout > 0 {
+		opts.Timeout = lineOpts.Timeout
+	}
+	if lineOpts.InsecureSkipVerify {
+		opts.InsecureSkipVerify = true
+	}
+
+	return AddressToUpstream(address, opts)
+}
+
+// parseUpstreamOption sets the option from the key=value pair
+func parseUpstreamOption(opts *Options, option string) error {
+	i := strings.IndexByte(option, '=')
+	if i <= 0 || i == len(option)-1 {
+		return fmt.Errorf("option %q is not in the key=value form", option)
+	}
+	key, value := option[:i], option[i+1:]
+
+	switch key {
+	case "bootstrap":
+		opts.Bootstrap = append(opts.Bootstrap, strings.Split(value, ",")...)
+	case "server-ip":
+		for _, s := range strings.Split(value, ",") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("invalid server-ip %q", s)
+			}
+			opts.ServerIPAddrs = append(opts.ServerIPAddrs, ip)
+		}
+	case "timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid timeout %q: %w", value, err)
+		}
+		if timeout < 0 {
+			return fmt.Errorf("negative timeout %q", value)
+		}
+		opts.Timeout = timeout
+	case "insecure":
+		insecure, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid insecure %q: %w", value, err)
+		}
+		opts.InsecureSkipVerify = insecure
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+
+	return nil
+}
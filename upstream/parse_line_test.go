@@ -0,0 +1,102 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUpstreamLine(t *testing.T) {
+	testCases := []struct {
+		line    string
+		address string
+		opts    *Options
+	}{{
+		line:    "8.8.8.8:53",
+		address: "8.8.8.8:53",
+		opts:    &Options{},
+	}, {
+		line:    "  tls://1.1.1.1 \t",
+		address: "tls://1.1.1.1",
+		opts:    &Options{},
+	}, {
+		line:    "tls://1.1.1.1 bootstrap=8.8.8.8 timeout=5s",
+		address: "tls://1.1.1.1",
+		opts:    &Options{Bootstrap: []string{"8.8.8.8"}, Timeout: 5 * time.Second},
+	}, {
+		line:    "https://dns.example/dns-query?x=1 bootstrap=8.8.8.8,1.1.1.1 bootstrap=tls://9.9.9.9 insecure=true",
+		address: "https://dns.example/dns-query?x=1",
+		opts: &Options{
+			Bootstrap:          []string{"8.8.8.8", "1.1.1.1", "tls://9.9.9.9"},
+			InsecureSkipVerify: true,
+		},
+	}, {
+		line:    "tls://dns.example server-ip=192.0.2.1,2001:db8::1 timeout=500ms",
+		address: "tls://dns.example",
+		opts: &Options{
+			ServerIPAddrs: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+			Timeout:       500 * time.Millisecond,
+		},
+	}}
+
+	for _, tc := range testCases {
+		opts, address, err := ParseUpstreamLine(tc.line)
+		if err != nil {
+			t.Fatalf("%q: %s", tc.line, err)
+		}
+		assert.Equal(t, tc.address, address, tc.line)
+		assert.Equal(t, tc.opts, opts, tc.line)
+	}
+}
+
+func TestParseUpstreamLineMalformed(t *testing.T) {
+	lines := []string{
+		"",
+		"   ",
+		"timeout=5s",
+		"tls://1.1.1.1 timeout",
+		"tls://1.1.1.1 timeout=",
+		"tls://1.1.1.1 =5s",
+		"tls://1.1.1.1 timeout=5",
+		"tls://1.1.1.1 timeout=-1s",
+		"tls://1.1.1.1 insecure=maybe",
+		"tls://1.1.1.1 server-ip=dns.example",
+		"tls://1.1.1.1 retries=3",
+	}
+
+	for _, line := range lines {
+		_, _, err := ParseUpstreamLine(line)
+		assert.NotNil(t, err, line)
+	}
+}
+
+func TestAddressToUpstreamLine(t *testing.T) {
+	opts := Options{Timeout: time.Second, Bootstrap: []string{"8.8.8.8"}}
+
+	// The options from the line override the given ones
+	u, err := AddressToUpstreamLine("tls://dns.example server-ip=192.0.2.1 timeout=5s insecure=true", opts)
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	o := u.(*dnsOverTLS).boot.options
+	assert.Equal(t, "tls://dns.example:853", u.Address())
+	assert.Equal(t, 5*time.Second, o.Timeout)
+	assert.True(t, o.InsecureSkipVerify)
+	assert.Equal(t, []net.IP{net.ParseIP("192.0.2.1")}, o.ServerIPAddrs)
+	assert.Equal(t, []string{"8.8.8.8"}, o.Bootstrap)
+
+	// And the given ones are kept otherwise
+	u, err = AddressToUpstreamLine("tls://dns.example bootstrap=1.1.1.1", opts)
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	o = u.(*dnsOverTLS).boot.options
+	assert.Equal(t, time.Second, o.Timeout)
+	assert.False(t, o.InsecureSkipVerify)
+	assert.Equal(t, []string{"1.1.1.1"}, o.Bootstrap)
+
+	_, err = AddressToUpstreamLine("tls://dns.example timeout=5", opts)
+	assert.NotNil(t, err)
+}
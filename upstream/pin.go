@@ -0,0 +1,105 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// pinParam is the URL query parameter with the SPKI pin of the server, e.g.
+// tls://1.1.1.1?pin=sha256/<base64>.  It may be repeated to pin several keys.
+const pinParam = "pin"
+
+// pinPrefix is the prefix of the only supported pin format, the SHA-256 hash of
+// the DER-encoded SubjectPublicKeyInfo like in HPKP (RFC 7469)
+const pinPrefix = "sha256/"
+
+// errPinMismatch fails the handshake with the server whose certificate chain
+// has none of the public keys pinned in the upstream URL
+var errPinMismatch = errors.New("server certificate doesn't match any of the SPKI pins")
+
+// parsePins removes the pin parameters from the URL query and returns the
+// pinned hashes
+func parsePins(u *url.URL) ([][]byte, error) {
+	query := u.Query()
+	values, ok := query[pinParam]
+	if !ok {
+		return nil, nil
+	}
+
+	switch u.Scheme {
+	case "tls", "https", "https+json", "quic":
+	default:
+		return nil, fmt.Errorf("SPKI pins are not supported for %s:// upstreams", u.Scheme)
+	}
+
+	var pins [][]byte
+	for _, v := range values {
+		pin, err := parsePin(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SPKI pin %q: %w", v, err)
+		}
+		pins = append(pins, pin)
+	}
+
+	query.Del(pinParam)
+	u.RawQuery = query.Encode()
+	return pins, nil
+}
+
+// parsePin parses the pin in the "sha256/<base64>" format
+func parsePin(pin string) ([]byte, error) {
+	if !strings.HasPrefix(pin, pinPrefix) {
+		return nil, fmt.Errorf("pin must start with %s", pinPrefix)
+	}
+
+	// The pluses of the base64 encoding are decoded from the query as spaces
+	// unless they are escaped
+	b64 := strings.Replace(pin[len(pinPrefix):], " ", "+", -1)
+	hash, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("SHA-256 hash must be %d bytes long, got %d", sha256.Size, len(hash))
+	}
+	return hash, nil
+}
+
+// verifyPins returns the function for tls.Config.VerifyPeerCertificate that
+// requires one of the certificates in the chain to have a pinned public key
+// and then calls next if it isn't nil
+func verifyPins(pins [][]byte, next func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if !matchPins(pins, rawCerts) {
+			return errPinMismatch
+		}
+		if next != nil {
+			return next(rawCerts, verifiedChains)
+		}
+		return nil
+	}
+}
+
+// matchPins checks if any of the certificates has a pinned public key
+func matchPins(pins [][]byte, rawCerts [][]byte) bool {
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			continue
+		}
+
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(pin, hash[:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
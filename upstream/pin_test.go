@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSPKIPins(t *testing.T) {
+	srv, err := dnsproxytest.NewTLSServer(nil)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+	doh, err := dnsproxytest.NewHTTPSServer(nil)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer doh.Close()
+
+	hash := sha256.Sum256(srv.Certificate.RawSubjectPublicKeyInfo)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+	otherPin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	exchange := func(address string) error {
+		u, err := AddressToUpstream(address, Options{Timeout: timeout, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("cannot create upstream %s: %s", address, err)
+		}
+		defer u.(Closer).Close()
+
+		_, err = u.Exchange(createTestMessage())
+		return err
+	}
+
+	// The handshake succeeds if any of the pins matches
+	assert.Nil(t, exchange(srv.URL+"?pin="+url.QueryEscape(pin)))
+	assert.Nil(t, exchange(srv.URL+"?pin="+otherPin+"&pin="+pin))
+	err = exchange(srv.URL + "?pin=" + otherPin)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), errPinMismatch.Error())
+	}
+
+	// The pin isn't sent to the DoH server
+	hash = sha256.Sum256(doh.Certificate.RawSubjectPublicKeyInfo)
+	dohPin := "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+	u, err := AddressToUpstream(doh.URL+"?pin="+dohPin, Options{Timeout: timeout, InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	assert.Equal(t, doh.URL, u.Address())
+	assert.Nil(t, exchange(doh.URL+"?pin="+dohPin))
+	assert.NotNil(t, exchange(doh.URL+"?pin="+otherPin))
+
+	// The clones keep the pins
+	u, err = AddressToUpstream(srv.URL+"?pin="+otherPin, Options{Timeout: timeout, InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	clone, err := u.(Cloner).WithOptions(&Options{Timeout: timeout, InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	_, err = clone.Exchange(createTestMessage())
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), errPinMismatch.Error())
+	}
+
+	// The fallbacks of the pinned upstream must be pinned as well
+	opts := Options{Timeout: timeout, InsecureSkipVerify: true, DoHFallbackURLs: []string{doh.URL}}
+	_, err = AddressToUpstream(doh.URL+"?pin="+dohPin, opts)
+	assert.NotNil(t, err)
+	opts.DoHFallbackURLs = []string{doh.URL + "?pin=" + dohPin}
+	u, err = AddressToUpstream(doh.URL+"?pin="+dohPin, opts)
+	if assert.Nil(t, err) {
+		assert.Len(t, u.(*dnsOverHTTPS).fallbacks, 1)
+	}
+
+	// The malformed pins are rejected right away
+	for _, address := range []string{
+		"tls://127.0.0.1?pin=sha256/not-base64!",
+		"tls://127.0.0.1?pin=sha256/AAAA",
+		"tls://127.0.0.1?pin=sha1/" + base64.StdEncoding.EncodeToString(hash[:]),
+		"tcp://127.0.0.1?pin=" + pin,
+	} {
+		_, err = AddressToUpstream(address, Options{})
+		assert.NotNil(t, err, address)
+	}
+
+	// The unescaped pluses are decoded from the query as spaces
+	plus := bytes.Repeat([]byte{0xfb}, sha256.Size)
+	pinURL, err := url.Parse("tls://127.0.0.1?pin=sha256/" + base64.StdEncoding.EncodeToString(plus))
+	assert.Nil(t, err)
+	pins, err := parsePins(pinURL)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{plus}, pins)
+	assert.Equal(t, "", pinURL.RawQuery)
+}
@@ -0,0 +1,367 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// errPipelineClosed is returned when the pipelined connection has been
+// closed before the query was sent.  It is safe to retry the query over a new
+// connection in this case.
+var errPipelineClosed = errors.New("pipelined connection is closed")
+
+// errPipelineFull is returned when there are no free message IDs left on the
+// pipelined connection.
+var errPipelineFull = errors.New("too many in-flight queries on the pipelined connection")
+
+// maxPipelineQueries is the maximum number of in-flight queries on a single
+// pipelined connection.  It is limited by the number of possible message IDs.
+const maxPipelineQueries = 0xffff
+
+// maxPipelineTimeouts is the number of the queries in a row that time out on a
+// pipelined connection before it's considered dead and closed.  A single slow
+// query only times out itself.
+const maxPipelineTimeouts = 3
+
+// pipelineResult is the result of a pipelined query.
+type pipelineResult struct {
+	reply    *dns.Msg
+	err      error
+	received time.Time // when the response was read
+	size     int       // size of the response read from the connection
+}
+
+// pipelineReq is a query waiting to be written to or answered on a pipelined
+// connection.
+type pipelineReq struct {
+	msg  *dns.Msg             // message to send, with the ID used on the wire
+	wire []byte               // packed msg, if it's packed before it's queued
+	resp chan *pipelineResult // buffered, receives exactly one result
+}
+
+// pipelineConn multiplexes several DNS queries over a single TCP or TLS
+// connection as allowed by RFC 7766 (section 6.2.1.1).  Queries are written by
+// a single writer goroutine and responses are dispatched to the waiting callers
+// by a single reader goroutine.  Since concurrent callers may use the same
+// message ID, every query gets a unique ID on the wire which is mapped back to
+// the original one once the response is received.
+type pipelineConn struct {
+	conn    net.Conn
+	timeout time.Duration // write timeout (0 means no timeout)
+
+	reqs chan *pipelineReq // queries waiting for the writer goroutine
+	done chan struct{}     // closed when the connection is closed
+
+	timeouts int32 // the number of the queries in a row that have timed out, accessed atomically
+
+	pending map[uint16]*pipelineReq // queries waiting for the response, by the wire ID
+	err     error                   // the reason the connection was closed
+	mu      sync.Mutex              // protects pending and err
+}
+
+// newPipelineConn creates a new *pipelineConn and starts its reader and writer
+// goroutines.
+func newPipelineConn(conn net.Conn, timeout time.Duration) *pipelineConn {
+	// The dialers set the deadline to cover the handshake, reset it so that
+	// the reader goroutine isn't interrupted.
+	_ = conn.SetDeadline(time.Time{})
+
+	pc := &pipelineConn{
+		conn:    conn,
+		timeout: timeout,
+		reqs:    make(chan *pipelineReq),
+		done:    make(chan struct{}),
+		pending: map[uint16]*pipelineReq{},
+	}
+
+	go pc.writeLoop()
+	go pc.readLoop()
+
+	return pc
+}
+
+// exchange sends the query over the pipelined connection and waits for the
+// response.  The message itself is not modified.
+func (pc *pipelineConn) exchange(m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
+	req := &pipelineReq{
+		msg:  m.Copy(),
+		resp: make(chan *pipelineResult, 1),
+	}
+
+	id, err := pc.register(req)
+	if err != nil {
+		return nil, err
+	}
+	req.msg.Id = id
+	req.wire, err = req.msg.Pack()
+	if err != nil {
+		pc.unregister(id)
+		return nil, err
+	}
+
+	var timeoutCh <-chan time.Time
+	if pc.timeout > 0 {
+		timer := time.NewTimer(pc.timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case pc.reqs <- req:
+		// Sent to the writer
+		tr.wroteQuery(connProtocol(pc.conn), pc.conn.RemoteAddr(), len(req.wire))
+	case <-pc.done:
+		pc.unregister(id)
+		return nil, errPipelineClosed
+	case <-timeoutCh:
+		pc.unregister(id)
+		err = &net.OpError{Op: "write", Net: "tcp", Err: errTimeout}
+		pc.timedOut(err)
+		return nil, err
+	}
+
+	select {
+	case res := <-req.resp:
+		if res.err != nil {
+			return nil, res.err
+		}
+
+		err = VerifyResponse(req.msg, res.reply)
+		if err != nil {
+			return nil, err
+		}
+
+		tr.readResponse(res.received, res.size)
+		res.reply.Id = m.Id
+		return res.reply, nil
+	case <-timeoutCh:
+		pc.unregister(id)
+		err = &net.OpError{Op: "read", Net: "tcp", Err: errTimeout}
+		pc.timedOut(err)
+		return nil, err
+	}
+}
+
+// timedOut counts the query that has timed out, the connection is closed with
+// err once maxPipelineTimeouts queries in a row have timed out
+func (pc *pipelineConn) timedOut(err error) {
+	if atomic.AddInt32(&pc.timeouts, 1) >= maxPipelineTimeouts {
+		log.Tracef("Too many timeouts on the pipelined connection to %s", pc.conn.RemoteAddr())
+		pc.close(err)
+	}
+}
+
+// register assigns a unique wire ID to the request and adds it to the pending
+// requests.
+func (pc *pipelineConn) register(req *pipelineReq) (uint16, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.err != nil {
+		return 0, errPipelineClosed
+	}
+
+	if len(pc.pending) >= maxPipelineQueries {
+		return 0, errPipelineFull
+	}
+
+	// Use random IDs to keep them unpredictable, just like dns.Id() does
+	id := dns.Id()
+	for {
+		if _, ok := pc.pending[id]; !ok {
+			break
+		}
+		id = dns.Id()
+	}
+
+	pc.pending[id] = req
+	return id, nil
+}
+
+// unregister removes the request from the pending requests.
+func (pc *pipelineConn) unregister(id uint16) {
+	pc.mu.Lock()
+	delete(pc.pending, id)
+	pc.mu.Unlock()
+}
+
+// isClosed returns true if the connection has been closed.
+func (pc *pipelineConn) isClosed() bool {
+	select {
+	case <-pc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the connection and fails all pending queries with err.
+func (pc *pipelineConn) close(err error) {
+	pc.mu.Lock()
+	if pc.err != nil {
+		pc.mu.Unlock()
+		return
+	}
+	pc.err = err
+	pending := pc.pending
+	pc.pending = map[uint16]*pipelineReq{}
+	close(pc.done)
+	pc.mu.Unlock()
+
+	_ = pc.conn.Close()
+
+	log.Tracef("Pipelined connection to %s is closed: %s", pc.conn.RemoteAddr(), err)
+	for _, req := range pending {
+		req.resp <- &pipelineResult{err: err}
+	}
+}
+
+// writeLoop writes the queued queries to the connection until it's closed.
+func (pc *pipelineConn) writeLoop() {
+	c := dns.Conn{Conn: pc.conn}
+	for {
+		select {
+		case req := <-pc.reqs:
+			if pc.timeout > 0 {
+				_ = pc.conn.SetWriteDeadline(time.Now().Add(pc.timeout))
+			}
+
+			_, err := c.Write(req.wire)
+			if err != nil {
+				pc.close(err)
+				return
+			}
+		case <-pc.done:
+			return
+		}
+	}
+}
+
+// readLoop reads the responses from the connection and dispatches them to the
+// waiting callers until the connection is closed.
+func (pc *pipelineConn) readLoop() {
+	c := dns.Conn{Conn: pc.conn}
+	bufPtr := bytesPool.Get().(*[]byte)
+	defer bytesPool.Put(bufPtr)
+	buf := *bufPtr
+	for {
+		n, err := c.Read(buf)
+		var reply *dns.Msg
+		if err == nil {
+			reply, err = proxyutil.UnpackMsg(buf[:n])
+		}
+		if err != nil {
+			pc.close(err)
+			return
+		}
+
+		// The connection is alive
+		atomic.StoreInt32(&pc.timeouts, 0)
+
+		pc.mu.Lock()
+		req, ok := pc.pending[reply.Id]
+		delete(pc.pending, reply.Id)
+		pc.mu.Unlock()
+
+		if !ok {
+			// Most likely the query has already timed out
+			log.Tracef("Dropping unexpected response with ID %d from %s", reply.Id, pc.conn.RemoteAddr())
+			continue
+		}
+
+		req.resp <- &pipelineResult{reply: reply, received: time.Now(), size: n}
+	}
+}
+
+// connProtocol returns the protocol of the pipelined connection for
+// ExchangeInfo
+func connProtocol(conn net.Conn) string {
+	if _, ok := conn.(*tls.Conn); ok {
+		return "tls"
+	}
+	return "tcp"
+}
+
+// errTimeout is the error used when a pipelined query times out.
+var errTimeout = timeoutError{}
+
+// timeoutError implements net.Error so that os.IsTimeout and the like work.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// pipeline keeps a single pipelined connection and re-creates it when it dies.
+type pipeline struct {
+	dial    func() (net.Conn, error) // creates a new connection
+	timeout time.Duration
+
+	conn *pipelineConn
+	mu   sync.Mutex // protects conn
+}
+
+// getConn returns the current pipelined connection or dials a new one if
+// there is none or it's closed.
+func (p *pipeline) getConn() (*pipelineConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil && !p.conn.isClosed() {
+		return p.conn, nil
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	p.conn = newPipelineConn(conn, p.timeout)
+	return p.conn, nil
+}
+
+// close closes the current pipelined connection, if any.
+func (p *pipeline) close() {
+	p.mu.Lock()
+	conn := p.conn
+	p.conn = nil
+	p.mu.Unlock()
+
+	if conn != nil {
+		conn.close(ErrClosed)
+	}
+}
+
+// exchange sends the query over the pipelined connection.  If the connection
+// turns out to be closed before the query is sent, it retries once over a new
+// connection.  The timed out query doesn't fail the other ones, the connection
+// is only closed on the read and write errors or after maxPipelineTimeouts
+// timeouts in a row, the next queries are sent over a new one then.
+func (p *pipeline) exchange(m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
+	conn, err := p.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.exchange(m, tr)
+	if err == errPipelineClosed {
+		log.Tracef("The pipelined connection is closed, re-connecting")
+
+		conn, err = p.getConn()
+		if err != nil {
+			return nil, err
+		}
+		tr.reconnect()
+		reply, err = conn.exchange(m, tr)
+	}
+
+	return reply, err
+}
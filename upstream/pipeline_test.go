@@ -0,0 +1,294 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startReorderingServer starts a TCP DNS server that waits for count queries
+// and then answers them in the reverse order.  It returns the listener and a
+// function that returns the number of accepted connections.
+func startReorderingServer(t *testing.T, count int) (net.Listener, func() int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	var mu sync.Mutex
+	accepted := 0
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepted++
+			mu.Unlock()
+
+			go func() {
+				defer conn.Close()
+				c := dns.Conn{Conn: conn}
+
+				var reqs []*dns.Msg
+				for len(reqs) < count {
+					req, err := c.ReadMsg()
+					if err != nil {
+						return
+					}
+					reqs = append(reqs, req)
+				}
+
+				for i := len(reqs) - 1; i >= 0; i-- {
+					res := new(dns.Msg)
+					res.SetReply(reqs[i])
+					_ = c.WriteMsg(res)
+				}
+			}()
+		}
+	}()
+
+	return l, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return accepted
+	}
+}
+
+func TestPipelineOutOfOrder(t *testing.T) {
+	const count = 20
+
+	l, accepted := startReorderingServer(t, count)
+	defer l.Close()
+
+	u, err := AddressToUpstream("tcp://"+l.Addr().String(), Options{Timeout: timeout, Pipelining: true})
+	assert.Nil(t, err)
+
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Use the same ID for all requests to check that collisions are
+			// handled properly
+			req := createHostTestMessage(fmt.Sprintf("host%d.example.org", i))
+			req.Id = 1
+
+			res, err := u.Exchange(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if res.Id != req.Id || res.Question[0].Name != req.Question[0].Name {
+				errs <- fmt.Errorf("wrong response to %s: %s", req.Question[0].Name, res.Question[0].Name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	assert.Equal(t, 1, accepted())
+}
+
+func TestPipelineTeardown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	// Close the connection as soon as the first query is read
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c := dns.Conn{Conn: conn}
+		_, _ = c.ReadMsg()
+		_ = conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+
+	pc := newPipelineConn(conn, timeout)
+	_, err = pc.exchange(createTestMessage(), nil)
+	assert.NotNil(t, err)
+	assert.True(t, pc.isClosed())
+
+	// The closed connection must not accept new queries
+	_, err = pc.exchange(createTestMessage(), nil)
+	assert.Equal(t, errPipelineClosed, err)
+}
+
+func TestPipelineRedial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	// The first connection never answers, the next ones do
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(silent bool) {
+				defer conn.Close()
+				c := dns.Conn{Conn: conn}
+				for {
+					req, err := c.ReadMsg()
+					if err != nil {
+						return
+					}
+					if !silent {
+						_ = c.WriteMsg(new(dns.Msg).SetReply(req))
+					}
+				}
+			}(i == 0)
+		}
+	}()
+
+	p := &pipeline{
+		dial:    func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) },
+		timeout: 200 * time.Millisecond,
+	}
+	defer p.close()
+
+	for i := 0; i < maxPipelineTimeouts; i++ {
+		_, err = p.exchange(createTestMessage(), nil)
+		if assert.NotNil(t, err) {
+			netErr, ok := err.(net.Error)
+			assert.True(t, ok && netErr.Timeout(), err.Error())
+		}
+	}
+
+	// The connection is replaced after the timeouts in a row
+	_, err = p.exchange(createTestMessage(), nil)
+	assert.Nil(t, err)
+}
+
+func TestPipelineSlowQuery(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	// The server never answers the slow query
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c := dns.Conn{Conn: conn}
+				for {
+					req, err := c.ReadMsg()
+					if err != nil {
+						return
+					}
+					if req.Question[0].Name != "slow.example.org." {
+						_ = c.WriteMsg(new(dns.Msg).SetReply(req))
+					}
+				}
+			}()
+		}
+	}()
+
+	dials := int32(0)
+	p := &pipeline{
+		dial: func() (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial("tcp", l.Addr().String())
+		},
+		timeout: 500 * time.Millisecond,
+	}
+	defer p.close()
+
+	// The slow query times out alone, the fast ones sent at the same time
+	// and after it are answered over the same connection
+	const fast = 10
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, fast+1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := p.exchange(createHostTestMessage("slow.example.org"), nil)
+		errs <- err
+	}()
+	for i := 0; i < fast; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+			_, err := p.exchange(createHostTestMessage(fmt.Sprintf("host%d.example.org", i)), nil)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	timeouts := 0
+	for err := range errs {
+		if err != nil {
+			netErr, ok := err.(net.Error)
+			assert.True(t, ok && netErr.Timeout(), err.Error())
+			timeouts++
+		}
+	}
+	assert.Equal(t, 1, timeouts)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+}
+
+func TestPipelineDoTRace(t *testing.T) {
+	const count = 50
+
+	srv := startTestDoTServer(t, nil)
+	defer srv.Close()
+
+	u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, InsecureSkipVerify: true, Pipelining: true})
+	assert.Nil(t, err)
+
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Half of the requests share the same ID
+			req := createHostTestMessage(fmt.Sprintf("host%d.example.org", i))
+			if i%2 == 0 {
+				req.Id = 1
+			}
+
+			res, err := u.Exchange(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if res.Id != req.Id || res.Question[0].Name != req.Question[0].Name {
+				errs <- fmt.Errorf("wrong response to %s: %s", req.Question[0].Name, res.Question[0].Name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// All the queries are sent over a single connection
+	assert.Equal(t, 1, srv.Accepted())
+}
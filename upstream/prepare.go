@@ -0,0 +1,47 @@
+package upstream
+
+import (
+	"github.com/miekg/dns"
+)
+
+// queryOptions are the Options applied to the queries by prepareQuery
+type queryOptions struct {
+	compress    *bool       // see Options.Compress
+	forceRD     *bool       // see Options.ForceRD
+	ednsOptions []dns.EDNS0 // see Options.EDNSOptions
+	maxSize     int         // see Options.MaxResponseSize
+}
+
+// newQueryOptions returns the query options of opts
+func newQueryOptions(opts *Options) queryOptions {
+	return queryOptions{
+		compress:    opts.Compress,
+		forceRD:     opts.ForceRD,
+		ednsOptions: opts.EDNSOptions,
+		maxSize:     opts.MaxResponseSize,
+	}
+}
+
+// prepareQuery begins the exchange tracked by t and returns the copy of m the
+// upstream sends, with opts applied.  finish must be called with the result of
+// the exchange, it removes the OPT record added for opts.ednsOptions, limits
+// the response size and ends the exchange.  It returns ErrClosed if the
+// upstream is closed.
+func prepareQuery(t *exchangeTracker, m *dns.Msg, opts queryOptions, tr *exchangeTrace) (
+	req *dns.Msg, finish func(reply *dns.Msg, err error) (*dns.Msg, error), err error) {
+	if err = t.begin(); err != nil {
+		return nil, nil, err
+	}
+
+	req = copyRequest(m, opts.compress)
+	forceRD(req, opts.forceRD)
+	req, addedOPT := withEDNSOptions(req, opts.ednsOptions)
+
+	finish = func(reply *dns.Msg, err error) (*dns.Msg, error) {
+		defer t.end()
+
+		removeAddedOPT(reply, addedOPT, tr)
+		return limitResponse(reply, err, opts.maxSize)
+	}
+	return req, finish, nil
+}
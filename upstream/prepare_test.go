@@ -0,0 +1,57 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrepareQuery(t *testing.T) {
+	rd := false
+	opts := queryOptions{
+		forceRD:     &rd,
+		ednsOptions: []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID}},
+		maxSize:     dns.MinMsgSize,
+	}
+	tracker := &exchangeTracker{}
+
+	// The caller's message isn't modified
+	m := createTestMessage()
+	req, finish, err := prepareQuery(tracker, m, opts, nil)
+	if err != nil {
+		t.Fatalf("cannot prepare the query: %s", err)
+	}
+	assert.True(t, m.RecursionDesired)
+	assert.Nil(t, m.IsEdns0())
+	assert.False(t, req.RecursionDesired)
+	if assert.NotNil(t, req.IsEdns0()) {
+		assert.Len(t, req.IsEdns0().Option, 1)
+	}
+
+	// The added OPT record is removed from the response
+	reply := new(dns.Msg).SetReply(req)
+	reply, err = finish(reply, nil)
+	assert.Nil(t, err)
+	if assert.NotNil(t, reply) {
+		assert.Nil(t, reply.IsEdns0())
+	}
+
+	// The large responses are rejected
+	_, finish, err = prepareQuery(tracker, m, opts, nil)
+	if err != nil {
+		t.Fatalf("cannot prepare the query: %s", err)
+	}
+	reply = new(dns.Msg).SetReply(m)
+	for i := 0; i < 50; i++ {
+		reply.Answer = append(reply.Answer, newTestRR("%s 60 IN TXT %q", m.Question[0].Name, "large response"))
+	}
+	_, err = finish(reply, nil)
+	assert.IsType(t, &ResponseTooLargeError{}, err)
+
+	// Both exchanges have ended
+	assert.Nil(t, tracker.shutdown(context.Background(), func() error { return nil }))
+	_, _, err = prepareQuery(tracker, m, opts, nil)
+	assert.Equal(t, ErrClosed, err)
+}
@@ -0,0 +1,79 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ProbeResult is the result of probing the upstream with ProbeUpstreams
+type ProbeResult struct {
+	Upstream Upstream      // probed upstream
+	RTT      time.Duration // how long the exchange took, 0 if it failed
+	Err      error         // nil if the upstream has responded
+}
+
+// NewProbeRequest returns the query ProbeUpstreams sends if req is nil, the
+// NS records of the root zone
+func NewProbeRequest() *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(".", dns.TypeNS)
+	return req
+}
+
+// ProbeUpstreams sends the request to all the upstreams concurrently and
+// returns the results in the order of the upstreams.  If req is nil,
+// NewProbeRequest is sent.  The upstream has failed if the exchange returns an
+// error or the response is SERVFAIL.  The exchanges that haven't finished when
+// ctx is done fail with its error, they keep running in the background.
+func ProbeUpstreams(ctx context.Context, upstreams []Upstream, req *dns.Msg) []ProbeResult {
+	if req == nil {
+		req = NewProbeRequest()
+	}
+
+	results := make([]ProbeResult, len(upstreams))
+	ch := make(chan int, len(upstreams))
+	for i, u := range upstreams {
+		results[i].Upstream = u
+		go func(i int, u Upstream) {
+			// Every exchange gets its own copy since the ID is changed
+			m := req.Copy()
+			m.Id = dns.Id()
+			start := time.Now()
+			reply, _, err := exchange(u, m)
+			if err == nil && reply == nil {
+				err = fmt.Errorf("upstream %s returned no response", u.Address())
+			} else if err == nil && reply.Rcode == dns.RcodeServerFailure {
+				err = fmt.Errorf("upstream %s responded with SERVFAIL", u.Address())
+			}
+			results[i] = ProbeResult{Upstream: u, Err: err}
+			if err == nil {
+				results[i].RTT = time.Since(start)
+			}
+			ch <- i
+		}(i, u)
+	}
+
+	done := make([]bool, len(upstreams))
+	for n := 0; n < len(upstreams); n++ {
+		select {
+		case i := <-ch:
+			done[i] = true
+		case <-ctx.Done():
+			// results can't be returned while the exchanges may still write
+			// to them
+			copied := make([]ProbeResult, len(upstreams))
+			for i, u := range upstreams {
+				if done[i] {
+					copied[i] = results[i]
+				} else {
+					copied[i] = ProbeResult{Upstream: u, Err: ctx.Err()}
+				}
+			}
+			return copied
+		}
+	}
+	return results
+}
@@ -0,0 +1,58 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeUpstreams(t *testing.T) {
+	var probed *dns.Msg
+	ok := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		probed = m
+		return new(dns.Msg).SetReply(m), nil
+	})
+	failed := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		return nil, errors.New("no route to host")
+	})
+	servfail := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		return new(dns.Msg).SetRcode(m, dns.RcodeServerFailure), nil
+	})
+	slow := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		time.Sleep(time.Second)
+		return new(dns.Msg).SetReply(m), nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	results := ProbeUpstreams(ctx, []Upstream{ok, failed, servfail, slow}, nil)
+	if !assert.Len(t, results, 4) {
+		return
+	}
+	for i, u := range []Upstream{ok, failed, servfail, slow} {
+		assert.Equal(t, u, results[i].Upstream)
+	}
+
+	assert.Nil(t, results[0].Err)
+	assert.True(t, results[0].RTT > 0)
+	if assert.NotNil(t, probed) {
+		assert.Equal(t, dns.Question{Name: ".", Qtype: dns.TypeNS, Qclass: dns.ClassINET}, probed.Question[0])
+	}
+	assert.NotNil(t, results[1].Err)
+	assert.NotNil(t, results[2].Err)
+	assert.Equal(t, context.DeadlineExceeded, results[3].Err)
+	for _, r := range results[1:] {
+		assert.Equal(t, time.Duration(0), r.RTT)
+	}
+
+	// The custom request
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	results = ProbeUpstreams(context.Background(), []Upstream{ok}, req)
+	assert.Nil(t, results[0].Err)
+	assert.Equal(t, "example.org.", probed.Question[0].Name)
+}
@@ -0,0 +1,164 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"golang.org/x/net/proxy"
+)
+
+// errProxyUDP is returned when UDP is used with Options.ProxyURL
+var errProxyUDP = errors.New("UDP can't be sent through the proxy")
+
+// defaultProxyPorts are the ports of the proxy URLs without one
+var defaultProxyPorts = map[string]string{"socks5": "1080", "http": "80"}
+
+// parseProxyURL parses and validates Options.ProxyURL
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+
+	port, ok := defaultProxyPorts[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported proxy URL scheme %q, must be socks5 or http", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("no host in the proxy URL")
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// checkProxyUDP returns an error if the UDP-based upstream is created with
+// Options.ProxyURL
+func checkProxyUDP(address string, opts Options) error {
+	if opts.ProxyURL == "" {
+		return nil
+	}
+	return fmt.Errorf("%s: %w, only tcp://, tls://, https:// and DNSCrypt upstreams can be used", address, errProxyUDP)
+}
+
+// newProxyDialHandler returns the dialHandler that connects to addr through
+// the proxy.  The connection to the proxy itself is created by forward.  Only
+// TCP is supported.
+func newProxyDialHandler(proxyURL *url.URL, forward dialHandler) dialHandler {
+	connect := newHTTPConnectDialer(proxyURL, forward)
+	if proxyURL.Scheme == "socks5" {
+		connect = newSOCKS5Dialer(proxyURL, forward)
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !strings.HasPrefix(network, "tcp") {
+			return nil, errProxyUDP
+		}
+		return connect(ctx, "tcp", addr)
+	}
+}
+
+// contextDialer is the dialHandler as proxy.Dialer and proxy.ContextDialer
+type contextDialer dialHandler
+
+// Dial implements the proxy.Dialer interface for contextDialer
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+// DialContext implements the proxy.ContextDialer interface for contextDialer
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// newSOCKS5Dialer returns the dialHandler that asks the SOCKS5 proxy to connect
+// to the address, the credentials of the proxy URL are sent if it has them
+func newSOCKS5Dialer(proxyURL *url.URL, forward dialHandler) dialHandler {
+	var auth *proxy.Auth
+	if user := proxyURL.User; user != nil {
+		pass, _ := user.Password()
+		auth = &proxy.Auth{User: user.Username(), Password: pass}
+	}
+
+	// It never fails, and the dialer is always a proxy.ContextDialer
+	d, _ := proxy.SOCKS5("tcp", proxyURL.Host, auth, contextDialer(forward))
+	dial := d.(proxy.ContextDialer).DialContext
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, errorx.Decorate(err, "proxy %s failed to connect to %s", proxyURL.Host, addr)
+		}
+		return conn, nil
+	}
+}
+
+// newHTTPConnectDialer returns the dialHandler that asks the HTTP proxy to
+// connect to the address with the CONNECT method
+func newHTTPConnectDialer(proxyURL *url.URL, forward dialHandler) dialHandler {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := forward(ctx, network, proxyURL.Host)
+		if err != nil {
+			return nil, errorx.Decorate(err, "failed to connect to the proxy %s", proxyURL.Host)
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+		err = httpConnect(conn, addr, proxyURL.User)
+		if err != nil {
+			_ = conn.Close()
+			return nil, errorx.Decorate(err, "proxy %s failed to connect to %s", proxyURL.Host, addr)
+		}
+		_ = conn.SetDeadline(time.Time{})
+
+		return conn, nil
+	}
+}
+
+// httpConnect asks the HTTP proxy to connect to addr with the CONNECT method,
+// the credentials are sent if user isn't nil
+func httpConnect(conn net.Conn, addr string, user *url.Userinfo) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	err := req.Write(conn)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the proxy responded with %s", resp.Status)
+	}
+
+	// The server mustn't send anything before the client's first message
+	if br.Buffered() > 0 {
+		return errors.New("unexpected data after the proxy response")
+	}
+	return nil
+}
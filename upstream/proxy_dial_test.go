@@ -0,0 +1,284 @@
+package upstream
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyURLSOCKS5(t *testing.T) {
+	srv := startTestDNSServer(t)
+	defer srv.Close()
+	addr := srv.Addr
+
+	p := startTestSOCKS5Proxy(t, "user", "pass")
+	defer p.close()
+
+	u, err := AddressToUpstream("tcp://"+addr, Options{Timeout: timeout, ProxyURL: "socks5://user:pass@" + p.addr})
+	assert.Nil(t, err)
+	res, err := u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange through the proxy: %s", err)
+	}
+	assert.Len(t, res.Answer, 1)
+	assert.Equal(t, []string{addr}, p.getTargets())
+
+	// Wrong credentials
+	u, err = AddressToUpstream("tcp://"+addr, Options{Timeout: timeout, ProxyURL: "socks5://user:wrong@" + p.addr})
+	assert.Nil(t, err)
+	_, err = u.Exchange(createTestMessage())
+	assert.NotNil(t, err)
+	assert.Len(t, p.getTargets(), 1)
+}
+
+func TestProxyURLHTTP(t *testing.T) {
+	srv := startTestDNSServer(t)
+	defer srv.Close()
+	addr := srv.Addr
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	var auth string
+	var authLock sync.Mutex
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				authLock.Lock()
+				auth = req.Header.Get("Proxy-Authorization")
+				authLock.Unlock()
+
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				pipeConns(conn, target)
+			}()
+		}
+	}()
+
+	u, err := AddressToUpstream("tcp://"+addr, Options{Timeout: timeout, ProxyURL: "http://user:pass@" + l.Addr().String()})
+	assert.Nil(t, err)
+	res, err := u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange through the proxy: %s", err)
+	}
+	assert.Len(t, res.Answer, 1)
+
+	authLock.Lock()
+	defer authLock.Unlock()
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")), auth)
+}
+
+func TestProxyURLDNSCrypt(t *testing.T) {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	assert.Nil(t, err)
+	cert, err := rc.CreateCert()
+	assert.Nil(t, err)
+
+	s := &dnscrypt.Server{
+		ProviderName: rc.ProviderName,
+		ResolverCert: cert,
+		Handler:      &testDNSCryptHandler{},
+	}
+
+	// Only TCP is served, everything must go through the proxy
+	tcpConn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.Nil(t, err)
+	defer tcpConn.Close()
+	go s.ServeTCP(tcpConn)
+
+	p := startTestSOCKS5Proxy(t, "", "")
+	defer p.close()
+
+	stamp, err := rc.CreateStamp(tcpConn.Addr().String())
+	assert.Nil(t, err)
+	u, err := AddressToUpstream(stamp.String(), Options{Timeout: timeout, ProxyURL: "socks5://" + p.addr})
+	assert.Nil(t, err)
+
+	res, err := u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange through the proxy: %s", err)
+	}
+	assert.Len(t, res.Answer, 1)
+
+	// The certificate request and the query
+	assert.Len(t, p.getTargets(), 2)
+}
+
+func TestProxyURLInvalid(t *testing.T) {
+	const proxyURL = "socks5://127.0.0.1:1080"
+
+	for _, address := range []string{"8.8.8.8", "udp://8.8.8.8", "quic://dns.adguard.com"} {
+		_, err := AddressToUpstream(address, Options{ProxyURL: proxyURL})
+		assert.NotNil(t, err, address)
+	}
+
+	_, err := AddressToUpstream("tls://dns.adguard.com", Options{ProxyURL: "ftp://127.0.0.1"})
+	assert.NotNil(t, err)
+	_, err = AddressToUpstream("tls://dns.adguard.com", Options{ProxyURL: "socks5://"})
+	assert.NotNil(t, err)
+
+	// The plain bootstrap can't go through the proxy either
+	_, err = AddressToUpstream("tls://dns.adguard.com", Options{ProxyURL: proxyURL, Bootstrap: []string{"8.8.8.8"}})
+	assert.NotNil(t, err)
+}
+
+// startTestDNSServer starts a plain DNS server that answers every query with
+// an A record
+func startTestDNSServer(t *testing.T) *dnsproxytest.Server {
+	srv, err := dnsproxytest.NewPlainServer(func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg).SetReply(req)
+		resp.Answer = []dns.RR{newTestRR("%s 60 IN A 192.0.2.1", req.Question[0].Name)}
+		return resp
+	})
+	if err != nil {
+		t.Fatalf("cannot start the DNS server: %s", err)
+	}
+	return srv
+}
+
+// SOCKS5 constants used by the test proxy, see RFC 1928 and RFC 1929
+const (
+	socks5Version      = 5
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5AddrIPv4     = 1
+)
+
+// testSOCKS5Proxy is a minimal SOCKS5 proxy that records the addresses the
+// clients connect to
+type testSOCKS5Proxy struct {
+	addr     string
+	user     string // if not empty, the username/password auth is required
+	password string
+
+	l       net.Listener
+	targets []string
+	mu      sync.Mutex // protects targets
+}
+
+// startTestSOCKS5Proxy starts the SOCKS5 proxy on a random port
+func startTestSOCKS5Proxy(t *testing.T, user, password string) *testSOCKS5Proxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+
+	p := &testSOCKS5Proxy{addr: l.Addr().String(), user: user, password: password, l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return p
+}
+
+func (p *testSOCKS5Proxy) close() { _ = p.l.Close() }
+
+func (p *testSOCKS5Proxy) getTargets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+// handle serves a single client, only the IPv4 addresses are supported
+func (p *testSOCKS5Proxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, buf[1])); err != nil {
+		return
+	}
+
+	if p.user == "" {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNone})
+	} else {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthPassword})
+		user, ok := readSOCKS5String(conn, 2)
+		pass, ok2 := readSOCKS5String(conn, 1)
+		if !ok || !ok2 {
+			return
+		}
+		if user != p.user || pass != p.password {
+			_, _ = conn.Write([]byte{1, 1})
+			return
+		}
+		_, _ = conn.Write([]byte{1, 0})
+	}
+
+	req := make([]byte, 4+net.IPv4len+2)
+	if _, err := io.ReadFull(conn, req); err != nil || req[3] != socks5AddrIPv4 {
+		return
+	}
+	ip := net.IP(req[4 : 4+net.IPv4len])
+	port := int(req[8])<<8 | int(req[9])
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		_, _ = conn.Write([]byte{socks5Version, 5, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+
+	p.mu.Lock()
+	p.targets = append(p.targets, addr)
+	p.mu.Unlock()
+
+	_, _ = conn.Write([]byte{socks5Version, 0, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	pipeConns(conn, target)
+}
+
+// readSOCKS5String reads the length-prefixed string, the prefix is skip bytes
+// long with the length in the last one
+func readSOCKS5String(r io.Reader, skip int) (string, bool) {
+	l := make([]byte, skip)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return "", false
+	}
+	s := make([]byte, l[skip-1])
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", false
+	}
+	return string(s), true
+}
+
+// pipeConns copies the data between the connections until one of them is
+// closed
+func pipeConns(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() { _, _ = io.Copy(a, b); done <- struct{}{} }()
+	go func() { _, _ = io.Copy(b, a); done <- struct{}{} }()
+	<-done
+}
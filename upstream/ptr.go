@@ -0,0 +1,27 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ExchangePTR sends the PTR query for the IP address to the upstream.  The
+// query name is the in-addr.arpa name for IPv4 addresses, including the
+// IPv4-mapped IPv6 ones, and the nibble-reversed ip6.arpa name for IPv6
+// addresses.
+func ExchangePTR(u Upstream, ip net.IP) (*dns.Msg, error) {
+	if ip.To16() == nil {
+		return nil, fmt.Errorf("invalid IP address: %v", ip)
+	}
+
+	arpa, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil, err
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(arpa, dns.TypePTR)
+	return u.Exchange(req)
+}
@@ -0,0 +1,44 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExchangePTR(t *testing.T) {
+	var qname string
+	u := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		qname = m.Question[0].Name
+		assert.Equal(t, dns.TypePTR, m.Question[0].Qtype)
+		assert.True(t, m.RecursionDesired)
+
+		res := new(dns.Msg).SetReply(m)
+		res.Answer = []dns.RR{newTestRR("%s 60 IN PTR host.example.", qname)}
+		return res, nil
+	})
+
+	testCases := []struct {
+		ip    string
+		qname string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa."},
+		{"::ffff:192.0.2.1", "1.2.0.192.in-addr.arpa."},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+	for _, tc := range testCases {
+		res, err := ExchangePTR(u, net.ParseIP(tc.ip))
+		if err != nil {
+			t.Fatalf("cannot exchange PTR for %s: %s", tc.ip, err)
+		}
+		assert.Equal(t, tc.qname, qname)
+		if assert.Len(t, res.Answer, 1) {
+			assert.Equal(t, "host.example.", res.Answer[0].(*dns.PTR).Ptr)
+		}
+	}
+
+	_, err := ExchangePTR(u, nil)
+	assert.NotNil(t, err)
+}
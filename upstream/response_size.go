@@ -0,0 +1,59 @@
+package upstream
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseTooLargeError is returned by the upstreams when the response is
+// larger than Options.MaxResponseSize
+type ResponseTooLargeError struct {
+	Size    int // size of the response in bytes, at least MaxSize+1 if the reading was stopped
+	MaxSize int // the limit
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response of %d bytes exceeds the limit of %d bytes", e.Size, e.MaxSize)
+}
+
+// limitResponse returns *ResponseTooLargeError instead of the response if its
+// packed size is larger than maxSize.  maxSize 0 means no limit.
+func limitResponse(reply *dns.Msg, err error, maxSize int) (*dns.Msg, error) {
+	if err != nil || maxSize <= 0 {
+		return reply, err
+	}
+
+	// The responses are compressed on the wire, but unpacking doesn't
+	// remember it
+	compress := reply.Compress
+	reply.Compress = true
+	size := reply.Len()
+	reply.Compress = compress
+
+	if size > maxSize {
+		return nil, &ResponseTooLargeError{Size: size, MaxSize: maxSize}
+	}
+	return reply, nil
+}
+
+// limitUDPSize returns a copy of the request that advertises the UDP payload
+// size of maxSize if it advertises a larger one, so that the server truncates
+// the larger responses instead of sending them
+func limitUDPSize(m *dns.Msg, maxSize int) *dns.Msg {
+	if maxSize <= 0 {
+		return m
+	}
+	if maxSize < dns.MinMsgSize {
+		maxSize = dns.MinMsgSize
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil || int(opt.UDPSize()) <= maxSize {
+		return m
+	}
+
+	req := m.Copy()
+	req.IsEdns0().SetUDPSize(uint16(maxSize))
+	return req
+}
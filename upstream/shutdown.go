@@ -0,0 +1,84 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned by Exchange once the upstream is closed or being shut down
+var ErrClosed = errors.New("upstream is closed")
+
+// Closer is implemented by the upstreams created by this package.  It allows
+// replacing the upstreams without leaking their connections.
+type Closer interface {
+	// Close stops accepting new queries and closes the connections right
+	// away, the queries in progress may fail
+	Close() error
+
+	// Shutdown stops accepting new queries, waits for the queries in progress
+	// to complete or ctx to be done, and then closes the connections.  It
+	// returns ctx.Err() if the queries didn't complete in time.
+	Shutdown(ctx context.Context) error
+}
+
+// exchangeTracker tracks the Exchange calls in progress so that the upstream
+// can be shut down gracefully
+type exchangeTracker struct {
+	mu     sync.Mutex
+	closed bool // if true, new exchanges are rejected
+	wg     sync.WaitGroup
+}
+
+// begin must be called when Exchange starts, and end when it returns.  It
+// returns ErrClosed if the upstream is closed.
+func (t *exchangeTracker) begin() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return ErrClosed
+	}
+
+	t.wg.Add(1)
+	return nil
+}
+
+// end marks the exchange as completed
+func (t *exchangeTracker) end() { t.wg.Done() }
+
+// close rejects new exchanges and calls release right away
+func (t *exchangeTracker) close(release func() error) error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	return release()
+}
+
+// shutdown rejects new exchanges, waits for the ones in progress until ctx is
+// done and calls release
+func (t *exchangeTracker) shutdown(ctx context.Context, release func() error) error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	releaseErr := release()
+	if err != nil {
+		return err
+	}
+	return releaseErr
+}
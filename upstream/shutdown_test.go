@@ -0,0 +1,93 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	u := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		close(started)
+		<-unblock
+		return new(dns.Msg).SetReply(m), nil
+	})
+
+	// Start a slow exchange
+	exchanged := make(chan error, 1)
+	go func() {
+		_, err := u.Exchange(createTestMessage())
+		exchanged <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- u.(Closer).Shutdown(context.Background())
+	}()
+
+	// New exchanges are rejected right away
+	assert.Eventually(t, func() bool {
+		_, err := u.Exchange(createTestMessage())
+		return err == ErrClosed
+	}, time.Second, time.Millisecond)
+
+	// Shutdown waits for the exchange in progress
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown must wait for the exchange in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+	assert.Nil(t, <-exchanged)
+	assert.Nil(t, <-shutdown)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	started := make(chan struct{})
+	u := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		close(started)
+		<-unblock
+		return new(dns.Msg).SetReply(m), nil
+	})
+
+	go func() {
+		_, _ = u.Exchange(createTestMessage())
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, u.(Closer).Shutdown(ctx))
+}
+
+func TestShutdownTLS(t *testing.T) {
+	srv := startTestDoTServer(t, nil)
+	defer srv.Close()
+
+	u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, InsecureSkipVerify: true})
+	assert.Nil(t, err)
+
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+
+	p := u.(*dnsOverTLS)
+	assert.Len(t, p.pool.conns, 1)
+
+	assert.Nil(t, p.Shutdown(context.Background()))
+
+	// The pooled connections are closed
+	assert.Empty(t, p.pool.conns)
+
+	_, err = u.Exchange(createTestMessage())
+	assert.Equal(t, ErrClosed, err)
+}
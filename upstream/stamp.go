@@ -0,0 +1,61 @@
+package upstream
+
+import (
+	"github.com/ameshkov/dnsstamps"
+	"github.com/joomcode/errorx"
+)
+
+// StampInfo contains what the DNS stamp claims about the DNS server
+// (see https://dnscrypt.info/stamps-specifications)
+type StampInfo struct {
+	Proto        dnsstamps.StampProtoType // protocol of the DNS server
+	ProviderName string                   // DNSCrypt provider name, or server hostname for DoH, DoT and DoQ
+	ServerAddr   string                   // server address (may be empty for DoH, DoT and DoQ)
+	PublicKey    []byte                   // DNSCrypt provider's public key, empty for other protocols
+	Path         string                   // HTTP path, DoH only
+
+	DNSSEC   bool // the server does DNSSEC validation
+	NoLog    bool // the server does not record logs
+	NoFilter bool // the server doesn't intentionally block domains
+}
+
+// ParseStamp parses the sdns:// DNS stamp and returns the information about
+// the DNS server it describes
+func ParseStamp(address string) (*StampInfo, error) {
+	stamp, err := dnsstamps.NewServerStampFromString(address)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to parse %s", address)
+	}
+
+	return newStampInfo(stamp), nil
+}
+
+// newStampInfo creates a new *StampInfo from the parsed DNS stamp
+func newStampInfo(stamp dnsstamps.ServerStamp) *StampInfo {
+	return &StampInfo{
+		Proto:        stamp.Proto,
+		ProviderName: stamp.ProviderName,
+		ServerAddr:   stamp.ServerAddrStr,
+		PublicKey:    stamp.ServerPk,
+		Path:         stamp.Path,
+		DNSSEC:       stamp.Props&dnsstamps.ServerInformalPropertyDNSSEC != 0,
+		NoLog:        stamp.Props&dnsstamps.ServerInformalPropertyNoLog != 0,
+		NoFilter:     stamp.Props&dnsstamps.ServerInformalPropertyNoFilter != 0,
+	}
+}
+
+// setStampInfo saves the stamp information to the upstream created from it
+func setStampInfo(u Upstream, info *StampInfo) {
+	switch u := u.(type) {
+	case *plainDNS:
+		u.stamp = info
+	case *dnsCrypt:
+		u.stamp = info
+	case *dnsOverHTTPS:
+		u.stamp = info
+	case *dnsOverTLS:
+		u.stamp = info
+	case *dnsOverQUIC:
+		u.stamp = info
+	}
+}
@@ -0,0 +1,60 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStamp(t *testing.T) {
+	// AdGuard DNS (DNSCrypt)
+	info, err := ParseStamp("sdns://AQIAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20")
+	assert.Nil(t, err)
+	assert.Equal(t, dnsstamps.StampProtoTypeDNSCrypt, info.Proto)
+	assert.Equal(t, "2.dnscrypt.default.ns1.adguard.com", info.ProviderName)
+	assert.Equal(t, "176.103.130.130:5443", info.ServerAddr)
+	assert.Len(t, info.PublicKey, 32)
+	assert.False(t, info.DNSSEC)
+	assert.True(t, info.NoLog)
+	assert.False(t, info.NoFilter)
+
+	// Cloudflare DNS (DoH)
+	info, err = ParseStamp("sdns://AgcAAAAAAAAABzEuMC4wLjGgENk8mGSlIfMGXMOlIlCcKvq7AVgcrZxtjon911-ep0cg63Ul-I8NlFj4GplQGb_TTLiczclX57DvMV8Q-JdjgRgSZG5zLmNsb3VkZmxhcmUuY29tCi9kbnMtcXVlcnk")
+	assert.Nil(t, err)
+	assert.Equal(t, dnsstamps.StampProtoTypeDoH, info.Proto)
+	assert.Equal(t, "dns.cloudflare.com", info.ProviderName)
+	assert.Equal(t, "/dns-query", info.Path)
+	assert.True(t, info.DNSSEC)
+	assert.True(t, info.NoLog)
+	assert.True(t, info.NoFilter)
+
+	_, err = ParseStamp("tls://1.1.1.1")
+	assert.NotNil(t, err)
+}
+
+func TestUpstreamProperties(t *testing.T) {
+	type stamped interface {
+		Properties() *StampInfo
+	}
+
+	// AdGuard DNS (DNSCrypt)
+	u, err := AddressToUpstream("sdns://AQIAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20", Options{})
+	assert.Nil(t, err)
+	info := u.(stamped).Properties()
+	assert.NotNil(t, info)
+	assert.Equal(t, "2.dnscrypt.default.ns1.adguard.com", info.ProviderName)
+
+	// AdGuard DNS (DNS-over-TLS)
+	u, err = AddressToUpstream("sdns://AwAAAAAAAAAAAAAPZG5zLmFkZ3VhcmQuY29t", Options{})
+	assert.Nil(t, err)
+	info = u.(stamped).Properties()
+	assert.NotNil(t, info)
+	assert.Equal(t, dnsstamps.StampProtoTypeTLS, info.Proto)
+	assert.Equal(t, "dns.adguard.com", info.ProviderName)
+
+	// Not created from a stamp
+	u, err = AddressToUpstream("tls://dns.adguard.com", Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, u.(stamped).Properties())
+}
@@ -0,0 +1,62 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// TLSState is the summary of the TLS connection used by the DoT or DoH upstream
+type TLSState struct {
+	Version            uint16 // TLS version, e.g. tls.VersionTLS13
+	CipherSuite        uint16 // cipher suite, e.g. tls.TLS_AES_128_GCM_SHA256
+	DidResume          bool   // the session was resumed from a previous connection
+	NegotiatedProtocol string // ALPN protocol, may be empty
+	ServerName         string // SNI sent to the server
+
+	// LeafSubject is the subject of the server certificate.  It is taken from
+	// the verified chain, or from the presented certificates if the
+	// verification was skipped.
+	LeafSubject string
+}
+
+// newTLSState summarizes the TLS connection state
+func newTLSState(cs tls.ConnectionState) *TLSState {
+	s := &TLSState{
+		Version:            cs.Version,
+		CipherSuite:        cs.CipherSuite,
+		DidResume:          cs.DidResume,
+		NegotiatedProtocol: cs.NegotiatedProtocol,
+		ServerName:         cs.ServerName,
+	}
+
+	if len(cs.VerifiedChains) > 0 && len(cs.VerifiedChains[0]) > 0 {
+		s.LeafSubject = cs.VerifiedChains[0][0].Subject.String()
+	} else if len(cs.PeerCertificates) > 0 {
+		s.LeafSubject = cs.PeerCertificates[0].Subject.String()
+	}
+
+	return s
+}
+
+// lastTLSState keeps the state of the last TLS connection used by the upstream
+type lastTLSState struct {
+	mu    sync.Mutex
+	state *TLSState
+}
+
+// set saves the state of the connection
+func (l *lastTLSState) set(cs tls.ConnectionState) {
+	s := newTLSState(cs)
+
+	l.mu.Lock()
+	l.state = s
+	l.mu.Unlock()
+}
+
+// get returns the saved state or nil if there were no connections yet
+func (l *lastTLSState) get() *TLSState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.state
+}
@@ -0,0 +1,52 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSState(t *testing.T) {
+	type tlsStater interface {
+		TLSState() *TLSState
+	}
+
+	srv := startTestDoTServer(t, nil)
+	defer srv.Close()
+
+	for _, pipelining := range []bool{false, true} {
+		u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, InsecureSkipVerify: true, Pipelining: pipelining})
+		assert.Nil(t, err)
+
+		// No connections yet
+		assert.Nil(t, u.(tlsStater).TLSState())
+
+		_, err = u.Exchange(createTestMessage())
+		assert.Nil(t, err)
+
+		state := u.(tlsStater).TLSState()
+		if state == nil {
+			t.Fatalf("no TLS state with pipelining=%v", pipelining)
+		}
+		assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+		assert.NotZero(t, state.CipherSuite)
+		assert.Equal(t, "O=AdGuard Tests", state.LeafSubject)
+	}
+
+	dohSrv := startTestDoHServer(t)
+	defer dohSrv.Close()
+
+	u, err := AddressToUpstream(dohSrv.URL, Options{Timeout: timeout, InsecureSkipVerify: true})
+	assert.Nil(t, err)
+
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+
+	state := u.(tlsStater).TLSState()
+	if state == nil {
+		t.Fatalf("no TLS state for DoH")
+	}
+	assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+	assert.NotEmpty(t, state.LeafSubject)
+}
@@ -1,13 +1,16 @@
 package upstream
 
 import (
+	"context"
 	"io"
+	"net"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
@@ -19,14 +22,52 @@ type dnsCrypt struct {
 	boot       *bootstrapper
 	client     *dnscrypt.Client       // DNSCrypt client properties
 	serverInfo *dnscrypt.ResolverInfo // DNSCrypt resolver info
+	stamp      *StampInfo             // information from the server's DNS stamp
+	transport  dnsCryptTransport      // if not nil, queries are sent through the relay or the proxy
+	exchanges  exchangeTracker        // Exchange calls in progress
 
 	sync.RWMutex // protects DNSCrypt client
 }
 
 func (p *dnsCrypt) Address() string { return p.boot.address }
 
+// Properties returns the information from the DNS stamp the upstream was created from
+func (p *dnsCrypt) Properties() *StampInfo { return p.stamp }
+
+// WithOptions implements the Cloner interface for *dnsCrypt
+func (p *dnsCrypt) WithOptions(opts *Options) (Upstream, error) {
+	return cloneUpstream(p.Address(), nil, nil, opts)
+}
+
+// Close implements the Closer interface for *dnsCrypt
+func (p *dnsCrypt) Close() error { return p.exchanges.close(p.release) }
+
+// Shutdown implements the Closer interface for *dnsCrypt
+func (p *dnsCrypt) Shutdown(ctx context.Context) error {
+	return p.exchanges.shutdown(ctx, p.release)
+}
+
+// release does nothing since DNSCrypt doesn't keep the connections open
+func (p *dnsCrypt) release() error { return nil }
+
 func (p *dnsCrypt) Exchange(m *dns.Msg) (*dns.Msg, error) {
-	reply, err := p.exchangeDNSCrypt(m)
+	return followCNAME(p.boot.options.FollowCNAME, p.exchangeTraced)(m, nil)
+}
+
+// ExchangeWithInfo implements the InfoExchanger interface for *dnsCrypt
+func (p *dnsCrypt) ExchangeWithInfo(m *dns.Msg) (*dns.Msg, *ExchangeInfo, error) {
+	return traceExchange(m, followCNAME(p.boot.options.FollowCNAME, p.exchangeTraced))
+}
+
+// exchangeTraced sends the query and records the details to tr
+func (p *dnsCrypt) exchangeTraced(m *dns.Msg, tr *exchangeTrace) (reply *dns.Msg, err error) {
+	m, finish, err := prepareQuery(&p.exchanges, m, newQueryOptions(&p.boot.options), tr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { reply, err = finish(reply, err) }()
+
+	reply, err = p.exchangeDNSCrypt(m, tr)
 
 	if os.IsTimeout(err) || err == io.EOF {
 		// If request times out, it is possible that the server configuration has been changed.
@@ -38,14 +79,15 @@ func (p *dnsCrypt) Exchange(m *dns.Msg) (*dns.Msg, error) {
 		p.Unlock()
 
 		// Retry the request one more time
-		return p.exchangeDNSCrypt(m)
+		tr.reconnect()
+		return p.exchangeDNSCrypt(m, tr)
 	}
 
 	return reply, err
 }
 
 // exchangeDNSCrypt attempts to send the DNS query and returns the response
-func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (*dns.Msg, error) {
+func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
 	var client *dnscrypt.Client
 	var resolverInfo *dnscrypt.ResolverInfo
 
@@ -60,10 +102,14 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (*dns.Msg, error) {
 
 		// Using "udp" for DNSCrypt upstreams by default
 		client = &dnscrypt.Client{Timeout: p.boot.options.Timeout}
-		ri, err := client.Dial(p.boot.address)
+		ri, err := p.dial(client)
 
 		if err != nil {
 			p.Unlock()
+			if _, ok := err.(*RelayError); ok {
+				// Keep relay errors distinguishable from the server ones
+				return nil, err
+			}
 			return nil, errorx.Decorate(err, "failed to fetch certificate info from %s", p.Address())
 		}
 
@@ -81,12 +127,20 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (*dns.Msg, error) {
 		p.Unlock()
 	}
 
-	reply, err := client.Exchange(m, resolverInfo)
+	transport := p.transport
+	if transport == nil {
+		// The messages are encrypted here rather than by dnscrypt.Client
+		// to know their sizes
+		transport = &dnsCryptDialer{
+			dialContext: (&net.Dialer{}).DialContext,
+			timeout:     p.boot.options.Timeout,
+		}
+	}
 
-	if reply != nil && reply.Truncated {
+	reply, err := transport.exchange("udp", m, resolverInfo, tr)
+	if reply != nil && reply.Truncated && !p.boot.options.DisableTCPFallback {
 		log.Tracef("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
-		tcpClient := dnscrypt.Client{Timeout: p.boot.options.Timeout, Net: "tcp"}
-		reply, err = tcpClient.Exchange(m, resolverInfo)
+		reply, err = transport.exchange("tcp", m, resolverInfo, tr)
 	}
 
 	if err == nil && reply != nil && reply.Id != m.Id {
@@ -95,3 +149,90 @@ func (p *dnsCrypt) exchangeDNSCrypt(m *dns.Msg) (*dns.Msg, error) {
 
 	return reply, err
 }
+
+// dial fetches the server certificate either directly or through the transport
+func (p *dnsCrypt) dial(client *dnscrypt.Client) (*dnscrypt.ResolverInfo, error) {
+	if p.transport == nil {
+		return client.Dial(p.boot.address)
+	}
+
+	stamp, err := dnsstamps.NewServerStampFromString(p.boot.address)
+	if err != nil {
+		return nil, err
+	}
+	return p.transport.dial(stamp)
+}
+
+// dnsCryptTransport sends the DNSCrypt queries in place of dnscrypt.Client,
+// it's also used to fetch the certificate when the queries can't be sent to
+// the server directly
+type dnsCryptTransport interface {
+	// dial fetches the server certificate and returns the resolver info
+	dial(stamp dnsstamps.ServerStamp) (*dnscrypt.ResolverInfo, error)
+	// exchange sends the query to the server over network, "udp" or "tcp",
+	// and records the details to tr
+	exchange(network string, m *dns.Msg, ri *dnscrypt.ResolverInfo, tr *exchangeTrace) (*dns.Msg, error)
+}
+
+// newDNSCryptTransport returns the transport for Options.DNSCryptRelay,
+// Options.ProxyURL and Options.DialContext or nil if none of them is set.  The
+// proxy only carries TCP, so all the queries are sent over TCP then.
+func newDNSCryptTransport(opts Options) (dnsCryptTransport, error) {
+	var relay *dnsCryptRelay
+	if opts.DNSCryptRelay != "" {
+		var err error
+		relay, err = newDNSCryptRelay(opts.DNSCryptRelay, opts.Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dialed := opts.ProxyURL != "" || opts.DialContext != nil
+	switch {
+	case !dialed && relay == nil:
+		return nil, nil
+	case !dialed:
+		return relay, nil
+	case relay != nil:
+		relay.dialContext = newDialHandler(opts)
+		relay.tcpOnly = opts.ProxyURL != ""
+		return relay, nil
+	default:
+		return &dnsCryptDialer{
+			dialContext: newDialHandler(opts),
+			timeout:     opts.Timeout,
+			tcpOnly:     opts.ProxyURL != "",
+		}, nil
+	}
+}
+
+// dnsCryptDialer sends the DNSCrypt queries to the server over the connections
+// created by Options.DialContext or through Options.ProxyURL
+type dnsCryptDialer struct {
+	dialContext dialHandler   // connects to the server
+	timeout     time.Duration // I/O timeout
+	tcpOnly     bool          // all the queries are sent over TCP, since the proxy only carries TCP
+}
+
+// roundTrip sends the packet to the DNSCrypt server and returns the server's
+// response
+func (d *dnsCryptDialer) roundTrip(network, serverAddr string, packet []byte) ([]byte, error) {
+	if d.tcpOnly {
+		network = "tcp"
+	}
+	conn, err := dialWithTimeout(d.dialContext, network, serverAddr, d.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return exchangePacket(conn, network, packet, d.timeout)
+}
+
+func (d *dnsCryptDialer) exchange(network string, m *dns.Msg, ri *dnscrypt.ResolverInfo, tr *exchangeTrace) (*dns.Msg, error) {
+	return dnsCryptExchange(d.roundTrip, network, m, ri, tr)
+}
+
+func (d *dnsCryptDialer) dial(stamp dnsstamps.ServerStamp) (*dnscrypt.ResolverInfo, error) {
+	return dnsCryptDial(d.roundTrip, stamp)
+}
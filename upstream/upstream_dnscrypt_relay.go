@@ -0,0 +1,415 @@
+package upstream
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnscrypt/v2/xsecretbox"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Anonymized DNSCrypt, see https://github.com/DNSCrypt/dnscrypt-protocol/blob/master/ANONYMIZED-DNSCRYPT.txt
+//
+// The client sends the encrypted query to the relay prefixed with the relay
+// header: <anon-magic> <server-ip> <server-port>.  The relay forwards the
+// query to the server and passes the response back as is.
+
+// relayMagic is <anon-magic> that starts every query sent to a relay
+var relayMagic = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+
+// relayStampProto is the protocol identifier of a DNSCrypt relay stamp
+const relayStampProto = 0x81
+
+// defaultRelayPort is used when the relay address has no port
+const defaultRelayPort = "443"
+
+// RelayError is returned when the query couldn't be passed to the DNSCrypt
+// server through the relay, or the response couldn't be received from it.
+// Errors that aren't RelayError come from the DNSCrypt server itself.
+type RelayError struct {
+	Relay string // relay address
+	Err   error  // the underlying network error
+}
+
+func (e *RelayError) Error() string {
+	return fmt.Sprintf("dnscrypt relay %s: %s", e.Relay, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *RelayError) Unwrap() error { return e.Err }
+
+// Timeout returns true if the relay didn't respond in time.  Note that it also
+// happens when the relay is fine but the server behind it doesn't respond.
+func (e *RelayError) Timeout() bool {
+	var ne net.Error
+	return errors.As(e.Err, &ne) && ne.Timeout()
+}
+
+// dnsCryptRelay sends DNSCrypt queries through an Anonymized DNSCrypt relay
+type dnsCryptRelay struct {
+	address     string        // relay address (ip:port)
+	timeout     time.Duration // I/O timeout
+	dialContext dialHandler   // connects to the relay
+	tcpOnly     bool          // if true, TCP is used even for the UDP queries, e.g. through a proxy
+}
+
+// newDNSCryptRelay parses the relay address which is either an sdns:// relay
+// stamp or an IP address with an optional port
+func newDNSCryptRelay(relay string, timeout time.Duration) (*dnsCryptRelay, error) {
+	addr := relay
+	if strings.HasPrefix(relay, "sdns://") {
+		var err error
+		addr, err = parseRelayStamp(relay)
+		if err != nil {
+			return nil, errorx.Decorate(err, "failed to parse relay stamp %s", relay)
+		}
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.Trim(addr, "[]")
+		port = defaultRelayPort
+	}
+
+	// Relays are specified by IP addresses just like DNSCrypt servers so that
+	// using them doesn't require any plain DNS lookups
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid relay address: %s", relay)
+	}
+
+	return &dnsCryptRelay{
+		address:     net.JoinHostPort(host, port),
+		timeout:     timeout,
+		dialContext: (&net.Dialer{Timeout: timeout}).DialContext,
+	}, nil
+}
+
+// parseRelayStamp returns the address from the DNSCrypt relay stamp:
+// "sdns://" || base64url(0x81 || LP(addr))
+func parseRelayStamp(stamp string) (string, error) {
+	bin, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(stamp, "sdns://"))
+	if err != nil {
+		return "", err
+	}
+
+	if len(bin) < 2 || bin[0] != relayStampProto {
+		return "", errors.New("not a DNSCrypt relay stamp")
+	}
+
+	l := int(bin[1])
+	if len(bin) != 2+l {
+		return "", errors.New("invalid relay address length")
+	}
+
+	return string(bin[2:]), nil
+}
+
+// relayHeader creates the relay header for the DNSCrypt server address
+func relayHeader(serverAddr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("server address must be an IP address: %s", serverAddr)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid server port: %s", serverAddr)
+	}
+
+	header := make([]byte, 0, len(relayMagic)+net.IPv6len+2)
+	header = append(header, relayMagic...)
+	header = append(header, ip.To16()...)
+	header = append(header, byte(port>>8), byte(port))
+	return header, nil
+}
+
+// roundTrip sends the packet to the DNSCrypt server through the relay and
+// returns the server's response.  network is either "udp" or "tcp".
+func (r *dnsCryptRelay) roundTrip(network, serverAddr string, packet []byte) ([]byte, error) {
+	header, err := relayHeader(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.tcpOnly {
+		network = "tcp"
+	}
+	conn, err := dialWithTimeout(r.dialContext, network, r.address, r.timeout)
+	if err != nil {
+		return nil, &RelayError{Relay: r.address, Err: err}
+	}
+	defer conn.Close()
+
+	response, err := exchangePacket(conn, network, append(header, packet...), r.timeout)
+	if err != nil {
+		return nil, &RelayError{Relay: r.address, Err: err}
+	}
+	return response, nil
+}
+
+// exchange encrypts the query, sends it to the DNSCrypt server through the
+// relay and decrypts the response
+func (r *dnsCryptRelay) exchange(network string, m *dns.Msg, ri *dnscrypt.ResolverInfo, tr *exchangeTrace) (*dns.Msg, error) {
+	return dnsCryptExchange(r.roundTrip, network, m, ri, tr)
+}
+
+// dial fetches the DNSCrypt server certificate through the relay and returns
+// the resolver info that can be used to encrypt queries to this server
+func (r *dnsCryptRelay) dial(stamp dnsstamps.ServerStamp) (*dnscrypt.ResolverInfo, error) {
+	return dnsCryptDial(r.roundTrip, stamp)
+}
+
+// dnsCryptRoundTrip sends the packet to the DNSCrypt server and returns the
+// server's response.  network is either "udp" or "tcp".
+type dnsCryptRoundTrip func(network, serverAddr string, packet []byte) ([]byte, error)
+
+// dialWithTimeout connects to the address with dial, the timeout of 0 means no
+// timeout
+func dialWithTimeout(dial dialHandler, network, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return dial(ctx, network, addr)
+}
+
+// exchangePacket writes the packet to the connection and reads the response,
+// over TCP both are prefixed with the length
+func exchangePacket(conn net.Conn, network string, query []byte, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if network == "tcp" {
+		l := make([]byte, 2)
+		binary.BigEndian.PutUint16(l, uint16(len(query)))
+		query = append(l, query...)
+	}
+
+	_, err := conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var response []byte
+	if network == "tcp" {
+		l := make([]byte, 2)
+		_, err = io.ReadFull(conn, l)
+		if err == nil {
+			response = make([]byte, binary.BigEndian.Uint16(l))
+			_, err = io.ReadFull(conn, response)
+		}
+	} else {
+		response = make([]byte, dns.MaxMsgSize)
+		var n int
+		n, err = conn.Read(response)
+		response = response[:n]
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// dnsCryptExchange encrypts the query, sends it to the DNSCrypt server with
+// roundTrip and decrypts the response.  The sizes recorded to tr are the ones
+// of the messages before the encryption.
+func dnsCryptExchange(roundTrip dnsCryptRoundTrip, network string, m *dns.Msg, ri *dnscrypt.ResolverInfo, tr *exchangeTrace) (*dns.Msg, error) {
+	start := time.Now()
+	packet, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	q := dnscrypt.EncryptedQuery{
+		EsVersion:   ri.ResolverCert.EsVersion,
+		ClientMagic: ri.ResolverCert.ClientMagic,
+		ClientPk:    ri.PublicKey,
+	}
+	query, err := q.Encrypt(packet, ri.SharedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := roundTrip(network, ri.ServerAddress, query)
+	if err != nil {
+		return nil, err
+	}
+
+	dr := dnscrypt.EncryptedResponse{EsVersion: ri.ResolverCert.EsVersion}
+	response, err := dr.Decrypt(b, ri.SharedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := new(dns.Msg)
+	err = reply.Unpack(response)
+	if err != nil {
+		return nil, err
+	}
+	tr.measured("dnscrypt", ri.ServerAddress, time.Since(start), len(packet), len(response))
+	return reply, nil
+}
+
+// dnsCryptDial fetches the DNSCrypt server certificate with roundTrip and
+// returns the resolver info that can be used to encrypt queries to this server
+func dnsCryptDial(roundTrip dnsCryptRoundTrip, stamp dnsstamps.ServerStamp) (*dnscrypt.ResolverInfo, error) {
+	cert, err := dnsCryptFetchCert(roundTrip, stamp)
+	if err != nil {
+		return nil, err
+	}
+
+	ri := &dnscrypt.ResolverInfo{
+		ServerPublicKey: stamp.ServerPk,
+		ServerAddress:   stamp.ServerAddrStr,
+		ProviderName:    stamp.ProviderName,
+		ResolverCert:    cert,
+	}
+
+	// Generate the secret/public pair
+	_, _ = rand.Read(ri.SecretKey[:])
+	curve25519.ScalarBaseMult(&ri.PublicKey, &ri.SecretKey)
+
+	// Compute shared key that we'll use to encrypt/decrypt messages
+	switch cert.EsVersion {
+	case dnscrypt.XChacha20Poly1305:
+		ri.SharedKey, err = xsecretbox.SharedKey(ri.SecretKey, cert.ResolverPk)
+		if err != nil {
+			return nil, err
+		}
+	case dnscrypt.XSalsa20Poly1305:
+		box.Precompute(&ri.SharedKey, &cert.ResolverPk, &ri.SecretKey)
+	default:
+		return nil, dnscrypt.ErrEsVersion
+	}
+
+	return ri, nil
+}
+
+// dnsCryptFetchCert requests the DNSCrypt server certificates with roundTrip
+// and returns the valid one with the highest serial
+func dnsCryptFetchCert(roundTrip dnsCryptRoundTrip, stamp dnsstamps.ServerStamp) (*dnscrypt.Cert, error) {
+	providerName := dns.Fqdn(stamp.ProviderName)
+
+	req := new(dns.Msg)
+	req.SetQuestion(providerName, dns.TypeTXT)
+	packet, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := roundTrip("udp", stamp.ServerAddrStr, packet)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := new(dns.Msg)
+	err = reply.Unpack(b)
+	if err != nil {
+		return nil, err
+	}
+	err = VerifyResponse(req, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return nil, dnscrypt.ErrFailedToFetchCert
+	}
+
+	var current *dnscrypt.Cert
+	certErr := dnscrypt.ErrFailedToFetchCert
+	for _, rr := range reply.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		cert := &dnscrypt.Cert{}
+		err = cert.Deserialize(unpackTxtString(strings.Join(txt.Txt, "")))
+		if err != nil {
+			log.Debug("[%s] failed to deserialize cert: %v", providerName, err)
+			certErr = err
+			continue
+		}
+
+		if !cert.VerifyDate() {
+			certErr = dnscrypt.ErrInvalidDate
+			continue
+		}
+
+		if !cert.VerifySignature(stamp.ServerPk) {
+			certErr = dnscrypt.ErrInvalidCertSignature
+			continue
+		}
+
+		// Prefer the higher serial, and then the better crypto construction
+		if current != nil && (cert.Serial < current.Serial ||
+			cert.Serial == current.Serial && cert.EsVersion <= current.EsVersion) {
+			continue
+		}
+
+		current = cert
+	}
+
+	if current == nil {
+		return nil, certErr
+	}
+
+	return current, nil
+}
+
+// unpackTxtString unescapes the TXT record string the way miekg/dns escapes it
+func unpackTxtString(s string) []byte {
+	isDigit := func(b byte) bool { return b >= '0' && b <= '9' }
+
+	msg := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			msg = append(msg, s[i])
+			continue
+		}
+
+		i++
+		if i == len(s) {
+			break
+		}
+
+		switch {
+		case i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]):
+			msg = append(msg, (s[i]-'0')*100+(s[i+1]-'0')*10+(s[i+2]-'0'))
+			i += 2
+		case s[i] == 't':
+			msg = append(msg, '\t')
+		case s[i] == 'r':
+			msg = append(msg, '\r')
+		case s[i] == 'n':
+			msg = append(msg, '\n')
+		default:
+			msg = append(msg, s[i])
+		}
+	}
+	return msg
+}
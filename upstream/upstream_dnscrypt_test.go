@@ -1,15 +1,25 @@
 package upstream
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
 	"github.com/ameshkov/dnscrypt/v2"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestUpstreamDNSCrypt(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	// AdGuard DNS (DNSCrypt)
 	address := "sdns://AQIAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20"
 	u, err := AddressToUpstream(address, Options{Timeout: dialTimeout})
@@ -66,6 +76,126 @@ func TestDNSCryptTruncated(t *testing.T) {
 	assert.False(t, res.Truncated)
 }
 
+func TestDNSCryptTCPFallback(t *testing.T) {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	assert.Nil(t, err)
+	cert, err := rc.CreateCert()
+	assert.Nil(t, err)
+
+	h := &truncatingDNSCryptHandler{}
+	s := &dnscrypt.Server{
+		ProviderName: rc.ProviderName,
+		ResolverCert: cert,
+		Handler:      h,
+	}
+
+	tcpConn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.Nil(t, err)
+	defer tcpConn.Close()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: tcpConn.Addr().(*net.TCPAddr).Port})
+	assert.Nil(t, err)
+	defer udpConn.Close()
+	go s.ServeUDP(udpConn)
+	go s.ServeTCP(tcpConn)
+
+	stamp, err := rc.CreateStamp(udpConn.LocalAddr().String())
+	assert.Nil(t, err)
+
+	// The truncated response is retried over TCP
+	u, err := AddressToUpstream(stamp.String(), Options{Timeout: timeout})
+	assert.Nil(t, err)
+	res, err := u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.False(t, res.Truncated)
+	assert.Len(t, res.Answer, 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&h.udp))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&h.tcp))
+
+	// Unless the fallback is disabled
+	u, err = AddressToUpstream(stamp.String(), Options{Timeout: timeout, DisableTCPFallback: true})
+	assert.Nil(t, err)
+	res, err = u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.True(t, res.Truncated)
+	assert.Len(t, res.Answer, 0)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&h.udp))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&h.tcp))
+}
+
+func TestDNSCryptDialContext(t *testing.T) {
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	assert.Nil(t, err)
+	cert, err := rc.CreateCert()
+	assert.Nil(t, err)
+
+	h := &truncatingDNSCryptHandler{}
+	s := &dnscrypt.Server{
+		ProviderName: rc.ProviderName,
+		ResolverCert: cert,
+		Handler:      h,
+	}
+
+	tcpConn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.Nil(t, err)
+	defer tcpConn.Close()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: tcpConn.Addr().(*net.TCPAddr).Port})
+	assert.Nil(t, err)
+	defer udpConn.Close()
+	go s.ServeUDP(udpConn)
+	go s.ServeTCP(tcpConn)
+
+	// The server is only reachable with the custom dialer
+	stamp, err := rc.CreateStamp("192.0.2.1:443")
+	assert.Nil(t, err)
+	var mu sync.Mutex
+	var dialed []string
+	u, err := AddressToUpstream(stamp.String(), Options{
+		Timeout: timeout,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, network+" "+addr)
+			mu.Unlock()
+			return (&net.Dialer{}).DialContext(ctx, network, udpConn.LocalAddr().String())
+		},
+	})
+	assert.Nil(t, err)
+
+	res, err := u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.Len(t, res.Answer, 1)
+
+	// The certificate request, the truncated UDP query and the TCP one
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"udp 192.0.2.1:443", "udp 192.0.2.1:443", "tcp 192.0.2.1:443"}, dialed)
+}
+
+// truncatingDNSCryptHandler sets TC over UDP and answers over TCP
+type truncatingDNSCryptHandler struct {
+	udp int32 // number of the queries over UDP, accessed atomically
+	tcp int32 // number of the queries over TCP, accessed atomically
+}
+
+// ServeDNS - implements Handler interface
+func (h *truncatingDNSCryptHandler) ServeDNS(rw dnscrypt.ResponseWriter, r *dns.Msg) error {
+	res := new(dns.Msg).SetReply(r)
+	if _, ok := rw.RemoteAddr().(*net.UDPAddr); ok {
+		atomic.AddInt32(&h.udp, 1)
+		res.Truncated = true
+		return rw.WriteMsg(res)
+	}
+
+	atomic.AddInt32(&h.tcp, 1)
+	res.Answer = []dns.RR{newTestRR("%s 60 IN A 192.0.2.1", r.Question[0].Name)}
+	return rw.WriteMsg(res)
+}
+
 type testDNSCryptHandler struct{}
 
 // ServeDNS - implements Handler interface
@@ -88,3 +218,193 @@ func (h *testDNSCryptHandler) ServeDNS(rw dnscrypt.ResponseWriter, r *dns.Msg) e
 	res.Answer = append(res.Answer, answer)
 	return rw.WriteMsg(res)
 }
+
+func TestDNSCryptRelay(t *testing.T) {
+	// Prepare the test DNSCrypt server config
+	rc, err := dnscrypt.GenerateResolverConfig("example.org", nil)
+	assert.Nil(t, err)
+
+	cert, err := rc.CreateCert()
+	assert.Nil(t, err)
+
+	s := &dnscrypt.Server{
+		ProviderName: rc.ProviderName,
+		ResolverCert: cert,
+		Handler:      &testDNSCryptHandler{},
+	}
+
+	// Prepare TCP and UDP listeners on the same port
+	tcpConn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.Nil(t, err)
+	defer tcpConn.Close()
+
+	port := tcpConn.Addr().(*net.TCPAddr).Port
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	assert.Nil(t, err)
+	defer udpConn.Close()
+
+	go s.ServeUDP(udpConn)
+	go s.ServeTCP(tcpConn)
+
+	relayAddr, relayed, closeRelay := startTestRelay(t)
+	defer closeRelay()
+
+	stamp, err := rc.CreateStamp(udpConn.LocalAddr().String())
+	assert.Nil(t, err)
+	u, err := AddressToUpstream(stamp.String(), Options{Timeout: timeout, DNSCryptRelay: relayAddr})
+	assert.Nil(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion("unit-test2.dns.adguard.com.", dns.TypeTXT)
+	req.RecursionDesired = true
+
+	// The response is truncated over UDP, so the query is retried over TCP
+	res, err := u.Exchange(req)
+	assert.Nil(t, err)
+	assert.False(t, res.Truncated)
+	assert.Equal(t, req.Id, res.Id)
+
+	// The certificate request, the UDP query and the TCP query
+	assert.Equal(t, int32(3), atomic.LoadInt32(relayed))
+}
+
+func TestDNSCryptRelayError(t *testing.T) {
+	// AdGuard DNS (DNSCrypt), must not be contacted directly
+	address := "sdns://AQIAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20"
+
+	// Nobody listens on this port
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.Nil(t, err)
+	relayAddr := conn.LocalAddr().String()
+	_ = conn.Close()
+
+	u, err := AddressToUpstream(address, Options{Timeout: time.Second, DNSCryptRelay: relayAddr})
+	assert.Nil(t, err)
+
+	_, err = u.Exchange(createTestMessage())
+	relayErr, ok := err.(*RelayError)
+	if !ok {
+		t.Fatalf("expected *RelayError, got %v", err)
+	}
+	assert.Equal(t, relayAddr, relayErr.Relay)
+
+	// Invalid relays are rejected right away
+	_, err = AddressToUpstream(address, Options{DNSCryptRelay: "relay.example.org:443"})
+	assert.NotNil(t, err)
+}
+
+func TestParseRelayAddress(t *testing.T) {
+	// Anonymized DNS relay stamp of 51.158.166.97:443
+	r, err := newDNSCryptRelay("sdns://gRE1MS4xNTguMTY2Ljk3OjQ0Mw", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "51.158.166.97:443", r.address)
+
+	r, err = newDNSCryptRelay("1.2.3.4", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3.4:443", r.address)
+
+	r, err = newDNSCryptRelay("[::1]:5443", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "[::1]:5443", r.address)
+
+	header, err := relayHeader("1.2.3.4:5443")
+	assert.Nil(t, err)
+	assert.Equal(t, relayMagic, header[:len(relayMagic)])
+	assert.Equal(t, net.ParseIP("1.2.3.4").To16(), net.IP(header[len(relayMagic):len(relayMagic)+16]))
+	assert.Equal(t, uint16(5443), binary.BigEndian.Uint16(header[len(header)-2:]))
+}
+
+// startTestRelay starts a minimal Anonymized DNSCrypt relay on UDP and TCP.
+// It returns the relay address, the counter of relayed queries and the
+// function that stops the relay.
+func startTestRelay(t *testing.T) (string, *int32, func()) {
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	assert.Nil(t, err)
+
+	port := tcpListener.Addr().(*net.TCPAddr).Port
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	assert.Nil(t, err)
+
+	relayed := new(int32)
+
+	// parse strips the relay header and returns the server address
+	parse := func(b []byte) (string, []byte, bool) {
+		headerLen := len(relayMagic) + net.IPv6len + 2
+		if len(b) < headerLen || !bytes.Equal(b[:len(relayMagic)], relayMagic) {
+			return "", nil, false
+		}
+		ip := net.IP(b[len(relayMagic) : len(relayMagic)+net.IPv6len])
+		port := binary.BigEndian.Uint16(b[headerLen-2:])
+		atomic.AddInt32(relayed, 1)
+		return (&net.TCPAddr{IP: ip, Port: int(port)}).String(), b[headerLen:], true
+	}
+
+	go func() {
+		b := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := udpConn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			server, query, ok := parse(b[:n])
+			if !ok {
+				continue
+			}
+
+			conn, err := net.Dial("udp", server)
+			if err != nil {
+				continue
+			}
+			_ = conn.SetDeadline(time.Now().Add(timeout))
+			_, _ = conn.Write(query)
+			resp := make([]byte, dns.MaxMsgSize)
+			n, err = conn.Read(resp)
+			_ = conn.Close()
+			if err == nil {
+				_, _ = udpConn.WriteToUDP(resp[:n], addr)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			client, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer client.Close()
+
+				l := make([]byte, 2)
+				if _, err := io.ReadFull(client, l); err != nil {
+					return
+				}
+				b := make([]byte, binary.BigEndian.Uint16(l))
+				if _, err := io.ReadFull(client, b); err != nil {
+					return
+				}
+				server, query, ok := parse(b)
+				if !ok {
+					return
+				}
+
+				conn, err := net.Dial("tcp", server)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				// Both the query and the response are prefixed with the length
+				binary.BigEndian.PutUint16(l, uint16(len(query)))
+				_, _ = conn.Write(append(l, query...))
+				_, _ = io.Copy(client, conn)
+			}()
+		}
+	}()
+
+	return udpConn.LocalAddr().String(), relayed, func() {
+		_ = tcpListener.Close()
+		_ = udpConn.Close()
+	}
+}
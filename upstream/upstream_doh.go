@@ -1,13 +1,20 @@
 package upstream
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 	"golang.org/x/net/http2"
@@ -16,6 +23,13 @@ import (
 // DoHMaxConnsPerHost controls the maximum number of connections per host.
 const DoHMaxConnsPerHost = 1
 
+// defaultDoHRefreshInterval is the default Options.DoHRefreshInterval
+const defaultDoHRefreshInterval = 10 * time.Minute
+
+// dohRefreshFailures is the number of failed connections in a row after which
+// the server's addresses are refreshed without waiting for the interval
+const dohRefreshFailures = 3
+
 // dnsOverHTTPS represents DNS-over-HTTPS upstream.
 type dnsOverHTTPS struct {
 	boot *bootstrapper
@@ -30,29 +44,229 @@ type dnsOverHTTPS struct {
 	// connections), so Clients should be reused instead of created as
 	// needed. Clients are safe for concurrent use by multiple goroutines.
 	client *http.Client
+
+	refreshAt  time.Time // when the server's addresses are refreshed next time, protected by mu
+	refreshing bool      // true while the addresses are being refreshed, protected by mu
+	failures   int       // the number of failed connections in a row, protected by mu
+	closed     bool      // true if the upstream is closed, protected by mu
+
+	// stamp is not nil if the upstream was created from a DNS stamp
+	stamp *StampInfo
+
+	// fallbacks are tried in order if this endpoint can't be reached
+	fallbacks []*dnsOverHTTPS
+
+	// tlsState is the state of the TLS connection of the last response
+	tlsState lastTLSState
+
+	// exchanges are the Exchange calls in progress
+	exchanges exchangeTracker
+
+	// preConnected keeps the connection established with Options.PreConnect
+	// until it's used, protected by mu
+	preConnected *preConnectedDialer
 }
 
 func (p *dnsOverHTTPS) Address() string { return p.boot.address }
 
+// Properties returns the information from the DNS stamp the upstream was created
+// from, or nil if it wasn't created from a stamp
+func (p *dnsOverHTTPS) Properties() *StampInfo { return p.stamp }
+
+// WithOptions implements the Cloner interface for *dnsOverHTTPS
+func (p *dnsOverHTTPS) WithOptions(opts *Options) (Upstream, error) {
+	return cloneUpstream(p.Address(), p.boot, p.stamp, opts)
+}
+
+// TLSState returns the state of the TLS connection the last response was
+// received over, or nil if there were no responses yet.  If a fallback
+// answered instead, its TLSState has the connection state.
+func (p *dnsOverHTTPS) TLSState() *TLSState { return p.tlsState.get() }
+
 func (p *dnsOverHTTPS) Exchange(m *dns.Msg) (*dns.Msg, error) {
-	client, err := p.getClient()
+	return followCNAME(p.boot.options.FollowCNAME, p.exchangeTraced)(m, nil)
+}
+
+// ExchangeWithInfo implements the InfoExchanger interface for *dnsOverHTTPS
+func (p *dnsOverHTTPS) ExchangeWithInfo(m *dns.Msg) (*dns.Msg, *ExchangeInfo, error) {
+	return traceExchange(m, followCNAME(p.boot.options.FollowCNAME, p.exchangeTraced))
+}
+
+// exchangeTraced sends the query and records the details to tr
+func (p *dnsOverHTTPS) exchangeTraced(m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
+	return p.exchangeContext(context.Background(), m, tr)
+}
+
+// exchangeContext implements the contextExchanger interface for *dnsOverHTTPS
+func (p *dnsOverHTTPS) exchangeContext(ctx context.Context, m *dns.Msg, tr *exchangeTrace) (reply *dns.Msg, err error) {
+	m, finish, err := prepareQuery(&p.exchanges, m, newQueryOptions(&p.boot.options), tr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { reply, err = finish(reply, err) }()
+	req, addedOPT := padMsg(m, p.boot.options.Padding)
+
+	// The fallbacks must fit into the same timeout
+	if p.boot.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.boot.options.Timeout)
+		defer cancel()
+	}
+
+	r, connected, err := p.exchange(ctx, req, tr)
+	for _, f := range p.fallbacks {
+		if connected || ctx.Err() != nil {
+			break
+		}
+
+		log.Tracef("Failed to connect to %s, trying %s: %s", p.Address(), f.Address(), err)
+		tr.reconnect()
+		r, connected, err = f.exchange(ctx, req, tr)
+	}
+
+	if err == nil && p.boot.options.Padding > 0 {
+		unpadMsg(r, addedOPT)
+	}
+	return r, err
+}
+
+// Close implements the Closer interface for *dnsOverHTTPS
+func (p *dnsOverHTTPS) Close() error { return p.exchanges.close(p.release) }
+
+// Shutdown implements the Closer interface for *dnsOverHTTPS
+func (p *dnsOverHTTPS) Shutdown(ctx context.Context) error {
+	return p.exchanges.shutdown(ctx, p.release)
+}
+
+// release closes the idle connections of this endpoint and the fallbacks.
+// The fallbacks are only used by this upstream, so they're done too.
+func (p *dnsOverHTTPS) release() error {
+	p.mu.Lock()
+	p.closed = true
+	if p.client != nil {
+		p.client.CloseIdleConnections()
+	}
+	if p.preConnected != nil {
+		p.preConnected.close()
+	}
+	p.mu.Unlock()
+
+	for _, f := range p.fallbacks {
+		_ = f.Close()
+	}
+	return nil
+}
+
+// exchange sends the query to this DoH endpoint only.  connected is false if
+// the endpoint couldn't be reached at all, so it makes sense to try another one.
+func (p *dnsOverHTTPS) exchange(ctx context.Context, m *dns.Msg, tr *exchangeTrace) (r *dns.Msg, connected bool, err error) {
+	client, err := p.getClient(ctx)
 	if err != nil {
-		return nil, errorx.Decorate(err, "couldn't initialize HTTP client or transport")
+		return nil, false, errorx.Decorate(err, "couldn't initialize HTTP client or transport")
 	}
 
 	logBegin(p.Address(), m)
-	r, err := p.exchangeHTTPSClient(m, client)
+	r, connected, err = p.exchangeHTTPSClient(ctx, m, client, tr)
 	logFinish(p.Address(), err)
 
-	return r, err
+	p.mu.Lock()
+	if connected {
+		p.failures = 0
+	} else {
+		p.failures++
+	}
+	p.mu.Unlock()
+
+	return r, connected, err
+}
+
+// preConnect bootstraps the server and makes the TLS handshake, so that the
+// first query doesn't wait for them.  No request is sent, the connection is
+// given to the HTTP transport when it dials the server for the first time.
+// The plain HTTP upstreams are only bootstrapped.
+func (p *dnsOverHTTPS) preConnect() error {
+	ctx := context.Background()
+	if p.boot.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.boot.options.Timeout)
+		defer cancel()
+	}
+
+	client, err := p.getClient(ctx)
+	if err != nil {
+		return errorx.Decorate(err, "couldn't initialize HTTP client or transport")
+	}
+	if strings.HasPrefix(p.boot.address, "http://") {
+		return nil
+	}
+
+	// The config has the ALPN protocols set up by http2.ConfigureTransports
+	transport := client.Transport.(*http.Transport)
+	conn, err := tlsDial(ctx, transport.DialContext, "tcp", transport.TLSClientConfig.Clone())
+	if err != nil {
+		return errorx.Decorate(err, "couldn't connect to %s", p.boot.address)
+	}
+	// The deadline only covers the handshake
+	_ = conn.SetDeadline(time.Time{})
+
+	d := &preConnectedDialer{
+		conn:        conn,
+		dialContext: transport.DialContext,
+		tlsConfig:   transport.TLSClientConfig,
+	}
+	transport.DialTLSContext = d.dialTLSContext
+
+	p.mu.Lock()
+	p.preConnected = d
+	p.mu.Unlock()
+	return nil
+}
+
+// preConnectedDialer is the http.Transport's DialTLSContext that returns the
+// connection established by preConnect first and dials the new ones after it
+type preConnectedDialer struct {
+	conn        net.Conn // established by preConnect, nil once it's taken
+	dialContext dialHandler
+	tlsConfig   *tls.Config
+
+	mu sync.Mutex // protects conn
+}
+
+// dialTLSContext returns the pre-established connection if it's not taken yet
+// or dials a new one
+func (d *preConnectedDialer) dialTLSContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	d.mu.Lock()
+	conn := d.conn
+	d.conn = nil
+	d.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	tlsConn, err := tlsDial(ctx, d.dialContext, network, d.tlsConfig.Clone())
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, tlsConn.SetDeadline(time.Time{})
+}
+
+// close closes the pre-established connection if it hasn't been taken
+func (d *preConnectedDialer) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil {
+		_ = d.conn.Close()
+		d.conn = nil
+	}
 }
 
 // exchangeHTTPSClient sends the DNS query to a DOH resolver using the specified
-// http.Client instance.
-func (p *dnsOverHTTPS) exchangeHTTPSClient(m *dns.Msg, client *http.Client) (*dns.Msg, error) {
+// http.Client instance.  connected is true if the HTTP response was received.
+func (p *dnsOverHTTPS) exchangeHTTPSClient(ctx context.Context, m *dns.Msg, client *http.Client, tr *exchangeTrace) (*dns.Msg, bool, error) {
 	buf, err := m.Pack()
 	if err != nil {
-		return nil, errorx.Decorate(err, "couldn't pack request msg")
+		return nil, true, errorx.Decorate(err, "couldn't pack request msg")
 	}
 
 	// It appears, that GET requests are more memory-efficient with Golang
@@ -60,8 +274,9 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(m *dns.Msg, client *http.Client) (*dn
 	requestURL := p.boot.address + "?dns=" + base64.RawURLEncoding.EncodeToString(buf)
 	req, err := http.NewRequest("GET", requestURL, nil)
 	if err != nil {
-		return nil, errorx.Decorate(err, "couldn't create a HTTP request to %s", p.boot.address)
+		return nil, true, errorx.Decorate(err, "couldn't create a HTTP request to %s", p.boot.address)
 	}
+	req = req.WithContext(withClientTrace(ctx, tr, len(buf)))
 	req.Header.Set("Accept", "application/dns-message")
 
 	resp, err := client.Do(req)
@@ -69,37 +284,120 @@ func (p *dnsOverHTTPS) exchangeHTTPSClient(m *dns.Msg, client *http.Client) (*dn
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return nil, errorx.Decorate(err, "couldn't do a GET request to '%s'", p.boot.address)
+		return nil, false, errorx.Decorate(err, "couldn't do a GET request to '%s'", p.boot.address)
+	}
+	if resp.TLS != nil {
+		p.tlsState.set(*resp.TLS)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	// Don't read more than needed to find out the response is too large
+	var bodyReader io.Reader = resp.Body
+	maxSize := p.boot.options.MaxResponseSize
+	if maxSize > 0 {
+		bodyReader = io.LimitReader(resp.Body, int64(maxSize)+1)
+	}
+	body, err := ioutil.ReadAll(bodyReader)
 	if err != nil {
-		return nil, errorx.Decorate(err, "couldn't read body contents for '%s'", p.boot.address)
+		return nil, true, errorx.Decorate(err, "couldn't read body contents for '%s'", p.boot.address)
+	}
+	tr.readResponse(time.Time{}, len(body))
+	if maxSize > 0 && len(body) > maxSize {
+		return nil, true, &ResponseTooLargeError{Size: len(body), MaxSize: maxSize}
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("got an unexpected HTTP status code %d from '%s'", resp.StatusCode, p.boot.address)
+		return nil, true, fmt.Errorf("got an unexpected HTTP status code %d from '%s'", resp.StatusCode, p.boot.address)
 	}
 	response := dns.Msg{}
 	err = response.Unpack(body)
 	if err != nil {
-		return nil, errorx.Decorate(err, "couldn't unpack DNS response from '%s': body is %s", p.boot.address, string(body))
+		return nil, true, errorx.Decorate(err, "couldn't unpack DNS response from '%s': body is %s", p.boot.address, string(body))
+	}
+	err = VerifyResponse(m, &response)
+	if err != nil {
+		return nil, true, err
 	}
-	if err == nil && response.Id != m.Id {
-		err = dns.ErrId
+	return &response, true, nil
+}
+
+// withClientTrace returns the context with the hooks that record the time the
+// request of size bytes was written and the address of the connection to tr.
+// ctx is returned as is if tr is nil.
+func withClientTrace(ctx context.Context, tr *exchangeTrace, size int) context.Context {
+	if tr == nil {
+		return ctx
 	}
-	return &response, err
+
+	var addr net.Addr
+	var mu sync.Mutex
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			addr = info.Conn.RemoteAddr()
+			mu.Unlock()
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err != nil {
+				return
+			}
+
+			mu.Lock()
+			a := addr
+			mu.Unlock()
+			tr.wroteQuery("https", a, size)
+		},
+	})
+}
+
+// newDoHFallbacks creates the DoH upstreams for the fallback URLs.  Each of
+// them is bootstrapped separately.  If the upstream has SPKI pins, every
+// fallback must have its own ones in the URL.
+func newDoHFallbacks(urls []string, opts Options) ([]*dnsOverHTTPS, error) {
+	// Fallbacks don't have fallbacks of their own, and they're other servers
+	// with other keys
+	pinned := len(opts.spkiPins) > 0
+	opts.DoHFallbackURLs = nil
+	opts.spkiPins = nil
+
+	var fallbacks []*dnsOverHTTPS
+	for _, u := range urls {
+		if !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("DoH fallback must be an https:// URL: %s", u)
+		}
+
+		f, err := AddressToUpstream(u, opts)
+		if err != nil {
+			return nil, errorx.Decorate(err, "couldn't create DoH fallback %s", u)
+		}
+
+		fallback := f.(*dnsOverHTTPS)
+		if pinned && len(fallback.boot.options.spkiPins) == 0 {
+			// Otherwise the pinned upstream would fail over to the
+			// servers with any key
+			return nil, fmt.Errorf("DoH fallback %s must have SPKI pins since the upstream has them", u)
+		}
+		fallbacks = append(fallbacks, fallback)
+	}
+	return fallbacks, nil
 }
 
 // getClient gets or lazily initializes an HTTP client (and transport) that will
-// be used for this DOH resolver.
-func (p *dnsOverHTTPS) getClient() (c *http.Client, err error) {
+// be used for this DOH resolver.  ctx bounds the bootstrap lookup, if any.
+func (p *dnsOverHTTPS) getClient(ctx context.Context) (c *http.Client, err error) {
 	startTime := time.Now()
 
 	p.mu.Lock()
-	defer p.mu.Unlock()
 	if p.client != nil {
-		return p.client, nil
+		c = p.client
+		refresh := p.startRefresh(startTime)
+		p.mu.Unlock()
+
+		// The query doesn't wait for the lookup, it uses the current client
+		if refresh {
+			go p.refreshClient(c)
+		}
+		return c, nil
 	}
+	defer p.mu.Unlock()
 
 	// Timeout can be exceeded while waiting for the lock
 	// This happens quite often on mobile devices
@@ -108,13 +406,76 @@ func (p *dnsOverHTTPS) getClient() (c *http.Client, err error) {
 		return nil, fmt.Errorf("timeout exceeded: %d ms", int(elapsed/time.Millisecond))
 	}
 
-	p.client, err = p.createClient()
+	p.client, err = p.createClient(ctx)
+	p.refreshAt = time.Now().Add(p.refreshInterval())
 
 	return p.client, err
 }
 
-func (p *dnsOverHTTPS) createClient() (*http.Client, error) {
-	transport, err := p.createTransport()
+// refreshInterval returns Options.DoHRefreshInterval or the default one if it's
+// 0.  It's negative if the refreshing is disabled.
+func (p *dnsOverHTTPS) refreshInterval() time.Duration {
+	if p.boot.options.DoHRefreshInterval == 0 {
+		return defaultDoHRefreshInterval
+	}
+	return p.boot.options.DoHRefreshInterval
+}
+
+// startRefresh checks if the server's addresses should be refreshed, either
+// because the interval has passed or the connections keep failing, and marks
+// the refresh as started.  Only one refresh is done at a time, the other
+// queries keep using the current client meanwhile.  p.mu must be locked.
+func (p *dnsOverHTTPS) startRefresh(now time.Time) bool {
+	if p.refreshing || p.refreshInterval() < 0 {
+		return false
+	}
+	if now.Before(p.refreshAt) && p.failures < dohRefreshFailures {
+		return false
+	}
+
+	p.refreshing = true
+	return true
+}
+
+// refreshClient repeats the bootstrap lookup and, if the server's addresses
+// have changed, replaces old with a new client that dials the new ones.  The
+// queries in progress finish with old, its idle connections are closed.  It's
+// run in the background, the lookup is bounded by Options.Timeout.
+func (p *dnsOverHTTPS) refreshClient(old *http.Client) {
+	ctx := context.Background()
+	if p.boot.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.boot.options.Timeout)
+		defer cancel()
+	}
+
+	var c *http.Client
+	changed, err := p.boot.refresh(ctx)
+	if changed {
+		c, err = p.createClient(ctx)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.refreshing = false
+	p.failures = 0
+	p.refreshAt = time.Now().Add(p.refreshInterval())
+	if err != nil {
+		log.Debug("Failed to refresh the addresses of %s: %s", p.Address(), err)
+		return
+	}
+	if c == nil || p.closed {
+		return
+	}
+
+	log.Debug("Replacing the HTTP client of %s since its addresses have changed", p.Address())
+	p.client = c
+	old.CloseIdleConnections()
+}
+
+func (p *dnsOverHTTPS) createClient(ctx context.Context) (*http.Client, error) {
+	transport, err := p.createTransport(ctx)
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't initialize HTTP transport")
 	}
@@ -125,15 +486,14 @@ func (p *dnsOverHTTPS) createClient() (*http.Client, error) {
 		Jar:       nil,
 	}
 
-	p.client = client
-	return p.client, nil
+	return client, nil
 }
 
 // createTransport initializes an HTTP transport that will be used specifically
 // for this DOH resolver. This HTTP transport ensures that the HTTP requests
 // will be sent exactly to the IP address got from the bootstrap resolver.
-func (p *dnsOverHTTPS) createTransport() (*http.Transport, error) {
-	tlsConfig, dialContext, err := p.boot.get()
+func (p *dnsOverHTTPS) createTransport(ctx context.Context) (*http.Transport, error) {
+	tlsConfig, dialContext, err := p.boot.getContext(ctx)
 	if err != nil {
 		return nil, errorx.Decorate(err, "couldn't bootstrap %s", p.boot.address)
 	}
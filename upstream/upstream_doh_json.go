@@ -0,0 +1,214 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// dohJSONContentType is the content type of the JSON DoH API responses
+const dohJSONContentType = "application/dns-json"
+
+// dnsOverHTTPSJSON is a DNS-over-HTTPS upstream that uses the JSON API of
+// Google and Cloudflare (?name=&type=) instead of the DNS wire format
+type dnsOverHTTPSJSON struct {
+	*dnsOverHTTPS
+
+	address string // the https+json:// address the upstream was created from
+}
+
+// dohJSONResponse is the JSON DoH API response
+type dohJSONResponse struct {
+	Status     int         `json:"Status"`
+	TC         bool        `json:"TC"`
+	RD         bool        `json:"RD"`
+	RA         bool        `json:"RA"`
+	AD         bool        `json:"AD"`
+	CD         bool        `json:"CD"`
+	Answer     []dohJSONRR `json:"Answer"`
+	Authority  []dohJSONRR `json:"Authority"`
+	Additional []dohJSONRR `json:"Additional"`
+}
+
+// dohJSONRR is a resource record in the JSON DoH API response
+type dohJSONRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// newDNSOverHTTPSJSON creates the JSON DoH upstream for the https+json:// URL.
+// The queries are sent to the same URL with the https scheme.  The options
+// that change the query in the wire format can't be used, the JSON API only
+// takes the question and the CD and DO flags.
+func newDNSOverHTTPSJSON(upstreamURL *url.URL, opts Options) (*dnsOverHTTPSJSON, error) {
+	address := upstreamURL.String()
+	switch {
+	case opts.ForceRD != nil:
+		return nil, fmt.Errorf("%s: ForceRD can't be used with the JSON DoH API", address)
+	case len(opts.EDNSOptions) != 0:
+		return nil, fmt.Errorf("%s: EDNSOptions can't be used with the JSON DoH API", address)
+	case opts.Padding > 0:
+		return nil, fmt.Errorf("%s: Padding can't be used with the JSON DoH API", address)
+	}
+
+	httpsURL := *upstreamURL
+	httpsURL.Scheme = "https"
+	b, err := urlToBoot(httpsURL.String(), opts)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't create tls bootstrapper")
+	}
+
+	return &dnsOverHTTPSJSON{dnsOverHTTPS: &dnsOverHTTPS{boot: b}, address: address}, nil
+}
+
+func (p *dnsOverHTTPSJSON) Address() string { return p.address }
+
+// WithOptions implements the Cloner interface for *dnsOverHTTPSJSON
+func (p *dnsOverHTTPSJSON) WithOptions(opts *Options) (Upstream, error) {
+	return cloneUpstream(p.address, p.boot, nil, opts)
+}
+
+func (p *dnsOverHTTPSJSON) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return followCNAME(p.boot.options.FollowCNAME, p.exchangeTraced)(m, nil)
+}
+
+// ExchangeWithInfo implements the InfoExchanger interface for
+// *dnsOverHTTPSJSON
+func (p *dnsOverHTTPSJSON) ExchangeWithInfo(m *dns.Msg) (*dns.Msg, *ExchangeInfo, error) {
+	return traceExchange(m, followCNAME(p.boot.options.FollowCNAME, p.exchangeTraced))
+}
+
+// exchangeTraced sends the query and records the details to tr
+func (p *dnsOverHTTPSJSON) exchangeTraced(m *dns.Msg, tr *exchangeTrace) (reply *dns.Msg, err error) {
+	m, finish, err := prepareQuery(&p.exchanges, m, newQueryOptions(&p.boot.options), tr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { reply, err = finish(reply, err) }()
+
+	ctx := context.Background()
+	if p.boot.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.boot.options.Timeout)
+		defer cancel()
+	}
+
+	client, err := p.getClient(ctx)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't initialize HTTP client or transport")
+	}
+
+	logBegin(p.Address(), m)
+	reply, err = p.exchangeJSON(ctx, m, client, tr)
+	logFinish(p.Address(), err)
+
+	return reply, err
+}
+
+// exchangeJSON sends the question as the JSON API query parameters and
+// converts the JSON response to a DNS message
+func (p *dnsOverHTTPSJSON) exchangeJSON(ctx context.Context, m *dns.Msg, client *http.Client, tr *exchangeTrace) (*dns.Msg, error) {
+	if len(m.Question) != 1 {
+		return nil, fmt.Errorf("JSON DoH API supports exactly one question, got %d", len(m.Question))
+	}
+	q := m.Question[0]
+
+	params := url.Values{}
+	params.Set("name", q.Name)
+	params.Set("type", strconv.Itoa(int(q.Qtype)))
+	if m.CheckingDisabled {
+		params.Set("cd", "1")
+	}
+	if opt := m.IsEdns0(); opt != nil && opt.Do() {
+		params.Set("do", "1")
+	}
+
+	query := params.Encode()
+	requestURL := p.boot.address + "?" + query
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't create a HTTP request to %s", p.boot.address)
+	}
+	req = req.WithContext(withClientTrace(ctx, tr, len(query)))
+	req.Header.Set("Accept", dohJSONContentType)
+
+	resp, err := client.Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't do a GET request to '%s'", p.boot.address)
+	}
+	if resp.TLS != nil {
+		p.tlsState.set(*resp.TLS)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't read body contents for '%s'", p.boot.address)
+	}
+	tr.readResponse(time.Time{}, len(body))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got an unexpected HTTP status code %d from '%s'", resp.StatusCode, p.boot.address)
+	}
+
+	jsonResp := dohJSONResponse{}
+	err = json.Unmarshal(body, &jsonResp)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't parse JSON response from '%s': body is %s", p.boot.address, string(body))
+	}
+
+	return jsonResp.toMsg(m)
+}
+
+// toMsg converts the JSON response to the reply to m
+func (r *dohJSONResponse) toMsg(m *dns.Msg) (*dns.Msg, error) {
+	reply := new(dns.Msg).SetRcode(m, r.Status)
+	reply.Truncated = r.TC
+	reply.RecursionDesired = r.RD
+	reply.RecursionAvailable = r.RA
+	reply.AuthenticatedData = r.AD
+	reply.CheckingDisabled = r.CD
+
+	var err error
+	if reply.Answer, err = dohJSONToRRs(r.Answer); err != nil {
+		return nil, err
+	}
+	if reply.Ns, err = dohJSONToRRs(r.Authority); err != nil {
+		return nil, err
+	}
+	if reply.Extra, err = dohJSONToRRs(r.Additional); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// dohJSONToRRs parses the records of a JSON response section
+func dohJSONToRRs(records []dohJSONRR) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, rec := range records {
+		rrtype, ok := dns.TypeToString[rec.Type]
+		if !ok {
+			rrtype = "TYPE" + strconv.Itoa(int(rec.Type))
+		}
+
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(rec.Name), rec.TTL, rrtype, rec.Data))
+		if err != nil {
+			return nil, errorx.Decorate(err, "couldn't parse record %s %s", rrtype, rec.Data)
+		}
+		if rr != nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, nil
+}
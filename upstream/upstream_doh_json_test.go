@@ -0,0 +1,107 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDoHJSONResponse is the shape of the Google JSON API response
+const testDoHJSONResponse = `{
+  "Status": 0,
+  "TC": false,
+  "RD": true,
+  "RA": true,
+  "AD": true,
+  "CD": false,
+  "Question": [{"name": "google-public-dns-a.google.com.", "type": 1}],
+  "Answer": [
+    {"name": "google-public-dns-a.google.com.", "type": 5, "TTL": 300, "data": "dns.google."},
+    {"name": "dns.google.", "type": 1, "TTL": 299, "data": "8.8.8.8"}
+  ],
+  "Comment": "Response from 216.239.32.10."
+}`
+
+func TestDoHJSON(t *testing.T) {
+	var query http.Header
+	var params map[string][]string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.Header
+		params = r.URL.Query()
+		w.Header().Set("Content-Type", dohJSONContentType)
+		_, _ = w.Write([]byte(testDoHJSONResponse))
+	}))
+	defer srv.Close()
+
+	address := strings.Replace(srv.URL, "https://", "https+json://", 1) + "/resolve"
+	u, err := AddressToUpstream(address, Options{Timeout: timeout, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	assert.Equal(t, address, u.Address())
+
+	req := createHostTestMessage("google-public-dns-a.google.com")
+	res, err := u.Exchange(req)
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+
+	assert.Equal(t, dohJSONContentType, query.Get("Accept"))
+	assert.Equal(t, []string{"google-public-dns-a.google.com."}, params["name"])
+	assert.Equal(t, []string{"1"}, params["type"])
+
+	assert.Equal(t, req.Id, res.Id)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.True(t, res.AuthenticatedData)
+	assert.False(t, res.Truncated)
+	if assert.Len(t, res.Answer, 2) {
+		assert.Equal(t, "dns.google.", res.Answer[0].(*dns.CNAME).Target)
+		a, ok := res.Answer[1].(*dns.A)
+		if assert.True(t, ok) {
+			assert.Equal(t, "8.8.8.8", a.A.String())
+			assert.Equal(t, uint32(299), a.Hdr.Ttl)
+		}
+	}
+	_ = u.(Closer).Close()
+
+	// Status is the response code
+	jsonResp := dohJSONResponse{Status: dns.RcodeNameError, TC: true}
+	res, err = jsonResp.toMsg(req)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	assert.True(t, res.Truncated)
+}
+
+func TestDoHJSONOptions(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", dohJSONContentType)
+		_, _ = w.Write([]byte(testDoHJSONResponse))
+	}))
+	defer srv.Close()
+	address := strings.Replace(srv.URL, "https://", "https+json://", 1) + "/resolve"
+
+	// The options the JSON API can't send are refused
+	rd := false
+	for _, opts := range []Options{
+		{ForceRD: &rd},
+		{EDNSOptions: []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID}}},
+		{Padding: 128},
+	} {
+		_, err := AddressToUpstream(address, opts)
+		assert.NotNil(t, err)
+	}
+
+	// The response size is limited
+	u, err := AddressToUpstream(address, Options{Timeout: timeout, InsecureSkipVerify: true, MaxResponseSize: 64})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	defer u.(Closer).Close()
+
+	_, err = u.Exchange(createHostTestMessage("google-public-dns-a.google.com"))
+	assert.IsType(t, &ResponseTooLargeError{}, err)
+}
@@ -0,0 +1,322 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestDoHServer starts a local DNS-over-HTTPS server that answers every
+// query with an A record
+func startTestDoHServer(t *testing.T) *dnsproxytest.Server {
+	srv, err := dnsproxytest.NewHTTPSServer(func(req *dns.Msg) *dns.Msg {
+		res := new(dns.Msg).SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(8, 8, 8, 8),
+		})
+		return res
+	})
+	if err != nil {
+		t.Fatalf("cannot start the DoH server: %s", err)
+	}
+	return srv
+}
+
+func TestDoHFallback(t *testing.T) {
+	srv := startTestDoHServer(t)
+	defer srv.Close()
+
+	// Nobody listens on this port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	unreachable := "https://" + l.Addr().String() + "/dns-query"
+	_ = l.Close()
+
+	opts := Options{
+		Timeout:            timeout,
+		InsecureSkipVerify: true,
+		DoHFallbackURLs:    []string{srv.URL},
+	}
+	u, err := AddressToUpstream(unreachable, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, unreachable, u.Address())
+
+	req := createTestMessage()
+	res, err := u.Exchange(req)
+	assert.Nil(t, err)
+	if res == nil {
+		t.Fatalf("no response from the fallback")
+	}
+	assert.Equal(t, req.Id, res.Id)
+	assert.Len(t, res.Answer, 1)
+
+	// Fallbacks must be DoH
+	opts.DoHFallbackURLs = []string{"tls://127.0.0.1"}
+	_, err = AddressToUpstream(unreachable, opts)
+	assert.NotNil(t, err)
+}
+
+func TestDoHPreConnect(t *testing.T) {
+	srv := startTestDoHServer(t)
+	defer srv.Close()
+
+	var dials int32
+	opts := Options{
+		Timeout:            timeout,
+		InsecureSkipVerify: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+
+	// The connection is established on the first query by default
+	u, err := AddressToUpstream(srv.URL, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dials))
+	_ = u.(Closer).Close()
+
+	// And right away with PreConnect, the first query reuses it
+	opts.PreConnect = true
+	u, err = AddressToUpstream(srv.URL, opts)
+	assert.Nil(t, err)
+	defer u.(Closer).Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+
+	// Only the handshake is made, the HTTP transport hasn't used the
+	// connection yet
+	d := u.(*dnsOverHTTPS).preConnected
+	if assert.NotNil(t, d) {
+		d.mu.Lock()
+		assert.NotNil(t, d.conn)
+		d.mu.Unlock()
+	}
+
+	req := createTestMessage()
+	res, err := u.Exchange(req)
+	assert.Nil(t, err)
+	if res == nil {
+		t.Fatalf("no response from the upstream")
+	}
+	assert.Equal(t, req.Id, res.Id)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+	assert.Equal(t, 1, srv.Accepted())
+	assert.Equal(t, "h2", u.(*dnsOverHTTPS).tlsState.get().NegotiatedProtocol)
+}
+
+func TestDoHRefresh(t *testing.T) {
+	srv := startTestDoHServer(t)
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Addr)
+	assert.Nil(t, err)
+
+	// The bootstrap resolver answers with the current address of the server
+	var current atomic.Value
+	current.Store("10.0.0.1")
+	boot, err := dnsproxytest.NewPlainServer(func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg).SetReply(req)
+		if req.Question[0].Qtype == dns.TypeA {
+			resp.Answer = []dns.RR{newTestRR("%s 60 IN A %s", req.Question[0].Name, current.Load().(string))}
+		}
+		return resp
+	})
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer boot.Close()
+
+	// Every address leads to the server unless it's down
+	var mu sync.Mutex
+	var dialed []string
+	down := map[string]bool{}
+	newUpstream := func(interval time.Duration) *dnsOverHTTPS {
+		u, err := AddressToUpstream("https://doh.example:"+port+"/dns-query", Options{
+			Bootstrap:          []string{boot.Addr},
+			Timeout:            timeout,
+			InsecureSkipVerify: true,
+			DoHRefreshInterval: interval,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				mu.Lock()
+				dialed = append(dialed, addr)
+				isDown := down[addr]
+				mu.Unlock()
+				if isDown {
+					return nil, errors.New("server is down")
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, srv.Addr)
+			},
+		})
+		if err != nil {
+			t.Fatalf("cannot create upstream: %s", err)
+		}
+		return u.(*dnsOverHTTPS)
+	}
+	lastDialed := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return dialed[len(dialed)-1]
+	}
+	expire := func(u *dnsOverHTTPS) {
+		u.mu.Lock()
+		u.refreshAt = time.Now()
+		u.mu.Unlock()
+	}
+	client := func(u *dnsOverHTTPS) *http.Client {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		return u.client
+	}
+	// The refresh is done in the background
+	waitRefresh := func(u *dnsOverHTTPS) {
+		assert.Eventually(t, func() bool {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			return !u.refreshing
+		}, timeout, time.Millisecond)
+	}
+
+	u := newUpstream(time.Hour)
+	defer u.Close()
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1:"+port, lastDialed())
+	first := client(u)
+
+	// The client is kept until the interval passes
+	current.Store("10.0.0.2")
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assert.True(t, first == client(u))
+
+	// Then the query that has noticed it is sent with the current client and
+	// the next ones dial the new addresses with the new client
+	expire(u)
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1:"+port, lastDialed())
+	waitRefresh(u)
+	assert.True(t, first != client(u))
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.2:"+port, lastDialed())
+
+	// The client is kept if the addresses are the same
+	second := client(u)
+	expire(u)
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	waitRefresh(u)
+	assert.True(t, second == client(u))
+
+	// The addresses are refreshed after the failed connections too
+	u = newUpstream(time.Hour)
+	defer u.Close()
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	mu.Lock()
+	down["10.0.0.2:"+port] = true
+	mu.Unlock()
+	client(u).CloseIdleConnections()
+	current.Store("10.0.0.3")
+	for i := 0; i < dohRefreshFailures+1; i++ {
+		_, err = u.Exchange(createTestMessage())
+		assert.NotNil(t, err)
+	}
+	waitRefresh(u)
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.3:"+port, lastDialed())
+
+	// Never with the refresh disabled
+	u = newUpstream(-1)
+	defer u.Close()
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	mu.Lock()
+	down["10.0.0.3:"+port] = true
+	mu.Unlock()
+	client(u).CloseIdleConnections()
+	current.Store("10.0.0.4")
+	for i := 0; i < dohRefreshFailures+1; i++ {
+		_, err = u.Exchange(createTestMessage())
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, "10.0.0.3:"+port, lastDialed())
+}
+
+func TestDoHQuestionMismatch(t *testing.T) {
+	// The stub server answers a different question
+	srv, err := dnsproxytest.NewHTTPServer(func(req *dns.Msg) *dns.Msg {
+		r := req.Copy()
+		r.Question[0].Name = "example.org."
+		return new(dns.Msg).SetReply(r)
+	})
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
+	u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, AllowPlaintextDoH: true})
+	if err != nil {
+		t.Fatalf("cannot create the upstream: %s", err)
+	}
+	defer u.(Closer).Close()
+
+	res, err := u.Exchange(createTestMessage())
+	assert.Equal(t, ErrQuestion, err)
+	assert.Nil(t, res)
+}
+
+func TestDoHPlaintext(t *testing.T) {
+	srv, err := dnsproxytest.NewHTTPServer(nil)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
+	// The unencrypted DoH is refused unless it's explicitly allowed
+	_, err = AddressToUpstream(srv.URL, Options{Timeout: timeout})
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, srv.Accepted())
+
+	u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, AllowPlaintextDoH: true})
+	if err != nil {
+		t.Fatalf("cannot create the upstream: %s", err)
+	}
+	defer u.(Closer).Close()
+	assert.Equal(t, srv.URL, u.Address())
+
+	req := createTestMessage()
+	res, err := u.Exchange(req)
+	assert.Nil(t, err)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, req.Id, res.Id)
+	}
+	assert.Nil(t, u.(*dnsOverHTTPS).TLSState())
+
+	// There's no TLS handshake to make in advance
+	accepted := srv.Accepted()
+	u, err = AddressToUpstream(srv.URL, Options{Timeout: timeout, AllowPlaintextDoH: true, PreConnect: true})
+	if err != nil {
+		t.Fatalf("cannot create the upstream: %s", err)
+	}
+	defer u.(Closer).Close()
+	assert.Nil(t, u.(*dnsOverHTTPS).preConnected)
+	assert.Equal(t, accepted, srv.Accepted())
+
+	res, err = u.Exchange(req)
+	assert.Nil(t, err)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, req.Id, res.Id)
+	}
+}
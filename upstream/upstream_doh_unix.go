@@ -0,0 +1,80 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// dohUnixDefaultHost is the Host header of the queries sent over a Unix socket
+// if the URL has no host
+const dohUnixDefaultHost = "localhost"
+
+// dnsOverHTTPSUnix is a DNS-over-HTTPS upstream that sends the queries over
+// plain HTTP to a local Unix socket, e.g. a sidecar DoH endpoint
+type dnsOverHTTPSUnix struct {
+	*dnsOverHTTPS
+
+	address string // the https+unix:// address the upstream was created from
+}
+
+// newDNSOverHTTPSUnix creates the DoH upstream for the https+unix:// URL.  The
+// socket path is the URL path up to and including the first element with the
+// ".sock" suffix, the rest is the HTTP path, e.g. the socket of
+// https+unix:///var/run/doh.sock/dns-query is /var/run/doh.sock and the HTTP
+// path is /dns-query.  The URL host, if any, is sent in the Host header.  The
+// bootstrap is not used.
+func newDNSOverHTTPSUnix(upstreamURL *url.URL, opts Options) (*dnsOverHTTPSUnix, error) {
+	socket, httpPath := splitUnixSocketPath(upstreamURL.Path)
+	if socket == "" {
+		return nil, fmt.Errorf("no Unix socket path in %s", upstreamURL)
+	}
+
+	host := upstreamURL.Host
+	if host == "" {
+		host = dohUnixDefaultHost
+	}
+	httpURL := url.URL{Scheme: "http", Host: host, Path: httpPath}
+
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		d := &net.Dialer{Timeout: opts.Timeout}
+		return d.DialContext(ctx, "unix", socket)
+	}
+	b := &bootstrapper{
+		address:        httpURL.String(),
+		options:        opts,
+		dialContext:    dial,
+		resolvedConfig: &tls.Config{},
+	}
+
+	fallbacks, err := newDoHFallbacks(opts.DoHFallbackURLs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dnsOverHTTPSUnix{
+		dnsOverHTTPS: &dnsOverHTTPS{boot: b, fallbacks: fallbacks},
+		address:      upstreamURL.String(),
+	}, nil
+}
+
+func (p *dnsOverHTTPSUnix) Address() string { return p.address }
+
+// WithOptions implements the Cloner interface for *dnsOverHTTPSUnix
+func (p *dnsOverHTTPSUnix) WithOptions(opts *Options) (Upstream, error) {
+	return cloneUpstream(p.address, nil, nil, opts)
+}
+
+// splitUnixSocketPath splits the https+unix:// URL path into the socket path
+// and the HTTP path.  If there is no element with the ".sock" suffix, the
+// whole path is the socket path.
+func splitUnixSocketPath(p string) (socket, httpPath string) {
+	const suffix = ".sock"
+	if i := strings.Index(p, suffix+"/"); i >= 0 {
+		return p[:i+len(suffix)], p[i+len(suffix):]
+	}
+	return p, "/"
+}
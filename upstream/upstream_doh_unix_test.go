@@ -0,0 +1,94 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoHUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dohunix")
+	if err != nil {
+		t.Fatalf("cannot create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "doh.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+
+	var host, path string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, path = r.Host, r.URL.Path
+
+		buf, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := &dns.Msg{}
+		if err = req.Unpack(buf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := new(dns.Msg).SetReply(req)
+		resp.Answer = []dns.RR{newTestRR("%s 60 IN A 192.0.2.1", req.Question[0].Name)}
+		buf, _ = resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(buf)
+	}))
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	testCases := []struct {
+		address string
+		host    string
+		path    string
+	}{{
+		address: "https+unix://" + socket + "/dns-query",
+		host:    "localhost",
+		path:    "/dns-query",
+	}, {
+		address: "https+unix://doh.example" + socket + "/custom/path",
+		host:    "doh.example",
+		path:    "/custom/path",
+	}, {
+		address: "https+unix://" + socket,
+		host:    "localhost",
+		path:    "/",
+	}}
+
+	for _, tc := range testCases {
+		u, err := AddressToUpstream(tc.address, Options{Timeout: timeout, Bootstrap: []string{"192.0.2.1:53"}})
+		if err != nil {
+			t.Fatalf("cannot create upstream %s: %s", tc.address, err)
+		}
+		assert.Equal(t, tc.address, u.Address())
+
+		req := createHostTestMessage("example.org")
+		res, err := u.Exchange(req)
+		if err != nil {
+			t.Fatalf("cannot exchange with %s: %s", tc.address, err)
+		}
+		assert.Equal(t, req.Id, res.Id)
+		if assert.Len(t, res.Answer, 1) {
+			assert.Equal(t, "192.0.2.1", res.Answer[0].(*dns.A).A.String())
+		}
+		assert.Equal(t, tc.host, host)
+		assert.Equal(t, tc.path, path)
+
+		_ = u.(Closer).Close()
+	}
+}
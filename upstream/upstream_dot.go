@@ -1,8 +1,11 @@
 package upstream
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
@@ -16,76 +19,319 @@ type dnsOverTLS struct {
 	boot *bootstrapper
 	pool *TLSPool
 
-	sync.RWMutex // protects pool
+	// pipeline is used instead of the pool when pipelining is enabled
+	pipeline *pipeline
+
+	// stamp is not nil if the upstream was created from a DNS stamp
+	stamp *StampInfo
+
+	// tlsState is the state of the last used TLS connection
+	tlsState lastTLSState
+
+	// exchanges are the Exchange calls in progress
+	exchanges exchangeTracker
+
+	sync.RWMutex // protects pool and pipeline
 }
 
 func (p *dnsOverTLS) Address() string { return p.boot.address }
 
+// Properties returns the information from the DNS stamp the upstream was created
+// from, or nil if it wasn't created from a stamp
+func (p *dnsOverTLS) Properties() *StampInfo { return p.stamp }
+
+// WithOptions implements the Cloner interface for *dnsOverTLS
+func (p *dnsOverTLS) WithOptions(opts *Options) (Upstream, error) {
+	return cloneUpstream(p.Address(), p.boot, p.stamp, opts)
+}
+
+// TLSState returns the state of the last TLS connection used to exchange
+// a query, or nil if there were no connections yet
+func (p *dnsOverTLS) TLSState() *TLSState { return p.tlsState.get() }
+
 func (p *dnsOverTLS) Exchange(m *dns.Msg) (*dns.Msg, error) {
-	var pool *TLSPool
-	p.RLock()
-	pool = p.pool
-	p.RUnlock()
-	if pool == nil {
-		p.Lock()
+	return followCNAME(p.boot.options.FollowCNAME, p.exchangeTraced)(m, nil)
+}
+
+// ExchangeWithInfo implements the InfoExchanger interface for *dnsOverTLS
+func (p *dnsOverTLS) ExchangeWithInfo(m *dns.Msg) (*dns.Msg, *ExchangeInfo, error) {
+	return traceExchange(m, followCNAME(p.boot.options.FollowCNAME, p.exchangeTraced))
+}
+
+// exchangeTraced sends the query and records the details to tr
+func (p *dnsOverTLS) exchangeTraced(m *dns.Msg, tr *exchangeTrace) (reply *dns.Msg, err error) {
+	m, finish, err := prepareQuery(&p.exchanges, m, newQueryOptions(&p.boot.options), tr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { reply, err = finish(reply, err) }()
+
+	if p.boot.options.Pipelining {
+		return exchangePadded(m, p.boot.options.Padding, func(m *dns.Msg) (*dns.Msg, error) {
+			return p.exchangePipelined(m, tr)
+		})
+	}
+
+	if p.boot.options.DisablePool {
+		return exchangePadded(m, p.boot.options.Padding, func(m *dns.Msg) (*dns.Msg, error) {
+			return p.exchangeOneShot(m, tr)
+		})
+	}
+
+	// Advertise the keepalive support to learn the server's idle timeout
+	req, addedOPT := addKeepalive(m)
+	// The padding goes last, the request already has the OPT record
+	req, _ = padMsg(req, p.boot.options.Padding)
+
+	pool := p.getPool()
+	err = p.withPooledConn(pool, tr, func(conn net.Conn) error {
+		logBegin(p.Address(), m)
+		reply, err = p.exchangeConn(conn, req, tr)
+		logFinish(p.Address(), err)
+		return err
+	})
+	if err != nil {
+		return reply, err
+	}
+
+	// The OPT record, if added, is removed along with the keepalive option
+	unpadMsg(reply, false)
+	if timeout, ok := takeKeepalive(reply, addedOPT); ok {
+		pool.setIdleTimeout(timeout)
+	}
+	return reply, nil
+}
+
+// getPool returns the connection pool, it's created on the first use
+func (p *dnsOverTLS) getPool() *TLSPool {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.pool == nil {
 		// lazy initialize it
 		p.pool = &TLSPool{boot: p.boot}
-		p.Unlock()
 	}
+	return p.pool
+}
 
-	p.RLock()
-	poolConn, err := p.pool.Get()
-	p.RUnlock()
+// withPooledConn calls exchange with a connection from the pool.  If exchange
+// fails, the connection is closed and exchange is retried once over a new one.
+// The connection is returned to the pool if exchange succeeds.
+func (p *dnsOverTLS) withPooledConn(pool *TLSPool, tr *exchangeTrace, exchange func(conn net.Conn) error) error {
+	// Wait for a free connection no longer than the query timeout
+	ctx := context.Background()
+	if p.boot.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.boot.options.Timeout)
+		defer cancel()
+	}
+
+	poolConn, err := pool.GetContext(ctx)
 	if err != nil {
-		return nil, errorx.Decorate(err, "Failed to get a connection from TLSPool to %s", p.Address())
+		if _, ok := err.(*PoolTimeoutError); ok {
+			return err
+		}
+		return errorx.Decorate(err, "Failed to get a connection from TLSPool to %s", p.Address())
 	}
 
-	logBegin(p.Address(), m)
-	reply, err := p.exchangeConn(poolConn, m)
-	logFinish(p.Address(), err)
+	err = exchange(poolConn)
 	if err != nil {
+		_ = poolConn.Close()
 		log.Tracef("The TLS connection is expired due to %s", err)
 
 		// The pooled connection might have been closed already (see https://github.com/AdguardTeam/dnsproxy/issues/3)
 		// So we're trying to re-connect right away here.
 		// We are forcing creation of a new connection instead of calling Get() again
 		// as there's no guarantee that other pooled connections are intact
-		p.RLock()
-		poolConn, err = p.pool.Create()
-		p.RUnlock()
+		poolConn, err = pool.create(ctx)
 		if err != nil {
-			return nil, errorx.Decorate(err, "Failed to create a new connection from TLSPool to %s", p.Address())
+			pool.release()
+			return errorx.Decorate(err, "Failed to create a new connection from TLSPool to %s", p.Address())
 		}
 
 		// Retry sending the DNS request
-		logBegin(p.Address(), m)
-		reply, err = p.exchangeConn(poolConn, m)
+		tr.reconnect()
+		err = exchange(poolConn)
+	}
+
+	if err != nil {
+		_ = poolConn.Close()
+		pool.release()
+		return err
+	}
+
+	pool.Put(poolConn)
+	return nil
+}
+
+// ExchangeWire implements the WireExchanger interface for *dnsOverTLS.  The
+// query is relayed as is over the pooled or a new connection only if the
+// padding is disabled and none of the other options that modify the messages
+// is set, the keepalive option isn't added then.
+func (p *dnsOverTLS) ExchangeWire(req []byte) (reply []byte, err error) {
+	if !p.relaysWire() {
+		return exchangeWireMsg(p.Exchange, req)
+	}
+	if _, err = wireQuestionEnd(req); err != nil {
+		return nil, err
+	}
+
+	if err = p.exchanges.begin(); err != nil {
+		return nil, err
+	}
+	defer p.exchanges.end()
+
+	if p.boot.options.DisablePool {
+		conn, err := p.dial(&TLSPool{boot: p.boot})
+		if err != nil {
+			return nil, errorx.Decorate(err, "Failed to connect to %s", p.Address())
+		}
+		defer conn.Close()
+
+		logBeginWire(p.Address(), req)
+		reply, err = p.exchangeConnWire(conn, req)
 		logFinish(p.Address(), err)
+		return reply, err
 	}
 
-	if err == nil {
-		p.RLock()
-		p.pool.Put(poolConn)
-		p.RUnlock()
+	err = p.withPooledConn(p.getPool(), nil, func(conn net.Conn) error {
+		logBeginWire(p.Address(), req)
+		reply, err = p.exchangeConnWire(conn, req)
+		logFinish(p.Address(), err)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return reply, err
+	return reply, nil
+}
+
+// relaysWire returns true if the queries in the wire format can be sent as is
+func (p *dnsOverTLS) relaysWire() bool {
+	opts := p.boot.options
+	return !opts.FollowCNAME && opts.ForceRD == nil && opts.Compress == nil && len(opts.EDNSOptions) == 0 &&
+		opts.MaxResponseSize <= 0 && opts.Padding <= 0 && !opts.Pipelining
+}
+
+// exchangeConnWire is exchangeConn for the query in the wire format, the
+// connection is closed if it fails
+func (p *dnsOverTLS) exchangeConnWire(conn net.Conn, req []byte) ([]byte, error) {
+	reply, err := exchangeStreamWire(conn, req, p.boot.options.Timeout)
+	if err != nil {
+		_ = conn.Close()
+		return nil, errorx.Decorate(err, "Failed to exchange a request with %s", p.Address())
+	}
+
+	p.saveTLSState(conn)
+	return reply, nil
 }
 
-func (p *dnsOverTLS) exchangeConn(poolConn net.Conn, m *dns.Msg) (*dns.Msg, error) {
-	c := dns.Conn{Conn: poolConn}
-	err := c.WriteMsg(m)
+// Close implements the Closer interface for *dnsOverTLS
+func (p *dnsOverTLS) Close() error { return p.exchanges.close(p.release) }
+
+// Shutdown implements the Closer interface for *dnsOverTLS
+func (p *dnsOverTLS) Shutdown(ctx context.Context) error {
+	return p.exchanges.shutdown(ctx, p.release)
+}
+
+// release closes the pooled and pipelined connections
+func (p *dnsOverTLS) release() error {
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.pool != nil {
+		p.pool.closeAll()
+	}
+	if p.pipeline != nil {
+		p.pipeline.close()
+	}
+	return nil
+}
+
+func (p *dnsOverTLS) exchangeConn(poolConn net.Conn, m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
+	n, err := writePrefixedMsg(poolConn, m)
 	if err != nil {
 		poolConn.Close()
 		return nil, errorx.Decorate(err, "Failed to send a request to %s", p.Address())
 	}
+	tr.wroteQuery("tls", poolConn.RemoteAddr(), n)
 
-	reply, err := c.ReadMsg()
+	reply, n, err := readPrefixedMsg(poolConn)
 	if err != nil {
 		poolConn.Close()
 		return nil, errorx.Decorate(err, "Failed to read a request from %s", p.Address())
 	}
-	if err == nil && reply.Id != m.Id {
-		err = dns.ErrId
+	tr.readResponse(time.Time{}, n)
+	if err == nil {
+		err = VerifyResponse(m, reply)
+	}
+	if err == nil {
+		p.saveTLSState(poolConn)
 	}
 	return reply, err
 }
+
+// saveTLSState saves the state of the TLS connection
+func (p *dnsOverTLS) saveTLSState(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		p.tlsState.set(tlsConn.ConnectionState())
+	}
+}
+
+// dial creates a new connection with the pool, the bootstrap lookup and the
+// handshake take no longer than the timeout together
+func (p *dnsOverTLS) dial(pool *TLSPool) (net.Conn, error) {
+	ctx := context.Background()
+	if p.boot.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.boot.options.Timeout)
+		defer cancel()
+	}
+	return pool.create(ctx)
+}
+
+// exchangeOneShot sends the query over a new connection and closes it once the
+// response is received
+func (p *dnsOverTLS) exchangeOneShot(m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
+	conn, err := p.dial(&TLSPool{boot: p.boot})
+	if err != nil {
+		return nil, errorx.Decorate(err, "Failed to connect to %s", p.Address())
+	}
+	defer conn.Close()
+
+	logBegin(p.Address(), m)
+	reply, err := p.exchangeConn(conn, m, tr)
+	logFinish(p.Address(), err)
+
+	return reply, err
+}
+
+// exchangePipelined sends the query over the single pipelined TLS connection
+func (p *dnsOverTLS) exchangePipelined(m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
+	p.Lock()
+	if p.pipeline == nil {
+		// lazy initialize it
+		pool := &TLSPool{boot: p.boot}
+		p.pipeline = &pipeline{
+			dial: func() (net.Conn, error) {
+				conn, err := p.dial(pool)
+				if err == nil {
+					p.saveTLSState(conn)
+				}
+				return conn, err
+			},
+			timeout: p.boot.options.Timeout,
+		}
+	}
+	pl := p.pipeline
+	p.Unlock()
+
+	logBegin(p.Address(), m)
+	reply, err := pl.exchange(m, tr)
+	logFinish(p.Address(), err)
+	if err != nil {
+		return nil, errorx.Decorate(err, "Failed to exchange a pipelined request with %s", p.Address())
+	}
+
+	return reply, nil
+}
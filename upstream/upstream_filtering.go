@@ -0,0 +1,115 @@
+package upstream
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// RequestFilter checks the request before it's sent to the upstream.  If it
+// returns true, the request is not sent and the returned response is used
+// instead.  A nil response means NXDOMAIN.
+type RequestFilter func(m *dns.Msg) (*dns.Msg, bool)
+
+// AnyMode defines how the upstream created with NewAnyUpstream handles the
+// queries for the ANY type
+type AnyMode int
+
+const (
+	// AnyForward forwards the ANY queries as is
+	AnyForward AnyMode = iota
+	// AnyMinimal answers the ANY queries with a single HINFO record (RFC 8482)
+	AnyMinimal
+	// AnyRefuse answers the ANY queries with REFUSED
+	AnyRefuse
+)
+
+// anyHINFOTTL is the TTL of the HINFO record in the minimal ANY responses
+const anyHINFOTTL = 3600
+
+// filteringUpstream is an Upstream that applies the filter to the requests
+// before sending them to the wrapped upstream
+type filteringUpstream struct {
+	upstream Upstream      // the upstream the allowed requests are sent to
+	filter   RequestFilter // decides which requests are blocked
+
+	exchanges exchangeTracker // Exchange calls in progress
+}
+
+// NewFilteringUpstream creates a new Upstream that calls filter for every
+// request and only sends the requests it doesn't block to u.  The filtering
+// upstreams may wrap each other, the outer filter is applied first.
+func NewFilteringUpstream(u Upstream, filter RequestFilter) Upstream {
+	return &filteringUpstream{upstream: u, filter: filter}
+}
+
+// NewAnyUpstream creates a new Upstream that handles the ANY queries according
+// to mode and sends the rest of the queries to u.  It allows reducing the DNS
+// amplification with the responses to the ANY queries.
+func NewAnyUpstream(u Upstream, mode AnyMode) Upstream {
+	if mode == AnyForward {
+		return u
+	}
+
+	return NewFilteringUpstream(u, func(m *dns.Msg) (*dns.Msg, bool) {
+		if len(m.Question) != 1 || m.Question[0].Qtype != dns.TypeANY {
+			return nil, false
+		}
+
+		resp := new(dns.Msg).SetReply(m)
+		if mode == AnyRefuse {
+			resp.Rcode = dns.RcodeRefused
+			return resp, true
+		}
+
+		resp.Answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{
+				Name:   m.Question[0].Name,
+				Rrtype: dns.TypeHINFO,
+				Class:  dns.ClassINET,
+				Ttl:    anyHINFOTTL,
+			},
+			Cpu: "RFC8482",
+		}}
+		return resp, true
+	})
+}
+
+func (u *filteringUpstream) Address() string { return u.upstream.Address() }
+
+func (u *filteringUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if err := u.exchanges.begin(); err != nil {
+		return nil, err
+	}
+	defer u.exchanges.end()
+
+	resp, blocked := u.filter(m)
+	if !blocked {
+		return u.upstream.Exchange(m)
+	}
+
+	if resp == nil {
+		return new(dns.Msg).SetRcode(m, dns.RcodeNameError), nil
+	}
+
+	// The filter may reuse the same response for many requests
+	resp = resp.Copy()
+	resp.Id = m.Id
+	return resp, nil
+}
+
+// Close implements the Closer interface for *filteringUpstream
+func (u *filteringUpstream) Close() error { return u.exchanges.close(u.release) }
+
+// Shutdown implements the Closer interface for *filteringUpstream
+func (u *filteringUpstream) Shutdown(ctx context.Context) error {
+	return u.exchanges.shutdown(ctx, u.release)
+}
+
+// release closes the wrapped upstream
+func (u *filteringUpstream) release() error {
+	if c, ok := u.upstream.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
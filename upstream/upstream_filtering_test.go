@@ -0,0 +1,103 @@
+package upstream
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilteringUpstream(t *testing.T) {
+	var forwarded int32
+	u := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&forwarded, 1)
+		res := new(dns.Msg).SetReply(m)
+		res.Answer = []dns.RR{newTestRR("%s 300 IN A 8.8.8.8", m.Question[0].Name)}
+		return res, nil
+	})
+
+	sinkhole := new(dns.Msg)
+	sinkhole.Answer = []dns.RR{newTestRR("ads.example.org. 60 IN A 0.0.0.0")}
+
+	f := NewFilteringUpstream(u, func(m *dns.Msg) (*dns.Msg, bool) {
+		switch name := m.Question[0].Name; {
+		case name == "ads.example.org.":
+			return sinkhole, true
+		case strings.HasSuffix(name, ".blocked.org."):
+			return nil, true
+		}
+		return nil, false
+	})
+	assert.Equal(t, "static", f.Address())
+
+	req := new(dns.Msg)
+	req.SetQuestion("ads.example.org.", dns.TypeA)
+	res, err := f.Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, req.Id, res.Id)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "0.0.0.0", res.Answer[0].(*dns.A).A.String())
+	}
+
+	req.SetQuestion("www.blocked.org.", dns.TypeA)
+	res, err = f.Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&forwarded))
+
+	// Allowed names are forwarded
+	req.SetQuestion("www.example.org.", dns.TypeA)
+	res, err = f.Exchange(req)
+	assert.Nil(t, err)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "8.8.8.8", res.Answer[0].(*dns.A).A.String())
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&forwarded))
+
+	// Closing the filter closes the wrapped upstream
+	assert.Nil(t, f.(Closer).Close())
+	_, err = u.Exchange(req)
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestAnyUpstream(t *testing.T) {
+	var forwarded int32
+	u := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&forwarded, 1)
+		res := new(dns.Msg).SetReply(m)
+		res.Answer = []dns.RR{newTestRR("%s 300 IN A 8.8.8.8", m.Question[0].Name)}
+		return res, nil
+	})
+
+	assert.Equal(t, u, NewAnyUpstream(u, AnyForward))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeANY)
+
+	res, err := NewAnyUpstream(u, AnyMinimal).Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "RFC8482", res.Answer[0].(*dns.HINFO).Cpu)
+		assert.Equal(t, "example.org.", res.Answer[0].Header().Name)
+	}
+
+	res, err = NewAnyUpstream(u, AnyRefuse).Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeRefused, res.Rcode)
+	assert.Empty(t, res.Answer)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&forwarded))
+
+	// Other queries are passed through
+	for _, mode := range []AnyMode{AnyMinimal, AnyRefuse} {
+		req.SetQuestion("example.org.", dns.TypeA)
+		res, err = NewAnyUpstream(u, mode).Exchange(req)
+		assert.Nil(t, err)
+		if assert.Len(t, res.Answer, 1) {
+			assert.Equal(t, "8.8.8.8", res.Answer[0].(*dns.A).A.String())
+		}
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&forwarded))
+}
@@ -0,0 +1,162 @@
+package upstream
+
+import (
+	"context"
+	"net"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// hostsTTL is the TTL of the records synthesized by the hosts upstream
+const hostsTTL = 60
+
+// HostsEntries contains the records the hosts upstream answers with.  The
+// names are case-insensitive, the trailing dot is optional.
+type HostsEntries struct {
+	IPs   map[string][]net.IP // A and AAAA records by the host name
+	CNAME map[string]string   // CNAME targets by the alias
+	TXT   map[string][]string // TXT records by the host name
+}
+
+// hostsUpstream answers the queries for the local host names and forwards
+// everything else to the fallback upstream
+type hostsUpstream struct {
+	hosts    *proxyutil.HostsTable // A, AAAA and PTR records
+	cname    map[string]string     // CNAME targets by the alias
+	txt      map[string][]string   // TXT records by the host name
+	fallback Upstream              // used for the queries that don't match, may be nil
+
+	exchanges exchangeTracker // Exchange calls in progress
+}
+
+// NewHostsUpstream creates a new Upstream that answers the A, AAAA, PTR, CNAME
+// and TXT queries matching the entries, and forwards all other queries to
+// fallback.  The PTR records are synthesized from the addresses of the hosts.
+// If a host has addresses of one family only, the queries for the other
+// family get an empty response.  If fallback is nil, the queries that don't
+// match are answered with NXDOMAIN.
+func NewHostsUpstream(entries HostsEntries, fallback Upstream) Upstream {
+	u := &hostsUpstream{
+		hosts:    proxyutil.NewHostsTable(),
+		cname:    map[string]string{},
+		txt:      map[string][]string{},
+		fallback: fallback,
+	}
+
+	for host, ips := range entries.IPs {
+		u.hosts.Add(host, ips)
+	}
+	for alias, target := range entries.CNAME {
+		u.cname[proxyutil.HostsName(alias)] = proxyutil.HostsName(target)
+	}
+	for host, txt := range entries.TXT {
+		u.txt[proxyutil.HostsName(host)] = txt
+	}
+
+	return u
+}
+
+func (u *hostsUpstream) Address() string { return "hosts" }
+
+func (u *hostsUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if err := u.exchanges.begin(); err != nil {
+		return nil, err
+	}
+	defer u.exchanges.end()
+
+	if len(m.Question) != 1 || m.Question[0].Qclass != dns.ClassINET {
+		return u.forward(m)
+	}
+
+	q := m.Question[0]
+	name := proxyutil.HostsName(q.Name)
+
+	if target, ok := u.cname[name]; ok {
+		return u.answerCNAME(m, q, target)
+	}
+
+	answer, ok := u.lookup(q.Name, name, q.Qtype)
+	if !ok {
+		return u.forward(m)
+	}
+
+	reply := new(dns.Msg).SetReply(m)
+	reply.Answer = answer
+	return reply, nil
+}
+
+// lookup returns the records of the specified type for the name and true if
+// the name has the records of this type or a related one.  owner is the name
+// the records are created with.
+func (u *hostsUpstream) lookup(owner, name string, qtype uint16) ([]dns.RR, bool) {
+	if qtype != dns.TypeTXT {
+		return u.hosts.Lookup(owner, qtype, hostsTTL)
+	}
+
+	txt, ok := u.txt[name]
+	if !ok {
+		return nil, false
+	}
+	return []dns.RR{&dns.TXT{Hdr: hostsHdr(owner, dns.TypeTXT), Txt: txt}}, true
+}
+
+// answerCNAME answers the query for the alias.  The records of the target are
+// added if it's a local host, otherwise they are requested from the fallback.
+func (u *hostsUpstream) answerCNAME(m *dns.Msg, q dns.Question, target string) (*dns.Msg, error) {
+	reply := new(dns.Msg).SetReply(m)
+	reply.Answer = []dns.RR{&dns.CNAME{Hdr: hostsHdr(q.Name, dns.TypeCNAME), Target: target}}
+	if q.Qtype == dns.TypeCNAME {
+		return reply, nil
+	}
+
+	if answer, ok := u.lookup(target, target, q.Qtype); ok {
+		reply.Answer = append(reply.Answer, answer...)
+		return reply, nil
+	}
+
+	if u.fallback == nil {
+		return reply, nil
+	}
+
+	req := m.Copy()
+	req.Question[0].Name = target
+	resp, err := u.fallback.Exchange(req)
+	if err != nil {
+		return nil, err
+	}
+
+	reply.Rcode = resp.Rcode
+	reply.Answer = append(reply.Answer, resp.Answer...)
+	reply.Ns = resp.Ns
+	return reply, nil
+}
+
+// forward sends the query to the fallback upstream
+func (u *hostsUpstream) forward(m *dns.Msg) (*dns.Msg, error) {
+	if u.fallback == nil {
+		return new(dns.Msg).SetRcode(m, dns.RcodeNameError), nil
+	}
+	return u.fallback.Exchange(m)
+}
+
+// Close implements the Closer interface for *hostsUpstream
+func (u *hostsUpstream) Close() error { return u.exchanges.close(u.release) }
+
+// Shutdown implements the Closer interface for *hostsUpstream
+func (u *hostsUpstream) Shutdown(ctx context.Context) error {
+	return u.exchanges.shutdown(ctx, u.release)
+}
+
+// release closes the fallback upstream
+func (u *hostsUpstream) release() error {
+	if c, ok := u.fallback.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// hostsHdr creates the header of a synthesized record
+func hostsHdr(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: hostsTTL}
+}
@@ -0,0 +1,101 @@
+package upstream
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostsUpstream(t *testing.T) {
+	var forwarded int32
+	fallback := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&forwarded, 1)
+		res := new(dns.Msg).SetReply(m)
+		res.Answer = []dns.RR{newTestRR("%s 300 IN A 8.8.8.8", m.Question[0].Name)}
+		return res, nil
+	})
+
+	u := NewHostsUpstream(HostsEntries{
+		IPs: map[string][]net.IP{
+			"Router.LAN":   {net.ParseIP("192.168.1.1"), net.ParseIP("fd00::1")},
+			"printer.lan.": {net.ParseIP("192.168.1.2")},
+		},
+		CNAME: map[string]string{"gw.lan": "router.lan", "search.lan": "www.example.org"},
+		TXT:   map[string][]string{"router.lan": {"v=test"}},
+	}, fallback)
+	assert.Equal(t, "hosts", u.Address())
+
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		res, err := u.Exchange(req)
+		if err != nil {
+			t.Fatalf("cannot exchange %s: %s", name, err)
+		}
+		assert.Equal(t, req.Id, res.Id)
+		return res
+	}
+
+	// A hit, the name is case-insensitive
+	res := exchange("router.lan.", dns.TypeA)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "192.168.1.1", res.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, "router.lan.", res.Answer[0].Header().Name)
+	}
+	res = exchange("ROUTER.lan.", dns.TypeAAAA)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "fd00::1", res.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+
+	// No IPv6 address for a local host
+	res = exchange("printer.lan.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Empty(t, res.Answer)
+
+	// PTR hits
+	res = exchange("2.1.168.192.in-addr.arpa.", dns.TypePTR)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "printer.lan.", res.Answer[0].(*dns.PTR).Ptr)
+	}
+	arpa, _ := dns.ReverseAddr("fd00::1")
+	res = exchange(arpa, dns.TypePTR)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "router.lan.", res.Answer[0].(*dns.PTR).Ptr)
+	}
+
+	res = exchange("router.lan.", dns.TypeTXT)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, []string{"v=test"}, res.Answer[0].(*dns.TXT).Txt)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&forwarded))
+
+	// CNAME to a local host and to a remote one
+	res = exchange("gw.lan.", dns.TypeA)
+	if assert.Len(t, res.Answer, 2) {
+		assert.Equal(t, "router.lan.", res.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "192.168.1.1", res.Answer[1].(*dns.A).A.String())
+	}
+	res = exchange("search.lan.", dns.TypeA)
+	if assert.Len(t, res.Answer, 2) {
+		assert.Equal(t, "www.example.org.", res.Answer[0].(*dns.CNAME).Target)
+		assert.Equal(t, "www.example.org.", res.Answer[1].Header().Name)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&forwarded))
+
+	// Misses fall through
+	res = exchange("example.org.", dns.TypeA)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "8.8.8.8", res.Answer[0].(*dns.A).A.String())
+	}
+	exchange("router.lan.", dns.TypeMX)
+	exchange("3.1.168.192.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&forwarded))
+
+	// Misses without a fallback
+	res, err := NewHostsUpstream(HostsEntries{}, nil).Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+}
@@ -0,0 +1,294 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// maxMinimizingSteps limits the number of queries sent to resolve a single name
+const maxMinimizingSteps = 32
+
+// maxMinimizingDepth limits the nesting of the lookups of the name servers
+// without glue records
+const maxMinimizingDepth = 4
+
+// errNoServers is returned when the referral has no usable name servers
+var errNoServers = errors.New("no usable name servers in the referral")
+
+// minimizingUpstream resolves the queries iteratively starting from the root
+// servers and uses QNAME minimization (RFC 7816).  Until the zone of the name
+// is found, the servers are only asked for the NS records of the name with one
+// more label than the current zone.  The full name is only sent to the
+// servers of its zone.  It's the relaxed mode: if a server doesn't answer the
+// minimized query properly, the full query is sent to it instead.
+type minimizingUpstream struct {
+	roots   []string      // root server addresses (ip:port)
+	timeout time.Duration // timeout of every query
+	port    string        // port of the name servers found in referrals
+
+	exchanges exchangeTracker // Exchange calls in progress
+}
+
+// NewMinimizingUpstream creates a new Upstream that resolves the queries
+// iteratively starting from the specified root servers using QNAME
+// minimization.  The root servers must be plain DNS addresses with IPs.
+// CNAMEs are not followed, the responses are returned as the authoritative
+// servers send them.
+func NewMinimizingUpstream(roots []string, opts Options) (Upstream, error) {
+	if len(roots) == 0 {
+		return nil, errors.New("no root servers specified")
+	}
+
+	u := &minimizingUpstream{timeout: opts.Timeout, port: "53"}
+	for _, r := range roots {
+		host, port, err := parseHostAndPort(r)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("root server must be an IP address: %s", r)
+		}
+		if port == "" {
+			port = "53"
+		}
+		u.roots = append(u.roots, net.JoinHostPort(host, port))
+	}
+
+	return u, nil
+}
+
+func (u *minimizingUpstream) Address() string { return "minimizing" }
+
+func (u *minimizingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if err := u.exchanges.begin(); err != nil {
+		return nil, err
+	}
+	defer u.exchanges.end()
+
+	if len(m.Question) != 1 {
+		return nil, fmt.Errorf("got %d questions instead of 1", len(m.Question))
+	}
+
+	reply, err := u.resolve(m, 0)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to resolve %s", m.Question[0].Name)
+	}
+
+	reply.Id = m.Id
+	reply.RecursionDesired = m.RecursionDesired
+	return reply, nil
+}
+
+// Close implements the Closer interface for *minimizingUpstream
+func (u *minimizingUpstream) Close() error { return u.exchanges.close(u.release) }
+
+// Shutdown implements the Closer interface for *minimizingUpstream
+func (u *minimizingUpstream) Shutdown(ctx context.Context) error {
+	return u.exchanges.shutdown(ctx, u.release)
+}
+
+// release does nothing since the queries use a new connection each time
+func (u *minimizingUpstream) release() error { return nil }
+
+// resolve resolves the query iteratively.  depth is the nesting level of the
+// name server lookups.
+func (u *minimizingUpstream) resolve(m *dns.Msg, depth int) (*dns.Msg, error) {
+	qname := dns.Fqdn(strings.ToLower(m.Question[0].Name))
+	labels := dns.CountLabel(qname)
+
+	zone := "."
+	servers := u.roots
+	// minimize is false once the minimized queries can't be used anymore
+	minimize := true
+
+	for step := 0; step < maxMinimizingSteps; step++ {
+		zoneLabels := dns.CountLabel(zone)
+		if minimize && zoneLabels+1 < labels {
+			child := childName(qname, zoneLabels+1)
+
+			resp, err := u.exchangeServers(servers, newMinimizedQuery(child))
+			if err != nil {
+				return nil, err
+			}
+
+			switch {
+			case resp.Rcode == dns.RcodeNameError:
+				// Nothing exists below the name that doesn't exist (RFC 8020)
+				reply := new(dns.Msg)
+				reply.SetRcode(m, dns.RcodeNameError)
+				reply.Ns = resp.Ns
+				return reply, nil
+			case resp.Rcode != dns.RcodeSuccess:
+				log.Tracef("%s: minimized query for %s failed with %s, sending the full name", zone, child, dns.RcodeToString[resp.Rcode])
+				minimize = false
+				continue
+			}
+
+			next, nextServers, err := u.followReferral(resp, zone, qname, depth)
+			if err != nil {
+				return nil, err
+			}
+			if next != "" {
+				zone, servers = next, nextServers
+				continue
+			}
+
+			// Either the name is not a zone cut, or the same servers are
+			// authoritative for it, add one more label
+			zone = child
+			continue
+		}
+
+		q := m.Copy()
+		q.Id = dns.Id()
+		q.RecursionDesired = false
+		resp, err := u.exchangeServers(servers, q)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0 {
+			next, nextServers, err := u.followReferral(resp, zone, qname, depth)
+			if err != nil {
+				return nil, err
+			}
+			if next != "" {
+				zone, servers = next, nextServers
+				continue
+			}
+		}
+
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("too many steps to resolve %s", qname)
+}
+
+// followReferral returns the zone and the addresses of its name servers if
+// resp is a referral to a zone below zone.  zone is empty if it's not.
+func (u *minimizingUpstream) followReferral(resp *dns.Msg, zone, qname string, depth int) (string, []string, error) {
+	next := ""
+	var names []string
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		owner := strings.ToLower(ns.Hdr.Name)
+		if !dns.IsSubDomain(owner, qname) || dns.CountLabel(owner) <= dns.CountLabel(zone) || !dns.IsSubDomain(zone, owner) {
+			// Not a referral closer to the name
+			continue
+		}
+
+		next = owner
+		names = append(names, strings.ToLower(ns.Ns))
+	}
+
+	if next == "" {
+		return "", nil, nil
+	}
+
+	servers := u.glueAddrs(resp, names)
+	if len(servers) == 0 {
+		var err error
+		servers, err = u.lookupServers(names, depth)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	log.Tracef("Following the referral to %s: %v", next, servers)
+	return next, servers, nil
+}
+
+// glueAddrs returns the addresses of the name servers from the glue records
+func (u *minimizingUpstream) glueAddrs(resp *dns.Msg, names []string) []string {
+	var addrs []string
+	for _, rr := range resp.Extra {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		for _, n := range names {
+			if strings.EqualFold(rr.Header().Name, n) {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), u.port))
+				break
+			}
+		}
+	}
+	return addrs
+}
+
+// lookupServers resolves the addresses of the name servers that have no glue
+func (u *minimizingUpstream) lookupServers(names []string, depth int) ([]string, error) {
+	if depth >= maxMinimizingDepth {
+		return nil, errNoServers
+	}
+
+	for _, n := range names {
+		req := new(dns.Msg)
+		req.SetQuestion(n, dns.TypeA)
+		resp, err := u.resolve(req, depth+1)
+		if err != nil {
+			log.Tracef("Failed to resolve the name server %s: %s", n, err)
+			continue
+		}
+
+		var addrs []string
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, net.JoinHostPort(a.A.String(), u.port))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+
+	return nil, errNoServers
+}
+
+// exchangeServers sends the query to the servers one by one until one of them
+// responds
+func (u *minimizingUpstream) exchangeServers(servers []string, m *dns.Msg) (*dns.Msg, error) {
+	var err error
+	for _, s := range servers {
+		p := &plainDNS{address: s, timeout: u.timeout}
+
+		var resp *dns.Msg
+		resp, err = p.Exchange(m)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// newMinimizedQuery creates the NS query for the minimized name
+func newMinimizedQuery(name string) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeNS)
+	q.RecursionDesired = false
+	return q
+}
+
+// childName returns the last n labels of the name
+func childName(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
@@ -0,0 +1,163 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testAuthServer is a stub authoritative server that records the queries
+type testAuthServer struct {
+	handler func(q dns.Question) *dns.Msg // returns the response to the query
+
+	queries []string // received queries in the "name type" form
+	mu      sync.Mutex
+}
+
+func (s *testAuthServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+
+	s.mu.Lock()
+	s.queries = append(s.queries, q.Name+" "+dns.TypeToString[q.Qtype])
+	s.mu.Unlock()
+
+	resp := s.handler(q)
+	rcode := resp.Rcode
+	resp.SetReply(req)
+	resp.Rcode = rcode
+	_ = w.WriteMsg(resp)
+}
+
+func (s *testAuthServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.queries...)
+}
+
+// testReferral creates a referral to the child zone served by ip
+func testReferral(child string, ip string) *dns.Msg {
+	ns := "ns." + child
+	resp := new(dns.Msg)
+	resp.Ns = []dns.RR{newTestRR("%s 3600 IN NS %s", child, ns)}
+	resp.Extra = []dns.RR{newTestRR("%s 3600 IN A %s", ns, ip)}
+	return resp
+}
+
+func newTestRR(format string, args ...interface{}) dns.RR {
+	rr, err := dns.NewRR(fmt.Sprintf(format, args...))
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// startTestAuthServers starts the servers on the same port of 127.0.0.1,
+// 127.0.0.2 and so on.  It returns the port and the function that stops the
+// servers.
+func startTestAuthServers(t *testing.T, servers []*testAuthServer) (string, func()) {
+	var port string
+	var running []*dns.Server
+	closeAll := func() {
+		for _, srv := range running {
+			_ = srv.Shutdown()
+		}
+	}
+	for i, s := range servers {
+		addr := net.JoinHostPort(net.IPv4(127, 0, 0, byte(i+1)).String(), port)
+		if port == "" {
+			addr = "127.0.0.1:0"
+		}
+
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			closeAll()
+			t.Skipf("cannot listen on %s: %s", addr, err)
+		}
+		if port == "" {
+			_, port, _ = net.SplitHostPort(pc.LocalAddr().String())
+		}
+
+		started := make(chan struct{})
+		srv := &dns.Server{PacketConn: pc, Handler: s, NotifyStartedFunc: func() { close(started) }}
+		go func() { _ = srv.ActivateAndServe() }()
+		<-started
+		running = append(running, srv)
+	}
+
+	return port, closeAll
+}
+
+func TestMinimizingUpstream(t *testing.T) {
+	root := &testAuthServer{handler: func(q dns.Question) *dns.Msg {
+		return testReferral("org.", "127.0.0.2")
+	}}
+	org := &testAuthServer{handler: func(q dns.Question) *dns.Msg {
+		return testReferral("example.org.", "127.0.0.3")
+	}}
+	example := &testAuthServer{handler: func(q dns.Question) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.Authoritative = true
+		soa := newTestRR("example.org. 3600 IN SOA ns.example.org. hostmaster.example.org. 1 3600 600 86400 60")
+		switch {
+		case q.Name == "www.sub.example.org." && q.Qtype == dns.TypeA:
+			resp.Answer = []dns.RR{newTestRR("www.sub.example.org. 60 IN A 1.2.3.4")}
+		case q.Name == "sub.example.org.":
+			// Empty non-terminal
+			resp.Ns = []dns.RR{soa}
+		case q.Name == "strict.example.org.":
+			// Broken server that doesn't like minimized queries
+			resp.Rcode = dns.RcodeRefused
+		default:
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = []dns.RR{soa}
+		}
+		return resp
+	}}
+
+	port, closeServers := startTestAuthServers(t, []*testAuthServer{root, org, example})
+	defer closeServers()
+
+	u, err := NewMinimizingUpstream([]string{"127.0.0.1:" + port}, Options{Timeout: timeout})
+	assert.Nil(t, err)
+	u.(*minimizingUpstream).port = port
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.sub.example.org.", dns.TypeA)
+	resp, err := u.Exchange(req)
+	if err != nil {
+		t.Fatalf("cannot resolve: %s", err)
+	}
+	assert.Equal(t, req.Id, resp.Id)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "1.2.3.4", resp.Answer[0].(*dns.A).A.String())
+	}
+
+	// Every server only gets the labels it needs
+	assert.Equal(t, []string{"org. NS"}, root.received())
+	assert.Equal(t, []string{"example.org. NS"}, org.received())
+	assert.Equal(t, []string{"sub.example.org. NS", "www.sub.example.org. A"}, example.received())
+
+	// Nothing is asked below the name that doesn't exist
+	req.SetQuestion("www.nope.example.org.", dns.TypeA)
+	resp, err = u.Exchange(req)
+	if err != nil {
+		t.Fatalf("cannot resolve: %s", err)
+	}
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Equal(t, "nope.example.org. NS", example.received()[2])
+	assert.Len(t, example.received(), 3)
+
+	// The full name is sent if the minimized query fails
+	req.SetQuestion("www.strict.example.org.", dns.TypeA)
+	_, err = u.Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"strict.example.org. NS", "www.strict.example.org. A"}, example.received()[3:])
+
+	_, err = NewMinimizingUpstream([]string{"example.org"}, Options{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"context"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// Key is the question the override upstream answers with the fixed records.
+// The name is case-insensitive, the trailing dot is optional.
+type Key struct {
+	Name  string
+	Qtype uint16
+}
+
+// overrideUpstream answers the overridden questions with the fixed records and
+// forwards everything else to the fallback upstream
+type overrideUpstream struct {
+	overrides map[Key][]dns.RR // records by the normalized key
+	fallback  Upstream         // used for the queries that don't match, may be nil
+
+	exchanges exchangeTracker // Exchange calls in progress
+}
+
+// NewOverrideUpstream creates a new Upstream that answers the queries matching
+// the overrides with an authoritative response containing the records, and
+// forwards all other queries to fallback.  It's useful for the split-horizon
+// setups, e.g. to return the internal address of a public host name.  The
+// records are sent with their own TTLs, the owner name is replaced with the
+// name from the query.  An empty list of records means an empty NOERROR
+// response.  If fallback is nil, the queries that don't match are answered
+// with NXDOMAIN.
+func NewOverrideUpstream(overrides map[Key][]dns.RR, fallback Upstream) Upstream {
+	u := &overrideUpstream{
+		overrides: map[Key][]dns.RR{},
+		fallback:  fallback,
+	}
+	for k, rrs := range overrides {
+		k.Name = proxyutil.HostsName(k.Name)
+		u.overrides[k] = append(u.overrides[k], rrs...)
+	}
+	return u
+}
+
+func (u *overrideUpstream) Address() string { return "override" }
+
+func (u *overrideUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if err := u.exchanges.begin(); err != nil {
+		return nil, err
+	}
+	defer u.exchanges.end()
+
+	if len(m.Question) != 1 || m.Question[0].Qclass != dns.ClassINET {
+		return u.forward(m)
+	}
+
+	q := m.Question[0]
+	rrs, ok := u.overrides[Key{Name: proxyutil.HostsName(q.Name), Qtype: q.Qtype}]
+	if !ok {
+		return u.forward(m)
+	}
+
+	reply := new(dns.Msg).SetReply(m)
+	reply.Authoritative = true
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		reply.Answer = append(reply.Answer, rr)
+	}
+	return reply, nil
+}
+
+// forward sends the query to the fallback upstream
+func (u *overrideUpstream) forward(m *dns.Msg) (*dns.Msg, error) {
+	if u.fallback == nil {
+		return new(dns.Msg).SetRcode(m, dns.RcodeNameError), nil
+	}
+	return u.fallback.Exchange(m)
+}
+
+// Close implements the Closer interface for *overrideUpstream
+func (u *overrideUpstream) Close() error { return u.exchanges.close(u.release) }
+
+// Shutdown implements the Closer interface for *overrideUpstream
+func (u *overrideUpstream) Shutdown(ctx context.Context) error {
+	return u.exchanges.shutdown(ctx, u.release)
+}
+
+// release closes the fallback upstream
+func (u *overrideUpstream) release() error {
+	if c, ok := u.fallback.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
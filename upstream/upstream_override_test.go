@@ -0,0 +1,67 @@
+package upstream
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverrideUpstream(t *testing.T) {
+	var forwarded int32
+	fallback := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&forwarded, 1)
+		res := new(dns.Msg).SetReply(m)
+		if m.Question[0].Qtype == dns.TypeAAAA {
+			res.Answer = []dns.RR{newTestRR("%s 300 IN AAAA 2001:db8::1", m.Question[0].Name)}
+		}
+		return res, nil
+	})
+
+	u := NewOverrideUpstream(map[Key][]dns.RR{
+		{Name: "WWW.example.com", Qtype: dns.TypeA}:    {newTestRR("www.example.com. 30 IN A 10.0.0.1")},
+		{Name: "empty.example.com.", Qtype: dns.TypeA}: nil,
+	}, fallback)
+	assert.Equal(t, "override", u.Address())
+
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		res, err := u.Exchange(req)
+		if err != nil {
+			t.Fatalf("cannot exchange %s: %s", name, err)
+		}
+		assert.Equal(t, req.Id, res.Id)
+		return res
+	}
+
+	// The override wins, the name is case-insensitive and the TTL is kept
+	res := exchange("www.EXAMPLE.com.", dns.TypeA)
+	assert.True(t, res.Authoritative)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "10.0.0.1", res.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, "www.EXAMPLE.com.", res.Answer[0].Header().Name)
+		assert.Equal(t, uint32(30), res.Answer[0].Header().Ttl)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&forwarded))
+
+	// The empty override is an empty response
+	res = exchange("empty.example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Empty(t, res.Answer)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&forwarded))
+
+	// The type that isn't overridden falls through
+	res = exchange("www.example.com.", dns.TypeAAAA)
+	assert.False(t, res.Authoritative)
+	if assert.Len(t, res.Answer, 1) {
+		assert.Equal(t, "2001:db8::1", res.Answer[0].(*dns.AAAA).AAAA.String())
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&forwarded))
+
+	// NXDOMAIN without the fallback
+	u = NewOverrideUpstream(nil, nil)
+	res = exchange("www.example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+}
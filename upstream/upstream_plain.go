@@ -1,9 +1,15 @@
 package upstream
 
 import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
 
@@ -11,9 +17,86 @@ import (
 // plain DNS
 //
 type plainDNS struct {
-	address   string
-	timeout   time.Duration
-	preferTCP bool
+	address     string
+	timeout     time.Duration
+	preferTCP   bool
+	noFallback  bool         // if true, the truncated responses aren't retried over TCP
+	followCNAME bool         // if true, the incomplete CNAME chains are followed
+	pipeline    *pipeline    // not nil if the queries are pipelined over a single TCP connection
+	stamp       *StampInfo   // not nil if the upstream was created from a DNS stamp
+	cookies     *dnsCookies  // not nil if DNS cookies are enabled
+	dial        dialHandler  // not nil if the connections are created by Options.DialContext or bound locally
+	query       queryOptions // applied to every query
+	udp         *udpSockets  // not nil if the queries are distributed across the shared UDP sockets
+	udpAddr     *net.UDPAddr // parsed address if it's an IP address, so that it's not resolved on every dial
+
+	// boot and pool are only used by the upstreams that only use TCP, pool
+	// is nil if the pool is disabled or the queries are pipelined
+	boot *bootstrapper
+	pool *tcpPool
+
+	exchanges exchangeTracker // Exchange calls in progress
+}
+
+// newPlainDNS creates a new plain DNS upstream
+func newPlainDNS(address string, opts Options) *plainDNS {
+	p := &plainDNS{
+		address:     address,
+		timeout:     opts.Timeout,
+		noFallback:  opts.DisableTCPFallback,
+		followCNAME: opts.FollowCNAME,
+		query:       newQueryOptions(&opts),
+	}
+	if opts.EnableDNSCookies {
+		p.cookies = newDNSCookies()
+	}
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		ip := net.ParseIP(host)
+		portNum, err := strconv.Atoi(port)
+		if ip != nil && err == nil {
+			p.udpAddr = &net.UDPAddr{IP: ip, Port: portNum}
+		}
+	}
+	if opts.DialContext != nil {
+		p.dial = opts.DialContext
+	} else if bindsLocally(opts) {
+		p.dial = newLocalDialHandler(opts)
+	}
+	if opts.UDPSockets > 0 {
+		p.udp = newUDPSockets(opts.UDPSockets, func() (net.Conn, error) {
+			ctx := context.Background()
+			if opts.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+				defer cancel()
+			}
+			return p.dialUDP(ctx)
+		}, opts.Timeout)
+	}
+	return p
+}
+
+// newPlainDNSOverTCP creates a new plain DNS upstream that only uses TCP.  The
+// hostname is resolved with the bootstrap resolvers.
+func newPlainDNSOverTCP(address string, opts Options) (*plainDNS, error) {
+	b, err := urlToBoot("tcp://"+address, opts)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't create tcp bootstrapper")
+	}
+
+	p := newPlainDNS(address, opts)
+	p.preferTCP = true
+	p.udp = nil // the queries are never sent over UDP
+	p.boot = b
+	if opts.Pipelining {
+		p.pipeline = &pipeline{
+			dial:    (&tcpPool{boot: b}).dial,
+			timeout: opts.Timeout,
+		}
+	} else if !opts.DisablePool {
+		p.pool = newTCPPool(b)
+	}
+	return p, nil
 }
 
 // Address returns the original address that we've put in initially, not resolved one
@@ -24,28 +107,368 @@ func (p *plainDNS) Address() string {
 	return p.address
 }
 
+// Properties returns the information from the DNS stamp the upstream was created
+// from, or nil if it wasn't created from a stamp
+func (p *plainDNS) Properties() *StampInfo { return p.stamp }
+
+// WithOptions implements the Cloner interface for *plainDNS
+func (p *plainDNS) WithOptions(opts *Options) (Upstream, error) {
+	return cloneUpstream(p.Address(), nil, p.stamp, opts)
+}
 func (p *plainDNS) Exchange(m *dns.Msg) (*dns.Msg, error) {
-	if p.preferTCP {
-		tcpClient := dns.Client{Net: "tcp", Timeout: p.timeout}
+	return followCNAME(p.followCNAME, p.exchangeTraced)(m, nil)
+}
+
+// ExchangeWithInfo implements the InfoExchanger interface for *plainDNS
+func (p *plainDNS) ExchangeWithInfo(m *dns.Msg) (*dns.Msg, *ExchangeInfo, error) {
+	return traceExchange(m, followCNAME(p.followCNAME, p.exchangeTraced))
+}
+
+// exchangeTraced sends the query and records the details to tr
+func (p *plainDNS) exchangeTraced(m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
+	return p.exchangeContext(context.Background(), m, tr)
+}
+
+// exchangeContext implements the contextExchanger interface for *plainDNS.  The
+// exchange ends once ctx is done, except for the pipelined queries and the ones
+// sent over the shared UDP sockets.
+func (p *plainDNS) exchangeContext(ctx context.Context, m *dns.Msg, tr *exchangeTrace) (reply *dns.Msg, err error) {
+	m, finish, err := prepareQuery(&p.exchanges, m, p.query, tr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { reply, err = finish(reply, err) }()
+
+	m = limitUDPSize(m, p.query.maxSize)
+	if p.cookies == nil {
+		return p.exchange(ctx, m, tr)
+	}
+
+	// The server responds with BADCOOKIE and its new cookie if the one we've
+	// sent is outdated, retry once with the new cookie
+	for i := 0; i < 2; i++ {
+		req, addedOPT := p.cookies.attach(m)
+		reply, err := p.exchange(ctx, req, tr)
+		if err != nil {
+			return nil, err
+		}
+
+		if reply.Rcode == dns.RcodeBadCookie {
+			log.Tracef("%s: BADCOOKIE received, retrying with the new server cookie", p.Address())
+			err = p.cookies.update(reply, false)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		err = p.cookies.update(reply, addedOPT)
+		if err != nil {
+			return nil, err
+		}
+		return reply, nil
+	}
+
+	return nil, errors.New("server rejected the DNS cookie")
+}
+
+// exchange sends the query and returns the response
+func (p *plainDNS) exchange(ctx context.Context, m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
+	if p.pipeline != nil {
 		logBegin(p.Address(), m)
-		reply, _, tcpErr := tcpClient.Exchange(m, p.address)
-		logFinish(p.Address(), tcpErr)
-		return reply, tcpErr
+		reply, err := p.pipeline.exchange(m, tr)
+		logFinish(p.Address(), err)
+		return reply, err
 	}
 
-	client := dns.Client{Timeout: p.timeout, UDPSize: dns.MaxMsgSize}
+	if p.preferTCP {
+		logBegin(p.Address(), m)
+		reply, err := p.exchangeTCP(ctx, m, tr)
+		logFinish(p.Address(), err)
+		return reply, err
+	}
 
 	logBegin(p.Address(), m)
-	reply, _, err := client.Exchange(m, p.address)
+	var reply *dns.Msg
+	var err error
+	if p.udp != nil {
+		reply, err = p.udp.exchange(m, tr)
+	} else {
+		reply, err = p.exchangeUDP(ctx, m, tr)
+	}
+	if err == nil {
+		err = VerifyResponse(m, reply)
+	}
 	logFinish(p.Address(), err)
+	if err != nil {
+		return nil, err
+	}
 
-	if reply != nil && reply.Truncated {
+	if reply.Truncated && !p.noFallback {
 		log.Tracef("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
-		tcpClient := dns.Client{Net: "tcp", Timeout: p.timeout}
 		logBegin(p.Address(), m)
-		reply, _, err = tcpClient.Exchange(m, p.address)
+		reply, err = p.exchangeNewTCP(ctx, m, tr)
 		logFinish(p.Address(), err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return reply, nil
+}
+
+// exchangeUDP sends the query over a new UDP connection and reads the response
+// into a pooled buffer
+func (p *plainDNS) exchangeUDP(ctx context.Context, m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	conn, err := p.dialUDP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer interruptOnDone(ctx, conn)()
+
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	// Options.DialContext might return a stream connection, the messages
+	// have the length prefix then as with dns.Conn
+	if _, ok := conn.(net.PacketConn); !ok {
+		var n int
+		n, err = writePrefixedMsg(conn, m)
+		if err != nil {
+			return nil, err
+		}
+		tr.wroteQuery("udp", conn.RemoteAddr(), n)
+		reply, n, err := readPrefixedMsg(conn)
+		if err == nil {
+			tr.readResponse(time.Time{}, n)
+		}
+		return reply, err
+	}
+
+	bufPtr := bytesPool.Get().(*[]byte)
+	defer bytesPool.Put(bufPtr)
+	buf := *bufPtr
+
+	b, err := m.PackBuffer(buf)
+	if err != nil {
+		return nil, err
+	}
+	tr.wroteQuery("udp", conn.RemoteAddr(), len(b))
+	_, err = conn.Write(b)
+	if err != nil {
+		return nil, err
 	}
 
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := proxyutil.UnpackMsg(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		// Just like dns.Client, ignore the mismatched responses and keep
+		// reading until the deadline
+		err = VerifyResponse(m, reply)
+		if err != nil {
+			log.Tracef("Dropping response from %s: %s", p.Address(), err)
+			continue
+		}
+		tr.readResponse(time.Time{}, n)
+		return reply, nil
+	}
+}
+
+// exchangeNewTCP sends the query over a new TCP connection to the address of
+// the UDP upstream
+func (p *plainDNS) exchangeNewTCP(ctx context.Context, m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	dial := p.dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", p.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer interruptOnDone(ctx, conn)()
+
+	return p.exchangeTCPConn(conn, m, tr, deadline)
+}
+
+// interruptOnDone interrupts the reads and writes on conn once ctx is done.
+// The returned function stops watching ctx, the connection is left alone after
+// it returns, so it can be pooled.
+func interruptOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	stopped := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-stopped:
+		}
+	}()
+	return func() {
+		close(stopped)
+		<-exited
+	}
+}
+
+// ExchangeWire implements the WireExchanger interface for *plainDNS.  The query
+// is relayed as is unless one of the options that modify the messages is set
+// or the queries are pipelined or sent over the shared UDP sockets.
+func (p *plainDNS) ExchangeWire(req []byte) (reply []byte, err error) {
+	if !p.relaysWire() {
+		return exchangeWireMsg(p.Exchange, req)
+	}
+	if _, err = wireQuestionEnd(req); err != nil {
+		return nil, err
+	}
+
+	if err = p.exchanges.begin(); err != nil {
+		return nil, err
+	}
+	defer p.exchanges.end()
+
+	logBeginWire(p.Address(), req)
+	if p.preferTCP {
+		reply, err = p.exchangeTCPWire(req)
+	} else {
+		reply, err = p.exchangeUDPWire(req)
+		if err == nil && isTruncatedWire(reply) && !p.noFallback {
+			log.Tracef("Truncated message was received from %s, retrying over TCP", p.Address())
+			reply, err = p.exchangeNewTCPWire(req)
+		}
+	}
+	logFinish(p.Address(), err)
 	return reply, err
 }
+
+// relaysWire returns true if the queries in the wire format can be sent as is
+func (p *plainDNS) relaysWire() bool {
+	return p.cookies == nil && !p.followCNAME && len(p.query.ednsOptions) == 0 && p.query.forceRD == nil &&
+		p.query.compress == nil && p.query.maxSize <= 0 && p.pipeline == nil && p.udp == nil
+}
+
+// exchangeUDPWire is exchangeUDP for the query in the wire format
+func (p *plainDNS) exchangeUDPWire(req []byte) ([]byte, error) {
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	conn, err := p.dialUDP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, ok := conn.(net.PacketConn); !ok {
+		return exchangeStreamWire(conn, req, p.timeout)
+	}
+
+	var deadline time.Time
+	if p.timeout > 0 {
+		deadline = time.Now().Add(p.timeout)
+	}
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	bufPtr := bytesPool.Get().(*[]byte)
+	defer bytesPool.Put(bufPtr)
+	for {
+		n, err := conn.Read(*bufPtr)
+		if err != nil {
+			return nil, err
+		}
+
+		// Just like dns.Client, ignore the mismatched responses and keep
+		// reading until the deadline
+		reply := (*bufPtr)[:n]
+		err = verifyWireResponse(req, reply)
+		if err != nil {
+			log.Tracef("Dropping response from %s: %s", p.Address(), err)
+			continue
+		}
+		return append([]byte(nil), reply...), nil
+	}
+}
+
+// exchangeNewTCPWire sends the query in the wire format over a new TCP
+// connection to the address of the UDP upstream
+func (p *plainDNS) exchangeNewTCPWire(req []byte) ([]byte, error) {
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	dial := p.dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", p.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return exchangeStreamWire(conn, req, p.timeout)
+}
+
+// Close implements the Closer interface for *plainDNS
+func (p *plainDNS) Close() error { return p.exchanges.close(p.release) }
+
+// Shutdown implements the Closer interface for *plainDNS
+func (p *plainDNS) Shutdown(ctx context.Context) error {
+	return p.exchanges.shutdown(ctx, p.release)
+}
+
+// release closes the pooled and pipelined connections and the shared UDP
+// sockets, if any
+func (p *plainDNS) release() error {
+	if p.pipeline != nil {
+		p.pipeline.close()
+	}
+	if p.udp != nil {
+		p.udp.closeAll()
+	}
+	if p.pool != nil {
+		p.pool.closeAll()
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// maxTCPIdleConns is the maximum number of the idle connections tcpPool keeps,
+// the connections returned to the full pool are closed
+const maxTCPIdleConns = 16
+
+// tcpIdleTimeout is how long tcpPool keeps an idle connection.  The servers
+// usually close the idle connections within seconds (RFC 7766), so the older
+// ones would most likely fail anyway.
+const tcpIdleTimeout = 10 * time.Second
+
+// tcpPool keeps the idle connections of a plain DNS-over-TCP upstream so that
+// the queries don't need a new connection every time
+type tcpPool struct {
+	boot *bootstrapper
+
+	maxIdle     int           // maximum number of the idle connections
+	idleTimeout time.Duration // the connections idle for longer are closed
+
+	conns []pooledConn // from the oldest to the newest
+	mu    sync.Mutex   // protects conns
+}
+
+// newTCPPool creates the pool of the connections to the bootstrapped address
+func newTCPPool(boot *bootstrapper) *tcpPool {
+	return &tcpPool{
+		boot:        boot,
+		maxIdle:     maxTCPIdleConns,
+		idleTimeout: tcpIdleTimeout,
+	}
+}
+
+// get returns an idle connection or dials a new one that is connected before
+// the deadline if it's not zero.  pooled is true if the connection was idle,
+// the server might have closed it already then.
+func (n *tcpPool) get(deadline time.Time) (conn net.Conn, pooled bool, err error) {
+	n.mu.Lock()
+	// The connections are put in order, so the expired ones come first
+	expired := 0
+	for expired < len(n.conns) && time.Since(n.conns[expired].idleSince) >= n.idleTimeout {
+		expired++
+	}
+	stale := append([]pooledConn(nil), n.conns[:expired]...)
+	n.conns = n.conns[:copy(n.conns, n.conns[expired:])]
+	if l := len(n.conns); l > 0 {
+		conn = n.conns[l-1].conn
+		n.conns = n.conns[:l-1]
+	}
+	n.mu.Unlock()
+
+	for _, pc := range stale {
+		log.Tracef("Closing the connection to %s idle for longer than %s", pc.conn.RemoteAddr(), n.idleTimeout)
+		_ = pc.conn.Close()
+	}
+
+	if conn != nil {
+		return conn, true, nil
+	}
+
+	conn, err = n.dialUntil(deadline)
+	return conn, false, err
+}
+
+// dial creates a new connection to the bootstrapped address, the bootstrap
+// lookup and the dialing take no longer than the timeout together
+func (n *tcpPool) dial() (net.Conn, error) {
+	var deadline time.Time
+	if n.boot.options.Timeout > 0 {
+		deadline = time.Now().Add(n.boot.options.Timeout)
+	}
+	return n.dialUntil(deadline)
+}
+
+// dialUntil creates a new connection to the bootstrapped address, the
+// bootstrap lookup and the dialing end by the deadline if it's not zero
+func (n *tcpPool) dialUntil(deadline time.Time) (net.Conn, error) {
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	_, dialContext, err := n.boot.getContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialContext(ctx, "tcp", "")
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to connect to %s", n.boot.address)
+	}
+	return conn, nil
+}
+
+// put returns the connection to the pool, it's closed if the pool is full
+func (n *tcpPool) put(conn net.Conn) {
+	n.mu.Lock()
+	full := len(n.conns) >= n.maxIdle
+	if !full {
+		n.conns = append(n.conns, pooledConn{conn: conn, idleSince: time.Now()})
+	}
+	n.mu.Unlock()
+
+	if full {
+		_ = conn.Close()
+	}
+}
+
+// closeAll closes all the idle connections
+func (n *tcpPool) closeAll() {
+	n.mu.Lock()
+	conns := n.conns
+	n.conns = nil
+	n.mu.Unlock()
+
+	for _, pc := range conns {
+		_ = pc.conn.Close()
+	}
+}
+
+// exchangeTCP sends the query over a pooled TCP connection, or over a new one
+// if the pool is disabled
+func (p *plainDNS) exchangeTCP(ctx context.Context, m *dns.Msg, tr *exchangeTrace) (reply *dns.Msg, err error) {
+	err = p.withTCPConn(ctx, tr, func(conn net.Conn, deadline time.Time) error {
+		reply, err = p.exchangeTCPConn(conn, m, tr, deadline)
+		return err
+	})
+	return reply, err
+}
+
+// exchangeTCPWire is exchangeTCP for the query in the wire format
+func (p *plainDNS) exchangeTCPWire(req []byte) (reply []byte, err error) {
+	err = p.withTCPConn(context.Background(), nil, func(conn net.Conn, deadline time.Time) error {
+		err = conn.SetDeadline(deadline)
+		if err == nil {
+			reply, err = exchangeStreamWire(conn, req, 0)
+		}
+		if err != nil {
+			_ = conn.Close()
+		}
+		return err
+	})
+	return reply, err
+}
+
+// withTCPConn calls exchange with a pooled TCP connection, or with a new one if
+// the pool is disabled.  exchange closes the connection if it fails.  The
+// whole exchange, including the retry over a new connection, ends by the
+// deadline passed to exchange if the timeout is set or ctx has one, and is
+// interrupted once ctx is done.
+func (p *plainDNS) withTCPConn(ctx context.Context, tr *exchangeTrace, exchange func(conn net.Conn, deadline time.Time) error) error {
+	deadline, _ := ctx.Deadline()
+	if p.timeout > 0 {
+		if d := time.Now().Add(p.timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	exchangeCtx := func(conn net.Conn) error {
+		defer interruptOnDone(ctx, conn)()
+		return exchange(conn, deadline)
+	}
+
+	if p.pool == nil {
+		conn, err := newTCPPool(p.boot).dialUntil(deadline)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		return exchangeCtx(conn)
+	}
+
+	conn, pooled, err := p.pool.get(deadline)
+	if err != nil {
+		return err
+	}
+
+	err = exchangeCtx(conn)
+	if err != nil && pooled && ctx.Err() == nil && (deadline.IsZero() || time.Now().Before(deadline)) {
+		// The server might have closed the idle connection, retry over a new
+		// one since the other pooled connections might be closed as well.
+		// The retry only gets the rest of the time.
+		log.Tracef("The pooled TCP connection to %s is expired due to %s", p.Address(), err)
+		conn, err = p.pool.dialUntil(deadline)
+		if err != nil {
+			return err
+		}
+		tr.reconnect()
+		err = exchangeCtx(conn)
+	}
+	if err != nil {
+		return err
+	}
+
+	p.pool.put(conn)
+	return nil
+}
+
+// exchangeTCPConn sends the query over the connection and reads the response
+// by the deadline if it's not zero, the connection is closed if it fails
+func (p *plainDNS) exchangeTCPConn(conn net.Conn, m *dns.Msg, tr *exchangeTrace, deadline time.Time) (*dns.Msg, error) {
+	var n int
+	err := conn.SetDeadline(deadline)
+	if err == nil {
+		n, err = writePrefixedMsg(conn, m)
+	}
+	var reply *dns.Msg
+	if err == nil {
+		tr.wroteQuery("tcp", conn.RemoteAddr(), n)
+		reply, n, err = readPrefixedMsg(conn)
+	}
+	if err == nil {
+		tr.readResponse(time.Time{}, n)
+	}
+	if err == nil {
+		err = VerifyResponse(m, reply)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return reply, nil
+}
@@ -1,12 +1,25 @@
 package upstream
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestDNSTruncated(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	// AdGuard DNS
 	address := "94.140.14.14:53"
 	// Google DNS
@@ -30,3 +43,671 @@ func TestDNSTruncated(t *testing.T) {
 		t.Fatalf("response must NOT be truncated")
 	}
 }
+
+func TestDNSTCPFallback(t *testing.T) {
+	var udpQueries, tcpQueries int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg).SetReply(r)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			atomic.AddInt32(&udpQueries, 1)
+			resp.Truncated = true
+		} else {
+			atomic.AddInt32(&tcpQueries, 1)
+			resp.Answer = []dns.RR{newTestRR("%s 60 IN A 192.0.2.1", r.Question[0].Name)}
+		}
+		_ = w.WriteMsg(resp)
+	})
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	tcpSrv := &dns.Server{Listener: tcpListener, Handler: handler}
+	go func() { _ = tcpSrv.ActivateAndServe() }()
+	defer tcpSrv.Shutdown()
+
+	udpConn, err := net.ListenPacket("udp", tcpListener.Addr().String())
+	assert.Nil(t, err)
+	udpSrv := &dns.Server{PacketConn: udpConn, Handler: handler}
+	go func() { _ = udpSrv.ActivateAndServe() }()
+	defer udpSrv.Shutdown()
+
+	addr := tcpListener.Addr().String()
+	u, err := AddressToUpstream(addr, Options{Timeout: timeout})
+	assert.Nil(t, err)
+	res, err := u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.False(t, res.Truncated)
+	assert.Len(t, res.Answer, 1)
+
+	u, err = AddressToUpstream(addr, Options{Timeout: timeout, DisableTCPFallback: true})
+	assert.Nil(t, err)
+	res, err = u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.True(t, res.Truncated)
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&udpQueries))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tcpQueries))
+}
+
+func TestDNSQuestionMismatch(t *testing.T) {
+	// Prepare a stub server that answers a different question
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			req := r.Copy()
+			req.Question[0].Name = "example.org."
+
+			res := new(dns.Msg)
+			res.SetReply(req)
+			_ = w.WriteMsg(res)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	// The mismatched response is ignored until the timeout
+	u, err := AddressToUpstream(conn.LocalAddr().String(), Options{Timeout: 200 * time.Millisecond})
+	assert.Nil(t, err)
+
+	req := createTestMessage()
+	res, err := u.Exchange(req)
+	if assert.NotNil(t, err) {
+		netErr, ok := err.(net.Error)
+		assert.True(t, ok && netErr.Timeout(), err.Error())
+	}
+	assert.Nil(t, res)
+}
+
+func TestDNSCompress(t *testing.T) {
+	// Prepare a stub server that saves the raw query bytes
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	packets := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			packet := make([]byte, n)
+			copy(packet, b)
+			packets <- packet
+
+			req := new(dns.Msg)
+			_ = req.Unpack(packet)
+			res := new(dns.Msg)
+			res.SetReply(req)
+			buf, _ := res.Pack()
+			_, _ = conn.WriteTo(buf, addr)
+		}
+	}()
+
+	enabled, disabled := true, false
+	testCases := []struct {
+		option  *bool
+		request bool // dns.Msg.Compress of the request
+		want    bool
+	}{
+		{nil, false, false},
+		{nil, true, true},
+		{&enabled, false, true},
+		{&disabled, true, false},
+	}
+
+	for _, tc := range testCases {
+		u, err := AddressToUpstream(conn.LocalAddr().String(), Options{Timeout: timeout, Compress: tc.option})
+		assert.Nil(t, err)
+
+		// The additional record has the same name as the question, so
+		// it can only be packed with a pointer if compression is enabled
+		req := createTestMessage()
+		req.Extra = append(req.Extra, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IP{1, 2, 3, 4},
+		})
+		req.Compress = tc.request
+
+		_, err = u.Exchange(req)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.request, req.Compress)
+
+		packet := <-packets
+		// Pointer to the question name right after the header
+		pointer := []byte{0xC0, 12}
+		assert.Equal(t, tc.want, bytes.Contains(packet[12:], pointer))
+	}
+}
+
+func TestDNSMaxResponseSize(t *testing.T) {
+	var advertised uint32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if opt := r.IsEdns0(); opt != nil {
+			atomic.StoreUint32(&advertised, uint32(opt.UDPSize()))
+		}
+
+		txt := make([]string, 10)
+		for i := range txt {
+			txt[i] = strings.Repeat("a", 200)
+		}
+		res := new(dns.Msg).SetReply(r)
+		res.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: txt,
+		}}
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			res.Truncate(dns.MinMsgSize)
+			if opt := r.IsEdns0(); opt != nil {
+				res.Truncate(int(opt.UDPSize()))
+			}
+		}
+		_ = w.WriteMsg(res)
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	tcpSrv := &dns.Server{Listener: l, Handler: handler}
+	go func() { _ = tcpSrv.ActivateAndServe() }()
+	defer tcpSrv.Shutdown()
+
+	// The truncated UDP responses are retried over TCP on the same port
+	conn, err := net.ListenPacket("udp", l.Addr().String())
+	assert.Nil(t, err)
+	udpSrv := &dns.Server{PacketConn: conn, Handler: handler}
+	go func() { _ = udpSrv.ActivateAndServe() }()
+	defer udpSrv.Shutdown()
+
+	exchange := func(addr string, maxSize int) (*dns.Msg, error) {
+		u, err := AddressToUpstream(addr, Options{Timeout: timeout, MaxResponseSize: maxSize})
+		if err != nil {
+			t.Fatalf("cannot create upstream: %s", err)
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeTXT)
+		req.SetEdns0(4096, false)
+		return u.Exchange(req)
+	}
+
+	// The response is about 2 KB
+	res, err := exchange("tcp://"+l.Addr().String(), 4096)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+
+	res, err = exchange("tcp://"+l.Addr().String(), 1024)
+	assert.Nil(t, res)
+	tooLarge, ok := err.(*ResponseTooLargeError)
+	if assert.True(t, ok, "unexpected error: %v", err) {
+		assert.Equal(t, 1024, tooLarge.MaxSize)
+		assert.True(t, tooLarge.Size > 1024)
+	}
+
+	// The advertised UDP payload size is limited too, so the server truncates
+	// the response and it's retried over TCP
+	res, err = exchange(conn.LocalAddr().String(), 1024)
+	assert.Nil(t, res)
+	assert.IsType(t, &ResponseTooLargeError{}, err)
+	assert.Equal(t, uint32(1024), atomic.LoadUint32(&advertised))
+}
+
+func TestDNSCookies(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	// The server cookie changes when the server rotates its secret
+	var mu sync.Mutex
+	serverCookie := "0102030405060708"
+	var received []string // server cookies received from the client
+	spoof := false
+
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			var cookie *dns.EDNS0_COOKIE
+			if opt := r.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+						cookie = c
+					}
+				}
+			}
+			if cookie == nil {
+				_ = w.WriteMsg(new(dns.Msg).SetRcode(r, dns.RcodeFormatError))
+				return
+			}
+
+			client, server := cookie.Cookie[:16], cookie.Cookie[16:]
+			received = append(received, server)
+			if spoof {
+				client = "ffffffffffffffff"
+			}
+
+			res := new(dns.Msg).SetReply(r)
+			if server != "" && server != serverCookie {
+				res.Rcode = dns.RcodeBadCookie
+			} else {
+				res.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(8, 8, 8, 8),
+				}}
+			}
+			res.SetEdns0(dns.DefaultMsgSize, false)
+			opt := res.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: client + serverCookie})
+			_ = w.WriteMsg(res)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	u, err := AddressToUpstream(conn.LocalAddr().String(), Options{Timeout: timeout, EnableDNSCookies: true})
+	assert.Nil(t, err)
+
+	getReceived := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, received...)
+	}
+
+	exchange := func() {
+		res, err := u.Exchange(createTestMessage())
+		if err != nil {
+			t.Fatalf("cannot exchange: %s", err)
+		}
+		assert.Len(t, res.Answer, 1)
+
+		// The request had no OPT, so the response mustn't have it either
+		assert.Nil(t, res.IsEdns0())
+	}
+
+	// The server cookie is sent after the first contact
+	exchange()
+	exchange()
+	assert.Equal(t, []string{"", "0102030405060708"}, getReceived())
+
+	// The new server cookie is used after BADCOOKIE
+	mu.Lock()
+	serverCookie = "1112131415161718"
+	mu.Unlock()
+	exchange()
+	assert.Equal(t, []string{"0102030405060708", "1112131415161718"}, getReceived()[2:])
+
+	// The response with someone else's client cookie is rejected
+	mu.Lock()
+	spoof = true
+	mu.Unlock()
+	_, err = u.Exchange(createTestMessage())
+	assert.Equal(t, errCookie, err)
+}
+
+func TestCustomDialContext(t *testing.T) {
+	var dialed []string
+	var mu sync.Mutex
+	dial := func(_ context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, network+" "+addr)
+		mu.Unlock()
+
+		// Serve the queries over an in-memory pipe
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			c := dns.Conn{Conn: server}
+			for {
+				req, err := c.ReadMsg()
+				if err != nil {
+					return
+				}
+				resp := new(dns.Msg).SetReply(req)
+				resp.Answer = []dns.RR{newTestRR("%s 60 IN A 192.0.2.2", req.Question[0].Name)}
+				_ = c.WriteMsg(resp)
+			}
+		}()
+		return client, nil
+	}
+
+	for _, addr := range []string{"192.0.2.1", "tcp://192.0.2.1"} {
+		u, err := AddressToUpstream(addr, Options{Timeout: timeout, DialContext: dial})
+		if err != nil {
+			t.Fatalf("cannot create upstream: %s", err)
+		}
+
+		req := createTestMessage()
+		reply, err := u.Exchange(req)
+		if err != nil {
+			t.Fatalf("%s: cannot exchange: %s", addr, err)
+		}
+		assert.Equal(t, req.Id, reply.Id)
+		if assert.Len(t, reply.Answer, 1) {
+			assert.Equal(t, "192.0.2.2", reply.Answer[0].(*dns.A).A.String())
+		}
+	}
+
+	// Encrypted upstreams dial the address the bootstrap has resolved
+	srv := startTestDoTServer(t, nil)
+	defer srv.Close()
+	u, err := AddressToUpstream("tls://dot.example", Options{
+		Timeout:            timeout,
+		InsecureSkipVerify: true,
+		ServerIPAddrs:      []net.IP{net.ParseIP("192.0.2.1")},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, network+" "+addr)
+			mu.Unlock()
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Addr)
+		},
+	})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	_, err = u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange over DoT: %s", err)
+	}
+	assert.Equal(t, 1, srv.Accepted())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"udp 192.0.2.1:53", "tcp 192.0.2.1:53", "tcp 192.0.2.1:853"}, dialed)
+
+	// DNS-over-QUIC can't use it
+	_, err = AddressToUpstream("quic://192.0.2.1", Options{Timeout: timeout, DialContext: dial})
+	assert.NotNil(t, err)
+}
+
+// countingListener counts the accepted connections
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, err
+}
+
+func TestDNSOverTCPOnly(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	l := &countingListener{Listener: tcpListener}
+	srv := &dns.Server{
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := new(dns.Msg).SetReply(r)
+			resp.Answer = []dns.RR{newTestRR("%s 60 IN A 192.0.2.1", r.Question[0].Name)}
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	// Count the UDP packets sent to the same port
+	conn, err := net.ListenPacket("udp", tcpListener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	var udpPackets int32
+	go func() {
+		b := make([]byte, dns.MaxMsgSize)
+		for {
+			_, _, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&udpPackets, 1)
+		}
+	}()
+
+	// The hostname is resolved with the bootstrap
+	_, port, _ := net.SplitHostPort(tcpListener.Addr().String())
+	u, err := AddressToUpstream("tcp://dns.example:"+port, Options{
+		Timeout:       timeout,
+		ServerIPAddrs: []net.IP{net.IPv4(127, 0, 0, 1)},
+	})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	defer u.(Closer).Close()
+
+	for i := 0; i < 3; i++ {
+		req := createTestMessage()
+		reply, err := u.Exchange(req)
+		if err != nil {
+			t.Fatalf("cannot exchange: %s", err)
+		}
+		assert.Equal(t, req.Id, reply.Id)
+	}
+
+	// The queries are sent over a single pooled connection
+	assert.Equal(t, int32(1), atomic.LoadInt32(&l.accepted))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&udpPackets))
+}
+
+func TestDNSOverTCPPoolLimits(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	l := &countingListener{Listener: tcpListener}
+	hang := make(chan struct{})
+	srv := &dns.Server{
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			switch r.Question[0].Name {
+			case "hang.example.":
+				// The pooled connection doesn't answer anymore
+				<-hang
+			case "slow.example.":
+				time.Sleep(50 * time.Millisecond)
+			}
+			_ = w.WriteMsg(new(dns.Msg).SetReply(r))
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+	defer close(hang)
+
+	const exchangeTimeout = time.Second
+	u, err := AddressToUpstream("tcp://"+tcpListener.Addr().String(), Options{Timeout: exchangeTimeout})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	defer u.(Closer).Close()
+	p := u.(*plainDNS)
+	p.pool.maxIdle = 2
+	p.pool.idleTimeout = 100 * time.Millisecond
+
+	// Only maxIdle of the concurrent connections are kept
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := u.Exchange(new(dns.Msg).SetQuestion("slow.example.", dns.TypeA))
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(4), atomic.LoadInt32(&l.accepted))
+	p.pool.mu.Lock()
+	assert.Len(t, p.pool.conns, 2)
+	p.pool.mu.Unlock()
+
+	// The connections idle for longer than idleTimeout are closed
+	time.Sleep(150 * time.Millisecond)
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&l.accepted))
+	p.pool.mu.Lock()
+	assert.Len(t, p.pool.conns, 1)
+	p.pool.mu.Unlock()
+
+	// The query that times out over the pooled connection isn't retried
+	// after the timeout
+	start := time.Now()
+	_, err = u.Exchange(new(dns.Msg).SetQuestion("hang.example.", dns.TypeA))
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < exchangeTimeout*3/2, time.Since(start).String())
+}
+
+func TestDNSUDPSockets(t *testing.T) {
+	const sockets = 4
+	const workers = 50
+	const queries = 20
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	// The server answers with the address encoded in the hostname after a
+	// random delay, so that the responses come out of order
+	var mu sync.Mutex
+	clients := map[string]bool{}
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			mu.Lock()
+			clients[w.RemoteAddr().String()] = true
+			mu.Unlock()
+
+			time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+
+			name := r.Question[0].Name
+			resp := new(dns.Msg).SetReply(r)
+			resp.Answer = []dns.RR{newTestRR("%s 60 IN A 192.0.%s", name, strings.TrimSuffix(name, ".example."))}
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	u, err := AddressToUpstream(conn.LocalAddr().String(), Options{Timeout: timeout, UDPSockets: sockets})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	defer u.(Closer).Close()
+
+	// All the queries have the same ID, so they only get the right response
+	// if the ID on the wire is unique
+	errs := make(chan error, workers)
+	wg := &sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < queries; j++ {
+				addr := fmt.Sprintf("%d.%d", i, j)
+				req := new(dns.Msg).SetQuestion(addr+".example.", dns.TypeA)
+				req.Id = 1
+
+				reply, err := u.Exchange(req)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if reply.Id != req.Id || len(reply.Answer) != 1 ||
+					reply.Answer[0].(*dns.A).A.String() != "192.0."+addr {
+					errs <- fmt.Errorf("wrong response to %s: %s", addr, reply)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("exchange failed: %s", err)
+	}
+
+	// The sockets are replaced after udpSocketMaxQueries queries
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, len(clients) >= workers*queries/udpSocketMaxQueries, "%d sockets", len(clients))
+}
+
+func TestDNSUDPSocketsMismatch(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	// The server sends the stray responses before the right one
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := new(dns.Msg).SetReply(r)
+			resp.Question[0].Name = "stray.example."
+			_ = w.WriteMsg(resp)
+
+			resp = new(dns.Msg).SetReply(r)
+			resp.Id++
+			_ = w.WriteMsg(resp)
+
+			resp = new(dns.Msg).SetReply(r)
+			resp.Answer = []dns.RR{newTestRR("%s 60 IN A 192.0.2.1", r.Question[0].Name)}
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	// Both the shared sockets and the socket per query skip them
+	for _, sockets := range []int{0, 1} {
+		u, err := AddressToUpstream(conn.LocalAddr().String(), Options{Timeout: timeout, UDPSockets: sockets})
+		if err != nil {
+			t.Fatalf("cannot create upstream: %s", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			reply, err := u.Exchange(createHostTestMessage("google-public-dns-a.google.com"))
+			if assert.Nil(t, err, "sockets: %d", sockets) {
+				assert.Len(t, reply.Answer, 1)
+			}
+		}
+		assert.Nil(t, u.(Closer).Close())
+	}
+}
+
+func BenchmarkExchangeUDP(b *testing.B) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("cannot listen: %s", err)
+	}
+	// The answer is parsed once, so that the allocations of the server don't
+	// hide the ones of the upstream
+	rr := newTestRR("%s 60 IN A 192.0.2.1", createTestMessage().Question[0].Name)
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := new(dns.Msg).SetReply(r)
+			resp.Answer = []dns.RR{rr}
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	u, err := AddressToUpstream(conn.LocalAddr().String(), Options{Timeout: timeout})
+	if err != nil {
+		b.Fatalf("cannot create upstream: %s", err)
+	}
+	req := createTestMessage()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = u.Exchange(req)
+		if err != nil {
+			b.Fatalf("cannot exchange: %s", err)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// errUDPSocketClosed is returned when the UDP socket has been closed or retired
+// before the query was sent.  It is safe to retry the query over a new socket
+// then.
+var errUDPSocketClosed = errors.New("udp socket is closed")
+
+// errUDPSocketFull is returned when there are no free message IDs left on the
+// UDP socket
+var errUDPSocketFull = errors.New("too many in-flight queries on the udp socket")
+
+// errUDPSocketRetired is the reason the UDP socket is closed after it has
+// sent udpSocketMaxQueries queries
+var errUDPSocketRetired = errors.New("udp socket is retired")
+
+// udpSocketMaxQueries is the number of queries sent over a shared UDP socket
+// before it's replaced with a new one, so that the source port changes from
+// time to time
+const udpSocketMaxQueries = 100
+
+// maxUDPReadErrors is the number of consecutive read errors after which the
+// shared UDP socket is closed.  A single error, e.g. ICMP port unreachable,
+// doesn't fail the queries in flight.
+const maxUDPReadErrors = 10
+
+// udpSockets distributes the queries of a plain DNS upstream across several
+// connected UDP sockets that stay open between the queries.  The sockets are
+// picked in turn and re-created when they're closed or retired.  Since every
+// socket keeps its source port for udpSocketMaxQueries queries, the responses
+// are easier to spoof than with a new socket per query.
+type udpSockets struct {
+	dial    func() (net.Conn, error) // creates a new connected socket
+	timeout time.Duration
+
+	next uint32 // the number of the sockets picked so far, accessed atomically
+
+	socks []*udpSocket
+	mu    sync.Mutex // protects socks
+}
+
+// newUDPSockets creates a new *udpSockets with count sockets, they're opened
+// on the first use
+func newUDPSockets(count int, dial func() (net.Conn, error), timeout time.Duration) *udpSockets {
+	return &udpSockets{
+		dial:    dial,
+		timeout: timeout,
+		socks:   make([]*udpSocket, count),
+	}
+}
+
+// get returns the next socket, it's opened if it's not yet or it's closed
+func (s *udpSockets) get() (*udpSocket, error) {
+	i := int(atomic.AddUint32(&s.next, 1) % uint32(len(s.socks)))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sock := s.socks[i]; sock != nil && sock.usable() {
+		return sock, nil
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	s.socks[i] = newUDPSocket(conn)
+	return s.socks[i], nil
+}
+
+// exchange sends the query over one of the sockets.  If the socket turns out
+// to be closed or retired before the query is sent, it retries once over
+// another one.
+func (s *udpSockets) exchange(m *dns.Msg, tr *exchangeTrace) (*dns.Msg, error) {
+	sock, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := sock.exchange(m, s.timeout, tr)
+	if err == errUDPSocketClosed {
+		log.Tracef("The UDP socket is closed, re-opening")
+
+		sock, err = s.get()
+		if err != nil {
+			return nil, err
+		}
+		tr.reconnect()
+		reply, err = sock.exchange(m, s.timeout, tr)
+	}
+
+	return reply, err
+}
+
+// closeAll closes all the sockets
+func (s *udpSockets) closeAll() {
+	s.mu.Lock()
+	socks := s.socks
+	s.socks = make([]*udpSocket, len(socks))
+	s.mu.Unlock()
+
+	for _, sock := range socks {
+		if sock != nil {
+			sock.close(ErrClosed)
+		}
+	}
+}
+
+// udpSocket is a connected UDP socket shared by the concurrent queries.  Every
+// query gets a unique ID on the wire which is mapped back to the original one
+// once the response is received by the reader goroutine.  The socket accepts
+// udpSocketMaxQueries queries and is closed once they're all answered or timed
+// out.
+type udpSocket struct {
+	conn net.Conn
+	done chan struct{} // closed when the socket is closed
+
+	pending map[uint16]*pipelineReq // queries waiting for the response, by the wire ID
+	queries int                     // the number of queries registered so far
+	err     error                   // the reason the socket was closed
+	mu      sync.Mutex              // protects pending, queries and err
+}
+
+// newUDPSocket creates a new *udpSocket and starts its reader goroutine
+func newUDPSocket(conn net.Conn) *udpSocket {
+	_ = conn.SetDeadline(time.Time{})
+
+	sock := &udpSocket{
+		conn:    conn,
+		done:    make(chan struct{}),
+		pending: map[uint16]*pipelineReq{},
+	}
+	go sock.readLoop()
+
+	return sock
+}
+
+// exchange sends the query over the socket and waits for the response.  The
+// message itself is not modified.
+func (sock *udpSocket) exchange(m *dns.Msg, timeout time.Duration, tr *exchangeTrace) (*dns.Msg, error) {
+	req := &pipelineReq{
+		msg:  m.Copy(),
+		resp: make(chan *pipelineResult, 1),
+	}
+
+	id, err := sock.register(req)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := sock.write(req.msg)
+	if err != nil {
+		sock.unregister(id)
+		return nil, err
+	}
+	tr.wroteQuery("udp", sock.conn.RemoteAddr(), n)
+
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case res := <-req.resp:
+		if res.err != nil {
+			return nil, res.err
+		}
+
+		// The reader has verified the response
+		tr.readResponse(res.received, res.size)
+		res.reply.Id = m.Id
+		return res.reply, nil
+	case <-timeoutCh:
+		sock.unregister(id)
+		return nil, &net.OpError{Op: "read", Net: "udp", Err: errTimeout}
+	}
+}
+
+// write sends the message and returns its size.  Options.DialContext might
+// return a stream connection, the messages have the length prefix then as with
+// dns.Conn.
+func (sock *udpSocket) write(m *dns.Msg) (int, error) {
+	if _, ok := sock.conn.(net.PacketConn); !ok {
+		return writePrefixedMsg(sock.conn, m)
+	}
+
+	bufPtr := bytesPool.Get().(*[]byte)
+	defer bytesPool.Put(bufPtr)
+
+	b, err := m.PackBuffer(*bufPtr)
+	if err != nil {
+		return 0, err
+	}
+	_, err = sock.conn.Write(b)
+	return len(b), err
+}
+
+// register assigns a unique wire ID to the request message and adds it to the
+// pending requests
+func (sock *udpSocket) register(req *pipelineReq) (uint16, error) {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+
+	if sock.err != nil || sock.queries >= udpSocketMaxQueries {
+		return 0, errUDPSocketClosed
+	}
+
+	if len(sock.pending) >= maxPipelineQueries {
+		return 0, errUDPSocketFull
+	}
+
+	id := dns.Id()
+	for {
+		if _, ok := sock.pending[id]; !ok {
+			break
+		}
+		id = dns.Id()
+	}
+
+	// The reader looks the message up under the lock, so the ID is set here
+	req.msg.Id = id
+	sock.pending[id] = req
+	sock.queries++
+	return id, nil
+}
+
+// unregister removes the request from the pending requests, the retired socket
+// is closed once there are none left
+func (sock *udpSocket) unregister(id uint16) {
+	sock.mu.Lock()
+	drained := sock.removeLocked(id)
+	sock.mu.Unlock()
+
+	if drained {
+		sock.close(errUDPSocketRetired)
+	}
+}
+
+// removeLocked removes the request from the pending requests and returns true
+// if the socket is retired and has no pending requests left.  sock.mu must be
+// locked.
+func (sock *udpSocket) removeLocked(id uint16) bool {
+	delete(sock.pending, id)
+	return sock.queries >= udpSocketMaxQueries && len(sock.pending) == 0
+}
+
+// usable returns true if the socket is neither closed nor retired
+func (sock *udpSocket) usable() bool {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+
+	return sock.err == nil && sock.queries < udpSocketMaxQueries
+}
+
+// isClosed returns true if the socket has been closed
+func (sock *udpSocket) isClosed() bool {
+	select {
+	case <-sock.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the socket and fails all pending queries with err
+func (sock *udpSocket) close(err error) {
+	sock.mu.Lock()
+	if sock.err != nil {
+		sock.mu.Unlock()
+		return
+	}
+	sock.err = err
+	pending := sock.pending
+	sock.pending = map[uint16]*pipelineReq{}
+	close(sock.done)
+	sock.mu.Unlock()
+
+	_ = sock.conn.Close()
+
+	log.Tracef("UDP socket to %s is closed: %s", sock.conn.RemoteAddr(), err)
+	for _, req := range pending {
+		req.resp <- &pipelineResult{err: err}
+	}
+}
+
+// readLoop reads the responses from the socket and dispatches them to the
+// waiting callers until the socket is closed
+func (sock *udpSocket) readLoop() {
+	_, packet := sock.conn.(net.PacketConn)
+
+	bufPtr := bytesPool.Get().(*[]byte)
+	defer bytesPool.Put(bufPtr)
+	buf := *bufPtr
+
+	readErrors := 0
+	for {
+		var reply *dns.Msg
+		var n int
+		var err error
+		if packet {
+			n, err = sock.conn.Read(buf)
+			if err == nil {
+				reply, err = proxyutil.UnpackMsg(buf[:n])
+				if err != nil {
+					log.Tracef("Dropping malformed response from %s: %s", sock.conn.RemoteAddr(), err)
+					continue
+				}
+			}
+		} else {
+			reply, n, err = readPrefixedMsg(sock.conn)
+		}
+		if err != nil {
+			// The read errors of a datagram socket, e.g. ICMP port
+			// unreachable, don't break it, the queries just time out
+			readErrors++
+			if packet && readErrors < maxUDPReadErrors && !sock.isClosed() {
+				log.Tracef("Reading from UDP socket to %s: %s", sock.conn.RemoteAddr(), err)
+				continue
+			}
+			sock.close(err)
+			return
+		}
+		readErrors = 0
+
+		sock.dispatch(reply, n)
+	}
+}
+
+// dispatch passes the response to the query it answers.  The responses that
+// don't pass VerifyResponse are dropped and the query keeps waiting, so that a
+// stray or spoofed packet doesn't fail it.
+func (sock *udpSocket) dispatch(reply *dns.Msg, n int) {
+	sock.mu.Lock()
+	req, ok := sock.pending[reply.Id]
+	var err error
+	if ok {
+		err = VerifyResponse(req.msg, reply)
+	}
+	drained := false
+	if ok && err == nil {
+		drained = sock.removeLocked(reply.Id)
+	}
+	sock.mu.Unlock()
+
+	if !ok {
+		// Most likely the query has already timed out
+		log.Tracef("Dropping unexpected response with ID %d from %s", reply.Id, sock.conn.RemoteAddr())
+		return
+	} else if err != nil {
+		log.Tracef("Dropping response with ID %d from %s: %s", reply.Id, sock.conn.RemoteAddr(), err)
+		return
+	}
+
+	req.resp <- &pipelineResult{reply: reply, received: time.Now(), size: n}
+	if drained {
+		sock.close(errUDPSocketRetired)
+	}
+}
+
+// dialUDP creates a new UDP connection to the upstream.  Connecting a UDP
+// socket doesn't block, so ctx only matters for the custom dialers.
+func (p *plainDNS) dialUDP(ctx context.Context) (net.Conn, error) {
+	if p.dial != nil {
+		return p.dial(ctx, "udp", p.address)
+	}
+	if p.udpAddr != nil {
+		conn, err := net.DialUDP("udp", nil, p.udpAddr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return (&net.Dialer{}).DialContext(ctx, "udp", p.address)
+}
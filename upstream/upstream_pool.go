@@ -3,6 +3,8 @@ package upstream
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
+	"math/rand"
 	"net"
 	"sync"
 	"time"
@@ -13,6 +15,9 @@ import (
 
 const dialTimeout = 10 * time.Second
 
+// defaultPoolIdleJitter is the default Options.PoolIdleJitter
+const defaultPoolIdleJitter = 0.1
+
 // TLSPool is a connections pool for the DNS-over-TLS Upstream.
 //
 // Example:
@@ -33,23 +38,97 @@ type TLSPool struct {
 	boot *bootstrapper
 
 	// connections
-	conns      []net.Conn
-	connsMutex sync.Mutex // protects conns
+	conns      []pooledConn
+	connsMutex sync.Mutex // protects conns, idleTimeout and hasIdleTimeout
+
+	// idleTimeout is the idle timeout the server has sent in the
+	// edns-tcp-keepalive option (RFC 7828).  The connections that are idle
+	// for longer are closed instead of being reused.
+	idleTimeout    time.Duration
+	hasIdleTimeout bool // false until the server sends the timeout
+
+	// slots has a value for every connection in use if their number is
+	// limited by Options.MaxPoolConns, nil until the first Get
+	slots chan struct{}
+}
+
+// PoolTimeoutError is returned by TLSPool.GetContext when all connections stay in use
+// until the context is done
+type PoolTimeoutError struct {
+	Address string // upstream address
+	Err     error  // context error
 }
 
-// Get gets or creates a new TLS connection
+func (e *PoolTimeoutError) Error() string {
+	return fmt.Sprintf("no free connection to %s: %s", e.Address, e.Err)
+}
+
+// Timeout implements the net.Error interface for *PoolTimeoutError
+func (e *PoolTimeoutError) Timeout() bool { return true }
+
+// Temporary implements the net.Error interface for *PoolTimeoutError
+func (e *PoolTimeoutError) Temporary() bool { return true }
+
+// Unwrap returns the context error
+func (e *PoolTimeoutError) Unwrap() error { return e.Err }
+
+// pooledConn is a connection in the pool
+type pooledConn struct {
+	conn      net.Conn
+	idleSince time.Time // when the connection was put to the pool
+	jitter    float64   // the fraction of the idle timeout the connection is evicted earlier
+}
+
+// evictAt returns when the connection idle since idleSince is evicted
+func (pc pooledConn) evictAt(idleTimeout time.Duration) time.Time {
+	return pc.idleSince.Add(idleTimeout - time.Duration(float64(idleTimeout)*pc.jitter))
+}
+
+// Get gets or creates a new TLS connection.  It's GetContext with the context
+// that is done after Options.Timeout if it's set.
 func (n *TLSPool) Get() (net.Conn, error) {
+	ctx := context.Background()
+	if n.boot.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.boot.options.Timeout)
+		defer cancel()
+	}
+	return n.GetContext(ctx)
+}
+
+// GetContext gets or creates a new TLS connection.  If Options.MaxPoolConns
+// connections are in use, it waits for one of them to be returned with Put
+// until ctx is done, and returns *PoolTimeoutError then.
+func (n *TLSPool) GetContext(ctx context.Context) (net.Conn, error) {
+	err := n.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	// get the connection from the slice inside the lock
 	var c net.Conn
+	var expired []net.Conn
 	n.connsMutex.Lock()
-	num := len(n.conns)
-	if num > 0 {
-		last := num - 1
-		c = n.conns[last]
+	idleTimeout := n.idleTimeout
+	for len(n.conns) > 0 {
+		last := len(n.conns) - 1
+		pc := n.conns[last]
 		n.conns = n.conns[:last]
+		if n.hasIdleTimeout && !time.Now().Before(pc.evictAt(idleTimeout)) {
+			expired = append(expired, pc.conn)
+			continue
+		}
+		c = pc.conn
+		break
 	}
 	n.connsMutex.Unlock()
 
+	// the server has most likely closed these connections already
+	for _, e := range expired {
+		log.Tracef("Closing the connection to %s idle for longer than %s", e.RemoteAddr(), idleTimeout)
+		_ = e.Close()
+	}
+
 	// if we got connection from the slice, update deadline and return it.
 	if c != nil {
 		err := c.SetDeadline(time.Now().Add(dialTimeout))
@@ -61,18 +140,74 @@ func (n *TLSPool) Get() (net.Conn, error) {
 		}
 	}
 
-	return n.Create()
+	c, err = n.create(ctx)
+	if err != nil {
+		n.release()
+		return nil, err
+	}
+	return c, nil
+}
+
+// acquire takes a slot for the connection to get if the number of the
+// connections in use is limited
+func (n *TLSPool) acquire(ctx context.Context) error {
+	if n.boot == nil || n.boot.options.MaxPoolConns <= 0 {
+		return nil
+	}
+
+	n.connsMutex.Lock()
+	if n.slots == nil {
+		n.slots = make(chan struct{}, n.boot.options.MaxPoolConns)
+	}
+	slots := n.slots
+	n.connsMutex.Unlock()
+
+	// Prefer a free slot even if ctx is already done
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return &PoolTimeoutError{Address: n.boot.address, Err: ctx.Err()}
+	}
+}
+
+// release frees the slot taken by Get for a connection that is closed instead
+// of being returned with Put
+func (n *TLSPool) release() {
+	n.connsMutex.Lock()
+	slots := n.slots
+	n.connsMutex.Unlock()
+
+	if slots == nil {
+		return
+	}
+	select {
+	case <-slots:
+	default:
+	}
 }
 
 // Create creates a new connection for the pool (but not puts it there)
 func (n *TLSPool) Create() (net.Conn, error) {
-	tlsConfig, dialContext, err := n.boot.get()
+	return n.create(context.Background())
+}
+
+// create is like Create, but the bootstrap lookup and the dialing are also
+// cancelled when ctx is done
+func (n *TLSPool) create(ctx context.Context) (net.Conn, error) {
+	tlsConfig, dialContext, err := n.boot.getContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	// we'll need a new connection, dial now
-	conn, err := tlsDial(dialContext, "tcp", tlsConfig)
+	conn, err := tlsDial(ctx, dialContext, "tcp", tlsConfig)
 	if err != nil {
 		return nil, errorx.Decorate(err, "Failed to connect to %s", tlsConfig.ServerName)
 	}
@@ -84,23 +219,75 @@ func (n *TLSPool) Put(c net.Conn) {
 	if c == nil {
 		return
 	}
+	n.release()
+
 	n.connsMutex.Lock()
-	n.conns = append(n.conns, c)
+	// the zero timeout means the server wants the connection to be closed
+	if n.hasIdleTimeout && n.idleTimeout == 0 {
+		n.connsMutex.Unlock()
+		_ = c.Close()
+		return
+	}
+	n.conns = append(n.conns, pooledConn{conn: c, idleSince: time.Now(), jitter: rand.Float64() * n.idleJitter()})
 	n.connsMutex.Unlock()
 }
 
+// idleJitter returns the maximum fraction of the idle timeout the connections
+// are evicted earlier
+func (n *TLSPool) idleJitter() float64 {
+	if n.boot == nil {
+		return defaultPoolIdleJitter
+	}
+
+	switch j := n.boot.options.PoolIdleJitter; {
+	case j == 0:
+		return defaultPoolIdleJitter
+	case j < 0:
+		return 0
+	case j > 1:
+		return 1
+	default:
+		return j
+	}
+}
+
+// setIdleTimeout sets the idle timeout of the pooled connections received
+// from the server
+func (n *TLSPool) setIdleTimeout(timeout time.Duration) {
+	n.connsMutex.Lock()
+	n.idleTimeout = timeout
+	n.hasIdleTimeout = true
+	n.connsMutex.Unlock()
+}
+
+// closeAll closes all the pooled connections
+func (n *TLSPool) closeAll() {
+	n.connsMutex.Lock()
+	conns := n.conns
+	n.conns = nil
+	n.connsMutex.Unlock()
+
+	for _, c := range conns {
+		_ = c.conn.Close()
+	}
+}
+
 // tlsDial is basically the same as tls.DialWithDialer, but we will call our own dialContext function to get connection
-func tlsDial(dialContext dialHandler, network string, config *tls.Config) (*tls.Conn, error) {
+func tlsDial(ctx context.Context, dialContext dialHandler, network string, config *tls.Config) (*tls.Conn, error) {
 	// we're using bootstrapped address instead of what's passed to the function
-	rawConn, err := dialContext(context.TODO(), network, "")
+	rawConn, err := dialContext(ctx, network, "")
 	if err != nil {
 		return nil, err
 	}
 
 	// we want the timeout to cover the whole process: TCP connection and TLS handshake
-	// dialTimeout will be used as connection deadLine
+	// dialTimeout will be used as connection deadLine, unless ctx ends earlier
+	deadline := time.Now().Add(dialTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
 	conn := tls.Client(rawConn, config)
-	err = conn.SetDeadline(time.Now().Add(dialTimeout))
+	err = conn.SetDeadline(deadline)
 	if err != nil {
 		log.Printf("DeadLine is not supported cause: %s", err)
 		conn.Close()
@@ -1,11 +1,21 @@
 package upstream
 
 import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestTLSPoolReconnect(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	u, err := AddressToUpstream("tls://one.one.one.one", Options{Bootstrap: []string{"8.8.8.8:53"}, Timeout: timeout})
 	if err != nil {
 		t.Fatalf("cannot create upstream: %s", err)
@@ -40,6 +50,8 @@ func TestTLSPoolReconnect(t *testing.T) {
 }
 
 func TestTLSPoolDeadLine(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	// Create TLS upstream
 	u, err := AddressToUpstream("tls://one.one.one.one", Options{Bootstrap: []string{"8.8.8.8:53"}, Timeout: timeout})
 	if err != nil {
@@ -61,7 +73,7 @@ func TestTLSPoolDeadLine(t *testing.T) {
 	if err != nil {
 		t.Fatalf("couldn't get connection from pool: %s", err)
 	}
-	response, err = p.exchangeConn(conn, req)
+	response, err = p.exchangeConn(conn, req, nil)
 	if err != nil {
 		t.Fatalf("first DNS message failed: %s", err)
 	}
@@ -79,7 +91,7 @@ func TestTLSPoolDeadLine(t *testing.T) {
 	if err != nil {
 		t.Fatalf("couldn't get connection from pool: %s", err)
 	}
-	response, err = p.exchangeConn(conn, req)
+	response, err = p.exchangeConn(conn, req, nil)
 	if err != nil {
 		t.Fatalf("first DNS message failed: %s", err)
 	}
@@ -92,8 +104,227 @@ func TestTLSPoolDeadLine(t *testing.T) {
 	}
 
 	// Connection with expired deadLine can't be used
-	response, err = p.exchangeConn(conn, req)
+	response, err = p.exchangeConn(conn, req, nil)
 	if err == nil {
 		t.Fatalf("this connection should be already closed, got response %s", response)
 	}
 }
+
+func TestTLSPoolDisabled(t *testing.T) {
+	srv := startTestDoTServer(t, nil)
+	defer srv.Close()
+
+	u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, InsecureSkipVerify: true, DisablePool: true})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	p := u.(*dnsOverTLS)
+
+	for i := 0; i < 3; i++ {
+		req := createTestMessage()
+		reply, err := u.Exchange(req)
+		if err != nil {
+			t.Fatalf("DNS message #%d failed: %s", i, err)
+		}
+		assert.Equal(t, req.Id, reply.Id)
+
+		// Nothing is kept in the pool
+		if p.pool != nil && len(p.pool.conns) != 0 {
+			t.Fatal("connections must not be pooled")
+		}
+	}
+
+	// Every query uses its own connection
+	assert.Equal(t, 3, srv.Accepted())
+}
+
+func TestTLSPoolResumption(t *testing.T) {
+	srv := startTestDoTServer(t, nil)
+	defer srv.Close()
+
+	for _, size := range []int{0, -1} {
+		u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, InsecureSkipVerify: true, TLSSessionCacheSize: size})
+		if err != nil {
+			t.Fatalf("cannot create upstream: %s", err)
+		}
+		p := u.(*dnsOverTLS)
+
+		_, err = u.Exchange(createTestMessage())
+		if err != nil {
+			t.Fatalf("first DNS message failed: %s", err)
+		}
+		assert.False(t, p.TLSState().DidResume)
+
+		// Close the pooled connection to force a reconnect
+		conn, _ := p.pool.Get()
+		conn.Close()
+		p.pool.Put(conn)
+
+		_, err = u.Exchange(createTestMessage())
+		if err != nil {
+			t.Fatalf("second DNS message failed: %s", err)
+		}
+
+		// The session is resumed unless the cache is disabled
+		assert.Equal(t, size >= 0, p.TLSState().DidResume)
+	}
+
+	assert.Equal(t, 4, srv.Accepted())
+}
+
+func TestTLSPoolKeepalive(t *testing.T) {
+	var advertised int32
+	srv := startTestDoTServer(t, func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg).SetReply(req)
+		opt := req.IsEdns0()
+		if opt == nil {
+			return resp
+		}
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0TCPKEEPALIVE {
+				atomic.AddInt32(&advertised, 1)
+			}
+		}
+
+		// The idle timeout is 200ms
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		respOpt := resp.IsEdns0()
+		respOpt.Option = append(respOpt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: []byte{0, 2}})
+		return resp
+	})
+	defer srv.Close()
+
+	u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	exchange := func() {
+		req := createTestMessage()
+		reply, err := u.Exchange(req)
+		if err != nil {
+			t.Fatalf("DNS message failed: %s", err)
+		}
+		assert.Equal(t, req.Id, reply.Id)
+
+		// The request had no OPT record, so the response mustn't have it
+		assert.Nil(t, reply.IsEdns0())
+		assert.Nil(t, req.IsEdns0())
+	}
+
+	exchange()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&advertised))
+	assert.Equal(t, 200*time.Millisecond, u.(*dnsOverTLS).pool.idleTimeout)
+
+	// The connection is reused within the idle timeout
+	exchange()
+	assert.Equal(t, 1, srv.Accepted())
+
+	// And evicted after it
+	time.Sleep(300 * time.Millisecond)
+	exchange()
+	assert.Equal(t, 2, srv.Accepted())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&advertised))
+}
+
+func TestTLSPoolIdleJitter(t *testing.T) {
+	const idleTimeout = 10 * time.Second
+
+	evictions := func(jitter float64) (min, max time.Duration) {
+		pool := &TLSPool{boot: &bootstrapper{options: Options{PoolIdleJitter: jitter}}}
+		pool.setIdleTimeout(idleTimeout)
+
+		// The connections put at once
+		for i := 0; i < 10; i++ {
+			c, s := net.Pipe()
+			defer c.Close()
+			defer s.Close()
+			pool.Put(c)
+		}
+
+		min, max = idleTimeout, 0
+		for _, pc := range pool.conns {
+			d := pc.evictAt(idleTimeout).Sub(pc.idleSince)
+			if d < min {
+				min = d
+			}
+			if d > max {
+				max = d
+			}
+		}
+		return min, max
+	}
+
+	// The eviction times are spread, but the connections are never kept for
+	// longer than the idle timeout
+	min, max := evictions(0.5)
+	assert.True(t, max-min > time.Second, "spread: %s", max-min)
+	assert.True(t, min >= idleTimeout/2)
+	assert.True(t, max <= idleTimeout)
+
+	min, max = evictions(-1)
+	assert.Equal(t, idleTimeout, min)
+	assert.Equal(t, idleTimeout, max)
+}
+
+func TestTLSPoolMaxConns(t *testing.T) {
+	srv := startTestDoTServer(t, func(req *dns.Msg) *dns.Msg {
+		return new(dns.Msg).SetReply(req)
+	})
+	defer srv.Close()
+
+	const timeout = 300 * time.Millisecond
+	u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, InsecureSkipVerify: true, MaxPoolConns: 1})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+
+	// The only connection is taken
+	pool := u.(*dnsOverTLS).getPool()
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatalf("cannot get a connection: %s", err)
+	}
+
+	// The wait ends once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = pool.GetContext(ctx)
+	poolErr, ok := err.(*PoolTimeoutError)
+	if !ok {
+		t.Fatalf("expected *PoolTimeoutError, got %v", err)
+	}
+	assert.True(t, errors.Is(poolErr, context.Canceled))
+
+	// The query doesn't wait for it longer than the timeout
+	start := time.Now()
+	_, err = u.Exchange(createTestMessage())
+	elapsed := time.Since(start)
+
+	poolErr, ok = err.(*PoolTimeoutError)
+	if !ok {
+		t.Fatalf("expected *PoolTimeoutError, got %v", err)
+	}
+	assert.True(t, errors.Is(poolErr, context.DeadlineExceeded))
+	assert.True(t, elapsed >= timeout && elapsed < 2*timeout, elapsed)
+
+	// The query waiting for the connection gets it once it's returned and
+	// reuses it
+	go func() {
+		time.Sleep(timeout / 3)
+		pool.Put(conn)
+	}()
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, srv.Accepted())
+}
+
+// startTestDoTServer starts a local DNS-over-TLS server with a self-signed
+// certificate, h creates the responses, an empty response is sent if it's nil
+func startTestDoTServer(t *testing.T, h dnsproxytest.Handler) *dnsproxytest.Server {
+	srv, err := dnsproxytest.NewTLSServer(h)
+	if err != nil {
+		t.Fatalf("cannot start the DoT server: %s", err)
+	}
+	return srv
+}
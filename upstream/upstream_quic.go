@@ -20,6 +20,9 @@ const handshakeTimeout = time.Second
 type dnsOverQUIC struct {
 	boot    *bootstrapper
 	session quic.Session
+	stamp   *StampInfo // not nil if the upstream was created from a DNS stamp
+
+	exchanges exchangeTracker // Exchange calls in progress
 
 	bytesPool    *sync.Pool // byte packets pool
 	sync.RWMutex            // protects session and bytesPool
@@ -27,13 +30,39 @@ type dnsOverQUIC struct {
 
 func (p *dnsOverQUIC) Address() string { return p.boot.address }
 
+// Properties returns the information from the DNS stamp the upstream was created
+// from, or nil if it wasn't created from a stamp
+func (p *dnsOverQUIC) Properties() *StampInfo { return p.stamp }
+
+// WithOptions implements the Cloner interface for *dnsOverQUIC
+func (p *dnsOverQUIC) WithOptions(opts *Options) (Upstream, error) {
+	return cloneUpstream(p.Address(), p.boot, p.stamp, opts)
+}
+
 func (p *dnsOverQUIC) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return followCNAME(p.boot.options.FollowCNAME, p.exchangeTraced)(m, nil)
+}
+
+// ExchangeWithInfo implements the InfoExchanger interface for *dnsOverQUIC
+func (p *dnsOverQUIC) ExchangeWithInfo(m *dns.Msg) (*dns.Msg, *ExchangeInfo, error) {
+	return traceExchange(m, followCNAME(p.boot.options.FollowCNAME, p.exchangeTraced))
+}
+
+// exchangeTraced sends the query and records the details to tr
+func (p *dnsOverQUIC) exchangeTraced(m *dns.Msg, tr *exchangeTrace) (reply *dns.Msg, err error) {
+	m, finish, err := prepareQuery(&p.exchanges, m, newQueryOptions(&p.boot.options), tr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { reply, err = finish(reply, err) }()
+	m, addedOPT := padMsg(m, p.boot.options.Padding)
+
 	session, err := p.getSession(true)
 	if err != nil {
 		return nil, err
 	}
 
-	stream, err := p.openStream(session)
+	stream, session, err := p.openStream(session, tr)
 	if err != nil {
 		return nil, errorx.Decorate(err, "failed to open new stream to %s", p.Address())
 	}
@@ -43,6 +72,7 @@ func (p *dnsOverQUIC) Exchange(m *dns.Msg) (*dns.Msg, error) {
 		return nil, err
 	}
 
+	tr.wroteQuery("quic", session.RemoteAddr(), len(buf))
 	_, err = stream.Write(buf)
 	if err != nil {
 		return nil, err
@@ -67,16 +97,42 @@ func (p *dnsOverQUIC) Exchange(m *dns.Msg) (*dns.Msg, error) {
 	if err != nil && n == 0 {
 		return nil, errorx.Decorate(err, "failed to read response from %s due to %v", p.Address(), err)
 	}
+	tr.readResponse(time.Time{}, n)
 
-	reply := new(dns.Msg)
+	reply = new(dns.Msg)
 	err = reply.Unpack(respBuf)
 	if err != nil {
 		return nil, errorx.Decorate(err, "failed to unpack response from %s", p.Address())
 	}
 
+	if p.boot.options.Padding > 0 {
+		unpadMsg(reply, addedOPT)
+	}
 	return reply, nil
 }
 
+// Close implements the Closer interface for *dnsOverQUIC
+func (p *dnsOverQUIC) Close() error { return p.exchanges.close(p.release) }
+
+// Shutdown implements the Closer interface for *dnsOverQUIC
+func (p *dnsOverQUIC) Shutdown(ctx context.Context) error {
+	return p.exchanges.shutdown(ctx, p.release)
+}
+
+// release closes the QUIC session, if any
+func (p *dnsOverQUIC) release() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.session == nil {
+		return nil
+	}
+
+	err := p.session.CloseWithError(0, "")
+	p.session = nil
+	return err
+}
+
 func (p *dnsOverQUIC) getBytesPool() *sync.Pool {
 	p.Lock()
 	if p.bytesPool == nil {
@@ -127,7 +183,9 @@ func (p *dnsOverQUIC) getSession(useCached bool) (quic.Session, error) {
 	return session, nil
 }
 
-func (p *dnsOverQUIC) openStream(session quic.Session) (quic.Stream, error) {
+// openStream opens a new stream in the session, the session is re-created if
+// it fails.  It returns the session the stream belongs to.
+func (p *dnsOverQUIC) openStream(session quic.Session, tr *exchangeTrace) (quic.Stream, quic.Session, error) {
 	ctx := context.Background()
 
 	if p.boot.options.Timeout > 0 {
@@ -139,20 +197,31 @@ func (p *dnsOverQUIC) openStream(session quic.Session) (quic.Stream, error) {
 
 	stream, err := session.OpenStreamSync(ctx)
 	if err == nil {
-		return stream, nil
+		return stream, session, nil
 	}
 
 	// try to recreate the session
 	newSession, err := p.getSession(false)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	tr.reconnect()
 	// open a new stream
-	return newSession.OpenStreamSync(ctx)
+	stream, err = newSession.OpenStreamSync(ctx)
+	return stream, newSession, err
 }
 
 func (p *dnsOverQUIC) openSession() (quic.Session, error) {
-	tlsConfig, dialContext, err := p.boot.get()
+	// The bootstrap lookup and the handshake take no longer than the timeout
+	// together
+	ctx := context.Background()
+	if p.boot.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.boot.options.Timeout)
+		defer cancel()
+	}
+
+	tlsConfig, dialContext, err := p.boot.getContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -160,7 +229,7 @@ func (p *dnsOverQUIC) openSession() (quic.Session, error) {
 	// we're using bootstrapped address instead of what's passed to the function
 	// it does not create an actual connection, but it helps us determine
 	// what IP is actually reachable (when there're v4/v6 addresses)
-	rawConn, err := dialContext(context.TODO(), "udp", "")
+	rawConn, err := dialContext(ctx, "udp", "")
 	if err != nil {
 		return nil, err
 	}
@@ -176,7 +245,7 @@ func (p *dnsOverQUIC) openSession() (quic.Session, error) {
 	quicConfig := &quic.Config{
 		HandshakeTimeout: handshakeTimeout,
 	}
-	session, err := quic.DialAddrContext(context.Background(), addr, tlsConfig, quicConfig)
+	session, err := quic.DialAddrContext(ctx, addr, tlsConfig, quicConfig)
 	if err != nil {
 		return nil, errorx.Decorate(err, "failed to open QUIC session to %s", p.Address())
 	}
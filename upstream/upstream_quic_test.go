@@ -3,11 +3,14 @@ package upstream
 import (
 	"testing"
 
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestUpstreamDOQ(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	// Create a DNS-over-QUIC upstream
 	address := "quic://dns.adguard.com"
 	u, err := AddressToUpstream(address, Options{InsecureSkipVerify: true})
@@ -0,0 +1,185 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrRateLimited is returned by the upstream created with
+// NewRateLimitedUpstream when the query exceeds the limit in the RateLimitFail
+// mode, or would be delayed for longer than the timeout in the RateLimitBlock
+// mode
+var ErrRateLimited = errors.New("upstream rate limit exceeded")
+
+// RateLimitMode defines what the upstream created with NewRateLimitedUpstream
+// does with the queries that exceed the limit
+type RateLimitMode int
+
+// defaultRateLimitTimeout is how long the queries may be delayed in the
+// RateLimitBlock mode if the timeout isn't set
+const defaultRateLimitTimeout = 10 * time.Second
+
+const (
+	// RateLimitBlock delays the queries until they fit into the limit, the
+	// queries that would wait for longer than the timeout fail with
+	// ErrRateLimited right away
+	RateLimitBlock RateLimitMode = iota
+	// RateLimitFail fails the queries with ErrRateLimited right away
+	RateLimitFail
+)
+
+// rateLimitedUpstream sends the queries to the wrapped upstream no faster than
+// the token bucket allows
+type rateLimitedUpstream struct {
+	upstream Upstream      // the upstream the queries are sent to
+	mode     RateLimitMode // what to do with the queries over the limit
+	timeout  time.Duration // the longest delay in the RateLimitBlock mode
+	bucket   *tokenBucket
+
+	done      chan struct{} // closed when the upstream is closed to release the delayed queries
+	closeOnce sync.Once
+	exchanges exchangeTracker // Exchange calls in progress
+}
+
+// NewRateLimitedUpstream creates a new Upstream that sends the queries to u at
+// the rate of qps queries per second on average, with the bursts of up to
+// burst queries.  Depending on mode, the queries over the limit are either
+// delayed or fail with ErrRateLimited.  The queries are delayed for timeout at
+// most, usually the Options.Timeout of u, the ones that would wait for longer
+// fail with ErrRateLimited at once.  If timeout is not positive, 10 seconds is
+// used.  The delayed queries fail with ErrClosed if the upstream is closed
+// meanwhile.  It's useful for the public resolvers that ban the clients
+// exceeding their limits.  If qps is not positive, u is returned as is.
+func NewRateLimitedUpstream(u Upstream, qps float64, burst int, mode RateLimitMode, timeout time.Duration) Upstream {
+	if qps <= 0 {
+		return u
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if timeout <= 0 {
+		timeout = defaultRateLimitTimeout
+	}
+
+	return &rateLimitedUpstream{
+		upstream: u,
+		mode:     mode,
+		timeout:  timeout,
+		bucket:   newTokenBucket(qps, burst),
+		done:     make(chan struct{}),
+	}
+}
+
+func (u *rateLimitedUpstream) Address() string { return u.upstream.Address() }
+
+func (u *rateLimitedUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if err := u.exchanges.begin(); err != nil {
+		return nil, err
+	}
+	defer u.exchanges.end()
+
+	var maxDelay time.Duration
+	if u.mode == RateLimitBlock {
+		maxDelay = u.timeout
+	}
+	delay, ok := u.bucket.take(time.Now(), maxDelay)
+	if !ok {
+		return nil, ErrRateLimited
+	}
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-u.done:
+			u.bucket.cancel()
+			return nil, ErrClosed
+		}
+	}
+
+	return u.upstream.Exchange(m)
+}
+
+// Close implements the Closer interface for *rateLimitedUpstream
+func (u *rateLimitedUpstream) Close() error { return u.exchanges.close(u.release) }
+
+// Shutdown implements the Closer interface for *rateLimitedUpstream
+func (u *rateLimitedUpstream) Shutdown(ctx context.Context) error {
+	return u.exchanges.shutdown(ctx, u.release)
+}
+
+// release fails the delayed queries and closes the wrapped upstream
+func (u *rateLimitedUpstream) release() error {
+	u.closeOnce.Do(func() { close(u.done) })
+
+	if c, ok := u.upstream.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// tokenBucket is the token bucket rate limiter.  The tokens are added at the
+// rate up to the burst, every query takes one.
+type tokenBucket struct {
+	rate  float64 // tokens per second
+	burst float64 // the maximum number of tokens
+
+	mu     sync.Mutex
+	tokens float64   // negative if the queries are waiting for the tokens
+	last   time.Time // when the tokens were added the last time
+}
+
+// newTokenBucket creates a new full bucket
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take takes a token and returns how long to wait until it's actually
+// available.  If the wait would be longer than maxDelay, it takes nothing and
+// returns false.
+func (b *tokenBucket) take(now time.Time, maxDelay time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+
+	delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if delay > maxDelay {
+		return 0, false
+	}
+
+	b.tokens--
+	return delay, true
+}
+
+// cancel returns the token taken by the query that hasn't waited for it
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	b.tokens++
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.mu.Unlock()
+}
@@ -0,0 +1,78 @@
+package upstream
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitedUpstream(t *testing.T) {
+	var sent int32
+	handler := func(m *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&sent, 1)
+		return new(dns.Msg).SetReply(m), nil
+	}
+	wrapped := NewStaticUpstream(handler)
+
+	// The queries over the burst fail right away
+	u := NewRateLimitedUpstream(wrapped, 1, 5, RateLimitFail, 0)
+	assert.Equal(t, wrapped.Address(), u.Address())
+	for i := 0; i < 5; i++ {
+		_, err := u.Exchange(createTestMessage())
+		assert.Nil(t, err)
+	}
+	start := time.Now()
+	_, err := u.Exchange(createTestMessage())
+	assert.Equal(t, ErrRateLimited, err)
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&sent))
+
+	// The queries over the burst are delayed to the rate
+	const qps = 20
+	u = NewRateLimitedUpstream(wrapped, qps, 2, RateLimitBlock, time.Second)
+	start = time.Now()
+	for i := 0; i < 2+qps/2; i++ {
+		_, err = u.Exchange(createTestMessage())
+		assert.Nil(t, err)
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 450*time.Millisecond && elapsed < 900*time.Millisecond, "elapsed %s", elapsed)
+
+	// The delayed queries fail once the upstream is closed
+	u = NewRateLimitedUpstream(wrapped, 0.1, 1, RateLimitBlock, 0)
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = u.(Closer).Close()
+	}()
+	start = time.Now()
+	_, err = u.Exchange(createTestMessage())
+	assert.Equal(t, ErrClosed, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// The queries that would wait for longer than the timeout fail at once,
+	// the wrapped upstream is closed along with the previous one
+	wrapped = NewStaticUpstream(handler)
+	u = NewRateLimitedUpstream(wrapped, 1, 1, RateLimitBlock, 500*time.Millisecond)
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	start = time.Now()
+	_, err = u.Exchange(createTestMessage())
+	assert.Equal(t, ErrRateLimited, err)
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+
+	// The failed query hasn't taken the token
+	time.Sleep(600 * time.Millisecond)
+	start = time.Now()
+	_, err = u.Exchange(createTestMessage())
+	assert.Nil(t, err)
+	elapsed = time.Since(start)
+	assert.True(t, elapsed >= 300*time.Millisecond && elapsed < 500*time.Millisecond, "elapsed %s", elapsed)
+
+	// No limit
+	assert.Equal(t, wrapped, NewRateLimitedUpstream(wrapped, 0, 1, RateLimitFail, 0))
+}
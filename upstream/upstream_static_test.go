@@ -0,0 +1,41 @@
+package upstream
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticUpstream(t *testing.T) {
+	u := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		res := new(dns.Msg).SetReply(m)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(8, 8, 8, 8),
+		})
+		return res, nil
+	})
+	assert.Equal(t, "static", u.Address())
+
+	// Works with the helpers just like the real upstreams
+	req := createTestMessage()
+	res, resolved, err := ExchangeParallel([]Upstream{u, NewStaticUpstream(func(*dns.Msg) (*dns.Msg, error) {
+		return nil, errors.New("failed")
+	})}, req)
+	assert.Nil(t, err)
+	assert.Equal(t, u, resolved)
+	assert.Equal(t, req.Id, res.Id)
+	assert.Len(t, res.Answer, 1)
+
+	res, err = NullUpstream().Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Empty(t, res.Answer)
+
+	// nil response without an error is an error
+	_, err = NewStaticUpstream(func(*dns.Msg) (*dns.Msg, error) { return nil, nil }).Exchange(req)
+	assert.NotNil(t, err)
+}
@@ -3,9 +3,11 @@ package upstream
 import (
 	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -16,8 +18,11 @@ func TestBootstrapTimeout(t *testing.T) {
 		count   = 10
 	)
 
-	// Specifying some wrong port instead so that bootstrap DNS timed out for sure
-	u, err := AddressToUpstream("tls://one.one.one.one", Options{Bootstrap: []string{"8.8.8.8:555"}, Timeout: timeout})
+	// The bootstrap server never answers, so that bootstrap DNS timed out
+	// for sure
+	boot := newSilentServer(t)
+	defer boot.Close()
+	u, err := AddressToUpstream("tls://one.one.one.one", Options{Bootstrap: []string{boot.LocalAddr().String()}, Timeout: timeout})
 	if err != nil {
 		t.Fatalf("cannot create upstream: %s", err)
 	}
@@ -63,8 +68,12 @@ func TestUpstreamRace(t *testing.T) {
 		count   = 5
 	)
 
-	// Specifying some wrong port instead so that bootstrap DNS timed out for sure
-	u, err := AddressToUpstream("tls://1.1.1.1", Options{Timeout: timeout})
+	srv, err := dnsproxytest.NewTLSServer(testHandler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+	u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, InsecureSkipVerify: true})
 	if err != nil {
 		t.Fatalf("cannot create upstream: %s", err)
 	}
@@ -98,6 +107,8 @@ func TestUpstreamRace(t *testing.T) {
 }
 
 func TestUpstreams(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	upstreams := []struct {
 		address   string
 		bootstrap []string
@@ -229,6 +240,28 @@ func TestUpstreamAddress(t *testing.T) {
 	u, _ = AddressToUpstream("https://one.one.one.one", opt)
 	assert.Equal(t, "https://one.one.one.one:443", u.Address())
 
+	// Default ports are added, the host is lowercased
+	u, _ = AddressToUpstream("tls://1.1.1.1", opt)
+	assert.Equal(t, "tls://1.1.1.1:853", u.Address())
+
+	u, _ = AddressToUpstream("TLS://One.One.One.One/", opt)
+	assert.Equal(t, "tls://one.one.one.one:853", u.Address())
+
+	u, _ = AddressToUpstream("quic://dns.adguard.com", opt)
+	assert.Equal(t, "quic://dns.adguard.com:784", u.Address())
+
+	u, _ = AddressToUpstream("https://Dns.Google/dns-query", opt)
+	assert.Equal(t, "https://dns.google:443/dns-query", u.Address())
+
+	u, _ = AddressToUpstream("dns://[2606:4700:4700::1111]", Options{})
+	assert.Equal(t, "[2606:4700:4700::1111]:53", u.Address())
+
+	u, _ = AddressToUpstream("[2606:4700:4700::1111]", Options{})
+	assert.Equal(t, "[2606:4700:4700::1111]:53", u.Address())
+
+	u, _ = AddressToUpstream("tcp://1.1.1.1:0053", Options{})
+	assert.Equal(t, "tcp://1.1.1.1:53", u.Address())
+
 	_, err := AddressToUpstream("asdf://1.1.1.1", Options{})
 	assert.NotNil(t, err) // bad scheme
 
@@ -243,6 +276,8 @@ func TestUpstreamAddress(t *testing.T) {
 }
 
 func TestUpstreamDOTBootstrap(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	upstreams := []struct {
 		address   string
 		bootstrap []string
@@ -275,6 +310,8 @@ func TestUpstreamDOTBootstrap(t *testing.T) {
 }
 
 func TestUpstreamDefaultOptions(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	addresses := []string{"tls://1.1.1.1", "8.8.8.8"}
 
 	for _, address := range addresses {
@@ -288,6 +325,8 @@ func TestUpstreamDefaultOptions(t *testing.T) {
 
 // Test for DoH and DoT upstreams with two bootstraps (only one is valid)
 func TestUpstreamsInvalidBootstrap(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	upstreams := []struct {
 		address   string
 		bootstrap []string
@@ -338,6 +377,8 @@ func TestUpstreamsInvalidBootstrap(t *testing.T) {
 }
 
 func TestUpstreamsWithServerIP(t *testing.T) {
+	dnsproxytest.RequireNetwork(t)
+
 	// use invalid bootstrap to make sure it fails if tries to use it
 	invalidBootstrap := []string{"1.2.3.4:55"}
 
@@ -411,6 +452,25 @@ func createHostTestMessage(host string) *dns.Msg {
 	return &req
 }
 
+// testHandler answers the A queries with 8.8.8.8 the way assertResponse
+// expects, and the other queries with the empty responses
+func testHandler(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg).SetReply(req)
+	if req.Question[0].Qtype == dns.TypeA {
+		resp.Answer = []dns.RR{newTestRR("%s 60 IN A 8.8.8.8", req.Question[0].Name)}
+	}
+	return resp
+}
+
+// newSilentServer creates the UDP socket on 127.0.0.1 that never answers
+func newSilentServer(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	return conn
+}
+
 func assertResponse(t *testing.T, reply *dns.Msg) {
 	if len(reply.Answer) != 1 {
 		t.Fatalf("DNS upstream returned reply with wrong number of answers - %d", len(reply.Answer))
@@ -423,3 +483,108 @@ func assertResponse(t *testing.T, reply *dns.Msg) {
 		t.Fatalf("DNS upstream returned wrong answer type instead of A: %v", reply.Answer[0])
 	}
 }
+
+// TestUpstreamsSharedRequest sends the same message to several upstreams at
+// once, the race detector catches the upstreams modifying it
+func TestUpstreamsSharedRequest(t *testing.T) {
+	plain, err := dnsproxytest.NewPlainServer(nil)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer plain.Close()
+	dot := startTestDoTServer(t, nil)
+	defer dot.Close()
+	doh := startTestDoHServer(t)
+	defer doh.Close()
+
+	var upstreams []Upstream
+	for _, address := range []string{plain.URL, "tcp://" + plain.Addr, dot.URL, doh.URL} {
+		u, err := AddressToUpstream(address, Options{Timeout: timeout, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("cannot create upstream %s: %s", address, err)
+		}
+		defer u.(Closer).Close()
+		upstreams = append(upstreams, u)
+	}
+
+	req := createTestMessage()
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	orig := req.Copy()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		for _, u := range upstreams {
+			wg.Add(1)
+			go func(u Upstream) {
+				defer wg.Done()
+				res, err := u.Exchange(req)
+				if assert.Nil(t, err, u.Address()) {
+					assert.Equal(t, req.Id, res.Id, u.Address())
+				}
+			}(u)
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, orig.String(), req.String())
+}
+
+func TestForceRD(t *testing.T) {
+	// The servers answer with the RD flag they've received in the A record
+	handler := func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg).SetReply(req)
+		ip := net.IPv4(192, 0, 2, 0)
+		if req.RecursionDesired {
+			ip = net.IPv4(192, 0, 2, 1)
+		}
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   ip,
+		}}
+		return resp
+	}
+	plain, err := dnsproxytest.NewPlainServer(handler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer plain.Close()
+	tls, err := dnsproxytest.NewTLSServer(handler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer tls.Close()
+	doh, err := dnsproxytest.NewHTTPSServer(handler)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer doh.Close()
+
+	set, unset := true, false
+	for _, address := range []string{plain.Addr, "tcp://" + plain.Addr, tls.URL, doh.URL} {
+		for _, tc := range []struct {
+			force *bool
+			rd    bool
+			want  bool
+		}{
+			{nil, false, false},
+			{nil, true, true},
+			{&set, false, true},
+			{&unset, true, false},
+		} {
+			u, err := AddressToUpstream(address, Options{Timeout: timeout, InsecureSkipVerify: true, ForceRD: tc.force})
+			if err != nil {
+				t.Fatalf("cannot create upstream %s: %s", address, err)
+			}
+
+			req := createTestMessage()
+			req.RecursionDesired = tc.rd
+			resp, err := u.Exchange(req)
+			_ = u.(Closer).Close()
+			if !assert.Nil(t, err, address) {
+				continue
+			}
+			assert.Equal(t, tc.want, resp.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, 1)), "%s %+v", address, tc)
+			assert.Equal(t, tc.rd, req.RecursionDesired)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ErrQuestion is returned by VerifyResponse when the question section of the
+// response doesn't match the one of the request
+var ErrQuestion = errors.New("response question doesn't match the request")
+
+// RcodeError is returned by VerifyResponse when the response has a response
+// code that isn't defined
+type RcodeError struct {
+	Rcode int // the response code
+}
+
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("response has an unknown rcode %d", e.Rcode)
+}
+
+// VerifyResponse checks that resp is actually the answer to req: the ID and
+// the question section must match, and the response code must be a known one.
+// This protects from accepting spoofed or stale responses received on the
+// same socket.  dns.ErrId is returned if the ID doesn't match.
+func VerifyResponse(req, resp *dns.Msg) error {
+	if resp.Id != req.Id {
+		return dns.ErrId
+	}
+
+	if len(resp.Question) != len(req.Question) {
+		return ErrQuestion
+	}
+
+	for i, q := range req.Question {
+		rq := resp.Question[i]
+		if rq.Qtype != q.Qtype || rq.Qclass != q.Qclass || !strings.EqualFold(rq.Name, q.Name) {
+			return ErrQuestion
+		}
+	}
+
+	if _, ok := dns.RcodeToString[resp.Rcode]; !ok {
+		return &RcodeError{Rcode: resp.Rcode}
+	}
+
+	return nil
+}
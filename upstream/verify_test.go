@@ -0,0 +1,46 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyResponse(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+
+	resp := new(dns.Msg).SetReply(req)
+	assert.Nil(t, VerifyResponse(req, resp))
+
+	// The names are compared case-insensitively
+	resp.Question[0].Name = "EXAMPLE.org."
+	assert.Nil(t, VerifyResponse(req, resp))
+
+	resp = new(dns.Msg).SetReply(req)
+	resp.Id = req.Id + 1
+	assert.Equal(t, dns.ErrId, VerifyResponse(req, resp))
+
+	for _, q := range []dns.Question{
+		{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "example.org.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+		{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassCHAOS},
+	} {
+		resp = new(dns.Msg).SetReply(req)
+		resp.Question[0] = q
+		assert.Equal(t, ErrQuestion, VerifyResponse(req, resp), q.String())
+	}
+
+	resp = new(dns.Msg).SetReply(req)
+	resp.Question = nil
+	assert.Equal(t, ErrQuestion, VerifyResponse(req, resp))
+
+	resp = new(dns.Msg).SetRcode(req, dns.RcodeNameError)
+	assert.Nil(t, VerifyResponse(req, resp))
+
+	resp.Rcode = 3000
+	err := VerifyResponse(req, resp)
+	if assert.IsType(t, &RcodeError{}, err) {
+		assert.Equal(t, 3000, err.(*RcodeError).Rcode)
+	}
+}
@@ -0,0 +1,213 @@
+package upstream
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// wireHeaderSize is the size of the DNS message header
+const wireHeaderSize = 12
+
+// errWireMalformed is returned by ExchangeWire if the query can't be parsed
+// far enough to check the response
+var errWireMalformed = errors.New("malformed DNS message")
+
+// WireExchanger is implemented by the upstreams that can relay the messages in
+// the wire format without unpacking and packing them
+type WireExchanger interface {
+	// ExchangeWire is like Upstream.Exchange, but the query and the response
+	// are in the wire format
+	ExchangeWire(req []byte) ([]byte, error)
+}
+
+// ExchangeWire sends the query in the wire format to the upstream and returns
+// the response in the wire format.  If u doesn't implement WireExchanger, the
+// query is unpacked, sent with Exchange and the response is packed.
+func ExchangeWire(u Upstream, req []byte) ([]byte, error) {
+	if we, ok := u.(WireExchanger); ok {
+		return we.ExchangeWire(req)
+	}
+	return exchangeWireMsg(u.Exchange, req)
+}
+
+// exchangeWireMsg unpacks the query, sends it with exchange and packs the
+// response.  It's used by the upstreams that need to modify the messages.
+func exchangeWireMsg(exchange func(m *dns.Msg) (*dns.Msg, error), req []byte) ([]byte, error) {
+	m := &dns.Msg{}
+	err := m.Unpack(req)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to unpack the request")
+	}
+
+	reply, err := exchange(m)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errors.New("no response")
+	}
+	return reply.Pack()
+}
+
+// wireQuestionEnd returns the offset of the end of the question section of the
+// message in the wire format
+func wireQuestionEnd(b []byte) (int, error) {
+	if len(b) < wireHeaderSize {
+		return 0, errWireMalformed
+	}
+
+	off := wireHeaderSize
+	for n := binary.BigEndian.Uint16(b[4:]); n > 0; n-- {
+		for {
+			if off >= len(b) {
+				return 0, errWireMalformed
+			}
+			l := int(b[off])
+			if l == 0 {
+				off++
+				break
+			}
+			if l&0xc0 != 0 {
+				// The pointer ends the name
+				off += 2
+				break
+			}
+			off += 1 + l
+		}
+		// The type and the class
+		off += 4
+		if off > len(b) {
+			return 0, errWireMalformed
+		}
+	}
+	return off, nil
+}
+
+// verifyWireResponse is VerifyResponse for the messages in the wire format, it
+// checks the ID and the question section, the names are case-insensitive
+func verifyWireResponse(req, resp []byte) error {
+	if len(resp) < wireHeaderSize {
+		return dns.ErrShortRead
+	}
+	if resp[0] != req[0] || resp[1] != req[1] {
+		return dns.ErrId
+	}
+
+	end, err := wireQuestionEnd(req)
+	if err != nil {
+		return err
+	}
+	if len(resp) < end || resp[4] != req[4] || resp[5] != req[5] {
+		return ErrQuestion
+	}
+
+	// wireQuestionEnd has checked the bounds
+	for off := wireHeaderSize; off < end; {
+		n := 1 + int(req[off])
+		switch {
+		case req[off] == 0:
+			// The root label, the type and the class
+			n = 5
+		case req[off]&0xc0 != 0:
+			// The pointer, the type and the class
+			n = 6
+		}
+		if !equalFoldASCII(req[off:off+n], resp[off:off+n], req[off] != 0 && req[off]&0xc0 == 0) {
+			return ErrQuestion
+		}
+		off += n
+	}
+	return nil
+}
+
+// equalFoldASCII compares the bytes, the ASCII letters after the first byte
+// are compared case-insensitively if fold is true
+func equalFoldASCII(a, b []byte, fold bool) bool {
+	for i := range a {
+		x, y := a[i], b[i]
+		if fold && i > 0 {
+			x, y = toLowerASCII(x), toLowerASCII(y)
+		}
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+// toLowerASCII returns the lowercase ASCII letter, other bytes are returned as
+// is
+func toLowerASCII(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// isTruncatedWire checks the TC bit of the message in the wire format
+func isTruncatedWire(b []byte) bool {
+	return len(b) > 2 && b[2]&0x02 != 0
+}
+
+// logBeginWire writes to log about the query in the wire format
+func logBeginWire(upstreamAddress string, req []byte) {
+	log.Debug("%s: sending request of %d bytes", upstreamAddress, len(req))
+}
+
+// writePrefixedWire writes the message with the length prefix to the stream
+// connection at once
+func writePrefixedWire(conn net.Conn, b []byte) error {
+	if len(b) > dns.MaxMsgSize {
+		return proxyutil.ErrTooLarge
+	}
+
+	bufPtr := bytesPool.Get().(*[]byte)
+	defer bytesPool.Put(bufPtr)
+	buf := *bufPtr
+
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	n := copy(buf[2:], b)
+	_, err := conn.Write(buf[:2+n])
+	return err
+}
+
+// readPrefixedWire reads the message with the length prefix from the stream
+// connection
+func readPrefixedWire(conn net.Conn) ([]byte, error) {
+	bufPtr := bytesPool.Get().(*[]byte)
+	defer bytesPool.Put(bufPtr)
+
+	b, err := proxyutil.ReadPrefixedBuffer(conn, *bufPtr)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), b...), nil
+}
+
+// exchangeStreamWire sends the query over the stream connection and reads the
+// response, the caller closes the connection if it fails
+func exchangeStreamWire(conn net.Conn, req []byte, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		err := conn.SetDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := writePrefixedWire(conn, req)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := readPrefixedWire(conn)
+	if err != nil {
+		return nil, err
+	}
+	return reply, verifyWireResponse(req, reply)
+}
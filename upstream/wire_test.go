@@ -0,0 +1,306 @@
+package upstream
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/dnsproxytest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// wireStub answers the queries with the compressed responses and remembers
+// the last one it has packed
+type wireStub struct {
+	mu     sync.Mutex     // protects modify and sent
+	modify func(*dns.Msg) // changes the response before it's packed
+	sent   []byte         // the last packed response
+}
+
+// setModify sets the function that changes the responses
+func (s *wireStub) setModify(modify func(resp *dns.Msg)) {
+	s.mu.Lock()
+	s.modify = modify
+	s.mu.Unlock()
+}
+
+// handle implements dnsproxytest.Handler for *wireStub
+func (s *wireStub) handle(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg).SetReply(req)
+	resp.Compress = true
+	resp.Answer = []dns.RR{
+		newTestRR("%s 60 IN A 192.0.2.1", req.Question[0].Name),
+		newTestRR("%s 60 IN A 192.0.2.2", req.Question[0].Name),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.modify != nil {
+		s.modify(resp)
+	}
+
+	// The server packs the response the same way
+	b, err := resp.Pack()
+	if err != nil {
+		panic(err)
+	}
+	s.sent = b
+	return resp
+}
+
+// lastSent returns the last response the stub has packed
+func (s *wireStub) lastSent() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent
+}
+
+// packTestMessage packs the test query with the mixed-case name
+func packTestMessage(t *testing.T) []byte {
+	req := createHostTestMessage("Wire.Example.ORG")
+	b, err := req.Pack()
+	if err != nil {
+		t.Fatalf("cannot pack the request: %s", err)
+	}
+	return b
+}
+
+func TestExchangeWire(t *testing.T) {
+	stub := &wireStub{}
+	plain, err := dnsproxytest.NewPlainServer(stub.handle)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer plain.Close()
+	dot, err := dnsproxytest.NewTLSServer(stub.handle)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer dot.Close()
+
+	for _, address := range []string{plain.URL, "tcp://" + plain.Addr, dot.URL} {
+		u, err := AddressToUpstream(address, Options{Timeout: timeout, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("cannot create upstream %s: %s", address, err)
+		}
+		if _, ok := u.(WireExchanger); !ok {
+			t.Fatalf("%s is not a WireExchanger", address)
+		}
+
+		// The response is relayed byte-for-byte, the compression is kept
+		for i := 0; i < 2; i++ {
+			req := packTestMessage(t)
+			reply, err := ExchangeWire(u, req)
+			if err != nil {
+				t.Fatalf("cannot exchange with %s: %s", address, err)
+			}
+			assert.Equal(t, stub.lastSent(), reply, address)
+			assert.Equal(t, req[:2], reply[:2], address)
+		}
+		assert.Nil(t, u.(Closer).Close())
+	}
+	assert.Equal(t, 1, dot.Accepted())
+
+	// The upstreams that modify the messages repack the response
+	for _, opts := range []Options{{ForceRD: new(bool)}, {EDNSOptions: []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID}}}} {
+		opts.Timeout = timeout
+		u, err := AddressToUpstream(plain.URL, opts)
+		assert.Nil(t, err)
+		req := packTestMessage(t)
+		reply, err := ExchangeWire(u, req)
+		if err != nil {
+			t.Fatalf("cannot exchange: %s", err)
+		}
+		m := &dns.Msg{}
+		assert.Nil(t, m.Unpack(reply))
+		assert.Equal(t, req[:2], reply[:2])
+		assert.Len(t, m.Answer, 2)
+	}
+
+	// The upstreams that don't implement WireExchanger as well
+	u := NewStaticUpstream(func(m *dns.Msg) (*dns.Msg, error) {
+		return new(dns.Msg).SetReply(m), nil
+	})
+	req := packTestMessage(t)
+	reply, err := ExchangeWire(u, req)
+	assert.Nil(t, err)
+	assert.Equal(t, req[:2], reply[:2])
+
+	_, err = ExchangeWire(u, []byte{1, 2, 3})
+	assert.NotNil(t, err)
+}
+
+func TestExchangeWireVerify(t *testing.T) {
+	stub := &wireStub{}
+	srv, err := dnsproxytest.NewPlainServer(stub.handle)
+	if err != nil {
+		t.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+	udp, err := AddressToUpstream(srv.URL, Options{Timeout: 200 * time.Millisecond})
+	assert.Nil(t, err)
+	tcp, err := AddressToUpstream("tcp://"+srv.Addr, Options{Timeout: timeout})
+	assert.Nil(t, err)
+
+	// The ID and the question must match, the case of the name may differ.
+	// The mismatched UDP responses are ignored until the timeout.
+	for _, modify := range []func(resp *dns.Msg){
+		func(resp *dns.Msg) { resp.Id++ },
+		func(resp *dns.Msg) { resp.Question[0].Qtype = dns.TypeAAAA },
+		func(resp *dns.Msg) { resp.Question[0].Name = "wire.example.net." },
+	} {
+		stub.setModify(modify)
+		_, err = ExchangeWire(udp, packTestMessage(t))
+		if assert.NotNil(t, err) {
+			netErr, ok := err.(net.Error)
+			assert.True(t, ok && netErr.Timeout(), err.Error())
+		}
+		_, err = ExchangeWire(tcp, packTestMessage(t))
+		assert.NotNil(t, err)
+	}
+	stub.setModify(func(resp *dns.Msg) { resp.Id++ })
+	_, err = ExchangeWire(tcp, packTestMessage(t))
+	assert.Equal(t, dns.ErrId, err)
+	stub.setModify(func(resp *dns.Msg) { resp.Question[0].Qtype = dns.TypeAAAA })
+	_, err = ExchangeWire(tcp, packTestMessage(t))
+	assert.Equal(t, ErrQuestion, err)
+
+	stub.setModify(func(resp *dns.Msg) { resp.Question[0].Name = "wire.example.org." })
+	for _, u := range []Upstream{udp, tcp} {
+		_, err = ExchangeWire(u, packTestMessage(t))
+		assert.Nil(t, err)
+	}
+
+	// The malformed queries aren't sent
+	_, err = ExchangeWire(udp, packTestMessage(t)[:20])
+	assert.NotNil(t, err)
+}
+
+func TestExchangeWireStray(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	// The server sends the stray responses before the right one
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := new(dns.Msg).SetReply(r)
+			resp.Id++
+			_ = w.WriteMsg(resp)
+
+			resp = new(dns.Msg).SetReply(r)
+			resp.Question[0].Name = "stray.example."
+			_ = w.WriteMsg(resp)
+
+			resp = new(dns.Msg).SetReply(r)
+			resp.Answer = []dns.RR{newTestRR("%s 60 IN A 192.0.2.1", r.Question[0].Name)}
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer srv.Shutdown()
+
+	u, err := AddressToUpstream(conn.LocalAddr().String(), Options{Timeout: timeout})
+	assert.Nil(t, err)
+	reply, err := ExchangeWire(u, packTestMessage(t))
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	m := &dns.Msg{}
+	assert.Nil(t, m.Unpack(reply))
+	assert.Len(t, m.Answer, 1)
+}
+
+func TestExchangeWireTruncated(t *testing.T) {
+	var mu sync.Mutex
+	var udp, tcp int
+	// The handler needs to know the transport, so it's not a dnsproxytest one
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg).SetReply(r)
+		mu.Lock()
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			udp++
+			resp.Truncated = true
+		} else {
+			tcp++
+			resp.Answer = []dns.RR{newTestRR("%s 60 IN A 192.0.2.1", r.Question[0].Name)}
+		}
+		mu.Unlock()
+		_ = w.WriteMsg(resp)
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	tcpSrv := &dns.Server{Listener: l, Handler: handler}
+	go func() { _ = tcpSrv.ActivateAndServe() }()
+	defer tcpSrv.Shutdown()
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	assert.Nil(t, err)
+	udpSrv := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = udpSrv.ActivateAndServe() }()
+	defer udpSrv.Shutdown()
+
+	u, err := AddressToUpstream(l.Addr().String(), Options{Timeout: timeout})
+	assert.Nil(t, err)
+	reply, err := ExchangeWire(u, packTestMessage(t))
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.False(t, isTruncatedWire(reply))
+
+	u, err = AddressToUpstream(l.Addr().String(), Options{Timeout: timeout, DisableTCPFallback: true})
+	assert.Nil(t, err)
+	reply, err = ExchangeWire(u, packTestMessage(t))
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.True(t, isTruncatedWire(reply))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, udp)
+	assert.Equal(t, 1, tcp)
+}
+
+func BenchmarkExchangeWire(b *testing.B) {
+	srv, err := dnsproxytest.NewPlainServer(func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg).SetReply(req)
+		resp.Answer = []dns.RR{newTestRR("%s 60 IN A 192.0.2.1", req.Question[0].Name)}
+		return resp
+	})
+	if err != nil {
+		b.Fatalf("cannot start the server: %s", err)
+	}
+	defer srv.Close()
+
+	u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout})
+	if err != nil {
+		b.Fatalf("cannot create upstream: %s", err)
+	}
+	req, err := createTestMessage().Pack()
+	if err != nil {
+		b.Fatalf("cannot pack the request: %s", err)
+	}
+
+	b.Run("wire", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err = ExchangeWire(u, req)
+			if err != nil {
+				b.Fatalf("cannot exchange: %s", err)
+			}
+		}
+	})
+
+	// The same as relaying with Exchange
+	b.Run("msg", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err = exchangeWireMsg(u.Exchange, req)
+			if err != nil {
+				b.Fatalf("cannot exchange: %s", err)
+			}
+		}
+	})
+}
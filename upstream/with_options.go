@@ -0,0 +1,53 @@
+package upstream
+
+import "errors"
+
+// Cloner is implemented by the upstreams created by this package.  It allows
+// applying the changed options on reload without losing the TLS sessions.
+type Cloner interface {
+	// WithOptions creates a new upstream for the same address with opts.  The
+	// new upstream resumes the TLS sessions of the original one if the
+	// options that affect them haven't changed.  The original upstream isn't
+	// closed.
+	WithOptions(opts *Options) (Upstream, error)
+}
+
+// cloneUpstream creates the upstream for address with opts, the session cache
+// of boot is shared with it if it's safe.  stamp, if not nil, is kept since
+// the address of the upstream created from a stamp is the URL.
+func cloneUpstream(address string, boot *bootstrapper, stamp *StampInfo, opts *Options) (Upstream, error) {
+	if opts == nil {
+		return nil, errors.New("no options specified")
+	}
+
+	o := *opts
+	if boot != nil && canShareSessions(boot.options, o) {
+		o.sessionCache = boot.sessionCache
+	}
+	if boot != nil {
+		o.spkiPins = boot.options.spkiPins
+	}
+
+	u, err := AddressToUpstream(address, o)
+	if err != nil {
+		return nil, err
+	}
+
+	if stamp != nil {
+		setStampInfo(u, stamp)
+	}
+	return u, nil
+}
+
+// canShareSessions checks if the TLS sessions established with the prev
+// options may be resumed with the next ones, i.e. the certificates are
+// verified the same way, the client certificate and the cache size are the
+// same.  The verification callbacks can't be compared, so the sessions aren't
+// shared if there are any.
+func canShareSessions(prev, next Options) bool {
+	return prev.TLSSessionCacheSize == next.TLSSessionCacheSize &&
+		prev.InsecureSkipVerify == next.InsecureSkipVerify &&
+		prev.ClientCert == next.ClientCert &&
+		prev.VerifyServerCertificate == nil &&
+		next.VerifyServerCertificate == nil
+}
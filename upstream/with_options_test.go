@@ -0,0 +1,55 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithOptions(t *testing.T) {
+	srv := startTestDoTServer(t, nil)
+	defer srv.Close()
+
+	u, err := AddressToUpstream(srv.URL, Options{Timeout: timeout, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("cannot create upstream: %s", err)
+	}
+	defer u.(Closer).Close()
+
+	_, err = u.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.False(t, u.(*dnsOverTLS).TLSState().DidResume)
+
+	// Only the timeout is changed, the session is resumed
+	c, err := u.(Cloner).WithOptions(&Options{Timeout: 2 * timeout, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("cannot clone upstream: %s", err)
+	}
+	defer c.(Closer).Close()
+	assert.Equal(t, u.Address(), c.Address())
+
+	_, err = c.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.True(t, c.(*dnsOverTLS).TLSState().DidResume)
+	assert.Equal(t, 2*timeout, c.(*dnsOverTLS).boot.options.Timeout)
+
+	// The cache size is changed, the new upstream starts over
+	c, err = u.(Cloner).WithOptions(&Options{Timeout: timeout, InsecureSkipVerify: true, TLSSessionCacheSize: 16})
+	if err != nil {
+		t.Fatalf("cannot clone upstream: %s", err)
+	}
+	defer c.(Closer).Close()
+
+	_, err = c.Exchange(createTestMessage())
+	if err != nil {
+		t.Fatalf("cannot exchange: %s", err)
+	}
+	assert.False(t, c.(*dnsOverTLS).TLSState().DidResume)
+
+	_, err = u.(Cloner).WithOptions(nil)
+	assert.NotNil(t, err)
+}